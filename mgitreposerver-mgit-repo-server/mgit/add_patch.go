@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// addPatch stages the hunks of the worktree changes to tracked files that
+// the user picks, like `git add -p`. Untracked files are left alone.
+func addPatch(repo *git.Repository, pathspecs []string) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("error getting worktree: %w", err)
+	}
+	status, err := scanStatus(repo, w)
+	if err != nil {
+		return fmt.Errorf("error getting status: %w", err)
+	}
+
+	paths := []string{}
+	for path, fileStatus := range status {
+		if fileStatus.Worktree != git.Modified && fileStatus.Worktree != git.Deleted {
+			continue
+		}
+		if len(pathspecs) == 0 || pathMatches(path, pathspecs, false) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		fmt.Println("No changes.")
+		return nil
+	}
+
+	selector := newHunkSelector("Stage")
+	results := []*applyResult{}
+	for _, path := range paths {
+		staged, err := readApplyTarget(repo, path, true)
+		if err != nil {
+			return err
+		}
+		current, err := readApplyTarget(repo, path, false)
+		if err != nil {
+			return err
+		}
+		if staged == nil {
+			continue
+		}
+
+		header := fmt.Sprintf("diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n", path, path, path, path)
+		var newContent []byte
+		if current == nil {
+			header = fmt.Sprintf("diff --git a/%s b/%s\ndeleted file mode %o\n--- a/%s\n+++ /dev/null\n", path, path, staged.Mode, path)
+		} else {
+			newContent = current.Content
+		}
+		if bytes.IndexByte(staged.Content, 0) >= 0 || bytes.IndexByte(newContent, 0) >= 0 {
+			fmt.Printf("%sBinary files differ; use `mgit add %s` to stage it\n", header, path)
+			continue
+		}
+
+		old := splitLines(string(staged.Content))
+		hunks, err := selector.selectFileHunks(header, old, splitLines(string(newContent)))
+		if err != nil {
+			return err
+		}
+		lines, err := applySelectedHunks(old, hunks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		selected := false
+		for _, hunk := range hunks {
+			selected = selected || hunk.Selected
+		}
+		if !selected {
+			continue
+		}
+		result := &applyResult{Path: path, Content: []byte(strings.Join(lines, "")), Mode: staged.Mode}
+		result.Deleted = current == nil && len(lines) == 0
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+	return writeApplyResults(repo, results, applyOptions{Cached: true})
+}
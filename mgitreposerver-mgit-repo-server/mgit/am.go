@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mgit am applies a series of mailed patches, as send-patch or git
+// format-patch write them, committing each with its author, date and
+// message:
+//
+//	mgit am [--3way] [-s] [-S] [--no-verify] [<mbox>...]
+//	mgit am --continue | --skip | --abort
+//
+// The patches are read from mbox files, or stdin. The MGit-Pubkey trailer
+// send-patch adds becomes the new MGit commit's author pubkey; it and the
+// MGit-Hash trailer are dropped from the message, since the commit gets an
+// MGit hash of its own. A patch that doesn't apply stops the series, kept
+// in .mgit/am-state.json: fix it up and stage it, then --continue, or
+// --skip it, or --abort to go back to where am started.
+
+const amStateFile = "am-state.json"
+
+// amPatch is a mailed patch, ready to apply and commit
+type amPatch struct {
+	Message string `json:"message"`
+	Author  string `json:"author"` // "Name <email>"
+	Date    string `json:"date"`   // as mgit commit --date takes it
+	Pubkey  string `json:"pubkey,omitempty"`
+	Diff    string `json:"diff"`
+}
+
+// amState is a series being applied
+type amState struct {
+	OrigHead   string     `json:"orig_head"` // the Git commit am started on
+	Patches    []*amPatch `json:"patches"`   // still to commit, the current one first
+	Conflicts  []string   `json:"conflicts,omitempty"`
+	ThreeWay   bool       `json:"three_way"`
+	CommitArgs []string   `json:"commit_args,omitempty"`
+}
+
+func amStatePath() string {
+	return filepath.Join(mgitDir(), amStateFile)
+}
+
+// loadAmState returns the am in progress, or nil
+func loadAmState() (*amState, error) {
+	data, err := os.ReadFile(amStatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &amState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %w", amStateFile, err)
+	}
+	return state, nil
+}
+
+func (s *amState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(amStatePath(), data, 0644)
+}
+
+// HandleAm handles the am command
+func HandleAm(args []string) {
+	threeWay, cont, skip, abort := false, false, false, false
+	commitArgs := []string{}
+	inputs := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--continue" || arg == "--resolved":
+			cont = true
+		case arg == "--skip":
+			skip = true
+		case arg == "--abort":
+			abort = true
+		case arg == "--3way" || arg == "-3":
+			threeWay = true
+		case arg == "-S" || arg == "--sign" || arg == "-s" || arg == "--signoff" || arg == "--no-verify":
+			commitArgs = append(commitArgs, arg)
+		case arg == "-":
+			inputs = append(inputs, arg)
+		case strings.HasPrefix(arg, "-"):
+			printAmUsage()
+			os.Exit(1)
+		default:
+			inputs = append(inputs, arg)
+		}
+	}
+
+	var err error
+	switch {
+	case cont && !skip && !abort && len(inputs) == 0:
+		err = continueAm()
+	case skip && !cont && !abort && len(inputs) == 0:
+		err = skipAm()
+	case abort && !cont && !skip && len(inputs) == 0:
+		err = abortAm()
+	case !cont && !skip && !abort:
+		err = startAm(inputs, threeWay, commitArgs)
+	default:
+		printAmUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printAmUsage() {
+	fmt.Println("Usage: mgit am [--3way] [-s] [-S] [--no-verify] [<mbox>...]")
+	fmt.Println("       mgit am --continue | --skip | --abort")
+}
+
+// startAm reads the series and applies it
+func startAm(inputs []string, threeWay bool, commitArgs []string) error {
+	if state, err := loadAmState(); err != nil || state != nil {
+		return fmt.Errorf("an am is in progress; run mgit am --continue, --skip or --abort")
+	}
+	if state, err := loadRebaseState(); err != nil || state != nil {
+		return fmt.Errorf("a rebase is in progress; run mgit rebase --continue or --abort")
+	}
+	if merge, err := loadPendingMerge(); err != nil || merge != nil {
+		return fmt.Errorf("a merge is in progress; commit the result or run mgit merge --abort")
+	}
+	if revert, err := loadPendingRevert(); err != nil || revert != nil {
+		return fmt.Errorf("a revert is in progress; run mgit revert --continue or --abort")
+	}
+	if pick, err := loadPendingCherryPick(); err != nil || pick != nil {
+		return fmt.Errorf("a cherry-pick is in progress; run mgit cherry-pick --continue or --abort")
+	}
+
+	if len(inputs) == 0 {
+		inputs = append(inputs, "-")
+	}
+	patches := []*amPatch{}
+	for _, input := range inputs {
+		text, err := readPatchInput(input)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", input, err)
+		}
+		for _, raw := range splitMailbox(text) {
+			patch, err := parseMailPatch(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", input, err)
+			}
+			patches = append(patches, patch)
+		}
+	}
+	if len(patches) == 0 {
+		return fmt.Errorf("no patches found")
+	}
+
+	// Each patch is committed from the index, so it must be clean
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("error getting HEAD: %w", err)
+	}
+	if staged, err := hasStagedChanges(repo); err != nil {
+		return fmt.Errorf("error getting status: %w", err)
+	} else if staged {
+		return fmt.Errorf("you have staged changes; commit or unstage them before running am")
+	}
+	// Like git, ORIG_HEAD lets the whole series be dropped with a reset
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("ORIG_HEAD", head.Hash())); err != nil {
+		return fmt.Errorf("error writing ORIG_HEAD: %w", err)
+	}
+
+	state := &amState{
+		OrigHead:   head.Hash().String(),
+		Patches:    patches,
+		ThreeWay:   threeWay,
+		CommitArgs: commitArgs,
+	}
+	runAm(repo, state)
+	return nil
+}
+
+// runAm applies and commits the patches left in state, stopping when one
+// doesn't apply
+func runAm(repo *git.Repository, state *amState) {
+	for len(state.Patches) > 0 {
+		patch := state.Patches[0]
+		subject, _, _ := strings.Cut(patch.Message, "\n")
+		fmt.Printf("Applying: %s\n", subject)
+
+		files, err := parsePatch(patch.Diff, 1)
+		if err == nil && len(files) == 0 {
+			err = fmt.Errorf("the patch has no diff")
+		}
+		var results []*applyResult
+		if err == nil {
+			opts := applyOptions{Index: true, ThreeWay: state.ThreeWay, Strip: 1}
+			if results, err = applyPatches(repo, files, opts); err == nil {
+				err = writeApplyResults(repo, results, opts)
+			}
+		}
+		if err != nil {
+			stopAm(state, fmt.Sprintf("Error applying patch: %s\n"+
+				"Patch failed at %s\n"+
+				"Apply it by hand and stage the result with mgit add, then run mgit am --continue.\n"+
+				"To leave it out, run mgit am --skip. To go back to where you were, run mgit am --abort.",
+				err, subject))
+		}
+		for _, result := range results {
+			if result.Conflicts > 0 {
+				fmt.Printf("Applied patch to '%s' with conflicts.\n", result.Path)
+				state.Conflicts = append(state.Conflicts, result.Path)
+			}
+		}
+		if len(state.Conflicts) > 0 {
+			stopAm(state, fmt.Sprintf("Patch failed at %s\n"+
+				"Resolve all conflicts, stage them with mgit add, then run mgit am --continue.\n"+
+				"To leave it out, run mgit am --skip. To go back to where you were, run mgit am --abort.", subject))
+		}
+		commitAmPatch(repo, state)
+	}
+	os.Remove(amStatePath())
+}
+
+// commitAmPatch commits what is staged as the current patch. The state is
+// saved first, since a failed commit exits.
+func commitAmPatch(repo *git.Repository, state *amState) {
+	if err := state.save(); err != nil {
+		fmt.Printf("Error saving am state: %s\n", err)
+		os.Exit(1)
+	}
+	patch := state.Patches[0]
+	if staged, err := hasStagedChanges(repo); err == nil && !staged {
+		stopAm(state, "No changes staged for this patch; if it is already applied, run mgit am --skip.")
+	}
+
+	args := append([]string{}, state.CommitArgs...)
+	args = append(args, "-m", patch.Message, "--author", patch.Author)
+	if patch.Date != "" {
+		args = append(args, "--date", patch.Date)
+	}
+	if patch.Pubkey != "" {
+		args = append(args, "--pubkey", patch.Pubkey)
+	}
+	HandleMGitCommit(args)
+
+	state.Patches = state.Patches[1:]
+	state.Conflicts = nil
+	if err := state.save(); err != nil {
+		fmt.Printf("Error saving am state: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// stopAm saves the series for --continue, --skip or --abort and exits
+func stopAm(state *amState, message string) {
+	if err := state.save(); err != nil {
+		fmt.Printf("Error saving am state: %s\n", err)
+	}
+	fmt.Println(message)
+	os.Exit(1)
+}
+
+// continueAm commits the current patch once it is applied and staged by
+// hand, and applies the rest
+func continueAm() error {
+	state, err := loadAmState()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no am in progress")
+	}
+	repo := getRepo()
+	unresolved, err := (&pendingMerge{Conflicts: state.Conflicts}).Unresolved(repo)
+	if err != nil {
+		return err
+	}
+	if len(unresolved) > 0 {
+		return fmt.Errorf("resolve the conflicts in these files and stage them first:\n  %s", strings.Join(unresolved, "\n  "))
+	}
+	commitAmPatch(repo, state)
+	runAm(repo, state)
+	return nil
+}
+
+// skipAm drops what the current patch staged and applies the rest
+func skipAm() error {
+	state, err := loadAmState()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no am in progress")
+	}
+	repo := getRepo()
+	if err := restoreHead(repo, state.Conflicts); err != nil {
+		return err
+	}
+	if len(state.Patches) > 0 {
+		state.Patches = state.Patches[1:]
+	}
+	state.Conflicts = nil
+	runAm(repo, state)
+	return nil
+}
+
+// abortAm drops the patch in progress and the ones already committed,
+// going back to where am started
+func abortAm() error {
+	state, err := loadAmState()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no am in progress")
+	}
+	repo := getRepo()
+	if err := restoreHead(repo, state.Conflicts); err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	origHead := plumbing.NewHash(state.OrigHead)
+	if head.Hash() != origHead {
+		if err := switchWorktree(repo, head.Hash(), origHead); err != nil {
+			return err
+		}
+		setReflogMessage("abort")
+		if err := setResetHead(repo, NewMGitStorage(), head, origHead); err != nil {
+			return err
+		}
+	}
+	return os.Remove(amStatePath())
+}
+
+// mboxFromLine matches the "From " line that starts each message of an
+// mbox, and mboxHeaderLine the header lines after it
+var (
+	mboxFromLine   = regexp.MustCompile(`^From \S+ `)
+	mboxHeaderLine = regexp.MustCompile(`^[A-Za-z0-9-]+:`)
+)
+
+// splitMailbox splits an mbox into its messages, unescaping the mboxrd way
+// the ">From " lines send-patch escapes. Text that isn't an mbox is one
+// message, so a single mailed patch saved as a file can be applied too.
+func splitMailbox(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	messages := []string{}
+	var current *strings.Builder
+	for i, line := range lines {
+		if mboxFromLine.MatchString(line) && (i == 0 || strings.TrimSpace(lines[i-1]) == "") &&
+			i+1 < len(lines) && mboxHeaderLine.MatchString(lines[i+1]) {
+			if current != nil {
+				messages = append(messages, current.String())
+			}
+			current = &strings.Builder{}
+			continue
+		}
+		if current == nil {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			current = &strings.Builder{}
+		}
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") && strings.HasPrefix(line, ">") {
+			line = line[1:]
+		}
+		current.WriteString(line)
+	}
+	if current != nil {
+		messages = append(messages, current.String())
+	}
+	return messages
+}
+
+// patchSubjectPrefix matches the "[PATCH n/m]" and "Re:" prefixes a
+// subject picks up on the way
+var patchSubjectPrefix = regexp.MustCompile(`^\s*(\[[^\]]*\]|[Rr][Ee]:)\s*`)
+
+// parseMailPatch reads the author, date, message and diff of a mailed
+// patch
+func parseMailPatch(raw string) (*amPatch, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error reading mail: %w", err)
+	}
+	decoder := &mime.WordDecoder{}
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, fmt.Errorf("bad subject: %w", err)
+	}
+	for {
+		trimmed := patchSubjectPrefix.ReplaceAllString(subject, "")
+		if trimmed == subject {
+			break
+		}
+		subject = trimmed
+	}
+	subject = strings.TrimSpace(subject)
+
+	mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("%q: multipart mail is not supported; send the patch inline", subject)
+	}
+	var decoded io.Reader = msg.Body
+	switch strings.ToLower(msg.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		decoded = quotedprintable.NewReader(decoded)
+	case "base64":
+		decoded = base64.NewDecoder(base64.StdEncoding, decoded)
+	}
+	content, err := io.ReadAll(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("%q: error decoding mail: %w", subject, err)
+	}
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+
+	author := msg.Header.Get("From")
+	// An in-body From line names the author when someone else sent it
+	if strings.HasPrefix(text, "From: ") {
+		line, rest, _ := strings.Cut(text, "\n")
+		author = strings.TrimPrefix(line, "From: ")
+		text = strings.TrimLeft(rest, "\n")
+	}
+	address, err := mail.ParseAddress(author)
+	if err != nil {
+		return nil, fmt.Errorf("%q: bad author %q: %w", subject, author, err)
+	}
+	patch := &amPatch{Author: fmt.Sprintf("%s <%s>", address.Name, address.Address)}
+	if address.Name == "" {
+		patch.Author = fmt.Sprintf("%s <%s>", address.Address, address.Address)
+	}
+	if when, err := msg.Header.Date(); err == nil {
+		patch.Date = fmt.Sprintf("%d %s", when.Unix(), when.Format("-0700"))
+	}
+
+	// The message ends at the "---" line before the diff, or at the diff
+	// itself when there is no such line
+	lines := strings.SplitAfter(text, "\n")
+	end := len(lines)
+	for i, line := range lines {
+		if strings.TrimRight(line, "\n") == "---" || strings.HasPrefix(line, "diff --git ") {
+			end = i
+			break
+		}
+	}
+	body := strings.TrimSpace(strings.Join(lines[:end], ""))
+	if end < len(lines) {
+		patch.Diff = strings.Join(lines[end:], "")
+	}
+
+	// The MGit trailers describe the sender's commit, not the one made here.
+	// The subject is put back for the trailers to follow a paragraph.
+	trailers, rest := trailerBlock(subject + "\n\n" + body)
+	if len(trailers) > 0 {
+		_, body, _ = strings.Cut(rest, "\n\n")
+		for _, t := range trailers {
+			switch {
+			case strings.EqualFold(t.Key, "MGit-Pubkey"):
+				patch.Pubkey = t.Value
+			case strings.EqualFold(t.Key, "MGit-Hash"):
+			default:
+				body = addTrailer(body, t.Key, t.Value)
+			}
+		}
+	}
+
+	patch.Message = subject
+	if body = strings.TrimSpace(body); body != "" {
+		patch.Message += "\n\n" + body
+	}
+	return patch, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// mgit commit --amend replaces the tip commit of the branch instead of
+// adding one. Amending with plain git would leave the MGit commit of the
+// old tip as the branch's MGit ref and its mapping pointing nowhere, so the
+// new commit gets its own MGit hash from the amended commit's parents, the
+// old mapping is marked superseded by it, and the MGit ref and reflog move
+// with the Git branch. Like git, the amended commit keeps its author,
+// pubkey and message unless new ones are given.
+
+// amendTarget returns the commit an amend replaces, HEAD's
+func amendTarget(repo *git.Repository) (*object.Commit, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("nothing to amend: %w", err)
+	}
+	return repo.CommitObject(head.Hash())
+}
+
+// dropParents rewrites a commit HEAD points at without its parents,
+// pointing HEAD at the rewritten commit. An amended root commit needs it,
+// as go-git gives a commit without parents HEAD's.
+func dropParents(repo *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	commit.ParentHashes = nil
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	rewritten, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return rewritten, pointHead(repo, rewritten)
+}
+
+// pointHead points HEAD, or the branch it is on, at a commit
+func pointHead(repo *git.Repository, hash plumbing.Hash) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	name := plumbing.HEAD
+	if head.Type() == plumbing.SymbolicReference {
+		name = head.Target()
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(name, hash))
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Commits made before a repository used MGit have no mappings, so no
+// pubkeys. Rewriting them to add some would change every hash, so instead
+// their authors claim them: mgit annotate-history reads a file mapping
+// author emails to npubs, one per line as in a mailmap,
+//
+//	# comments and blank lines are skipped
+//	Jane Doe <jane@example.com> npub1...
+//	<jdoe@old-host.example> npub1...
+//
+// walks the history, and signs an in-toto statement whose subjects are the
+// unmapped commits written under the signer's emails. Each author runs it
+// with their own key. The claims are kept in .mgit/claims, one file per
+// npub that grows as more commits are claimed, and are checked by
+// mgit annotate-history --verify, which needs only the Git history.
+
+const (
+	historyClaimType      = "https://github.com/imyjimmy/mgit/history-claim/v1"
+	historyClaimExtension = ".intoto.jsonl"
+)
+
+type historyClaimStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     historyClaim    `json:"predicate"`
+}
+
+// historyClaim is the predicate: who claims the subject commits, and the
+// emails they wrote them under
+type historyClaim struct {
+	Claimant  string   `json:"claimant"`
+	Emails    []string `json:"emails"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// claimsDir is where an MGit store keeps history claims
+func claimsDir(storage *MGitStorage) string {
+	return filepath.Join(storage.RootDir, "claims")
+}
+
+// HandleAnnotateHistory handles the annotate-history command
+func HandleAnnotateHistory(args []string) {
+	usage := "Usage: mgit annotate-history [-n] <email-map> [<revision>]\n" +
+		"       mgit annotate-history --verify [<claim>...]"
+	if len(args) > 0 && args[0] == "--verify" {
+		if !verifyHistoryClaims(args[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	dryRun := false
+	positional := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "-n" || arg == "--dry-run":
+			dryRun = true
+		case strings.HasPrefix(arg, "-"):
+			fmt.Println(usage)
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	rev := "HEAD"
+	if len(positional) == 2 {
+		rev = positional[1]
+	}
+
+	emails, err := loadEmailMap(positional[0])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	repo := getRepo()
+	storage := NewMGitStorage()
+	start, err := resolveGitRevision(repo, rev)
+	if err != nil {
+		fmt.Printf("Error: %s: %s\n", rev, err)
+		os.Exit(1)
+	}
+	byPubkey, unknown, err := unmappedCommitsByAuthor(repo, storage, start, emails)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if dryRun {
+		pubkeys := make([]string, 0, len(byPubkey))
+		for pubkey := range byPubkey {
+			pubkeys = append(pubkeys, pubkey)
+		}
+		sort.Strings(pubkeys)
+		for _, pubkey := range pubkeys {
+			fmt.Printf("%s would claim %d commits\n", pubkey, len(byPubkey[pubkey]))
+		}
+		if unknown > 0 {
+			fmt.Printf("%d commits have authors not in %s\n", unknown, positional[0])
+		}
+		return
+	}
+
+	signer, err := newSigner()
+	if err != nil {
+		fmt.Printf("Error opening signer: %s\n", err)
+		os.Exit(1)
+	}
+	defer signer.Close()
+	key, err := signer.PublicKey()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	claimant := encodeNpub(key)
+
+	claimEmails := []string{}
+	for email, pubkey := range emails {
+		if pubkey == claimant {
+			claimEmails = append(claimEmails, email)
+		}
+	}
+	if len(claimEmails) == 0 {
+		fmt.Printf("Error: the signer's key %s has no emails in %s\n", claimant, positional[0])
+		os.Exit(1)
+	}
+
+	added, total, err := addHistoryClaim(storage, signer, claimant, claimEmails, byPubkey[claimant])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if added == 0 {
+		fmt.Printf("No new commits to claim for %s (%d claimed)\n", claimant, total)
+		return
+	}
+	fmt.Printf("Claimed %d commits as %s (%d in total) in %s\n", added, claimant, total,
+		filepath.Join(claimsDir(storage), claimant+historyClaimExtension))
+}
+
+// loadEmailMap reads an email to npub map, keyed by lowercased email
+func loadEmailMap(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	emails := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		npub := fields[len(fields)-1]
+		pubkey, err := decodeNostrKey(npub, "npub")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, lineNo, npub, err)
+		}
+		email := fields[0]
+		if open := strings.LastIndex(line, "<"); open >= 0 {
+			if end := strings.Index(line[open:], ">"); end > 0 {
+				email = line[open+1 : open+end]
+			}
+		}
+		if len(fields) < 2 || !strings.Contains(email, "@") {
+			return nil, fmt.Errorf("%s:%d: expected an email and an npub", path, lineNo)
+		}
+		emails[strings.ToLower(email)] = encodeNpub(pubkey)
+	}
+	return emails, scanner.Err()
+}
+
+// unmappedCommitsByAuthor walks the history from start and groups the Git
+// hashes of commits without an MGit mapping by their author's npub. It
+// also counts those whose author isn't in the map.
+func unmappedCommitsByAuthor(repo *git.Repository, storage *MGitStorage, start plumbing.Hash, emails map[string]string) (map[string][]string, int, error) {
+	mappings, err := storage.GetMappings()
+	if err != nil {
+		return nil, 0, err
+	}
+	mapped := map[string]bool{}
+	for _, mapping := range mappings {
+		mapped[mapping.GitHash] = true
+	}
+
+	iter, err := repo.Log(&git.LogOptions{From: start})
+	if err != nil {
+		return nil, 0, err
+	}
+	byPubkey := map[string][]string{}
+	unknown := 0
+	err = iter.ForEach(func(commit *object.Commit) error {
+		if mapped[commit.Hash.String()] {
+			return nil
+		}
+		pubkey, ok := emails[strings.ToLower(commit.Author.Email)]
+		if !ok {
+			unknown++
+			return nil
+		}
+		byPubkey[pubkey] = append(byPubkey[pubkey], commit.Hash.String())
+		return nil
+	})
+	return byPubkey, unknown, err
+}
+
+// addHistoryClaim adds commits to claimant's claim, re-signing it with
+// the union of the old and new commits and emails. It returns how many
+// commits were new and how many the claim now has.
+func addHistoryClaim(storage *MGitStorage, signer Signer, claimant string, emails, commits []string) (int, int, error) {
+	path := filepath.Join(claimsDir(storage), claimant+historyClaimExtension)
+	claimed := map[string]bool{}
+	emailSet := map[string]bool{}
+	for _, email := range emails {
+		emailSet[email] = true
+	}
+	if _, err := os.Stat(path); err == nil {
+		old, signers, err := readHistoryClaim(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		if old.Predicate.Claimant != claimant || !containsString(signers, claimant) {
+			return 0, 0, fmt.Errorf("%s is not a claim signed by %s", path, claimant)
+		}
+		for _, subject := range old.Subject {
+			claimed[subject.Digest["gitCommit"]] = true
+		}
+		for _, email := range old.Predicate.Emails {
+			emailSet[email] = true
+		}
+	}
+
+	added := 0
+	for _, commit := range commits {
+		if !claimed[commit] {
+			claimed[commit] = true
+			added++
+		}
+	}
+	if added == 0 {
+		return 0, len(claimed), nil
+	}
+
+	statement := historyClaimStatement{
+		Type:          inTotoStatementType,
+		PredicateType: historyClaimType,
+		Predicate:     historyClaim{Claimant: claimant, CreatedAt: time.Now().UTC().Format(time.RFC3339)},
+	}
+	for commit := range claimed {
+		statement.Subject = append(statement.Subject, inTotoSubject{
+			Name:   commit,
+			Digest: map[string]string{"gitCommit": commit},
+		})
+	}
+	sort.Slice(statement.Subject, func(i, j int) bool { return statement.Subject[i].Name < statement.Subject[j].Name })
+	for email := range emailSet {
+		statement.Predicate.Emails = append(statement.Predicate.Emails, email)
+	}
+	sort.Strings(statement.Predicate.Emails)
+
+	envelope, err := signStatement(signer, &statement)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error signing claim: %w", err)
+	}
+	data, err := nostrJSON(envelope)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, 0, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return 0, 0, fmt.Errorf("error writing claim: %w", err)
+	}
+	return added, len(claimed), nil
+}
+
+// readHistoryClaim reads a claim file, checking its signatures
+func readHistoryClaim(path string) (*historyClaimStatement, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a DSSE envelope: %w", path, err)
+	}
+	payload, signers, err := openEnvelope(&envelope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var statement historyClaimStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, nil, fmt.Errorf("%s: malformed statement: %w", path, err)
+	}
+	if statement.Type != inTotoStatementType || statement.PredicateType != historyClaimType {
+		return nil, nil, fmt.Errorf("%s is not an MGit history claim", path)
+	}
+	return &statement, signers, nil
+}
+
+// verifyHistoryClaims checks claim files, or every claim in .mgit/claims:
+// each must be signed by its claimant, and each commit it claims must be
+// in the history and written under one of the claimed emails
+func verifyHistoryClaims(paths []string) bool {
+	repo := getRepo()
+	if len(paths) == 0 {
+		paths, _ = filepath.Glob(filepath.Join(claimsDir(NewMGitStorage()), "*"+historyClaimExtension))
+		if len(paths) == 0 {
+			fmt.Println("No history claims")
+			return true
+		}
+	}
+
+	valid := true
+	for _, path := range paths {
+		statement, signers, err := readHistoryClaim(path)
+		if err != nil {
+			fmt.Printf("Claim verification failed: %s\n", err)
+			valid = false
+			continue
+		}
+		claimant := statement.Predicate.Claimant
+		if !containsString(signers, claimant) {
+			fmt.Printf("Claim verification failed: %s is not signed by its claimant %s\n", path, claimant)
+			valid = false
+			continue
+		}
+
+		emails := map[string]bool{}
+		for _, email := range statement.Predicate.Emails {
+			emails[strings.ToLower(email)] = true
+		}
+		failed := 0
+		for _, subject := range statement.Subject {
+			gitHash := subject.Digest["gitCommit"]
+			commit, err := repo.CommitObject(plumbing.NewHash(gitHash))
+			switch {
+			case err != nil:
+				fmt.Printf("  %s: not in this repository\n", shortHash(gitHash))
+				failed++
+			case !emails[strings.ToLower(commit.Author.Email)]:
+				fmt.Printf("  %s: written by %s, not under a claimed email\n", shortHash(gitHash), commit.Author.Email)
+				failed++
+			}
+		}
+		if failed > 0 {
+			fmt.Printf("Claim by %s: %d of %d commits failed\n", claimant, failed, len(statement.Subject))
+			valid = false
+		} else {
+			fmt.Printf("Claim by %s: %d commits verified\n", claimant, len(statement.Subject))
+		}
+	}
+	return valid
+}
+
+// historyClaimants returns, for each claimed Git hash, the npubs whose
+// claims in .mgit/claims include it. Claims that don't verify are skipped.
+func historyClaimants(storage *MGitStorage) map[string][]string {
+	claimants := map[string][]string{}
+	paths, _ := filepath.Glob(filepath.Join(claimsDir(storage), "*"+historyClaimExtension))
+	for _, path := range paths {
+		statement, signers, err := readHistoryClaim(path)
+		if err != nil || !containsString(signers, statement.Predicate.Claimant) {
+			continue
+		}
+		for _, subject := range statement.Subject {
+			gitHash := subject.Digest["gitCommit"]
+			claimants[gitHash] = append(claimants[gitHash], statement.Predicate.Claimant)
+		}
+	}
+	return claimants
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// applyOptions are the flags of the apply command
+type applyOptions struct {
+	Cached   bool // apply to the index only
+	Index    bool // apply to both the worktree and the index
+	ThreeWay bool
+	Check    bool
+	Reverse  bool
+	Strip    int
+}
+
+// applyResult is the new state of one path after applying a patch
+type applyResult struct {
+	Path      string
+	Content   []byte
+	Mode      filemode.FileMode
+	Deleted   bool
+	Conflicts int
+}
+
+// HandleApply handles the apply command. It reads unified diffs from the
+// given files, or stdin, and applies them to the worktree, the index or
+// both, without the git binary. Either every file applies or nothing is
+// changed, except that --3way leaves conflict markers in files it couldn't
+// merge cleanly.
+func HandleApply(args []string) {
+	opts := applyOptions{Strip: 1}
+	inputs := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--cached":
+			opts.Cached = true
+		case arg == "--index":
+			opts.Index = true
+		case arg == "--3way" || arg == "-3":
+			opts.ThreeWay = true
+		case arg == "--check":
+			opts.Check = true
+		case arg == "-R" || arg == "--reverse":
+			opts.Reverse = true
+		case strings.HasPrefix(arg, "-p") && len(arg) > 2:
+			n, err := strconv.Atoi(arg[2:])
+			if err != nil || n < 0 {
+				fmt.Printf("Error: invalid strip count %s\n", arg[2:])
+				os.Exit(1)
+			}
+			opts.Strip = n
+		case arg == "-":
+			inputs = append(inputs, arg)
+		case strings.HasPrefix(arg, "-"):
+			fmt.Println("Usage: mgit apply [--cached | --index] [--3way] [--check] [-R] [-p<n>] [<patch>...]")
+			os.Exit(1)
+		default:
+			inputs = append(inputs, arg)
+		}
+	}
+	if opts.Cached && opts.Index {
+		fmt.Println("Error: --cached and --index are mutually exclusive")
+		os.Exit(1)
+	}
+	// Like git, a three-way apply records its result in the index
+	if opts.ThreeWay && !opts.Cached {
+		opts.Index = true
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, "-")
+	}
+
+	files := []*patchFile{}
+	for _, input := range inputs {
+		text, err := readPatchInput(input)
+		if err != nil {
+			fmt.Printf("Error reading patch %s: %s\n", input, err)
+			os.Exit(1)
+		}
+		parsed, err := parsePatch(text, opts.Strip)
+		if err != nil {
+			fmt.Printf("Error reading patch %s: %s\n", input, err)
+			os.Exit(1)
+		}
+		files = append(files, parsed...)
+	}
+	if len(files) == 0 {
+		fmt.Println("Error: No valid patches in input")
+		os.Exit(1)
+	}
+
+	var repo *git.Repository
+	if opts.Cached || opts.Index {
+		repo = getRepo()
+	} else if r, err := openRepo(); err == nil {
+		// Optional: only --3way needs the object store here
+		repo = r
+	}
+
+	results, err := applyPatches(repo, files, opts)
+	if err != nil {
+		fmt.Printf("Error applying patch: %s\n", err)
+		os.Exit(1)
+	}
+	if opts.Check {
+		return
+	}
+
+	if err := writeApplyResults(repo, results, opts); err != nil {
+		fmt.Printf("Error applying patch: %s\n", err)
+		os.Exit(1)
+	}
+
+	conflicted := false
+	for _, result := range results {
+		if result.Conflicts > 0 {
+			fmt.Printf("Applied patch to '%s' with conflicts.\n", result.Path)
+			conflicted = true
+		}
+	}
+	if conflicted {
+		os.Exit(1)
+	}
+}
+
+func readPatchInput(input string) (string, error) {
+	var data []byte
+	var err error
+	if input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(input)
+	}
+	return string(data), err
+}
+
+// applyPatches computes the result of applying every file diff, without
+// touching the worktree or index. Later diffs of the same path see the
+// results of earlier ones, so a series of patches can be applied at once.
+func applyPatches(repo *git.Repository, files []*patchFile, opts applyOptions) ([]*applyResult, error) {
+	results := []*applyResult{}
+	pending := map[string]*applyResult{}
+
+	current := func(p string) (*applyResult, error) {
+		if result, ok := pending[p]; ok {
+			if result.Deleted {
+				return nil, nil
+			}
+			return result, nil
+		}
+		return readApplyTarget(repo, p, opts.Cached)
+	}
+	record := func(result *applyResult) {
+		if existing, ok := pending[result.Path]; ok {
+			*existing = *result
+			return
+		}
+		pending[result.Path] = result
+		results = append(results, result)
+	}
+
+	for _, file := range files {
+		if opts.Reverse {
+			file.reverse()
+		}
+		name := file.NewPath
+		if name == "" {
+			name = file.OldPath
+		}
+		if file.Binary {
+			return nil, fmt.Errorf("%s: binary patches are not supported", name)
+		}
+		for _, p := range []string{file.OldPath, file.NewPath} {
+			if p != "" && !validPatchPath(p) {
+				return nil, fmt.Errorf("invalid path '%s'", p)
+			}
+		}
+
+		var preimage *applyResult
+		if !file.IsNew {
+			var err error
+			if preimage, err = current(file.OldPath); err != nil {
+				return nil, err
+			}
+			if preimage == nil {
+				return nil, fmt.Errorf("%s: does not exist in %s", file.OldPath, applyTargetName(opts))
+			}
+		} else if existing, err := current(file.NewPath); err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, fmt.Errorf("%s: already exists in %s", file.NewPath, applyTargetName(opts))
+		}
+		if (file.IsRename || file.IsCopy) && !file.IsDelete {
+			if existing, err := current(file.NewPath); err != nil {
+				return nil, err
+			} else if existing != nil {
+				return nil, fmt.Errorf("%s: already exists in %s", file.NewPath, applyTargetName(opts))
+			}
+		}
+
+		var oldLines []string
+		mode := filemode.Regular
+		if preimage != nil {
+			oldLines = splitLines(string(preimage.Content))
+			mode = preimage.Mode
+		}
+
+		newLines, err := applyHunks(oldLines, file.Hunks)
+		conflicts := 0
+		if err != nil {
+			if !opts.ThreeWay {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			newLines, conflicts, err = applyThreeWay(repo, file, oldLines)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if conflicts > 0 && opts.Cached {
+				return nil, fmt.Errorf("%s: patch does not apply cleanly and --cached can't record conflicts", name)
+			}
+		}
+
+		if file.NewMode != "" {
+			if mode, err = filemode.New(file.NewMode); err != nil {
+				return nil, fmt.Errorf("%s: invalid mode %s", name, file.NewMode)
+			}
+		}
+
+		if file.IsDelete {
+			if len(newLines) > 0 {
+				return nil, fmt.Errorf("%s: removal patch leaves file contents", file.OldPath)
+			}
+			record(&applyResult{Path: file.OldPath, Deleted: true})
+			continue
+		}
+
+		record(&applyResult{
+			Path:      file.NewPath,
+			Content:   []byte(strings.Join(newLines, "")),
+			Mode:      mode,
+			Conflicts: conflicts,
+		})
+		if file.IsRename && file.OldPath != file.NewPath {
+			record(&applyResult{Path: file.OldPath, Deleted: true})
+		}
+	}
+
+	return results, nil
+}
+
+// applyThreeWay falls back to a three-way merge when a patch doesn't apply:
+// the patch is applied to the blob it was made against, named by its
+// "index" line, and the result merged with the current content
+func applyThreeWay(repo *git.Repository, file *patchFile, ours []string) ([]string, int, error) {
+	if repo == nil || file.OldHash == "" {
+		return nil, 0, fmt.Errorf("patch does not apply and has no blob to fall back on for a 3-way merge")
+	}
+	blob, err := findBlob(repo, file.OldHash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository lacks the necessary blob (%s) to perform 3-way merge", file.OldHash)
+	}
+	content, err := readBlob(blob)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	base := splitLines(string(content))
+	theirs, err := applyHunks(base, file.Hunks)
+	if err != nil {
+		return nil, 0, fmt.Errorf("patch does not apply to its own preimage %s", file.OldHash)
+	}
+
+	merged, conflicts := merge3Lines(base, ours, theirs, mergeLabels{Ours: "ours", Theirs: "theirs"})
+	return merged, conflicts, nil
+}
+
+// findBlob looks up a blob by a full or abbreviated hash
+func findBlob(repo *git.Repository, prefix string) (*object.Blob, error) {
+	if len(prefix) == 40 && plumbing.IsHash(prefix) {
+		return repo.BlobObject(plumbing.NewHash(prefix))
+	}
+
+	blobs, err := repo.BlobObjects()
+	if err != nil {
+		return nil, err
+	}
+	defer blobs.Close()
+
+	var found *object.Blob
+	err = blobs.ForEach(func(blob *object.Blob) error {
+		if strings.HasPrefix(blob.Hash.String(), prefix) {
+			if found != nil && found.Hash != blob.Hash {
+				return fmt.Errorf("short hash %s is ambiguous", prefix)
+			}
+			found = blob
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return found, nil
+}
+
+func readBlob(blob *object.Blob) ([]byte, error) {
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// readApplyTarget reads the current content of a path from the worktree,
+// or from the index with cached. It returns nil if the path doesn't exist.
+func readApplyTarget(repo *git.Repository, p string, cached bool) (*applyResult, error) {
+	if cached {
+		idx, err := repo.Storer.Index()
+		if err != nil {
+			return nil, fmt.Errorf("error reading index: %w", err)
+		}
+		entry, err := idx.Entry(p)
+		if err == index.ErrEntryNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blob, err := repo.BlobObject(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		content, err := readBlob(blob)
+		if err != nil {
+			return nil, err
+		}
+		return &applyResult{Path: p, Content: content, Mode: entry.Mode}, nil
+	}
+
+	fullPath := filepath.Join(repoRoot(), filepath.FromSlash(p))
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := filemode.NewFromOSFileMode(info.Mode())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	var content []byte
+	if mode == filemode.Symlink {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(filepath.ToSlash(target))
+	} else if content, err = os.ReadFile(fullPath); err != nil {
+		return nil, err
+	}
+	return &applyResult{Path: p, Content: content, Mode: mode}, nil
+}
+
+// writeApplyResults writes the results to the worktree and updates the
+// index as the options ask
+func writeApplyResults(repo *git.Repository, results []*applyResult, opts applyOptions) error {
+	if opts.Cached {
+		idx, err := repo.Storer.Index()
+		if err != nil {
+			return fmt.Errorf("error reading index: %w", err)
+		}
+		for _, result := range results {
+			if result.Deleted {
+				idx.Remove(result.Path)
+				continue
+			}
+			hash, err := storeBlob(repo, result.Content)
+			if err != nil {
+				return err
+			}
+			entry, err := idx.Entry(result.Path)
+			if err != nil {
+				entry = idx.Add(result.Path)
+			}
+			entry.Hash = hash
+			entry.Mode = result.Mode
+			entry.Size = uint32(len(result.Content))
+		}
+		return repo.Storer.SetIndex(idx)
+	}
+
+	root := repoRoot()
+	staged := []string{}
+	for _, result := range results {
+		fullPath := filepath.Join(root, filepath.FromSlash(result.Path))
+		if result.Deleted {
+			if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if err := writeWorktreeFile(fullPath, result); err != nil {
+			return err
+		}
+		// Conflicted files stay unstaged so the index keeps the last good state
+		if result.Conflicts == 0 {
+			staged = append(staged, result.Path)
+		}
+	}
+
+	if opts.Index {
+		return stagePaths(repo, root, staged)
+	}
+	return nil
+}
+
+func writeWorktreeFile(fullPath string, result *applyResult) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	if result.Mode == filemode.Symlink {
+		os.Remove(fullPath)
+		return os.Symlink(filepath.FromSlash(string(result.Content)), fullPath)
+	}
+
+	perm := os.FileMode(0644)
+	if result.Mode == filemode.Executable {
+		perm = 0755
+	}
+	if info, err := os.Lstat(fullPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.Remove(fullPath)
+	}
+	if err := os.WriteFile(fullPath, result.Content, perm); err != nil {
+		return err
+	}
+	// WriteFile leaves the mode of an existing file alone
+	return os.Chmod(fullPath, perm)
+}
+
+// validPatchPath rejects absolute paths and paths that leave the repository
+func validPatchPath(p string) bool {
+	if strings.HasPrefix(p, "/") || filepath.IsAbs(p) {
+		return false
+	}
+	for _, part := range strings.Split(path.Clean(p), "/") {
+		if part == ".." || part == ".git" || part == ".mgit" {
+			return false
+		}
+	}
+	return true
+}
+
+func applyTargetName(opts applyOptions) string {
+	if opts.Cached {
+		return "index"
+	}
+	return "working directory"
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// mgit archive exports the tree of a commit, without its history:
+//
+//	mgit archive [--format=tar|tar.gz|zip] [--prefix=<dir>/] [-o <file>] <rev> [<path>...]
+//	mgit archive --verify <file> [--format=...] [--prefix=<dir>/] <rev> [<path>...]
+//
+// The revision is anything resolveMGitRevision takes, so an MGit hash from
+// an audit log can be exported as is. Every entry gets the commit's time,
+// and the archive comment carries the MGit hash, as git archive does with
+// the Git one. Without -o the archive goes to stdout.
+//
+// An archive is reproducible: the same revision, paths and options give the
+// same bytes on any machine, so a release attested with mgit attest can be
+// rebuilt and checked by anyone with the repository. Entries are sorted by
+// name, their times are the commit's, owners and the gzip header are left
+// empty, and compression uses a fixed level. --verify rebuilds the archive
+// and compares it with a file, listing the entries that differ if it
+// doesn't match.
+
+// archiveCompression is the deflate level of zip and tar.gz archives. It is
+// part of the archive's bytes, so changing it changes every archive.
+const archiveCompression = flate.BestCompression
+
+// archiveWriter is the part of a tar or zip writer the tree is written with
+type archiveWriter interface {
+	addFile(name string, mode filemode.FileMode, size int64, content io.Reader) error
+	Close() error
+}
+
+// HandleArchive handles the archive command
+func HandleArchive(args []string) {
+	format, prefix, output, verify := "", "", "", ""
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--format" && i+1 < len(args):
+			format = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix = strings.TrimPrefix(arg, "--prefix=")
+		case (arg == "-o" || arg == "--output") && i+1 < len(args):
+			output = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--output="):
+			output = strings.TrimPrefix(arg, "--output=")
+		case arg == "--verify" && i+1 < len(args):
+			verify = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--verify="):
+			verify = strings.TrimPrefix(arg, "--verify=")
+		case strings.HasPrefix(arg, "-"):
+			printArchiveUsage()
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 || (verify != "" && output != "") {
+		printArchiveUsage()
+		os.Exit(1)
+	}
+	if format == "" {
+		// Like git, the output name picks the format when none is given
+		name := output
+		if verify != "" {
+			name = verify
+		}
+		format = archiveFormatOf(name)
+	}
+	if format == "tgz" {
+		format = "tar.gz"
+	}
+	if format != "tar" && format != "tar.gz" && format != "zip" {
+		fmt.Printf("Error: unknown archive format %q; use tar, tar.gz or zip\n", format)
+		os.Exit(1)
+	}
+
+	if verify != "" {
+		if err := verifyArchive(format, prefix, verify, positional[0], positional[1:]); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := writeArchive(format, prefix, output, positional[0], positional[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		if output != "" {
+			os.Remove(output)
+		}
+		os.Exit(1)
+	}
+}
+
+func printArchiveUsage() {
+	fmt.Println("Usage: mgit archive [--format=tar|tar.gz|zip] [--prefix=<dir>/] [-o <file>] <rev> [<path>...]")
+	fmt.Println("       mgit archive --verify <file> [--format=tar|tar.gz|zip] [--prefix=<dir>/] <rev> [<path>...]")
+}
+
+// archiveFormatOf picks the format of an archive by its file name, tar when
+// the name doesn't say
+func archiveFormatOf(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	}
+	return "tar"
+}
+
+// archiveSource is what an archive is made from: a commit's files under
+// the paths asked for, sorted by name
+type archiveSource struct {
+	MGitHash string
+	Modified time.Time
+	Files    []*object.File
+}
+
+// resolveArchiveSource resolves rev and collects the files of its tree
+// under the given paths, all of them by default
+func resolveArchiveSource(rev string, paths []string) (*archiveSource, error) {
+	repo := getRepo()
+	storage := NewMGitStorage()
+	mcommit, err := resolveMGitRevision(repo, storage, rev)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(mcommit.GitHash))
+	if err != nil {
+		return nil, fmt.Errorf("error getting Git commit %s of %s: %w", shortHash(mcommit.GitHash), shortHash(mcommit.MGitHash), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range paths {
+		paths[i] = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(p)), "/")
+	}
+	files := []*object.File{}
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if pathMatches(file.Name, paths, false) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && len(paths) > 0 {
+		return nil, fmt.Errorf("no files in %s match %s", shortHash(mcommit.MGitHash), strings.Join(paths, " "))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return &archiveSource{MGitHash: mcommit.MGitHash, Modified: commit.Committer.When, Files: files}, nil
+}
+
+// writeArchive resolves rev and writes the archive of its files to output,
+// or stdout
+func writeArchive(format, prefix, output, rev string, paths []string) error {
+	source, err := resolveArchiveSource(rev, paths)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is written until the revision and paths are known to be good
+	var out io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return buildArchive(out, format, prefix, source)
+}
+
+// buildArchive writes the archive of source's files in a format
+func buildArchive(out io.Writer, format, prefix string, source *archiveSource) error {
+	var archive archiveWriter
+	var err error
+	switch format {
+	case "zip":
+		archive, err = newZipArchive(out, source.Modified, source.MGitHash)
+	case "tar.gz":
+		archive, err = newTarGzArchive(out, source.Modified, source.MGitHash)
+	default:
+		archive, err = newTarArchive(out, source.Modified, source.MGitHash)
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range source.Files {
+		reader, err := file.Reader()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", file.Name, err)
+		}
+		err = archive.addFile(prefix+file.Name, file.Mode, file.Size, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+type tarArchive struct {
+	*tar.Writer
+	modified time.Time
+}
+
+func newTarArchive(out io.Writer, modified time.Time, mgitHash string) (*tarArchive, error) {
+	writer := tar.NewWriter(out)
+	err := writer.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": mgitHash},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchive{Writer: writer, modified: modified}, nil
+}
+
+// tarGzArchive is a tar archive compressed with gzip. The gzip header has no
+// name or time, as gzip -n writes it.
+type tarGzArchive struct {
+	*tarArchive
+	gzip *gzip.Writer
+}
+
+func newTarGzArchive(out io.Writer, modified time.Time, mgitHash string) (*tarGzArchive, error) {
+	compressed, err := gzip.NewWriterLevel(out, archiveCompression)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := newTarArchive(compressed, modified, mgitHash)
+	if err != nil {
+		return nil, err
+	}
+	return &tarGzArchive{tarArchive: archive, gzip: compressed}, nil
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tarArchive.Close(); err != nil {
+		return err
+	}
+	return a.gzip.Close()
+}
+
+func (a *tarArchive) addFile(name string, mode filemode.FileMode, size int64, content io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		ModTime: a.modified,
+		Mode:    0644,
+		Size:    size,
+	}
+	switch mode {
+	case filemode.Executable:
+		header.Mode = 0755
+	case filemode.Symlink:
+		target, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Mode = 0777
+		header.Linkname = string(target)
+		header.Size = 0
+		return a.WriteHeader(header)
+	}
+	if err := a.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(a, content)
+	return err
+}
+
+type zipArchive struct {
+	*zip.Writer
+	modified time.Time
+}
+
+func newZipArchive(out io.Writer, modified time.Time, mgitHash string) (*zipArchive, error) {
+	writer := zip.NewWriter(out)
+	writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, archiveCompression)
+	})
+	if err := writer.SetComment(mgitHash); err != nil {
+		return nil, err
+	}
+	return &zipArchive{Writer: writer, modified: modified}, nil
+}
+
+func (a *zipArchive) addFile(name string, mode filemode.FileMode, size int64, content io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: a.modified,
+	}
+	switch mode {
+	case filemode.Executable:
+		header.SetMode(0755)
+	case filemode.Symlink:
+		header.SetMode(os.ModeSymlink | 0777)
+	default:
+		header.SetMode(0644)
+	}
+	writer, err := a.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// verifyArchive rebuilds the archive of rev and checks that a file is
+// byte for byte the same. When it isn't, the entries that differ are
+// listed, telling an archive with other files from one that has the same
+// files but was made with other options or another tool.
+func verifyArchive(format, prefix, path, rev string, paths []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	source, err := resolveArchiveSource(rev, paths)
+	if err != nil {
+		return err
+	}
+	var rebuilt bytes.Buffer
+	if err := buildArchive(&rebuilt, format, prefix, source); err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, rebuilt.Bytes()) {
+		fmt.Printf("%s matches the %s archive of %s (sha256 %s)\n", path, format, shortHash(source.MGitHash), archiveSHA256(data))
+		return nil
+	}
+
+	fmt.Printf("%s does not match the %s archive of %s\n", path, format, shortHash(source.MGitHash))
+	fmt.Printf("  sha256 %s, expected %s\n", archiveSHA256(data), archiveSHA256(rebuilt.Bytes()))
+	theirs, err := archiveEntries(format, data)
+	if err != nil {
+		return fmt.Errorf("error reading %s as %s: %w", path, format, err)
+	}
+	ours, err := archiveEntries(format, rebuilt.Bytes())
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range ours {
+		names = append(names, name)
+	}
+	for name := range theirs {
+		if _, ok := ours[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	differing := 0
+	for _, name := range names {
+		want, inOurs := ours[name]
+		got, inTheirs := theirs[name]
+		switch {
+		case !inTheirs:
+			fmt.Printf("  missing:  %s\n", name)
+		case !inOurs:
+			fmt.Printf("  extra:    %s\n", name)
+		case got != want:
+			fmt.Printf("  modified: %s\n", name)
+		default:
+			continue
+		}
+		differing++
+	}
+	if differing == 0 {
+		fmt.Println("  The files are the same, but the archive was made with other options or another tool")
+	}
+	return fmt.Errorf("archive verification failed")
+}
+
+func archiveSHA256(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// archiveEntries reads the entries of an archive, as a digest of each
+// entry's mode and content (a symlink's target) by name
+func archiveEntries(format string, data []byte) (map[string]string, error) {
+	entries := map[string]string{}
+	add := func(name string, mode os.FileMode, content io.Reader) error {
+		h := sha256.New()
+		fmt.Fprintf(h, "%o\x00", mode.Perm()|mode&os.ModeSymlink)
+		if _, err := io.Copy(h, content); err != nil {
+			return err
+		}
+		entries[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}
+
+	if format == "zip" {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range reader.File {
+			content, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(file.Name, file.Mode(), content)
+			content.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	var in io.Reader = bytes.NewReader(data)
+	if format == "tar.gz" {
+		compressed, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		defer compressed.Close()
+		in = compressed
+	}
+	reader := tar.NewReader(in)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			err = add(header.Name, os.ModeSymlink|0777, strings.NewReader(header.Linkname))
+		case tar.TypeReg:
+			err = add(header.Name, os.FileMode(header.Mode).Perm(), reader)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An attestation is an in-toto statement that some artifacts were built
+// from a verified MGit commit, in a DSSE envelope signed with the signer.
+// Everything needed to check it is in the file, so it verifies offline:
+// 'mgit attest --verify' needs neither the repository nor the server.
+
+const (
+	inTotoStatementType  = "https://in-toto.io/Statement/v1"
+	inTotoPayloadType    = "application/vnd.in-toto+json"
+	mgitProvenanceType   = "https://github.com/imyjimmy/mgit/provenance/v1"
+	attestationExtension = ".intoto.jsonl"
+)
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     mgitProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// mgitProvenance is the predicate: the commit the subjects came from and
+// what else went into building them
+type mgitProvenance struct {
+	MGitCommit  string              `json:"mgitCommit"`
+	GitCommit   string              `json:"gitCommit"`
+	GitTree     string              `json:"gitTree"`
+	Signed      bool                `json:"signed"`
+	Authors     []provenanceAuthor  `json:"authors"`
+	BuildInputs provenanceBuildInfo `json:"buildInputs"`
+	CreatedAt   string              `json:"createdAt"`
+}
+
+type provenanceAuthor struct {
+	Role   string `json:"role"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Pubkey string `json:"pubkey,omitempty"`
+}
+
+type provenanceBuildInfo struct {
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Materials  []inTotoSubject   `json:"materials,omitempty"`
+}
+
+// dsseEnvelope is a DSSE envelope; keyid is the signer's npub
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// dsseDigest is what an envelope signature signs: the SHA-256 of the
+// DSSE pre-authentication encoding of the payload
+func dsseDigest(payloadType string, payload []byte) [32]byte {
+	pae := fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	return sha256.Sum256(append([]byte(pae), payload...))
+}
+
+// HandleAttest handles the attest command, which writes a signed
+// provenance document for a commit, or checks one with --verify
+func HandleAttest(args []string) {
+	if len(args) > 0 && args[0] == "--verify" {
+		verifyAttestation(args[1:])
+		return
+	}
+
+	usage := "Usage: mgit attest [-o <file>] [--input <name>=<value>] [--material <file>] <mgit-rev> [<artifact>...]\n" +
+		"       mgit attest --verify [--pubkey <npub>] <attestation> [<artifact>...]"
+	output := ""
+	parameters := map[string]string{}
+	materialPaths := []string{}
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-o" || arg == "--output") && i+1 < len(args):
+			output = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--output="):
+			output = strings.TrimPrefix(arg, "--output=")
+		case arg == "--input" && i+1 < len(args):
+			name, value, ok := strings.Cut(args[i+1], "=")
+			if !ok || name == "" {
+				fmt.Printf("Error: --input takes <name>=<value>, not %q\n", args[i+1])
+				os.Exit(1)
+			}
+			parameters[name] = value
+			i++
+		case arg == "--material" && i+1 < len(args):
+			materialPaths = append(materialPaths, args[i+1])
+			i++
+		case strings.HasPrefix(arg, "-"):
+			fmt.Println(usage)
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	commit, err := resolveMGitRevision(repo, storage, positional[0])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Only a commit whose whole history verifies is worth vouching for
+	if !verifyMGitHistory(repo, storage, commit.MGitHash, true, nil) {
+		fmt.Printf("Error: the history of %s doesn't verify, so it can't be attested\n", shortHash(commit.MGitHash))
+		os.Exit(1)
+	}
+	signed, _ := verifyMGitSignature(commit)
+
+	subjects, err := digestFiles(positional[1:])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if len(subjects) == 0 {
+		// Without artifacts the commit itself is the subject
+		subjects = []inTotoSubject{{
+			Name:   filepath.Base(repoRoot()),
+			Digest: map[string]string{"gitCommit": commit.GitHash, "mgitCommit": commit.MGitHash},
+		}}
+	}
+	materials, err := digestFiles(materialPaths)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	statement := inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       subjects,
+		PredicateType: mgitProvenanceType,
+		Predicate: mgitProvenance{
+			MGitCommit:  commit.MGitHash,
+			GitCommit:   commit.GitHash,
+			GitTree:     commit.TreeHash,
+			Signed:      signed,
+			Authors:     provenanceAuthors(commit),
+			BuildInputs: provenanceBuildInfo{Parameters: parameters, Materials: materials},
+			CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	if len(parameters) == 0 {
+		statement.Predicate.BuildInputs.Parameters = nil
+	}
+
+	signer, err := newSigner()
+	if err != nil {
+		fmt.Printf("Error opening signer: %s\n", err)
+		os.Exit(1)
+	}
+	defer signer.Close()
+	envelope, err := signStatement(signer, &statement)
+	if err != nil {
+		fmt.Printf("Error signing attestation: %s\n", err)
+		os.Exit(1)
+	}
+
+	data, err := nostrJSON(envelope)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if output == "" {
+		output = shortHash(commit.MGitHash) + attestationExtension
+	}
+	if err := os.WriteFile(output, append(data, '\n'), 0644); err != nil {
+		fmt.Printf("Error writing attestation: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Attested %s (%d subjects) as %s in %s\n",
+		shortHash(commit.MGitHash), len(subjects), envelope.Signatures[0].KeyID, output)
+}
+
+// provenanceAuthors lists who made a commit
+func provenanceAuthors(commit *MCommitStruct) []provenanceAuthor {
+	authors := []provenanceAuthor{}
+	for _, person := range []struct {
+		role string
+		sig  *MGitSignature
+	}{{"author", commit.Author}, {"committer", commit.Committer}} {
+		if person.sig != nil {
+			authors = append(authors, provenanceAuthor{person.role, person.sig.Name, person.sig.Email, person.sig.Pubkey})
+		}
+	}
+	return authors
+}
+
+// digestFiles names each file with its SHA-256
+func digestFiles(paths []string) ([]inTotoSubject, error) {
+	subjects := []inTotoSubject{}
+	for _, path := range paths {
+		digest, err := fileSHA256(path)
+		if err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, inTotoSubject{
+			Name:   filepath.ToSlash(path),
+			Digest: map[string]string{"sha256": digest},
+		})
+	}
+	return subjects, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// signStatement puts an in-toto statement in a DSSE envelope signed by
+// signer
+func signStatement(signer Signer, statement interface{}) (*dsseEnvelope, error) {
+	payload, err := nostrJSON(statement)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := signer.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(dsseDigest(inTotoPayloadType, payload))
+	if err != nil {
+		return nil, err
+	}
+	return &dsseEnvelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []dsseSignature{{KeyID: encodeNpub(pubkey), Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// openAttestation checks an envelope's signatures and decodes its
+// statement, returning the npubs whose signatures verify
+func openAttestation(envelope *dsseEnvelope) (*inTotoStatement, []string, error) {
+	payload, signers, err := openEnvelope(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, nil, fmt.Errorf("malformed statement: %w", err)
+	}
+	if statement.Type != inTotoStatementType || statement.PredicateType != mgitProvenanceType {
+		return nil, nil, fmt.Errorf("not an MGit provenance statement")
+	}
+	return &statement, signers, nil
+}
+
+// openEnvelope checks an envelope's signatures, returning its payload and
+// the npubs whose signatures verify
+func openEnvelope(envelope *dsseEnvelope) ([]byte, []string, error) {
+	if envelope.PayloadType != inTotoPayloadType {
+		return nil, nil, fmt.Errorf("payload type is %q, not %q", envelope.PayloadType, inTotoPayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	digest := dsseDigest(envelope.PayloadType, payload)
+	signers := []string{}
+	for _, signature := range envelope.Signatures {
+		pubkey, err := decodeNostrKey(signature.KeyID, "npub")
+		if err != nil {
+			return nil, nil, fmt.Errorf("signature key %q: %w", signature.KeyID, err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil || !schnorrVerify(pubkey, digest, sig) {
+			return nil, nil, fmt.Errorf("bad signature by %s", signature.KeyID)
+		}
+		signers = append(signers, encodeNpub(pubkey))
+	}
+	if len(signers) == 0 {
+		return nil, nil, fmt.Errorf("attestation is not signed")
+	}
+	return payload, signers, nil
+}
+
+// verifyAttestation handles attest --verify: it checks the signatures, the
+// signer if --pubkey names one, and that each artifact given is a subject
+func verifyAttestation(args []string) {
+	usage := "Usage: mgit attest --verify [--pubkey <npub>] <attestation> [<artifact>...]"
+	want := ""
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--pubkey" && i+1 < len(args):
+			want = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--pubkey="):
+			want = strings.TrimPrefix(args[i], "--pubkey=")
+		case strings.HasPrefix(args[i], "-"):
+			fmt.Println(usage)
+			os.Exit(1)
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+	if len(positional) == 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(positional[0])
+	if err != nil {
+		fmt.Printf("Error reading attestation: %s\n", err)
+		os.Exit(1)
+	}
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		fmt.Printf("Error: %s is not a DSSE envelope: %s\n", positional[0], err)
+		os.Exit(1)
+	}
+	statement, signers, err := openAttestation(&envelope)
+	if err != nil {
+		fmt.Printf("Attestation verification failed: %s\n", err)
+		os.Exit(1)
+	}
+	if want != "" {
+		pubkey, err := decodeNostrKey(want, "npub")
+		if err != nil {
+			fmt.Printf("Error: --pubkey: %s\n", err)
+			os.Exit(1)
+		}
+		found := false
+		for _, signer := range signers {
+			found = found || signer == encodeNpub(pubkey)
+		}
+		if !found {
+			fmt.Printf("Attestation verification failed: not signed by %s\n", encodeNpub(pubkey))
+			os.Exit(1)
+		}
+	}
+
+	p := statement.Predicate
+	field := func(label, value string) { fmt.Printf("%-13s%s\n", label+":", value) }
+	field("Signed by", strings.Join(signers, ", "))
+	field("MGit commit", p.MGitCommit)
+	field("Git commit", fmt.Sprintf("%s (tree %s)", p.GitCommit, p.GitTree))
+	for _, author := range p.Authors {
+		label := "Author"
+		if author.Role == "committer" {
+			label = "Committer"
+		}
+		field(label, strings.TrimSpace(fmt.Sprintf("%s <%s> %s", author.Name, author.Email, author.Pubkey)))
+	}
+	names := make([]string, 0, len(p.BuildInputs.Parameters))
+	for name := range p.BuildInputs.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field("Input", name+"="+p.BuildInputs.Parameters[name])
+	}
+	for _, material := range p.BuildInputs.Materials {
+		field("Material", material.Name+" sha256:"+material.Digest["sha256"])
+	}
+	field("Created", p.CreatedAt)
+
+	failed := false
+	for _, path := range positional[1:] {
+		digest, err := fileSHA256(path)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		name := ""
+		for _, subject := range statement.Subject {
+			if subject.Digest["sha256"] == digest {
+				name = subject.Name
+				break
+			}
+		}
+		if name == "" {
+			fmt.Printf("%s: not a subject of this attestation\n", path)
+			failed = true
+		} else {
+			fmt.Printf("%s: matches subject %s\n", path, name)
+		}
+	}
+	if failed {
+		fmt.Println("Attestation verification failed!")
+		os.Exit(1)
+	}
+	if want == "" {
+		fmt.Println("Attestation verification successful! Check that you trust the signer above, or pass --pubkey.")
+	} else {
+		fmt.Println("Attestation verification successful!")
+	}
+}
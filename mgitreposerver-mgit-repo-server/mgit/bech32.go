@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// bech32Charset is the alphabet of bech32 strings such as npub and nsec keys
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+// convertBits regroups a byte slice between bit widths, as bech32 data is
+// stored in 5-bit groups
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	acc := uint32(0)
+	bits := uint(0)
+	maxv := uint32(1)<<to - 1
+	out := []byte{}
+	for _, value := range data {
+		if uint32(value)>>from != 0 {
+			return nil, fmt.Errorf("invalid data")
+		}
+		acc = acc<<from | uint32(value)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return out, nil
+}
+
+// bech32Encode encodes data under a human-readable prefix, e.g. "npub"
+func bech32Encode(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	check := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(check>>uint(5*(5-i)))&31])
+	}
+	return sb.String(), nil
+}
+
+// bech32Decode decodes a bech32 string into its prefix and data
+func bech32Decode(value string) (string, []byte, error) {
+	if strings.ToLower(value) != value && strings.ToUpper(value) != value {
+		return "", nil, fmt.Errorf("mixed case in bech32 string")
+	}
+	value = strings.ToLower(value)
+	sep := strings.LastIndex(value, "1")
+	if sep < 1 || sep+7 > len(value) {
+		return "", nil, fmt.Errorf("invalid bech32 string")
+	}
+
+	hrp := value[:sep]
+	values := make([]byte, 0, len(value)-sep-1)
+	for _, c := range value[sep+1:] {
+		idx := strings.IndexRune(bech32Charset, c)
+		if idx < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", c)
+		}
+		values = append(values, byte(idx))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, fmt.Errorf("invalid bech32 checksum")
+	}
+
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
+
+// decodeNostrKey decodes an npub or nsec, or a 64-character hex key, into
+// its 32 bytes. prefix is the bech32 prefix expected.
+func decodeNostrKey(value, prefix string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 64 {
+		if key, err := hex.DecodeString(value); err == nil {
+			return key, nil
+		}
+	}
+
+	hrp, data, err := bech32Decode(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", prefix, err)
+	}
+	if hrp != prefix {
+		return nil, fmt.Errorf("expected an %s key, got %s", prefix, hrp)
+	}
+	if len(data) != 32 {
+		return nil, fmt.Errorf("invalid %s: key is %d bytes", prefix, len(data))
+	}
+	return data, nil
+}
+
+// encodeNpub encodes an x-only public key as an npub
+func encodeNpub(pub []byte) string {
+	npub, _ := bech32Encode("npub", pub)
+	return npub
+}
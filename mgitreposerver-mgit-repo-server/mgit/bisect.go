@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mgit bisect searches the MGit commit graph in .mgit/objects for the
+// commit that introduced a regression, the way git bisect does:
+//
+//	mgit bisect start [<bad> [<good>...]]
+//	mgit bisect bad [<rev>] | good [<rev>...] | skip [<rev>...]
+//	mgit bisect reset
+//
+// Commits are named and reported by MGit hash. At each step the Git
+// commit of the chosen MGit commit is checked out, with a detached HEAD.
+// The search is kept in .mgit/bisect-state.json until reset, which goes
+// back to where start was run.
+
+const bisectStateFile = "bisect-state.json"
+
+// bisectState is a bisection in progress, by MGit hash
+type bisectState struct {
+	OrigHead string   `json:"orig_head"` // the branch, or Git commit, start was run on
+	Bad      string   `json:"bad,omitempty"`
+	Good     []string `json:"good"`
+	Skipped  []string `json:"skipped"`
+}
+
+func bisectStatePath() string {
+	return filepath.Join(mgitDir(), bisectStateFile)
+}
+
+// loadBisectState returns the bisection in progress, or nil
+func loadBisectState() (*bisectState, error) {
+	data, err := os.ReadFile(bisectStatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &bisectState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %w", bisectStateFile, err)
+	}
+	return state, nil
+}
+
+func (s *bisectState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bisectStatePath(), data, 0644)
+}
+
+// HandleBisect handles the bisect command
+func HandleBisect(args []string) {
+	if len(args) == 0 {
+		printBisectUsage()
+		os.Exit(1)
+	}
+	sub, args := args[0], args[1:]
+
+	var err error
+	switch sub {
+	case "start":
+		err = bisectStart(args)
+	case "bad", "good", "skip":
+		err = bisectMark(sub, args)
+	case "reset":
+		err = bisectReset()
+	default:
+		printBisectUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printBisectUsage() {
+	fmt.Println("Usage: mgit bisect [start [<bad> [<good>...]] | bad [<rev>] | good [<rev>...] | skip [<rev>...] | reset]")
+}
+
+// bisectStart begins a bisection, optionally marking the bad and good
+// commits at once
+func bisectStart(args []string) error {
+	existing, err := loadBisectState()
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("already bisecting; run 'mgit bisect reset' first")
+	}
+
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("error getting HEAD: %w", err)
+	}
+	state := &bisectState{OrigHead: head.Hash().String(), Good: []string{}, Skipped: []string{}}
+	if head.Name().IsBranch() {
+		state.OrigHead = head.Name().Short()
+	}
+
+	storage := NewMGitStorage()
+	for i, arg := range args {
+		commit, err := resolveMGitRevision(repo, storage, arg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+		if i == 0 {
+			state.Bad = commit.MGitHash
+		} else {
+			state.Good = append(state.Good, commit.MGitHash)
+		}
+	}
+	if err := state.save(); err != nil {
+		return err
+	}
+	return bisectNext(repo, storage, state)
+}
+
+// bisectMark marks commits, HEAD's by default, and moves to the next one
+func bisectMark(mark string, args []string) error {
+	state, err := loadBisectState()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("not bisecting; run 'mgit bisect start' first")
+	}
+	if mark == "bad" && len(args) > 1 {
+		return fmt.Errorf("only one commit can be bad")
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	hashes := []string{}
+	if len(args) == 0 {
+		head, err := repo.Head()
+		if err != nil {
+			return fmt.Errorf("error getting HEAD: %w", err)
+		}
+		mgitHash, err := storage.GetMGitHashFromGit(head.Hash().String())
+		if err != nil {
+			return fmt.Errorf("HEAD (%s) has no MGit commit", shortHash(head.Hash().String()))
+		}
+		hashes = append(hashes, mgitHash)
+	}
+	for _, arg := range args {
+		commit, err := resolveMGitRevision(repo, storage, arg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+		hashes = append(hashes, commit.MGitHash)
+	}
+
+	switch mark {
+	case "bad":
+		state.Bad = hashes[0]
+	case "good":
+		state.Good = append(state.Good, hashes...)
+	case "skip":
+		state.Skipped = append(state.Skipped, hashes...)
+	}
+	if err := state.save(); err != nil {
+		return err
+	}
+	return bisectNext(repo, storage, state)
+}
+
+// bisectNext checks out the next commit to test, or reports the first
+// bad commit once it is known
+func bisectNext(repo *git.Repository, storage *MGitStorage, state *bisectState) error {
+	switch {
+	case state.Bad == "" && len(state.Good) == 0:
+		fmt.Println("Waiting for a bad and a good commit")
+		return nil
+	case state.Bad == "":
+		fmt.Println("Waiting for a bad commit")
+		return nil
+	case len(state.Good) == 0:
+		fmt.Println("Waiting for good commit(s)")
+		return nil
+	}
+
+	candidates := mgitRange(storage, []string{state.Bad}, state.Good)
+	if len(candidates) == 0 {
+		return fmt.Errorf("the bad commit %s is an ancestor of a good commit", shortHash(state.Bad))
+	}
+
+	skipped := map[string]bool{}
+	for _, hash := range state.Skipped {
+		skipped[hash] = true
+	}
+	next, left := bisectionPoint(candidates, state.Bad, skipped)
+	if next == nil {
+		if left == 0 {
+			bad, err := storage.GetCommit(state.Bad)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s is the first bad commit\n", bad.MGitHash)
+			printMGitCommit(bad, nil)
+			return nil
+		}
+		fmt.Println("There are only skipped commits left to test.")
+		fmt.Println("The first bad commit could be any of:")
+		for _, commit := range candidates {
+			if commit.MGitHash == state.Bad || skipped[commit.MGitHash] {
+				fmt.Println(commit.MGitHash)
+			}
+		}
+		return nil
+	}
+
+	if _, err := switchToRevision(repo, next.GitHash); err != nil {
+		return err
+	}
+	if err := followGitHead(repo, storage); err != nil {
+		return err
+	}
+	steps := bits.Len(uint(left))
+	fmt.Printf("Bisecting: %d commits left to test after this (roughly %d steps)\n", left, steps)
+	fmt.Printf("[%s] %s\n", displayShortHash(next.MGitHash, next.GitHash),
+		strings.SplitN(strings.TrimSpace(next.Message), "\n", 2)[0])
+	return nil
+}
+
+// bisectionPoint picks the candidate that best halves the candidates: the
+// one whose ancestors among them are closest to half, and how many
+// commits would be left to test after it. When no candidate but the bad
+// one is left to test it returns nil and how many of them were skipped.
+func bisectionPoint(candidates []*MCommitStruct, bad string, skipped map[string]bool) (*MCommitStruct, int) {
+	inRange := map[string]*MCommitStruct{}
+	for _, commit := range candidates {
+		inRange[commit.MGitHash] = commit
+	}
+
+	// Sorted, so equally good picks are made the same way every time
+	sorted := append([]*MCommitStruct{}, candidates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MGitHash < sorted[j].MGitHash })
+
+	var best *MCommitStruct
+	bestScore, bestLeft := -1, 0
+	skippedLeft := 0
+	for _, commit := range sorted {
+		if skipped[commit.MGitHash] {
+			skippedLeft++
+		}
+		if commit.MGitHash == bad || skipped[commit.MGitHash] {
+			continue
+		}
+
+		// The commit and its ancestors in range: if it is bad they are
+		// what's left, otherwise the rest is
+		reach := map[string]bool{}
+		queue := []string{commit.MGitHash}
+		for len(queue) > 0 {
+			hash := queue[0]
+			queue = queue[1:]
+			if reach[hash] {
+				continue
+			}
+			reach[hash] = true
+			for _, parent := range inRange[hash].ParentHashes {
+				if inRange[parent] != nil && !reach[parent] {
+					queue = append(queue, parent)
+				}
+			}
+		}
+		ifBad, ifGood := len(reach)-1, len(candidates)-len(reach)-1
+		score, left := ifBad, ifGood
+		if ifGood < ifBad {
+			score, left = ifGood, ifBad
+		}
+		if score > bestScore {
+			best, bestScore, bestLeft = commit, score, left
+		}
+	}
+	if best == nil {
+		return nil, skippedLeft
+	}
+	return best, bestLeft
+}
+
+// bisectReset ends the bisection and checks out what start was run on
+func bisectReset() error {
+	state, err := loadBisectState()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		fmt.Println("Not bisecting")
+		return nil
+	}
+
+	repo := getRepo()
+	if _, err := switchToRevision(repo, state.OrigHead); err != nil {
+		return fmt.Errorf("cannot go back to %s: %w", state.OrigHead, err)
+	}
+	if err := followGitHead(repo, NewMGitStorage()); err != nil {
+		return err
+	}
+	if err := os.Remove(bisectStatePath()); err != nil {
+		return err
+	}
+	if _, err := repo.Reference(plumbing.NewBranchReferenceName(state.OrigHead), true); err == nil {
+		fmt.Printf("Switched to branch '%s'\n", state.OrigHead)
+	} else {
+		fmt.Printf("Checked out commit %s\n", shortHash(state.OrigHead))
+	}
+	return nil
+}
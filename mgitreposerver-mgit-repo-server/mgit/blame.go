@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// blameLine is the commit a line of the blamed file is attributed to
+type blameLine struct {
+	Commit  *object.Commit
+	Ignored bool // passed over an ignored commit to get here
+}
+
+// blameEntry is a commit's version of the file and the final lines that
+// are still looking for their origin in it
+type blameEntry struct {
+	commit *object.Commit
+	lines  []string
+	owners map[int][]int // line in this version -> lines of the final file
+}
+
+// HandleBlame handles the blame command, which shows the commit and author
+// pubkey that last changed each line of a file. Commits listed with
+// --ignore-rev, --ignore-revs-file or blame.ignoreRevsFile (by MGit or Git
+// hash) are skipped, so mass reformatting doesn't take the credit.
+func HandleBlame(args []string) {
+	ignoreFiles := []string{}
+	if file := GetConfigValue("blame.ignoreRevsFile", ""); file != "" {
+		ignoreFiles = append(ignoreFiles, expandHomePath(file))
+	}
+	ignoreRevs := []string{}
+	rev := "HEAD"
+	file := ""
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--ignore-rev" && i+1 < len(args):
+			i++
+			ignoreRevs = append(ignoreRevs, args[i])
+		case strings.HasPrefix(arg, "--ignore-rev="):
+			ignoreRevs = append(ignoreRevs, strings.TrimPrefix(arg, "--ignore-rev="))
+		case arg == "--ignore-revs-file" && i+1 < len(args):
+			i++
+			ignoreFiles = append(ignoreFiles, args[i])
+		case strings.HasPrefix(arg, "--ignore-revs-file="):
+			ignoreFiles = append(ignoreFiles, strings.TrimPrefix(arg, "--ignore-revs-file="))
+		case arg == "--no-ignore-revs":
+			ignoreFiles = nil
+			ignoreRevs = nil
+		case arg == "--":
+			if i+1 < len(args) {
+				file = args[i+1]
+			}
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	switch {
+	case file == "" && len(positional) == 1:
+		file = positional[0]
+	case file == "" && len(positional) == 2:
+		rev, file = positional[0], positional[1]
+	case file != "" && len(positional) == 1:
+		rev = positional[0]
+	}
+	if file == "" {
+		fmt.Println("Usage: mgit blame [--ignore-rev <rev>] [--ignore-revs-file <file>] [<rev>] [--] <file>")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	path, err := repoRelativePath(file)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	start, err := resolveCommitRevision(repo, storage, rev)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	ignored := map[plumbing.Hash]bool{}
+	for _, name := range ignoreFiles {
+		revs, err := readIgnoreRevsFile(name)
+		if err != nil {
+			fmt.Printf("Error reading ignore-revs file: %s\n", err)
+			os.Exit(1)
+		}
+		ignoreRevs = append(ignoreRevs, revs...)
+	}
+	for _, ignoreRev := range ignoreRevs {
+		hash, err := resolveCommitRevision(repo, storage, ignoreRev)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring unknown revision %s\n", ignoreRev)
+			continue
+		}
+		ignored[hash] = true
+	}
+
+	commit, err := repo.CommitObject(start)
+	if err != nil {
+		fmt.Printf("Error getting commit: %s\n", err)
+		os.Exit(1)
+	}
+	lines, result, err := blameFile(repo, commit, path, ignored)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	printBlame(storage, lines, result)
+}
+
+// resolveCommitRevision resolves a revision to a Git commit hash, taking
+// MGit hashes and prefixes as well as anything git would
+func resolveCommitRevision(repo *git.Repository, storage *MGitStorage, rev string) (plumbing.Hash, error) {
+	if hash, err := resolveGitRevision(repo, rev); err == nil {
+		return hash, nil
+	}
+	commit, err := resolveMGitRevision(repo, storage, rev)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return plumbing.NewHash(commit.GitHash), nil
+}
+
+// readIgnoreRevsFile reads an ignore-revs file: one revision per line, with
+// blank lines and # comments skipped
+func readIgnoreRevsFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	revs := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			revs = append(revs, line)
+		}
+	}
+	return revs, scanner.Err()
+}
+
+// blameFile attributes each line of a file at a commit to the commit that
+// introduced it. Lines are handed from each commit to its parents wherever
+// a parent has them unchanged. An ignored commit also hands over the lines
+// it changed (see passOverIgnored).
+func blameFile(repo *git.Repository, start *object.Commit, path string, ignored map[plumbing.Hash]bool) ([]string, []blameLine, error) {
+	lines, err := fileLinesAt(start, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lines == nil {
+		return nil, nil, fmt.Errorf("no such path %s in %s", path, shortHash(start.Hash.String()))
+	}
+
+	result := make([]blameLine, len(lines))
+	owners := map[int][]int{}
+	for i := range lines {
+		owners[i] = []int{i}
+	}
+	pending := map[plumbing.Hash]*blameEntry{
+		start.Hash: {commit: start, lines: lines, owners: owners},
+	}
+
+	// Newest commit first, so every child has handed its lines over
+	// before a parent is looked at
+	for len(pending) > 0 {
+		var entry *blameEntry
+		for _, candidate := range pending {
+			if entry == nil || candidate.commit.Committer.When.After(entry.commit.Committer.When) {
+				entry = candidate
+			}
+		}
+		delete(pending, entry.commit.Hash)
+
+		parents := []*blameEntry{}
+		for _, parentHash := range entry.commit.ParentHashes {
+			parent, err := repo.CommitObject(parentHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			parentLines, err := fileLinesAt(parent, path)
+			if err != nil {
+				return nil, nil, err
+			}
+			if parentLines == nil {
+				continue
+			}
+			target, ok := pending[parent.Hash]
+			if !ok {
+				target = &blameEntry{commit: parent, lines: parentLines, owners: map[int][]int{}}
+			}
+			parents = append(parents, target)
+		}
+
+		// Unchanged lines go to the first parent that has them
+		for _, parent := range parents {
+			for _, edit := range diffLines(parent.lines, entry.lines) {
+				if edit.Op != diffEqual {
+					continue
+				}
+				if finals, ok := entry.owners[edit.BIndex]; ok {
+					parent.owners[edit.AIndex] = append(parent.owners[edit.AIndex], finals...)
+					delete(entry.owners, edit.BIndex)
+				}
+			}
+		}
+
+		if ignored[entry.commit.Hash] && len(parents) > 0 {
+			passOverIgnored(entry, parents[0], result)
+		}
+
+		for _, finals := range entry.owners {
+			for _, final := range finals {
+				result[final].Commit = entry.commit
+			}
+		}
+		for _, parent := range parents {
+			if len(parent.owners) > 0 {
+				pending[parent.commit.Hash] = parent
+			}
+		}
+	}
+	return lines, result, nil
+}
+
+// passOverIgnored hands the lines an ignored commit changed to its parent:
+// within each change, the n-th new line goes to the n-th old line. Lines
+// beyond the old ones were added by the commit and stay with it.
+func passOverIgnored(entry, parent *blameEntry, result []blameLine) {
+	deleted := []int{}
+	inserted := []int{}
+	flush := func() {
+		for i, line := range inserted {
+			finals, ok := entry.owners[line]
+			if !ok || i >= len(deleted) {
+				continue
+			}
+			target := deleted[i]
+			parent.owners[target] = append(parent.owners[target], finals...)
+			for _, final := range finals {
+				result[final].Ignored = true
+			}
+			delete(entry.owners, line)
+		}
+		deleted, inserted = deleted[:0], inserted[:0]
+	}
+	for _, edit := range diffLines(parent.lines, entry.lines) {
+		switch edit.Op {
+		case diffDelete:
+			deleted = append(deleted, edit.AIndex)
+		case diffInsert:
+			inserted = append(inserted, edit.BIndex)
+		default:
+			flush()
+		}
+	}
+	flush()
+}
+
+// fileLinesAt returns the lines of a file in a commit, or nil if the commit
+// doesn't have it
+func fileLinesAt(commit *object.Commit, path string) ([]string, error) {
+	file, err := commit.File(path)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	lines := splitLines(content)
+	if lines == nil {
+		lines = []string{}
+	}
+	return lines, nil
+}
+
+// printBlame prints one line per line of the file: the MGit hash of the
+// commit it comes from (its Git hash if it has none), the author and their
+// pubkey, the date and the line itself. A commit from before MGit shows
+// the pubkey that claimed it with annotate-history, marked with "~". Lines
+// that were passed over an ignored commit are marked with "?" when
+// blame.markIgnoredLines is set.
+func printBlame(storage *MGitStorage, lines []string, result []blameLine) {
+	markIgnored := GetConfigBool("blame.markIgnoredLines", false)
+	labels := map[plumbing.Hash]string{}
+	pubkeys := map[plumbing.Hash]string{}
+	var claimants map[string][]string
+	width := len(fmt.Sprint(len(lines)))
+
+	for i, line := range lines {
+		commit := result[i].Commit
+		label, ok := labels[commit.Hash]
+		if !ok {
+			label = shortHash(commit.Hash.String())
+			if mgitHash, err := storage.GetMGitHashFromGit(commit.Hash.String()); err == nil {
+				label = shortHash(mgitHash)
+				if mgitCommit, err := storage.GetCommit(mgitHash); err == nil && mgitCommit.Author != nil {
+					pubkeys[commit.Hash] = shortPubkey(mgitCommit.Author.Pubkey)
+				}
+			} else {
+				if claimants == nil {
+					claimants = historyClaimants(storage)
+				}
+				if claimed := claimants[commit.Hash.String()]; len(claimed) > 0 {
+					pubkeys[commit.Hash] = "~" + shortPubkey(claimed[0])
+				}
+			}
+			labels[commit.Hash] = label
+		}
+		if markIgnored && result[i].Ignored {
+			label = "?" + label[:len(label)-1]
+		}
+
+		author := commit.Author.Name
+		if pubkey := pubkeys[commit.Hash]; pubkey != "" {
+			author += " " + pubkey
+		}
+		fmt.Printf("%s (%s %s %*d) %s", label, author, commit.Author.When.Format("2006-01-02 15:04:05 -0700"),
+			width, i+1, line)
+		if !strings.HasSuffix(line, "\n") {
+			fmt.Println()
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// A branch is a Git ref, an MGit ref under .mgit/refs/heads, a reflog
+// under .mgit/logs/refs/heads and a [branch "<name>"] section in the
+// config, so deleting or renaming one changes them all together:
+//
+//	mgit branch -d <branch>...           delete branches merged into their
+//	                                     upstream, or into HEAD without one
+//	mgit branch -D <branch>...           delete them whether merged or not
+//	mgit branch -m [<old>] <new>         rename a branch, the current one
+//	                                     by default
+//	mgit branch -M [<old>] <new>         rename it over an existing branch
+//
+// -d and -m take -f/--force as well. Neither works on a branch checked out
+// in another worktree, nor deletes the current branch. A deleted branch's
+// commits stay reachable by MGit hash until gc prunes them.
+
+// branchSection is the config section of a branch
+func branchSection(branch string) string {
+	return fmt.Sprintf("branch \"%s\"", branch)
+}
+
+// mgitBranchRefPath is where a branch's MGit ref is kept
+func mgitBranchRefPath(storage *MGitStorage, branch string) string {
+	return filepath.Join(storage.RootDir, "refs", "heads", filepath.FromSlash(branch))
+}
+
+// branchEditArgs splits the arguments of -d and -m into branch names and
+// whether -f or --force was among them
+func branchEditArgs(args []string) ([]string, bool) {
+	names := []string{}
+	force := false
+	for _, arg := range args {
+		if arg == "-f" || arg == "--force" {
+			force = true
+		} else {
+			names = append(names, arg)
+		}
+	}
+	return names, force
+}
+
+// deleteBranches deletes branches, going on past the ones that can't be.
+// It reports whether all were deleted.
+func deleteBranches(repo *git.Repository, names []string, force bool) bool {
+	ok := true
+	for _, name := range names {
+		if err := deleteBranch(repo, NewMGitStorage(), name, force); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// deleteBranch deletes a branch's Git ref, MGit ref, reflog and config.
+// Without force the branch must be merged into its upstream, or into HEAD
+// if it has none.
+func deleteBranch(repo *git.Repository, storage *MGitStorage, branch string, force bool) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	ref, err := repo.Reference(name, false)
+	if err != nil {
+		return fmt.Errorf("branch '%s' not found", branch)
+	}
+	if head, err := repo.Head(); err == nil && head.Name() == name {
+		return fmt.Errorf("cannot delete branch '%s', which is checked out; switch to another branch first", branch)
+	}
+	if path := branchCheckedOutElsewhere(branch); path != "" {
+		return fmt.Errorf("cannot delete branch '%s', which is checked out at '%s'", branch, path)
+	}
+	if !force {
+		merged, into, err := branchMerged(repo, branch, ref.Hash())
+		if err != nil {
+			return err
+		}
+		if !merged {
+			return fmt.Errorf("the branch '%s' is not fully merged into %s; if you are sure you want to delete it, run 'mgit branch -D %s'", branch, into, branch)
+		}
+	}
+
+	mgitHash, _ := storage.GetRef(name.String())
+	mgitHash = strings.TrimSpace(mgitHash)
+	if err := repo.Storer.RemoveReference(name); err != nil {
+		return fmt.Errorf("failed to delete branch '%s': %w", branch, err)
+	}
+	if err := removeRefFile(storage, mgitBranchRefPath(storage, branch)); err != nil {
+		return fmt.Errorf("failed to delete the MGit ref of '%s': %w", branch, err)
+	}
+	if err := removeRefFile(storage, reflogPath(storage, name.String())); err != nil {
+		return fmt.Errorf("failed to delete the reflog of '%s': %w", branch, err)
+	}
+	if err := setGitBranchConfig(repo, branch, ""); err != nil {
+		return err
+	}
+	if err := RemoveConfigSection(branchSection(branch), false); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted branch %s (was %s).\n", branch, displayShortHash(mgitHash, ref.Hash().String()))
+	return nil
+}
+
+// branchMerged reports whether a branch's tip is merged into its upstream,
+// or into HEAD if it has none, which it names
+func branchMerged(repo *git.Repository, branch string, tip plumbing.Hash) (bool, string, error) {
+	into := "HEAD"
+	var target plumbing.Hash
+	if upstream := branchUpstream(branch); upstream != "" {
+		if ref, err := repo.Reference(plumbing.ReferenceName(upstream), true); err == nil {
+			into, target = plumbing.ReferenceName(upstream).Short(), ref.Hash()
+		}
+	}
+	if target.IsZero() {
+		head, err := repo.Head()
+		if err != nil {
+			return false, into, nil // An unborn HEAD has nothing merged
+		}
+		target = head.Hash()
+	}
+	ancestors, err := gitAncestors(repo, target)
+	if err != nil {
+		return false, into, err
+	}
+	return ancestors[tip], into, nil
+}
+
+// renameBranch renames a branch's Git ref, MGit ref, reflog and config,
+// and HEAD with them if it is on the branch. With force it replaces a
+// branch of the new name.
+func renameBranch(repo *git.Repository, storage *MGitStorage, oldBranch, newBranch string, force bool) error {
+	oldName, newName := plumbing.NewBranchReferenceName(oldBranch), plumbing.NewBranchReferenceName(newBranch)
+	ref, err := repo.Reference(oldName, false)
+	if err != nil {
+		return fmt.Errorf("branch '%s' not found", oldBranch)
+	}
+	if err := newName.Validate(); err != nil || strings.HasPrefix(newBranch, "-") {
+		return fmt.Errorf("'%s' is not a valid branch name", newBranch)
+	}
+	if oldBranch == newBranch {
+		return nil
+	}
+	head, headErr := repo.Head()
+	onBranch := headErr == nil && head.Name() == oldName
+	if _, err := repo.Reference(newName, false); err == nil {
+		switch {
+		case !force:
+			return fmt.Errorf("a branch named '%s' already exists; use -M to replace it", newBranch)
+		case headErr == nil && head.Name() == newName:
+			return fmt.Errorf("cannot replace branch '%s', which is checked out", newBranch)
+		case branchCheckedOutElsewhere(newBranch) != "":
+			return fmt.Errorf("cannot replace branch '%s', which is checked out at '%s'", newBranch, branchCheckedOutElsewhere(newBranch))
+		}
+	}
+	if path := branchCheckedOutElsewhere(oldBranch); path != "" {
+		return fmt.Errorf("cannot rename branch '%s', which is checked out at '%s'", oldBranch, path)
+	}
+
+	// Git: the new ref first, so the branch is never lost
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(newName, ref.Hash())); err != nil {
+		return fmt.Errorf("failed to rename branch '%s': %w", oldBranch, err)
+	}
+	if err := repo.Storer.RemoveReference(oldName); err != nil {
+		return fmt.Errorf("failed to rename branch '%s': %w", oldBranch, err)
+	}
+	if onBranch {
+		if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, newName)); err != nil {
+			return err
+		}
+	}
+
+	// MGit: the ref and its reflog move, with an entry for the rename
+	mgitHash, refErr := storage.GetRef(oldName.String())
+	mgitHash = strings.TrimSpace(mgitHash)
+	for _, paths := range [][2]string{
+		{mgitBranchRefPath(storage, oldBranch), mgitBranchRefPath(storage, newBranch)},
+		{reflogPath(storage, oldName.String()), reflogPath(storage, newName.String())},
+	} {
+		if err := moveRefFile(storage, paths[0], paths[1]); err != nil {
+			return fmt.Errorf("failed to rename the MGit side of '%s': %w", oldBranch, err)
+		}
+	}
+	message := fmt.Sprintf("%s: renamed %s to %s", reflogAction, oldName, newName)
+	if refErr == nil {
+		if err := appendReflog(storage, newName.String(), mgitHash, mgitHash, message); err != nil {
+			return err
+		}
+	}
+	if mgitHead, err := storage.GetHead(); err == nil && strings.TrimSpace(mgitHead) == oldName.String() {
+		// HEAD follows the branch without moving, so this isn't a switch
+		if err := os.WriteFile(storage.HeadPath(), []byte("ref: "+newName.String()), 0644); err != nil {
+			return fmt.Errorf("failed to update HEAD: %w", err)
+		}
+		if refErr == nil {
+			if err := appendReflog(storage, "HEAD", mgitHash, mgitHash, message); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Config: the upstream and description go with the branch
+	if err := setGitBranchConfig(repo, oldBranch, newBranch); err != nil {
+		return err
+	}
+	if err := RemoveConfigSection(branchSection(newBranch), false); err != nil {
+		return err
+	}
+	if err := RenameConfigSection(branchSection(oldBranch), branchSection(newBranch), false); err != nil {
+		return err
+	}
+
+	fmt.Printf("Renamed branch '%s' to '%s'\n", oldBranch, newBranch)
+	return nil
+}
+
+// setGitBranchConfig moves a branch's section of .git/config to a new
+// name, or removes it when the new name is ""
+func setGitBranchConfig(repo *git.Repository, oldBranch, newBranch string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	branch, ok := cfg.Branches[oldBranch]
+	_, replaced := cfg.Branches[newBranch]
+	if !ok && !replaced {
+		return nil
+	}
+	delete(cfg.Branches, oldBranch)
+	delete(cfg.Branches, newBranch)
+	if ok && newBranch != "" {
+		branch.Name = newBranch
+		cfg.Branches[newBranch] = branch
+	}
+	return repo.SetConfig(cfg)
+}
+
+// moveRefFile moves a ref or reflog file, replacing what the destination
+// held; a missing source moves nothing
+func moveRefFile(storage *MGitStorage, from, to string) error {
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return removeRefFile(storage, to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	removeEmptyRefDirs(storage, filepath.Dir(from))
+	return nil
+}
+
+// removeRefFile removes a ref or reflog file if there is one, with the
+// directories of a branch name with slashes that it leaves empty
+func removeRefFile(storage *MGitStorage, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyRefDirs(storage, filepath.Dir(path))
+	return nil
+}
+
+// removeEmptyRefDirs removes empty directories from dir up, stopping at
+// refs/heads and logs/refs/heads
+func removeEmptyRefDirs(storage *MGitStorage, dir string) {
+	stops := map[string]bool{
+		filepath.Join(storage.RootDir, "refs", "heads"):         true,
+		filepath.Join(storage.RootDir, "logs", "refs", "heads"): true,
+	}
+	for !stops[dir] && strings.HasPrefix(dir, storage.RootDir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A branch's upstream and description live in .mgit/config the way git
+// keeps them in .git/config:
+//
+//	[branch "feature/labs"]
+//		remote = origin
+//		merge = refs/heads/main
+//		description = Lab results import
+//
+// A remote of "." tracks a local branch. Descriptions can span lines,
+// which the config stores escaped as \n.
+
+const branchDescriptionFile = "EDIT_DESCRIPTION"
+
+// branchUpstream returns the ref a branch tracks, refs/remotes/<remote>/<branch>
+// or for a local upstream refs/heads/<branch>, or "" if it tracks none
+func branchUpstream(branch string) string {
+	remote := GetConfigValue("branch."+branch+".remote", "")
+	merge := GetConfigValue("branch."+branch+".merge", "")
+	if remote == "" || !strings.HasPrefix(merge, "refs/heads/") {
+		return ""
+	}
+	if remote == "." {
+		return merge
+	}
+	return "refs/remotes/" + remote + "/" + strings.TrimPrefix(merge, "refs/heads/")
+}
+
+// branchDescription returns a branch's description, or ""
+func branchDescription(branch string) string {
+	value := GetConfigValue("branch."+branch+".description", "")
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(value)
+}
+
+// aheadBehind counts the commits on local that upstream lacks, and those
+// on upstream that local lacks
+func aheadBehind(repo *git.Repository, local, upstream plumbing.Hash) (int, int, error) {
+	count := func(from, other plumbing.Hash) (int, error) {
+		exclude, err := gitAncestors(repo, other)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		err = walkGitCommits(repo, from, exclude, func(*object.Commit) { n++ })
+		return n, err
+	}
+	ahead, err := count(local, upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	behind, err := count(upstream, local)
+	return ahead, behind, err
+}
+
+// handleBranchOption handles the branch options that take a dash:
+//
+//	-u, --set-upstream-to <upstream> [<branch>]
+//	--unset-upstream [<branch>]
+//	--edit-description [<branch>]
+//	-v, -vv    list branches with their commits, and with -vv their
+//	           upstream, how far ahead and behind it they are, and their
+//	           description
+//	-r, -a     list the remote-tracking branches, or all branches, from
+//	           the MGit ref store
+//	-d, -D, -m, -M  delete or rename branches, with their MGit refs
+//
+// The branch defaults to the current one.
+func handleBranchOption(args []string) {
+	repo := getRepo()
+	option, rest := args[0], args[1:]
+	var err error
+	switch {
+	case option == "-u" || option == "--set-upstream-to":
+		if len(rest) == 0 {
+			fmt.Printf("Error: %s needs an upstream\n", option)
+			os.Exit(1)
+		}
+		err = setBranchUpstream(repo, rest[0], branchArgument(repo, rest[1:]))
+	case strings.HasPrefix(option, "--set-upstream-to="):
+		err = setBranchUpstream(repo, strings.TrimPrefix(option, "--set-upstream-to="), branchArgument(repo, rest))
+	case option == "--unset-upstream":
+		branch := branchArgument(repo, rest)
+		if branchUpstream(branch) == "" {
+			err = fmt.Errorf("branch '%s' has no upstream information", branch)
+			break
+		}
+		if err = UnsetConfigValue("branch."+branch+".remote", false); err == nil {
+			err = UnsetConfigValue("branch."+branch+".merge", false)
+		}
+	case option == "--edit-description":
+		err = editBranchDescription(branchArgument(repo, rest))
+	case option == "-v" || option == "--verbose":
+		err = listBranchesVerbose(repo, false)
+	case option == "-vv":
+		err = listBranchesVerbose(repo, true)
+	case option == "-r" || option == "--remotes":
+		err = listBranchesWithRemotes(repo, false)
+	case option == "-a" || option == "--all":
+		err = listBranchesWithRemotes(repo, true)
+	case option == "-d" || option == "--delete" || option == "-D":
+		names, force := branchEditArgs(rest)
+		if len(names) == 0 {
+			fmt.Println("Error: branch name required")
+			os.Exit(1)
+		}
+		if !deleteBranches(repo, names, force || option == "-D") {
+			os.Exit(1)
+		}
+	case option == "-m" || option == "--move" || option == "-M":
+		names, force := branchEditArgs(rest)
+		switch len(names) {
+		case 1:
+			err = renameBranch(repo, NewMGitStorage(), branchArgument(repo, nil), names[0], force || option == "-M")
+		case 2:
+			err = renameBranch(repo, NewMGitStorage(), names[0], names[1], force || option == "-M")
+		default:
+			fmt.Println("Usage: mgit branch -m [<old>] <new>")
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Error: unknown option %s\n", option)
+		fmt.Println("Usage: mgit branch [-v | -vv | -r | -a | <name> | -d | -D <branch>... | -m | -M [<old>] <new> | -u <upstream> [<branch>] | --unset-upstream [<branch>] | --edit-description [<branch>]]")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// branchArgument returns the branch named in args, which must exist, or
+// the current branch
+func branchArgument(repo *git.Repository, args []string) string {
+	if len(args) > 0 {
+		if _, err := repo.Reference(plumbing.NewBranchReferenceName(args[0]), false); err != nil {
+			fmt.Printf("Error: branch '%s' does not exist\n", args[0])
+			os.Exit(1)
+		}
+		return args[0]
+	}
+	head, err := repo.Head()
+	if err != nil || !head.Name().IsBranch() {
+		fmt.Println("Error: HEAD is not on a branch; name the branch")
+		os.Exit(1)
+	}
+	return head.Name().Short()
+}
+
+// setBranchUpstream makes branch track a remote-tracking branch, given as
+// <remote>/<branch>, or a local branch
+func setBranchUpstream(repo *git.Repository, upstream, branch string) error {
+	remote, merge := "", ""
+	if _, err := repo.Reference(plumbing.ReferenceName("refs/remotes/"+upstream), false); err == nil {
+		slash := strings.Index(upstream, "/")
+		if slash <= 0 {
+			return fmt.Errorf("cannot set up tracking information for '%s'", upstream)
+		}
+		remote, merge = upstream[:slash], "refs/heads/"+upstream[slash+1:]
+	} else if _, err := repo.Reference(plumbing.NewBranchReferenceName(upstream), false); err == nil {
+		if upstream == branch {
+			return fmt.Errorf("branch '%s' cannot track itself", branch)
+		}
+		remote, merge = ".", "refs/heads/"+upstream
+	} else {
+		return fmt.Errorf("the requested upstream branch '%s' does not exist", upstream)
+	}
+
+	if err := SetConfigValue("branch."+branch+".remote", remote, false); err != nil {
+		return err
+	}
+	if err := SetConfigValue("branch."+branch+".merge", merge, false); err != nil {
+		return err
+	}
+	fmt.Printf("branch '%s' set up to track '%s'.\n", branch, upstream)
+	return nil
+}
+
+// editBranchDescription opens the editor on a branch's description. An
+// empty description removes it.
+func editBranchDescription(branch string) error {
+	path := filepath.Join(mgitCommonDir(), branchDescriptionFile)
+	template := branchDescription(branch)
+	if template != "" {
+		template += "\n"
+	}
+	template += fmt.Sprintf("# Please edit the description for the branch\n#   %s\n# Lines starting with '#' will be stripped.\n", branch)
+	if err := os.WriteFile(path, []byte(template), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := runEditor(path); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	description := stripCommentLines(string(data))
+	if description == "" {
+		return UnsetConfigValue("branch."+branch+".description", false)
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(description)
+	return SetConfigValue("branch."+branch+".description", escaped, false)
+}
+
+// listBranchesVerbose lists the branches with the short MGit hash and
+// subject of their commits, and with tracking their upstream and
+// description
+func listBranchesVerbose(repo *git.Repository, tracking bool) error {
+	storage := NewMGitStorage()
+	iter, err := repo.Branches()
+	if err != nil {
+		return err
+	}
+	branches := []*plumbing.Reference{}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		branches = append(branches, ref)
+		return nil
+	})
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Name() < branches[j].Name() })
+
+	width := 0
+	for _, ref := range branches {
+		if len(ref.Name().Short()) > width {
+			width = len(ref.Name().Short())
+		}
+	}
+	current := ""
+	if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+		current = head.Name().Short()
+	}
+
+	for _, ref := range branches {
+		name := ref.Name().Short()
+		marker := " "
+		if name == current {
+			marker = "*"
+		}
+		hash := ref.Hash().String()
+		if mgitHash, err := storage.GetMGitHashFromGit(hash); err == nil {
+			hash = mgitHash
+		}
+		subject := ""
+		if commit, err := repo.CommitObject(ref.Hash()); err == nil {
+			subject = strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0]
+		}
+		if tracking {
+			if upstream := branchTrackingSummary(repo, name, ref.Hash()); upstream != "" {
+				subject = upstream + " " + subject
+			}
+		}
+		fmt.Printf("%s %-*s %s %s\n", marker, width, name, shortHash(hash), subject)
+
+		if description := branchDescription(name); tracking && description != "" {
+			for _, line := range strings.Split(description, "\n") {
+				fmt.Printf("  %-*s   %s\n", width, "", line)
+			}
+		}
+	}
+	return nil
+}
+
+// branchTrackingSummary is the bracketed upstream part of a -vv line, e.g.
+// "[origin/main: ahead 2, behind 1]", or "" without an upstream
+func branchTrackingSummary(repo *git.Repository, branch string, hash plumbing.Hash) string {
+	upstream := branchUpstream(branch)
+	if upstream == "" {
+		return ""
+	}
+	short := plumbing.ReferenceName(upstream).Short()
+	ref, err := repo.Reference(plumbing.ReferenceName(upstream), true)
+	if err != nil {
+		return "[" + short + ": gone]"
+	}
+	ahead, behind, err := aheadBehind(repo, hash, ref.Hash())
+	if err != nil {
+		return "[" + short + "]"
+	}
+	counts := []string{}
+	if ahead > 0 {
+		counts = append(counts, fmt.Sprintf("ahead %d", ahead))
+	}
+	if behind > 0 {
+		counts = append(counts, fmt.Sprintf("behind %d", behind))
+	}
+	if len(counts) == 0 {
+		return "[" + short + "]"
+	}
+	return "[" + short + ": " + strings.Join(counts, ", ") + "]"
+}
+
+// mgitAheadBehind is aheadBehind on the MGit DAG, from the MGit commit of
+// local to the MGit ref store's upstream. ok is false when either has no
+// MGit commit.
+func mgitAheadBehind(storage *MGitStorage, local plumbing.Hash, upstream *plumbing.Reference) (ahead, behind int, ok bool) {
+	localMGit, err := storage.GetMGitHashFromGit(local.String())
+	if err != nil {
+		return 0, 0, false
+	}
+	upstreamMGit, err := storage.GetRef(upstream.Name().String())
+	if err != nil {
+		if upstreamMGit, err = storage.GetMGitHashFromGit(upstream.Hash().String()); err != nil {
+			return 0, 0, false
+		}
+	}
+	ahead = len(mgitRange(storage, []string{localMGit}, []string{upstreamMGit}))
+	behind = len(mgitRange(storage, []string{upstreamMGit}, []string{localMGit}))
+	return ahead, behind, true
+}
+
+// upstreamStatus is what mgit status says about how a branch compares
+// with its upstream, or "" without an upstream
+func upstreamStatus(repo *git.Repository, branch string, hash plumbing.Hash) string {
+	upstream := branchUpstream(branch)
+	if upstream == "" {
+		return ""
+	}
+	short := plumbing.ReferenceName(upstream).Short()
+	ref, err := repo.Reference(plumbing.ReferenceName(upstream), true)
+	if err != nil {
+		return fmt.Sprintf("Your branch is based on '%s', but the upstream is gone.\n"+
+			"  (use \"mgit branch --unset-upstream\" to fixup)", short)
+	}
+
+	ahead, behind, ok := mgitAheadBehind(NewMGitStorage(), hash, ref)
+	if !ok {
+		// Commits made without mgit have no MGit commits to count
+		if ahead, behind, err = aheadBehind(repo, hash, ref.Hash()); err != nil {
+			return ""
+		}
+	}
+	commits := func(n int) string {
+		if n == 1 {
+			return "1 commit"
+		}
+		return fmt.Sprintf("%d commits", n)
+	}
+	switch {
+	case ahead > 0 && behind > 0:
+		return fmt.Sprintf("Your branch and '%s' have diverged,\n"+
+			"and have %d and %d different commits each, respectively.\n"+
+			"  (use \"mgit pull\" to merge the remote branch into yours)", short, ahead, behind)
+	case ahead > 0:
+		return fmt.Sprintf("Your branch is ahead of '%s' by %s.\n"+
+			"  (use \"mgit push\" to publish your local commits)", short, commits(ahead))
+	case behind > 0:
+		return fmt.Sprintf("Your branch is behind '%s' by %s, and can be fast-forwarded.\n"+
+			"  (use \"mgit pull\" to update your local branch)", short, commits(behind))
+	}
+	return fmt.Sprintf("Your branch is up to date with '%s'.", short)
+}
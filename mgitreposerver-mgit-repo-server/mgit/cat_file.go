@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// HandleCatFile handles the cat-file command, which prints the type, size or
+// content of a Git object or of an MGit commit object. It only reads the
+// object store, so it works in bare repositories.
+func HandleCatFile(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: mgit cat-file (-t | -s | -e | -p) <object>")
+		os.Exit(1)
+	}
+
+	mode := args[0]
+	name := args[1]
+	switch mode {
+	case "-t", "-s", "-e", "-p":
+	default:
+		fmt.Println("Usage: mgit cat-file (-t | -s | -e | -p) <object>")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+
+	// Git objects take precedence over MGit objects with the same name
+	if obj, err := findGitObject(repo, name); err == nil {
+		if err := printGitObject(repo, obj, mode); err != nil {
+			fmt.Printf("Error reading object %s: %s\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if commit, err := NewMGitStorage().GetCommit(name); err == nil {
+		if err := printMGitObject(commit, mode); err != nil {
+			fmt.Printf("Error reading object %s: %s\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Fall back to revisions, including MGit hashes from the mappings. A
+	// tag name is the tag object, not the commit it tags.
+	hash, err := resolveGitRevision(repo, name)
+	if tag, tagErr := repo.Tag(name); tagErr == nil {
+		hash, err = tag.Hash(), nil
+	}
+	if err == nil {
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, hash)
+		if err == nil {
+			if err := printGitObject(repo, obj, mode); err != nil {
+				fmt.Printf("Error reading object %s: %s\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	if mode != "-e" {
+		fmt.Printf("Error: Not a valid object name %s\n", name)
+	}
+	os.Exit(1)
+}
+
+// findGitObject looks up an object of any type by its full Git hash
+func findGitObject(repo *git.Repository, name string) (plumbing.EncodedObject, error) {
+	if len(name) != 40 || !plumbing.IsHash(name) {
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return repo.Storer.EncodedObject(plumbing.AnyObject, plumbing.NewHash(name))
+}
+
+// printGitObject prints a Git object the way git cat-file does
+func printGitObject(repo *git.Repository, obj plumbing.EncodedObject, mode string) error {
+	switch mode {
+	case "-e":
+		return nil
+	case "-t":
+		fmt.Println(obj.Type())
+		return nil
+	case "-s":
+		fmt.Println(obj.Size())
+		return nil
+	}
+
+	if obj.Type() == plumbing.TreeObject {
+		tree, err := object.DecodeTree(repo.Storer, obj)
+		if err != nil {
+			return err
+		}
+		for _, entry := range tree.Entries {
+			printTreeEntry(entry, entry.Name, false)
+		}
+		return nil
+	}
+
+	reader, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
+
+// printMGitObject prints an MGit commit object, using its stored JSON form
+// for the content and size
+func printMGitObject(commit *MCommitStruct, mode string) error {
+	data, err := json.MarshalIndent(commit, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case "-t":
+		fmt.Println(commit.Type)
+	case "-s":
+		fmt.Println(len(data))
+	case "-p":
+		fmt.Println(string(data))
+	}
+	return nil
+}
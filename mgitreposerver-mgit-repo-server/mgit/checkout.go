@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Checking out a branch compares its Git tip with its MGit ref. They
+// drift apart when the branch moves outside mgit, e.g. by a plain git
+// commit or reset, and the MGit side would otherwise go on silently
+// describing another commit. A mismatch is reported; mgit checkout
+// --reconcile regenerates the MGit side from Git: the ref moves to the
+// tip's MGit commit, and Git commits without one get MGit objects
+// attributed to user.pubkey, as mgit git -- does for commits it sees made.
+
+// branchRefMismatch is how a branch's MGit ref disagrees with Git
+type branchRefMismatch struct {
+	Branch  string
+	GitTip  string
+	TipMGit string // MGit hash of the tip, "" if it has none
+	MGitRef string // what the MGit ref holds, "" if there is none
+}
+
+// String describes the mismatch
+func (m *branchRefMismatch) String() string {
+	tip := shortHash(m.GitTip)
+	if m.TipMGit != "" {
+		tip = fmt.Sprintf("%s (MGit %s)", tip, shortHash(m.TipMGit))
+	} else {
+		tip += " (no MGit commit)"
+	}
+	if m.MGitRef == "" {
+		return fmt.Sprintf("branch '%s' is at Git commit %s, but has no MGit ref", m.Branch, tip)
+	}
+	ref := shortHash(m.MGitRef)
+	if commit, err := NewMGitStorage().GetCommit(m.MGitRef); err == nil {
+		ref = fmt.Sprintf("%s (Git %s)", ref, shortHash(commit.GitHash))
+	}
+	return fmt.Sprintf("branch '%s' is at Git commit %s, but its MGit ref points at %s", m.Branch, tip, ref)
+}
+
+// checkBranchRefs compares a branch's Git tip with its MGit ref. It
+// returns nil when they agree, or when no commit on the branch has ever
+// had an MGit side.
+func checkBranchRefs(repo *git.Repository, storage *MGitStorage, branch string) (*branchRefMismatch, error) {
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return nil, err
+	}
+	m := &branchRefMismatch{Branch: branch, GitTip: ref.Hash().String()}
+	m.TipMGit, _ = storage.GetMGitHashFromGit(m.GitTip)
+	m.MGitRef, _ = storage.GetRef(plumbing.NewBranchReferenceName(branch).String())
+
+	if m.MGitRef != m.TipMGit {
+		return m, nil
+	}
+	if m.MGitRef != "" {
+		return nil, nil
+	}
+
+	// Neither has an MGit hash: a plain Git branch, unless it grew out of
+	// MGit commits
+	mappings, err := storage.GetMappings()
+	if err != nil || len(mappings) == 0 {
+		return nil, err
+	}
+	ancestors, err := gitAncestors(repo, ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		if ancestors[plumbing.NewHash(mapping.GitHash)] {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// verifyBranchRefs checks every branch's MGit ref against its Git tip,
+// printing the ones that drifted. With fix, a drifted ref is moved to the
+// MGit commit its tip maps to, with a reflog entry; a tip without one
+// needs mgit checkout --reconcile. It reports whether all refs agree, or
+// were fixed.
+func verifyBranchRefs(repo *git.Repository, storage *MGitStorage, fix bool) (bool, error) {
+	branches, err := repo.Branches()
+	if err != nil {
+		return false, err
+	}
+	mismatches := []*branchRefMismatch{}
+	err = branches.ForEach(func(ref *plumbing.Reference) error {
+		m, err := checkBranchRefs(repo, storage, ref.Name().Short())
+		if m != nil {
+			mismatches = append(mismatches, m)
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	for _, m := range mismatches {
+		fmt.Printf("Ref drift: %s\n", m)
+		switch {
+		case !fix:
+			ok = false
+		case m.TipMGit == "":
+			fmt.Printf("  can't fix: run 'mgit checkout --reconcile %s' to create its MGit commits\n", m.Branch)
+			ok = false
+		default:
+			setReflogMessage("fix drifted ref to match Git %s", shortHash(m.GitTip))
+			if err := storage.UpdateRef(plumbing.NewBranchReferenceName(m.Branch).String(), m.TipMGit); err != nil {
+				return false, err
+			}
+			fmt.Printf("  fixed: %s -> %s\n", m.Branch, shortHash(m.TipMGit))
+		}
+	}
+	if !ok && !fix {
+		fmt.Println("Run 'mgit verify --fix-refs' to point the MGit refs at their Git tips")
+	}
+	return ok, nil
+}
+
+// reconcileBranchRef regenerates a branch's MGit side from its Git tip
+func reconcileBranchRef(repo *git.Repository, storage *MGitStorage, m *branchRefMismatch) error {
+	if m.TipMGit == "" {
+		pubkey := GetNostrPubKey()
+		if pubkey == "" {
+			return fmt.Errorf("the branch has commits without MGit objects; set user.pubkey to attribute them")
+		}
+
+		// Walk back from the tip to the commits MGit already knows
+		mappings, err := storage.GetMappings()
+		if err != nil {
+			return err
+		}
+		known := map[plumbing.Hash]bool{}
+		for _, mapping := range mappings {
+			known[plumbing.NewHash(mapping.GitHash)] = true
+		}
+		commits, err := newGitCommits(repo, []plumbing.Hash{plumbing.NewHash(m.GitTip)}, known)
+		if err != nil {
+			return err
+		}
+		for _, commit := range commits {
+			if err := storeReconciledCommit(storage, commit, pubkey); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("MGit: created %d MGit commit object(s) for commits made outside mgit\n", len(commits))
+
+		if m.TipMGit, err = storage.GetMGitHashFromGit(m.GitTip); err != nil {
+			return err
+		}
+	}
+
+	if err := storage.UpdateRef(plumbing.NewBranchReferenceName(m.Branch).String(), m.TipMGit); err != nil {
+		return err
+	}
+	fmt.Printf("MGit: %s -> %s\n", m.Branch, shortHash(m.TipMGit))
+	return nil
+}
+
+// switchToRevision checks out a branch, or a commit by Git or MGit hash
+// with a detached HEAD, returning the branch name ("" when detached).
+// Only the files that differ change, so untracked files and .mgit stay.
+func switchToRevision(repo *git.Repository, rev string) (string, error) {
+	branch := ""
+	var target plumbing.Hash
+	if ref, err := repo.Reference(plumbing.NewBranchReferenceName(rev), true); err == nil {
+		if path := branchCheckedOutElsewhere(rev); path != "" {
+			return "", fmt.Errorf("'%s' is already checked out at '%s'", rev, path)
+		}
+		branch, target = rev, ref.Hash()
+	} else {
+		hash, err := resolveGitRevision(repo, rev)
+		if err != nil {
+			return "", err
+		}
+		target = hash
+	}
+
+	from := plumbing.ZeroHash
+	if head, err := repo.Head(); err == nil {
+		from = head.Hash()
+	}
+	if err := switchWorktree(repo, from, target); err != nil {
+		return "", err
+	}
+
+	head := plumbing.NewHashReference(plumbing.HEAD, target)
+	if branch != "" {
+		head = plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch))
+	}
+	return branch, repo.Storer.SetReference(head)
+}
+
+// createBranchAt creates a branch at a commit and switches to it. The
+// worktree already holds the commit, so it isn't touched; the MGit ref
+// starts where the MGit HEAD is.
+func createBranchAt(repo *git.Repository, branch string, hash plumbing.Hash) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	if _, err := repo.Reference(name, false); err == nil {
+		return fmt.Errorf("a branch named '%s' already exists", branch)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name)); err != nil {
+		return err
+	}
+
+	storage := NewMGitStorage()
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		return nil
+	}
+	if mgitHash, err := storage.GetMGitHashFromGit(hash.String()); err == nil {
+		setReflogMessage("Created from %s", shortHash(mgitHash))
+		if err := storage.UpdateRef(name.String(), mgitHash); err != nil {
+			return err
+		}
+		setReflogMessage("")
+	}
+	return followGitHead(repo, storage)
+}
+
+// checkCheckedOutBranch runs after a checkout: it moves the MGit HEAD
+// along, then checks the branch's refs, reconciling them if asked to
+func checkCheckedOutBranch(repo *git.Repository, branch string, reconcile bool) error {
+	storage := NewMGitStorage()
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		return nil
+	}
+	// With sparse metadata, a branch not checked out before may have none
+	if head, err := repo.Head(); err == nil {
+		materializeSparseCommit(repo, storage, head.Hash())
+	}
+	if err := followGitHead(repo, storage); err != nil {
+		return err
+	}
+	if branch == "" {
+		return nil
+	}
+
+	m, err := checkBranchRefs(repo, storage, branch)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		if reconcile {
+			fmt.Printf("MGit: %s already agrees with Git\n", branch)
+		}
+		return nil
+	}
+	if reconcile {
+		return reconcileBranchRef(repo, storage, m)
+	}
+	fmt.Printf("Warning: %s\n", m)
+	fmt.Printf("  Run 'mgit checkout --reconcile %s' to regenerate the MGit side from Git\n", branch)
+	return nil
+}
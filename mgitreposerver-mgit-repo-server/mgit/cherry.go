@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// HandleCherry handles the cherry command. It lists the commits of head
+// that are not in upstream, marking with "-" those whose change has already
+// been applied upstream under another hash and with "+" those that haven't.
+func HandleCherry(args []string) {
+	verbose := false
+	revisions := []string{}
+	for _, arg := range args {
+		if arg == "-v" {
+			verbose = true
+		} else {
+			revisions = append(revisions, arg)
+		}
+	}
+
+	if len(revisions) < 1 || len(revisions) > 2 {
+		fmt.Println("Usage: mgit cherry [-v] <upstream> [<head>]")
+		os.Exit(1)
+	}
+	head := "HEAD"
+	if len(revisions) == 2 {
+		head = revisions[1]
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+
+	upstreamCommit, err := resolveMGitRevision(repo, storage, revisions[0])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	headCommit, err := resolveMGitRevision(repo, storage, head)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Patch IDs of the changes only upstream has
+	upstreamPatches := map[string]bool{}
+	for _, commit := range mgitRange(storage, []string{upstreamCommit.MGitHash}, []string{headCommit.MGitHash}) {
+		if id, err := patchID(repo, commit); err == nil && id != "" {
+			upstreamPatches[id] = true
+		}
+	}
+
+	// Oldest first, like git cherry
+	local := mgitRange(storage, []string{headCommit.MGitHash}, []string{upstreamCommit.MGitHash})
+	for i := len(local) - 1; i >= 0; i-- {
+		commit := local[i]
+		mark := "+"
+		if id, err := patchID(repo, commit); err == nil && upstreamPatches[id] {
+			mark = "-"
+		}
+
+		if verbose {
+			subject := commit.Message
+			if idx := strings.Index(subject, "\n"); idx != -1 {
+				subject = subject[:idx]
+			}
+			fmt.Printf("%s %s %s\n", mark, commit.MGitHash, subject)
+		} else {
+			fmt.Printf("%s %s\n", mark, commit.MGitHash)
+		}
+	}
+}
+
+// patchID computes a stable ID for the change a commit introduces relative
+// to its first parent, independent of line numbers and whitespace, so the
+// same change applied on top of different history gets the same ID. Merges
+// have no patch ID.
+func patchID(repo *git.Repository, mgitCommit *MCommitStruct) (string, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(mgitCommit.GitHash))
+	if err != nil {
+		return "", err
+	}
+	if commit.NumParents() > 1 {
+		return "", nil
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+	var parentTree *object.Tree
+	if commit.NumParents() == 1 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return "", err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return "", err
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return "", err
+	}
+	patch, err := changes.Patch()
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha1.New()
+	for _, filePatch := range patch.FilePatches() {
+		from, to := filePatch.Files()
+		if from != nil {
+			fmt.Fprintf(hasher, "a/%s\n", from.Path())
+		}
+		if to != nil {
+			fmt.Fprintf(hasher, "b/%s\n", to.Path())
+		}
+		for _, chunk := range filePatch.Chunks() {
+			prefix := ""
+			switch chunk.Type() {
+			case diff.Add:
+				prefix = "+"
+			case diff.Delete:
+				prefix = "-"
+			default:
+				continue
+			}
+			for _, line := range strings.Split(chunk.Content(), "\n") {
+				line = strings.Join(strings.Fields(line), "")
+				if line != "" {
+					hasher.Write([]byte(prefix + line + "\n"))
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
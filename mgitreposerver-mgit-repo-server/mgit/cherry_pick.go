@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// A cherry-pick stopped on conflicts leaves CHERRY_PICK_HEAD, naming the
+// picked commit, and MERGE_MSG, as git does. The next mgit commit, or
+// mgit cherry-pick --continue, finishes it.
+const cherryPickHeadFile = "CHERRY_PICK_HEAD"
+
+// loadPendingCherryPick returns the cherry-pick in progress, or nil
+func loadPendingCherryPick() (*pendingMerge, error) {
+	return loadStoppedState(cherryPickHeadFile)
+}
+
+func clearCherryPickState() {
+	os.Remove(filepath.Join(mgitDir(), cherryPickHeadFile))
+	os.Remove(filepath.Join(mgitDir(), mergeMsgFile))
+}
+
+// HandleCherryPick handles the cherry-pick command, which applies the
+// changes a commit, from any branch, makes onto the current branch:
+//
+//	mgit cherry-pick [-n] [-x] [-m <parent>] [-S] [-s] [--no-verify] <commit>
+//	mgit cherry-pick --continue | --abort
+//
+// The commit can be named by Git or MGit hash. The pick is a new MGit
+// commit on top of HEAD, so its MGit parent is the current branch's MGit
+// commit and it gets its own MGit hash and mapping; it keeps the picked
+// commit's message, author, date and pubkey. -x notes the picked commit's
+// MGit hash in the message; -n stages the changes without committing.
+func HandleCherryPick(args []string) {
+	noCommit, recordOrigin, cont, abort := false, false, false, false
+	mainline := 0
+	commitArgs := []string{}
+	revisions := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--continue":
+			cont = true
+		case arg == "--abort":
+			abort = true
+		case arg == "-n" || arg == "--no-commit":
+			noCommit = true
+		case arg == "-x":
+			recordOrigin = true
+		case arg == "-m" || arg == "--mainline":
+			if i+1 >= len(args) {
+				fmt.Printf("Error: %s needs a parent number\n", arg)
+				os.Exit(1)
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				fmt.Printf("Error: invalid parent number %s\n", args[i])
+				os.Exit(1)
+			}
+			mainline = n
+		case arg == "-S" || arg == "--sign" || arg == "-s" || arg == "--signoff" || arg == "--no-verify":
+			commitArgs = append(commitArgs, arg)
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printCherryPickUsage()
+			os.Exit(1)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	switch {
+	case cont && len(revisions) == 0:
+		continueCherryPick(commitArgs)
+		return
+	case abort && len(revisions) == 0:
+		if err := abortCherryPick(getRepo()); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(revisions) != 1 || cont || abort {
+		printCherryPickUsage()
+		os.Exit(1)
+	}
+
+	if state, err := loadRebaseState(); err != nil || state != nil {
+		fmt.Println("Error: a rebase is in progress; run mgit rebase --continue or --abort")
+		os.Exit(1)
+	}
+	if merge, err := loadPendingMerge(); err != nil || merge != nil {
+		fmt.Println("Error: a merge is in progress; commit the result or run mgit merge --abort")
+		os.Exit(1)
+	}
+	if revert, err := loadPendingRevert(); err != nil || revert != nil {
+		fmt.Println("Error: a revert is in progress; run mgit revert --continue or --abort")
+		os.Exit(1)
+	}
+	if pick, err := loadPendingCherryPick(); err != nil || pick != nil {
+		fmt.Println("Error: a cherry-pick is in progress; run mgit cherry-pick --continue or --abort")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	head, err := repo.Head()
+	if err != nil {
+		fmt.Printf("Error getting HEAD: %s\n", err)
+		os.Exit(1)
+	}
+	target, err := resolveCommitRevision(repo, storage, revisions[0])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	commit, err := repo.CommitObject(target)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	parent := plumbing.ZeroHash
+	switch {
+	case commit.NumParents() > 1 && mainline == 0:
+		fmt.Printf("Error: commit %s is a merge but no -m option was given\n", shortHash(target.String()))
+		os.Exit(1)
+	case mainline > commit.NumParents():
+		fmt.Printf("Error: commit %s does not have parent %d\n", shortHash(target.String()), mainline)
+		os.Exit(1)
+	case mainline > 0:
+		parent = commit.ParentHashes[mainline-1]
+	case commit.NumParents() == 1:
+		parent = commit.ParentHashes[0]
+	}
+
+	// The pick is committed from the index, so it must be clean
+	if !noCommit {
+		if staged, err := hasStagedChanges(repo); err != nil {
+			fmt.Printf("Error getting status: %s\n", err)
+			os.Exit(1)
+		} else if staged {
+			fmt.Println("Error: you have staged changes; commit or unstage them before cherry-picking")
+			os.Exit(1)
+		}
+	}
+
+	message := strings.TrimRight(commit.Message, "\n")
+	if recordOrigin {
+		hash := target.String()
+		if mgitHash, err := storage.GetMGitHashFromGit(hash); err == nil && mgitHash != "" {
+			hash = mgitHash
+		}
+		message += fmt.Sprintf("\n\n(cherry picked from commit %s)", hash)
+	}
+
+	result, err := mergeTrees(repo, parent, head.Hash(), target, mergeLabels{
+		Ours:   "HEAD",
+		Theirs: commitOneline(repo, target),
+	})
+	if err == nil {
+		err = checkMergeWorktree(repo, head.Hash(), result)
+	}
+	if err == nil {
+		err = writeMergeResult(repo, result)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(result.Conflicts) > 0 {
+		for _, conflict := range result.Conflicts {
+			fmt.Println(conflict.Message)
+		}
+		if !noCommit {
+			if err := saveStoppedState(cherryPickHeadFile, target, message, result.Conflicts); err != nil {
+				fmt.Printf("Error saving cherry-pick state: %s\n", err)
+			}
+		}
+		fmt.Printf("Could not apply %s\n", commitOneline(repo, target))
+		fmt.Println("Resolve all conflicts, stage them with mgit add, then run mgit cherry-pick --continue.")
+		fmt.Println("To go back to where you were, run mgit cherry-pick --abort.")
+		os.Exit(1)
+	}
+	if noCommit {
+		return
+	}
+	if staged, err := hasStagedChanges(repo); err == nil && !staged {
+		fmt.Printf("Error: %s changes nothing on top of HEAD\n", commitOneline(repo, target))
+		os.Exit(1)
+	}
+
+	author, date, pubkey := pickedAuthor(repo, storage, target)
+	commitArgs = append(commitArgs, "-m", message, "--author", author, "--date", date)
+	if pubkey != "" {
+		commitArgs = append(commitArgs, "--pubkey", pubkey)
+	}
+	HandleMGitCommit(commitArgs)
+}
+
+func printCherryPickUsage() {
+	fmt.Println("Usage: mgit cherry-pick [-n] [-x] [-m <parent>] [-S] [-s] [--no-verify] <commit>")
+	fmt.Println("       mgit cherry-pick --continue | --abort")
+}
+
+// pickedAuthor returns a picked commit's author, date and pubkey as mgit
+// commit takes them. The pubkey is "" when the commit has no MGit commit.
+func pickedAuthor(repo *git.Repository, storage *MGitStorage, hash plumbing.Hash) (string, string, string) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return "", "", ""
+	}
+	author := fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email)
+	date := fmt.Sprintf("%d %s", commit.Author.When.Unix(), commit.Author.When.Format("-0700"))
+	pubkey := ""
+	if mgitHash, err := storage.GetMGitHashFromGit(hash.String()); err == nil {
+		if old, err := storage.GetCommit(mgitHash); err == nil && old.Author != nil {
+			pubkey = old.Author.Pubkey
+		}
+	}
+	return author, date, pubkey
+}
+
+// continueCherryPick commits a stopped cherry-pick once its conflicts are
+// resolved
+func continueCherryPick(commitArgs []string) {
+	pick, err := loadPendingCherryPick()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if pick == nil {
+		fmt.Println("Error: no cherry-pick in progress")
+		os.Exit(1)
+	}
+	// The commit checks the conflicts are resolved and takes the message
+	// and author
+	HandleMGitCommit(commitArgs)
+}
+
+// abortCherryPick puts back HEAD's version of every path a stopped
+// cherry-pick staged or left conflicted
+func abortCherryPick(repo *git.Repository) error {
+	pick, err := loadPendingCherryPick()
+	if err != nil {
+		return err
+	}
+	if pick == nil {
+		return fmt.Errorf("no cherry-pick in progress")
+	}
+	if err := restoreHead(repo, pick.Conflicts); err != nil {
+		return err
+	}
+	clearCherryPickState()
+	return nil
+}
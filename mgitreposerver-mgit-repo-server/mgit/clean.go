@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mgit clean removes untracked files from the working tree, so boxes
+// without git installed can still be tidied:
+//
+//	mgit clean [-n] [-f] [-d] [-x | -X] [--] [<path>...]
+//
+// Like git, it refuses to do anything without -n or -f unless
+// clean.requireForce is false. -d also removes untracked directories, -x
+// also removes ignored files and -X removes only ignored files. .git and
+// .mgit are never touched, nor are nested repositories.
+
+// cleaner finds what a clean would remove
+type cleaner struct {
+	root        string
+	tracked     map[string]bool // tracked files, and every directory above one
+	ignores     *ignoreMatcher
+	paths       []string
+	dirs        bool
+	ignored     bool // remove ignored files too
+	onlyIgnored bool
+}
+
+// HandleClean handles the clean command
+func HandleClean(args []string) {
+	dryRun, force := false, false
+	c := &cleaner{}
+	paths := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		if strings.HasPrefix(arg, "--") {
+			switch arg {
+			case "--dry-run":
+				dryRun = true
+			case "--force":
+				force = true
+			default:
+				printCleanUsage()
+				os.Exit(1)
+			}
+			continue
+		}
+		// Short options can be combined, as in -fdx
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'n':
+				dryRun = true
+			case 'f':
+				force = true
+			case 'd':
+				c.dirs = true
+			case 'x':
+				c.ignored = true
+			case 'X':
+				c.onlyIgnored = true
+			default:
+				printCleanUsage()
+				os.Exit(1)
+			}
+		}
+	}
+	if c.ignored && c.onlyIgnored {
+		fmt.Println("Error: -x and -X cannot be used together")
+		os.Exit(1)
+	}
+	if !dryRun && !force && GetConfigBool("clean.requireForce", true) {
+		fmt.Println("Error: clean.requireForce defaults to true and neither -n nor -f given; refusing to clean")
+		os.Exit(1)
+	}
+
+	for _, arg := range paths {
+		path, err := repoRelativePath(arg)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if path == "." {
+			c.paths = nil
+			break
+		}
+		c.paths = append(c.paths, path)
+	}
+
+	if err := c.load(); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	removals, _, err := c.scan("")
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, path := range removals {
+		if dryRun {
+			fmt.Printf("Would remove %s\n", path)
+			continue
+		}
+		fmt.Printf("Removing %s\n", path)
+		if err := os.RemoveAll(filepath.Join(c.root, filepath.FromSlash(path))); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func printCleanUsage() {
+	fmt.Println("Usage: mgit clean [-n] [-f] [-d] [-x | -X] [--] [<path>...]")
+}
+
+// load reads the index, so tracked paths and their directories are kept
+func (c *cleaner) load() error {
+	repo := getRepo()
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	c.root = repoRoot()
+	c.ignores = newIgnoreMatcher(c.root)
+	c.tracked = map[string]bool{}
+	for _, entry := range idx.Entries {
+		path := entry.Name
+		for path != "." && !c.tracked[path] {
+			c.tracked[path] = true
+			path = filepath.ToSlash(filepath.Dir(path))
+		}
+	}
+	return nil
+}
+
+// scan returns what to remove below dir, directories with a trailing
+// slash, and whether all of dir would go
+func (c *cleaner) scan(dir string) ([]string, bool, error) {
+	entries, err := os.ReadDir(filepath.Join(c.root, filepath.FromSlash(dir)))
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	removals := []string{}
+	whole := true
+	for _, entry := range entries {
+		path := entry.Name()
+		if dir != "" {
+			path = dir + "/" + path
+		}
+		if isMetadataPath(path) || !pathMatches(path, c.paths, entry.IsDir()) {
+			whole = false
+			continue
+		}
+
+		if !entry.IsDir() {
+			if !c.tracked[path] && c.removable(c.ignores.Ignored(path)) {
+				removals = append(removals, path)
+			} else {
+				whole = false
+			}
+			continue
+		}
+
+		// Submodules and other repositories have their own history
+		if _, err := os.Lstat(filepath.Join(c.root, filepath.FromSlash(path), ".git")); err == nil {
+			whole = false
+			continue
+		}
+		switch {
+		case c.tracked[path]:
+			below, _, err := c.scan(path)
+			if err != nil {
+				return nil, false, err
+			}
+			removals = append(removals, below...)
+			whole = false
+		case !c.dirs:
+			whole = false
+		case c.ignores.IgnoredDir(path):
+			if c.removable(true) {
+				removals = append(removals, path+"/")
+			} else {
+				whole = false
+			}
+		default:
+			below, all, err := c.scan(path)
+			if err != nil {
+				return nil, false, err
+			}
+			if all && pathMatches(path, c.paths, false) {
+				removals = append(removals, path+"/")
+			} else {
+				removals = append(removals, below...)
+				whole = false
+			}
+		}
+	}
+	return removals, whole, nil
+}
+
+// removable reports whether an untracked path is cleaned, given whether it
+// is ignored
+func (c *cleaner) removable(ignored bool) bool {
+	if c.onlyIgnored {
+		return ignored
+	}
+	return !ignored || c.ignored
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
@@ -21,25 +22,85 @@ type AuthToken struct {
 	Access  string `json:"access"`
 }
 
-// TokenStore represents the token storage in mgitconfig
+// TokenStore represents the token storage in the mgit config directory
 type TokenStore struct {
 	Tokens []AuthToken `json:"tokens"`
 }
 
 // CloneOptions represents options for the clone command
 type CloneOptions struct {
-	NoCheckout bool
-	Depth      int
-	Branch     string
+	NoCheckout   bool
+	Depth        int
+	Branch       string
+	PinnedPubkey string
+	ServerNpub   string
+	// RecurseSubmodules runs submodule update --init --recursive once the
+	// clone is checked out
+	RecurseSubmodules bool
+	// SparseMetadata sets mgit.sparseMetadata in the clone
+	SparseMetadata bool
+	// RecurseConfig applies the config the server recommends for the
+	// repository
+	RecurseConfig bool
 }
 
 // HandleClone handles the clone command
 func HandleClone(args []string) {
+	opts := CloneOptions{}
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--pinned-pubkey" && i+1 < len(args) {
+			opts.PinnedPubkey = args[i+1]
+			i++
+		} else if strings.HasPrefix(args[i], "--pinned-pubkey=") {
+			opts.PinnedPubkey = strings.TrimPrefix(args[i], "--pinned-pubkey=")
+		} else if args[i] == "--server-npub" && i+1 < len(args) {
+			opts.ServerNpub = args[i+1]
+			i++
+		} else if strings.HasPrefix(args[i], "--server-npub=") {
+			opts.ServerNpub = strings.TrimPrefix(args[i], "--server-npub=")
+		} else if args[i] == "--recurse-submodules" {
+			opts.RecurseSubmodules = true
+		} else if args[i] == "--recurse-config" {
+			opts.RecurseConfig = true
+		} else if args[i] == "--sparse-metadata" {
+			opts.SparseMetadata = true
+		} else if args[i] == "--depth" && i+1 < len(args) {
+			opts.Depth = parseCloneDepth(args[i+1])
+			i++
+		} else if strings.HasPrefix(args[i], "--depth=") {
+			opts.Depth = parseCloneDepth(strings.TrimPrefix(args[i], "--depth="))
+		} else {
+			positional = append(positional, args[i])
+		}
+	}
+	args = positional
+
 	if len(args) < 1 {
-		fmt.Println("Usage: mgit clone <url> [destination]")
+		fmt.Println("Usage: mgit clone [--pinned-pubkey sha256//<base64>] [--server-npub <npub>] [--recurse-submodules] [--recurse-config] [--depth <n>] [--sparse-metadata] <url> [destination]")
 		os.Exit(1)
 	}
 
+	if opts.PinnedPubkey != "" {
+		if err := validatePin(opts.PinnedPubkey); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		// The new repository has no config yet, so expose the pin for origin
+		// through the environment layer of GetConfigValue during the clone
+		os.Setenv("MGIT_REMOTE_ORIGIN_PINNEDPUBKEY", opts.PinnedPubkey)
+	}
+	if opts.ServerNpub != "" {
+		if _, err := decodeNostrKey(opts.ServerNpub, "npub"); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Setenv("MGIT_REMOTE_ORIGIN_SERVERNPUB", opts.ServerNpub)
+	}
+	if opts.SparseMetadata {
+		os.Setenv("MGIT_MGIT_SPARSEMETADATA", "true")
+	}
+
 	url := args[0]
 	destination := ""
 	if len(args) > 1 {
@@ -53,28 +114,91 @@ func HandleClone(args []string) {
 	// Normalize URL to ensure it doesn't end with a slash
 	url = strings.TrimSuffix(url, "/")
 
+	// The server proves who it is before it gets the token
+	if err := verifyServerIdentity("origin", url); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
 	// Get token for the repository
 	token := getTokenForRepo(url)
 
 	// Clone the repository
-	err := cloneRepository(url, destination, token)
+	err := cloneRepository(url, destination, token, &opts)
 	if err != nil {
 		fmt.Printf("Error cloning repository: %s\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Printf("Successfully cloned repository to %s\n", destination)
+
+	if err := applyCloneTemplateHooks(destination); err != nil {
+		fmt.Printf("Warning: Failed to copy template hooks: %s\n", err)
+	}
+	postCloneHook, err := postCloneHookPath(destination)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if opts.RecurseConfig {
+		fmt.Println("Applying the server's recommended config...")
+		if err := applyRecommendedConfig(destination, url, token); err != nil {
+			fmt.Printf("Error: could not apply the recommended config: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.RecurseSubmodules && !opts.NoCheckout {
+		if _, err := os.Stat(filepath.Join(destination, ".gitmodules")); err == nil {
+			if err := runInSubmodule(destination, "submodule", "update", "--init", "--recursive"); err != nil {
+				fmt.Printf("Error: could not update submodules: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// The clone stays even if the hook fails
+	if err := runPostCloneHook(destination, postCloneHook, url); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseCloneDepth parses the value of clone --depth, exiting if it isn't a
+// positive number
+func parseCloneDepth(value string) int {
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 1 {
+		fmt.Printf("Error: --depth must be a positive number, not '%s'\n", value)
+		os.Exit(1)
+	}
+	return depth
 }
 
-// getTokenForRepo retrieves the authentication token for a repository URL
+// getTokenForRepo retrieves the authentication token for a repository URL,
+// asking the configured credential helpers before tokens.json
 func getTokenForRepo(repoURL string) string {
+	if token, ok := credentialFill(repoURL); ok {
+		return token
+	}
+
+	if token, ok := lookupStoredToken(repoURL); ok {
+		return token
+	}
+
+	fmt.Println("No authentication token found for this repository. Please authenticate first using the web interface.")
+	os.Exit(1)
+	return ""
+}
+
+// lookupStoredToken finds the token for a repository URL in tokens.json
+func lookupStoredToken(repoURL string) (string, bool) {
 	// Get the path to the mgit config file
 	configPath := getTokenConfigPath()
 
 	// Check if the file exists
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		fmt.Println("No authentication token found. Please authenticate first using the web interface.")
-		os.Exit(1)
+		return "", false
 	}
 
 	// Read the token file
@@ -94,18 +218,16 @@ func getTokenForRepo(repoURL string) string {
 	// Find the token for the repository
 	for _, t := range store.Tokens {
     // Add diagnostic print statement
-    fmt.Printf("Comparing URLs - Stored: %s, Current: %s\n", t.RepoURL, repoURL)
+    fmt.Fprintf(os.Stderr, "Comparing URLs - Stored: %s, Current: %s\n", t.RepoURL, repoURL)
     
     // Check if the repo URL matches
     if matchRepoURL(t.RepoURL, repoURL) {
-        fmt.Printf("Found matching token for %s\n", repoURL)
-        return t.Token
+        fmt.Fprintf(os.Stderr, "Found matching token for %s\n", repoURL)
+        return t.Token, true
     }
 }
 
-	fmt.Println("No authentication token found for this repository. Please authenticate first using the web interface.")
-	os.Exit(1)
-	return ""
+	return "", false
 }
 
 // matchRepoURL checks if two repository URLs refer to the same repository
@@ -114,7 +236,7 @@ func matchRepoURL(storedURL, providedURL string) bool {
 	storedURL = strings.TrimSuffix(strings.TrimSuffix(storedURL, "/"), ".git")
 	providedURL = strings.TrimSuffix(strings.TrimSuffix(providedURL, "/"), ".git")
 	
-	fmt.Printf("Matching URLs - Stored: %s, Provided: %s\n", storedURL, providedURL)
+	fmt.Fprintf(os.Stderr, "Matching URLs - Stored: %s, Provided: %s\n", storedURL, providedURL)
 	
 	// Check for exact match first
 	if storedURL == providedURL {
@@ -125,7 +247,7 @@ func matchRepoURL(storedURL, providedURL string) bool {
 	storedRepoID := extractRepoIDFromAnyURL(storedURL)
 	providedRepoID := extractRepoIDFromAnyURL(providedURL)
 	
-	fmt.Printf("Extracted RepoIDs - Stored: %s, Provided: %s\n", storedRepoID, providedRepoID)
+	fmt.Fprintf(os.Stderr, "Extracted RepoIDs - Stored: %s, Provided: %s\n", storedRepoID, providedRepoID)
 	
 	// Consider it a match if we can extract valid repo IDs and they match
 	return storedRepoID != "" && providedRepoID != "" && storedRepoID == providedRepoID
@@ -150,18 +272,22 @@ func extractRepoIDFromAnyURL(url string) string {
 	return ""
 }
 
-// getTokenConfigPath returns the path to the token config file
+// getTokenConfigPath returns the path to the token config file, which
+// MGIT_TOKENS_PATH overrides
 func getTokenConfigPath() string {
-	home, err := os.UserHomeDir()
+	if path := os.Getenv("MGIT_TOKENS_PATH"); path != "" {
+		return expandHomePath(path)
+	}
+	dir, err := userConfigDir()
 	if err != nil {
 		fmt.Printf("Error getting home directory: %s\n", err)
 		os.Exit(1)
 	}
-	return filepath.Join(home, ".mgitconfig", "tokens.json")
+	return filepath.Join(dir, "tokens.json")
 }
 
 // cloneRepository clones a repository
-func cloneRepository(url, destination, token string) error {
+func cloneRepository(url, destination, token string, opts *CloneOptions) error {
 	// Create the destination directory if it doesn't exist
 	if err := os.MkdirAll(destination, 0755); err != nil {
 		return fmt.Errorf("error creating destination directory: %w", err)
@@ -174,18 +300,30 @@ func cloneRepository(url, destination, token string) error {
 	if err != nil {
 		return fmt.Errorf("error fetching repository metadata: %w", err)
 	}
+	// The token works, so let credential helpers remember it
+	credentialApprove(url, token)
 
 	fmt.Printf("Repository: %s\nAccess level: %s\n", repoInfo.Name, repoInfo.Access)
 
 	// First, clone the Git data using git-upload-pack
 	fmt.Println("Cloning Git repository data...")
-	if err := cloneGitData(url, destination, token); err != nil {
+	if err := cloneGitData(url, destination, token, opts.Depth); err != nil {
 		return fmt.Errorf("error cloning Git data: %w", err)
 	}
 
-	// Then, fetch and set up the MGit metadata
+	// Then, fetch the MGit objects and set up the metadata, only for the
+	// history a shallow clone has, or for the default branch with sparse
+	// metadata
 	fmt.Println("Fetching MGit metadata...")
-	if err := fetchMGitMetadata(url, destination, token); err != nil {
+	query := ""
+	if opts.Depth > 0 {
+		query = shallowMetadataQuery(destination, opts.Depth)
+	} else if sparseMetadataEnabled() {
+		if repo, err := git.PlainOpen(destination); err == nil {
+			query = sparseMetadataQuery(repo)
+		}
+	}
+	if err := fetchMGitData("origin", url, token, destination, query); err != nil {
 		return fmt.Errorf("error fetching MGit metadata: %w", err)
 	}
 
@@ -196,9 +334,7 @@ func cloneRepository(url, destination, token string) error {
 			// Don't fail the clone operation, but warn the user
 	}
 
-	/* diagnostic code */
-	// Verify MGit setup
-	fmt.Println("Verifying MGit repository setup...")
+	// Check the MGit setup; what it finds is traced with MGIT_TRACE
 
 	// Check HEAD file
 	headPath := filepath.Join(destination, ".mgit", "HEAD")
@@ -209,7 +345,7 @@ func cloneRepository(url, destination, token string) error {
 			if err != nil {
 					fmt.Printf("Warning: Could not read HEAD file: %s\n", err)
 			} else {
-					fmt.Printf("MGit HEAD points to: %s\n", string(headContent))
+					traceEvent("clone.head", "ref", string(headContent))
 			}
 	}
 
@@ -224,17 +360,16 @@ func cloneRepository(url, destination, token string) error {
 			} else if len(files) == 0 {
 					fmt.Println("Warning: No branch references found in MGit repository")
 			} else {
-					fmt.Println("MGit branch references:")
 					for _, file := range files {
 							refPath := filepath.Join(refsPath, file.Name())
 							refContent, _ := os.ReadFile(refPath)
-							fmt.Printf("  %s: %s\n", file.Name(), string(refContent))
+							traceEvent("clone.branch", "name", file.Name(), "mgit_hash", string(refContent))
 					}
 			}
 	}
 
 	// Set up the MGit configuration for the cloned repository
-	if err := setupMGitConfig(destination, repoInfo); err != nil {
+	if err := setupMGitConfig(destination, repoInfo, opts); err != nil {
 		return fmt.Errorf("error setting up MGit configuration: %w", err)
 	}
 
@@ -268,7 +403,10 @@ func fetchRepositoryInfo(url, token string) (*RepositoryInfo, error) {
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 	
 	// Make the request
-	client := &http.Client{}
+	client, err := newHTTPClient("origin")
+	if err != nil {
+		return nil, err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %w", err)
@@ -276,6 +414,9 @@ func fetchRepositoryInfo(url, token string) (*RepositoryInfo, error) {
 	defer resp.Body.Close()
 	
 	// Check the response status
+	if resp.StatusCode == http.StatusUnauthorized {
+		credentialReject(url, token)
+	}
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		return nil, fmt.Errorf("error response from server: %s", string(bodyBytes))
@@ -307,8 +448,19 @@ func extractServerBaseURL(url string) string {
 	return url[:lastSlashIndex]
 }
 
-// cloneGitData clones the Git data using git-upload-pack
-func cloneGitData(url, destination, token string) error {
+// repoAPIURL returns the URL of a repository API endpoint for either a clone
+// URL (http://host/repo) or a remote URL (http://host/api/mgit/repos/repo)
+func repoAPIURL(url, endpoint string) string {
+	url = strings.TrimSuffix(url, "/")
+	if strings.Contains(url, "/api/mgit/repos/") {
+		return fmt.Sprintf("%s/%s", url, endpoint)
+	}
+	return fmt.Sprintf("%s/api/mgit/repos/%s/%s", extractServerBaseURL(url), extractRepoID(url), endpoint)
+}
+
+// cloneGitData clones the Git data using git-upload-pack, only the last
+// depth commits of the default branch if depth is set
+func cloneGitData(url, destination, token string, depth int) error {
 	// Extract the repository ID and server base URL
 	repoID := extractRepoID(url)
 	serverBaseURL := extractServerBaseURL(url)
@@ -334,29 +486,33 @@ func cloneGitData(url, destination, token string) error {
 
 	// Use git clone with the -c option for Authorization header
 	authHeader := fmt.Sprintf("http.extraHeader=Authorization: Bearer %s", token)
-	// Debug print statements
-	fmt.Println("Debug info for git clone:")
-	fmt.Printf("  Auth header config: %s\n", authHeader)
-	fmt.Printf("  Token: %s\n", token)
-	fmt.Printf("  Git URL: %s\n", gitURL)
-	fmt.Printf("  Destination: %s\n", destination)
+	// The token stays out of the trace
+	span := startSpan("git.clone", "url", gitURL, "destination", destination)
 	
 	// Use git clone with the temporary config
-	cmd := exec.Command("git", "clone", "-c", authHeader, gitURL, destination)
+	gitArgs := append(gitTLSArgs("origin"), "clone", "-c", authHeader)
+	if depth > 0 {
+		gitArgs = append(gitArgs, "--depth", fmt.Sprint(depth))
+	}
+	gitArgs = append(gitArgs, gitURL, destination)
+	cmd := exec.Command("git", gitArgs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	
 	if err := cmd.Run(); err != nil {
+		span.End(err)
 		return fmt.Errorf("error running git clone: %w", err)
 	}
+	span.End(nil)
 	
 	return nil
 }
 
 // reconstructMGitObjects reconstructs MGit objects from Git commits using mappings
 func reconstructMGitObjects(repoPath string) error {
-	// Create necessary directory structure first
-	mgitDir := filepath.Join(repoPath, ".mgit")
+	// Create necessary directory structure first, in the store a linked
+	// worktree shares with the main one
+	mgitDir := readCommonDir(filepath.Join(repoPath, ".mgit"))
 	objDir := filepath.Join(mgitDir, "objects")
 	refsDir := filepath.Join(mgitDir, "refs")
 	refsHeadsDir := filepath.Join(refsDir, "heads")
@@ -370,34 +526,35 @@ func reconstructMGitObjects(repoPath string) error {
 	}
 
 	// Open the Git repository
-	repo, err := git.PlainOpen(repoPath)
+	repo, err := git.PlainOpenWithOptions(repoPath, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
 	if err != nil {
 			return fmt.Errorf("error opening Git repository: %w", err)
 	}
 	
-	// Use the correct path for hash_mappings.json
-	hashMappingsPath := filepath.Join(repoPath, ".mgit", "mappings", "hash_mappings.json")
+	// Use the mapping store of the repository
+	mappingStore := NewMappingStore(mgitDir)
+	if err := mappingStore.migrate(); err != nil {
+			return fmt.Errorf("error migrating mappings: %w", err)
+	}
+	hashMappingsPath := mappingStore.Path()
 	
 	// Check if the mappings file exists
 	if _, err = os.Stat(hashMappingsPath); os.IsNotExist(err) {
 			return fmt.Errorf("no MGit mappings found in the repository")
 	}
 	
-	// Read the mappings file
-	mappingsData, err := os.ReadFile(hashMappingsPath)
+	// Look mappings up by Git hash for parent and ref resolution in the
+	// sorted file, so huge mapping sets never have to be held in memory
+	mappings, err := mappingStore.OpenSorted()
 	if err != nil {
-			return fmt.Errorf("error reading mappings file: %w", err)
-	}
-	
-	// Parse the mappings
-	var mappings []NostrCommitMapping
-	if err := json.Unmarshal(mappingsData, &mappings); err != nil {
-			return fmt.Errorf("error parsing mappings file: %w", err)
+			return fmt.Errorf("error opening mappings file: %w", err)
 	}
+	defer mappings.Close()
 	
 	// Create the MGit storage
 	storage := &MGitStorage{
-			RootDir: filepath.Join(repoPath, ".mgit"),
+			RootDir: mgitDir,
+			HeadDir: filepath.Join(repoPath, ".mgit"),
 	}
 	
 	// Initialize the MGit storage
@@ -405,65 +562,9 @@ func reconstructMGitObjects(repoPath string) error {
 			return fmt.Errorf("error initializing MGit storage: %w", err)
 	}
 	
-	// Process each mapping
-	for _, mapping := range mappings {
-			// Check if the MGit object already exists
-			_, err := storage.GetCommit(mapping.MGitHash)
-			if err == nil {
-					// Object already exists, skip
-					continue
-			}
-			
-			// Get the Git commit
-			gitHash := plumbing.NewHash(mapping.GitHash)
-			gitCommit, err := repo.CommitObject(gitHash)
-			if err != nil {
-					fmt.Printf("Warning: Could not find Git commit %s: %s\n", mapping.GitHash, err)
-					continue
-			}
-			
-			// Find MGit parent hashes
-			parentMGitHashes := []string{}
-			for _, parentGitHash := range gitCommit.ParentHashes {
-					// Find corresponding MGit hash from mappings
-					for _, m := range mappings {
-							if m.GitHash == parentGitHash.String() {
-									parentMGitHashes = append(parentMGitHashes, m.MGitHash)
-									break
-							}
-					}
-			}
-			
-			// Create the MGit commit object
-			mgitCommit := &MCommitStruct{
-					Type:         MGitCommitObject,
-					MGitHash:     mapping.MGitHash,
-					GitHash:      mapping.GitHash,
-					TreeHash:     gitCommit.TreeHash.String(),
-					ParentHashes: parentMGitHashes,
-					Author: &MGitSignature{
-							Name:   gitCommit.Author.Name,
-							Email:  gitCommit.Author.Email,
-							Pubkey: mapping.Pubkey,
-							When:   gitCommit.Author.When,
-					},
-					Committer: &MGitSignature{
-							Name:   gitCommit.Committer.Name,
-							Email:  gitCommit.Committer.Email,
-							Pubkey: mapping.Pubkey,
-							When:   gitCommit.Committer.When,
-					},
-					Message:  gitCommit.Message,
-					Metadata: map[string]string{"version": "1.0"},
-			}
-			
-			// Store the MGit commit
-			if err := storage.StoreCommit(mgitCommit); err != nil {
-					fmt.Printf("Warning: Could not store MGit commit %s: %s\n", mapping.MGitHash, err)
-					continue
-			}
-			
-			fmt.Printf("Reconstructed MGit commit: %s\n", mapping.MGitHash[:7])
+	// Build the MGit commit objects in parallel
+	if err := rebuildMGitCommits(repoPath, storage, mappings); err != nil {
+			return err
 	}
 	
 	// Update branch references
@@ -478,23 +579,16 @@ func reconstructMGitObjects(repoPath string) error {
 					gitHash := ref.Hash().String()
 					
 					// Find corresponding MGit hash
-					var mgitHash string
-					for _, mapping := range mappings {
-							if mapping.GitHash == gitHash {
-									mgitHash = mapping.MGitHash
-									
-									// Update MGit branch reference
-									refPath := fmt.Sprintf("refs/heads/%s", branchName)
-									if err := storage.UpdateRef(refPath, mapping.MGitHash); err != nil {
-											fmt.Printf("Warning: Could not update branch ref %s: %s\n", branchName, err)
-									} else {
-											fmt.Printf("Set branch reference %s to MGit hash %s\n", branchName, mgitHash[:7])
-									}
-									break
+					mgitHash, _ := mappings.MGitHash(gitHash)
+					if mgitHash != "" {
+							// Update MGit branch reference
+							refPath := fmt.Sprintf("refs/heads/%s", branchName)
+							if err := storage.UpdateRef(refPath, mgitHash); err != nil {
+									fmt.Printf("Warning: Could not update branch ref %s: %s\n", branchName, err)
+							} else {
+									traceEvent("clone.set_ref", "branch", branchName, "mgit_hash", mgitHash)
 							}
-					}
-					
-					if mgitHash == "" {
+					} else {
 							fmt.Printf("Warning: Could not find MGit hash for branch %s at git hash %s\n", branchName, gitHash)
 					}
 			}
@@ -505,6 +599,16 @@ func reconstructMGitObjects(repoPath string) error {
 			return fmt.Errorf("error processing references: %w", err)
 	}
 	
+	// Where a shallow clone's history stops
+	if err := writeMGitShallow(mgitDir, repo, mappings.MGitHash); err != nil {
+			return fmt.Errorf("error writing shallow file: %w", err)
+	}
+	
+	// Remote-tracking branches, so the server's branches can be named by MGit hash
+	if err := updateRemoteTrackingRefs(repo, storage, ""); err != nil {
+			return fmt.Errorf("error updating remote-tracking branches: %w", err)
+	}
+	
 	// Update HEAD
 	head, err := repo.Head()
 	if err != nil {
@@ -521,19 +625,13 @@ func reconstructMGitObjects(repoPath string) error {
 					return fmt.Errorf("error writing HEAD file: %w", err)
 			}
 			
-			fmt.Printf("Set HEAD to branch: %s\n", branchName)
+			traceEvent("clone.set_head", "branch", branchName)
 	} else {
 			// Detached HEAD - try to find the corresponding MGit hash
 			gitHash := head.Hash().String()
 			
 			// Find the MGit hash for this Git hash
-			var mgitHash string
-			for _, mapping := range mappings {
-					if mapping.GitHash == gitHash {
-							mgitHash = mapping.MGitHash
-							break
-					}
-			}
+			mgitHash, _ := mappings.MGitHash(gitHash)
 			
 			if mgitHash == "" {
 					return fmt.Errorf("could not find MGit hash for detached HEAD at %s", gitHash)
@@ -545,80 +643,60 @@ func reconstructMGitObjects(repoPath string) error {
 					return fmt.Errorf("error writing HEAD file: %w", err)
 			}
 			
-			fmt.Printf("Set HEAD to detached commit: %s\n", mgitHash[:7])
+			traceEvent("clone.set_head", "mgit_hash", mgitHash)
 	}
 	
 	return nil
 }
 
-// fetchMGitMetadata fetches the MGit metadata and sets it up in the repository
-func fetchMGitMetadata(url, destination, token string) error {
-	// Extract the repository ID and server base URL
-	repoID := extractRepoID(url)
-	serverBaseURL := extractServerBaseURL(url)
+// fetchMGitMetadata fetches the MGit metadata and sets it up in the
+// repository. A shallow repository keeps only the mappings of the commits
+// it has.
+func fetchMGitMetadata(remoteName, url, destination, token, query string) error {
+	mgitDir := readCommonDir(filepath.Join(destination, ".mgit"))
 	
-	// Construct the URL for the MGit metadata endpoint
-	metadataURL := fmt.Sprintf("%s/api/mgit/repos/%s/metadata", serverBaseURL, repoID)
-	
-	// Create the request
-	req, err := http.NewRequest("GET", metadataURL, nil)
-	if err != nil {
-			return fmt.Errorf("error creating request: %w", err)
+	// Create the .mgit directory structure
+	mappingsDir := filepath.Join(mgitDir, "mappings")
+	if err := os.MkdirAll(mappingsDir, 0755); err != nil {
+			return fmt.Errorf("error creating .mgit/mappings directory: %w", err)
 	}
 	
-	// Add the authorization header
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	
-	// Make the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// Stream the server's mappings page by page into a new mapping file
+	store := NewMappingStore(mgitDir)
+	writer, err := newMappingFileWriter(store.Path() + ".tmp", false)
 	if err != nil {
-			return fmt.Errorf("error making request: %w", err)
+			return err
 	}
-	defer resp.Body.Close()
+	defer writer.Abort()
 	
-	// Check the response status
-	if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			return fmt.Errorf("error response from server: %s", string(bodyBytes))
+	add := writer.Add
+	if repo, shallow := openShallowRepo(destination); shallow {
+		add = keepLocalMappings(repo, writer.Add)
 	}
-	
-	// Parse the response to get the mappings
-	var mappings []interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&mappings); err != nil {
-			return fmt.Errorf("error parsing metadata response: %w", err)
+	notModified, err := fetchMetadataPages(remoteName, url, token, mgitDir, query, add)
+	if err != nil {
+			return err
 	}
-	
-	// Create the .mgit directory structure
-	mgitDir := filepath.Join(destination, ".mgit")
-	mappingsDir := filepath.Join(mgitDir, "mappings")
-	if err := os.MkdirAll(mappingsDir, 0755); err != nil {
-			return fmt.Errorf("error creating .mgit/mappings directory: %w", err)
+	if notModified {
+			fmt.Println("MGit metadata unchanged on server, using cached copy")
 	}
 	
-	// Write the hash_mappings.json file
-	mappingsPath := filepath.Join(mappingsDir, "hash_mappings.json")
-	mappingsJSON, err := json.MarshalIndent(mappings, "", "  ")
-	if err != nil {
-			return fmt.Errorf("error serializing mappings: %w", err)
+	// Keep mappings of local commits the server doesn't know about yet
+	if err := store.ForEach(writer.Add); err != nil {
+			return fmt.Errorf("error reading local mappings: %w", err)
 	}
 	
-	if err := os.WriteFile(mappingsPath, mappingsJSON, 0644); err != nil {
+	// Write the hash_mappings.json file
+	if err := writer.Commit(store.Path()); err != nil {
 			return fmt.Errorf("error writing hash_mappings.json file: %w", err)
 	}
 	
-	// ADDED: Also write to nostr_mappings.json for compatibility
-	nostrMappingsPath := filepath.Join(mgitDir, "nostr_mappings.json")
-	if err := os.WriteFile(nostrMappingsPath, mappingsJSON, 0644); err != nil {
-			return fmt.Errorf("error writing nostr_mappings.json file: %w", err)
-	}
-	
-	fmt.Printf("Successfully fetched and stored MGit metadata\n")
+	fmt.Printf("Successfully fetched and stored %d MGit mappings\n", writer.count)
 	return nil
 }
 
 // setupMGitConfig sets up the MGit configuration for the cloned repository
-func setupMGitConfig(destination string, repoInfo *RepositoryInfo) error {
+func setupMGitConfig(destination string, repoInfo *RepositoryInfo, opts *CloneOptions) error {
 	// Create the MGit config
 	configPath := filepath.Join(destination, ".mgit", "config")
 	
@@ -641,6 +719,17 @@ func setupMGitConfig(destination string, repoInfo *RepositoryInfo) error {
 	config.Set("repository", "id", repoInfo.ID)
 	config.Set("repository", "name", repoInfo.Name)
 	
+	// Remember the pin so later pulls and pushes keep verifying the server
+	if opts.PinnedPubkey != "" {
+		config.Set(`remote "origin"`, "pinnedPubkey", opts.PinnedPubkey)
+	}
+	if opts.ServerNpub != "" {
+		config.Set(`remote "origin"`, "serverNpub", opts.ServerNpub)
+	}
+	if opts.SparseMetadata {
+		config.Set("mgit", "sparseMetadata", "true")
+	}
+	
 	// Save the config
 	if err := config.Save(configPath); err != nil {
 		return fmt.Errorf("error saving MGit config: %w", err)
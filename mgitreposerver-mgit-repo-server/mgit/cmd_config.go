@@ -13,18 +13,27 @@ func HandleConfig(args []string) {
 		return
 	}
 
-	// Check for --global flag
-	isGlobal := false
+	// Check for --global and --validate flags
+	isGlobal, validate := false, false
 	filteredArgs := []string{}
 	for _, arg := range args {
 		if arg == "--global" {
 			isGlobal = true
+		} else if arg == "--validate" {
+			validate = true
 		} else {
 			filteredArgs = append(filteredArgs, arg)
 		}
 	}
 	args = filteredArgs
 
+	if validate && len(args) == 0 {
+		if !validateConfigFiles(isGlobal) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(args) == 1 {
 		// Get a config value
 		value := GetConfigValue(args[0], "")
@@ -40,6 +49,10 @@ func HandleConfig(args []string) {
 		// Set a config value
 		key := args[0]
 		value := args[1]
+		if err := validateConfigValue(key, value); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
 		err := SetConfigValue(key, value, isGlobal)
 		if err != nil {
 			fmt.Printf("Error setting config value: %s\n", err)
@@ -50,6 +63,7 @@ func HandleConfig(args []string) {
 	}
 
 	fmt.Println("Usage: mgit config [--global] [<key> [<value>]]")
+	fmt.Println("       mgit config [--global] --validate")
 	os.Exit(1)
 }
 
@@ -73,6 +87,36 @@ func listConfig() {
 	}
 }
 
+// validateConfigFiles checks the values in the local and global config, or
+// only the global one, against the schema of known keys. It reports false if
+// any is invalid.
+func validateConfigFiles(globalOnly bool) bool {
+	valid := true
+	for _, global := range []bool{false, true} {
+		if globalOnly && !global {
+			continue
+		}
+		path := GetConfigFilePath(global)
+		config, err := LoadConfig(path)
+		if err != nil {
+			fmt.Printf("Error reading %s config: %s\n", getConfigType(global), err)
+			valid = false
+			continue
+		}
+		problems := validateConfig(config)
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", path)
+			continue
+		}
+		valid = false
+		fmt.Printf("%s:\n", path)
+		for _, problem := range problems {
+			fmt.Printf("\t%s\n", problem)
+		}
+	}
+	return valid
+}
+
 // printConfig prints a config
 func printConfig(config *Config) {
 	for section, values := range config.Sections {
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// diffSide is one side of a diff: the files of a commit, the index or the
+// working tree. Working tree files that differ from the index are read to
+// be hashed, and their content is kept, as is the dirt of submodules with
+// changes of their own.
+type diffSide struct {
+	Entries map[string]*mergeEntry
+	Content map[string][]byte
+	Dirt    map[string]submoduleDirt
+}
+
+// read returns a file's content. A submodule reads as the line git shows
+// for it, marked -dirty when its checkout has changes.
+func (s *diffSide) read(repo *git.Repository, path string) ([]byte, error) {
+	if content, ok := s.Content[path]; ok {
+		return content, nil
+	}
+	entry := s.Entries[path]
+	if entry.Mode == filemode.Submodule {
+		dirty := ""
+		if !s.Dirt[path].clean() {
+			dirty = "-dirty"
+		}
+		return []byte("Subproject commit " + entry.Hash.String() + dirty + "\n"), nil
+	}
+	return blobContent(repo, entry.Hash)
+}
+
+// commitDiffSide is the files of a commit; the zero hash stands for the
+// empty tree of an unborn branch
+func commitDiffSide(repo *git.Repository, hash plumbing.Hash) (*diffSide, error) {
+	side := &diffSide{Entries: map[string]*mergeEntry{}}
+	if hash.IsZero() {
+		return side, nil
+	}
+	entries, err := treeEntries(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	side.Entries = entries
+	return side, nil
+}
+
+// indexDiffSide is the files in the index
+func indexDiffSide(repo *git.Repository) (*diffSide, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	side := &diffSide{Entries: map[string]*mergeEntry{}}
+	for _, entry := range idx.Entries {
+		side.Entries[entry.Name] = &mergeEntry{Hash: entry.Hash, Mode: entry.Mode}
+	}
+	return side, nil
+}
+
+// worktreeDiffSide is the tracked files in the working tree: the index,
+// with the files the status finds changed read from disk
+func worktreeDiffSide(repo *git.Repository, index *diffSide) (*diffSide, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("error getting worktree: %w", err)
+	}
+	status, err := scanStatus(repo, w)
+	if err != nil {
+		return nil, fmt.Errorf("error getting status: %w", err)
+	}
+
+	side := &diffSide{Entries: map[string]*mergeEntry{}, Content: map[string][]byte{}, Dirt: map[string]submoduleDirt{}}
+	for path, entry := range index.Entries {
+		side.Entries[path] = entry
+		if entry.Mode != filemode.Submodule {
+			continue
+		}
+		dirt, err := submoduleDirtState(filepath.Join(repoRoot(), filepath.FromSlash(path)))
+		if err != nil {
+			return nil, err
+		}
+		if !dirt.clean() {
+			side.Dirt[path] = dirt
+		}
+	}
+	for path, fileStatus := range status {
+		if side.Entries[path] == nil || (fileStatus.Worktree != git.Modified && fileStatus.Worktree != git.Deleted) {
+			continue
+		}
+		if side.Entries[path].Mode == filemode.Submodule {
+			head, err := submoduleHead(filepath.Join(repoRoot(), filepath.FromSlash(path)))
+			if err != nil {
+				return nil, err
+			}
+			side.Entries[path] = &mergeEntry{Hash: head, Mode: filemode.Submodule}
+			continue
+		}
+		current, err := readApplyTarget(repo, path, false)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			delete(side.Entries, path)
+			continue
+		}
+		side.Entries[path] = &mergeEntry{Hash: plumbing.ComputeHash(plumbing.BlobObject, current.Content), Mode: current.Mode}
+		side.Content[path] = current.Content
+	}
+	return side, nil
+}
+
+// diffOptions are what diff prints
+type diffOptions struct {
+	Context    int
+	NameOnly   bool
+	NameStatus bool
+	Submodule  string // how submodules are shown: short or log
+}
+
+// changedPaths lists, sorted, the paths under the pathspecs whose files
+// differ between the sides, or whose submodule has changes of its own
+func changedPaths(a, b *diffSide, pathspecs []string) []string {
+	paths := []string{}
+	for path, entry := range a.Entries {
+		changed := !sameEntry(entry, b.Entries[path]) || !b.Dirt[path].clean()
+		if changed && pathMatches(path, pathspecs, false) {
+			paths = append(paths, path)
+		}
+	}
+	for path := range b.Entries {
+		if a.Entries[path] == nil && pathMatches(path, pathspecs, false) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeDiff writes the differences between two sides as a unified diff,
+// computed here rather than by git
+func writeDiff(w io.Writer, repo *git.Repository, a, b *diffSide, pathspecs []string, opts *diffOptions) (int, error) {
+	paths := changedPaths(a, b, pathspecs)
+	for _, path := range paths {
+		from, to := a.Entries[path], b.Entries[path]
+		switch {
+		case opts.NameOnly:
+			fmt.Fprintln(w, path)
+			continue
+		case opts.NameStatus:
+			status := "M"
+			if from == nil {
+				status = "A"
+			} else if to == nil {
+				status = "D"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", status, path)
+			continue
+		case opts.Submodule == "log" && isSubmoduleChange(from, to):
+			writeSubmoduleLog(w, path, from, to, b.Dirt[path])
+			continue
+		}
+		if err := writeFileDiff(w, repo, path, a, b, opts.Context); err != nil {
+			return 0, err
+		}
+	}
+	return len(paths), nil
+}
+
+// isSubmoduleChange reports whether a change is to a submodule on both
+// sides it exists on
+func isSubmoduleChange(from, to *mergeEntry) bool {
+	return (from == nil || from.Mode == filemode.Submodule) && (to == nil || to.Mode == filemode.Submodule)
+}
+
+// writeFileDiff writes the diff of one file in git's format
+func writeFileDiff(w io.Writer, repo *git.Repository, path string, a, b *diffSide, context int) error {
+	from, to := a.Entries[path], b.Entries[path]
+	oldName, newName := "a/"+path, "b/"+path
+	fmt.Fprintf(w, "diff --git %s %s\n", oldName, newName)
+
+	var oldContent, newContent []byte
+	var err error
+	switch {
+	case from == nil:
+		fmt.Fprintf(w, "new file mode %o\n", uint32(to.Mode))
+		fmt.Fprintf(w, "index %s..%s\n", shortHash(plumbing.ZeroHash.String()), shortHash(to.Hash.String()))
+		oldName = "/dev/null"
+	case to == nil:
+		fmt.Fprintf(w, "deleted file mode %o\n", uint32(from.Mode))
+		fmt.Fprintf(w, "index %s..%s\n", shortHash(from.Hash.String()), shortHash(plumbing.ZeroHash.String()))
+		newName = "/dev/null"
+	case from.Mode != to.Mode:
+		fmt.Fprintf(w, "old mode %o\nnew mode %o\n", uint32(from.Mode), uint32(to.Mode))
+		if from.Hash == to.Hash {
+			return nil
+		}
+		fmt.Fprintf(w, "index %s..%s\n", shortHash(from.Hash.String()), shortHash(to.Hash.String()))
+	default:
+		fmt.Fprintf(w, "index %s..%s %o\n", shortHash(from.Hash.String()), shortHash(to.Hash.String()), uint32(to.Mode))
+	}
+
+	if from != nil {
+		if oldContent, err = a.read(repo, path); err != nil {
+			return fmt.Errorf("error reading %s: %w", path, err)
+		}
+	}
+	if to != nil {
+		if newContent, err = b.read(repo, path); err != nil {
+			return fmt.Errorf("error reading %s: %w", path, err)
+		}
+	}
+	if isBinaryContent(oldContent) || isBinaryContent(newContent) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return nil
+	}
+
+	edits := diffLines(splitLines(string(oldContent)), splitLines(string(newContent)))
+	hunks := makeHunks(edits, 0, len(edits), context, true)
+	if len(hunks) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		io.WriteString(w, hunk.String())
+	}
+	return nil
+}
+
+// HandleDiff handles the diff command:
+//
+//	mgit diff [-- <paths>]                   working tree against the index
+//	mgit diff --staged [<commit>]            the index against a commit, HEAD by default
+//	mgit diff <commit>                       the working tree against a commit
+//	mgit diff <commit> <commit>, <a>..<b>    two commits
+//	mgit diff <a>...<b>                      b against its merge base with a
+//
+// Commits can be named by MGit hash as well as anything git takes.
+// --submodule[=log] shows a submodule's change as the commits it moved
+// between instead of its "Subproject commit" lines.
+func HandleDiff(args []string) {
+	opts := &diffOptions{Context: hunkContext, Submodule: GetConfigValue("diff.submodule", "short")}
+	staged := false
+	exitCode := false
+	revisions := []string{}
+	pathArgs := []string{}
+	repo := getRepo()
+	storage := NewMGitStorage()
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			pathArgs = append(pathArgs, args[i+1:]...)
+			i = len(args)
+		case arg == "--staged" || arg == "--cached":
+			staged = true
+		case arg == "--name-only":
+			opts.NameOnly = true
+		case arg == "--name-status":
+			opts.NameStatus = true
+		case arg == "--exit-code":
+			exitCode = true
+		case arg == "--submodule":
+			opts.Submodule = "log"
+		case strings.HasPrefix(arg, "--submodule="):
+			opts.Submodule = strings.TrimPrefix(arg, "--submodule=")
+			if opts.Submodule != "short" && opts.Submodule != "log" {
+				fmt.Printf("Error: unknown submodule format %s\n", opts.Submodule)
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "-U") || strings.HasPrefix(arg, "--unified="):
+			n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(arg, "-U"), "--unified="))
+			if err != nil || n < 0 {
+				fmt.Printf("Error: invalid context length in %s\n", arg)
+				os.Exit(1)
+			}
+			opts.Context = n
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printDiffUsage()
+			os.Exit(1)
+		case len(pathArgs) > 0:
+			pathArgs = append(pathArgs, arg)
+		default:
+			// Like git, what isn't a revision may be a path
+			if _, _, _, ok := parseRevisionRange(arg); ok {
+				revisions = append(revisions, arg)
+			} else if _, err := resolveCommitRevision(repo, storage, arg); err == nil {
+				revisions = append(revisions, arg)
+			} else if _, err := os.Lstat(arg); err == nil {
+				pathArgs = append(pathArgs, arg)
+			} else {
+				fmt.Printf("Error: unknown revision or path %s\n", arg)
+				os.Exit(1)
+			}
+		}
+	}
+
+	pathspecs := []string{}
+	for _, arg := range pathArgs {
+		path, err := repoRelativePath(arg)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if path == "." {
+			pathspecs = nil
+			break
+		}
+		pathspecs = append(pathspecs, path)
+	}
+
+	a, b, err := diffSides(repo, storage, revisions, staged)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	changed, err := writeDiff(out, repo, a, b, pathspecs, opts)
+	out.Flush()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if exitCode && changed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printDiffUsage() {
+	fmt.Println("Usage: mgit diff [--staged] [-U<n>] [--name-only | --name-status] [--submodule[=short|log]] [--exit-code] [<commit> [<commit>] | <a>..<b> | <a>...<b>] [-- <paths>...]")
+}
+
+// diffSides picks the two sides the revisions and --staged ask for
+func diffSides(repo *git.Repository, storage *MGitStorage, revisions []string, staged bool) (*diffSide, *diffSide, error) {
+	resolve := func(rev string) (*diffSide, error) {
+		hash, err := resolveCommitRevision(repo, storage, rev)
+		if err != nil {
+			return nil, err
+		}
+		return commitDiffSide(repo, hash)
+	}
+
+	if len(revisions) == 1 {
+		if left, right, symmetric, ok := parseRevisionRange(revisions[0]); ok {
+			if staged {
+				return nil, nil, fmt.Errorf("--staged takes at most one commit")
+			}
+			if !symmetric {
+				revisions = []string{left, right}
+			} else {
+				leftHash, err := resolveCommitRevision(repo, storage, left)
+				if err != nil {
+					return nil, nil, err
+				}
+				rightHash, err := resolveCommitRevision(repo, storage, right)
+				if err != nil {
+					return nil, nil, err
+				}
+				base, err := mergeBaseOf(repo, leftHash, rightHash)
+				if err != nil {
+					return nil, nil, err
+				}
+				a, err := commitDiffSide(repo, base)
+				if err != nil {
+					return nil, nil, err
+				}
+				b, err := commitDiffSide(repo, rightHash)
+				return a, b, err
+			}
+		}
+	}
+
+	switch {
+	case len(revisions) > 2 || (staged && len(revisions) > 1):
+		printDiffUsage()
+		os.Exit(1)
+	case len(revisions) == 2:
+		a, err := resolve(revisions[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := resolve(revisions[1])
+		return a, b, err
+	}
+
+	index, err := indexDiffSide(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	if staged {
+		var a *diffSide
+		if len(revisions) == 1 {
+			a, err = resolve(revisions[0])
+		} else if head, headErr := repo.Head(); headErr == nil {
+			a, err = commitDiffSide(repo, head.Hash())
+		} else {
+			a, err = commitDiffSide(repo, plumbing.ZeroHash)
+		}
+		return a, index, err
+	}
+
+	worktree, err := worktreeDiffSide(repo, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(revisions) == 1 {
+		a, err := resolve(revisions[0])
+		return a, worktree, err
+	}
+	return index, worktree, nil
+}
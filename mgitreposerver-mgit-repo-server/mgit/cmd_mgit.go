@@ -1,57 +1,414 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 // HandleMGitCommit handles the mgit commit command
 func HandleMGitCommit(args []string) {
 	message := ""
+	authorFlag := ""
+	dateFlag := ""
+	pubkeyFlag := ""
+	sign := GetConfigBool("commit.sign", false)
+	signoff := false
+	verify := true
+	amend, noEdit, resetAuthor := false, false, false
+	var pathspecs []string
 	for i := 0; i < len(args); i++ {
-		if args[i] == "-m" && i+1 < len(args) {
-			message = args[i+1]
-			break
+		arg := args[i]
+		hasValue := i+1 < len(args)
+		switch {
+		case arg == "--":
+			pathspecs = args[i+1:]
+			i = len(args)
+		case arg == "-m" && hasValue:
+			i++
+			message = args[i]
+		case arg == "--author" && hasValue:
+			i++
+			authorFlag = args[i]
+		case arg == "--date" && hasValue:
+			i++
+			dateFlag = args[i]
+		case arg == "--pubkey" && hasValue:
+			i++
+			pubkeyFlag = args[i]
+		case strings.HasPrefix(arg, "--author="):
+			authorFlag = strings.TrimPrefix(arg, "--author=")
+		case strings.HasPrefix(arg, "--date="):
+			dateFlag = strings.TrimPrefix(arg, "--date=")
+		case strings.HasPrefix(arg, "--pubkey="):
+			pubkeyFlag = strings.TrimPrefix(arg, "--pubkey=")
+		case arg == "-S" || arg == "--sign":
+			sign = true
+		case arg == "--no-sign":
+			sign = false
+		case arg == "-s" || arg == "--signoff":
+			signoff = true
+		case arg == "--no-signoff":
+			signoff = false
+		case arg == "-n" || arg == "--no-verify":
+			verify = false
+		case arg == "--amend":
+			amend = true
+		case arg == "--no-edit":
+			noEdit = true
+		case arg == "--reset-author":
+			resetAuthor = true
 		}
 	}
 
-	if message == "" {
-		fmt.Println("Usage: mgit commit -m <message>")
+	// With pathspecs only what is staged under them is committed
+	if len(pathspecs) > 0 {
+		paths, err := commitPathspecs(pathspecs)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		pathspecs = paths
+	}
+
+	// A merge stopped on conflicts is finished by the next commit, once
+	// the conflicts are resolved and staged
+	merge, err := loadPendingMerge()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	var parents []plumbing.Hash
+	if merge != nil {
+		if len(pathspecs) > 0 {
+			fmt.Println("Error: cannot do a partial commit during a merge")
+			os.Exit(1)
+		}
+		unresolved, err := merge.Unresolved(getRepo())
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if len(unresolved) > 0 {
+			fmt.Printf("Error: resolve the conflicts in these files and stage them first:\n  %s\n", strings.Join(unresolved, "\n  "))
+			os.Exit(1)
+		}
+		head, err := getRepo().Head()
+		if err != nil {
+			fmt.Printf("Error getting HEAD: %s\n", err)
+			os.Exit(1)
+		}
+		parents = []plumbing.Hash{head.Hash(), merge.Theirs}
+		if message == "" {
+			message = merge.Message
+		}
+	}
+
+	// So is a stopped revert, without the second parent
+	revert, err := loadPendingRevert()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if revert != nil {
+		unresolved, err := revert.Unresolved(getRepo())
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if len(unresolved) > 0 {
+			fmt.Printf("Error: resolve the conflicts in these files and stage them first:\n  %s\n", strings.Join(unresolved, "\n  "))
+			os.Exit(1)
+		}
+		if message == "" {
+			message = revert.Message
+		}
+	}
+
+	// And a stopped cherry-pick, which keeps the picked commit's author
+	pick, err := loadPendingCherryPick()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
 		os.Exit(1)
 	}
+	if pick != nil {
+		unresolved, err := pick.Unresolved(getRepo())
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if len(unresolved) > 0 {
+			fmt.Printf("Error: resolve the conflicts in these files and stage them first:\n  %s\n", strings.Join(unresolved, "\n  "))
+			os.Exit(1)
+		}
+		if message == "" {
+			message = pick.Message
+		}
+		if authorFlag == "" && dateFlag == "" && pubkeyFlag == "" {
+			authorFlag, dateFlag, pubkeyFlag = pickedAuthor(getRepo(), NewMGitStorage(), pick.Theirs)
+		}
+	}
+
+	// An amend replaces HEAD and is checked against HEAD's parents. Like
+	// git, it keeps HEAD's message with --no-edit, and its author unless
+	// --author, --date, --pubkey or --reset-author say otherwise.
+	signingParents := parents
+	var amended *object.Commit
+	if amend {
+		if merge != nil || revert != nil || pick != nil {
+			fmt.Println("Error: cannot amend in the middle of a merge, revert or cherry-pick")
+			os.Exit(1)
+		}
+		if amended, err = amendTarget(getRepo()); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if message == "" && noEdit {
+			message = amended.Message
+		}
+		if !resetAuthor {
+			oldAuthor, oldDate, oldPubkey := pickedAuthor(getRepo(), NewMGitStorage(), amended.Hash)
+			if authorFlag == "" {
+				authorFlag = oldAuthor
+			}
+			if dateFlag == "" {
+				dateFlag = oldDate
+			}
+			if pubkeyFlag == "" {
+				pubkeyFlag = oldPubkey
+			}
+		}
+		signingParents = amended.ParentHashes
+	}
+
+	if verify {
+		if err := runHook("pre-commit", "", []string{fmt.Sprintf("MGIT_COMMIT_SIGN=%t", sign)}); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Without -m the message is written in the editor, from commit.template
+	// or the amended commit's message
+	if message == "" {
+		start := ""
+		if amended != nil {
+			start = amended.Message
+		}
+		var err error
+		if message, err = editCommitMessage(start); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
 
 	// Get user information from config
 	userName := GetConfigValue("user.name", "")
 	userEmail := GetConfigValue("user.email", "")
 	userPubkey := GetConfigValue("user.pubkey", "")
 
-	if userName == "" || userEmail == "" {
+	author, committer, err := commitIdentities(userName, userEmail, userPubkey, authorFlag, dateFlag, pubkeyFlag)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if author.Name == "" || author.Email == "" {
 		fmt.Println("Please set your user name and email first:")
 		fmt.Println("  mgit config --global user.name \"Your Name\"")
 		fmt.Println("  mgit config --global user.email \"your.email@example.com\"")
 		os.Exit(1)
 	}
 
+	// Like git, the sign-off is the committer's
+	if signoff {
+		message = addTrailer(message, signoffKey, signoffTrailer(signoffIdentity(author, committer, userPubkey)))
+	}
+
+	// The message is final before it is hashed, so it is checked here
+	if verify {
+		if message, err = checkCommitMessage(message); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Paths reserved to a group by the signing rules need a signature from
+	// a member; --no-verify doesn't skip this, verify would fail it anyway
+	if err := checkCommitSigning(getRepo(), pathspecs, signingParents, author.Pubkey, sign); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Open the signer first, so a missing device or wrong key stops the
+	// commit before anything is written
+	var signer Signer
+	if sign {
+		if signer, err = openCommitSigner(author.Pubkey); err != nil {
+			fmt.Printf("Error: cannot sign commit: %s\n", err)
+			os.Exit(1)
+		}
+		defer signer.Close()
+	}
+
 	// Create the commit with MCommit
 	hash, err := MGitCommit(message, &MCommitOptions{
-		Author: &Signature{
-			Name:   userName,
-			Email:  userEmail,
-			Pubkey: userPubkey,
-			When:   time.Now(),
-		},
+		Author:    author,
+		Committer: committer,
+		Signer:    signer,
+		Parents:   parents,
+		Paths:     pathspecs,
+		Amend:     amend,
 	})
 
 	if err != nil {
 		fmt.Printf("Error committing changes: %s\n", err)
 		os.Exit(1)
 	}
+	if merge != nil {
+		clearMergeState()
+	}
+	if revert != nil {
+		clearRevertState()
+	}
+	if pick != nil {
+		clearCherryPickState()
+	}
+	storage := NewMGitStorage()
+	runPostCommitHook(storage, hash)
+
+	gitHash := ""
+	if commit, err := storage.GetCommit(hash.String()); err == nil {
+		gitHash = commit.GitHash
+	}
+	if amend {
+		fmt.Printf("Amended commit [%s]: %s\n", displayShortHash(hash.String(), gitHash), message)
+		return
+	}
+	fmt.Printf("Committed changes [%s]: %s\n", displayShortHash(hash.String(), gitHash), message)
+}
+
+// signoffIdentity returns who signs off a commit: the committer (which
+// commitIdentities leaves nil when it is the author) with the user's own
+// pubkey, since --pubkey only says whose the change is
+func signoffIdentity(author, committer *Signature, userPubkey string) *Signature {
+	sig := *author
+	if committer != nil {
+		sig = *committer
+	}
+	sig.Pubkey = userPubkey
+	return &sig
+}
+
+// openCommitSigner opens the configured signer and checks that its key is
+// the author's pubkey
+func openCommitSigner(pubkey string) (Signer, error) {
+	if pubkey == "" {
+		return nil, fmt.Errorf("no pubkey configured")
+	}
+	authorKey, err := decodeNostrKey(pubkey, "npub")
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := newSigner()
+	if err != nil {
+		return nil, err
+	}
+	signerKey, err := signer.PublicKey()
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	if !bytes.Equal(signerKey, authorKey) {
+		signer.Close()
+		return nil, fmt.Errorf("signing key %s is not the author pubkey %s", encodeNpub(signerKey), pubkey)
+	}
+	return signer, nil
+}
+
+// commitIdentities builds the author and committer of a commit. The author
+// comes from --author/--date/--pubkey, then GIT_AUTHOR_NAME, GIT_AUTHOR_EMAIL,
+// GIT_AUTHOR_DATE and MGIT_AUTHOR_PUBKEY, then the configured user. Like git,
+// the committer is the configured user at the current time unless
+// GIT_COMMITTER_NAME, GIT_COMMITTER_EMAIL or GIT_COMMITTER_DATE say
+// otherwise. The committer is nil when nothing was overridden, so existing
+// commits keep author and committer identical.
+func commitIdentities(userName, userEmail, userPubkey, authorFlag, dateFlag, pubkeyFlag string) (*Signature, *Signature, error) {
+	now := time.Now()
+	author := &Signature{
+		Name:   envOr("GIT_AUTHOR_NAME", userName),
+		Email:  envOr("GIT_AUTHOR_EMAIL", userEmail),
+		Pubkey: envOr("MGIT_AUTHOR_PUBKEY", userPubkey),
+		When:   now,
+	}
+	overridden := author.Name != userName || author.Email != userEmail
+
+	if authorFlag != "" {
+		name, email, err := parseIdentity(authorFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		author.Name, author.Email = name, email
+		overridden = true
+	}
+
+	if date := envOr("GIT_AUTHOR_DATE", ""); date != "" || dateFlag != "" {
+		if dateFlag != "" {
+			date = dateFlag
+		}
+		when, err := parseDate(date)
+		if err != nil {
+			return nil, nil, err
+		}
+		author.When = when
+		overridden = true
+	}
+
+	if pubkeyFlag != "" {
+		author.Pubkey = pubkeyFlag
+	}
+	if author.Pubkey != userPubkey && !ValidateNostrPubKey(author.Pubkey) {
+		return nil, nil, fmt.Errorf("invalid nostr pubkey %q, expected an npub", author.Pubkey)
+	}
+
+	committer := &Signature{
+		Name:   envOr("GIT_COMMITTER_NAME", userName),
+		Email:  envOr("GIT_COMMITTER_EMAIL", userEmail),
+		Pubkey: author.Pubkey,
+		When:   now,
+	}
+	if committer.Name != userName || committer.Email != userEmail {
+		overridden = true
+	}
+	if date := envOr("GIT_COMMITTER_DATE", ""); date != "" {
+		when, err := parseDate(date)
+		if err != nil {
+			return nil, nil, err
+		}
+		committer.When = when
+		overridden = true
+	}
+
+	if !overridden {
+		return author, nil, nil
+	}
+	return author, committer, nil
+}
 
-	fmt.Printf("Committed changes [%s]: %s\n", hash.String()[:7], message)
+// envOr returns the value of an environment variable, or def when unset
+func envOr(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return def
 }
 
 // HandleMGitLog handles the mgit log command for the MGit hash chain
@@ -61,9 +418,18 @@ func HandleMGitLog(args []string) {
 	graph := false
 	decorate := false
 	all := false
+	leftRight := false
+	filter := noLogFilter
 	maxCount := 10 // Default
+	revisions := []string{}
+	format, args := formatOption(args)
 	
-	for _, arg := range args {
+	for i, arg := range args {
+			if !strings.HasPrefix(arg, "-") && (i == 0 || args[i-1] != "-n") {
+					revisions = append(revisions, arg)
+					continue
+			}
+
 			switch arg {
 			case "--oneline":
 					oneline = true
@@ -73,6 +439,24 @@ func HandleMGitLog(args []string) {
 					decorate = true
 			case "--all":
 					all = true
+			case "--left-right":
+					leftRight = true
+			case "--merges":
+					filter.MinParents = 2
+			case "--no-merges":
+					filter.MaxParents = 1
+			case "--first-parent":
+					filter.FirstParent = true
+			case "--no-min-parents":
+					filter.MinParents = 0
+			case "--no-max-parents":
+					filter.MaxParents = -1
+			}
+			if value, ok := strings.CutPrefix(arg, "--min-parents="); ok {
+					fmt.Sscanf(value, "%d", &filter.MinParents)
+			}
+			if value, ok := strings.CutPrefix(arg, "--max-parents="); ok {
+					fmt.Sscanf(value, "%d", &filter.MaxParents)
 			}
 			
 			// Handle -n flag for limiting commits
@@ -95,104 +479,172 @@ func HandleMGitLog(args []string) {
 	storage := NewMGitStorage()
 	repo := getRepo()
 
+	var formatter *commitFormatter
+	if format != "" {
+			var err error
+			if formatter, err = newCommitFormatter(storage, format); err != nil {
+					fmt.Printf("Error: %s\n", err)
+					os.Exit(1)
+			}
+	}
+
+	if len(revisions) > 1 {
+			fmt.Println("Usage: mgit log [options] [<revision> | <left>..<right> | <left>...<right>]")
+			os.Exit(1)
+	}
+
+	// Ranges list the commits one side has that the other doesn't
+	if len(revisions) == 1 {
+			if left, right, symmetric, ok := parseRevisionRange(revisions[0]); ok {
+					showMGitLogRange(repo, storage, left, right, symmetric, leftRight, oneline, graph, maxCount, filter, formatter)
+					return
+			}
+	}
+
 	// Collect starting commits based on flags
 	startingCommits := []*MCommitStruct{}
 
-	// Get the HEAD commit
-	headCommit, err := storage.GetHeadCommit()
+	// Get the HEAD commit, or the commit to start from
+	var headCommit *MCommitStruct
+	var err error
+	if len(revisions) == 1 {
+			headCommit, err = resolveMGitRevision(repo, storage, revisions[0])
+	} else {
+			headCommit, err = storage.GetHeadCommit()
+	}
 	if err != nil {
 			fmt.Printf("Error getting HEAD commit: %s\n", err)
 			os.Exit(1)
 	}
 
-	// If --all flag is specified, include commits from all branches
+	// With --all, every branch, remote-tracking branch and tag is a start
 	if all {
-		// Get all branches
-		refs, err := repo.References()
-		if err == nil {
-				_ = refs.ForEach(func(ref *plumbing.Reference) error {
-						if ref.Name().IsBranch() {
-								// Skip if this is the current branch (already added as HEAD)
-								if headCommit != nil && ref.Hash().String() == headCommit.GitHash {
-										return nil
-								}
-								
-								// Get MGit hash for this Git hash
-								mgitHash, err := storage.GetMGitHashFromGit(ref.Hash().String())
-								if err == nil {
-										commit, err := storage.GetCommit(mgitHash)
-										if err == nil {
-												startingCommits = append(startingCommits, commit)
-										}
-								}
-						}
-						return nil
-				})
-		}
+			startingCommits = append(startingCommits, logStartingCommits(repo, storage)...)
 	}
-	
-	headRef, err := repo.Head()
-	currentBranch := ""
-	if err == nil && headRef.Name().IsBranch() {
-			currentBranch = headRef.Name().Short()
+
+	var decorations map[string][]string
+	if decorate {
+			decorations = logDecorations(repo, storage)
 	}
 
 	// If not using special formatting, use the default format
-	if !oneline && !graph {
+	if !oneline && !graph && formatter == nil {
 			fmt.Println("MGit Commit History:")
 			fmt.Println("====================")
 	}
 
-	// Start with head commit
-	if oneline {
-			printMGitCommitOneline(headCommit, graph, decorate, currentBranch)
-	} else {
-			printMGitCommit(headCommit)
-	}
-	count := 1
-
-	// Process parents recursively with a breadth-first approach
-	visited := map[string]bool{headCommit.MGitHash: true}
-	queue := headCommit.ParentHashes
+	// Walk back from the starting commits breadth-first, or newest first
+	// when there are several
+	count := 0
+	visited := map[string]bool{}
+	pending := append([]*MCommitStruct{headCommit}, startingCommits...)
+	shallow := loadMGitShallow(storage.RootDir)
 
-	for len(queue) > 0 && count < maxCount {
-			currentHash := queue[0]
-			queue = queue[1:]
-
-			if visited[currentHash] {
-					continue
+	for len(pending) > 0 && count < maxCount {
+			next := 0
+			if all {
+					for i := range pending {
+							if commitTime(pending[i]).After(commitTime(pending[next])) {
+									next = i
+							}
+					}
 			}
+			commit := pending[next]
+			pending = append(pending[:next], pending[next+1:]...)
 
-			commit, err := storage.GetCommit(currentHash)
-			if err != nil {
-					fmt.Printf("Warning: Could not load commit %s: %s\n", currentHash, err)
+			if visited[commit.MGitHash] {
 					continue
 			}
+			visited[commit.MGitHash] = true
 
-			if oneline {
-					printMGitCommitOneline(commit, graph, decorate, "")
-			} else {
-					printMGitCommit(commit)
+			if filter.shows(commit) {
+					if formatter != nil {
+							formatter.Print(commit)
+					} else if oneline {
+							printMGitCommitOneline(commit, graph, decorations[commit.MGitHash])
+					} else {
+							printMGitCommit(commit, decorations[commit.MGitHash])
+					}
+					count++
 			}
-			count++
-			visited[currentHash] = true
 
-			// Add parents to queue
-			for _, parent := range commit.ParentHashes {
-					if !visited[parent] {
-							queue = append(queue, parent)
+			// Add parents to the pending commits; a shallow clone has none
+			// past its oldest commits
+			if shallow[commit.MGitHash] {
+					continue
+			}
+			for _, parent := range filter.follows(commit) {
+					if visited[parent] {
+							continue
+					}
+					parentCommit, err := storage.GetCommit(parent)
+					if err != nil {
+							fmt.Printf("Warning: Could not load commit %s: %s\n", parent, err)
+							continue
 					}
+					pending = append(pending, parentCommit)
 			}
 	}
 }
 
-// printMGitCommitOneline prints a single MGit commit in oneline format
-func printMGitCommitOneline(commit *MCommitStruct, showGraph bool, decorate bool, branchName string) {
-	// First 7 characters of hash (like git)
-	shortHash := commit.MGitHash
-	if len(shortHash) > 7 {
-			shortHash = shortHash[:7]
+// showMGitLogRange prints the commits of left..right, or of left...right
+// with --left-right marking which side each commit comes from
+func showMGitLogRange(repo *git.Repository, storage *MGitStorage, left, right string, symmetric, leftRight, oneline, graph bool, maxCount int, filter logFilter, formatter *commitFormatter) {
+	leftCommit, err := resolveMGitRevision(repo, storage, left)
+	if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+	}
+	rightCommit, err := resolveMGitRevision(repo, storage, right)
+	if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+	}
+
+	commits := mgitRangeFiltered(storage, []string{rightCommit.MGitHash}, []string{leftCommit.MGitHash}, filter)
+	marks := map[string]string{}
+	for _, commit := range commits {
+			marks[commit.MGitHash] = ">"
+	}
+
+	if symmetric {
+			leftOnly := mgitRangeFiltered(storage, []string{leftCommit.MGitHash}, []string{rightCommit.MGitHash}, filter)
+			for _, commit := range leftOnly {
+					marks[commit.MGitHash] = "<"
+			}
+			commits = append(commits, leftOnly...)
+			sort.SliceStable(commits, func(i, j int) bool {
+					return commits[i].Committer.When.After(commits[j].Committer.When)
+			})
 	}
+
+	if !oneline && !graph && formatter == nil {
+			fmt.Println("MGit Commit History:")
+			fmt.Println("====================")
+	}
+
+	for i, commit := range commits {
+			if i >= maxCount {
+					break
+			}
+			if leftRight && symmetric {
+					fmt.Print(marks[commit.MGitHash] + " ")
+			}
+			if formatter != nil {
+					formatter.Print(commit)
+			} else if oneline {
+					printMGitCommitOneline(commit, graph, nil)
+			} else {
+					printMGitCommit(commit, nil)
+			}
+	}
+}
+
+// printMGitCommitOneline prints a single MGit commit in oneline format,
+// followed by the refs that point at it
+func printMGitCommitOneline(commit *MCommitStruct, showGraph bool, refs []string) {
+	// Abbreviated like git, in the mgit.displayHash style
+	hash := displayShortHash(commit.MGitHash, commit.GitHash)
 	
 	// Add graph symbol if requested
 	prefix := ""
@@ -200,11 +652,7 @@ func printMGitCommitOneline(commit *MCommitStruct, showGraph bool, decorate bool
 			prefix = "* "
 	}
 	
-	// Add decoration if requested
-	decoration := ""
-	if decorate && branchName != "" {
-			decoration = fmt.Sprintf(" (HEAD -> %s)", branchName)
-	}
+	decoration := formatDecorations(refs)
 	
 	// Get first line of commit message
 	message := commit.Message
@@ -212,13 +660,13 @@ func printMGitCommitOneline(commit *MCommitStruct, showGraph bool, decorate bool
 			message = message[:idx]
 	}
 	
-	fmt.Printf("%s%s%s %s\n", prefix, shortHash, decoration, message)
+	fmt.Printf("%s%s%s %s\n", prefix, hash, decoration, message)
 }
 
-// printMGitCommit prints a single MGit commit
-func printMGitCommit(commit *MCommitStruct) {
-	fmt.Printf("commit %s\n", commit.MGitHash)
-	fmt.Printf("git-commit %s\n", commit.GitHash)
+// printMGitCommit prints a single MGit commit, with the refs that point at
+// it after its hash
+func printMGitCommit(commit *MCommitStruct, refs []string) {
+	fmt.Print(displayHashHeader(commit.MGitHash, commit.GitHash, formatDecorations(refs)))
 	
 	pubkeyInfo := ""
 	if commit.Author.Pubkey != "" {
@@ -243,19 +691,102 @@ func printMGitCommit(commit *MCommitStruct) {
 
 // HandleMGitVerify verifies the integrity of the MGit commit chain
 func HandleMGitVerify(args []string) {
+	useCache := true
+	recurse := false
+	lookupMappings := false
+	fixRefs := false
+	anchorFlag := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--no-cache" {
+			useCache = false
+		}
+		if arg == "--fix-refs" {
+			fixRefs = true
+		}
+		if arg == "--lookup-mappings" {
+			lookupMappings = true
+		}
+		if arg == "--recurse-submodules" {
+			recurse = true
+		}
+		if arg == "--trust-anchor" && i+1 < len(args) {
+			i++
+			anchorFlag = args[i]
+		}
+		if strings.HasPrefix(arg, "--trust-anchor=") {
+			anchorFlag = strings.TrimPrefix(arg, "--trust-anchor=")
+		}
+	}
+
 	storage := NewMGitStorage()
+	repo := getRepo()
+	lookup := newMappingLookup(repo, storage, lookupMappings)
+	defer lookup.Close()
 	
 	// Get all commits
 	headCommit, err := storage.GetHeadCommit()
+	if err != nil && lookup != nil {
+		headCommit, err = lookup.HeadCommit()
+	}
 	if err != nil {
 		fmt.Printf("Error getting HEAD commit: %s\n", err)
 		os.Exit(1)
 	}
 	
+	valid := verifyMGitHistory(repo, storage, headCommit.MGitHash, useCache, lookup)
+	refsValid, err := verifyBranchRefs(repo, storage, fixRefs)
+	if err != nil {
+		fmt.Printf("Error checking branch refs: %s\n", err)
+		os.Exit(1)
+	}
+	valid = valid && refsValid
+	if anchor := trustAnchorPath(anchorFlag); anchor != "" {
+		// Checked even if the history failed, to report everything at once
+		valid = verifyTrustAnchor(storage, anchor) && valid
+	}
+	if !recurse {
+		if valid {
+			fmt.Println("MGit commit chain verification successful!")
+		} else {
+			fmt.Println("MGit commit chain verification failed!")
+			os.Exit(1)
+		}
+		return
+	}
+	
+	// With submodules the superproject is only as trusted as what it pins
+	submodules, err := verifySubmodules(repo, repoRoot(), headCommit.GitHash, "", useCache)
+	if err != nil {
+		fmt.Printf("Error verifying submodules: %s\n", err)
+		os.Exit(1)
+	}
+	if len(submodules) > 0 {
+		printSubmoduleSummary(submodules)
+	}
+	switch status := submoduleTrustStatus(submodules); {
+	case !valid || status == submoduleFailed:
+		fmt.Println("MGit commit chain verification failed!")
+		os.Exit(1)
+	case status == submoduleUnverified:
+		fmt.Println("MGit commit chain verification successful, but not every submodule could be verified")
+	default:
+		fmt.Printf("MGit commit chain verification successful! (with %d submodules)\n", len(submodules))
+	}
+}
+
+// verifyMGitHistory verifies the MGit hashes and signatures of a commit and
+// its ancestors, printing what fails. Commits that verified before with the
+// same inputs are skipped using the verification cache; useCache false
+// re-verifies everything, refreshing the cache. With a lookup, commits
+// missing from the local metadata are looked up on the server.
+func verifyMGitHistory(repo *git.Repository, storage *MGitStorage, start string, useCache bool, lookup *mappingLookup) bool {
 	// Build the commit graph
 	commits := make(map[string]*MCommitStruct)
 	visited := make(map[string]bool)
-	queue := []string{headCommit.MGitHash}
+	children := make(map[string]*MCommitStruct)
+	queue := []string{start}
+	shallow := loadMGitShallow(storage.RootDir)
 	
 	for len(queue) > 0 {
 		current := queue[0]
@@ -266,6 +797,9 @@ func HandleMGitVerify(args []string) {
 		}
 		
 		commit, err := storage.GetCommit(current)
+		if err != nil && lookup != nil && children[current] != nil {
+			commit, err = lookup.ParentCommit(children[current], current)
+		}
 		if err != nil {
 			fmt.Printf("Error getting commit %s: %s\n", current, err)
 			continue
@@ -274,43 +808,110 @@ func HandleMGitVerify(args []string) {
 		commits[current] = commit
 		visited[current] = true
 		
+		// The parents of a shallow clone's oldest commits were never fetched
+		if shallow[current] {
+			continue
+		}
 		for _, parent := range commit.ParentHashes {
 			if !visited[parent] {
 				queue = append(queue, parent)
+				children[parent] = commit
+			}
+		}
+	}
+	
+	rules, err := loadSigningRules(storage)
+	if err != nil {
+		fmt.Printf("Error reading signing rules: %s\n", err)
+		return false
+	}
+	
+	cache := loadVerifyCache(storage)
+	cache.rules = rules.Digest()
+	cached := 0
+	if useCache {
+		for _, commit := range commits {
+			if cache.Has(commit) {
+				cached++
 			}
 		}
 	}
 	
 	// Verify each commit's hash
 	valid := true
-	fmt.Printf("Verifying %d MGit commits...\n", len(commits))
+	if cached > 0 {
+		fmt.Printf("Verifying %d MGit commits (%d unchanged since the last verify)...\n", len(commits), cached)
+	} else {
+		fmt.Printf("Verifying %d MGit commits...\n", len(commits))
+	}
 	
 	for hash, commit := range commits {
-		// Get the Git commit
-		gitHash := commit.GitHash
-		repo := getRepo()
-		gitCommit, err := repo.CommitObject(plumbing.NewHash(gitHash))
+		if useCache && cache.Has(commit) {
+			continue
+		}
+		
+		// Compute the expected MGit hash from the Git commit
+		expectedHash, err := expectedMGitHash(repo, commit)
 		if err != nil {
-			fmt.Printf("Error: Cannot find Git commit %s: %s\n", gitHash, err)
+			fmt.Printf("Error: Cannot find Git commit %s: %s\n", commit.GitHash, err)
 			valid = false
 			continue
 		}
 		
-		// Compute the expected MGit hash
-		expectedHash := computeMGitHash(gitCommit, commit.ParentHashes, commit.Author.Pubkey)
-		
+		ok := true
 		if expectedHash.String() != hash {
 			fmt.Printf("Hash verification failed for commit %s:\n", hash)
 			fmt.Printf("  Expected: %s\n", expectedHash.String())
 			fmt.Printf("  Actual:   %s\n", hash)
+			ok = false
+		}
+		
+		signed, sigErr := verifyMGitSignature(commit)
+		if sigErr != nil {
+			fmt.Printf("Signature verification failed for commit %s: %s\n", hash, sigErr)
+			ok = false
+		}
+		
+		if len(rules) > 0 {
+			paths, err := commitChangedPaths(repo, plumbing.NewHash(commit.GitHash))
+			if err != nil {
+				fmt.Printf("Error: Cannot list the changes of commit %s: %s\n", hash, err)
+				ok = false
+			}
+			pubkey := ""
+			if commit.Author != nil {
+				pubkey = commit.Author.Pubkey
+			}
+			for _, problem := range rules.Violations(paths, pubkey, signed && sigErr == nil) {
+				fmt.Printf("Signing rule broken by commit %s: %s\n", hash, problem)
+				ok = false
+			}
+		}
+		
+		// Only successes are cached, so failures are reported every time
+		if ok {
+			cache.Add(commit)
+		} else {
 			valid = false
 		}
 	}
 	
-	if valid {
-		fmt.Println("MGit commit chain verification successful!")
-	} else {
-		fmt.Println("MGit commit chain verification failed!")
-		os.Exit(1)
+	if err := cache.Save(); err != nil {
+		fmt.Printf("Warning: Failed to save verification cache: %s\n", err)
 	}
-}
\ No newline at end of file
+	return valid
+}
+
+// expectedMGitHash recomputes the MGit hash of a commit from its Git commit,
+// parents and pubkey. A commit verifies when this matches its MGitHash.
+func expectedMGitHash(repo *git.Repository, commit *MCommitStruct) (plumbing.Hash, error) {
+	gitCommit, err := repo.CommitObject(plumbing.NewHash(commit.GitHash))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	pubkey := ""
+	if commit.Author != nil {
+		pubkey = commit.Author.Pubkey
+	}
+	return computeMGitHash(gitCommit, commit.ParentHashes, pubkey), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commands maps each command name to its handler
+var commands = map[string]func([]string){
+	"init":               initRepo,
+	"clone":              HandleClone,
+	"add":                addFiles,
+	"commit":             HandleMGitCommit,
+	"push":               pushChanges,
+	"pull":               pullChanges,
+	"quota":              HandleQuota,
+	"remote":             HandleRemote,
+	"status":             showStatus,
+	"branch":             handleBranch,
+	"tag":                HandleTag,
+	"checkout":           checkoutBranch,
+	"restore":            HandleRestore,
+	"clean":              HandleClean,
+	"reset":              HandleReset,
+	"stash":              HandleStash,
+	"log":                HandleMGitLog,
+	"reflog":             HandleReflog,
+	"rebase":             HandleRebase,
+	"bisect":             HandleBisect,
+	"revert":             HandleRevert,
+	"cherry-pick":        HandleCherryPick,
+	"show":               HandleMGitShow,
+	"diff":               HandleDiff,
+	"blame":              HandleBlame,
+	"grep":               HandleGrep,
+	"verify":             HandleMGitVerify,
+	"attest":             HandleAttest,
+	"annotate-history":   HandleAnnotateHistory,
+	"config":             HandleConfig,
+	"merge":              HandleMerge,
+	"maintenance":        HandleMaintenance,
+	"gc":                 HandleGC,
+	"workspace":          HandleWorkspace,
+	"worktree":           HandleWorktree,
+	"submodule":          HandleSubmodule,
+	"summary":            HandleSummary,
+	"merge-base":         HandleMergeBase,
+	"cherry":             HandleCherry,
+	"apply":              HandleApply,
+	"send-patch":         HandleSendPatch,
+	"am":                 HandleAm,
+	"web":                HandleWeb,
+	"export-site":        HandleExportSite,
+	"archive":            HandleArchive,
+	"credential":         HandleCredential,
+	"signer":             HandleSigner,
+	"fsck":               HandleFsck,
+	"fsmonitor":          HandleFsmonitor,
+	"git":                HandleGit,
+	"cat-file":           HandleCatFile,
+	"interpret-trailers": HandleInterpretTrailers,
+	"ls-tree":            HandleLsTree,
+	"upload-pack":        HandleUploadPack,
+	"receive-pack":       HandleReceivePack,
+	"pack-objects":       HandlePackObjects,
+	"unpack-objects":     HandleUnpackObjects,
+}
+
+// unknownCommand handles a command that isn't in the registry. With
+// core.gitFallback set it passes the command to git; otherwise it suggests
+// the closest commands and, depending on help.autocorrect, runs the best
+// one instead:
+//
+//	0, false, show  only suggest (the default)
+//	never           don't suggest either
+//	immediate, true run the suggestion right away
+//	prompt          ask before running it
+//	<n>             run it after n tenths of a second
+//
+// It returns the handler to run, or exits.
+func unknownCommand(name string) func([]string) {
+	if handler, ok := gitFallback(name); ok {
+		return handler
+	}
+
+	setting := strings.ToLower(GetConfigValue("help.autocorrect", "0"))
+	if setting == "never" {
+		fmt.Printf("Unknown command: %s\n", name)
+		printUsage()
+		os.Exit(1)
+	}
+
+	suggestions := suggestCommands(name)
+	if len(suggestions) == 0 {
+		fmt.Printf("Unknown command: %s\n", name)
+		printUsage()
+		os.Exit(1)
+	}
+
+	if len(suggestions) == 1 {
+		suggestion := suggestions[0]
+		switch delay, ok := autocorrectDelay(setting); {
+		case setting == "prompt":
+			fmt.Printf("Unknown command: %s\n", name)
+			fmt.Printf("Run 'mgit %s' instead [y/N]? ", suggestion)
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer == "y" || answer == "yes" {
+				return commands[suggestion]
+			}
+			os.Exit(1)
+		case ok && delay == 0:
+			fmt.Fprintf(os.Stderr, "WARNING: You called an mgit command named '%s', which does not exist.\n", name)
+			fmt.Fprintf(os.Stderr, "Continuing under the assumption that you meant '%s'.\n", suggestion)
+			return commands[suggestion]
+		case ok:
+			fmt.Fprintf(os.Stderr, "WARNING: You called an mgit command named '%s', which does not exist.\n", name)
+			fmt.Fprintf(os.Stderr, "Continuing in %.1f seconds, assuming that you meant '%s'.\n", delay.Seconds(), suggestion)
+			time.Sleep(delay)
+			return commands[suggestion]
+		}
+	}
+
+	fmt.Printf("Unknown command: %s\n", name)
+	if len(suggestions) == 1 {
+		fmt.Println("\nThe most similar command is")
+	} else {
+		fmt.Println("\nThe most similar commands are")
+	}
+	for _, suggestion := range suggestions {
+		fmt.Printf("\t%s\n", suggestion)
+	}
+	os.Exit(1)
+	return nil
+}
+
+// autocorrectDelay reads a help.autocorrect setting as the time to wait
+// before running a suggestion. It reports false when the setting doesn't
+// run suggestions at all.
+func autocorrectDelay(setting string) (time.Duration, bool) {
+	switch setting {
+	case "immediate", "true", "yes", "on":
+		return 0, true
+	case "", "show", "false", "no", "off", "prompt":
+		return 0, false
+	}
+	tenths, err := strconv.Atoi(setting)
+	if err != nil || tenths == 0 {
+		return 0, false
+	}
+	if tenths < 0 {
+		return 0, true
+	}
+	return time.Duration(tenths) * 100 * time.Millisecond, true
+}
+
+// suggestCommands returns the registered commands closest to a mistyped
+// name: those at the smallest edit distance within a small budget, unless
+// that takes more than one edit and the name is a prefix of some commands
+func suggestCommands(name string) []string {
+	budget := len(name) / 3
+	if budget < 2 {
+		budget = 2
+	}
+
+	best := budget + 1
+	closest := []string{}
+	prefixed := []string{}
+	for command := range commands {
+		if strings.HasPrefix(command, name) {
+			prefixed = append(prefixed, command)
+		}
+		distance := editDistance(name, command)
+		switch {
+		case distance < best:
+			best = distance
+			closest = []string{command}
+		case distance == best:
+			closest = append(closest, command)
+		}
+	}
+	if best > 1 && len(prefixed) > 0 {
+		closest = prefixed
+	}
+	sort.Strings(closest)
+	return closest
+}
+
+// editDistance is the optimal string alignment distance between two
+// strings: the insertions, deletions, substitutions and swaps of adjacent
+// characters needed to turn one into the other
+func editDistance(a, b string) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := rows[i-1][j] + 1
+			if v := rows[i][j-1] + 1; v < d {
+				d = v
+			}
+			if v := rows[i-1][j-1] + cost; v < d {
+				d = v
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if v := rows[i-2][j-2] + 1; v < d {
+					d = v
+				}
+			}
+			rows[i][j] = d
+		}
+	}
+	return rows[len(a)][len(b)]
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Commit messages are checked before the commit is hashed, first by the
+// commit-msg hook, which gets the message file to check or rewrite as in
+// git, then by built-in rules set in the config:
+//
+//	commitmsg.maxSubjectLength  the longest subject line allowed
+//	commitmsg.requireTrailers   trailers every message needs, e.g.
+//	                            "Signed-off-by Reviewed-by"
+//	commitmsg.types             conventional-commit types the subject must
+//	                            start with, e.g. "feat fix docs"
+//	commitmsg.requirePatientId  whether a patient ID trailer is required,
+//	                            for medical record repositories
+//	commitmsg.patientIdTrailer  its key, Patient-ID by default
+//	commitmsg.patientIdPattern  a regular expression the ID must match
+//
+// --no-verify skips both.
+
+// conventionalSubject matches "<type>(<scope>)!: <description>"
+var conventionalSubject = regexp.MustCompile(`^([A-Za-z]+)(\([^()]*\))?!?: \S`)
+
+// checkCommitMessage runs the commit-msg hook and the built-in rules on a
+// message, returning the message as the hook left it
+func checkCommitMessage(message string) (string, error) {
+	message, err := runCommitMsgHook(message)
+	if err != nil {
+		return "", err
+	}
+	problems, err := lintCommitMessage(message)
+	if err != nil {
+		return "", err
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("commit message rejected:\n  %s\n(use --no-verify to bypass)", strings.Join(problems, "\n  "))
+	}
+	return message, nil
+}
+
+// runCommitMsgHook passes the message to the commit-msg hook in
+// .mgit/COMMIT_EDITMSG, reading back what the hook leaves there
+func runCommitMsgHook(message string) (string, error) {
+	path, err := filepath.Abs(filepath.Join(mgitDir(), "COMMIT_EDITMSG"))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(message), 0644); err != nil {
+		return "", err
+	}
+	if err := runHook("commit-msg", "", nil, path); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if edited := stripCommentLines(string(data)); edited != stripCommentLines(message) {
+		if edited == "" {
+			return "", fmt.Errorf("commit-msg hook left an empty commit message")
+		}
+		return edited, nil
+	}
+	return message, nil
+}
+
+// lintCommitMessage checks a message against the built-in rules, returning
+// what it breaks. The error is for rules that are themselves invalid.
+func lintCommitMessage(message string) ([]string, error) {
+	problems := []string{}
+	subject, _, _ := strings.Cut(strings.TrimLeft(message, "\n"), "\n")
+	trailers := parseTrailers(message)
+
+	if value := GetConfigValue("commitmsg.maxSubjectLength", ""); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid commitmsg.maxSubjectLength %q", value)
+		}
+		if length := len([]rune(subject)); length > limit {
+			problems = append(problems, fmt.Sprintf("subject is %d characters, longer than commitmsg.maxSubjectLength (%d)", length, limit))
+		}
+	}
+
+	for _, key := range strings.Fields(GetConfigValue("commitmsg.requireTrailers", "")) {
+		if len(trailerValues(trailers, key)) == 0 {
+			problems = append(problems, fmt.Sprintf("missing a %s trailer", key))
+		}
+	}
+
+	if types := strings.Fields(GetConfigValue("commitmsg.types", "")); len(types) > 0 {
+		match := conventionalSubject.FindStringSubmatch(subject)
+		switch {
+		case match == nil:
+			problems = append(problems, fmt.Sprintf("subject is not \"<type>: <description>\" with a type of %s", strings.Join(types, ", ")))
+		case !containsString(types, match[1]):
+			problems = append(problems, fmt.Sprintf("commit type %q is not one of %s", match[1], strings.Join(types, ", ")))
+		}
+	}
+
+	if GetConfigBool("commitmsg.requirePatientId", false) {
+		key := GetConfigValue("commitmsg.patientIdTrailer", "Patient-ID")
+		var pattern *regexp.Regexp
+		if value := GetConfigValue("commitmsg.patientIdPattern", ""); value != "" {
+			var err error
+			if pattern, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("invalid commitmsg.patientIdPattern: %w", err)
+			}
+		}
+		ids := trailerValues(trailers, key)
+		if len(ids) == 0 {
+			problems = append(problems, fmt.Sprintf("missing a %s trailer", key))
+		}
+		for _, id := range ids {
+			if pattern != nil && !pattern.MatchString(id) {
+				problems = append(problems, fmt.Sprintf("%s %q does not match commitmsg.patientIdPattern", key, id))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// commitEditHelp follows the message in the file commit opens
+const commitEditHelp = `
+# Please enter the commit message for your changes. Lines starting
+# with '#' will be ignored, and an empty message aborts the commit.
+`
+
+// commitTemplate reads commit.template, a file the commit message starts
+// from. Relative paths are from the top of the working tree.
+func commitTemplate() (string, error) {
+	path := GetConfigValue("commit.template", "")
+	if path == "" {
+		return "", nil
+	}
+	path = expandHomePath(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(repoRoot(), path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read commit.template: %w", err)
+	}
+	return string(data), nil
+}
+
+// editCommitMessage has the user write a commit message in their editor,
+// starting from start, or commit.template if there is none. Like git, it
+// refuses an empty message and a template left unedited.
+func editCommitMessage(start string) (string, error) {
+	template := ""
+	if start == "" {
+		var err error
+		if template, err = commitTemplate(); err != nil {
+			return "", err
+		}
+		start = template
+	}
+
+	path := filepath.Join(mgitDir(), "COMMIT_EDITMSG")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(start+commitEditHelp), 0644); err != nil {
+		return "", err
+	}
+	if err := runEditor(path); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	message := stripCommentLines(string(data))
+	if message == "" {
+		return "", fmt.Errorf("aborting commit due to empty commit message")
+	}
+	if template != "" && message == stripCommentLines(template) {
+		return "", fmt.Errorf("aborting commit; you did not edit the message")
+	}
+	return message, nil
+}
+
+// stripCommentLines drops the '#' lines of an edited message and the
+// blank lines around it
+func stripCommentLines(text string) string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitPaths makes a Git commit of only the staged changes under the
+// pathspecs. go-git commits the whole index, so the commit is made from an
+// index holding HEAD's files plus the staged versions of those under the
+// pathspecs, and the full index is put back afterwards, where the changes
+// outside the pathspecs are still staged.
+func commitPaths(repo *git.Repository, w *git.Worktree, message string, opts *git.CommitOptions, pathspecs []string) (plumbing.Hash, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error reading index: %w", err)
+	}
+	partial, err := partialCommitIndex(repo, idx, pathspecs)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := repo.Storer.SetIndex(partial); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error writing index: %w", err)
+	}
+
+	hash, err := w.Commit(message, opts)
+	if restoreErr := repo.Storer.SetIndex(idx); restoreErr != nil && err == nil {
+		err = fmt.Errorf("error restoring the index: %w", restoreErr)
+	}
+	return hash, err
+}
+
+// partialCommitIndex is the index a commit of the pathspecs records: the
+// HEAD tree, submodules included, with everything under the pathspecs
+// replaced by what is staged there
+func partialCommitIndex(repo *git.Repository, idx *index.Index, pathspecs []string) (*index.Index, error) {
+	partial := &index.Index{Version: idx.Version}
+	head, err := repo.Head()
+	if err == nil {
+		commit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			return nil, err
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+		walker := object.NewTreeWalker(tree, true, nil)
+		defer walker.Close()
+		for {
+			name, entry, err := walker.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if entry.Mode == filemode.Dir || pathMatches(name, pathspecs, false) {
+				continue
+			}
+			partial.Entries = append(partial.Entries, &index.Entry{Name: name, Hash: entry.Hash, Mode: entry.Mode})
+		}
+	} else if err != plumbing.ErrReferenceNotFound {
+		return nil, err
+	}
+
+	for _, entry := range idx.Entries {
+		if pathMatches(entry.Name, pathspecs, false) {
+			staged := *entry
+			partial.Entries = append(partial.Entries, &staged)
+		}
+	}
+	sort.Slice(partial.Entries, func(i, j int) bool {
+		return partial.Entries[i].Name < partial.Entries[j].Name
+	})
+	return partial, nil
+}
+
+// commitPathspecs resolves the pathspecs given to commit against the top of
+// the working tree, checking something under them is staged. A pathspec
+// naming the whole repository means no limit, so nil is returned.
+func commitPathspecs(args []string) ([]string, error) {
+	pathspecs := []string{}
+	for _, arg := range args {
+		path, err := repoRelativePath(arg)
+		if err != nil {
+			return nil, err
+		}
+		if path == "." {
+			return nil, nil
+		}
+		pathspecs = append(pathspecs, path)
+	}
+	staged, err := stagedUnder(getRepo(), pathspecs)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	if !staged {
+		return nil, fmt.Errorf("no changes staged under %s", strings.Join(args, ", "))
+	}
+	return pathspecs, nil
+}
+
+// stagedUnder reports whether anything under the pathspecs is staged
+func stagedUnder(repo *git.Repository, pathspecs []string) (bool, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, err
+	}
+	staged, err := stagedStatus(repo, idx)
+	if err != nil {
+		return false, err
+	}
+	for path := range staged {
+		if pathMatches(path, pathspecs, false) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
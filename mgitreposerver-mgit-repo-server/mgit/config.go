@@ -111,18 +111,25 @@ func (c *Config) Set(section, key, value string) {
 	c.Sections[section][key] = value
 }
 
-// GetConfigFilePath returns the path to the config file
+// GetConfigFilePath returns the path to the config file. MGIT_GLOBAL_CONFIG
+// and MGIT_CONFIG override the global and local locations.
 func GetConfigFilePath(global bool) string {
 	if global {
-		home, err := os.UserHomeDir()
+		if path := os.Getenv("MGIT_GLOBAL_CONFIG"); path != "" {
+			return expandHomePath(path)
+		}
+		dir, err := userConfigDir()
 		if err != nil {
 			return ""
 		}
-		return filepath.Join(home, ".mgitconfig", "config")
+		return filepath.Join(dir, "config")
 	}
 	
 	// Local config
-	return ".mgit/config"
+	if path := os.Getenv("MGIT_CONFIG"); path != "" {
+		return expandHomePath(path)
+	}
+	return filepath.Join(mgitCommonDir(), "config")
 }
 
 // GetConfigValue gets a config value from either local or global config
@@ -134,17 +141,14 @@ func GetConfigValue(key, defaultValue string) string {
 	}
 	
 	// Parse the key into section and name
-	parts := strings.SplitN(key, ".", 2)
-	if len(parts) != 2 {
+	section, name, err := splitConfigKey(key)
+	if err != nil {
 		return defaultValue
 	}
 	
-	section := parts[0]
-	name := parts[1]
-	
 	// Check local config first
 	localConfigPath := GetConfigFilePath(false)
-	localConfig, err := LoadConfig(localConfigPath)
+	localConfig, err := LoadConfigWithIncludes(localConfigPath)
 	if err == nil {
 		value := localConfig.Get(section, name)
 		if value != "" {
@@ -154,7 +158,32 @@ func GetConfigValue(key, defaultValue string) string {
 	
 	// Then check global config
 	globalConfigPath := GetConfigFilePath(true)
-	globalConfig, err := LoadConfig(globalConfigPath)
+	globalConfig, err := LoadConfigWithIncludes(globalConfigPath)
+	if err == nil {
+		value := globalConfig.Get(section, name)
+		if value != "" {
+			return value
+		}
+	}
+	
+	return defaultValue
+}
+
+// GetGlobalConfigValue gets a config value from the environment or the
+// global config, never the local one, for the settings of a server that
+// the repositories it serves must not change
+func GetGlobalConfigValue(key, defaultValue string) string {
+	envKey := "MGIT_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+	if value, exists := os.LookupEnv(envKey); exists {
+		return value
+	}
+	
+	section, name, err := splitConfigKey(key)
+	if err != nil {
+		return defaultValue
+	}
+	
+	globalConfig, err := LoadConfigWithIncludes(GetConfigFilePath(true))
 	if err == nil {
 		value := globalConfig.Get(section, name)
 		if value != "" {
@@ -168,14 +197,11 @@ func GetConfigValue(key, defaultValue string) string {
 // SetConfigValue sets a config value in either local or global config
 func SetConfigValue(key, value string, global bool) error {
 	// Parse the key into section and name
-	parts := strings.SplitN(key, ".", 2)
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid config key format: %s", key)
+	section, name, err := splitConfigKey(key)
+	if err != nil {
+		return err
 	}
 	
-	section := parts[0]
-	name := parts[1]
-	
 	configPath := GetConfigFilePath(global)
 	config, err := LoadConfig(configPath)
 	if err != nil {
@@ -184,4 +210,94 @@ func SetConfigValue(key, value string, global bool) error {
 	
 	config.Set(section, name, value)
 	return config.Save(configPath)
+}
+
+// UnsetConfigValue removes a config value from either local or global config
+func UnsetConfigValue(key string, global bool) error {
+	section, name, err := splitConfigKey(key)
+	if err != nil {
+		return err
+	}
+	
+	configPath := GetConfigFilePath(global)
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	
+	if values, exists := config.Sections[section]; exists {
+		delete(values, name)
+	}
+	return config.Save(configPath)
+}
+
+// RenameConfigSection moves a section, such as [remote "origin"], and all
+// its values to a new name
+func RenameConfigSection(oldSection, newSection string, global bool) error {
+	configPath := GetConfigFilePath(global)
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	
+	values, exists := config.Sections[oldSection]
+	if !exists {
+		return nil
+	}
+	delete(config.Sections, oldSection)
+	config.Sections[newSection] = values
+	return config.Save(configPath)
+}
+
+// RemoveConfigSection removes a section and all its values
+func RemoveConfigSection(section string, global bool) error {
+	configPath := GetConfigFilePath(global)
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	
+	if _, exists := config.Sections[section]; !exists {
+		return nil
+	}
+	delete(config.Sections, section)
+	return config.Save(configPath)
+}
+
+// splitConfigKey splits a dotted key into its section and name. Keys with a
+// subsection (remote.origin.url) map to the git-style section header
+// [remote "origin"].
+func splitConfigKey(key string) (string, string, error) {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first <= 0 || last == len(key)-1 {
+		return "", "", fmt.Errorf("invalid config key format: %s", key)
+	}
+	
+	if first == last {
+		return key[:first], key[first+1:], nil
+	}
+	
+	return fmt.Sprintf("%s \"%s\"", key[:first], key[first+1:last]), key[last+1:], nil
+}
+
+// GetConfigBool gets a boolean config value, accepting the same spellings as git
+func GetConfigBool(key string, defaultValue bool) bool {
+	value, err := parseConfigBool(GetConfigValue(key, ""))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// expandHomePath expands a leading ~/ in a configured path
+func expandHomePath(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
 }
\ No newline at end of file
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxIncludeDepth guards against include cycles
+const maxIncludeDepth = 10
+
+// LoadConfigWithIncludes loads a config file and merges in the files named
+// by its [include] sections and by [includeIf "<condition>"] sections whose
+// condition matches the current repository. Values from included files
+// override the including file, as they do in git.
+//
+// Supported conditions:
+//
+//	gitdir:<pattern>     the repository's .git directory matches the glob
+//	gitdir/i:<pattern>   same, case-insensitively
+//	onbranch:<pattern>   the checked-out branch matches the glob
+func LoadConfigWithIncludes(file string) (*Config, error) {
+	return loadConfigWithIncludes(file, 0)
+}
+
+func loadConfigWithIncludes(file string, depth int) (*Config, error) {
+	config, err := LoadConfig(file)
+	if err != nil || depth >= maxIncludeDepth {
+		return config, err
+	}
+
+	// Apply includes in a stable order
+	sections := make([]string, 0, len(config.Sections))
+	for section := range config.Sections {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		includePath := config.Sections[section]["path"]
+		if includePath == "" || !includeApplies(section, file) {
+			continue
+		}
+
+		includePath = expandHomePath(includePath)
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(file), includePath)
+		}
+
+		included, err := loadConfigWithIncludes(includePath, depth+1)
+		if err != nil {
+			continue // Like git, a missing or unreadable include is ignored
+		}
+
+		for includedSection, values := range included.Sections {
+			for key, value := range values {
+				config.Set(includedSection, key, value)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// includeApplies reports whether a section is an include whose condition,
+// if any, matches the current repository
+func includeApplies(section, configFile string) bool {
+	lower := strings.ToLower(section)
+	if lower == "include" {
+		return true
+	}
+	if !strings.HasPrefix(lower, "includeif ") {
+		return false
+	}
+
+	condition := strings.TrimSpace(section[len("includeIf "):])
+	condition = strings.Trim(condition, `"`)
+
+	switch {
+	case strings.HasPrefix(condition, "gitdir:"):
+		return matchGitdirCondition(strings.TrimPrefix(condition, "gitdir:"), configFile, false)
+	case strings.HasPrefix(condition, "gitdir/i:"):
+		return matchGitdirCondition(strings.TrimPrefix(condition, "gitdir/i:"), configFile, true)
+	case strings.HasPrefix(condition, "onbranch:"):
+		return matchOnbranchCondition(strings.TrimPrefix(condition, "onbranch:"))
+	}
+	return false
+}
+
+// currentGitDir returns the absolute path of the current repository's .git
+// directory, or "" outside a repository
+func currentGitDir() string {
+	gitDir, err := filepath.Abs(repoGitDir())
+	if err != nil {
+		return ""
+	}
+	if _, err := os.Stat(gitDir); err != nil {
+		return ""
+	}
+	return gitDir
+}
+
+// matchGitdirCondition matches the .git directory against a gitdir pattern
+// using git's rules: ~/ expands to the home directory, ./ is relative to the
+// config file, other relative patterns match at any depth and a trailing
+// slash matches everything below the directory
+func matchGitdirCondition(pattern, configFile string, foldCase bool) bool {
+	gitDir := currentGitDir()
+	if gitDir == "" {
+		return false
+	}
+
+	trailingSlash := strings.HasSuffix(pattern, "/")
+	pattern = expandHomePath(pattern)
+	if strings.HasPrefix(pattern, "./") {
+		pattern = filepath.Join(filepath.Dir(configFile), pattern[2:])
+	} else if !filepath.IsAbs(pattern) {
+		pattern = "**/" + pattern
+	}
+	if trailingSlash {
+		pattern = strings.TrimSuffix(pattern, "/") + "/**"
+	}
+
+	pattern = filepath.ToSlash(pattern)
+	gitDir = filepath.ToSlash(gitDir)
+	if foldCase {
+		pattern = strings.ToLower(pattern)
+		gitDir = strings.ToLower(gitDir)
+	}
+
+	return globToRegexp(pattern).MatchString(gitDir)
+}
+
+// matchOnbranchCondition matches the checked-out branch against a pattern
+func matchOnbranchCondition(pattern string) bool {
+	gitDir := currentGitDir()
+	if gitDir == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return false
+	}
+	head := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(head, "ref: refs/heads/") {
+		return false
+	}
+	branch := strings.TrimPrefix(head, "ref: refs/heads/")
+
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	return globToRegexp(pattern).MatchString(branch)
+}
+
+// globToRegexp converts a wildmatch-style glob, where ** crosses directory
+// boundaries and * does not, into an anchored regular expression
+func globToRegexp(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
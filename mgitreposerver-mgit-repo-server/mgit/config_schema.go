@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configSchema checks the values of the config keys MGit knows. mgit config
+// refuses to set a value its key's check rejects, and mgit config
+// --validate audits the values already in a config file. Keys not listed
+// here, such as those with a subsection (remote.origin.url), take any value.
+var configSchema = map[string]func(string) error{
+	"user.pubkey":       validateNpub,
+	"notify.recipients": validateNostrKeys,
+	"notify.relays":     validateRelayURLs,
+
+	"blame.markIgnoredLines":     validateBool,
+	"clean.requireForce":         validateBool,
+	"commit.sign":                validateBool,
+	"commitmsg.requirePatientId": validateBool,
+	"core.gitFallback":           validateBool,
+	"core.untrackedCache":        validateBool,
+	"credential.useHttpPath":     validateBool,
+	"http.sslVerify":             validateBool,
+	"pull.verify":                validateBool,
+	"push.requireSigned":         validateBool,
+	"push.summaries":             validateBool,
+	"tag.sign":                   validateBool,
+	"verify.lookupMappings":      validateBool,
+
+	"commitmsg.maxSubjectLength": validatePositiveInt,
+	"http.idleTimeout":           validatePositiveInt,
+	"metadata.pageSize":          validatePositiveInt,
+	"push.chunkRetries":          validateNonNegativeInt,
+	"signer.baud":                validatePositiveInt,
+	"signer.timeout":             validatePositiveInt,
+	"sendemail.smtpServerPort":   validatePort,
+	"web.port":                   validatePort,
+	"push.chunkSize":             validateByteSize,
+	"core.abbrev":                validateAbbrev,
+
+	"diff.submodule":           validateOneOf("short", "log"),
+	"http.version":             validateOneOf("HTTP/2", "HTTP/1.1"),
+	"merge.ff":                 validateBoolOr("only"),
+	"mgit.displayHash":         validateOneOf("mgit", "git", "both"),
+	"mgit.sparseMetadata":      validateBool,
+	"sendemail.smtpEncryption": validateOneOf("ssl", "tls"),
+	"signer.backend":           validateOneOf("local", "device", "command"),
+}
+
+// validateConfigValue checks a value against its key's schema, if it has one
+func validateConfigValue(key, value string) error {
+	check, known := configSchema[key]
+	if !known {
+		return nil
+	}
+	if err := check(value); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return nil
+}
+
+// validateConfig checks every value of a config against the schema,
+// returning one message per bad value
+func validateConfig(config *Config) []string {
+	problems := []string{}
+	for section, values := range config.Sections {
+		for name, value := range values {
+			if strings.Contains(section, " ") {
+				continue // A subsection
+			}
+			if err := validateConfigValue(section+"."+name, value); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// parseConfigBool parses a boolean with the spellings git accepts
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean (true/false, yes/no, on/off, 1/0)", value)
+}
+
+func validateBool(value string) error {
+	_, err := parseConfigBool(value)
+	return err
+}
+
+func validateBoolOr(words ...string) func(string) error {
+	return func(value string) error {
+		for _, word := range words {
+			if strings.EqualFold(value, word) {
+				return nil
+			}
+		}
+		if _, err := parseConfigBool(value); err != nil {
+			return fmt.Errorf("%q is neither a boolean nor %s", value, strings.Join(words, ", "))
+		}
+		return nil
+	}
+}
+
+func validateOneOf(choices ...string) func(string) error {
+	return func(value string) error {
+		for _, choice := range choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(choices, ", "))
+	}
+}
+
+func validatePositiveInt(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("%q is not a positive number", value)
+	}
+	return nil
+}
+
+func validateNonNegativeInt(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a number of zero or more", value)
+	}
+	return nil
+}
+
+func validatePort(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("%q is not a port number", value)
+	}
+	return nil
+}
+
+func validateByteSize(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty size")
+	}
+	if size, err := parseByteSize(value); err != nil || size <= 0 {
+		return fmt.Errorf("%q is not a size such as 512k or 8m", value)
+	}
+	return nil
+}
+
+// validateAbbrev accepts what display_hash.go does: auto, off or 4 to 40
+func validateAbbrev(value string) error {
+	switch strings.ToLower(value) {
+	case "auto", "no", "false", "off":
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 4 || n > 40 {
+		return fmt.Errorf("%q is not auto, off or a length from 4 to 40", value)
+	}
+	return nil
+}
+
+// validateNpub accepts only a bech32 npub, the form commits carry
+func validateNpub(value string) error {
+	if !strings.HasPrefix(value, "npub1") {
+		return fmt.Errorf("%q is not an npub", value)
+	}
+	_, err := decodeNostrKey(value, "npub")
+	return err
+}
+
+// validateNostrKeys accepts a space-separated list of npubs or hex keys
+func validateNostrKeys(value string) error {
+	for _, key := range strings.Fields(value) {
+		if _, err := decodeNostrKey(key, "npub"); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// validateRelayURLs accepts a space-separated list of wss:// relay URLs
+func validateRelayURLs(value string) error {
+	relays := strings.Fields(value)
+	if len(relays) == 0 {
+		return fmt.Errorf("no relays given")
+	}
+	for _, relay := range relays {
+		u, err := url.Parse(relay)
+		if err != nil || u.Scheme != "wss" || u.Host == "" {
+			return fmt.Errorf("%q is not a wss:// URL", relay)
+		}
+	}
+	return nil
+}
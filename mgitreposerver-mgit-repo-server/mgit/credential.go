@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// credential is a description in git's credential helper protocol: a set of
+// key=value lines naming what a secret is for, and the secret itself. MGit
+// tokens travel as the password.
+type credential struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+	Password string
+	Quit     bool
+}
+
+// credentialForURL describes the credential for a repository URL. Unlike
+// git, the path is included unless credential.useHttpPath is false, since
+// MGit tokens are issued per repository rather than per server.
+func credentialForURL(repoURL string) credential {
+	cred := credential{Username: GetConfigValue("credential.username", "mgit")}
+	parsed, err := url.Parse(repoURL)
+	if err != nil || parsed.Host == "" {
+		cred.Host = repoURL
+		return cred
+	}
+
+	cred.Protocol = parsed.Scheme
+	cred.Host = parsed.Host
+	if parsed.User != nil && parsed.User.Username() != "" {
+		cred.Username = parsed.User.Username()
+	}
+	if GetConfigBool("credential.useHttpPath", true) {
+		cred.Path = strings.TrimPrefix(parsed.Path, "/")
+	}
+	return cred
+}
+
+// encode writes the credential in the helper protocol
+func (c credential) encode() string {
+	var buf strings.Builder
+	for _, field := range [][2]string{
+		{"protocol", c.Protocol},
+		{"host", c.Host},
+		{"path", c.Path},
+		{"username", c.Username},
+		{"password", c.Password},
+	} {
+		if field[1] != "" {
+			fmt.Fprintf(&buf, "%s=%s\n", field[0], field[1])
+		}
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// readCredential parses key=value lines up to a blank line or EOF, updating
+// cred with the keys it knows
+func readCredential(r io.Reader, cred *credential) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("invalid credential line: %s", line)
+		}
+		switch key {
+		case "protocol":
+			cred.Protocol = value
+		case "host":
+			cred.Host = value
+		case "path":
+			cred.Path = value
+		case "username":
+			cred.Username = value
+		case "password":
+			cred.Password = value
+		case "url":
+			parsed := credentialForURL(value)
+			cred.Protocol, cred.Host, cred.Path = parsed.Protocol, parsed.Host, parsed.Path
+		case "quit":
+			cred.Quit = value == "1" || value == "true"
+		}
+	}
+	return scanner.Err()
+}
+
+// credentialHelpers returns the helpers configured for a URL, in the order
+// to ask them: one set for the repository or its server
+// (credential.<url>.helper), then credential.helper.
+func credentialHelpers(repoURL string) []string {
+	candidates := []string{strings.TrimSuffix(repoURL, "/")}
+	if parsed, err := url.Parse(repoURL); err == nil && parsed.Host != "" {
+		candidates = append(candidates, parsed.Scheme+"://"+parsed.Host)
+	}
+
+	helpers := []string{}
+	for _, candidate := range candidates {
+		if helper := GetConfigValue("credential."+candidate+".helper", ""); helper != "" {
+			helpers = append(helpers, helper)
+			break
+		}
+	}
+	if helper := GetConfigValue("credential.helper", ""); helper != "" && (len(helpers) == 0 || helpers[0] != helper) {
+		helpers = append(helpers, helper)
+	}
+	return helpers
+}
+
+// runCredentialHelper runs a helper with an action (get, store or erase),
+// resolving its name the way git does: "!cmd" runs cmd in the shell, an
+// absolute path runs as is, and anything else names git-credential-<name>,
+// looked up on the PATH and then in git's own exec path.
+func runCredentialHelper(helper, action string, cred credential) (credential, error) {
+	command := helper
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		command = helper[1:]
+	case filepath.IsAbs(strings.Fields(helper)[0]):
+	default:
+		name := strings.Fields(helper)[0]
+		if _, err := exec.LookPath("git-credential-" + name); err == nil {
+			command = "git-credential-" + helper
+		} else {
+			command = "git credential-" + helper
+		}
+	}
+
+	cmd := exec.Command("sh", "-c", command+" "+action)
+	cmd.Stdin = strings.NewReader(cred.encode())
+	cmd.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return cred, fmt.Errorf("credential helper %q failed: %w", helper, err)
+	}
+
+	if action == "get" {
+		if err := readCredential(&stdout, &cred); err != nil {
+			return cred, fmt.Errorf("credential helper %q: %w", helper, err)
+		}
+	}
+	return cred, nil
+}
+
+// credentialFill asks the configured helpers for the token of a repository,
+// returning the first one a helper provides
+func credentialFill(repoURL string) (string, bool) {
+	cred := credentialForURL(repoURL)
+	for _, helper := range credentialHelpers(repoURL) {
+		result, err := runCredentialHelper(helper, "get", cred)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+			continue
+		}
+		if result.Password != "" {
+			return result.Password, true
+		}
+		if result.Quit {
+			break
+		}
+	}
+	return "", false
+}
+
+// credentialApprove tells the helpers a token worked so they can store it
+func credentialApprove(repoURL, token string) {
+	credentialNotify(repoURL, token, "store")
+}
+
+// credentialReject tells the helpers a token was refused so they can
+// forget it
+func credentialReject(repoURL, token string) {
+	credentialNotify(repoURL, token, "erase")
+}
+
+func credentialNotify(repoURL, token, action string) {
+	cred := credentialForURL(repoURL)
+	cred.Password = token
+	for _, helper := range credentialHelpers(repoURL) {
+		if _, err := runCredentialHelper(helper, action, cred); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		}
+	}
+}
+
+// HandleCredential handles the credential command, the counterpart of git
+// credential: it reads a credential description on stdin and fills it from
+// the helpers and tokens.json (fill), or passes it to the helpers to store
+// (approve) or erase (reject).
+func HandleCredential(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mgit credential (fill | approve | reject)")
+		os.Exit(1)
+	}
+
+	cred := credential{}
+	if err := readCredential(os.Stdin, &cred); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	repoURL := cred.Host
+	if cred.Protocol != "" {
+		repoURL = cred.Protocol + "://" + cred.Host
+	}
+	if cred.Path != "" {
+		repoURL += "/" + cred.Path
+	}
+
+	switch args[0] {
+	case "fill":
+		token, ok := credentialFill(repoURL)
+		if !ok {
+			token, ok = lookupStoredToken(repoURL)
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "No credential found for %s\n", repoURL)
+			os.Exit(1)
+		}
+		cred.Password = token
+		if cred.Username == "" {
+			cred.Username = credentialForURL(repoURL).Username
+		}
+		fmt.Print(cred.encode())
+	case "approve":
+		credentialApprove(repoURL, cred.Password)
+	case "reject":
+		credentialReject(repoURL, cred.Password)
+	default:
+		fmt.Println("Usage: mgit credential (fill | approve | reject)")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitRawDate matches git's internal date format, "<unix seconds> <offset>",
+// optionally prefixed with @
+var gitRawDate = regexp.MustCompile(`^@?(\d+)(?:\s+([+-]\d{4}))?$`)
+
+// dateLayouts are the date formats accepted by --date and GIT_AUTHOR_DATE,
+// covering the RFC 2822 and ISO 8601 forms git accepts
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006 -0700",
+	time.UnixDate,
+	time.ANSIC,
+}
+
+// parseDate parses a date given on the command line or in the environment.
+// Dates without a zone are taken to be local time.
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if match := gitRawDate.FindStringSubmatch(value); match != nil {
+		seconds, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q: %w", value, err)
+		}
+		when := time.Unix(seconds, 0)
+		if match[2] != "" {
+			offset, _ := time.Parse("-0700", match[2])
+			_, zoneOffset := offset.Zone()
+			when = when.In(time.FixedZone("", zoneOffset))
+		}
+		return when, nil
+	}
+
+	for _, layout := range dateLayouts {
+		if when, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return when, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// parseIdentity splits "Name <email>" into its name and email
+func parseIdentity(value string) (string, string, error) {
+	open := strings.Index(value, "<")
+	close := strings.LastIndex(value, ">")
+	if open < 0 || close < open {
+		return "", "", fmt.Errorf("invalid identity %q, expected \"Name <email>\"", value)
+	}
+
+	name := strings.TrimSpace(value[:open])
+	email := strings.TrimSpace(value[open+1 : close])
+	if name == "" {
+		return "", "", fmt.Errorf("invalid identity %q: name is empty", value)
+	}
+	return name, email, nil
+}
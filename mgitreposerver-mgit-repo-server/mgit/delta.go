@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// deltaBlock is the length of the base windows a delta can copy from.
+// Shorter matches cost more to encode than to insert.
+const deltaBlock = 16
+
+// Delta instructions. A delta starts with the base and target lengths as
+// uvarints, followed by instructions that build the target:
+//
+//	deltaInsert <uvarint n> <n bytes>         append the bytes
+//	deltaCopy   <uvarint offset> <uvarint n>  append n bytes of the base
+const (
+	deltaInsert byte = 'i'
+	deltaCopy   byte = 'c'
+)
+
+// makeDelta encodes target as a delta against base. MGit objects of related
+// commits share most of their text, so a delta is a fraction of the object.
+func makeDelta(base, target []byte) []byte {
+	var out bytes.Buffer
+	putUvarint(&out, uint64(len(base)))
+	putUvarint(&out, uint64(len(target)))
+
+	// Index the base by block, keeping the first occurrence of each
+	index := map[string]int{}
+	for i := 0; i+deltaBlock <= len(base); i++ {
+		block := string(base[i : i+deltaBlock])
+		if _, ok := index[block]; !ok {
+			index[block] = i
+		}
+	}
+
+	literal := 0 // start of the pending insert
+	flush := func(end int) {
+		if end > literal {
+			out.WriteByte(deltaInsert)
+			putUvarint(&out, uint64(end-literal))
+			out.Write(target[literal:end])
+		}
+	}
+
+	for i := 0; i+deltaBlock <= len(target); {
+		offset, ok := index[string(target[i:i+deltaBlock])]
+		if !ok {
+			i++
+			continue
+		}
+
+		// Extend the match forwards, and backwards into the pending insert
+		length := deltaBlock
+		for offset+length < len(base) && i+length < len(target) && base[offset+length] == target[i+length] {
+			length++
+		}
+		for offset > 0 && i > literal && base[offset-1] == target[i-1] {
+			offset--
+			i--
+			length++
+		}
+
+		flush(i)
+		out.WriteByte(deltaCopy)
+		putUvarint(&out, uint64(offset))
+		putUvarint(&out, uint64(length))
+		i += length
+		literal = i
+	}
+	flush(len(target))
+
+	return out.Bytes()
+}
+
+// applyDelta rebuilds the target a delta was made from
+func applyDelta(base, delta []byte) ([]byte, error) {
+	reader := bytes.NewReader(delta)
+	baseLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt delta header")
+	}
+	targetLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt delta header")
+	}
+	if baseLen != uint64(len(base)) {
+		return nil, fmt.Errorf("delta base is %d bytes, expected %d", len(base), baseLen)
+	}
+	if targetLen > maxMGitObjectSize {
+		return nil, fmt.Errorf("delta target of %d bytes is too large", targetLen)
+	}
+
+	target := make([]byte, 0, targetLen)
+	for reader.Len() > 0 {
+		op, _ := reader.ReadByte()
+		switch op {
+		case deltaInsert:
+			n, err := binary.ReadUvarint(reader)
+			if err != nil || n > uint64(reader.Len()) {
+				return nil, fmt.Errorf("corrupt delta: bad insert")
+			}
+			chunk := make([]byte, n)
+			reader.Read(chunk)
+			target = append(target, chunk...)
+		case deltaCopy:
+			offset, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, fmt.Errorf("corrupt delta: bad copy")
+			}
+			n, err := binary.ReadUvarint(reader)
+			if err != nil || offset > uint64(len(base)) || n > uint64(len(base))-offset {
+				return nil, fmt.Errorf("corrupt delta: copy outside base")
+			}
+			target = append(target, base[offset:offset+n]...)
+		default:
+			return nil, fmt.Errorf("corrupt delta: unknown instruction %q", op)
+		}
+		if uint64(len(target)) > targetLen {
+			return nil, fmt.Errorf("corrupt delta: target too long")
+		}
+	}
+
+	if uint64(len(target)) != targetLen {
+		return nil, fmt.Errorf("corrupt delta: target is %d bytes, expected %d", len(target), targetLen)
+	}
+	return target, nil
+}
+
+func putUvarint(buf *bytes.Buffer, value uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], value)])
+}
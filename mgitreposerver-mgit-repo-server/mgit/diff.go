@@ -0,0 +1,144 @@
+package main
+
+import "strings"
+
+// diffOp is the kind of a line edit
+type diffOp byte
+
+const (
+	diffEqual  diffOp = '='
+	diffDelete diffOp = '-'
+	diffInsert diffOp = '+'
+)
+
+// diffEdit is one line of an edit script. AIndex and BIndex are the line's
+// positions in the old and new text, -1 where it doesn't occur.
+type diffEdit struct {
+	Op     diffOp
+	Line   string
+	AIndex int
+	BIndex int
+}
+
+// splitLines splits text into lines that keep their "\n", so a missing
+// newline at the end of the text survives a round trip
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script from a to b with Myers'
+// O(ND) algorithm
+func diffLines(a, b []string) []diffEdit {
+	// Common prefix and suffix don't need the search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]diffEdit, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, diffEdit{Op: diffEqual, Line: a[i], AIndex: i, BIndex: i})
+	}
+	for _, edit := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		if edit.AIndex >= 0 {
+			edit.AIndex += prefix
+		}
+		if edit.BIndex >= 0 {
+			edit.BIndex += prefix
+		}
+		edits = append(edits, edit)
+	}
+	for i := 0; i < suffix; i++ {
+		ai := len(a) - suffix + i
+		bi := len(b) - suffix + i
+		edits = append(edits, diffEdit{Op: diffEqual, Line: a[ai], AIndex: ai, BIndex: bi})
+	}
+	return edits
+}
+
+func myers(a, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	offset := max
+	v := make([]int, 2*max+2)
+	trace := [][]int{}
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// Walk the trace backwards to recover the edits
+	edits := []diffEdit{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, diffEdit{Op: diffEqual, Line: a[x], AIndex: x, BIndex: y})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, diffEdit{Op: diffInsert, Line: b[y], AIndex: -1, BIndex: y})
+		} else {
+			x--
+			edits = append(edits, diffEdit{Op: diffDelete, Line: a[x], AIndex: x, BIndex: -1})
+		}
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// legacyConfigDirName is the directory under $HOME that held the global
+// config and tokens before mgit followed the XDG base directory spec
+const legacyConfigDirName = ".mgitconfig"
+
+var migrateConfigDirOnce sync.Once
+
+// userConfigDir returns the directory for the global config and tokens,
+// $XDG_CONFIG_HOME/mgit (~/.config/mgit by default). An existing
+// ~/.mgitconfig is moved there the first time it is needed.
+func userConfigDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" || !filepath.IsAbs(base) {
+		base = filepath.Join(home, ".config")
+	}
+	dir := filepath.Join(base, "mgit")
+
+	legacyDir := filepath.Join(home, legacyConfigDirName)
+	migrateConfigDirOnce.Do(func() {
+		migrateLegacyConfigDir(legacyDir, dir)
+	})
+
+	// Keep using the legacy directory if it couldn't be moved
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := os.Stat(legacyDir); err == nil {
+			return legacyDir, nil
+		}
+	}
+	return dir, nil
+}
+
+// userCacheDir returns the directory for caches that aren't tied to one
+// repository, $XDG_CACHE_HOME/mgit (~/.cache/mgit by default)
+func userCacheDir() (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" || !filepath.IsAbs(base) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(base, "mgit"), nil
+}
+
+// migrateLegacyConfigDir moves ~/.mgitconfig to the XDG location unless the
+// XDG directory already exists
+func migrateLegacyConfigDir(legacyDir, dir string) {
+	info, err := os.Stat(legacyDir)
+	if err != nil || !info.IsDir() {
+		return
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not migrate %s to %s: %s\n", legacyDir, dir, err)
+		return
+	}
+	if err := os.Rename(legacyDir, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not migrate %s to %s: %s\n", legacyDir, dir, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Moved %s to %s\n", legacyDir, dir)
+}
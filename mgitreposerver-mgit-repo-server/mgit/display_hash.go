@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How commits are named in log, show, status and commit output:
+//
+//	core.abbrev       length of abbreviated hashes: 4 to 40, "auto" (7)
+//	                  or "no" for full hashes
+//	mgit.displayHash  mgit, git or both
+//
+// Without mgit.displayHash the output is as it always was: one-line forms
+// give the MGit hash, and full commit headers give both.
+
+const defaultAbbrev = 7
+
+var (
+	displayOnce   sync.Once
+	displayAbbrev int
+	displayMode   string
+)
+
+func loadHashDisplay() {
+	displayOnce.Do(func() {
+		displayAbbrev = defaultAbbrev
+		switch value := strings.ToLower(GetConfigValue("core.abbrev", "auto")); value {
+		case "auto":
+		case "no", "false", "off":
+			displayAbbrev = 40
+		default:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 4 || n > 40 {
+				fmt.Fprintf(os.Stderr, "Warning: invalid core.abbrev %q, using %d\n", value, defaultAbbrev)
+				break
+			}
+			displayAbbrev = n
+		}
+
+		switch value := strings.ToLower(GetConfigValue("mgit.displayHash", "")); value {
+		case "", "mgit", "git", "both":
+			displayMode = value
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: invalid mgit.displayHash %q, expected mgit, git or both\n", value)
+		}
+	})
+}
+
+// abbrevLength is how many characters an abbreviated hash keeps
+func abbrevLength() int {
+	loadHashDisplay()
+	return displayAbbrev
+}
+
+// hashDisplayMode is mgit.displayHash, or "" when it isn't set
+func hashDisplayMode() string {
+	loadHashDisplay()
+	return displayMode
+}
+
+// displayShortHash names a commit in one-line output: its abbreviated
+// MGit hash, Git hash, or both as "<mgit>/<git>". A missing hash falls
+// back to the other.
+func displayShortHash(mgitHash, gitHash string) string {
+	switch {
+	case mgitHash == "":
+		return shortHash(gitHash)
+	case gitHash == "":
+		return shortHash(mgitHash)
+	}
+	switch hashDisplayMode() {
+	case "git":
+		return shortHash(gitHash)
+	case "both":
+		return shortHash(mgitHash) + "/" + shortHash(gitHash)
+	}
+	return shortHash(mgitHash)
+}
+
+// displayHashHeader is the hash lines that open a full commit: "commit
+// <hash>", with decorations after it, and "git-commit <git hash>" when
+// both are shown
+func displayHashHeader(mgitHash, gitHash, decorations string) string {
+	switch {
+	case hashDisplayMode() == "git" && gitHash != "":
+		return fmt.Sprintf("commit %s%s\n", gitHash, decorations)
+	case hashDisplayMode() == "mgit" || gitHash == "":
+		return fmt.Sprintf("commit %s%s\n", mgitHash, decorations)
+	}
+	return fmt.Sprintf("commit %s%s\ngit-commit %s\n", mgitHash, decorations, gitHash)
+}
+
+// displayParentHash names a parent in full, by its MGit hash, Git hash,
+// or both as "<mgit> (git <git>)"
+func displayParentHash(storage *MGitStorage, mgitHash string) string {
+	mode := hashDisplayMode()
+	if mode != "git" && mode != "both" {
+		return mgitHash
+	}
+	parent, err := storage.GetCommit(mgitHash)
+	if err != nil || parent.GitHash == "" {
+		return mgitHash
+	}
+	if mode == "git" {
+		return parent.GitHash
+	}
+	return fmt.Sprintf("%s (git %s)", mgitHash, parent.GitHash)
+}
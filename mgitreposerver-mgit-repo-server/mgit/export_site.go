@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// An exported site has the pages mgit web serves, as plain files:
+//
+//	index.html                      history of HEAD
+//	branch/<branch>.html            history of each branch
+//	commit/<mgit hash>.html         every commit on them, with its diff
+//	tree/<mgit hash>/index.html     files of HEAD and of each branch
+//	tree/<mgit hash>/<dir>/index.html
+//	tree/<mgit hash>/<file>.html
+//
+// Links between pages are relative, so the site works from any directory
+// of any web server, or straight from disk.
+
+func siteLogPage(rev string) string {
+	if rev == "" || rev == "HEAD" {
+		return "index.html"
+	}
+	return "branch/" + rev + ".html"
+}
+
+func siteCommitPage(hash string) string {
+	return "commit/" + hash + ".html"
+}
+
+func siteTreePage(hash, filePath string, dir bool) string {
+	if !dir {
+		return "tree/" + hash + "/" + filePath + ".html"
+	}
+	return path.Join("tree", hash, filePath, "index.html")
+}
+
+// siteExporter writes the pages of a site
+type siteExporter struct {
+	web   *webServer
+	dir   string
+	links webLinks
+	pages int
+}
+
+// HandleExportSite handles the export-site command, which writes a static
+// HTML site for browsing the repository into a directory:
+//
+//	mgit export-site [--force] <dir>
+//
+// The site is what mgit web shows: the MGit history with pubkeys and
+// verification badges, commit diffs, and the files of HEAD and of each
+// branch. The directory must be empty unless --force is given, which
+// writes over the pages already there.
+func HandleExportSite(args []string) {
+	force := false
+	dirs := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "-f" || arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printExportSiteUsage()
+			os.Exit(1)
+		default:
+			dirs = append(dirs, arg)
+		}
+	}
+	if len(dirs) != 1 {
+		printExportSiteUsage()
+		os.Exit(1)
+	}
+
+	if entries, err := os.ReadDir(dirs[0]); err == nil && len(entries) > 0 && !force {
+		fmt.Printf("Error: %s is not empty; use --force to write into it\n", dirs[0])
+		os.Exit(1)
+	}
+
+	exporter := &siteExporter{
+		web: &webServer{
+			repo:    getRepo(),
+			storage: NewMGitStorage(),
+			name:    repoDisplayName(),
+		},
+		dir: dirs[0],
+	}
+	commits, err := exporter.export()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d commits in %d pages to %s\n", commits, exporter.pages, dirs[0])
+}
+
+func printExportSiteUsage() {
+	fmt.Println("Usage: mgit export-site [--force] <dir>")
+}
+
+// export writes the whole site and returns how many commits it shows
+func (e *siteExporter) export() (int, error) {
+	s := e.web
+	head, err := resolveMGitRevision(s.repo, s.storage, "HEAD")
+	if err != nil {
+		return 0, fmt.Errorf("nothing to export: %w", err)
+	}
+
+	heads := map[string]*MCommitStruct{"HEAD": head}
+	branches := []string{}
+	for _, branch := range s.branches() {
+		commit, err := resolveMGitRevision(s.repo, s.storage, branch)
+		if err != nil {
+			fmt.Printf("Warning: skipping branch %s: %s\n", branch, err)
+			continue
+		}
+		heads[branch] = commit
+		branches = append(branches, branch)
+	}
+
+	e.links = webLinks{Static: true, Head: head.MGitHash, Trees: map[string]bool{}}
+	trees := map[string]*MCommitStruct{}
+	starts := []string{}
+	for _, commit := range heads {
+		if trees[commit.MGitHash] == nil {
+			trees[commit.MGitHash] = commit
+			e.links.Trees[commit.MGitHash] = true
+			starts = append(starts, commit.MGitHash)
+		}
+	}
+	sort.Strings(starts)
+
+	for _, rev := range append([]string{"HEAD"}, branches...) {
+		err := e.write(siteLogPage(rev), "log", map[string]interface{}{
+			"Rev":      rev,
+			"Branches": branches,
+			"Commits":  s.logCommits(heads[rev], 0),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	commits := mgitRange(s.storage, starts, nil)
+	for _, commit := range commits {
+		data, err := s.commitPage(commit)
+		if err != nil {
+			return 0, fmt.Errorf("error exporting commit %s: %w", shortHash(commit.MGitHash), err)
+		}
+		if err := e.write(siteCommitPage(commit.MGitHash), "commit", data); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, hash := range starts {
+		if err := e.writeTree(trees[hash]); err != nil {
+			return 0, err
+		}
+	}
+	return len(commits), nil
+}
+
+// writeTree writes the directory and file pages of a commit
+func (e *siteExporter) writeTree(commit *MCommitStruct) error {
+	gitCommit, err := e.web.repo.CommitObject(plumbing.NewHash(commit.GitHash))
+	if err != nil {
+		return err
+	}
+	tree, err := gitCommit.Tree()
+	if err != nil {
+		return err
+	}
+
+	pending := []webTreeEntry{{Dir: true}}
+	for len(pending) > 0 {
+		entry := pending[0]
+		pending = pending[1:]
+
+		name, data, err := e.web.treePage(commit, tree, entry.Path)
+		if err != nil {
+			// Submodules can't be browsed, as in mgit web
+			name, data = "error", map[string]interface{}{"Error": err.Error()}
+		}
+		if err := e.write(siteTreePage(commit.MGitHash, entry.Path, entry.Dir), name, data); err != nil {
+			return err
+		}
+		if entries, ok := data["Entries"].([]webTreeEntry); ok {
+			pending = append(pending, entries...)
+		}
+	}
+	return nil
+}
+
+// write renders a page of the site, linking relative to where it is
+func (e *siteExporter) write(page, name string, data map[string]interface{}) error {
+	links := e.links
+	links.Root = strings.Repeat("../", strings.Count(page, "/"))
+	data["Repo"] = e.web.name
+	data["Links"] = links
+
+	var buf bytes.Buffer
+	if err := webTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		return fmt.Errorf("error rendering %s: %w", page, err)
+	}
+	file := filepath.Join(e.dir, filepath.FromSlash(page))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	e.pages++
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// commitFormatData is what a --format template sees for a commit:
+//
+//	.MGitHash .GitHash  full hashes
+//	.Parents            parent MGit hashes
+//	.Author .Committer  .Name .Email .Pubkey (npub) .When
+//	.Subject .Body      the message's first line and the rest
+//	.Message            the whole message
+//	.Signature          "good", "bad" or "none"
+//	.SignatureError     why a bad signature is bad
+//	.Refs               branches pointing at the commit
+//	.Head               whether HEAD is the commit
+//
+// Besides the text/template builtins, templates can use short (7 hex
+// digits), npub (abbreviated pubkey), date (with an optional Go time
+// layout) and join.
+type commitFormatData struct {
+	MGitHash       string
+	GitHash        string
+	Parents        []string
+	Author         *MGitSignature
+	Committer      *MGitSignature
+	Subject        string
+	Body           string
+	Message        string
+	Signature      string
+	SignatureError string
+	Refs           []string
+	Head           bool
+}
+
+// branchFormatData is what a branch --format template sees:
+//
+//	.Name .Current  the branch and whether it is checked out
+//	.GitHash        the Git commit the branch points at
+//	.Commit         that commit's MGit data as above, or nil without one
+type branchFormatData struct {
+	Name    string
+	Current bool
+	GitHash string
+	Commit  *commitFormatData
+}
+
+// formatFuncs are the functions --format templates get
+var formatFuncs = template.FuncMap{
+	"short": shortHash,
+	"npub":  shortPubkey,
+	"date": func(t time.Time, layout ...string) string {
+		if len(layout) > 0 {
+			return t.Format(layout[0])
+		}
+		return t.Format("2006-01-02 15:04:05 -0700")
+	},
+	"join": func(items []string, sep string) string { return strings.Join(items, sep) },
+}
+
+// parseFormat parses a --format template. Escapes like \n and \t are
+// expanded so they can be written on the command line.
+func parseFormat(format string) (*template.Template, error) {
+	format = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(format)
+	tmpl, err := template.New("format").Funcs(formatFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format: %w", err)
+	}
+	return tmpl, nil
+}
+
+// executeFormat prints one template result, ending it with a newline
+// unless the template already did, like git's tformat
+func executeFormat(w io.Writer, tmpl *template.Template, data interface{}) error {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return err
+	}
+	out := b.String()
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// commitFormatter prints commits with a --format template
+type commitFormatter struct {
+	tmpl *template.Template
+	refs map[string][]string // MGit hash -> branch names
+	head string
+}
+
+// newCommitFormatter parses a template and loads the refs it may show
+func newCommitFormatter(storage *MGitStorage, format string) (*commitFormatter, error) {
+	tmpl, err := parseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	f := &commitFormatter{tmpl: tmpl, refs: mgitBranchesByHash(storage)}
+	if head, err := storage.GetHeadCommit(); err == nil {
+		f.head = head.MGitHash
+	}
+	return f, nil
+}
+
+// Data returns the template data of a commit
+func (f *commitFormatter) Data(commit *MCommitStruct) *commitFormatData {
+	data := &commitFormatData{
+		MGitHash:  commit.MGitHash,
+		GitHash:   commit.GitHash,
+		Parents:   commit.ParentHashes,
+		Author:    commit.Author,
+		Committer: commit.Committer,
+		Message:   commit.Message,
+		Refs:      f.refs[commit.MGitHash],
+		Head:      commit.MGitHash == f.head,
+	}
+	if data.Committer == nil {
+		data.Committer = commit.Author
+	}
+	data.Subject, data.Body, _ = strings.Cut(strings.TrimRight(commit.Message, "\n"), "\n")
+	data.Body = strings.TrimLeft(data.Body, "\n")
+
+	switch signed, err := verifyMGitSignature(commit); {
+	case err != nil:
+		data.Signature = "bad"
+		data.SignatureError = err.Error()
+	case signed:
+		data.Signature = "good"
+	default:
+		data.Signature = "none"
+	}
+	return data
+}
+
+// Print prints a commit with the template
+func (f *commitFormatter) Print(commit *MCommitStruct) {
+	if err := executeFormat(os.Stdout, f.tmpl, f.Data(commit)); err != nil {
+		fmt.Printf("Error formatting commit %s: %s\n", shortHash(commit.MGitHash), err)
+		os.Exit(1)
+	}
+}
+
+// mgitBranchesByHash maps MGit hashes to the MGit branches at them
+func mgitBranchesByHash(storage *MGitStorage) map[string][]string {
+	refs := map[string][]string{}
+	root := filepath.Join(storage.RootDir, "refs", "heads")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		name, _ := filepath.Rel(root, path)
+		hash := strings.TrimSpace(string(data))
+		refs[hash] = append(refs[hash], filepath.ToSlash(name))
+		return nil
+	})
+	for _, names := range refs {
+		sort.Strings(names)
+	}
+	return refs
+}
+
+// printBranchesFormatted prints each branch with a --format template
+func printBranchesFormatted(branches storer.ReferenceIter, current, format string) error {
+	storage := NewMGitStorage()
+	commits, err := newCommitFormatter(storage, format)
+	if err != nil {
+		return err
+	}
+	return branches.ForEach(func(branch *plumbing.Reference) error {
+		data := branchFormatData{
+			Name:    branch.Name().Short(),
+			Current: branch.Name().Short() == current,
+			GitHash: branch.Hash().String(),
+		}
+		if mgitHash, err := storage.GetMGitHashFromGit(data.GitHash); err == nil {
+			if commit, err := storage.GetCommit(mgitHash); err == nil {
+				data.Commit = commits.Data(commit)
+			}
+		}
+		return executeFormat(os.Stdout, commits.tmpl, data)
+	})
+}
+
+// formatOption removes a --format=<template> option from args, returning
+// the template and the remaining arguments
+func formatOption(args []string) (string, []string) {
+	format := ""
+	rest := []string{}
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "--format="); ok {
+			format = value
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return format, rest
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mgit fsck checks the MGit store the way git fsck checks git's:
+//
+//	mgit fsck [--no-dangling]
+//	mgit fsck --rebuild-mappings [--dry-run]
+//
+// Every object in .mgit/objects, loose or packed, must parse and hash to
+// its name, and a commit must name a Git commit the repository has and
+// parents it has objects for, short of a shallow boundary or sparse
+// metadata. Every mapping must point at an MGit object of the same Git
+// commit, and every object at a mapping. Every ref must name an object,
+// and each branch's MGit ref the MGit commit of its Git tip. Each problem
+// is printed with the repair for it, and fsck fails if there are any.
+// Objects nothing reaches (see reachableMGitObjects) are listed as
+// dangling, which is no problem: gc prunes them in time.
+//
+// --rebuild-mappings regenerates hash_mappings.json from the objects
+// instead; --dry-run reports what a rebuild would do without writing.
+
+// HandleFsck handles the fsck command
+func HandleFsck(args []string) {
+	rebuild := false
+	dryRun := false
+	dangling := true
+	for _, arg := range args {
+		switch arg {
+		case "--rebuild-mappings":
+			rebuild = true
+		case "-n", "--dry-run":
+			dryRun = true
+		case "--no-dangling":
+			dangling = false
+		case "--dangling":
+			dangling = true
+		default:
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		}
+	}
+	if dryRun && !rebuild {
+		fmt.Println("Usage: mgit fsck [--no-dangling] | mgit fsck --rebuild-mappings [--dry-run]")
+		os.Exit(1)
+	}
+
+	if rebuild {
+		if err := rebuildMappings(getRepo(), NewMGitStorage(), dryRun); err != nil {
+			fmt.Printf("Error rebuilding mappings: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	report, err := checkMGitStore(getRepo(), NewMGitStorage(), dangling)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Checked %d objects, %d mappings and %d refs", report.Objects, report.Mappings, report.Refs)
+	if report.Dangling > 0 {
+		fmt.Printf(", %d dangling", report.Dangling)
+	}
+	fmt.Println()
+	switch {
+	case report.Problems == 1:
+		fmt.Println("1 problem found")
+		os.Exit(1)
+	case report.Problems > 1:
+		fmt.Printf("%d problems found\n", report.Problems)
+		os.Exit(1)
+	}
+}
+
+// fsckReport counts what fsck checked and found
+type fsckReport struct {
+	Objects  int
+	Mappings int
+	Refs     int
+	Problems int
+	Dangling int
+}
+
+// problem reports a problem and how to repair it
+func (r *fsckReport) problem(repair, format string, args ...interface{}) {
+	r.Problems++
+	fmt.Printf("error: "+format+"\n", args...)
+	if repair != "" {
+		fmt.Printf("  repair: %s\n", repair)
+	}
+}
+
+// fsckObject is what fsck learned of a valid object
+type fsckObject struct {
+	Type    MGitObjectType
+	GitHash string // of a commit
+}
+
+// checkMGitStore runs fsck's checks on an MGit store, printing what it
+// finds
+func checkMGitStore(repo *git.Repository, storage *MGitStorage, dangling bool) (*fsckReport, error) {
+	report := &fsckReport{}
+	objects, err := fsckObjects(repo, storage, report)
+	if err != nil {
+		return nil, err
+	}
+	if err := fsckMappings(storage, objects, report); err != nil {
+		return nil, err
+	}
+	if err := fsckRefs(repo, storage, objects, report); err != nil {
+		return nil, err
+	}
+	if !dangling {
+		return report, nil
+	}
+
+	reachable, err := reachableMGitObjects(repo, storage)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(objects))
+	for hash := range objects {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if !reachable[hash] {
+			fmt.Printf("dangling %s %s\n", objects[hash].Type, hash)
+			report.Dangling++
+		}
+	}
+	return report, nil
+}
+
+// objectRepair suggests how to repair a damaged object: a loose one can be
+// removed and fetched again, a packed one only restored with its pack
+func objectRepair(rootDir, hash string) string {
+	path := mgitObjectPath(rootDir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Sprintf("remove %s and run 'mgit pull' to fetch it again", path)
+	}
+	return "the pack holding it is damaged; restore .mgit/objects/pack from a backup or another clone"
+}
+
+// fsckObjects checks every object, returning the valid ones
+func fsckObjects(repo *git.Repository, storage *MGitStorage, report *fsckReport) (map[string]fsckObject, error) {
+	if err := fsckPacks(storage.RootDir, report); err != nil {
+		return nil, err
+	}
+	hashes, err := listMGitObjects(storage.RootDir)
+	if err != nil {
+		// A pack index that can't be read hides every object of its pack
+		report.problem("remove the index and its pack, then restore the pack from a backup or another clone",
+			"objects can't be listed: %s", err)
+		if hashes, err = listLooseObjects(storage.RootDir); err != nil {
+			return nil, err
+		}
+	}
+	report.Objects = len(hashes)
+
+	shallow := loadMGitShallow(storage.RootDir)
+	sparse := sparseMetadataEnabled()
+	objects := map[string]fsckObject{}
+	for _, hash := range hashes {
+		data, err := readMGitObject(storage.RootDir, hash)
+		if err != nil {
+			report.problem(objectRepair(storage.RootDir, hash), "object %s can't be read: %s", hash, err)
+			continue
+		}
+		var header struct {
+			Type MGitObjectType `json:"type"`
+		}
+		if err := json.Unmarshal(data, &header); err != nil {
+			report.problem(objectRepair(storage.RootDir, hash), "object %s is not valid JSON: %s", hash, err)
+			continue
+		}
+
+		switch header.Type {
+		case MGitTagObject:
+			var tag MTagStruct
+			if err := json.Unmarshal(data, &tag); err != nil {
+				report.problem(objectRepair(storage.RootDir, hash), "tag %s doesn't parse: %s", hash, err)
+				continue
+			}
+			if tag.MGitHash != hash || computeMGitTagHash(&tag) != hash {
+				report.problem(objectRepair(storage.RootDir, hash), "tag %s doesn't hash to its name", hash)
+				continue
+			}
+			if !hasMGitObject(storage.RootDir, tag.Object) {
+				report.problem("run 'mgit pull' to fetch it", "missing %s %s, tagged by %s", tag.ObjectType, tag.Object, hash)
+			}
+			objects[hash] = fsckObject{Type: MGitTagObject}
+
+		case MGitCommitObject, "":
+			var commit MCommitStruct
+			if err := json.Unmarshal(data, &commit); err != nil {
+				report.problem(objectRepair(storage.RootDir, hash), "commit %s doesn't parse: %s", hash, err)
+				continue
+			}
+			if commit.MGitHash != hash {
+				report.problem(objectRepair(storage.RootDir, hash), "commit %s claims to be %s", hash, commit.MGitHash)
+				continue
+			}
+			if commit.GitHash == "" {
+				report.problem(objectRepair(storage.RootDir, hash), "commit %s names no Git commit", hash)
+				continue
+			}
+			objects[hash] = fsckObject{Type: MGitCommitObject, GitHash: commit.GitHash}
+
+			expected, err := expectedMGitHash(repo, &commit)
+			switch {
+			case err != nil:
+				report.problem("run 'mgit pull' to fetch the Git commit; if it was discarded, 'mgit gc' prunes the object once nothing reaches it",
+					"commit %s maps to Git commit %s, which the repository doesn't have", hash, commit.GitHash)
+			case expected.String() != hash:
+				report.problem(objectRepair(storage.RootDir, hash),
+					"commit %s doesn't hash to its name: its Git commit, parents and pubkey make %s", hash, expected)
+			}
+			if shallow[hash] || sparse {
+				continue
+			}
+			for _, parent := range commit.ParentHashes {
+				if !hasMGitObject(storage.RootDir, parent) {
+					report.problem("run 'mgit pull' to fetch it", "missing commit %s, parent of %s", parent, hash)
+				}
+			}
+
+		default:
+			report.problem(objectRepair(storage.RootDir, hash), "object %s has unknown type %q", hash, header.Type)
+		}
+	}
+	return objects, nil
+}
+
+// fsckPacks checks every local pack has an index. A pack without one is
+// ignored, so its objects are only as good as missing.
+func fsckPacks(rootDir string, report *fsckReport) error {
+	packs, err := filepath.Glob(filepath.Join(mgitPackDir(rootDir), "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		if _, err := os.Stat(strings.TrimSuffix(pack, ".pack") + ".idx"); os.IsNotExist(err) {
+			report.problem("it is left over from an interrupted gc; remove it, or let 'mgit gc' remove it once it is an hour old",
+				"pack %s has no index", filepath.Base(pack))
+		}
+	}
+	return nil
+}
+
+// fsckMappings checks every mapping points at an object of its Git commit,
+// and every commit object has a mapping
+func fsckMappings(storage *MGitStorage, objects map[string]fsckObject, report *fsckReport) error {
+	rebuild := "run 'mgit fsck --rebuild-mappings' to regenerate the mappings from the objects"
+	mapped := map[string]bool{}
+	err := streamMappingsFile(storage.Mappings().Path(), func(mapping NostrCommitMapping) error {
+		report.Mappings++
+		object, ok := objects[mapping.MGitHash]
+		switch {
+		case !isMGitHash(mapping.MGitHash) || mapping.GitHash == "":
+			report.problem(rebuild, "mapping %q -> %q is incomplete", mapping.GitHash, mapping.MGitHash)
+		case !ok && !hasMGitObject(storage.RootDir, mapping.MGitHash):
+			report.problem("run 'mgit pull' to fetch it",
+				"missing commit %s, mapped from Git commit %s", mapping.MGitHash, mapping.GitHash)
+		case !ok:
+			// The object is damaged, which was reported with it
+		case object.GitHash != mapping.GitHash:
+			report.problem(rebuild, "mapping %s -> %s, but that object is of Git commit %s",
+				mapping.GitHash, mapping.MGitHash, object.GitHash)
+		default:
+			mapped[mapping.MGitHash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		report.problem(rebuild, "the mapping file is damaged: %s", err)
+		return nil
+	}
+
+	for hash, object := range objects {
+		if object.Type == MGitCommitObject && !mapped[hash] {
+			report.problem(rebuild, "commit %s has no mapping to Git commit %s", hash, object.GitHash)
+		}
+	}
+	return nil
+}
+
+// fsckRefs checks every MGit ref and HEAD name a valid object, and each
+// branch's MGit ref agrees with its Git tip
+func fsckRefs(repo *git.Repository, storage *MGitStorage, objects map[string]fsckObject, report *fsckReport) error {
+	refsDir := filepath.Join(storage.RootDir, "refs")
+	err := filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return err
+		}
+		rel, err := filepath.Rel(storage.RootDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		report.Refs++
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash := strings.TrimSpace(string(data))
+		branch, isBranch := strings.CutPrefix(name, "refs/heads/")
+		repair := fmt.Sprintf("remove %s, or point it at the right MGit hash", path)
+		if isBranch {
+			repair = "run 'mgit verify --fix-refs' to point it at the MGit commit of its Git tip"
+			if _, err := repo.Reference(plumbing.NewBranchReferenceName(branch), false); err != nil {
+				report.problem(fmt.Sprintf("remove %s, or recreate the Git branch", path),
+					"%s has no Git branch", name)
+				return nil
+			}
+		}
+
+		object, ok := objects[hash]
+		switch {
+		case !isMGitHash(hash):
+			report.problem(repair, "%s holds %q, which is not an MGit hash", name, hash)
+		case !ok && !hasMGitObject(storage.RootDir, hash):
+			report.problem("run 'mgit pull' to fetch it", "missing object %s, named by %s", hash, name)
+		case ok && isBranch && object.Type != MGitCommitObject:
+			report.problem(repair, "%s points at %s, which is a %s, not a commit", name, hash, object.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// HEAD names a branch, which may not have commits yet, or an object
+	report.Refs++
+	head, err := storage.GetHead()
+	switch {
+	case err != nil:
+		report.problem("run 'mgit checkout <branch>' to write it again", "HEAD can't be read: %s", err)
+	case strings.HasPrefix(head, "refs/"):
+	case !isMGitHash(strings.TrimSpace(head)):
+		report.problem("run 'mgit checkout <branch>' to write it again", "HEAD holds %q, which is neither a ref nor an MGit hash", head)
+	case !hasMGitObject(storage.RootDir, strings.TrimSpace(head)):
+		report.problem("run 'mgit pull' to fetch it", "missing commit %s, HEAD's", strings.TrimSpace(head))
+	}
+
+	// Branches whose MGit ref drifted from Git, e.g. by a plain git commit
+	branches, err := repo.Branches()
+	if err != nil {
+		return err
+	}
+	return branches.ForEach(func(ref *plumbing.Reference) error {
+		m, err := checkBranchRefs(repo, storage, ref.Name().Short())
+		if err != nil || m == nil || m.MGitRef != "" && !isMGitHash(strings.TrimSpace(m.MGitRef)) {
+			return err
+		}
+		if m.TipMGit == "" {
+			report.problem(fmt.Sprintf("run 'mgit checkout --reconcile %s' to create its MGit commits", m.Branch), "%s", m)
+		} else {
+			report.problem("run 'mgit verify --fix-refs' to point it at the MGit commit of its Git tip", "%s", m)
+		}
+		return nil
+	})
+}
+
+// rebuildMappings regenerates the mapping store from the commit objects in
+// .mgit/objects, which hold the same Git hash, MGit hash and pubkey as the
+// mapping entries. Mappings the old file has for commits without an object
+// are kept, as far as the file can still be read; the old file is backed
+// up before it is replaced.
+func rebuildMappings(repo *git.Repository, storage *MGitStorage, dryRun bool) error {
+	hashes, err := listMGitObjects(storage.RootDir)
+	if err != nil {
+		return fmt.Errorf("error listing objects: %w", err)
+	}
+
+	rebuilt := []NostrCommitMapping{}
+	covered := map[string]bool{}
+	bad := 0
+	for _, hash := range hashes {
+		data, err := readMGitObject(storage.RootDir, hash)
+		if err != nil {
+			return err
+		}
+		var commit MCommitStruct
+		switch err := json.Unmarshal(data, &commit); {
+		case err != nil:
+			fmt.Printf("Error: object %s is not valid JSON: %s\n", hash, err)
+			bad++
+			continue
+		case commit.MGitHash != hash:
+			fmt.Printf("Error: object %s claims to be %s\n", hash, commit.MGitHash)
+			bad++
+			continue
+		case commit.Type == MGitTagObject:
+			continue
+		case commit.GitHash == "":
+			fmt.Printf("Error: object %s names no Git commit\n", hash)
+			bad++
+			continue
+		}
+		if _, err := repo.CommitObject(plumbing.NewHash(commit.GitHash)); err != nil {
+			fmt.Printf("Warning: object %s maps to Git commit %s, which this repository doesn't have\n",
+				shortHash(hash), shortHash(commit.GitHash))
+		}
+
+		pubkey := ""
+		if commit.Author != nil {
+			pubkey = commit.Author.Pubkey
+		}
+		rebuilt = append(rebuilt, NostrCommitMapping{GitHash: commit.GitHash, MGitHash: hash, Pubkey: pubkey})
+		covered[commit.GitHash] = true
+		covered[hash] = true
+	}
+
+	// Salvage what the old file still has for commits without an object.
+	// A corrupted file ends the salvage where it breaks.
+	kept := 0
+	store := storage.Mappings()
+	_, statErr := os.Stat(store.Path())
+	err = streamMappingsFile(store.Path(), func(mapping NostrCommitMapping) error {
+		if mapping.GitHash == "" || mapping.MGitHash == "" || covered[mapping.GitHash] || covered[mapping.MGitHash] {
+			return nil
+		}
+		rebuilt = append(rebuilt, mapping)
+		covered[mapping.GitHash] = true
+		kept++
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Warning: the mapping file is damaged, salvaged what came before: %s\n", err)
+	}
+
+	fmt.Printf("%d mappings from %d objects", len(rebuilt)-kept, len(hashes))
+	if bad > 0 {
+		fmt.Printf(" (%d unusable)", bad)
+	}
+	if kept > 0 {
+		fmt.Printf(", %d kept from the old mapping file", kept)
+	}
+	fmt.Println()
+	if dryRun {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(store.Path()), 0755); err != nil {
+		return err
+	}
+	if statErr == nil {
+		backup := fmt.Sprintf("%s.%s.bak", store.Path(), time.Now().Format("20060102150405"))
+		if err := copyFile(store.Path(), backup); err != nil {
+			return fmt.Errorf("error backing up the mapping file: %w", err)
+		}
+		fmt.Printf("Old mapping file saved as %s\n", backup)
+	}
+
+	writer, err := newMappingFileWriter(store.Path()+".tmp", false)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort()
+	for _, mapping := range rebuilt {
+		if err := writer.Add(mapping); err != nil {
+			return err
+		}
+	}
+	return writer.Commit(store.Path())
+}
+
+// copyFile copies a file's content
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(to, data, 0644)
+}
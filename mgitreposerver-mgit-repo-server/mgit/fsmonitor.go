@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+)
+
+// fsmonitorMaxLog is the size at which the daemon starts a new change log,
+// which costs a single full rescan
+const fsmonitorMaxLog = 8 << 20
+
+// fsmonitorRescan is the change log line asking for a full rescan
+const fsmonitorRescan = "*"
+
+// fsmonitorBaseline is the worktree status as of the last status call, and
+// how far into the change log it accounts for
+type fsmonitorBaseline struct {
+	Offset        int64    `json:"offset"`
+	IndexChecksum string   `json:"index_checksum"`
+	Modified      []string `json:"modified"`
+	Deleted       []string `json:"deleted"`
+	Untracked     []string `json:"untracked"`
+}
+
+// fsmonitorDir returns the directory holding the daemon's pid file, change
+// log and the cached status baseline
+func fsmonitorDir() string {
+	return filepath.Join(mgitDir(), "cache", "fsmonitor")
+}
+
+// HandleFsmonitor handles the fsmonitor command
+func HandleFsmonitor(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mgit fsmonitor (start | stop | status)")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "start":
+		if err := startFsmonitor(); err != nil {
+			fmt.Printf("Error starting fsmonitor: %s\n", err)
+			os.Exit(1)
+		}
+	case "stop":
+		if err := stopFsmonitor(); err != nil {
+			fmt.Printf("Error stopping fsmonitor: %s\n", err)
+			os.Exit(1)
+		}
+	case "status":
+		if pid, running := fsmonitorPid(); running {
+			fmt.Printf("fsmonitor is running (pid %d)\n", pid)
+		} else {
+			fmt.Println("fsmonitor is not running")
+		}
+	case "run":
+		// Internal: the daemon itself, started by 'mgit fsmonitor start'
+		if err := runFsmonitor(); err != nil {
+			fmt.Printf("Error running fsmonitor: %s\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("Usage: mgit fsmonitor (start | stop | status)")
+		os.Exit(1)
+	}
+}
+
+// fsmonitorPid returns the pid of the daemon and whether it is running
+func fsmonitorPid() (int, bool) {
+	data, err := os.ReadFile(filepath.Join(fsmonitorDir(), "daemon.pid"))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return pid, false
+	}
+	return pid, process.Signal(syscall.Signal(0)) == nil
+}
+
+// startFsmonitor starts the daemon in the background
+func startFsmonitor() error {
+	if pid, running := fsmonitorPid(); running {
+		fmt.Printf("fsmonitor is already running (pid %d)\n", pid)
+		return nil
+	}
+
+	repo := getRepo()
+	if _, err := repo.Worktree(); err != nil {
+		return fmt.Errorf("fsmonitor needs a worktree: %w", err)
+	}
+
+	dir := fsmonitorDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating fsmonitor directory: %w", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(repoRoot())
+	if err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, "daemon.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, "-C", root, "fsmonitor", "run")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	// Wait for the daemon to set up its watches
+	for i := 0; i < 50; i++ {
+		if current, running := fsmonitorPid(); running && current == pid {
+			fmt.Printf("fsmonitor started (pid %d)\n", pid)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("daemon did not start, see %s", filepath.Join(dir, "daemon.log"))
+}
+
+// stopFsmonitor asks the daemon to exit
+func stopFsmonitor() error {
+	pid, running := fsmonitorPid()
+	if !running {
+		fmt.Println("fsmonitor is not running")
+		return nil
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(os.Interrupt); err != nil {
+		return err
+	}
+	fmt.Printf("fsmonitor stopped (pid %d)\n", pid)
+	return nil
+}
+
+// runFsmonitor watches the worktree and appends every changed path to the
+// change log until interrupted
+func runFsmonitor() error {
+	root, err := filepath.Abs(repoRoot())
+	if err != nil {
+		return err
+	}
+	dir := fsmonitorDir()
+	logPath := filepath.Join(dir, "changes")
+	pidPath := filepath.Join(dir, "daemon.pid")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if _, err := watchTree(watcher, root, root); err != nil {
+		return err
+	}
+
+	// Changes made while no daemon was watching are unknown
+	if err := os.WriteFile(logPath, []byte(fsmonitorRescan+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(pidPath)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	signal.Ignore(syscall.SIGHUP)
+
+	fmt.Printf("fsmonitor watching %s\n", root)
+	for {
+		select {
+		case <-signals:
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			rel, err := filepath.Rel(root, event.Name)
+			if err != nil || isMetadataPath(filepath.ToSlash(rel)) {
+				continue
+			}
+
+			changed := []string{filepath.ToSlash(rel)}
+			if event.Has(fsnotify.Create) {
+				// Files may land in a new directory before it is watched
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					files, err := watchTree(watcher, root, event.Name)
+					if err != nil {
+						fmt.Printf("Warning: %s\n", err)
+						changed = []string{fsmonitorRescan}
+					} else {
+						changed = append(changed, files...)
+					}
+				}
+			}
+			if err := appendFsmonitorLog(logPath, changed); err != nil {
+				fmt.Printf("Warning: could not record change: %s\n", err)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Usually a queue overflow, so events may have been lost
+			fmt.Printf("Warning: %s\n", err)
+			appendFsmonitorLog(logPath, []string{fsmonitorRescan})
+		}
+	}
+}
+
+// isMetadataPath reports whether a worktree-relative path belongs to the
+// .git or .mgit directories, whose changes don't affect status
+func isMetadataPath(path string) bool {
+	for _, dir := range []string{".git", ".mgit"} {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// watchTree adds watches for a directory and everything below it, returning
+// the worktree-relative paths of the files found
+func watchTree(watcher *fsnotify.Watcher, root, dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if isMetadataPath(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() {
+			files = append(files, rel)
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("cannot watch %s: %w", path, err)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// appendFsmonitorLog appends paths to the change log, starting a new log
+// once it grows past fsmonitorMaxLog
+func appendFsmonitorLog(logPath string, paths []string) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if info, err := os.Stat(logPath); err == nil && info.Size() > fsmonitorMaxLog {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		paths = []string{fsmonitorRescan}
+	}
+
+	file, err := os.OpenFile(logPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(strings.Join(paths, "\n") + "\n")
+	return err
+}
+
+// fsmonitorStatus computes the status from the last baseline, re-examining
+// only the paths the daemon logged since then and the paths whose index
+// entries changed
+func fsmonitorStatus(repo *git.Repository, w *git.Worktree) (git.Status, error) {
+	dir := fsmonitorDir()
+	root := w.Filesystem.Root()
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := indexChecksum()
+	if err != nil {
+		return nil, err
+	}
+
+	var baseline *fsmonitorBaseline
+	if data, err := os.ReadFile(filepath.Join(dir, "baseline.json")); err == nil {
+		baseline = &fsmonitorBaseline{}
+		if json.Unmarshal(data, baseline) != nil {
+			baseline = nil
+		}
+	}
+
+	offset := int64(0)
+	if baseline != nil {
+		offset = baseline.Offset
+	}
+	changed, end, rescan, err := readFsmonitorLog(filepath.Join(dir, "changes"), offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseline == nil || rescan {
+		status, err := scanStatus(repo, w)
+		if err != nil {
+			return nil, err
+		}
+		baseline = &fsmonitorBaseline{}
+		for path, fileStatus := range status {
+			switch fileStatus.Worktree {
+			case git.Modified:
+				baseline.Modified = append(baseline.Modified, path)
+			case git.Deleted:
+				baseline.Deleted = append(baseline.Deleted, path)
+			case git.Untracked:
+				baseline.Untracked = append(baseline.Untracked, path)
+			}
+		}
+		baseline.Offset = end
+		baseline.IndexChecksum = checksum
+		return status, saveFsmonitorBaseline(baseline)
+	}
+
+	entries := map[string]*index.Entry{}
+	for _, entry := range idx.Entries {
+		entries[entry.Name] = entry
+	}
+
+	// Entries staged, unstaged or reset since the baseline need a fresh look
+	if checksum != baseline.IndexChecksum {
+		old, err := readIndexSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		oldEntries := map[string]*index.Entry{}
+		for _, entry := range old.Entries {
+			oldEntries[entry.Name] = entry
+		}
+		for name, entry := range entries {
+			if prev, ok := oldEntries[name]; !ok || prev.Hash != entry.Hash || prev.Mode != entry.Mode {
+				changed[name] = true
+			}
+		}
+		for name := range oldEntries {
+			if _, ok := entries[name]; !ok {
+				changed[name] = true
+			}
+		}
+	}
+
+	// A logged directory stands for everything that is or was below it
+	for path := range changed {
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(path)))
+		if err == nil && info.IsDir() {
+			filepath.WalkDir(filepath.Join(root, filepath.FromSlash(path)), func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				rel, _ := filepath.Rel(root, p)
+				rel = filepath.ToSlash(rel)
+				if isMetadataPath(rel) {
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !d.IsDir() {
+					changed[rel] = true
+				}
+				return nil
+			})
+		}
+		for name := range entries {
+			if strings.HasPrefix(name, path+"/") {
+				changed[name] = true
+			}
+		}
+	}
+
+	worktree := map[string]git.StatusCode{}
+	for _, path := range baseline.Modified {
+		worktree[path] = git.Modified
+	}
+	for _, path := range baseline.Deleted {
+		worktree[path] = git.Deleted
+	}
+	for _, path := range baseline.Untracked {
+		worktree[path] = git.Untracked
+	}
+
+	ignores := newIgnoreMatcher(root)
+	for path := range changed {
+		code, err := worktreePathStatus(root, path, entries[path], ignores)
+		if err != nil {
+			return nil, err
+		}
+		delete(worktree, path)
+		if code != git.Unmodified {
+			worktree[path] = code
+		}
+	}
+
+	staged, err := stagedStatus(repo, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := git.Status{}
+	for path, code := range staged {
+		status[path] = &git.FileStatus{Staging: code, Worktree: git.Unmodified}
+	}
+	baseline = &fsmonitorBaseline{Offset: end, IndexChecksum: checksum}
+	for path, code := range worktree {
+		fileStatus, ok := status[path]
+		if !ok {
+			fileStatus = &git.FileStatus{Staging: git.Unmodified}
+			status[path] = fileStatus
+		}
+		fileStatus.Worktree = code
+		switch code {
+		case git.Modified:
+			baseline.Modified = append(baseline.Modified, path)
+		case git.Deleted:
+			baseline.Deleted = append(baseline.Deleted, path)
+		case git.Untracked:
+			fileStatus.Staging = git.Untracked
+			baseline.Untracked = append(baseline.Untracked, path)
+		}
+	}
+
+	return status, saveFsmonitorBaseline(baseline)
+}
+
+// addWithFsmonitor stages the given paths, expanding directories to the
+// changed files the fsmonitor status reports below them
+func addWithFsmonitor(repo *git.Repository, w *git.Worktree, paths []string) error {
+	root := w.Filesystem.Root()
+	var status git.Status
+
+	toStage := []string{}
+	for _, path := range paths {
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(path)))
+		if err != nil || !info.IsDir() {
+			toStage = append(toStage, path)
+			continue
+		}
+
+		if status == nil {
+			if status, err = repoStatus(repo, w); err != nil {
+				return err
+			}
+		}
+		for name, fileStatus := range status {
+			if fileStatus.Worktree == git.Unmodified {
+				continue
+			}
+			if path == "." || strings.HasPrefix(name, path+"/") {
+				toStage = append(toStage, name)
+			}
+		}
+	}
+
+	return stagePaths(repo, root, toStage)
+}
+
+// readFsmonitorLog reads the paths logged after offset. It returns the new
+// offset and whether a full rescan is needed because the log was restarted
+// or the daemon asked for one.
+func readFsmonitorLog(logPath string, offset int64) (map[string]bool, int64, bool, error) {
+	changed := map[string]bool{}
+
+	file, err := os.Open(logPath)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	end := info.Size()
+	if end < offset {
+		return changed, end, true, nil
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, false, err
+	}
+
+	rescan := false
+	scanner := bufio.NewScanner(io.LimitReader(file, end-offset))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch line {
+		case "":
+		case fsmonitorRescan:
+			rescan = true
+		default:
+			changed[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	return changed, end, rescan, nil
+}
+
+// indexChecksum returns the trailing checksum of the index file
+func indexChecksum() (string, error) {
+	file, err := os.Open(filepath.Join(repoGitDir(), "index"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() < 20 {
+		return "", nil
+	}
+
+	sum := make([]byte, 20)
+	if _, err := file.ReadAt(sum, info.Size()-20); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// readIndexSnapshot decodes the copy of the index taken with the baseline
+func readIndexSnapshot() (*index.Index, error) {
+	idx := &index.Index{}
+	file, err := os.Open(filepath.Join(fsmonitorDir(), "index"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := index.NewDecoder(file).Decode(idx); err != nil {
+		return nil, fmt.Errorf("error reading index snapshot: %w", err)
+	}
+	return idx, nil
+}
+
+// saveFsmonitorBaseline stores a baseline together with a copy of the index
+// it was computed against
+func saveFsmonitorBaseline(baseline *fsmonitorBaseline) error {
+	dir := fsmonitorDir()
+	sort.Strings(baseline.Modified)
+	sort.Strings(baseline.Deleted)
+	sort.Strings(baseline.Untracked)
+
+	indexData, err := os.ReadFile(filepath.Join(repoGitDir(), "index"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index"), indexData, 0644); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "baseline.json"), data, 0644)
+}
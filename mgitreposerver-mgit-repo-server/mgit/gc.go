@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mgit gc tidies the MGit store the way git gc tidies git's:
+//
+//	mgit gc [--prune=<date> | --no-prune] [--dry-run]
+//
+// It expires old reflog entries, packs the reachable MGit objects into a
+// single pack, so .mgit/objects doesn't keep a file for every commit ever
+// made, and prunes the unreachable ones older than gc.pruneExpire (2 weeks
+// by default). Like git, it keeps an unreachable object until then: one
+// just reset away from can still be recovered through its MGit hash.
+// Unreachable objects of an old pack are written out loose again, with the
+// pack's time, to wait out the rest of their grace period. Last, the
+// mapping file is compacted, dropping the mappings of pruned objects, and
+// the short-hash index in .mgit/cache/hashes is rebuilt, so it forgets
+// the commits pruned here or by git gc and the lines commits appended.
+//
+// What is reachable: the MGit refs, the HEAD and reflogs of every
+// worktree, and the MGit commits of the Git refs, with the commits tags
+// point at and the ancestors of them all.
+
+// gcStats is what a gc did, or would do with --dry-run
+type gcStats struct {
+	Packed  int
+	Loosed  int
+	Pruned  map[string]bool
+	Expired int // reflog entries
+}
+
+// HandleGC handles the gc command
+func HandleGC(args []string) {
+	now := time.Now()
+	expire, err := parseExpiry(GetConfigValue("gc.pruneExpire", "2.weeks.ago"), now)
+	if err != nil {
+		fmt.Printf("Error: gc.pruneExpire: %s\n", err)
+		os.Exit(1)
+	}
+	dryRun := false
+	for _, arg := range args {
+		switch {
+		case arg == "--dry-run" || arg == "-n":
+			dryRun = true
+		case arg == "--no-prune":
+			expire = time.Time{}
+		case arg == "--prune":
+			// The configured grace period
+		case strings.HasPrefix(arg, "--prune="):
+			if expire, err = parseExpiry(strings.TrimPrefix(arg, "--prune="), now); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+		default:
+			printGCUsage()
+			os.Exit(1)
+		}
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	unlock, err := lockMaintenance(storage)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	stats, err := collectGarbage(repo, storage, expire, dryRun)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		unlock()
+		os.Exit(1)
+	}
+	printGCStats(stats, dryRun)
+}
+
+func printGCUsage() {
+	fmt.Println("Usage: mgit gc [--prune=<date> | --no-prune] [--dry-run]")
+}
+
+func printGCStats(stats *gcStats, dryRun bool) {
+	report := func(n int, done, would string) {
+		if n == 0 {
+			return
+		}
+		if dryRun {
+			done = would
+		}
+		fmt.Printf(done+"\n", n)
+	}
+	report(stats.Expired, "Expired %d reflog entries", "Would expire %d reflog entries")
+	report(stats.Packed, "Packed %d objects", "Would pack %d objects")
+	report(stats.Loosed, "Unpacked %d unreachable objects until they expire", "Would unpack %d unreachable objects until they expire")
+	report(len(stats.Pruned), "Pruned %d unreachable objects", "Would prune %d unreachable objects")
+	if stats.Expired == 0 && stats.Packed == 0 && stats.Loosed == 0 && len(stats.Pruned) == 0 {
+		fmt.Println("Nothing to do")
+	}
+}
+
+// collectGarbage runs gc on a repository's MGit store. A zero expire
+// prunes nothing.
+func collectGarbage(repo *git.Repository, storage *MGitStorage, expire time.Time, dryRun bool) (*gcStats, error) {
+	stats := &gcStats{Pruned: map[string]bool{}}
+	expired, err := expireAllReflogs(storage, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	stats.Expired = expired
+	if !dryRun {
+		if err := removeStaleTempFiles(storage); err != nil {
+			return nil, err
+		}
+	}
+
+	reachable, err := reachableMGitObjects(repo, storage)
+	if err != nil {
+		return nil, err
+	}
+	loose, err := listLooseObjects(storage.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	packs, err := loadObjectPacks(storage.RootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// What goes in the new pack, and what becomes loose or goes away
+	packed := map[string][]byte{}
+	unpacked := map[string]*objectPackIndex{}
+	isLoose := map[string]bool{}
+	reachableLoose := 0
+	for _, hash := range loose {
+		isLoose[hash] = true
+		if reachable[hash] {
+			reachableLoose++
+			data, err := os.ReadFile(mgitObjectPath(storage.RootDir, hash))
+			if err != nil {
+				return nil, err
+			}
+			packed[hash] = data
+			continue
+		}
+		info, err := os.Stat(mgitObjectPath(storage.RootDir, hash))
+		if err != nil {
+			return nil, err
+		}
+		if !expire.IsZero() && info.ModTime().Before(expire) {
+			stats.Pruned[hash] = true
+		}
+	}
+	for _, pack := range packs {
+		info, err := os.Stat(pack.Path)
+		if err != nil {
+			return nil, err
+		}
+		for hash := range pack.Offsets {
+			switch {
+			case isLoose[hash] || packed[hash] != nil || unpacked[hash] != nil:
+			case reachable[hash]:
+				if packed[hash], err = pack.readPackedObject(hash); err != nil {
+					return nil, err
+				}
+			case !expire.IsZero() && info.ModTime().Before(expire):
+				stats.Pruned[hash] = true
+			default:
+				unpacked[hash] = pack
+			}
+		}
+	}
+	stats.Loosed = len(unpacked)
+
+	// A single pack of everything reachable is as packed as it gets
+	if len(packs) <= 1 && reachableLoose == 0 && len(unpacked) == 0 && len(stats.Pruned) == 0 {
+		if dryRun {
+			return stats, nil
+		}
+		return stats, refreshHashIndex(repo, storage)
+	}
+	stats.Packed = len(packed)
+	if dryRun {
+		return stats, nil
+	}
+
+	// Unreachable objects leave their pack before it goes
+	for hash, pack := range unpacked {
+		data, err := pack.readPackedObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeLooseObject(storage.RootDir, hash, data, pack.Path); err != nil {
+			return nil, err
+		}
+	}
+	newPack := ""
+	if len(packed) > 0 {
+		if newPack, err = writeLocalObjectPack(storage.RootDir, packed); err != nil {
+			return nil, fmt.Errorf("error writing pack: %w", err)
+		}
+	}
+	for _, pack := range packs {
+		if pack.Path == newPack {
+			continue
+		}
+		if err := os.Remove(strings.TrimSuffix(pack.Path, ".pack") + ".idx"); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(pack.Path); err != nil {
+			return nil, err
+		}
+	}
+	forgetObjectPacks(storage.RootDir)
+	for _, hash := range loose {
+		if packed[hash] != nil || stats.Pruned[hash] {
+			if err := os.Remove(mgitObjectPath(storage.RootDir, hash)); err != nil {
+				return nil, err
+			}
+			os.Remove(filepath.Dir(mgitObjectPath(storage.RootDir, hash))) // Only if empty
+		}
+	}
+
+	if _, _, err := storage.Mappings().CompactWithout(stats.Pruned); err != nil {
+		return nil, fmt.Errorf("error compacting mappings: %w", err)
+	}
+	// Short hashes of pruned commits mustn't resolve any more
+	return stats, refreshHashIndex(repo, storage)
+}
+
+// refreshHashIndex rebuilds the short-hash index from the commits and
+// mappings that are left
+func refreshHashIndex(repo *git.Repository, storage *MGitStorage) error {
+	if _, err := rebuildHashIndex(repo, storage); err != nil {
+		return fmt.Errorf("error rebuilding the hash index: %w", err)
+	}
+	return nil
+}
+
+// writeLooseObject writes an object out loose, dated like the file it came
+// from so its grace period doesn't start over
+func writeLooseObject(rootDir, hash string, data []byte, from string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	path := mgitObjectPath(rootDir, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// removeStaleTempFiles removes the temporary files interrupted writes left
+// in .mgit an hour or more ago, and packs an interrupted gc wrote no index
+// for
+func removeStaleTempFiles(storage *MGitStorage) error {
+	return filepath.Walk(storage.RootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || time.Since(info.ModTime()) < time.Hour {
+			return nil
+		}
+		name := info.Name()
+		stale := strings.HasSuffix(name, ".tmp") || strings.HasPrefix(name, "tmp-pack-")
+		if strings.HasSuffix(name, ".pack") && filepath.Dir(path) == mgitPackDir(storage.RootDir) {
+			_, err := os.Stat(strings.TrimSuffix(path, ".pack") + ".idx")
+			stale = os.IsNotExist(err)
+		}
+		if stale {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// reachableMGitObjects returns the MGit objects gc keeps: those reachable
+// from the MGit refs, the HEAD and reflogs of each worktree, and the Git
+// refs
+func reachableMGitObjects(repo *git.Repository, storage *MGitStorage) (map[string]bool, error) {
+	roots := []string{}
+	add := func(hash string) {
+		if hash = strings.TrimSpace(hash); isMGitHash(hash) && hash != strings.Repeat("0", 40) {
+			roots = append(roots, hash)
+		}
+	}
+
+	// The MGit refs, whatever namespace they're in
+	refsDir := filepath.Join(storage.RootDir, "refs")
+	err := filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		add(string(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// HEAD and the reflogs, of the main worktree and the linked ones
+	storages := []*MGitStorage{{RootDir: storage.RootDir}}
+	if worktrees, err := listWorktrees(); err == nil {
+		for _, wt := range worktrees {
+			headDir := filepath.Join(wt.Path, ".mgit")
+			if readCommonDir(headDir) != headDir {
+				storages = append(storages, &MGitStorage{RootDir: storage.RootDir, HeadDir: headDir})
+			}
+		}
+	}
+	for _, wtStorage := range storages {
+		if data, err := os.ReadFile(wtStorage.HeadPath()); err == nil {
+			add(string(data))
+		}
+		refs, err := reflogRefs(wtStorage)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			entries, err := readReflog(wtStorage, ref)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				add(entry.Old)
+				add(entry.New)
+			}
+		}
+	}
+
+	// The Git refs, by the MGit commits of the newest mapped commits they
+	// reach
+	gitRoots, err := mappedGitRefCommits(repo, storage)
+	if err != nil {
+		return nil, err
+	}
+	roots = append(roots, gitRoots...)
+
+	// Tags name other objects, commits or tags
+	for i := 0; i < len(roots); i++ {
+		if tag, err := storage.GetTag(roots[i]); err == nil {
+			add(tag.Object)
+		}
+	}
+	return mgitAncestors(storage, roots...), nil
+}
+
+// mappedGitRefCommits returns the MGit hashes of what the Git refs point
+// at. A commit without a mapping, such as one made with plain git, stands
+// for the nearest mapped commits it descends from.
+func mappedGitRefCommits(repo *git.Repository, storage *MGitStorage) ([]string, error) {
+	mgitByGit := map[plumbing.Hash]string{}
+	err := storage.ForEachMapping(func(mapping NostrCommitMapping) error {
+		mgitByGit[plumbing.NewHash(mapping.GitHash)] = mapping.MGitHash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queue := []plumbing.Hash{}
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			queue = append(queue, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if head, err := repo.Head(); err == nil {
+		queue = append(queue, head.Hash())
+	}
+
+	roots := []string{}
+	seen := map[plumbing.Hash]bool{}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if mgitHash, ok := mgitByGit[hash]; ok {
+			roots = append(roots, mgitHash)
+			continue
+		}
+		// Annotated tags and unmapped commits lead on to what they name
+		if tag, err := repo.TagObject(hash); err == nil {
+			queue = append(queue, tag.Target)
+			continue
+		}
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			continue // Not a commit, or beyond a shallow boundary
+		}
+		queue = append(queue, commit.ParentHashes...)
+	}
+	return roots, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// HandleGit handles `mgit git -- <args>`, which runs a git command mgit
+// doesn't implement and then brings .mgit back in line with what it did
+func HandleGit(args []string) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Println("Usage: mgit git -- <git command> [args]")
+		os.Exit(1)
+	}
+	os.Exit(runGitPassthrough(args))
+}
+
+// gitFallback returns a handler that passes an unknown command to git when
+// core.gitFallback is set
+func gitFallback(name string) (func([]string), bool) {
+	if !GetConfigBool("core.gitFallback", false) {
+		return nil, false
+	}
+	return func(args []string) {
+		os.Exit(runGitPassthrough(append([]string{name}, args...)))
+	}, true
+}
+
+// runGitPassthrough runs git in the current directory with the terminal
+// attached, reconciles the MGit layer and returns git's exit code
+func runGitPassthrough(args []string) int {
+	repo := getRepo()
+	before := gitBranchHashes(repo)
+	started := time.Now()
+
+	cmd := newGitCommand(args...)
+	cmd.Dir = ""
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	code := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			fmt.Printf("Error running git: %s\n", err)
+			return 1
+		}
+		code = exitErr.ExitCode()
+	}
+
+	// Even a failed command (say, a rebase stopped on a conflict) may have
+	// moved refs, so reconcile either way
+	repo, err := openRepo()
+	if err != nil {
+		fmt.Printf("Warning: could not reopen the repository to reconcile MGit: %s\n", err)
+		return code
+	}
+	if err := reconcileMGit(repo, before, started); err != nil {
+		fmt.Printf("Warning: could not reconcile MGit: %s\n", err)
+	}
+	return code
+}
+
+// gitBranchHashes returns the commits that local and remote-tracking
+// branches and HEAD point to
+func gitBranchHashes(repo *git.Repository) []plumbing.Hash {
+	hashes := []plumbing.Hash{}
+	if head, err := repo.Head(); err == nil {
+		hashes = append(hashes, head.Hash())
+	}
+	refs, err := repo.References()
+	if err != nil {
+		return hashes
+	}
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && (ref.Name().IsBranch() || ref.Name().IsRemote()) {
+			hashes = append(hashes, ref.Hash())
+		}
+		return nil
+	})
+	return hashes
+}
+
+// reconcileMGit brings .mgit in line with the Git repository after git has
+// run on it directly:
+//
+//   - commits the command created get MGit objects, attributed to
+//     user.pubkey as `mgit commit` would (but unsigned)
+//   - other new commits without an MGit object are reported
+//   - MGit branch refs follow the Git branches, and are removed with them
+//   - the MGit HEAD follows the Git HEAD
+//
+// A commit counts as created by the command when it wasn't reachable from
+// any branch before and its committer date isn't earlier than the command.
+func reconcileMGit(repo *git.Repository, before []plumbing.Hash, started time.Time) error {
+	storage := NewMGitStorage()
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		return nil
+	}
+
+	known := []plumbing.Hash{}
+	for _, hash := range before {
+		if _, err := repo.CommitObject(hash); err == nil {
+			known = append(known, hash)
+		}
+	}
+	old, err := gitAncestors(repo, known...)
+	if err != nil {
+		return err
+	}
+
+	newCommits, err := newGitCommits(repo, gitBranchHashes(repo), old)
+	if err != nil {
+		return err
+	}
+
+	pubkey := GetNostrPubKey()
+	created := 0
+	missing := []string{}
+	for _, commit := range newCommits {
+		if _, err := storage.GetMGitHashFromGit(commit.Hash.String()); err == nil {
+			continue
+		}
+		if pubkey == "" || commit.Committer.When.Before(started.Truncate(time.Second)) {
+			missing = append(missing, shortHash(commit.Hash.String()))
+			continue
+		}
+		if err := storeReconciledCommit(storage, commit, pubkey); err != nil {
+			return err
+		}
+		created++
+	}
+	if created > 0 {
+		fmt.Printf("MGit: created %d MGit commit object(s) for new commits\n", created)
+	}
+	if len(missing) > 0 {
+		fmt.Printf("MGit: %d new commit(s) have no MGit object: %s\n", len(missing), strings.Join(missing, " "))
+	}
+
+	return reconcileMGitRefs(repo, storage)
+}
+
+// newGitCommits returns the commits reachable from heads but not in old,
+// parents before their children
+func newGitCommits(repo *git.Repository, heads []plumbing.Hash, old map[plumbing.Hash]bool) ([]*object.Commit, error) {
+	ordered := []*object.Commit{}
+	visited := map[plumbing.Hash]bool{}
+	var visit func(hash plumbing.Hash) error
+	visit = func(hash plumbing.Hash) error {
+		if old[hash] || visited[hash] {
+			return nil
+		}
+		visited[hash] = true
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return err
+		}
+		for _, parent := range commit.ParentHashes {
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		ordered = append(ordered, commit)
+		return nil
+	}
+	for _, head := range heads {
+		if err := visit(head); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// storeReconciledCommit writes the MGit object and mapping for a Git
+// commit, the way MGitCommit does for the commits it creates
+func storeReconciledCommit(storage *MGitStorage, commit *object.Commit, pubkey string) error {
+	parents := []string{}
+	for _, parent := range commit.ParentHashes {
+		if mgitHash, err := storage.GetMGitHashFromGit(parent.String()); err == nil {
+			parents = append(parents, mgitHash)
+		} else {
+			parents = append(parents, parent.String())
+		}
+	}
+	mgitHash := computeMGitHash(commit, parents, pubkey)
+	mgitCommit := &MCommitStruct{
+		Type:         MGitCommitObject,
+		MGitHash:     mgitHash.String(),
+		GitHash:      commit.Hash.String(),
+		TreeHash:     commit.TreeHash.String(),
+		ParentHashes: parents,
+		Author:       convertToMGitSignature(commit.Author, pubkey),
+		Committer:    convertToMGitSignature(commit.Committer, pubkey),
+		Message:      commit.Message,
+		Metadata:     map[string]string{"version": "1.0"},
+	}
+	if err := storage.StoreCommit(mgitCommit); err != nil {
+		return fmt.Errorf("error storing MGit commit: %w", err)
+	}
+	if err := storage.StoreMapping(commit.Hash.String(), mgitHash.String(), pubkey); err != nil {
+		return fmt.Errorf("error storing hash mapping: %w", err)
+	}
+	return nil
+}
+
+// reconcileMGitRefs points the MGit branch refs and HEAD at the MGit
+// commits of their Git counterparts
+func reconcileMGitRefs(repo *git.Repository, storage *MGitStorage) error {
+	branches := map[string]bool{}
+	refs, err := repo.Branches()
+	if err != nil {
+		return err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		branches[name] = true
+		mgitHash, err := storage.GetMGitHashFromGit(ref.Hash().String())
+		if err != nil {
+			return nil
+		}
+		if current, err := storage.GetRef(name); err == nil && current == mgitHash {
+			return nil
+		}
+		if err := storage.UpdateRef(name, mgitHash); err != nil {
+			return err
+		}
+		fmt.Printf("MGit: %s -> %s\n", ref.Name().Short(), shortHash(mgitHash))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Drop the refs of branches git deleted
+	headsDir := filepath.Join(storage.RootDir, "refs", "heads")
+	filepath.Walk(headsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(storage.RootDir, path)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if !branches[name] {
+			if os.Remove(path) == nil {
+				os.Remove(reflogPath(storage, name))
+				fmt.Printf("MGit: deleted %s\n", strings.TrimPrefix(name, "refs/heads/"))
+			}
+		}
+		return nil
+	})
+	return followGitHead(repo, storage)
+}
+
+// followGitHead points the MGit HEAD where the Git HEAD is: at the same
+// branch, or detached at the MGit commit of the Git one
+func followGitHead(repo *git.Repository, storage *MGitStorage) error {
+	head, err := repo.Head()
+	if err != nil {
+		return nil
+	}
+	if head.Name().IsBranch() {
+		return storage.UpdateHead(head.Name().String())
+	}
+	mgitHash, err := storage.GetMGitHashFromGit(head.Hash().String())
+	if err != nil {
+		return nil
+	}
+	return storage.DetachHead(mgitHash)
+}
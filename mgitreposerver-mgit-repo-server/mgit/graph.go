@@ -0,0 +1,143 @@
+package main
+
+import "sort"
+
+// mgitAncestors returns the MGit hashes of the given commits and all of
+// their ancestors. Parents whose objects are missing are included but not
+// walked further.
+func mgitAncestors(storage *MGitStorage, starts ...string) map[string]bool {
+	seen := map[string]bool{}
+	queue := append([]string{}, starts...)
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+
+		commit, err := storage.GetCommit(current)
+		if err != nil {
+			continue
+		}
+		for _, parent := range commit.ParentHashes {
+			if !seen[parent] {
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return seen
+}
+
+// logFilter narrows a log walk by the number of parents of the commits it
+// shows, and with FirstParent follows only the first parent of merges
+type logFilter struct {
+	MinParents  int
+	MaxParents  int // negative for no limit
+	FirstParent bool
+}
+
+// noLogFilter shows every commit and follows every parent
+var noLogFilter = logFilter{MaxParents: -1}
+
+// shows reports whether a commit passes the parent count limits
+func (f logFilter) shows(commit *MCommitStruct) bool {
+	n := len(commit.ParentHashes)
+	return n >= f.MinParents && (f.MaxParents < 0 || n <= f.MaxParents)
+}
+
+// follows returns the parents of a commit the walk goes on to
+func (f logFilter) follows(commit *MCommitStruct) []string {
+	if f.FirstParent && len(commit.ParentHashes) > 1 {
+		return commit.ParentHashes[:1]
+	}
+	return commit.ParentHashes
+}
+
+// mgitRange returns the commits reachable from include but not from
+// exclude, newest first in breadth-first order, like git's "exclude..include"
+func mgitRange(storage *MGitStorage, include, exclude []string) []*MCommitStruct {
+	return mgitRangeFiltered(storage, include, exclude, noLogFilter)
+}
+
+// mgitRangeFiltered is mgitRange with a log filter. The filter only decides
+// what is walked and listed; everything reachable from exclude is still
+// excluded.
+func mgitRangeFiltered(storage *MGitStorage, include, exclude []string, filter logFilter) []*MCommitStruct {
+	excluded := mgitAncestors(storage, exclude...)
+
+	commits := []*MCommitStruct{}
+	visited := map[string]bool{}
+	queue := append([]string{}, include...)
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] || excluded[current] {
+			continue
+		}
+		visited[current] = true
+
+		commit, err := storage.GetCommit(current)
+		if err != nil {
+			continue
+		}
+		if filter.shows(commit) {
+			commits = append(commits, commit)
+		}
+		for _, parent := range filter.follows(commit) {
+			if !visited[parent] && !excluded[parent] {
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return commits
+}
+
+// mgitMergeBases returns the best common ancestors of one and the others,
+// as git merge-base does: common ancestors that aren't ancestors of another
+// common ancestor. They are ordered newest first.
+func mgitMergeBases(storage *MGitStorage, one string, others ...string) []*MCommitStruct {
+	oneAncestors := mgitAncestors(storage, one)
+	otherAncestors := mgitAncestors(storage, others...)
+
+	common := map[string]bool{}
+	for hash := range oneAncestors {
+		if otherAncestors[hash] {
+			common[hash] = true
+		}
+	}
+
+	// Anything reachable from a parent of a common ancestor isn't best
+	parents := []string{}
+	for hash := range common {
+		if commit, err := storage.GetCommit(hash); err == nil {
+			parents = append(parents, commit.ParentHashes...)
+		}
+	}
+	dominated := mgitAncestors(storage, parents...)
+
+	bases := []*MCommitStruct{}
+	for hash := range common {
+		if dominated[hash] {
+			continue
+		}
+		if commit, err := storage.GetCommit(hash); err == nil {
+			bases = append(bases, commit)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool {
+		if !bases[i].Committer.When.Equal(bases[j].Committer.When) {
+			return bases[i].Committer.When.After(bases[j].Committer.When)
+		}
+		return bases[i].MGitHash < bases[j].MGitHash
+	})
+	return bases
+}
+
+// isMGitAncestor reports whether ancestor is reachable from descendant; a
+// commit counts as its own ancestor
+func isMGitAncestor(storage *MGitStorage, ancestor, descendant string) bool {
+	return mgitAncestors(storage, descendant)[ancestor]
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// grepOptions are how grep matches and what it prints
+type grepOptions struct {
+	Pattern     *regexp.Regexp
+	LineNumbers bool
+	FilesOnly   bool
+	Count       bool
+}
+
+// grepLine is a matching line
+type grepLine struct {
+	Number int
+	Text   string
+}
+
+// grepResult is what a file's content yields: its matching lines, or
+// for binary content only whether it matches
+type grepResult struct {
+	Binary bool
+	Lines  []grepLine
+}
+
+func (r *grepResult) matched() bool {
+	return r.Binary || len(r.Lines) > 0
+}
+
+// grepContent searches content line by line
+func grepContent(content []byte, opts *grepOptions) *grepResult {
+	if isBinaryContent(content) {
+		return &grepResult{Binary: opts.Pattern.Match(content)}
+	}
+	result := &grepResult{}
+	for i, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if opts.Pattern.MatchString(line) {
+			result.Lines = append(result.Lines, grepLine{i + 1, line})
+		}
+	}
+	return result
+}
+
+// printGrepResult prints a file's matches, the name prefixed with the MGit
+// hash of the commit searched, if any. It reports whether there were any.
+func printGrepResult(prefix, path string, result *grepResult, opts *grepOptions) bool {
+	if !result.matched() {
+		return false
+	}
+	name := prefix + path
+	switch {
+	case opts.FilesOnly:
+		fmt.Println(name)
+	case opts.Count:
+		if result.Binary {
+			fmt.Printf("%s:1\n", name)
+		} else {
+			fmt.Printf("%s:%d\n", name, len(result.Lines))
+		}
+	case result.Binary:
+		fmt.Printf("Binary file %s matches\n", name)
+	default:
+		for _, line := range result.Lines {
+			if opts.LineNumbers {
+				fmt.Printf("%s:%d:%s\n", name, line.Number, line.Text)
+			} else {
+				fmt.Printf("%s:%s\n", name, line.Text)
+			}
+		}
+	}
+	return true
+}
+
+// HandleGrep handles the grep command, which searches the tracked files in
+// the working tree, the index (--cached), or the trees of revisions. A
+// revision can be a range, a..b or a...b, which searches every commit in
+// it, and --all searches every commit on a branch, remote-tracking branch
+// or tag, e.g. to find when a sensitive string entered the history.
+// Matches in revisions are prefixed with the MGit hash of their commit.
+func HandleGrep(args []string) {
+	patterns := []string{}
+	ignoreCase, fixed, word := false, false, false
+	cached, all := false, false
+	opts := &grepOptions{}
+	revisions := []string{}
+	pathArgs := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			pathArgs = append(pathArgs, args[i+1:]...)
+			i = len(args)
+		case arg == "-e":
+			if i+1 >= len(args) {
+				fmt.Println("Error: -e needs a pattern")
+				os.Exit(1)
+			}
+			i++
+			patterns = append(patterns, args[i])
+		case arg == "-i" || arg == "--ignore-case":
+			ignoreCase = true
+		case arg == "-F" || arg == "--fixed-strings":
+			fixed = true
+		case arg == "-w" || arg == "--word-regexp":
+			word = true
+		case arg == "-n" || arg == "--line-number":
+			opts.LineNumbers = true
+		case arg == "-l" || arg == "--files-with-matches":
+			opts.FilesOnly = true
+		case arg == "-c" || arg == "--count":
+			opts.Count = true
+		case arg == "--cached":
+			cached = true
+		case arg == "--all":
+			all = true
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printGrepUsage()
+			os.Exit(1)
+		case len(patterns) == 0:
+			patterns = append(patterns, arg)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	if len(patterns) == 0 {
+		printGrepUsage()
+		os.Exit(1)
+	}
+	if cached && (all || len(revisions) > 0) {
+		fmt.Println("Error: --cached cannot be used with revisions")
+		os.Exit(1)
+	}
+
+	pattern, err := grepPattern(patterns, ignoreCase, fixed, word)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	opts.Pattern = pattern
+
+	pathspecs := []string{}
+	for _, arg := range pathArgs {
+		path, err := repoRelativePath(arg)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if path == "." {
+			pathspecs = nil
+			break
+		}
+		pathspecs = append(pathspecs, path)
+	}
+
+	repo := getRepo()
+	var found bool
+	if all || len(revisions) > 0 {
+		found, err = grepRevisions(repo, NewMGitStorage(), revisions, all, pathspecs, opts)
+	} else {
+		found, err = grepIndex(repo, cached, pathspecs, opts)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		os.Exit(1)
+	}
+}
+
+func printGrepUsage() {
+	fmt.Println("Usage: mgit grep [-i] [-F] [-w] [-n] [-l | -c] [--cached] (-e <pattern> | <pattern>)... [<revision>... | --all] [-- <paths>...]")
+}
+
+// grepPattern combines the -e patterns into one regular expression
+func grepPattern(patterns []string, ignoreCase, fixed, word bool) (*regexp.Regexp, error) {
+	parts := []string{}
+	for _, p := range patterns {
+		if fixed {
+			p = regexp.QuoteMeta(p)
+		} else if _, err := regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		parts = append(parts, "(?:"+p+")")
+	}
+	expr := strings.Join(parts, "|")
+	if word {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return pattern, nil
+}
+
+// grepIndex searches the tracked files, as the index has them with
+// cached or else as they are in the working tree
+func grepIndex(repo *git.Repository, cached bool, pathspecs []string, opts *grepOptions) (bool, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, fmt.Errorf("error reading index: %w", err)
+	}
+	root := repoRoot()
+	found := false
+	for _, entry := range idx.Entries {
+		if !pathMatches(entry.Name, pathspecs, false) {
+			continue
+		}
+		var content []byte
+		if cached {
+			if content, err = blobContent(repo, entry.Hash); err != nil {
+				return found, fmt.Errorf("error reading %s: %w", entry.Name, err)
+			}
+		} else {
+			info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(entry.Name)))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if content, err = os.ReadFile(filepath.Join(root, filepath.FromSlash(entry.Name))); err != nil {
+				return found, fmt.Errorf("error reading %s: %w", entry.Name, err)
+			}
+		}
+		if printGrepResult("", entry.Name, grepContent(content, opts), opts) {
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// grepRevisions searches the trees of the commits the revisions name.
+// Each blob is searched once however many commits have it.
+func grepRevisions(repo *git.Repository, storage *MGitStorage, revisions []string, all bool, pathspecs []string, opts *grepOptions) (bool, error) {
+	commits, err := grepCommits(repo, storage, revisions, all)
+	if err != nil {
+		return false, err
+	}
+	hashes, err := loadHashIndex(repo, storage)
+	if err != nil {
+		return false, err
+	}
+
+	results := map[plumbing.Hash]*grepResult{}
+	found := false
+	for _, commit := range commits {
+		key := commit.Hash.String()
+		if mgitHash := hashes.toMGit[key]; mgitHash != "" {
+			key = mgitHash
+		}
+		prefix := shortHash(key) + ":"
+
+		files, err := commit.Files()
+		if err != nil {
+			return found, err
+		}
+		matches := []*object.File{}
+		err = files.ForEach(func(file *object.File) error {
+			if file.Mode.IsFile() && pathMatches(file.Name, pathspecs, false) {
+				matches = append(matches, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return found, err
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i].Name < matches[j].Name })
+
+		for _, file := range matches {
+			result, ok := results[file.Hash]
+			if !ok {
+				content, err := readBlob(&file.Blob)
+				if err != nil {
+					return found, fmt.Errorf("error reading %s at %s: %w", file.Name, shortHash(key), err)
+				}
+				result = grepContent(content, opts)
+				results[file.Hash] = result
+			}
+			if printGrepResult(prefix, file.Name, result, opts) {
+				found = true
+			}
+		}
+	}
+	return found, nil
+}
+
+// grepCommits lists the commits to search, newest first within each
+// revision: a revision's own commit, every commit in a range, or with all
+// every commit reachable from a branch, remote-tracking branch or tag
+func grepCommits(repo *git.Repository, storage *MGitStorage, revisions []string, all bool) ([]*object.Commit, error) {
+	commits := []*object.Commit{}
+	seen := map[plumbing.Hash]bool{}
+	add := func(c *object.Commit) {
+		if !seen[c.Hash] {
+			seen[c.Hash] = true
+			commits = append(commits, c)
+		}
+	}
+
+	for _, rev := range revisions {
+		left, right, symmetric, ok := parseRevisionRange(rev)
+		if !ok {
+			hash, err := resolveCommitRevision(repo, storage, rev)
+			if err != nil {
+				return nil, err
+			}
+			commit, err := repo.CommitObject(hash)
+			if err != nil {
+				return nil, err
+			}
+			add(commit)
+			continue
+		}
+
+		leftHash, err := resolveCommitRevision(repo, storage, left)
+		if err != nil {
+			return nil, err
+		}
+		rightHash, err := resolveCommitRevision(repo, storage, right)
+		if err != nil {
+			return nil, err
+		}
+		leftSide, err := gitAncestors(repo, leftHash)
+		if err != nil {
+			return nil, err
+		}
+		if !symmetric {
+			if err := walkGitCommits(repo, rightHash, leftSide, add); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rightSide, err := gitAncestors(repo, rightHash)
+		if err != nil {
+			return nil, err
+		}
+		if err := walkGitCommits(repo, rightHash, leftSide, add); err != nil {
+			return nil, err
+		}
+		if err := walkGitCommits(repo, leftHash, rightSide, add); err != nil {
+			return nil, err
+		}
+	}
+
+	if all {
+		refs, err := repo.References()
+		if err != nil {
+			return nil, err
+		}
+		starts := []plumbing.Hash{}
+		err = refs.ForEach(func(ref *plumbing.Reference) error {
+			name := ref.Name()
+			if ref.Type() != plumbing.HashReference || !(name.IsBranch() || name.IsRemote() || name.IsTag()) {
+				return nil
+			}
+			hash := ref.Hash()
+			if tag, err := repo.TagObject(hash); err == nil {
+				hash = tag.Target
+			}
+			starts = append(starts, hash)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// History shared between refs is walked once
+		reached := map[plumbing.Hash]bool{}
+		for _, start := range starts {
+			err := walkGitCommits(repo, start, reached, func(c *object.Commit) {
+				reached[c.Hash] = true
+				add(c)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return commits, nil
+}
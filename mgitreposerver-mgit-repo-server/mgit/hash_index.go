@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// errAmbiguousHash is returned for a prefix of more than one commit's hash
+var errAmbiguousHash = errors.New("ambiguous commit hash prefix")
+
+// hashIndexHeader starts the short-hash index file; a file with another
+// header is rebuilt
+const hashIndexHeader = "# mgit hash index v1"
+
+// hashIndex resolves abbreviated Git and MGit commit hashes without
+// walking every commit object. It is kept in .mgit/cache/hashes, one
+// "<git hash> <mgit hash>" line per commit, "-" standing for a side the
+// commit lacks. Commits made by mgit are appended as they are created; the
+// index is rebuilt when a ref points at a commit it doesn't know.
+type hashIndex struct {
+	git    []string          // sorted
+	mgit   []string          // sorted
+	toMGit map[string]string // git hash -> mgit hash, "" if none
+	toGit  map[string]string // mgit hash -> git hash, "" if none
+}
+
+// hashIndexPath returns where an MGit store keeps its short-hash index
+func hashIndexPath(storage *MGitStorage) string {
+	return filepath.Join(storage.RootDir, "cache", "hashes")
+}
+
+// loadHashIndex reads the short-hash index, rebuilding it if it is
+// missing or doesn't know every ref's commit
+func loadHashIndex(repo *git.Repository, storage *MGitStorage) (*hashIndex, error) {
+	if idx := readHashIndex(hashIndexPath(storage)); idx != nil && idx.knowsRefs(repo, storage) {
+		return idx, nil
+	}
+	return rebuildHashIndex(repo, storage)
+}
+
+// readHashIndex reads the index file, returning nil if it is missing or
+// unreadable
+func readHashIndex(path string) *hashIndex {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != hashIndexHeader {
+		return nil
+	}
+	idx := &hashIndex{toMGit: map[string]string{}, toGit: map[string]string{}}
+	for scanner.Scan() {
+		gitHash, mgitHash, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil
+		}
+		idx.add(gitHash, mgitHash)
+	}
+	if scanner.Err() != nil {
+		return nil
+	}
+	sort.Strings(idx.git)
+	sort.Strings(idx.mgit)
+	return idx
+}
+
+// add records a commit; either hash may be "-". A pair overrides what is
+// known of either side alone.
+func (idx *hashIndex) add(gitHash, mgitHash string) {
+	if gitHash == "-" {
+		gitHash = ""
+	}
+	if mgitHash == "-" {
+		mgitHash = ""
+	}
+	if gitHash != "" {
+		if previous, ok := idx.toMGit[gitHash]; !ok {
+			idx.git = append(idx.git, gitHash)
+			idx.toMGit[gitHash] = mgitHash
+		} else if previous == "" {
+			idx.toMGit[gitHash] = mgitHash
+		}
+	}
+	if mgitHash != "" {
+		if previous, ok := idx.toGit[mgitHash]; !ok {
+			idx.mgit = append(idx.mgit, mgitHash)
+			idx.toGit[mgitHash] = gitHash
+		} else if previous == "" {
+			idx.toGit[mgitHash] = gitHash
+		}
+	}
+}
+
+// knowsRefs reports whether every branch, remote-tracking branch and MGit
+// branch points at a commit in the index. One that doesn't means commits
+// were made behind the index's back.
+func (idx *hashIndex) knowsRefs(repo *git.Repository, storage *MGitStorage) bool {
+	known := true
+	if refs, err := repo.References(); err == nil {
+		refs.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() != plumbing.HashReference || !(ref.Name().IsBranch() || ref.Name().IsRemote()) {
+				return nil
+			}
+			if _, ok := idx.toMGit[ref.Hash().String()]; !ok {
+				known = false
+				return storer.ErrStop
+			}
+			return nil
+		})
+	}
+	if !known {
+		return false
+	}
+	for hash := range mgitBranchesByHash(storage) {
+		if _, ok := idx.toGit[hash]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildHashIndex indexes every Git commit and MGit commit object, paired
+// through the hash mappings, and saves the index
+func rebuildHashIndex(repo *git.Repository, storage *MGitStorage) (*hashIndex, error) {
+	span := startSpan("hash_index.rebuild")
+	idx := &hashIndex{toMGit: map[string]string{}, toGit: map[string]string{}}
+
+	err := storage.Mappings().ForEach(func(m NostrCommitMapping) error {
+		idx.add(m.GitHash, m.MGitHash)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		span.End(err)
+		return nil, fmt.Errorf("error reading mappings: %w", err)
+	}
+	if hashes, err := listMGitObjects(storage.RootDir); err == nil {
+		for _, hash := range hashes {
+			idx.add("", hash)
+		}
+	}
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		span.End(err)
+		return nil, fmt.Errorf("error listing commits: %w", err)
+	}
+	err = commits.ForEach(func(c *object.Commit) error {
+		idx.add(c.Hash.String(), "")
+		return nil
+	})
+	commits.Close()
+	if err != nil {
+		span.End(err)
+		return nil, fmt.Errorf("error listing commits: %w", err)
+	}
+	sort.Strings(idx.git)
+	sort.Strings(idx.mgit)
+	span.End(nil)
+
+	// A cache that can't be written only costs the next lookup a rebuild
+	idx.save(hashIndexPath(storage))
+	return idx, nil
+}
+
+// save writes the index, replacing the file atomically
+func (idx *hashIndex) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, hashIndexHeader)
+	for _, gitHash := range idx.git {
+		mgitHash := idx.toMGit[gitHash]
+		if mgitHash == "" {
+			mgitHash = "-"
+		}
+		fmt.Fprintf(writer, "%s %s\n", gitHash, mgitHash)
+	}
+	for _, mgitHash := range idx.mgit {
+		if idx.toGit[mgitHash] == "" {
+			fmt.Fprintf(writer, "- %s\n", mgitHash)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// recordHashIndex appends a new commit to the index, if there is one, so
+// it stays fresh without a rebuild
+func recordHashIndex(storage *MGitStorage, gitHash, mgitHash string) {
+	path := hashIndexPath(storage)
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%s %s\n", gitHash, mgitHash)
+}
+
+// withPrefix returns the hashes in a sorted list that start with prefix
+func withPrefix(sorted []string, prefix string) []string {
+	matches := []string{}
+	for i := sort.SearchStrings(sorted, prefix); i < len(sorted) && strings.HasPrefix(sorted[i], prefix); i++ {
+		matches = append(matches, sorted[i])
+	}
+	return matches
+}
+
+// Resolve finds the commit whose Git or MGit hash starts with prefix,
+// returning both of its hashes (either may be empty). A prefix of both
+// hashes of one commit names it once; anything else matching is
+// ambiguous.
+func (idx *hashIndex) Resolve(prefix string) (gitHash, mgitHash string, err error) {
+	prefix = strings.ToLower(prefix)
+	type pair struct{ git, mgit string }
+	found := map[pair]bool{}
+	for _, hash := range withPrefix(idx.git, prefix) {
+		found[pair{hash, idx.toMGit[hash]}] = true
+	}
+	for _, hash := range withPrefix(idx.mgit, prefix) {
+		found[pair{idx.toGit[hash], hash}] = true
+	}
+	switch len(found) {
+	case 0:
+		return "", "", fmt.Errorf("no commit with hash prefix %s", prefix)
+	case 1:
+		for p := range found {
+			return p.git, p.mgit, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w %s", errAmbiguousHash, prefix)
+}
+
+// isHashPrefix reports whether rev could abbreviate a hash: 4 to 40 hex
+// digits
+func isHashPrefix(rev string) bool {
+	if len(rev) < 4 || len(rev) > 40 {
+		return false
+	}
+	for _, c := range strings.ToLower(rev) {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveHashPrefix resolves an abbreviated Git or MGit hash through the
+// short-hash index. When nothing matches, the index is rebuilt once, in
+// case commits were made behind its back.
+func resolveHashPrefix(repo *git.Repository, storage *MGitStorage, prefix string) (gitHash, mgitHash string, err error) {
+	idx, err := loadHashIndex(repo, storage)
+	if err != nil {
+		return "", "", err
+	}
+	gitHash, mgitHash, err = idx.Resolve(prefix)
+	if err != nil && !errors.Is(err, errAmbiguousHash) {
+		if idx, rebuildErr := rebuildHashIndex(repo, storage); rebuildErr == nil {
+			gitHash, mgitHash, err = idx.Resolve(prefix)
+		}
+	}
+	return gitHash, mgitHash, err
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// hooksDir is where hooks are looked up: core.hooksPath, relative to the
+// top of the working tree, else .mgit/hooks
+func hooksDir() string {
+	path := GetConfigValue("core.hooksPath", "")
+	if path == "" {
+		return filepath.Join(mgitCommonDir(), "hooks")
+	}
+	path = expandHomePath(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(repoRoot(), path)
+	}
+	return path
+}
+
+// runHook runs a hook, if it exists and is executable, from the top of the
+// working tree with the given arguments, standard input and extra
+// environment. A hook that fails is an error naming it.
+func runHook(name, stdin string, env []string, args ...string) error {
+	return runHookAt(filepath.Join(hooksDir(), name), name, stdin, env, args...)
+}
+
+// runHookAt runs the hook at path as runHook does
+func runHookAt(path, name, stdin string, env []string, args ...string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return nil
+	}
+
+	span := startSpan("hook", "name", name)
+	cmd := exec.Command(path, args...)
+	cmd.Dir = repoRoot()
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), hookEnv()...)
+	cmd.Env = append(cmd.Env, env...)
+	err = cmd.Run()
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
+
+// hookEnv is the environment every hook gets: MGIT_DIR, and this mgit
+// first on the PATH so hooks run the same version
+func hookEnv() []string {
+	env := []string{}
+	if dir, err := filepath.Abs(mgitDir()); err == nil {
+		env = append(env, "MGIT_DIR="+dir)
+	}
+	if self, err := os.Executable(); err == nil {
+		env = append(env, "PATH="+filepath.Dir(self)+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+	return env
+}
+
+// runPostCommitHook runs the post-commit hook after a commit is made. As
+// in git it can't undo the commit, so a failure is only reported. Besides
+// the environment every hook gets, it is told about the commit, so
+// attestation services such as timestampers and compliance loggers needn't
+// parse mgit's output:
+//
+//	MGIT_COMMIT_MGIT_HASH   the commit's MGit hash
+//	MGIT_COMMIT_GIT_HASH    its Git hash
+//	MGIT_AUTHOR_PUBKEY      the author's npub
+//	MGIT_SIGNATURE_PAYLOAD  the 32-byte digest, in hex, that a signature of
+//	                        the commit signs
+//	MGIT_COMMIT_SIGNATURE   the commit's signature, in hex, if it is signed
+//
+// The MGit variables are empty for a commit made without a pubkey, which
+// has no MGit side.
+func runPostCommitHook(storage *MGitStorage, hash plumbing.Hash) {
+	if err := runHook("post-commit", "", postCommitEnv(storage, hash)); err != nil {
+		fmt.Printf("Warning: %s\n", err)
+	}
+}
+
+// postCommitEnv is the environment of the post-commit hook for the commit
+// with the given MGit hash, or Git hash if it has no MGit side
+func postCommitEnv(storage *MGitStorage, hash plumbing.Hash) []string {
+	commit, err := storage.GetCommit(hash.String())
+	if err != nil {
+		return []string{
+			"MGIT_COMMIT_MGIT_HASH=",
+			"MGIT_COMMIT_GIT_HASH=" + hash.String(),
+			"MGIT_AUTHOR_PUBKEY=",
+			"MGIT_SIGNATURE_PAYLOAD=",
+			"MGIT_COMMIT_SIGNATURE=",
+		}
+	}
+	pubkey := ""
+	if commit.Author != nil {
+		pubkey = commit.Author.Pubkey
+	}
+	payload := mgitSignatureDigest(commit.MGitHash)
+	return []string{
+		"MGIT_COMMIT_MGIT_HASH=" + commit.MGitHash,
+		"MGIT_COMMIT_GIT_HASH=" + commit.GitHash,
+		"MGIT_AUTHOR_PUBKEY=" + pubkey,
+		"MGIT_SIGNATURE_PAYLOAD=" + hex.EncodeToString(payload[:]),
+		"MGIT_COMMIT_SIGNATURE=" + commit.Metadata["signature"],
+	}
+}
+
+// sampleHooks are installed by init as <name>.sample; removing the suffix
+// enables them
+var sampleHooks = map[string]string{
+	"pre-commit":  sampleHookConfig + preCommitSample,
+	"post-commit": sampleHookConfig + postCommitSample,
+	"pre-push":    sampleHookConfig + prePushSample,
+}
+
+// installSampleHooks writes the sample hooks into an MGit directory,
+// leaving any that are already there
+func installSampleHooks(mgitRoot string) error {
+	dir := filepath.Join(mgitRoot, "hooks")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, script := range sampleHooks {
+		path := filepath.Join(dir, name+".sample")
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleHookConfig starts each sample: the shebang and a config reader
+// that falls back to a default
+const sampleHookConfig = `#!/bin/sh
+
+config() {
+	value=$(mgit config "$1")
+	case "$value" in
+	"No value set for"*) echo "$2" ;;
+	*) echo "$value" ;;
+	esac
+}
+`
+
+const preCommitSample = `
+# Sample pre-commit hook. To enable it, rename it to pre-commit.
+#
+# Refuses unsigned commits when hooks.requireSigned is true; mgit tells
+# the hook with MGIT_COMMIT_SIGN whether the commit will be signed. Warns
+# about staged files larger than hooks.largeFileLimit bytes (default 5 MB),
+# refusing them when hooks.largeFileRefuse is true.
+
+if [ "$(config hooks.requireSigned false)" = true ] && [ "$MGIT_COMMIT_SIGN" != true ]; then
+	echo "pre-commit: commits must be signed; use 'mgit commit -S' or set commit.sign" >&2
+	exit 1
+fi
+
+limit=$(config hooks.largeFileLimit 5242880)
+large=$(git diff --cached --name-only --diff-filter=AM | while IFS= read -r file; do
+	size=$(git cat-file -s ":$file" 2>/dev/null) || continue
+	if [ "$size" -gt "$limit" ]; then
+		echo "  $file ($size bytes)"
+	fi
+done)
+if [ -n "$large" ]; then
+	echo "pre-commit: staged files larger than $limit bytes:" >&2
+	echo "$large" >&2
+	if [ "$(config hooks.largeFileRefuse false)" = true ]; then
+		exit 1
+	fi
+fi
+exit 0
+`
+
+const postCommitSample = `
+# Sample post-commit hook. To enable it, rename it to post-commit.
+#
+# Appends a line per commit to hooks.commitLog (default .mgit/commit.log)
+# for a timestamper or compliance logger to pick up:
+#
+#   <unix time> <MGit hash> <author npub> <signature payload> <signature>
+#
+# mgit describes the commit in MGIT_COMMIT_MGIT_HASH, MGIT_COMMIT_GIT_HASH,
+# MGIT_AUTHOR_PUBKEY, MGIT_SIGNATURE_PAYLOAD (the digest a signature of the
+# commit signs) and MGIT_COMMIT_SIGNATURE (empty when unsigned). Whatever
+# the hook does, the commit stays.
+
+[ -n "$MGIT_COMMIT_MGIT_HASH" ] || exit 0
+log=$(config hooks.commitLog "$MGIT_DIR/commit.log")
+echo "$(date +%s) $MGIT_COMMIT_MGIT_HASH $MGIT_AUTHOR_PUBKEY $MGIT_SIGNATURE_PAYLOAD ${MGIT_COMMIT_SIGNATURE:--}" >> "$log"
+`
+
+const prePushSample = `
+# Sample pre-push hook. To enable it, rename it to pre-push.
+#
+# mgit passes the remote's name and URL as arguments, and a line per
+# pushed ref on standard input:
+#
+#   <local ref> <local hash> <remote ref> <remote hash>
+#
+# Refuses pushes to the branches (or globs) in hooks.protectedBranches,
+# default "main master", unless MGIT_ALLOW_PROTECTED=1, and pushes of a
+# history whose MGit hashes or signatures don't verify.
+
+set -f
+protected=$(config hooks.protectedBranches "main master")
+while read -r local_ref local_hash remote_ref remote_hash; do
+	branch=${remote_ref#refs/heads/}
+	for pattern in $protected; do
+		case "$branch" in
+		$pattern)
+			if [ "$MGIT_ALLOW_PROTECTED" != 1 ]; then
+				echo "pre-push: $branch is protected; set MGIT_ALLOW_PROTECTED=1 to push to it" >&2
+				exit 1
+			fi
+			;;
+		esac
+	done
+done
+
+if ! mgit verify >/dev/null; then
+	echo "pre-push: the MGit history doesn't verify; see 'mgit verify'" >&2
+	exit 1
+fi
+exit 0
+`
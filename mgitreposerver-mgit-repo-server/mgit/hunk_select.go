@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// hunkContext is the number of unchanged lines shown around a change
+const hunkContext = 3
+
+// hunkLine is one line of a hunk: context, deleted or inserted
+type hunkLine struct {
+	Op   diffOp
+	Text string // with its "\n", unless it is the last line and has none
+}
+
+// selectHunk is a hunk offered for selection. Start and End delimit its
+// edits in the file's edit script, which splitting needs.
+type selectHunk struct {
+	OldStart   int // 0-based
+	NewStart   int
+	Lines      []hunkLine
+	Start, End int
+	Groups     int // runs of changed lines; more than one can be split
+	Selected   bool
+}
+
+// makeHunks groups the changes in edits[from:to] into hunks with up to
+// context unchanged lines around them. With merge, changes whose contexts
+// would touch share a hunk, as in a diff; without, every run of changes
+// gets its own, which is how a hunk is split.
+func makeHunks(edits []diffEdit, from, to, context int, merge bool) []*selectHunk {
+	type group struct{ start, end int }
+	groups := []group{}
+	for i := from; i < to; {
+		if edits[i].Op == diffEqual {
+			i++
+			continue
+		}
+		start := i
+		for i < to && edits[i].Op != diffEqual {
+			i++
+		}
+		groups = append(groups, group{start, i})
+	}
+
+	hunks := []*selectHunk{}
+	for i := 0; i < len(groups); {
+		first, last := i, i
+		for merge && last+1 < len(groups) && groups[last+1].start-groups[last].end <= 2*context {
+			last++
+		}
+		i = last + 1
+
+		start := groups[first].start
+		for n := 0; n < context && start > from && edits[start-1].Op == diffEqual; n++ {
+			start--
+		}
+		end := groups[last].end
+		for n := 0; n < context && end < to && edits[end].Op == diffEqual; n++ {
+			end++
+		}
+
+		hunk := &selectHunk{Start: start, End: end, Groups: last - first + 1}
+		for _, edit := range edits[:start] {
+			if edit.Op != diffInsert {
+				hunk.OldStart++
+			}
+			if edit.Op != diffDelete {
+				hunk.NewStart++
+			}
+		}
+		for _, edit := range edits[start:end] {
+			hunk.Lines = append(hunk.Lines, hunkLine{Op: edit.Op, Text: edit.Line})
+		}
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
+
+// sides returns the old and new text of a hunk
+func (h *selectHunk) sides() (old, new []string) {
+	for _, line := range h.Lines {
+		if line.Op != diffInsert {
+			old = append(old, line.Text)
+		}
+		if line.Op != diffDelete {
+			new = append(new, line.Text)
+		}
+	}
+	return old, new
+}
+
+// header formats the hunk's @@ line
+func (h *selectHunk) header() string {
+	old, new := h.sides()
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.OldStart, len(old)), hunkRange(h.NewStart, len(new)))
+}
+
+// hunkRange formats one side of a hunk header like diff does, where an
+// empty side names the line before it
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// String formats the hunk as it appears in a unified diff
+func (h *selectHunk) String() string {
+	var b strings.Builder
+	b.WriteString(h.header())
+	b.WriteString("\n")
+	for _, line := range h.Lines {
+		b.WriteByte(hunkPrefix(line.Op))
+		b.WriteString(line.Text)
+		if !strings.HasSuffix(line.Text, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	return b.String()
+}
+
+// hunkPrefix is the diff prefix of a line
+func hunkPrefix(op diffOp) byte {
+	switch op {
+	case diffDelete:
+		return '-'
+	case diffInsert:
+		return '+'
+	}
+	return ' '
+}
+
+// applySelectedHunks applies the selected hunks to old. Hunks are in file
+// order; where a hunk's leading context overlaps the previous selected
+// hunk, which happens after a split, the overlap is skipped, and it must
+// be unchanged context.
+func applySelectedHunks(old []string, hunks []*selectHunk) ([]string, error) {
+	result := []string{}
+	cursor := 0
+	for _, hunk := range hunks {
+		if !hunk.Selected {
+			continue
+		}
+		lines := hunk.Lines
+		for skip := cursor - hunk.OldStart; skip > 0; {
+			if len(lines) == 0 || lines[0].Op != diffEqual {
+				return nil, fmt.Errorf("hunk %s overlaps the hunk before it", hunk.header())
+			}
+			lines = lines[1:]
+			skip--
+		}
+		start := hunk.OldStart
+		if start < cursor {
+			start = cursor
+		}
+
+		result = append(result, old[cursor:start]...)
+		cursor = start
+		for _, line := range lines {
+			if line.Op != diffInsert {
+				if cursor >= len(old) || old[cursor] != line.Text {
+					return nil, fmt.Errorf("hunk %s does not apply", hunk.header())
+				}
+				cursor++
+			}
+			if line.Op != diffDelete {
+				result = append(result, line.Text)
+			}
+		}
+	}
+	return append(result, old[cursor:]...), nil
+}
+
+// reverseHunks returns the hunks turned around, so that applying them
+// undoes them. Selections carry over.
+func reverseHunks(hunks []*selectHunk) []*selectHunk {
+	reversed := []*selectHunk{}
+	for _, hunk := range hunks {
+		r := &selectHunk{OldStart: hunk.NewStart, NewStart: hunk.OldStart, Selected: hunk.Selected}
+		for _, line := range hunk.Lines {
+			switch line.Op {
+			case diffDelete:
+				line.Op = diffInsert
+			case diffInsert:
+				line.Op = diffDelete
+			}
+			r.Lines = append(r.Lines, line)
+		}
+		reversed = append(reversed, r)
+	}
+	return reversed
+}
+
+// hunkSelector asks about hunks on the terminal, one at a time
+type hunkSelector struct {
+	in *bufio.Reader
+	// Verb is what selecting a hunk does, as in "Stage this hunk"
+	Verb string
+	// Reverse means the selected hunks will be undone rather than applied,
+	// as when discarding changes, so an edited hunk must keep its new side
+	Reverse bool
+	quit    bool
+}
+
+// newHunkSelector creates a selector reading answers from stdin
+func newHunkSelector(verb string) *hunkSelector {
+	return &hunkSelector{in: bufio.NewReader(os.Stdin), Verb: verb}
+}
+
+// hunkHelp explains the answers to a hunk prompt
+const hunkHelp = `y - %[1]s this hunk
+n - do not %[1]s this hunk
+q - quit; do not %[1]s this hunk or any of the remaining ones
+a - %[1]s this hunk and all later hunks in the file
+d - do not %[1]s this hunk or any of the later hunks in the file
+s - split the current hunk into smaller hunks
+e - manually edit the current hunk
+? - print help
+`
+
+// selectFileHunks asks about each hunk of the change from old to new and
+// marks the ones to take. header is printed before the first hunk. It
+// returns the hunks, in file order, or nil if there is nothing to ask.
+func (s *hunkSelector) selectFileHunks(header string, old, new []string) ([]*selectHunk, error) {
+	edits := diffLines(old, new)
+	hunks := makeHunks(edits, 0, len(edits), hunkContext, true)
+	if len(hunks) == 0 || s.quit {
+		return nil, nil
+	}
+	fmt.Print(header)
+
+	verb := strings.ToLower(s.Verb)
+	for i := 0; i < len(hunks); {
+		hunk := hunks[i]
+		fmt.Print(hunk.String())
+		options := "y,n,q,a,d"
+		if hunk.Groups > 1 {
+			options += ",s"
+		}
+		options += ",e,?"
+		fmt.Printf("(%d/%d) %s this hunk [%s]? ", i+1, len(hunks), s.Verb, options)
+
+		answer, err := s.in.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		if err != nil && answer == "" {
+			// End of input means stop, as with q
+			fmt.Println()
+			s.quit = true
+			return hunks, nil
+		}
+		if answer == "" {
+			continue
+		}
+
+		switch answer[0] {
+		case 'y':
+			hunk.Selected = true
+			i++
+		case 'n':
+			i++
+		case 'q':
+			s.quit = true
+			return hunks, nil
+		case 'a':
+			for _, rest := range hunks[i:] {
+				rest.Selected = true
+			}
+			return hunks, nil
+		case 'd':
+			return hunks, nil
+		case 's':
+			if hunk.Groups < 2 {
+				fmt.Println("Sorry, cannot split this hunk")
+				continue
+			}
+			split := makeHunks(edits, hunk.Start, hunk.End, hunkContext, false)
+			fmt.Printf("Split into %d hunks.\n", len(split))
+			hunks = append(hunks[:i], append(split, hunks[i+1:]...)...)
+		case 'e':
+			edited, err := s.editHunk(hunk)
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				continue
+			}
+			if edited == nil {
+				continue
+			}
+			edited.Selected = true
+			hunks[i] = edited
+			i++
+		default:
+			fmt.Printf(hunkHelp, verb)
+		}
+	}
+	return hunks, nil
+}
+
+// editHunk lets the user edit a hunk in their editor. The edited hunk may
+// only drop changes: the side it will be applied to must still match. It
+// returns nil if the user emptied the hunk.
+func (s *hunkSelector) editHunk(hunk *selectHunk) (*selectHunk, error) {
+	file, err := os.CreateTemp("", "mgit-hunk-*.diff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	fmt.Fprintf(file, "# Manual hunk edit mode -- see bottom for a quick guide.\n%s", hunk.String())
+	removeMinus, removePlus := "make them ' ' lines (context)", "delete them"
+	if s.Reverse {
+		removeMinus, removePlus = removePlus, removeMinus
+	}
+	fmt.Fprintf(file, `# ---
+# To remove '-' lines, %s.
+# To remove '+' lines, %s.
+# Lines starting with # will be removed.
+# If the hunk can't be applied cleanly, you will be asked to edit it again.
+# To abort the edit and %s nothing, delete all lines.
+`, removeMinus, removePlus, strings.ToLower(s.Verb))
+	file.Close()
+
+	for {
+		if err := runEditor(file.Name()); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		edited := &selectHunk{OldStart: hunk.OldStart, NewStart: hunk.NewStart, Start: hunk.Start, End: hunk.End, Groups: 1}
+		for _, line := range splitLines(string(data)) {
+			switch {
+			case strings.HasPrefix(line, "#"), strings.HasPrefix(line, "@@"):
+			case strings.HasPrefix(line, "\\"):
+				// "\ No newline at end of file" applies to the line before
+				if n := len(edited.Lines); n > 0 {
+					edited.Lines[n-1].Text = strings.TrimSuffix(edited.Lines[n-1].Text, "\n")
+				}
+			case strings.HasPrefix(line, "-"):
+				edited.Lines = append(edited.Lines, hunkLine{Op: diffDelete, Text: line[1:]})
+			case strings.HasPrefix(line, "+"):
+				edited.Lines = append(edited.Lines, hunkLine{Op: diffInsert, Text: line[1:]})
+			case strings.HasPrefix(line, " "):
+				edited.Lines = append(edited.Lines, hunkLine{Op: diffEqual, Text: line[1:]})
+			case line == "\n":
+				// Editors like to strip the space of empty context lines
+				edited.Lines = append(edited.Lines, hunkLine{Op: diffEqual, Text: "\n"})
+			}
+		}
+		if len(edited.Lines) == 0 {
+			return nil, nil
+		}
+
+		oldSide, newSide := hunk.sides()
+		editedOld, editedNew := edited.sides()
+		if s.Reverse {
+			oldSide, editedOld = newSide, editedNew
+		}
+		if equalLines(oldSide, editedOld) {
+			return edited, nil
+		}
+		fmt.Print("Your edited hunk does not apply. Edit again (saying \"no\" discards!) [y/n]? ")
+		answer, _ := s.in.ReadString('\n')
+		if !strings.HasPrefix(strings.TrimSpace(answer), "y") {
+			return nil, nil
+		}
+	}
+}
+
+// runEditor opens a file in the user's editor: GIT_EDITOR, core.editor,
+// VISUAL or EDITOR, in that order, else vi
+func runEditor(path string) error {
+	editor := os.Getenv("GIT_EDITOR")
+	if editor == "" {
+		editor = GetConfigValue("core.editor", "")
+	}
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if editor == "" {
+			editor = os.Getenv(name)
+		}
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %q failed: %w", editor, err)
+	}
+	return nil
+}
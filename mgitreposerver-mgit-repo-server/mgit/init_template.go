@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// An init template is a directory whose parts are copied into each new
+// repository:
+//
+//	hooks/            into .mgit/hooks, keeping their modes
+//	config            as the repository config, .mgit/config
+//	commit-template   as .mgit/commit-template, the commit.template
+//	info/             into .git/info, e.g. ignore patterns in info/exclude
+//	worktree/         into the working tree, e.g. OWNERS or .gitignore
+//
+// Files already there, like those of a directory being made a repository,
+// are left alone.
+
+// initTemplateDir returns the template directory to use: --template=<dir>,
+// else init.templateDir. An empty --template= uses none.
+func initTemplateDir(flag string, flagSet bool) string {
+	if flagSet {
+		return expandHomePath(flag)
+	}
+	return expandHomePath(GetConfigValue("init.templateDir", ""))
+}
+
+// applyInitTemplate copies a template directory into the repository at
+// path, returning how many files it copied
+func applyInitTemplate(templateDir, path string) (int, error) {
+	info, err := os.Stat(templateDir)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read template directory: %w", err)
+	}
+	if !info.IsDir() {
+		return 0, fmt.Errorf("template %s is not a directory", templateDir)
+	}
+
+	mgitRoot := filepath.Join(path, ".mgit")
+	parts := []struct{ from, to string }{
+		{"hooks", filepath.Join(mgitRoot, "hooks")},
+		{"config", filepath.Join(mgitRoot, "config")},
+		{"commit-template", filepath.Join(mgitRoot, "commit-template")},
+		{"info", filepath.Join(path, ".git", "info")},
+		{"worktree", path},
+	}
+	copied := 0
+	for _, part := range parts {
+		n, err := copyTemplatePart(filepath.Join(templateDir, part.from), part.to)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+
+	// A template's commit message template is what commit starts from,
+	// unless the template's config names another
+	if _, err := os.Stat(filepath.Join(templateDir, "commit-template")); err == nil {
+		configPath := filepath.Join(mgitRoot, "config")
+		config, err := LoadConfig(configPath)
+		if err != nil {
+			return copied, err
+		}
+		// Appended rather than saved, which would drop the comments and
+		// includes of the template's config
+		if config.Get("commit", "template") == "" {
+			file, err := os.OpenFile(configPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return copied, err
+			}
+			_, err = file.WriteString("\n[commit]\n\ttemplate = .mgit/commit-template\n")
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return copied, err
+			}
+		}
+	}
+	return copied, nil
+}
+
+// copyTemplatePart copies a template file, or a directory's files, to the
+// repository without overwriting anything. A missing part is skipped.
+func copyTemplatePart(from, to string) (int, error) {
+	if _, err := os.Lstat(from); os.IsNotExist(err) {
+		return 0, nil
+	}
+	copied := 0
+	err := filepath.WalkDir(from, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	return copied, err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Repository location overrides set by the global --git-dir and --work-tree
+// options. Both are absolute once set.
+var (
+	gitDirOverride   string
+	workTreeOverride string
+)
+
+var (
+	discoverOnce   sync.Once
+	discoveredRoot string
+	discoveredBare bool
+)
+
+// repoRoot returns the top of the working tree of the current repository,
+// or the repository itself when it is bare
+func repoRoot() string {
+	if workTreeOverride != "" {
+		return workTreeOverride
+	}
+	if gitDirOverride != "" {
+		if filepath.Base(gitDirOverride) == ".git" {
+			return filepath.Dir(gitDirOverride)
+		}
+		return gitDirOverride
+	}
+
+	discover()
+	return discoveredRoot
+}
+
+// isBareRepo reports whether the current repository has no working tree
+func isBareRepo() bool {
+	if workTreeOverride != "" {
+		return false
+	}
+	if gitDirOverride != "" {
+		return filepath.Base(gitDirOverride) != ".git"
+	}
+
+	discover()
+	return discoveredBare
+}
+
+func discover() {
+	discoverOnce.Do(func() {
+		discoveredRoot, discoveredBare = discoverRepoRoot()
+	})
+}
+
+// discoverRepoRoot walks up from the current directory to the nearest
+// directory containing .git, or that is itself a bare repository, like git
+// does. It returns "." when that is the current directory or when no
+// repository is found, so callers report the usual "repository does not
+// exist" error.
+func discoverRepoRoot() (string, bool) {
+	if _, err := os.Stat(".git"); err == nil {
+		return ".", false
+	}
+	if looksLikeGitDir(".") {
+		return ".", true
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return ".", false
+	}
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ".", false
+		}
+		dir = parent
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, false
+		}
+		if looksLikeGitDir(dir) {
+			return dir, true
+		}
+	}
+}
+
+// looksLikeGitDir reports whether dir has the layout of a git directory
+func looksLikeGitDir(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// repoGitDir returns the git directory of the current repository, following
+// a .git file ("gitdir: <path>") as used by linked worktrees and submodules
+func repoGitDir() string {
+	if gitDirOverride != "" {
+		return gitDirOverride
+	}
+	if isBareRepo() {
+		return repoRoot()
+	}
+
+	dotGit := filepath.Join(repoRoot(), ".git")
+	info, err := os.Stat(dotGit)
+	if err != nil || info.IsDir() {
+		return dotGit
+	}
+
+	data, err := os.ReadFile(dotGit)
+	if err != nil {
+		return dotGit
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return dotGit
+	}
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoRoot(), gitDir)
+	}
+	return gitDir
+}
+
+// repoRelativePath converts a path given on the command line, relative to
+// the current directory, into a path relative to the top of the working tree
+func repoRelativePath(path string) (string, error) {
+	root, err := filepath.Abs(repoRoot())
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside repository at %s", path, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// mgitDir returns the .mgit directory of the current repository, which sits
+// at the top of the working tree, or inside the repository when it is bare.
+// In a linked worktree it holds only that worktree's HEAD and state.
+func mgitDir() string {
+	return filepath.Join(repoRoot(), ".mgit")
+}
+
+// mgitCommonDir returns the .mgit directory with what the worktrees of a
+// repository share: objects, refs, mappings and config. A linked worktree's
+// .mgit names it in a commondir file, like git's worktrees do.
+func mgitCommonDir() string {
+	return readCommonDir(mgitDir())
+}
+
+// repoCommonGitDir is mgitCommonDir for the git directory
+func repoCommonGitDir() string {
+	return readCommonDir(repoGitDir())
+}
+
+// readCommonDir follows the commondir file of a worktree's directory, if
+// it has one
+func readCommonDir(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "commondir"))
+	if err != nil {
+		return dir
+	}
+	common := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(dir, common)
+	}
+	return filepath.Clean(common)
+}
+
+// openRepo opens the current repository, honoring --git-dir and --work-tree
+func openRepo() (*git.Repository, error) {
+	if gitDirOverride == "" {
+		return git.PlainOpenWithOptions(repoRoot(), &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	}
+
+	storage := filesystem.NewStorage(osfs.New(gitDirOverride), cache.NewObjectLRUDefault())
+	if isBareRepo() {
+		return git.Open(storage, nil)
+	}
+	return git.Open(storage, osfs.New(repoRoot()))
+}
+
+// newGitCommand prepares a git subprocess that operates on the current
+// repository
+func newGitCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoRoot()
+	if gitDirOverride != "" {
+		cmd.Env = append(os.Environ(), "GIT_DIR="+gitDirOverride)
+		if !isBareRepo() {
+			root, _ := filepath.Abs(repoRoot())
+			cmd.Env = append(cmd.Env, "GIT_WORK_TREE="+root)
+		}
+	}
+	return cmd
+}
+
+// setRepoLocation applies a --git-dir or --work-tree option. Relative paths
+// are resolved now, so they are relative to any preceding -C.
+func setRepoLocation(target *string, path string) error {
+	abs, err := filepath.Abs(expandHomePath(path))
+	if err != nil {
+		return err
+	}
+	*target = abs
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// logRef is a branch, remote-tracking branch or tag with the MGit commit it
+// points at
+type logRef struct {
+	Name     plumbing.ReferenceName
+	MGitHash string
+}
+
+// logRefs lists the branches, remote-tracking branches and tags that point
+// at MGit commits, resolving symbolic refs like origin/HEAD and peeling
+// annotated tags
+func logRefs(repo *git.Repository, storage *MGitStorage) []logRef {
+	refs := []logRef{}
+	iter, err := repo.References()
+	if err != nil {
+		return refs
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		if !(name.IsBranch() || name.IsRemote() || name.IsTag()) {
+			return nil
+		}
+		if ref.Type() == plumbing.SymbolicReference {
+			resolved, err := repo.Reference(name, true)
+			if err != nil {
+				return nil
+			}
+			ref = resolved
+		}
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				return nil
+			}
+			hash = commit.Hash
+		}
+		if mgitHash, err := storage.GetMGitHashFromGit(hash.String()); err == nil {
+			refs = append(refs, logRef{name, mgitHash})
+		}
+		return nil
+	})
+	return refs
+}
+
+// logDecorations maps MGit hashes to the labels log --decorate shows for
+// them, as git does: "HEAD -> <branch>" (or "HEAD" when detached), then
+// branches, remote-tracking branches and "tag: <name>"
+func logDecorations(repo *git.Repository, storage *MGitStorage) map[string][]string {
+	refs := logRefs(repo, storage)
+	sort.Slice(refs, func(i, j int) bool {
+		if ri, rj := logRefRank(refs[i].Name), logRefRank(refs[j].Name); ri != rj {
+			return ri < rj
+		}
+		return refs[i].Name < refs[j].Name
+	})
+
+	current := ""
+	head, headErr := repo.Head()
+	if headErr == nil && head.Name().IsBranch() {
+		current = head.Name().Short()
+	}
+
+	decorations := map[string][]string{}
+	if headErr == nil && current == "" {
+		if mgitHash, err := storage.GetMGitHashFromGit(head.Hash().String()); err == nil {
+			decorations[mgitHash] = []string{"HEAD"}
+		}
+	}
+	for _, ref := range refs {
+		label := ref.Name.Short()
+		switch {
+		case ref.Name.IsTag():
+			label = "tag: " + label
+		case ref.Name.IsBranch() && label == current:
+			// HEAD goes first, joined to its branch
+			decorations[ref.MGitHash] = append([]string{"HEAD -> " + label}, decorations[ref.MGitHash]...)
+			continue
+		}
+		decorations[ref.MGitHash] = append(decorations[ref.MGitHash], label)
+	}
+	return decorations
+}
+
+func logRefRank(name plumbing.ReferenceName) int {
+	switch {
+	case name.IsBranch():
+		return 0
+	case name.IsRemote():
+		return 1
+	}
+	return 2
+}
+
+// formatDecorations is the " (a, b)" shown after a decorated commit's hash
+func formatDecorations(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(labels, ", ") + ")"
+}
+
+// logStartingCommits is where log --all starts: every commit a branch,
+// remote-tracking branch or tag points at
+func logStartingCommits(repo *git.Repository, storage *MGitStorage) []*MCommitStruct {
+	commits := []*MCommitStruct{}
+	seen := map[string]bool{}
+	for _, ref := range logRefs(repo, storage) {
+		if seen[ref.MGitHash] {
+			continue
+		}
+		seen[ref.MGitHash] = true
+		if commit, err := storage.GetCommit(ref.MGitHash); err == nil {
+			commits = append(commits, commit)
+		}
+	}
+	return commits
+}
+
+// commitTime is when a commit was committed, for ordering
+func commitTime(commit *MCommitStruct) time.Time {
+	if commit.Committer != nil {
+		return commit.Committer.When
+	}
+	if commit.Author != nil {
+		return commit.Author.When
+	}
+	return time.Time{}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// HandleLsTree handles the ls-tree command, listing the contents of a tree
+// object. It only reads the object store, so it works in bare repositories.
+func HandleLsTree(args []string) {
+	recursive := false
+	nameOnly := false
+	treeish := ""
+	paths := []string{}
+
+	for _, arg := range args {
+		switch {
+		case arg == "-r":
+			recursive = true
+		case arg == "--name-only":
+			nameOnly = true
+		case treeish == "":
+			treeish = arg
+		default:
+			paths = append(paths, strings.TrimSuffix(arg, "/"))
+		}
+	}
+
+	if treeish == "" {
+		fmt.Println("Usage: mgit ls-tree [-r] [--name-only] <tree-ish> [<path>...]")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	tree, err := resolveTree(repo, treeish)
+	if err != nil {
+		fmt.Printf("Error: Not a valid tree object %s: %s\n", treeish, err)
+		os.Exit(1)
+	}
+
+	if err := listTree(repo, tree, "", recursive, nameOnly, paths); err != nil {
+		fmt.Printf("Error listing tree: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// resolveTree resolves a tree hash, or the tree of a commit given by any
+// revision mgit understands, including MGit hashes
+func resolveTree(repo *git.Repository, treeish string) (*object.Tree, error) {
+	if len(treeish) == 40 && plumbing.IsHash(treeish) {
+		if tree, err := repo.TreeObject(plumbing.NewHash(treeish)); err == nil {
+			return tree, nil
+		}
+	}
+
+	hash, err := resolveGitRevision(repo, treeish)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// listTree prints the entries of a tree whose paths match the filter
+func listTree(repo *git.Repository, tree *object.Tree, prefix string, recursive, nameOnly bool, paths []string) error {
+	for _, entry := range tree.Entries {
+		entryPath := path.Join(prefix, entry.Name)
+		isTree := entry.Mode == filemode.Dir
+
+		if !pathMatches(entryPath, paths, isTree && recursive) {
+			continue
+		}
+
+		if isTree && recursive {
+			subtree, err := repo.TreeObject(entry.Hash)
+			if err != nil {
+				return err
+			}
+			if err := listTree(repo, subtree, entryPath, recursive, nameOnly, paths); err != nil {
+				return err
+			}
+			continue
+		}
+
+		printTreeEntry(entry, entryPath, nameOnly)
+	}
+	return nil
+}
+
+// pathMatches reports whether an entry is selected by the path filter. A
+// directory being descended into also matches when a filter lies below it.
+func pathMatches(entryPath string, paths []string, descending bool) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if entryPath == p || strings.HasPrefix(entryPath, p+"/") {
+			return true
+		}
+		if descending && strings.HasPrefix(p, entryPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// printTreeEntry prints a tree entry in git's ls-tree format
+func printTreeEntry(entry object.TreeEntry, name string, nameOnly bool) {
+	if nameOnly {
+		fmt.Println(name)
+		return
+	}
+
+	objType := plumbing.BlobObject
+	switch entry.Mode {
+	case filemode.Dir:
+		objType = plumbing.TreeObject
+	case filemode.Submodule:
+		objType = plumbing.CommitObject
+	}
+	fmt.Printf("%06o %s %s\t%s\n", uint32(entry.Mode), objType, entry.Hash, name)
+}
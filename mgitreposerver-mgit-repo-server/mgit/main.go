@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -14,67 +13,176 @@ import (
 )
 
 func main() {
-	if len(os.Args) < 2 {
+	cmdArgs := parseGlobalOptions(os.Args[1:])
+	if len(cmdArgs) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
-	args := os.Args[2:]
-
-	switch command {
-	case "init":
-		initRepo(args)
-	case "clone":
-		HandleClone(args)
-	case "add":
-		addFiles(args)
-	case "commit":
-		HandleMGitCommit(args)
-	case "push":
-		pushChanges(args)
-	case "pull":
-		pullChanges(args)
-	case "status":
-		showStatus(args)
-	case "branch":
-		handleBranch(args)
-	case "checkout":
-		checkoutBranch(args)
-	case "log":
-		HandleMGitLog(args)
-	case "show":
-		HandleMGitShow(args)
-	case "verify":
-		HandleMGitVerify(args)
-	case "config":
-		HandleConfig(args)
-	case "upload-pack":
-		HandleUploadPack(args)
-	default:
-		fmt.Printf("Unknown command: %s\n", command)
-		printUsage()
-		os.Exit(1)
+	command := cmdArgs[0]
+	args := cmdArgs[1:]
+
+	handler, ok := commands[command]
+	if !ok {
+		handler = unknownCommand(command)
+	}
+	// Commands that fail exit without ending the span; the start event
+	// still shows what ran
+	traceEvent("command.start", "command", command, "args", len(args))
+	span := startSpan("command", "command", command)
+	setReflogAction(command)
+	handler(args)
+	span.End(nil)
+}
+
+// parseGlobalOptions applies the options given before the command and
+// returns the command and its arguments
+func parseGlobalOptions(args []string) []string {
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch {
+		case args[0] == "--config-file":
+			if len(args) < 2 {
+				fmt.Println("Error: --config-file requires a path")
+				os.Exit(1)
+			}
+			os.Setenv("MGIT_GLOBAL_CONFIG", args[1])
+			args = args[2:]
+		case strings.HasPrefix(args[0], "--config-file="):
+			os.Setenv("MGIT_GLOBAL_CONFIG", strings.TrimPrefix(args[0], "--config-file="))
+			args = args[1:]
+		case args[0] == "-C":
+			if len(args) < 2 {
+				fmt.Println("Error: -C requires a path")
+				os.Exit(1)
+			}
+			if err := os.Chdir(args[1]); err != nil {
+				fmt.Printf("Error: cannot change to %s: %s\n", args[1], err)
+				os.Exit(1)
+			}
+			args = args[2:]
+		case args[0] == "--git-dir" || args[0] == "--work-tree":
+			if len(args) < 2 {
+				fmt.Printf("Error: %s requires a path\n", args[0])
+				os.Exit(1)
+			}
+			args = append([]string{args[0] + "=" + args[1]}, args[2:]...)
+		case strings.HasPrefix(args[0], "--git-dir="):
+			if err := setRepoLocation(&gitDirOverride, strings.TrimPrefix(args[0], "--git-dir=")); err != nil {
+				fmt.Printf("Error: invalid --git-dir: %s\n", err)
+				os.Exit(1)
+			}
+			args = args[1:]
+		case strings.HasPrefix(args[0], "--work-tree="):
+			if err := setRepoLocation(&workTreeOverride, strings.TrimPrefix(args[0], "--work-tree=")); err != nil {
+				fmt.Printf("Error: invalid --work-tree: %s\n", err)
+				os.Exit(1)
+			}
+			args = args[1:]
+		default:
+			fmt.Printf("Unknown option: %s\n", args[0])
+			printUsage()
+			os.Exit(1)
+		}
 	}
+	return args
 }
 
 func printUsage() {
 	fmt.Println("mgit - A go-git wrapper")
-	fmt.Println("Usage: mgit <command> [args]")
+	fmt.Println("Usage: mgit [-C <path>] [--git-dir=<path>] [--work-tree=<path>] [--config-file <path>] <command> [args]")
 	fmt.Println("Commands:")
-	fmt.Println("  init            Initialize a new repository")
+	fmt.Println("  init [--template=<dir>] [path]  Initialize a new repository")
 	fmt.Println("  clone <url>     Clone a repository")
+	fmt.Println("  clone --recurse-submodules <url>  Clone a repository and its submodules")
+	fmt.Println("  clone --depth <n> <url>  Clone only the last n commits of the default branch")
+	fmt.Println("  clone --sparse-metadata <url>  Clone, keeping MGit metadata of checked-out branches only")
+	fmt.Println("  clone --recurse-config <url>  Clone and apply the config the server recommends")
 	fmt.Println("  add <files...>  Add files to staging")
+	fmt.Println("  add -p [<paths>]  Choose hunks to stage interactively")
 	fmt.Println("  commit -m <msg> Commit staged changes")
-	fmt.Println("  push            Push commits to remote")
-	fmt.Println("  pull            Pull changes from remote")
+	fmt.Println("  commit -s -m <msg>  Commit with a Signed-off-by trailer naming your npub")
+	fmt.Println("  commit -m <msg> -- <paths>  Commit only the changes staged under the paths")
+	fmt.Println("  commit --no-verify  Commit without the pre-commit and commit-msg hooks or commitmsg.* rules")
+	fmt.Println("  commit --amend [--no-edit] [--reset-author]  Replace the last commit, with a new MGit hash")
+	fmt.Println("  push [<remote>]  Push commits to a remote, by default the branch's or origin")
+	fmt.Println("  push --dry-run  Show what a push would upload, and policy violations")
+	fmt.Println("  push --queue    Record a push to deliver later")
+	fmt.Println("  push --flush    Deliver queued pushes")
+	fmt.Println("  push --no-verify  Push without running the pre-push hook")
+	fmt.Println("  quota [<remote>]  Show the repository's size on the server against its quota")
+	fmt.Println("  pull [<remote>]  Pull changes from a remote")
+	fmt.Println("  remote [-v]     List remotes (add, remove, rename, set-url, show)")
 	fmt.Println("  status          Show repository status")
 	fmt.Println("  branch          List branches")
 	fmt.Println("  branch <name>   Create a new branch")
-	fmt.Println("  checkout <ref>  Checkout a branch or commit")
+	fmt.Println("  branch -v | -vv  List branches with their commits, upstream, ahead/behind and description")
+	fmt.Println("  branch -r | -a  List the remote-tracking branches, or all branches, with their MGit hashes")
+	fmt.Println("  branch -d | -D <branch>...  Delete branches and their MGit refs, -D even if not merged")
+	fmt.Println("  branch -m | -M [<old>] <new>  Rename a branch with its MGit ref, reflog and config")
+	fmt.Println("  branch -u <upstream> [<branch>]  Set the upstream a branch tracks (--unset-upstream to remove it)")
+	fmt.Println("  branch --edit-description [<branch>]  Describe a branch in .mgit/config")
+	fmt.Println("  tag [-l] [<pattern>]  List tags")
+	fmt.Println("  tag [-a | -s] [-m <msg>] <name> [<commit>]  Tag a commit, annotated tags with the tagger's pubkey (-d to delete, -v to verify)")
+	fmt.Println("  checkout [--reconcile] <ref>  Checkout a branch or commit, checking its MGit ref agrees with Git")
+	fmt.Println("  checkout -p [<rev>]  Choose hunks to restore from the index or a revision")
+	fmt.Println("  restore <paths...>  Restore files from the index (--staged: HEAD, --source: a revision)")
+	fmt.Println("  restore -p [<paths>]  Choose hunks to discard or restore")
+	fmt.Println("  clean [-n | -f] [-d] [-x | -X] [<paths>]  Remove untracked files, honoring .gitignore")
+	fmt.Println("  reset [--soft | --mixed | --hard] [<commit>]  Move the branch and its MGit ref to a commit, by Git or MGit hash")
+	fmt.Println("  stash [push [-m <msg>] [-u]]  Save local changes in .mgit/stash and revert them")
+	fmt.Println("  stash list | show [-p] | apply | pop | drop [<stash>]  Manage stashed changes")
+	fmt.Println("  stash push --remote[=<remote>] | stash fetch [<remote>]  Move stashes between clones through the server, encrypted")
 	fmt.Println("  log             Show commit history")
+	fmt.Println("  log <a>..<b>    Show commits in b that are not in a")
+	fmt.Println("  log --merges | --no-merges | --first-parent  Filter history by merges")
+	fmt.Println("  log --format=<template>  Print each commit with a Go template")
+	fmt.Println("  log --all --decorate  Show the history of every branch, remote and tag, labelled")
+	fmt.Println("  reflog [show]   Show where HEAD or a branch has been (<ref>@{n})")
+	fmt.Println("  reflog expire   Prune old reflog entries (gc.reflogExpire)")
+	fmt.Println("  maintenance run | start | stop  Run or schedule repository upkeep")
+	fmt.Println("  gc [--prune=<date> | --no-prune] [--dry-run]  Pack reachable MGit objects and prune unreachable ones")
+	fmt.Println("  workspace add | list | exec -- <command>  Run a command across registered repositories")
+	fmt.Println("  summary [--json] [--upload[=<remote>]] [<branch>...]  Update the per-branch summaries in .mgit/summaries (pushes upload them)")
+	fmt.Println("  worktree add [-b <branch>] <path> [<commit>] | list | remove <path>  Check out more branches side by side, sharing .mgit")
+	fmt.Println("  submodule [status] | add <url> [<path>] | init | update [--init] [--recursive]  Manage submodules, with their MGit metadata")
+	fmt.Println("  fsck [--no-dangling]  Check the MGit objects, mappings and refs, suggesting repairs")
+	fmt.Println("  fsck --rebuild-mappings  Regenerate the hash mappings from the MGit objects")
+	fmt.Println("  cherry <upstream> [head]  Show commits not yet applied upstream")
+	fmt.Println("  merge [--no-ff | --ff-only] <commit>  Merge a commit into the current branch")
+	fmt.Println("  merge --abort   Give up a merge stopped on conflicts")
+	fmt.Println("  rebase [--onto <newbase>] <upstream>  Replay the branch on upstream with new MGit hashes (--continue, --abort)")
+	fmt.Println("  bisect start [<bad> [<good>...]] | bad | good | skip | reset  Find the commit that introduced a bug, by MGit hash")
+	fmt.Println("  revert [-n] [-m <parent>] [-S] <commit>  Commit the inverse of a commit, with its own MGit hash (--continue, --abort)")
+	fmt.Println("  cherry-pick [-n] [-x] [-m <parent>] [-S] <commit>  Apply a commit from another branch as a new MGit commit (--continue, --abort)")
+	fmt.Println("  merge-base <a> <b>  Find the best common ancestor of commits")
 	fmt.Println("  show [commit]    Show commit details and changes")
-	fmt.Println("  config          Get and set configuration values")
+	fmt.Println("  diff [--staged] [<commit> [<commit>]]  Show changes in the working tree, the index or between commits (MGit hashes too)")
+	fmt.Println("  diff --submodule[=short|log]  Show submodule changes as the commits they moved between")
+	fmt.Println("  blame [--ignore-revs-file <file>] <file>  Show who last changed each line")
+	fmt.Println("  grep [--cached] <pattern> [<revision>... | --all]  Search tracked files, the index or revisions, by MGit hash")
+	fmt.Println("  verify [--no-cache] [--recurse-submodules] [--trust-anchor <file>] [--lookup-mappings] [--fix-refs]  Verify MGit hashes, signatures and branch refs")
+	fmt.Println("  attest <mgit-rev> [<artifact>...]  Write a signed provenance document (--verify to check one)")
+	fmt.Println("  annotate-history [-n] <email-map> [<rev>]  Claim your pre-MGit commits with a signed statement (--verify to check claims)")
+	fmt.Println("  apply [--3way] [<patch>]  Apply a unified diff to the worktree or index")
+	fmt.Println("  send-patch [--to <addr>] [--mbox <file>] <since> | <a>..<b> | -<n>  Mail commits as patches with MGit trailers")
+	fmt.Println("  am [--3way] [<mbox>...]  Apply mailed patches as MGit commits (--continue, --skip, --abort)")
+	fmt.Println("  config [--validate]  Get and set configuration values, or check them")
+	fmt.Println("  web [--port <port>]  Browse the repository in a local web UI")
+	fmt.Println("  export-site [--force] <dir>  Write the web UI's pages as a static HTML site")
+	fmt.Println("  archive [--format=tar|tar.gz|zip] [-o <file>] <rev> [<path>...]  Export the tree of a commit, by MGit hash")
+	fmt.Println("  archive --verify <file> <rev> [<path>...]  Check an archive is byte for byte the one of a commit")
+	fmt.Println("  credential fill|approve|reject  Query and update credential helpers")
+	fmt.Println("  signer          Show the signing backend and its public key")
+	fmt.Println("  fsmonitor start|stop|status  Watch the worktree to speed up status and add")
+	fmt.Println("  git -- <args>   Run a git command mgit lacks, then update .mgit to match")
+	fmt.Println("  cat-file -p <object>  Show a Git or MGit object")
+	fmt.Println("  interpret-trailers [--parse | --json] [<file>]  Add or extract commit message trailers")
+	fmt.Println("  ls-tree <tree-ish>    List the contents of a tree")
+	fmt.Println("Environment:")
+	fmt.Println("  MGIT_CONFIG         Repository config file (default .mgit/config)")
+	fmt.Println("  MGIT_GLOBAL_CONFIG  Global config file (default ~/.config/mgit/config)")
+	fmt.Println("  MGIT_TOKENS_PATH    Token store (default ~/.config/mgit/tokens.json)")
+	fmt.Println("  MGIT_NSEC           Secret key for the local signer")
 }
 
 /* 
@@ -90,8 +198,15 @@ func printUsage() {
 */
 func initRepo(args []string) {
 	path := "."
-	if len(args) > 0 {
-		path = args[0]
+	template := ""
+	templateSet := false
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "--template="); ok {
+			template = value
+			templateSet = true
+		} else {
+			path = arg
+		}
 	}
 
 	_, err := git.PlainInit(path, false)
@@ -101,6 +216,19 @@ func initRepo(args []string) {
 	}
 	fmt.Printf("Initialized empty Git repository in %s\n", path)
 	
+	// The template comes first, so its .gitignore gets the .mgit/ line too
+	if templateDir := initTemplateDir(template, templateSet); templateDir != "" {
+		copied, err := applyInitTemplate(templateDir, path)
+		if err != nil {
+			fmt.Printf("Warning: Failed to apply template %s: %s\n", templateDir, err)
+		} else {
+			fmt.Printf("Copied %d files from template %s\n", copied, templateDir)
+		}
+	}
+	if err := installSampleHooks(filepath.Join(path, ".mgit")); err != nil {
+		fmt.Printf("Warning: Failed to install sample hooks: %s\n", err)
+	}
+	
 	// Add .mgit to .gitignore
 	gitignorePath := filepath.Join(path, ".gitignore")
 	
@@ -135,7 +263,7 @@ func initRepo(args []string) {
 }
 
 func getRepo() *git.Repository {
-	repo, err := git.PlainOpen(".")
+	repo, err := openRepo()
 	if err != nil {
 		fmt.Printf("Error opening repository: %s\n", err)
 		os.Exit(1)
@@ -144,8 +272,13 @@ func getRepo() *git.Repository {
 }
 
 func addFiles(args []string) {
-	if len(args) < 1 {
-		fmt.Println("Usage: mgit add <files...>")
+	patch := false
+	if len(args) > 0 && (args[0] == "-p" || args[0] == "--patch") {
+		patch = true
+		args = args[1:]
+	}
+	if len(args) < 1 && !patch {
+		fmt.Println("Usage: mgit add [-p] <files...>")
 		os.Exit(1)
 	}
 
@@ -156,12 +289,58 @@ func addFiles(args []string) {
 		os.Exit(1)
 	}
 
+	paths := []string{}
 	for _, file := range args {
-		_, err := w.Add(file)
+		path, err := repoRelativePath(file)
 		if err != nil {
 			fmt.Printf("Error adding file %s: %s\n", file, err)
 			os.Exit(1)
 		}
+		paths = append(paths, path)
+	}
+
+	if patch {
+		pathspecs := []string{}
+		for _, path := range paths {
+			if path == "." {
+				// The whole repository
+				pathspecs = nil
+				break
+			}
+			pathspecs = append(pathspecs, path)
+		}
+		if err := addPatch(repo, pathspecs); err != nil {
+			fmt.Printf("Error adding changes: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// With the fsmonitor running, stage from its view of the worktree
+	// instead of letting go-git rescan everything for each path
+	if _, running := fsmonitorPid(); running {
+		if err := addWithFsmonitor(repo, w, paths); err != nil {
+			fmt.Printf("Error adding files: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Changes staged for commit")
+		return
+	}
+
+	for i, path := range paths {
+		// go-git can't stage a submodule, so record its commit ourselves
+		if isSubmodulePath(repoRoot(), path) {
+			if err := stagePaths(repo, repoRoot(), []string{path}); err != nil {
+				fmt.Printf("Error adding file %s: %s\n", args[i], err)
+				os.Exit(1)
+			}
+			continue
+		}
+		_, err = w.Add(path)
+		if err != nil {
+			fmt.Printf("Error adding file %s: %s\n", args[i], err)
+			os.Exit(1)
+		}
 	}
 	fmt.Println("Changes staged for commit")
 }
@@ -207,32 +386,158 @@ func commitChanges(args []string) {
 }
 
 func pushChanges(args []string) {
+	queue := false
+	flush := false
+	dryRun := false
+	verify := true
+	remotes := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--queue":
+			queue = true
+		case arg == "--flush":
+			flush = true
+		case arg == "--dry-run" || arg == "-n":
+			dryRun = true
+		case arg == "--no-verify":
+			verify = false
+		case !strings.HasPrefix(arg, "-"):
+			remotes = append(remotes, arg)
+		}
+	}
+
+	if queue && flush || dryRun && flush || len(remotes) > 1 || flush && len(remotes) > 0 {
+		fmt.Println("Usage: mgit push [--dry-run] [--queue | --flush] [<remote>]")
+		os.Exit(1)
+	}
+
 	repo := getRepo()
+	remoteName := defaultRemote(repo)
+	if len(remotes) == 1 {
+		remoteName = remotes[0]
+	}
+
+	// Check the push against the policy before it goes anywhere
+	var plan *pushPlan
+	if !flush {
+		var err error
+		plan, err = planPush(repo, remoteName, queue)
+		if err != nil {
+			fmt.Printf("Error planning push: %s\n", err)
+			os.Exit(1)
+		}
+		if dryRun {
+			printPushPlan(plan)
+			fmt.Println("\nDry run: nothing was pushed")
+			if len(plan.Violations) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+		if len(plan.Violations) > 0 {
+			fmt.Println("Error: push refused by policy:")
+			for _, violation := range plan.Violations {
+				fmt.Printf("  %s\n", violation)
+			}
+			os.Exit(1)
+		}
+		for _, warning := range plan.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		if verify {
+			if err := runPrePushHook(plan); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
 	
+	if queue {
+		entry, err := queuePush(repo, remoteName)
+		if err != nil {
+			fmt.Printf("Error queueing push: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Queued push of %s (%s) to %s; run 'mgit push --flush' when the server is reachable\n",
+			entry.Branch, entry.GitHash[:7], entry.Remote)
+		return
+	}
+
+	if flush {
+		if err := flushPushQueue(repo, verify); err != nil {
+			fmt.Printf("Error flushing push queue: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := runGitPush(repo, remoteName, "HEAD"); err != nil {
+			fmt.Printf("Error pushing changes: %s\n", err)
+			os.Exit(1)
+	}
+	fmt.Println("Changes pushed to remote")
+
+	if err := uploadMGitData(repo, remoteName); err != nil {
+			fmt.Printf("Warning: Failed to upload MGit metadata: %s\n", err)
+	}
+	if err := updateRemoteTrackingRefs(repo, NewMGitStorage(), remoteName); err != nil {
+			fmt.Printf("Warning: Failed to update MGit remote-tracking branches: %s\n", err)
+	}
+	if err := pushBranchSummaries(repo, remoteName, []string{plan.Branch}); err != nil {
+			fmt.Printf("Warning: Failed to upload branch summaries: %s\n", err)
+	}
+
+	mgitHead, _ := NewMGitStorage().GetMGitHashFromGit(plan.NewHash.String())
+	if err := notifyPush(plan, mgitHead); err != nil {
+			fmt.Printf("Warning: Failed to send push notifications: %s\n", err)
+	}
+}
+
+// runGitPull fast-forwards the current branch from a remote with git,
+// using the stored token
+func runGitPull(repo *git.Repository, remoteName string) error {
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+			return err
+	}
+	token := getTokenForRepo(remoteURL)
+	
+	gitArgs := append(gitTLSArgs(remoteName), "-c",
+			"http.extraHeader=Authorization: Bearer "+token,
+			"pull", "--ff-only", remoteName)
+	cmd := newGitCommand(gitArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runGitPush pushes a refspec to a remote using the stored token
+func runGitPush(repo *git.Repository, remoteName, refspec string) error {
 	// Get the remote URL
 	remoteURL := ""
-	remote, err := repo.Remote("origin")
+	remote, err := repo.Remote(remoteName)
 	if err == nil && len(remote.Config().URLs) > 0 {
 			remoteURL = remote.Config().URLs[0]
 	}
 
+	// Make sure of the server before handing it the token
+	if err := verifyServerIdentity(remoteName, remoteURL); err != nil {
+			return err
+	}
+
 	// Get token for the repository
 	token := getTokenForRepo(remoteURL)
 	
 	// Use git push with temporary header configuration
-	cmd := exec.Command("git", "-c", 
-			"http.extraHeader=Authorization: Bearer "+token, 
-			"push", "origin", "HEAD")
+	gitArgs := append(gitTLSArgs(remoteName), "-c",
+			"http.extraHeader=Authorization: Bearer "+token,
+			"push", remoteName, refspec)
+	cmd := newGitCommand(gitArgs...)
 	
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Dir = "."
 	
-	if err := cmd.Run(); err != nil {
-			fmt.Printf("Error pushing changes: %s\n", err)
-			os.Exit(1)
-	}
-	fmt.Println("Changes pushed to remote")
+	return cmd.Run()
 }
 
 func pullChanges(args []string) {
@@ -243,18 +548,73 @@ func pullChanges(args []string) {
 		os.Exit(1)
 	}
 
-	err = w.Pull(&git.PullOptions{
-		Progress: os.Stdout,
-	})
-	if err != nil {
-		if err == git.NoErrAlreadyUpToDate {
-			fmt.Println("Already up-to-date")
-			return
+	if len(args) > 1 || len(args) == 1 && strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: mgit pull [<remote>]")
+		os.Exit(1)
+	}
+	remoteName := defaultRemote(repo)
+	if len(args) > 0 {
+		remoteName = args[0]
+	}
+	if _, err := repo.Remote(remoteName); err != nil {
+		fmt.Printf("Error: no such remote '%s'\n", remoteName)
+		os.Exit(1)
+	}
+
+	if remoteURL, err := getRemoteURL(repo, remoteName); err == nil {
+		if err := verifyServerIdentity(remoteName, remoteURL); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
 		}
-		fmt.Printf("Error pulling changes: %s\n", err)
+	}
+	// After the identity check, so pull's connections are pinned to it
+	if err := installHTTPTransport(remoteName); err != nil {
+		fmt.Printf("Error configuring HTTP transport: %s\n", err)
 		os.Exit(1)
 	}
-	fmt.Println("Changes pulled from remote")
+
+	if len(gitShallowCommits(repo)) > 0 {
+		// go-git can't pull into a shallow repository
+		err = runGitPull(repo, remoteName)
+	} else {
+		err = w.Pull(&git.PullOptions{
+			RemoteName: remoteName,
+			Progress:   os.Stdout,
+		})
+	}
+	if err != nil {
+		if err != git.NoErrAlreadyUpToDate {
+			fmt.Printf("Error pulling changes: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Already up-to-date")
+	} else {
+		fmt.Println("Changes pulled from remote")
+	}
+
+	// Refresh MGit metadata; the ETag cache makes this cheap when nothing changed
+	if err := syncMGitMetadata(repo, remoteName); err != nil {
+		fmt.Printf("Warning: Failed to refresh MGit metadata: %s\n", err)
+	}
+
+	// Verify what was pulled; the verification cache skips known commits
+	if GetConfigBool("pull.verify", false) {
+		storage := NewMGitStorage()
+		lookup := newMappingLookup(repo, storage, false)
+		defer lookup.Close()
+		headCommit, err := storage.GetHeadCommit()
+		if err != nil && lookup != nil {
+			headCommit, err = lookup.HeadCommit()
+		}
+		if err != nil {
+			fmt.Printf("Error getting HEAD commit: %s\n", err)
+			os.Exit(1)
+		}
+		if !verifyMGitHistory(repo, storage, headCommit.MGitHash, true, lookup) {
+			fmt.Println("MGit commit chain verification failed!")
+			os.Exit(1)
+		}
+	}
 }
 
 func showStatus(args []string) {
@@ -265,15 +625,27 @@ func showStatus(args []string) {
 		os.Exit(1)
 	}
 
-	status, err := w.Status()
+	status, err := repoStatus(repo, w)
 	if err != nil {
 		fmt.Printf("Error getting status: %s\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Println("Current branch:", getCurrentBranch(repo))
+	if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+		if tracking := upstreamStatus(repo, head.Name().Short(), head.Hash()); tracking != "" {
+			fmt.Println(tracking)
+		}
+	}
 	fmt.Println()
 	
+	// Submodules are listed with the commits they moved between
+	stagedNotes, unstagedNotes, err := submoduleStatusNotes(repo, status)
+	if err != nil {
+		fmt.Printf("Error getting submodule status: %s\n", err)
+		os.Exit(1)
+	}
+
 	if status.IsClean() {
 		fmt.Println("Nothing to commit, working tree clean")
 		return
@@ -284,7 +656,7 @@ func showStatus(args []string) {
 		if fileStatus.Staging == git.Added {
 			fmt.Printf("  new file:   %s\n", file)
 		} else if fileStatus.Staging == git.Modified {
-			fmt.Printf("  modified:   %s\n", file)
+			fmt.Printf("  modified:   %s%s\n", file, stagedNotes[file])
 		} else if fileStatus.Staging == git.Deleted {
 			fmt.Printf("  deleted:    %s\n", file)
 		}
@@ -294,7 +666,7 @@ func showStatus(args []string) {
 	fmt.Println("Changes not staged for commit:")
 	for file, fileStatus := range status {
 		if fileStatus.Worktree == git.Modified {
-			fmt.Printf("  modified:   %s\n", file)
+			fmt.Printf("  modified:   %s%s\n", file, unstagedNotes[file])
 		} else if fileStatus.Worktree == git.Deleted {
 			fmt.Printf("  deleted:    %s\n", file)
 		}
@@ -320,11 +692,18 @@ func getCurrentBranch(repo *git.Repository) string {
 		return head.Name().Short()
 	}
 	
-	return head.Hash().String()[:7]
+	mgitHash, _ := NewMGitStorage().GetMGitHashFromGit(head.Hash().String())
+	return displayShortHash(mgitHash, head.Hash().String())
 }
 
 func handleBranch(args []string) {
 	repo := getRepo()
+	format, args := formatOption(args)
+	
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		handleBranchOption(args)
+		return
+	}
 	
 	if len(args) == 0 {
 		// List branches
@@ -335,6 +714,13 @@ func handleBranch(args []string) {
 		}
 		
 		currentBranch := getCurrentBranch(repo)
+		if format != "" {
+			if err := printBranchesFormatted(branches, currentBranch, format); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 		fmt.Println("Branches:")
 		
 		err = branches.ForEach(func(branch *plumbing.Reference) error {
@@ -354,24 +740,13 @@ func handleBranch(args []string) {
 		// Create a new branch
 		branchName := args[0]
 		
-		w, err := repo.Worktree()
-		if err != nil {
-			fmt.Printf("Error getting worktree: %s\n", err)
-			os.Exit(1)
-		}
-		
 		head, err := repo.Head()
 		if err != nil {
 			fmt.Printf("Error getting HEAD: %s\n", err)
 			os.Exit(1)
 		}
 		
-		err = w.Checkout(&git.CheckoutOptions{
-			Hash:   head.Hash(),
-			Branch: plumbing.NewBranchReferenceName(branchName),
-			Create: true,
-		})
-		if err != nil {
+		if err := createBranchAt(repo, branchName, head.Hash()); err != nil {
 			fmt.Printf("Error creating branch %s: %s\n", branchName, err)
 			os.Exit(1)
 		}
@@ -381,37 +756,51 @@ func handleBranch(args []string) {
 }
 
 func checkoutBranch(args []string) {
+	if len(args) > 0 && (args[0] == "-p" || args[0] == "--patch") {
+		checkoutPatch(args[1:])
+		return
+	}
+	reconcile := false
+	if len(args) > 0 && args[0] == "--reconcile" {
+		reconcile = true
+		args = args[1:]
+	}
+	repo := getRepo()
+	
+	// With only --reconcile, the current branch is reconciled in place
+	if reconcile && len(args) == 0 {
+		head, err := repo.Head()
+		if err != nil || !head.Name().IsBranch() {
+			fmt.Println("Error: not on a branch; name the branch to reconcile")
+			os.Exit(1)
+		}
+		if err := checkCheckedOutBranch(repo, head.Name().Short(), true); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(args) < 1 {
-		fmt.Println("Usage: mgit checkout <branch>")
+		fmt.Println("Usage: mgit checkout [--reconcile] <branch>")
 		os.Exit(1)
 	}
 	
-	repo := getRepo()
-	w, err := repo.Worktree()
+	branchName, err := switchToRevision(repo, args[0])
 	if err != nil {
-		fmt.Printf("Error getting worktree: %s\n", err)
+		fmt.Printf("Error checking out %s: %s\n", args[0], err)
 		os.Exit(1)
 	}
-	
-	branchName := args[0]
-	
-	err = w.Checkout(&git.CheckoutOptions{
-		Branch: plumbing.NewBranchReferenceName(branchName),
-	})
-	if err != nil {
-		// Maybe it's a commit hash?
-		hash := plumbing.NewHash(branchName)
-		err = w.Checkout(&git.CheckoutOptions{
-			Hash: hash,
-		})
-		if err != nil {
-			fmt.Printf("Error checking out %s: %s\n", branchName, err)
-			os.Exit(1)
-		}
-		fmt.Printf("Checked out commit %s\n", branchName)
+	if branchName == "" {
+		fmt.Printf("Checked out commit %s\n", args[0])
 	} else {
 		fmt.Printf("Switched to branch '%s'\n", branchName)
 	}
+	
+	// The MGit side follows, and must agree with the branch's Git tip
+	if err := checkCheckedOutBranch(repo, branchName, reconcile); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
 }
 
 func showLog(args []string) {
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// maintenanceTask is a job maintenance runs and how often it runs unless
+// maintenance.<name>.schedule says otherwise
+type maintenanceTask struct {
+	Name     string
+	Schedule string
+	Run      func(repo *git.Repository, storage *MGitStorage) error
+}
+
+// maintenanceTasks are run in this order
+var maintenanceTasks = []maintenanceTask{
+	{Name: "cache-refresh", Schedule: "hourly", Run: refreshCachesTask},
+	{Name: "gc", Schedule: "daily", Run: gcTask},
+	{Name: "mappings", Schedule: "daily", Run: compactMappingsTask},
+	{Name: "verify", Schedule: "weekly", Run: verifyTask},
+}
+
+// maintenanceSchedules are the schedules from most to least frequent. A
+// scheduled run does the tasks of its schedule and the more frequent ones,
+// so each task still runs when timers coincide and only one fires.
+var maintenanceSchedules = []string{"hourly", "daily", "weekly"}
+
+// maintenanceLockStale is how old a lock can get before it is taken to be
+// left over from a crashed run
+const maintenanceLockStale = 24 * time.Hour
+
+// HandleMaintenance handles the maintenance command
+//
+//	run [--task=<name>]... [--schedule=<frequency>] [--registered]
+//	start [--scheduler=auto|cron|systemd]
+//	stop [--scheduler=auto|cron|systemd]
+func HandleMaintenance(args []string) {
+	if len(args) == 0 {
+		printMaintenanceUsage()
+	}
+	switch args[0] {
+	case "run":
+		maintenanceRun(args[1:])
+	case "start":
+		maintenanceStart(args[1:])
+	case "stop":
+		maintenanceStop(args[1:])
+	default:
+		printMaintenanceUsage()
+	}
+}
+
+func printMaintenanceUsage() {
+	fmt.Println("Usage: mgit maintenance run [--task=<name>] [--schedule=hourly|daily|weekly]")
+	fmt.Println("       mgit maintenance start [--scheduler=auto|cron|systemd]")
+	fmt.Println("       mgit maintenance stop [--scheduler=auto|cron|systemd]")
+	os.Exit(1)
+}
+
+// maintenanceRun runs the maintenance tasks, all enabled ones by default
+func maintenanceRun(args []string) {
+	tasks := []string{}
+	schedule := ""
+	registered := false
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--task="):
+			tasks = append(tasks, strings.TrimPrefix(arg, "--task="))
+		case strings.HasPrefix(arg, "--schedule="):
+			schedule = strings.TrimPrefix(arg, "--schedule=")
+			if scheduleRank(schedule) < 0 {
+				fmt.Printf("Error: unknown schedule %q\n", schedule)
+				os.Exit(1)
+			}
+		case arg == "--registered":
+			registered = true
+		default:
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		}
+	}
+	for _, name := range tasks {
+		if findMaintenanceTask(name) == nil {
+			fmt.Printf("Error: unknown task %q\n", name)
+			os.Exit(1)
+		}
+	}
+
+	// The scheduler runs every registered repository, each in its own
+	// process so one broken repository doesn't stop the rest
+	if registered {
+		if !runRegisteredMaintenance(args) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	unlock, err := lockMaintenance(storage)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	failed := false
+	for _, task := range maintenanceTasks {
+		if !maintenanceTaskSelected(task, tasks, schedule) {
+			continue
+		}
+		fmt.Printf("Running %s...\n", task.Name)
+		if err := task.Run(repo, storage); err != nil {
+			fmt.Printf("Error: %s failed: %s\n", task.Name, err)
+			failed = true
+		}
+	}
+	if failed {
+		unlock()
+		os.Exit(1)
+	}
+}
+
+// runRegisteredMaintenance reruns maintenance in each registered
+// repository, with the given arguments less --registered
+func runRegisteredMaintenance(args []string) bool {
+	repos, err := readRepoList(maintenanceRepos)
+	if err != nil {
+		fmt.Printf("Error reading registered repositories: %s\n", err)
+		return false
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return false
+	}
+
+	runArgs := []string{}
+	for _, arg := range args {
+		if arg != "--registered" {
+			runArgs = append(runArgs, arg)
+		}
+	}
+	ok := true
+	for _, dir := range repos {
+		fmt.Printf("== %s\n", dir)
+		cmd := exec.Command(self, append([]string{"-C", dir, "maintenance", "run"}, runArgs...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// findMaintenanceTask looks a task up by name
+func findMaintenanceTask(name string) *maintenanceTask {
+	for i := range maintenanceTasks {
+		if maintenanceTasks[i].Name == name {
+			return &maintenanceTasks[i]
+		}
+	}
+	return nil
+}
+
+// maintenanceTaskSelected reports whether a run does a task: named tasks
+// always run; otherwise maintenance.<task>.enabled decides, and with a
+// schedule, the task's maintenance.<task>.schedule has to be due
+func maintenanceTaskSelected(task maintenanceTask, names []string, schedule string) bool {
+	if len(names) > 0 {
+		for _, name := range names {
+			if name == task.Name {
+				return true
+			}
+		}
+		return false
+	}
+	if !GetConfigBool("maintenance."+task.Name+".enabled", true) {
+		return false
+	}
+	if schedule == "" {
+		return true
+	}
+	taskRank := scheduleRank(GetConfigValue("maintenance."+task.Name+".schedule", task.Schedule))
+	return taskRank >= 0 && taskRank <= scheduleRank(schedule)
+}
+
+// scheduleRank orders schedules by frequency, or returns -1 for an
+// unknown one
+func scheduleRank(schedule string) int {
+	for i, s := range maintenanceSchedules {
+		if s == schedule {
+			return i
+		}
+	}
+	return -1
+}
+
+// lockMaintenance keeps two maintenance runs from working on a repository
+// at once, since a slow run can still be going when the next timer fires.
+// It returns the function that releases the lock.
+func lockMaintenance(storage *MGitStorage) (func(), error) {
+	path := filepath.Join(storage.RootDir, "maintenance.lock")
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > maintenanceLockStale {
+		os.Remove(path)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("another maintenance run holds %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	file.Close()
+
+	released := false
+	return func() {
+		if !released {
+			released = true
+			os.Remove(path)
+		}
+	}, nil
+}
+
+// refreshCachesTask refetches the push policy of every remote, so pushes
+// queued while offline are checked against a recent copy
+func refreshCachesTask(repo *git.Repository, storage *MGitStorage) error {
+	remotes, err := repo.Remotes()
+	if err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		cfg := remote.Config()
+		if len(cfg.URLs) == 0 {
+			continue
+		}
+		if _, _, err := loadServerPolicy(cfg.Name, cfg.URLs[0], false); err != nil {
+			return fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// gcTask runs mgit gc with the configured gc.pruneExpire: it expires old
+// reflog entries, removes temporary files left in .mgit by interrupted
+// writes, packs the reachable MGit objects and prunes unreachable ones
+func gcTask(repo *git.Repository, storage *MGitStorage) error {
+	expire, err := parseExpiry(GetConfigValue("gc.pruneExpire", "2.weeks.ago"), time.Now())
+	if err != nil {
+		return fmt.Errorf("gc.pruneExpire: %w", err)
+	}
+	stats, err := collectGarbage(repo, storage, expire, false)
+	if err != nil {
+		return err
+	}
+	printGCStats(stats, false)
+	return nil
+}
+
+// compactMappingsTask rewrites the mapping file without duplicates
+func compactMappingsTask(repo *git.Repository, storage *MGitStorage) error {
+	before, after, err := storage.Mappings().Compact()
+	if err != nil {
+		return err
+	}
+	if before != after {
+		fmt.Printf("Compacted mappings from %d to %d entries\n", before, after)
+	}
+	return nil
+}
+
+// verifyTask verifies the history of HEAD, which also keeps the
+// verification cache warm for interactive runs
+func verifyTask(repo *git.Repository, storage *MGitStorage) error {
+	head, err := storage.GetHeadCommit()
+	if err != nil {
+		// Nothing committed yet
+		return nil
+	}
+	if !verifyMGitHistory(repo, storage, head.MGitHash, true, nil) {
+		return fmt.Errorf("MGit commit chain verification failed")
+	}
+	return nil
+}
+
+// maintenanceRepos lists the repositories the scheduled runs maintain
+const maintenanceRepos = "maintenance-repos"
+
+// maintenanceStart registers the current repository and installs the
+// timers that run maintenance on all registered repositories
+func maintenanceStart(args []string) {
+	scheduler := parseScheduler(args)
+	root, err := filepath.Abs(repoRoot())
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	repos, err := readRepoList(maintenanceRepos)
+	if err != nil {
+		fmt.Printf("Error reading registered repositories: %s\n", err)
+		os.Exit(1)
+	}
+	registered := false
+	for _, repo := range repos {
+		registered = registered || repo == root
+	}
+	if !registered {
+		if err := saveRepoList(maintenanceRepos, append(repos, root)); err != nil {
+			fmt.Printf("Error registering repository: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	// One random minute per machine spreads the load of many nodes on a
+	// server, and keeps the hourly, daily and weekly runs apart
+	minute := rand.Intn(60)
+	switch scheduler {
+	case "systemd":
+		err = installSystemdTimers(self, minute)
+	default:
+		err = installCrontab(self, minute)
+	}
+	if err != nil {
+		fmt.Printf("Error installing %s schedule: %s\n", scheduler, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Scheduled maintenance of %s with %s\n", root, scheduler)
+}
+
+// maintenanceStop unregisters the current repository and removes the
+// timers once no registered repository is left
+func maintenanceStop(args []string) {
+	scheduler := parseScheduler(args)
+	root, err := filepath.Abs(repoRoot())
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	repos, err := readRepoList(maintenanceRepos)
+	if err != nil {
+		fmt.Printf("Error reading registered repositories: %s\n", err)
+		os.Exit(1)
+	}
+	kept := []string{}
+	for _, repo := range repos {
+		if repo != root {
+			kept = append(kept, repo)
+		}
+	}
+	if err := saveRepoList(maintenanceRepos, kept); err != nil {
+		fmt.Printf("Error unregistering repository: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Stopped maintenance of %s\n", root)
+	if len(kept) > 0 {
+		return
+	}
+
+	switch scheduler {
+	case "systemd":
+		err = removeSystemdTimers()
+	default:
+		err = removeCrontab()
+	}
+	if err != nil {
+		fmt.Printf("Error removing %s schedule: %s\n", scheduler, err)
+		os.Exit(1)
+	}
+}
+
+// parseScheduler reads --scheduler, picking systemd user timers where
+// systemd runs the user's session and cron otherwise
+func parseScheduler(args []string) string {
+	scheduler := "auto"
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--scheduler="):
+			scheduler = strings.TrimPrefix(arg, "--scheduler=")
+		default:
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		}
+	}
+	switch scheduler {
+	case "cron", "systemd":
+		return scheduler
+	case "auto":
+		if exec.Command("systemctl", "--user", "show-environment").Run() == nil {
+			return "systemd"
+		}
+		return "cron"
+	}
+	fmt.Printf("Error: unknown scheduler %q\n", scheduler)
+	os.Exit(1)
+	return ""
+}
+
+// crontabBegin and crontabEnd delimit mgit's lines in the crontab
+const (
+	crontabBegin = "# BEGIN mgit maintenance"
+	crontabEnd   = "# END mgit maintenance"
+)
+
+// installCrontab replaces mgit's block in the user's crontab. Like git, the
+// hourly run skips midnight, when the daily run does its tasks too, and
+// the daily run skips Sunday, when the weekly run does.
+func installCrontab(self string, minute int) error {
+	current, err := readCrontab()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString(stripCrontabBlock(current))
+	b.WriteString(crontabBegin + "\n")
+	command := fmt.Sprintf("nice -n 19 %q maintenance run --registered", self)
+	fmt.Fprintf(&b, "%d 1-23 * * * %s --schedule=hourly\n", minute, command)
+	fmt.Fprintf(&b, "%d 0 * * 1-6 %s --schedule=daily\n", minute, command)
+	fmt.Fprintf(&b, "%d 0 * * 0 %s --schedule=weekly\n", minute, command)
+	b.WriteString(crontabEnd + "\n")
+	return writeCrontab(b.String())
+}
+
+// removeCrontab removes mgit's block from the user's crontab
+func removeCrontab() error {
+	current, err := readCrontab()
+	if err != nil {
+		return err
+	}
+	return writeCrontab(stripCrontabBlock(current))
+}
+
+// readCrontab returns the user's crontab, empty if they have none
+func readCrontab() (string, error) {
+	out, err := exec.Command("crontab", "-l").Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// crontab -l fails when there is no crontab yet
+			return "", nil
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// writeCrontab installs a crontab
+func writeCrontab(content string) error {
+	cmd := exec.Command("crontab", "-")
+	cmd.Stdin = strings.NewReader(content)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("crontab: %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// stripCrontabBlock returns a crontab without mgit's block
+func stripCrontabBlock(content string) string {
+	var b strings.Builder
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == crontabBegin:
+			inBlock = true
+		case line == crontabEnd:
+			inBlock = false
+		case !inBlock:
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// systemdUnitDir is where user units go
+func systemdUnitDir() (string, error) {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" || !filepath.IsAbs(base) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, "systemd", "user"), nil
+}
+
+// systemdService runs maintenance for the schedule the timer instance
+// names, at the lowest CPU and IO priority so it never competes with the
+// node's other apps
+const systemdService = `[Unit]
+Description=MGit repository maintenance (%%i)
+
+[Service]
+Type=oneshot
+ExecStart="%s" maintenance run --registered --schedule=%%i
+Nice=19
+IOSchedulingClass=idle
+`
+
+// systemdTimer fires one schedule; Persistent catches up on runs missed
+// while the node was off
+const systemdTimer = `[Unit]
+Description=MGit repository maintenance (%[1]s)
+
+[Timer]
+OnCalendar=%[2]s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+
+// systemdCalendars are the timers' OnCalendar expressions, split the same
+// way as the crontab lines
+func systemdCalendars(minute int) map[string]string {
+	return map[string]string{
+		"hourly": fmt.Sprintf("*-*-* 1..23:%02d:00", minute),
+		"daily":  fmt.Sprintf("Mon..Sat *-*-* 0:%02d:00", minute),
+		"weekly": fmt.Sprintf("Sun *-*-* 0:%02d:00", minute),
+	}
+}
+
+// installSystemdTimers writes the maintenance service and timers and
+// enables the timers
+func installSystemdTimers(self string, minute int) error {
+	dir, err := systemdUnitDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	service := fmt.Sprintf(systemdService, self)
+	if err := os.WriteFile(filepath.Join(dir, "mgit-maintenance@.service"), []byte(service), 0644); err != nil {
+		return err
+	}
+	calendars := systemdCalendars(minute)
+	timers := []string{}
+	for _, schedule := range maintenanceSchedules {
+		timer := fmt.Sprintf(systemdTimer, schedule, calendars[schedule])
+		name := "mgit-maintenance@" + schedule + ".timer"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(timer), 0644); err != nil {
+			return err
+		}
+		timers = append(timers, name)
+	}
+
+	if err := runSystemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return runSystemctl(append([]string{"enable", "--now"}, timers...)...)
+}
+
+// removeSystemdTimers disables the timers and removes the units
+func removeSystemdTimers() error {
+	dir, err := systemdUnitDir()
+	if err != nil {
+		return err
+	}
+	timers := []string{}
+	for _, schedule := range maintenanceSchedules {
+		timers = append(timers, "mgit-maintenance@"+schedule+".timer")
+	}
+	if err := runSystemctl(append([]string{"disable", "--now"}, timers...)...); err != nil {
+		return err
+	}
+	for _, name := range append(timers, "mgit-maintenance@.service") {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return runSystemctl("daemon-reload")
+}
+
+// runSystemctl runs systemctl on the user's manager
+func runSystemctl(args ...string) error {
+	cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
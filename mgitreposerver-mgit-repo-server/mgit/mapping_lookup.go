@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Local metadata can be partial, e.g. when mappings were pushed from
+// another clone after the last fetch. With verify.lookupMappings, or
+// mgit verify --lookup-mappings, a commit whose mapping is missing is
+// looked up on the server by its Git hash:
+//
+//	GET /api/mgit/repos/<repo>/mappings/<git hash>
+//
+// The remote asked is verify.lookupRemote, or the current branch's
+// remote. An answer is only remembered for the run until its MGit commit
+// object is built and checked: the MGit hash must be reproduced from the
+// Git commit, parents and pubkey. Only then are the mapping and object
+// stored, so the next verify doesn't ask again, and a server can't plant
+// a mapping the local metadata would trust later.
+
+// mappingLookup looks up the mappings missing from a repository's
+// metadata on its server
+type mappingLookup struct {
+	repo    *git.Repository
+	storage *MGitStorage
+	remote  string
+
+	url       string
+	token     string
+	client    *http.Client
+	connected bool
+
+	// local looks up the mappings already known, opened when first needed
+	local *sortedMappingFile
+
+	// asked remembers the hashes asked for in this run, found or not
+	asked map[string]*NostrCommitMapping
+}
+
+// newMappingLookup returns the lookup for a repository, or nil if
+// lookups are off. enabled overrides verify.lookupMappings.
+func newMappingLookup(repo *git.Repository, storage *MGitStorage, enabled bool) *mappingLookup {
+	if !enabled && !GetConfigBool("verify.lookupMappings", false) {
+		return nil
+	}
+	remote := GetConfigValue("verify.lookupRemote", "")
+	if remote == "" {
+		remote = defaultRemote(repo)
+	}
+	return &mappingLookup{
+		repo:    repo,
+		storage: storage,
+		remote:  remote,
+		asked:   map[string]*NostrCommitMapping{},
+	}
+}
+
+// Close closes the local mappings, if they were opened
+func (l *mappingLookup) Close() error {
+	if l == nil || l.local == nil {
+		return nil
+	}
+	return l.local.Close()
+}
+
+// connect finds the remote and checks its server's identity, the first
+// time something is looked up
+func (l *mappingLookup) connect() error {
+	if l.connected {
+		return nil
+	}
+	url, err := getRemoteURL(l.repo, l.remote)
+	if err != nil {
+		return err
+	}
+	token, ok := credentialFill(url)
+	if !ok {
+		token, ok = lookupStoredToken(url)
+	}
+	if !ok {
+		return errNoToken
+	}
+	if err := verifyServerIdentity(l.remote, url); err != nil {
+		return err
+	}
+	client, err := newHTTPClient(l.remote)
+	if err != nil {
+		return err
+	}
+	l.url, l.token, l.client = url, token, client
+	l.connected = true
+	return nil
+}
+
+// Commit returns the MGit commit of a Git commit, looking up its mapping
+// if it isn't known locally and building its object if it's missing
+func (l *mappingLookup) Commit(gitHash string) (*MCommitStruct, error) {
+	mapping, err := l.mapping(gitHash)
+	if err != nil {
+		return nil, err
+	}
+	if mapping == nil {
+		return nil, fmt.Errorf("the server has no mapping for commit %s", shortHash(gitHash))
+	}
+	if commit, err := l.storage.GetCommit(mapping.MGitHash); err == nil {
+		return commit, nil
+	}
+
+	// The object's parents are the MGit hashes of the Git parents, which
+	// may need looking up too
+	gitCommit, err := l.repo.CommitObject(plumbing.NewHash(gitHash))
+	if err != nil {
+		return nil, err
+	}
+	mgitHashByGit := map[string]string{}
+	for _, parent := range gitCommit.ParentHashes {
+		parentMapping, err := l.mapping(parent.String())
+		if err != nil {
+			return nil, err
+		}
+		if parentMapping != nil {
+			mgitHashByGit[parent.String()] = parentMapping.MGitHash
+		}
+	}
+
+	commit := buildMGitCommit(l.repo, l.storage, *mapping, func(gitHash string) (string, bool) {
+		mgitHash, ok := mgitHashByGit[gitHash]
+		return mgitHash, ok
+	})
+	if commit == nil {
+		return nil, fmt.Errorf("cannot build MGit commit %s", shortHash(mapping.MGitHash))
+	}
+
+	// Nothing is stored until the mapping proves to be the Git commit's
+	if expected := computeMGitHash(gitCommit, commit.ParentHashes, mapping.Pubkey); expected.String() != mapping.MGitHash {
+		return nil, fmt.Errorf("mapping %s -> %s doesn't match the Git commit (expected %s)",
+			shortHash(gitHash), shortHash(mapping.MGitHash), shortHash(expected.String()))
+	}
+	if _, err := verifyMGitSignature(commit); err != nil {
+		return nil, fmt.Errorf("MGit commit %s: %w", shortHash(mapping.MGitHash), err)
+	}
+	if _, ok := l.asked[gitHash]; ok {
+		if err := l.storage.Mappings().Upsert(*mapping); err != nil {
+			return nil, fmt.Errorf("error caching mapping: %w", err)
+		}
+	}
+	if err := l.storage.StoreCommit(commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+// ParentCommit returns the parent of child with the given MGit hash,
+// found through child's Git parents
+func (l *mappingLookup) ParentCommit(child *MCommitStruct, mgitHash string) (*MCommitStruct, error) {
+	gitCommit, err := l.repo.CommitObject(plumbing.NewHash(child.GitHash))
+	if err != nil {
+		return nil, err
+	}
+	var lookupErr error
+	for _, parent := range gitCommit.ParentHashes {
+		commit, err := l.Commit(parent.String())
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		if commit.MGitHash == mgitHash {
+			return commit, nil
+		}
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return nil, fmt.Errorf("no parent of %s has MGit hash %s", shortHash(child.MGitHash), shortHash(mgitHash))
+}
+
+// HeadCommit returns the MGit commit of HEAD, looking it up if need be
+func (l *mappingLookup) HeadCommit() (*MCommitStruct, error) {
+	head, err := l.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	return l.Commit(head.Hash().String())
+}
+
+// mapping returns the mapping of a Git commit, from the local mappings or
+// the server. It is nil if neither has one. Answers from the server are
+// kept in asked, not stored.
+func (l *mappingLookup) mapping(gitHash string) (*NostrCommitMapping, error) {
+	if mapping, ok := l.asked[gitHash]; ok {
+		return mapping, nil
+	}
+	if l.local == nil {
+		local, err := l.storage.Mappings().OpenSorted()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read hash mappings: %w", err)
+		}
+		l.local = local
+	}
+	if l.local != nil {
+		if mapping, ok := l.local.Mapping(gitHash); ok {
+			return mapping, nil
+		}
+	}
+
+	mapping, err := l.fetch(gitHash)
+	if err != nil {
+		return nil, err
+	}
+	l.asked[gitHash] = mapping
+	if mapping == nil {
+		return nil, nil
+	}
+	fmt.Printf("Looked up mapping %s -> %s on %s\n", shortHash(gitHash), shortHash(mapping.MGitHash), l.remote)
+	return mapping, nil
+}
+
+// fetch asks the server for the mapping of a Git commit. It returns nil
+// if the server has none.
+func (l *mappingLookup) fetch(gitHash string) (*NostrCommitMapping, error) {
+	if err := l.connect(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", repoAPIURL(l.url, "mappings/"+gitHash), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", l.token))
+	setAcceptEncoding(req)
+
+	span := startSpan("mappings.lookup", "git_hash", gitHash)
+	resp, err := l.client.Do(req)
+	span.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response from server: %s", string(data))
+	}
+
+	var mapping NostrCommitMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("error parsing mapping: %w", err)
+	}
+	if mapping.GitHash != gitHash || len(mapping.MGitHash) != 40 {
+		return nil, fmt.Errorf("the server answered with a mapping for a different commit")
+	}
+	return &mapping, nil
+}
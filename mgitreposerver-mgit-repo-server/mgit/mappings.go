@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// legacyMappingsFile is the pre-unification mapping file that duplicated
+// hash_mappings.json. It is migrated into the mapping store on first use.
+const legacyMappingsFile = "nostr_mappings.json"
+
+// mappingTailLimit is how many appended mappings a reader holds in memory
+// before it folds them into the sorted part of the file
+const mappingTailLimit = 4096
+
+// mappingChunkSize is how many mappings a mapping file writer sorts in
+// memory before spilling them to a run file
+const mappingChunkSize = 16384
+
+// MappingStore is the single authoritative store of Git <-> MGit hash
+// mappings, kept in <mgit dir>/mappings/hash_mappings.json. The file is a
+// JSON array sorted by Git hash, one mapping per Git hash, followed by the
+// mappings Upsert has appended since it was last rewritten. A later
+// mapping of a Git hash replaces an earlier one; readers see the two parts
+// merged, and any rewrite of the file folds the appended ones in.
+type MappingStore struct {
+	RootDir string // The .mgit directory
+}
+
+// NewMappingStore creates a mapping store for an .mgit directory
+func NewMappingStore(rootDir string) *MappingStore {
+	return &MappingStore{RootDir: rootDir}
+}
+
+// Path returns the path to the mapping file
+func (m *MappingStore) Path() string {
+	return filepath.Join(m.RootDir, "mappings", "hash_mappings.json")
+}
+
+// migrate folds a legacy nostr_mappings.json into the store once. Entries
+// already in the store win; the legacy file is kept as a .migrated backup.
+func (m *MappingStore) migrate() error {
+	legacyPath := filepath.Join(m.RootDir, legacyMappingsFile)
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.Path()), 0755); err != nil {
+		return fmt.Errorf("failed to create mapping directory: %w", err)
+	}
+
+	writer, err := newMappingFileWriter(m.Path()+".tmp", true)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort()
+
+	if err := streamMappingsFile(legacyPath, writer.Add); err != nil {
+		return fmt.Errorf("error reading %s: %w", legacyMappingsFile, err)
+	}
+	existing := 0
+	err = streamMappingsFile(m.Path(), func(mapping NostrCommitMapping) error {
+		existing++
+		return writer.Add(mapping)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writer.Commit(m.Path()); err != nil {
+		return err
+	}
+	migrated := writer.count - existing
+	if err := os.Rename(legacyPath, legacyPath+".migrated"); err != nil {
+		return fmt.Errorf("error retiring %s: %w", legacyMappingsFile, err)
+	}
+
+	if migrated > 0 {
+		fmt.Printf("Migrated %d mapping(s) from %s into the mapping store\n", migrated, legacyMappingsFile)
+	}
+	return nil
+}
+
+// ForEach calls fn for each mapping without loading the whole mapping file
+// into memory. fn can return errStopMappings to stop early.
+func (m *MappingStore) ForEach(fn func(NostrCommitMapping) error) error {
+	if err := m.migrate(); err != nil {
+		return err
+	}
+	span := startSpan("mappings.scan")
+	err := m.scan(fn)
+	span.End(err)
+	return err
+}
+
+// Find returns the first mapping satisfying match, or nil if there is none
+func (m *MappingStore) Find(match func(NostrCommitMapping) bool) (*NostrCommitMapping, error) {
+	if err := m.migrate(); err != nil {
+		return nil, err
+	}
+	span := startSpan("mappings.find")
+	var mapping *NostrCommitMapping
+	err := m.scan(func(candidate NostrCommitMapping) error {
+		if match(candidate) {
+			mapping = &candidate
+			return errStopMappings
+		}
+		return nil
+	})
+	span.Set("found", mapping != nil)
+	span.End(err)
+	return mapping, err
+}
+
+// Upsert replaces the mapping for the same Git hash, or adds it, by
+// appending it to the file
+func (m *MappingStore) Upsert(mapping NostrCommitMapping) error {
+	if err := m.migrate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.Path()), 0755); err != nil {
+		return fmt.Errorf("failed to create mapping directory: %w", err)
+	}
+	span := startSpan("mappings.upsert", "git_hash", mapping.GitHash, "mgit_hash", mapping.MGitHash)
+	err := appendMappingFile(m.Path(), mapping)
+	span.End(err)
+	return err
+}
+
+// Supersede marks the mappings of rewritten commits with the MGit hashes
+// that replaced them, given as old MGit hash -> new MGit hash, in one
+// rewrite of the mapping file
+func (m *MappingStore) Supersede(rewritten map[string]string) error {
+	if len(rewritten) == 0 {
+		return nil
+	}
+	if err := m.migrate(); err != nil {
+		return err
+	}
+	path := m.Path()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	writer, err := newMappingFileWriter(path+".tmp", true)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort()
+
+	span := startSpan("mappings.supersede", "commits", len(rewritten))
+	err = streamMappingsFile(path, func(mapping NostrCommitMapping) error {
+		if replacement, ok := rewritten[mapping.MGitHash]; ok {
+			mapping.SupersededBy = replacement
+		}
+		return writer.Add(mapping)
+	})
+	if err == nil {
+		err = writer.Commit(path)
+	}
+	span.End(err)
+	return err
+}
+
+// Compact rewrites the mapping file without duplicate or empty entries,
+// returning how many entries there were and how many are left
+func (m *MappingStore) Compact() (int, int, error) {
+	return m.CompactWithout(nil)
+}
+
+// CompactWithout compacts the mapping file and drops the mappings of the
+// given MGit hashes, except those recording what superseded a commit
+func (m *MappingStore) CompactWithout(pruned map[string]bool) (int, int, error) {
+	if err := m.migrate(); err != nil {
+		return 0, 0, err
+	}
+	path := m.Path()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+
+	writer, err := newMappingFileWriter(path+".tmp", true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer writer.Abort()
+
+	before := 0
+	err = streamMappingsFile(path, func(mapping NostrCommitMapping) error {
+		before++
+		if mapping.GitHash == "" || mapping.MGitHash == "" {
+			return nil
+		}
+		if pruned[mapping.MGitHash] && mapping.SupersededBy == "" {
+			return nil
+		}
+		return writer.Add(mapping)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := writer.Commit(path); err != nil {
+		return 0, 0, err
+	}
+	return before, writer.count, nil
+}
+
+// errLongMappingTail is returned when more mappings have been appended to
+// the mapping file than a reader will hold
+var errLongMappingTail = errors.New("too many appended mappings")
+
+// scan passes fn the mappings of the store, one per Git hash, in Git hash
+// order. A long run of appended mappings is folded into the file first.
+func (m *MappingStore) scan(fn func(NostrCommitMapping) error) error {
+	path := m.Path()
+	sorted, tail, err := readMappingTail(path, mappingTailLimit)
+	if err == errLongMappingTail {
+		if _, _, err = m.CompactWithout(nil); err == nil {
+			sorted, tail, err = readMappingTail(path, mappingTailLimit)
+		}
+		if err != nil {
+			// A store that can't be rewritten is read as it is
+			sorted, tail, err = readMappingTail(path, 0)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return mergeMappingTail(path, sorted, tail, fn)
+}
+
+// errStopMappings can be returned from a mapping callback to end the
+// iteration early without reporting an error
+var errStopMappings = errors.New("stop iterating mappings")
+
+// decodeMappingElements decodes the remaining elements of a JSON array of
+// mappings whose opening bracket has already been consumed
+func decodeMappingElements(decoder *json.Decoder, fn func(NostrCommitMapping) error) error {
+	for decoder.More() {
+		var mapping NostrCommitMapping
+		if err := decoder.Decode(&mapping); err != nil {
+			return fmt.Errorf("error parsing mapping: %w", err)
+		}
+		if err := fn(mapping); err != nil {
+			return err
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("error parsing mappings: %w", err)
+	}
+	return nil
+}
+
+// streamMappingsFile passes each mapping stored in a mapping file to fn,
+// decoding one entry at a time so huge files never have to fit in memory.
+// A missing file has no mappings.
+func streamMappingsFile(path string, fn func(NostrCommitMapping) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("error parsing %s: expected a JSON array", path)
+	}
+
+	err = decodeMappingElements(decoder, fn)
+	if err == errStopMappings {
+		return nil
+	}
+	return err
+}
+
+// readMappingTail reads how many mappings the sorted part of a mapping
+// file has, where Git hashes only go up, and the mappings appended after
+// it, sorted by Git hash with the last of each Git hash kept. More than
+// limit appended mappings is errLongMappingTail; a zero limit is none.
+func readMappingTail(path string, limit int) (int, []NostrCommitMapping, error) {
+	sorted := 0
+	tail := []NostrCommitMapping{}
+	previous := ""
+	err := streamMappingsFile(path, func(mapping NostrCommitMapping) error {
+		if len(tail) == 0 && (sorted == 0 || mapping.GitHash > previous) {
+			sorted++
+			previous = mapping.GitHash
+			return nil
+		}
+		if limit > 0 && len(tail) == limit {
+			return errLongMappingTail
+		}
+		tail = append(tail, mapping)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return sorted, sortMappings(tail, true), nil
+}
+
+// mergeMappingTail passes fn the sorted part of a mapping file merged with
+// its sorted tail, a tail mapping replacing one of the same Git hash
+func mergeMappingTail(path string, sorted int, tail []NostrCommitMapping, fn func(NostrCommitMapping) error) error {
+	stopped := false
+	emit := func(mapping NostrCommitMapping) error {
+		err := fn(mapping)
+		stopped = err == errStopMappings
+		return err
+	}
+
+	errSortedDone := errors.New("end of the sorted mappings")
+	read := 0
+	err := streamMappingsFile(path, func(mapping NostrCommitMapping) error {
+		if read == sorted {
+			return errSortedDone
+		}
+		read++
+		for len(tail) > 0 && tail[0].GitHash <= mapping.GitHash {
+			replaced := tail[0].GitHash == mapping.GitHash
+			if err := emit(tail[0]); err != nil {
+				return err
+			}
+			tail = tail[1:]
+			if replaced {
+				return nil
+			}
+		}
+		return emit(mapping)
+	})
+	if err != nil && err != errSortedDone || stopped {
+		return err
+	}
+	for _, mapping := range tail {
+		if err := emit(mapping); err != nil {
+			if stopped {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedMappingFile looks up the MGit hashes of Git hashes in a sorted
+// mapping file by binary search, reading a few hundred bytes per step, so
+// none of the file is held in memory. It is safe for concurrent use.
+type sortedMappingFile struct {
+	file *os.File
+	size int64
+}
+
+// mappingField starts the value of a field in the layout mapping file
+// writers use
+func mappingField(name string) []byte {
+	return []byte(fmt.Sprintf("%q: \"", name))
+}
+
+// OpenSorted opens the mapping file for lookups by Git hash, first folding
+// in any appended mappings so all of it is sorted. It must be closed.
+func (m *MappingStore) OpenSorted() (*sortedMappingFile, error) {
+	if err := m.migrate(); err != nil {
+		return nil, err
+	}
+	_, tail, err := readMappingTail(m.Path(), 1)
+	if err == errLongMappingTail || err == nil && len(tail) > 0 {
+		_, _, err = m.CompactWithout(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(m.Path())
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &sortedMappingFile{file: file, size: info.Size()}, nil
+}
+
+// Close closes the mapping file
+func (f *sortedMappingFile) Close() error {
+	return f.file.Close()
+}
+
+// field finds the first value of a field at or after offset, returning it
+// and where it is. ok is false past the last one.
+func (f *sortedMappingFile) field(name []byte, offset int64) (value string, at int64, ok bool) {
+	buf := make([]byte, 512)
+	for offset < f.size {
+		// Mappings appended since the file was opened aren't sorted
+		if rest := f.size - offset; rest < int64(len(buf)) {
+			buf = buf[:rest]
+		}
+		n, err := f.file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", 0, false
+		}
+		chunk := buf[:n]
+		if i := bytes.Index(chunk, name); i >= 0 {
+			if j := bytes.IndexByte(chunk[i+len(name):], '"'); j >= 0 {
+				return string(chunk[i+len(name) : i+len(name)+j]), offset + int64(i), true
+			}
+		}
+		if offset+int64(n) >= f.size {
+			break
+		}
+		// Step back far enough not to miss a value across chunks
+		offset += int64(n - len(name) - 128)
+	}
+	return "", 0, false
+}
+
+// MGitHash returns the MGit hash mapped from a Git hash
+func (f *sortedMappingFile) MGitHash(gitHash string) (string, bool) {
+	at, ok := f.search(gitHash)
+	if !ok {
+		return "", false
+	}
+	mgitHash, _, ok := f.field(mappingField("mgit_hash"), at)
+	return mgitHash, ok
+}
+
+// Mapping returns the mapping of a Git hash, with its MGit hash and pubkey
+func (f *sortedMappingFile) Mapping(gitHash string) (*NostrCommitMapping, bool) {
+	at, ok := f.search(gitHash)
+	if !ok {
+		return nil, false
+	}
+	mgitHash, _, ok := f.field(mappingField("mgit_hash"), at)
+	if !ok {
+		return nil, false
+	}
+	pubkey, _, ok := f.field(mappingField("pubkey"), at)
+	if !ok {
+		return nil, false
+	}
+	return &NostrCommitMapping{GitHash: gitHash, MGitHash: mgitHash, Pubkey: pubkey}, true
+}
+
+// search finds where the mapping of a Git hash starts
+func (f *sortedMappingFile) search(gitHash string) (int64, bool) {
+	gitField := mappingField("git_hash")
+
+	// The first offset whose next mapping's Git hash isn't below gitHash
+	low, high := int64(0), f.size
+	for low < high {
+		mid := low + (high-low)/2
+		hash, at, ok := f.field(gitField, mid)
+		if !ok || hash >= gitHash {
+			high = mid
+		} else {
+			low = at + 1
+		}
+	}
+	hash, at, ok := f.field(gitField, low)
+	if !ok || hash != gitHash {
+		return 0, false
+	}
+	return at, true
+}
+
+// appendMappingFile adds a mapping at the end of a mapping file, in place
+// of the closing bracket, without rewriting what comes before
+func appendMappingFile(path string, mapping NostrCommitMapping) error {
+	data, err := json.MarshalIndent(mapping, "  ", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing mapping: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	end, empty, err := mappingArrayEnd(file)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	entry := []byte(",\n  ")
+	switch {
+	case end == 0:
+		entry = []byte("[\n  ")
+	case empty:
+		entry = []byte("\n  ")
+	}
+	entry = append(append(entry, data...), "\n]"...)
+	if _, err := file.WriteAt(entry, end); err != nil {
+		return err
+	}
+	if err := file.Truncate(end + int64(len(entry))); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// mappingArrayEnd finds where a mapping file's last entry ends, or its
+// opening bracket if it has none, which empty reports. An empty file ends
+// at 0.
+func mappingArrayEnd(file *os.File) (int64, bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := info.Size()
+	start := size - 4096
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, size-start)
+	if _, err := file.ReadAt(buf, start); err != nil && err != io.EOF {
+		return 0, false, err
+	}
+
+	isSpace := func(c byte) bool { return c == ' ' || c == '\n' || c == '\r' || c == '\t' }
+	i := len(buf) - 1
+	for i >= 0 && isSpace(buf[i]) {
+		i--
+	}
+	if i < 0 && start == 0 {
+		return 0, true, nil
+	}
+	if i < 0 || buf[i] != ']' {
+		return 0, false, errors.New("expected a JSON array")
+	}
+	for i--; i >= 0 && isSpace(buf[i]); i-- {
+	}
+	if i < 0 {
+		return 0, false, errors.New("expected a JSON array")
+	}
+	return start + int64(i) + 1, buf[i] == '[', nil
+}
+
+// sortMappings sorts mappings by Git hash, keeping one per Git hash: the
+// last of them with keepLast, or else the first
+func sortMappings(mappings []NostrCommitMapping, keepLast bool) []NostrCommitMapping {
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return mappings[i].GitHash < mappings[j].GitHash
+	})
+	kept := mappings[:0]
+	for _, mapping := range mappings {
+		switch {
+		case len(kept) == 0 || kept[len(kept)-1].GitHash != mapping.GitHash:
+			kept = append(kept, mapping)
+		case keepLast:
+			kept[len(kept)-1] = mapping
+		}
+	}
+	return kept
+}
+
+// mappingFileWriter writes a mapping file in the same layout as
+// json.MarshalIndent, sorted by Git hash and with one mapping per Git
+// hash: the first added, or the last with keepLast. It sorts
+// mappingChunkSize mappings at a time, spilling each sorted chunk to a run
+// file beside the output, and merges the runs when committed, so however
+// many mappings there are it holds only a chunk of them.
+type mappingFileWriter struct {
+	path     string
+	keepLast bool
+	chunk    []NostrCommitMapping
+	runs     []*os.File
+	count    int // Mappings written, once committed
+}
+
+// newMappingFileWriter starts writing a mapping file at path
+func newMappingFileWriter(path string, keepLast bool) (*mappingFileWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", path, err)
+	}
+	file.Close()
+	return &mappingFileWriter{path: path, keepLast: keepLast}, nil
+}
+
+// Add adds a mapping, spilling the chunk when it is full
+func (w *mappingFileWriter) Add(mapping NostrCommitMapping) error {
+	w.chunk = append(w.chunk, mapping)
+	if len(w.chunk) < mappingChunkSize {
+		return nil
+	}
+
+	run, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".run*")
+	if err != nil {
+		return fmt.Errorf("error creating mapping run: %w", err)
+	}
+	w.runs = append(w.runs, run)
+	writer := bufio.NewWriter(run)
+	encoder := json.NewEncoder(writer)
+	for _, mapping := range sortMappings(w.chunk, w.keepLast) {
+		if err := encoder.Encode(mapping); err != nil {
+			return fmt.Errorf("error writing mapping run: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing mapping run: %w", err)
+	}
+	w.chunk = w.chunk[:0]
+	return nil
+}
+
+// Commit merges the runs into the file and atomically moves it to path
+func (w *mappingFileWriter) Commit(path string) error {
+	runs := &mappingRuns{keepLast: w.keepLast}
+	for i, file := range w.runs {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		runs.add(&mappingRun{decoder: json.NewDecoder(bufio.NewReader(file)), order: i})
+	}
+	runs.add(&mappingRun{pending: sortMappings(w.chunk, w.keepLast), order: len(w.runs)})
+	if runs.err != nil {
+		return fmt.Errorf("error reading mapping run: %w", runs.err)
+	}
+
+	file, err := os.Create(w.path)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", w.path, err)
+	}
+	writer := bufio.NewWriter(file)
+	writer.WriteString("[")
+	w.count = 0
+	last := ""
+	for runs.Len() > 0 {
+		run := runs.runs[0]
+		if w.count == 0 || run.head.GitHash != last {
+			data, err := json.MarshalIndent(run.head, "  ", "  ")
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("error serializing mapping: %w", err)
+			}
+			if w.count > 0 {
+				writer.WriteString(",")
+			}
+			writer.WriteString("\n  ")
+			writer.Write(data)
+			w.count++
+			last = run.head.GitHash
+		}
+		if runs.advance(run) {
+			heap.Fix(runs, 0)
+		} else {
+			heap.Pop(runs)
+		}
+		if runs.err != nil {
+			file.Close()
+			return fmt.Errorf("error reading mapping run: %w", runs.err)
+		}
+	}
+	if w.count > 0 {
+		writer.WriteString("\n")
+	}
+	writer.WriteString("]")
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, path); err != nil {
+		return err
+	}
+	w.path = ""
+	w.removeRuns()
+	return nil
+}
+
+// Abort discards a file that was not committed
+func (w *mappingFileWriter) Abort() {
+	if w == nil {
+		return
+	}
+	w.removeRuns()
+	if w.path != "" {
+		os.Remove(w.path)
+	}
+}
+
+// removeRuns removes the run files
+func (w *mappingFileWriter) removeRuns() {
+	for _, run := range w.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+	w.runs = nil
+}
+
+// mappingRun is a sorted run of mappings being merged, read from a run
+// file or, for the last chunk, from memory
+type mappingRun struct {
+	decoder *json.Decoder
+	pending []NostrCommitMapping
+	head    NostrCommitMapping
+	order   int // Runs of mappings added earlier come first
+}
+
+// next moves to the run's next mapping, reporting whether it has one
+func (r *mappingRun) next() (bool, error) {
+	if r.decoder == nil {
+		if len(r.pending) == 0 {
+			return false, nil
+		}
+		r.head, r.pending = r.pending[0], r.pending[1:]
+		return true, nil
+	}
+	r.head = NostrCommitMapping{}
+	if err := r.decoder.Decode(&r.head); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mappingRuns is a heap of runs ordered by the Git hash of their next
+// mapping, and for the same Git hash by which of the mappings is kept
+type mappingRuns struct {
+	runs     []*mappingRun
+	keepLast bool
+	err      error // The first error reading a run
+}
+
+func (h *mappingRuns) Len() int { return len(h.runs) }
+
+func (h *mappingRuns) Less(i, j int) bool {
+	a, b := h.runs[i], h.runs[j]
+	if a.head.GitHash != b.head.GitHash {
+		return a.head.GitHash < b.head.GitHash
+	}
+	return (a.order < b.order) != h.keepLast
+}
+
+func (h *mappingRuns) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *mappingRuns) Push(x any) { h.runs = append(h.runs, x.(*mappingRun)) }
+
+func (h *mappingRuns) Pop() any {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
+
+// add puts a run on the heap, unless it is empty
+func (h *mappingRuns) add(run *mappingRun) {
+	if h.advance(run) {
+		heap.Push(h, run)
+	}
+}
+
+// advance moves a run to its next mapping, reporting whether it has one
+func (h *mappingRuns) advance(run *mappingRun) bool {
+	ok, err := run.next()
+	if err != nil && h.err == nil {
+		h.err = err
+	}
+	return ok
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/sha1"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -26,6 +27,16 @@ type Signature struct {
 type MCommitOptions struct {
 	Author    *Signature
 	Committer *Signature
+	// Signer, if set, signs the MGit hash with the author's nostr key
+	Signer Signer
+	// Parents, if set, replaces HEAD as the parents, e.g. for a merge
+	Parents []plumbing.Hash
+	// Paths, if set, limits the commit to the staged changes under these
+	// paths; the rest stay staged
+	Paths []string
+	// Amend, if set, replaces the HEAD commit with the new one, which gets
+	// HEAD's parents, and supersedes its mapping
+	Amend bool
 	// Additional fields can be added here if needed
 }
 
@@ -49,7 +60,7 @@ func convertToMGitSignature(sig object.Signature, pubkey string) *MGitSignature
 }
 
 // MGitCommit creates a commit that incorporates the nostr pubkey in hash calculation
-func MGitCommit(message string, opts *MCommitOptions) (plumbing.Hash, error) {
+func MGitCommit(message string, opts *MCommitOptions) (hash plumbing.Hash, err error) {
 	// Get repository
 	repo := getRepo()
 	w, err := repo.Worktree()
@@ -69,12 +80,47 @@ func MGitCommit(message string, opts *MCommitOptions) (plumbing.Hash, error) {
 	if opts.Committer != nil {
 		commitOpts.Committer = convertToGitSignature(opts.Committer)
 	}
+
+	// A merge commit may have the tree of a parent, which is fine
+	if len(opts.Parents) > 0 {
+		commitOpts.Parents = opts.Parents
+		commitOpts.AllowEmptyCommits = len(opts.Parents) > 1
+	}
+	
+	// An amended commit takes HEAD's place, on HEAD's parents; if anything
+	// fails once Git has moved the branch, it is put back
+	var amended *object.Commit
+	if opts.Amend {
+		if amended, err = amendTarget(repo); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		commitOpts.Parents = amended.ParentHashes
+		commitOpts.AllowEmptyCommits = true
+		defer func() {
+			if err != nil {
+				if restoreErr := pointHead(repo, amended.Hash); restoreErr != nil {
+					err = fmt.Errorf("%w; restoring HEAD also failed: %s", err, restoreErr)
+				}
+			}
+		}()
+	}
 	
 	// Perform the standard git commit
-	gitHash, err := w.Commit(message, commitOpts)
+	var gitHash plumbing.Hash
+	if len(opts.Paths) > 0 {
+		gitHash, err = commitPaths(repo, w, message, commitOpts, opts.Paths)
+	} else {
+		gitHash, err = w.Commit(message, commitOpts)
+	}
 	if err != nil {
 		return plumbing.ZeroHash, fmt.Errorf("error committing: %s", err)
 	}
+	// go-git makes HEAD the parent of a commit without parents
+	if amended != nil && len(amended.ParentHashes) == 0 {
+		if gitHash, err = dropParents(repo, gitHash); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("error amending the root commit: %w", err)
+		}
+	}
 	
 	// If no pubkey is present, just return the Git hash
 	if opts.Author.Pubkey == "" {
@@ -125,6 +171,14 @@ func MGitCommit(message string, opts *MCommitOptions) (plumbing.Hash, error) {
 		Metadata:     map[string]string{"version": "1.0"},
 	}
 	
+	// The Git commit already exists, so a signer that fails or declines
+	// leaves an unsigned MGit commit rather than none at all
+	if opts.Signer != nil {
+		if err := signMGitCommit(opts.Signer, mgitCommit); err != nil {
+			fmt.Printf("Warning: MGit commit was not signed: %s\n", err)
+		}
+	}
+	
 	// Store the MGit commit object
 	if err := storage.StoreCommit(mgitCommit); err != nil {
 		return plumbing.ZeroHash, fmt.Errorf("error storing MGit commit: %w", err)
@@ -134,8 +188,31 @@ func MGitCommit(message string, opts *MCommitOptions) (plumbing.Hash, error) {
 	if err := storage.StoreMapping(gitHash.String(), mgitHash.String(), opts.Author.Pubkey); err != nil {
 		return plumbing.ZeroHash, fmt.Errorf("error storing hash mapping: %w", err)
 	}
+	recordHashIndex(storage, gitHash.String(), mgitHash.String())
 	
-	// Update the current branch reference in MGit
+	// The amended commit's mapping points at its replacement. The MGit
+	// hash doesn't cover the message, so rewording may not change it.
+	if amended != nil {
+		if oldMGitHash, err := storage.GetMGitHashFromGit(amended.Hash.String()); err == nil && oldMGitHash != mgitHash.String() {
+			if err := storage.Mappings().Supersede(map[string]string{oldMGitHash: mgitHash.String()}); err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("error superseding the amended commit's mapping: %w", err)
+			}
+		}
+	}
+	
+	// Update the current branch reference in MGit, logged as git does:
+	// "commit (amend): <subject>"
+	if reflogAction == "commit" {
+		switch {
+		case amended != nil:
+			reflogAction = "commit (amend)"
+		case len(gitCommit.ParentHashes) == 0:
+			reflogAction = "commit (initial)"
+		case len(gitCommit.ParentHashes) > 1:
+			reflogAction = "commit (merge)"
+		}
+	}
+	setReflogMessage("%s", strings.SplitN(strings.TrimSpace(message), "\n", 2)[0])
 	head, err := repo.Head()
 	if err == nil && head.Name().IsBranch() {
 		branchName := head.Name().Short()
@@ -155,6 +232,9 @@ func MGitCommit(message string, opts *MCommitOptions) (plumbing.Hash, error) {
 // computeMGitHash computes a new hash incorporating the nostr pubkey
 // and using parent MGit hashes instead of Git hashes
 func computeMGitHash(commit *object.Commit, parentMGitHashes []string, pubkey string) plumbing.Hash {
+	span := startSpan("hash.mgit", "git_hash", commit.Hash.String(), "parents", len(parentMGitHashes))
+	defer span.End(nil)
+
 	// Create a new hasher
 	hasher := sha1.New()
 	
@@ -175,15 +255,20 @@ func computeMGitHash(commit *object.Commit, parentMGitHashes []string, pubkey st
 		pubkey)
 	hasher.Write([]byte(authorStr))
 	
-	// Include committer information
-	committerStr := fmt.Sprintf("%s <%s> %d", 
+	// Include committer information. This freezes the legacy hash input
+	// format: the first implementation passed the pubkey to a format without
+	// a verb for it, so fmt appended "%!(EXTRA string=<pubkey>)" to the bytes
+	// hashed. Every MGit hash made since covers that suffix, so it is spelled
+	// out here rather than left to fmt, and must not change.
+	committerStr := fmt.Sprintf("%s <%s> %d%%!(EXTRA string=%s)", 
 		commit.Committer.Name, 
 		commit.Committer.Email, 
 		commit.Committer.When.Unix(),
 		pubkey)
 	hasher.Write([]byte(committerStr))
 	
-	// Include the commit message
+	// Include the commit message. Also frozen: the legacy format hashes the
+	// committer line a second time in place of the message.
 	hasher.Write([]byte(committerStr))
 	
 	// Calculate the new hash
@@ -205,14 +290,11 @@ func StoreMGitCommitMapping(gitHash, mgitHash plumbing.Hash) error {
 
 // getMGitHashForCommit retrieves the MGit hash for a Git commit hash
 func GetMGitHashForCommit(gitHash plumbing.Hash) string {
-	mappings := getAllNostrMappings()
 	gitHashStr := gitHash.String()
-	
-	for _, mapping := range mappings {
-			if mapping.GitHash == gitHashStr {
-					return mapping.MGitHash
-			}
+	mgitHash, err := NewMGitStorage().GetMGitHashFromGit(gitHashStr)
+	if err != nil {
+			return ""
 	}
 	
-	return ""
-}
\ No newline at end of file
+	return mgitHash
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mergeFFMode is how a merge treats a branch it could fast-forward to
+type mergeFFMode string
+
+const (
+	mergeFF     mergeFFMode = "ff"      // fast-forward when possible
+	mergeNoFF   mergeFFMode = "no-ff"   // always create a merge commit
+	mergeFFOnly mergeFFMode = "ff-only" // fast-forward or refuse
+)
+
+// mergeFFConfig reads merge.ff: true (the default) fast-forwards when
+// possible, false always creates a merge commit, and only refuses anything
+// but a fast-forward
+func mergeFFConfig() (mergeFFMode, error) {
+	value := strings.ToLower(GetConfigValue("merge.ff", "true"))
+	switch value {
+	case "true", "yes", "on", "1":
+		return mergeFF, nil
+	case "false", "no", "off", "0":
+		return mergeNoFF, nil
+	case "only":
+		return mergeFFOnly, nil
+	}
+	return "", fmt.Errorf("invalid merge.ff value %q, expected true, false or only", value)
+}
+
+// HandleMerge handles the merge command. It merges a commit into the
+// current branch by fast-forwarding, or with a merge commit when the
+// fast-forward mode asks for one or the histories have diverged. No-ff
+// merge commits are where a team records who reviewed and merged a branch.
+// The merge commit's MGit parents are the MGit hashes of both sides.
+func HandleMerge(args []string) {
+	if len(args) == 1 && args[0] == "--abort" {
+		if err := abortMerge(getRepo()); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	mode, err := mergeFFConfig()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	message := ""
+	sign := GetConfigBool("commit.sign", false)
+	signoff := false
+	revisions := []string{}
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--ff":
+			mode = mergeFF
+		case arg == "--no-ff":
+			mode = mergeNoFF
+		case arg == "--ff-only":
+			mode = mergeFFOnly
+		case arg == "-m" && i+1 < len(args):
+			i++
+			message = args[i]
+		case arg == "-S" || arg == "--sign":
+			sign = true
+		case arg == "--no-sign":
+			sign = false
+		case arg == "--signoff":
+			signoff = true
+		case arg == "--no-signoff":
+			signoff = false
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	if len(revisions) != 1 {
+		fmt.Println("Usage: mgit merge [--ff | --no-ff | --ff-only] [-m <message>] [-S] [--signoff] <commit>")
+		fmt.Println("       mgit merge --abort")
+		os.Exit(1)
+	}
+	rev := revisions[0]
+
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		fmt.Printf("Error getting HEAD: %s\n", err)
+		os.Exit(1)
+	}
+	if !head.Name().IsBranch() {
+		fmt.Println("Error: cannot merge into a detached HEAD")
+		os.Exit(1)
+	}
+	if merge, err := loadPendingMerge(); err != nil || merge != nil {
+		fmt.Println("Error: a merge is in progress; commit the result or run mgit merge --abort")
+		os.Exit(1)
+	}
+	ours := head.Hash()
+	theirs, err := resolveGitRevision(repo, rev)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	oursAncestors, err := gitAncestors(repo, ours)
+	if err != nil {
+		fmt.Printf("Error reading history: %s\n", err)
+		os.Exit(1)
+	}
+	if oursAncestors[theirs] {
+		fmt.Println("Already up to date.")
+		return
+	}
+	theirsAncestors, err := gitAncestors(repo, theirs)
+	if err != nil {
+		fmt.Printf("Error reading history: %s\n", err)
+		os.Exit(1)
+	}
+	diverged := !theirsAncestors[ours]
+	if diverged && mode == mergeFFOnly {
+		fmt.Println("Error: not possible to fast-forward, aborting.")
+		os.Exit(1)
+	}
+
+	// Updating the index would lose staged changes; unstaged ones survive
+	// unless the merge touches them, which makes switchWorktree refuse
+	if staged, err := hasStagedChanges(repo); err != nil {
+		fmt.Printf("Error getting status: %s\n", err)
+		os.Exit(1)
+	} else if staged {
+		fmt.Println("Error: you have staged changes; commit or unstage them before merging")
+		os.Exit(1)
+	}
+
+	// Build the merge commit's identity and signer before touching anything
+	var author, committer *Signature
+	var signer Signer
+	if mode == mergeNoFF || diverged {
+		author, committer, err = commitIdentities(GetConfigValue("user.name", ""), GetConfigValue("user.email", ""), GetConfigValue("user.pubkey", ""), "", "", "")
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if author.Name == "" || author.Email == "" {
+			fmt.Println("Please set your user name and email first:")
+			fmt.Println("  mgit config --global user.name \"Your Name\"")
+			fmt.Println("  mgit config --global user.email \"your.email@example.com\"")
+			os.Exit(1)
+		}
+		if sign {
+			if signer, err = openCommitSigner(author.Pubkey); err != nil {
+				fmt.Printf("Error: cannot sign merge commit: %s\n", err)
+				os.Exit(1)
+			}
+			defer signer.Close()
+		}
+	}
+
+	if message == "" {
+		message = defaultMergeMessage(repo, rev)
+	}
+	if signoff && author != nil {
+		message = addTrailer(message, signoffKey, signoffTrailer(signoffIdentity(author, committer, GetConfigValue("user.pubkey", ""))))
+	}
+	if diverged {
+		if !mergeDiverged(repo, ours, theirs, rev, message) {
+			os.Exit(1)
+		}
+	} else {
+		fmt.Printf("Updating %s..%s\n", shortHash(ours.String()), shortHash(theirs.String()))
+		if err := switchWorktree(repo, ours, theirs); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	storage := NewMGitStorage()
+	if mode != mergeNoFF && !diverged {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), theirs)); err != nil {
+			fmt.Printf("Error updating branch: %s\n", err)
+			os.Exit(1)
+		}
+		if mgitHash, err := storage.GetMGitHashFromGit(theirs.String()); err == nil {
+			if err := storage.UpdateRef(head.Name().String(), mgitHash); err != nil {
+				fmt.Printf("Warning: Failed to update MGit branch ref: %s\n", err)
+			}
+		}
+		fmt.Println("Fast-forward")
+		return
+	}
+
+	// The index and worktree now hold the merged tree, which the merge
+	// commit records on top of the branch
+	hash, err := MGitCommit(message, &MCommitOptions{
+		Author:    author,
+		Committer: committer,
+		Signer:    signer,
+		Parents:   []plumbing.Hash{ours, theirs},
+	})
+	if err != nil {
+		fmt.Printf("Error creating merge commit: %s\n", err)
+		os.Exit(1)
+	}
+	runPostCommitHook(NewMGitStorage(), hash)
+	fmt.Printf("Merge made by a merge commit [%s]: %s\n", shortHash(hash.String()), message)
+}
+
+// mergeDiverged merges theirs into the worktree and index, three-way from
+// the merge base. On conflicts it writes the files with markers, records
+// the merge for commit to finish and returns false.
+func mergeDiverged(repo *git.Repository, ours, theirs plumbing.Hash, rev, message string) bool {
+	base, err := mergeBaseOf(repo, ours, theirs)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return false
+	}
+	result, err := mergeTrees(repo, base, ours, theirs, mergeLabels{Ours: "HEAD", Theirs: rev})
+	if err != nil {
+		fmt.Printf("Error merging: %s\n", err)
+		return false
+	}
+	if err := checkMergeWorktree(repo, ours, result); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return false
+	}
+	if err := writeMergeResult(repo, result); err != nil {
+		fmt.Printf("Error writing merge result: %s\n", err)
+		return false
+	}
+	if len(result.Conflicts) == 0 {
+		return true
+	}
+
+	for _, conflict := range result.Conflicts {
+		fmt.Println(conflict.Message)
+	}
+	if err := saveMergeState(theirs, message, result.Conflicts); err != nil {
+		fmt.Printf("Error saving merge state: %s\n", err)
+		return false
+	}
+	fmt.Println("Automatic merge failed; fix conflicts and then commit the result.")
+	return false
+}
+
+// defaultMergeMessage names what was merged the way git does
+func defaultMergeMessage(repo *git.Repository, rev string) string {
+	if _, err := repo.Reference(plumbing.NewBranchReferenceName(rev), false); err == nil {
+		return fmt.Sprintf("Merge branch '%s'", rev)
+	}
+	return fmt.Sprintf("Merge commit '%s'", rev)
+}
+
+// hasStagedChanges reports whether the index differs from HEAD
+func hasStagedChanges(repo *git.Repository) (bool, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, err
+	}
+	staged, err := stagedStatus(repo, idx)
+	if err != nil {
+		return false, err
+	}
+	return len(staged) > 0, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import "strings"
+
+// mergeLabels name the sides of a conflict in the markers
+type mergeLabels struct {
+	Ours   string
+	Base   string
+	Theirs string
+}
+
+// merge3Lines merges the changes from base to ours and from base to theirs,
+// diff3 style. Regions changed on only one side take that side; regions
+// changed the same way on both sides are taken once; anything else becomes
+// a conflict, written with markers. It returns the merged lines and the
+// number of conflicts.
+func merge3Lines(base, ours, theirs []string, labels mergeLabels) ([]string, int) {
+	oursMatch := matchedLines(base, ours)
+	theirsMatch := matchedLines(base, theirs)
+
+	merged := []string{}
+	conflicts := 0
+	i, j, k := 0, 0, 0
+
+	for {
+		// Copy the lines all three agree on
+		for i < len(base) && oursMatch[i] == j && theirsMatch[i] == k {
+			merged = append(merged, base[i])
+			i++
+			j++
+			k++
+		}
+
+		// Find the next base line both sides kept, past their current positions
+		next := i
+		for next < len(base) && (oursMatch[next] < j || theirsMatch[next] < k) {
+			next++
+		}
+
+		var baseChunk, oursChunk, theirsChunk []string
+		if next < len(base) {
+			baseChunk, oursChunk, theirsChunk = base[i:next], ours[j:oursMatch[next]], theirs[k:theirsMatch[next]]
+		} else {
+			baseChunk, oursChunk, theirsChunk = base[i:], ours[j:], theirs[k:]
+		}
+
+		if len(baseChunk) > 0 || len(oursChunk) > 0 || len(theirsChunk) > 0 {
+			switch {
+			case equalLines(oursChunk, baseChunk):
+				merged = append(merged, theirsChunk...)
+			case equalLines(theirsChunk, baseChunk), equalLines(oursChunk, theirsChunk):
+				merged = append(merged, oursChunk...)
+			default:
+				conflicts++
+				merged = append(merged, conflictMarker("<<<<<<<", labels.Ours, merged))
+				merged = append(merged, oursChunk...)
+				if labels.Base != "" {
+					merged = append(merged, conflictMarker("|||||||", labels.Base, merged))
+					merged = append(merged, baseChunk...)
+				}
+				merged = append(merged, conflictMarker("=======", "", merged))
+				merged = append(merged, theirsChunk...)
+				merged = append(merged, conflictMarker(">>>>>>>", labels.Theirs, merged))
+			}
+		}
+
+		if next >= len(base) {
+			break
+		}
+		i, j, k = next, oursMatch[next], theirsMatch[next]
+	}
+
+	return merged, conflicts
+}
+
+// matchedLines maps each line of base to its line in other, or -1 where
+// the line was deleted
+func matchedLines(base, other []string) []int {
+	match := make([]int, len(base))
+	for i := range match {
+		match[i] = -1
+	}
+	for _, edit := range diffLines(base, other) {
+		if edit.Op == diffEqual {
+			match[edit.AIndex] = edit.BIndex
+		}
+	}
+	return match
+}
+
+// conflictMarker builds a marker line, first terminating the preceding line
+// if it lacks a newline so the marker starts on a line of its own
+func conflictMarker(marker, label string, preceding []string) string {
+	line := marker
+	if label != "" {
+		line += " " + label
+	}
+	if len(preceding) > 0 && !strings.HasSuffix(preceding[len(preceding)-1], "\n") {
+		line = "\n" + line
+	}
+	return line + "\n"
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// HandleMergeBase handles the merge-base command, which finds the best
+// common ancestor of commits in the MGit commit graph
+func HandleMergeBase(args []string) {
+	all := false
+	isAncestor := false
+	revisions := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "--all", "-a":
+			all = true
+		case "--is-ancestor":
+			isAncestor = true
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+
+	if len(revisions) < 2 || (isAncestor && len(revisions) != 2) {
+		fmt.Println("Usage: mgit merge-base [--all] <commit> <commit>...")
+		fmt.Println("       mgit merge-base --is-ancestor <commit> <commit>")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+
+	hashes := []string{}
+	for _, rev := range revisions {
+		commit, err := resolveMGitRevision(repo, storage, rev)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(128)
+		}
+		hashes = append(hashes, commit.MGitHash)
+	}
+
+	// Like git, answer through the exit status only
+	if isAncestor {
+		if isMGitAncestor(storage, hashes[0], hashes[1]) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	bases := mgitMergeBases(storage, hashes[0], hashes[1:]...)
+	if len(bases) == 0 {
+		os.Exit(1)
+	}
+	if !all {
+		bases = bases[:1]
+	}
+	for _, base := range bases {
+		fmt.Println(base.MGitHash)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A merge of diverged histories that stops on conflicts leaves its state
+// in .mgit, as git does in .git: MERGE_HEAD names the commit being merged
+// and MERGE_MSG holds the message, listing the conflicts, that commit
+// starts from once they are resolved.
+const (
+	mergeHeadFile = "MERGE_HEAD"
+	mergeMsgFile  = "MERGE_MSG"
+)
+
+// mergeEntry is a file in one of the trees a merge compares
+type mergeEntry struct {
+	Hash plumbing.Hash
+	Mode filemode.FileMode
+}
+
+// mergeTreeResult is what merging two trees writes to the worktree and
+// index
+type mergeTreeResult struct {
+	Results   []*applyResult
+	Gitlinks  map[string]*mergeEntry // submodule commits to record
+	Conflicts []mergeConflict
+}
+
+// mergeConflict is a path a merge couldn't resolve
+type mergeConflict struct {
+	Path    string
+	Message string // "CONFLICT (<kind>): ..." as git prints it
+}
+
+// treeEntries lists the files of a commit's tree, submodules included, by
+// path
+func treeEntries(repo *git.Repository, hash plumbing.Hash) (map[string]*mergeEntry, error) {
+	entries := map[string]*mergeEntry{}
+	tree, err := commitTree(repo, hash)
+	if err != nil || tree == nil {
+		return entries, err
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Dir {
+			entries[name] = &mergeEntry{Hash: entry.Hash, Mode: entry.Mode}
+		}
+	}
+}
+
+// sameEntry reports whether two tree entries, either of which may be
+// missing, hold the same thing
+func sameEntry(a, b *mergeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hash == b.Hash && a.Mode == b.Mode
+}
+
+// mergeTrees merges the changes from base to theirs into ours, path by
+// path. A path changed on one side only takes that side; text files
+// changed on both are merged line by line, with conflict markers where the
+// changes overlap. Other paths changed on both sides conflict, keeping
+// what exists of ours, or theirs where we deleted the file.
+func mergeTrees(repo *git.Repository, base, ours, theirs plumbing.Hash, labels mergeLabels) (*mergeTreeResult, error) {
+	baseEntries, err := treeEntries(repo, base)
+	if err != nil {
+		return nil, err
+	}
+	oursEntries, err := treeEntries(repo, ours)
+	if err != nil {
+		return nil, err
+	}
+	theirsEntries, err := treeEntries(repo, theirs)
+	if err != nil {
+		return nil, err
+	}
+	return mergeTreeEntries(repo, baseEntries, oursEntries, theirsEntries, labels)
+}
+
+// mergeTreeEntries is mergeTrees over files already listed, for a side
+// that isn't a commit. Their blobs must be in the object store.
+func mergeTreeEntries(repo *git.Repository, baseEntries, oursEntries, theirsEntries map[string]*mergeEntry, labels mergeLabels) (*mergeTreeResult, error) {
+	paths := []string{}
+	for path, entry := range theirsEntries {
+		if !sameEntry(entry, baseEntries[path]) {
+			paths = append(paths, path)
+		}
+	}
+	for path := range baseEntries {
+		if theirsEntries[path] == nil {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	result := &mergeTreeResult{Gitlinks: map[string]*mergeEntry{}}
+	for _, path := range paths {
+		b, o, t := baseEntries[path], oursEntries[path], theirsEntries[path]
+		switch {
+		case sameEntry(o, t):
+			// Both sides made the same change
+		case sameEntry(o, b):
+			if err := result.take(repo, path, t); err != nil {
+				return nil, err
+			}
+		case o == nil || t == nil:
+			changed, who := t, "HEAD"
+			if o != nil {
+				changed, who = o, labels.Theirs
+			}
+			result.conflict(path, "CONFLICT (modify/delete): %s deleted in %s", path, who)
+			if o == nil && changed.Mode != filemode.Submodule {
+				content, err := blobContent(repo, changed.Hash)
+				if err != nil {
+					return nil, err
+				}
+				result.Results = append(result.Results, &applyResult{Path: path, Content: content, Mode: changed.Mode, Conflicts: 1})
+			}
+		default:
+			if err := result.mergeFile(repo, path, b, o, t, labels); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (r *mergeTreeResult) conflict(path, format string, args ...interface{}) {
+	r.Conflicts = append(r.Conflicts, mergeConflict{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// take records a path taking one side's entry, nil deleting it
+func (r *mergeTreeResult) take(repo *git.Repository, path string, entry *mergeEntry) error {
+	if entry == nil {
+		r.Results = append(r.Results, &applyResult{Path: path, Deleted: true})
+		return nil
+	}
+	if entry.Mode == filemode.Submodule {
+		r.Gitlinks[path] = entry
+		return nil
+	}
+	content, err := blobContent(repo, entry.Hash)
+	if err != nil {
+		return err
+	}
+	r.Results = append(r.Results, &applyResult{Path: path, Content: content, Mode: entry.Mode})
+	return nil
+}
+
+// mergeFile merges a file both sides changed
+func (r *mergeTreeResult) mergeFile(repo *git.Repository, path string, base, ours, theirs *mergeEntry, labels mergeLabels) error {
+	if !ours.Mode.IsRegular() || !theirs.Mode.IsRegular() {
+		r.conflict(path, "CONFLICT (content): %s changed on both sides and cannot be merged", path)
+		return nil
+	}
+	// Like git, a mode change on one side survives a content merge
+	mode := ours.Mode
+	if base != nil && ours.Mode == base.Mode {
+		mode = theirs.Mode
+	}
+
+	var baseContent []byte
+	if base != nil && base.Mode.IsRegular() {
+		var err error
+		if baseContent, err = blobContent(repo, base.Hash); err != nil {
+			return err
+		}
+	}
+	oursContent, err := blobContent(repo, ours.Hash)
+	if err != nil {
+		return err
+	}
+	theirsContent, err := blobContent(repo, theirs.Hash)
+	if err != nil {
+		return err
+	}
+	if isBinaryContent(baseContent) || isBinaryContent(oursContent) || isBinaryContent(theirsContent) {
+		r.conflict(path, "CONFLICT (content): binary file %s changed on both sides", path)
+		return nil
+	}
+
+	merged, conflicts := merge3Lines(splitLines(string(baseContent)), splitLines(string(oursContent)), splitLines(string(theirsContent)), labels)
+	if conflicts > 0 {
+		kind := "content"
+		if base == nil {
+			kind = "add/add"
+		}
+		r.conflict(path, "CONFLICT (%s): merge conflict in %s", kind, path)
+	}
+	r.Results = append(r.Results, &applyResult{Path: path, Content: []byte(strings.Join(merged, "")), Mode: mode, Conflicts: conflicts})
+	return nil
+}
+
+// isBinaryContent guesses, as git does, that data with a NUL byte in its
+// first 8000 bytes is binary
+func isBinaryContent(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+func blobContent(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return readBlob(blob)
+}
+
+// checkMergeWorktree refuses a merge that would overwrite local changes:
+// every path it writes must hold HEAD's version in the worktree
+func checkMergeWorktree(repo *git.Repository, ours plumbing.Hash, result *mergeTreeResult) error {
+	oursEntries, err := treeEntries(repo, ours)
+	if err != nil {
+		return err
+	}
+	root := repoRoot()
+	dirty := []string{}
+	for _, r := range result.Results {
+		current, err := worktreeBlobHash(filepath.Join(root, filepath.FromSlash(r.Path)))
+		if err != nil {
+			return err
+		}
+		want := plumbing.ZeroHash
+		if entry := oursEntries[r.Path]; entry != nil {
+			want = entry.Hash
+		}
+		if current != want {
+			dirty = append(dirty, r.Path)
+		}
+	}
+	if len(dirty) > 0 {
+		return fmt.Errorf("your local changes to these files would be overwritten by merge:\n  %s\nCommit or stash them first",
+			strings.Join(dirty, "\n  "))
+	}
+	return nil
+}
+
+// writeMergeResult writes a merge to the worktree and index. Conflicted
+// files are written with their markers and left unstaged.
+func writeMergeResult(repo *git.Repository, result *mergeTreeResult) error {
+	if err := writeApplyResults(repo, result.Results, applyOptions{Index: true}); err != nil {
+		return err
+	}
+	if len(result.Gitlinks) == 0 {
+		return nil
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	for path, entry := range result.Gitlinks {
+		indexEntry, err := idx.Entry(path)
+		if err != nil {
+			indexEntry = idx.Add(path)
+		}
+		indexEntry.Hash = entry.Hash
+		indexEntry.Mode = filemode.Submodule
+	}
+	return repo.Storer.SetIndex(idx)
+}
+
+// mergeBaseOf finds the Git merge base of two commits
+func mergeBaseOf(repo *git.Repository, ours, theirs plumbing.Hash) (plumbing.Hash, error) {
+	oursCommit, err := repo.CommitObject(ours)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	theirsCommit, err := repo.CommitObject(theirs)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	bases, err := oursCommit.MergeBase(theirsCommit)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(bases) == 0 {
+		return plumbing.ZeroHash, fmt.Errorf("refusing to merge unrelated histories")
+	}
+	return bases[0].Hash, nil
+}
+
+// saveMergeState records a merge stopped on conflicts. Like git, the
+// message lists the conflicted paths in comments.
+func saveMergeState(theirs plumbing.Hash, message string, conflicts []mergeConflict) error {
+	return saveStoppedState(mergeHeadFile, theirs, message, conflicts)
+}
+
+// saveStoppedState records a merge-like operation stopped on conflicts:
+// the commit it was merging in headFile and the message in MERGE_MSG
+func saveStoppedState(headFile string, theirs plumbing.Hash, message string, conflicts []mergeConflict) error {
+	var msg strings.Builder
+	msg.WriteString(message + "\n\n# Conflicts:\n")
+	for _, conflict := range conflicts {
+		msg.WriteString("#\t" + conflict.Path + "\n")
+	}
+	if err := os.WriteFile(filepath.Join(mgitDir(), mergeMsgFile), []byte(msg.String()), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(mgitDir(), headFile), []byte(theirs.String()+"\n"), 0644)
+}
+
+// pendingMerge is a merge stopped on conflicts
+type pendingMerge struct {
+	Theirs    plumbing.Hash
+	Message   string
+	Conflicts []string // paths
+}
+
+// loadPendingMerge returns the merge in progress, or nil if there is none
+func loadPendingMerge() (*pendingMerge, error) {
+	return loadStoppedState(mergeHeadFile)
+}
+
+// loadStoppedState returns the operation stopped with headFile, or nil
+func loadStoppedState(headFile string) (*pendingMerge, error) {
+	data, err := os.ReadFile(filepath.Join(mgitDir(), headFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash := strings.TrimSpace(string(data))
+	if !plumbing.IsHash(hash) {
+		return nil, fmt.Errorf("%s is corrupt", headFile)
+	}
+	merge := &pendingMerge{Theirs: plumbing.NewHash(hash)}
+	message, _ := os.ReadFile(filepath.Join(mgitDir(), mergeMsgFile))
+	merge.Message = stripCommentLines(string(message))
+	for _, line := range strings.Split(string(message), "\n") {
+		if strings.HasPrefix(line, "#\t") {
+			merge.Conflicts = append(merge.Conflicts, strings.TrimPrefix(line, "#\t"))
+		}
+	}
+	return merge, nil
+}
+
+// clearMergeState forgets a stopped merge once it is committed or aborted
+func clearMergeState() {
+	os.Remove(filepath.Join(mgitDir(), mergeHeadFile))
+	os.Remove(filepath.Join(mgitDir(), mergeMsgFile))
+}
+
+// Unresolved lists the conflicted files that still have conflict markers
+// or whose resolution isn't staged
+func (m *pendingMerge) Unresolved(repo *git.Repository) ([]string, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	root := repoRoot()
+	unresolved := []string{}
+	for _, path := range m.Conflicts {
+		fullPath := filepath.Join(root, filepath.FromSlash(path))
+		current, err := worktreeBlobHash(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		staged := plumbing.ZeroHash
+		if entry, err := idx.Entry(path); err == nil {
+			staged = entry.Hash
+		}
+		if current != staged || hasConflictMarkers(fullPath) {
+			unresolved = append(unresolved, path)
+		}
+	}
+	return unresolved, nil
+}
+
+// hasConflictMarkers reports whether a file has lines merge3Lines marks
+// conflicts with
+func hasConflictMarkers(fullPath string) bool {
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "<<<<<<< ") || line == "=======" || strings.HasPrefix(line, ">>>>>>> ") {
+			return true
+		}
+	}
+	return false
+}
+
+// abortMerge puts back HEAD's version of every path a stopped merge could
+// have written
+func abortMerge(repo *git.Repository) error {
+	merge, err := loadPendingMerge()
+	if err != nil {
+		return err
+	}
+	if merge == nil {
+		return fmt.Errorf("there is no merge to abort (%s missing)", mergeHeadFile)
+	}
+	theirs := merge.Theirs
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	base, err := mergeBaseOf(repo, head.Hash(), theirs)
+	if err != nil {
+		return err
+	}
+	result, err := mergeTrees(repo, base, head.Hash(), theirs, mergeLabels{})
+	if err != nil {
+		return err
+	}
+	paths := []string{}
+	for _, r := range result.Results {
+		paths = append(paths, r.Path)
+	}
+	for path := range result.Gitlinks {
+		paths = append(paths, path)
+	}
+	if err := restoreCommitPaths(repo, head.Hash(), paths); err != nil {
+		return err
+	}
+	clearMergeState()
+	return nil
+}
+
+// restoreCommitPaths puts a commit's version of the paths back in the
+// worktree and index
+func restoreCommitPaths(repo *git.Repository, hash plumbing.Hash, paths []string) error {
+	oursEntries, err := treeEntries(repo, hash)
+	if err != nil {
+		return err
+	}
+
+	restore := &mergeTreeResult{Gitlinks: map[string]*mergeEntry{}}
+	for _, path := range paths {
+		if err := restore.take(repo, path, oursEntries[path]); err != nil {
+			return err
+		}
+	}
+	return writeMergeResult(repo, restore)
+}
+
+// restoreHead puts back HEAD's version of every path staged since HEAD,
+// and of the conflicted paths, undoing a revert or cherry-pick that
+// stopped on conflicts
+func restoreHead(repo *git.Repository, conflicts []string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	headSide, err := commitDiffSide(repo, head.Hash())
+	if err != nil {
+		return err
+	}
+	index, err := indexDiffSide(repo)
+	if err != nil {
+		return err
+	}
+	paths := changedPaths(headSide, index, nil)
+	paths = append(paths, conflicts...)
+	return restoreCommitPaths(repo, head.Hash(), paths)
+}
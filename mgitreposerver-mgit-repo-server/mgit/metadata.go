@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// getRemoteURL returns the first URL configured for a git remote
+func getRemoteURL(repo *git.Repository, remoteName string) (string, error) {
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return "", fmt.Errorf("error getting remote %s: %w", remoteName, err)
+	}
+	if len(remote.Config().URLs) == 0 {
+		return "", fmt.Errorf("remote %s has no URL", remoteName)
+	}
+	return remote.Config().URLs[0], nil
+}
+
+// uploadMGitData sends the server what it lacks of our MGit data after a
+// push: just the missing objects, from which it learns their mappings too,
+// or the full mapping set if it predates object transfer
+func uploadMGitData(repo *git.Repository, remoteName string) error {
+	err := pushMGitObjects(repo, remoteName)
+	if err == errNoObjectTransfer {
+		return uploadMGitMetadata(repo, remoteName)
+	}
+	return err
+}
+
+// uploadMGitMetadata sends the local hash mappings to the server after a
+// push. The payload is gzip-compressed since mapping files compress well.
+func uploadMGitMetadata(repo *git.Repository, remoteName string) error {
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		return err
+	}
+
+	store := NewMGitStorage().Mappings()
+	if err := store.migrate(); err != nil {
+		return err
+	}
+	mappingsData, err := os.ReadFile(store.Path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // Nothing to upload
+		}
+		return fmt.Errorf("error reading hash mappings: %w", err)
+	}
+
+	token := getTokenForRepo(remoteURL)
+
+	req, err := newGzipRequest("POST", repoAPIURL(remoteURL, "metadata"), mappingsData)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAcceptEncoding(req)
+
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		fmt.Printf("Uploaded MGit metadata (%d bytes uncompressed)\n", len(mappingsData))
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		fmt.Println("Server does not accept MGit metadata uploads, skipping")
+		return nil
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	bodyBytes, _ := io.ReadAll(body)
+	return fmt.Errorf("error response from server: %s", string(bodyBytes))
+}
+
+// metadataCacheDir returns the directory holding the cached metadata
+// response and its ETag
+func metadataCacheDir(mgitDir string) string {
+	return filepath.Join(mgitDir, "cache", "metadata")
+}
+
+// fetchMetadataPages streams the server's hash mappings to fn page by page,
+// following next_cursor until the last page. A cached copy of the mapping
+// set is revalidated with If-None-Match, so an unchanged set costs a 304
+// instead of a full download. The returned flag reports a 304. query is
+// added to the request, e.g. a shallow clone's depth.
+func fetchMetadataPages(remoteName, url, token, mgitDir, query string, fn func(NostrCommitMapping) error) (bool, error) {
+	cacheDir := metadataCacheDir(mgitDir)
+	bodyPath := filepath.Join(cacheDir, "response.json")
+	etagPath := filepath.Join(cacheDir, "etag")
+
+	// Only revalidate when we still have the body the ETag belongs to
+	etag := ""
+	if _, err := os.Stat(bodyPath); err == nil {
+		if data, err := os.ReadFile(etagPath); err == nil {
+			etag = strings.TrimSpace(string(data))
+		}
+	}
+
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return false, err
+	}
+
+	pageSize := GetConfigValue("metadata.pageSize", "5000")
+	cursor := ""
+	var cache *mappingFileWriter
+	newETag := ""
+
+	for page := 0; ; page++ {
+		pageURL := fmt.Sprintf("%s?limit=%s", repoAPIURL(url, "metadata"), pageSize)
+		if cursor != "" {
+			pageURL += "&cursor=" + neturl.QueryEscape(cursor)
+		}
+		if query != "" {
+			pageURL += "&" + query
+		}
+
+		req, err := http.NewRequest("GET", pageURL, nil)
+		if err != nil {
+			return false, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		setAcceptEncoding(req)
+		if page == 0 && etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, fmt.Errorf("error making request: %w", err)
+		}
+
+		if page == 0 && resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			if err := streamMappingsFile(bodyPath, fn); err != nil {
+				return false, fmt.Errorf("error reading cached metadata: %w", err)
+			}
+			return true, nil
+		}
+
+		if page == 0 {
+			// Rebuild the cache alongside the pages we stream
+			newETag = resp.Header.Get("ETag")
+			if err := os.MkdirAll(cacheDir, 0755); err != nil {
+				resp.Body.Close()
+				return false, fmt.Errorf("error creating metadata cache: %w", err)
+			}
+			cache, err = newMappingFileWriter(bodyPath+".tmp", false)
+			if err != nil {
+				resp.Body.Close()
+				return false, err
+			}
+			defer cache.Abort()
+		}
+
+		cursor, err = readMetadataPage(resp, func(mapping NostrCommitMapping) error {
+			if err := cache.Add(mapping); err != nil {
+				return err
+			}
+			return fn(mapping)
+		})
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+
+		if cursor == "" {
+			break
+		}
+	}
+
+	if err := cache.Commit(bodyPath); err != nil {
+		return false, fmt.Errorf("error writing metadata cache: %w", err)
+	}
+	if newETag != "" {
+		if err := os.WriteFile(etagPath, []byte(newETag), 0644); err != nil {
+			return false, fmt.Errorf("error writing metadata cache: %w", err)
+		}
+	} else {
+		os.Remove(etagPath)
+	}
+
+	return false, nil
+}
+
+// readMetadataPage decodes one metadata response, passing each mapping to
+// fn without holding the whole page in memory. Paginating servers respond
+// with {"mappings": [...], "next_cursor": "..."}, others with a bare array.
+// It returns the cursor of the next page, or "" when this was the last one.
+func readMetadataPage(resp *http.Response, fn func(NostrCommitMapping) error) (string, error) {
+	body, err := decodedBody(resp)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(body)
+		return "", fmt.Errorf("error response from server: %s", string(bodyBytes))
+	}
+
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return "", fmt.Errorf("error parsing metadata response: %w", err)
+	}
+
+	// Unpaginated servers send the bare array
+	if token == json.Delim('[') {
+		return "", decodeMappingElements(decoder, fn)
+	}
+
+	if token != json.Delim('{') {
+		return "", fmt.Errorf("error parsing metadata response: unexpected %v", token)
+	}
+
+	nextCursor := ""
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("error parsing metadata response: %w", err)
+		}
+
+		switch key {
+		case "mappings":
+			if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+				return "", fmt.Errorf("error parsing metadata response: mappings is not an array")
+			}
+			if err := decodeMappingElements(decoder, fn); err != nil {
+				return "", err
+			}
+		case "next_cursor":
+			var value *string
+			if err := decoder.Decode(&value); err != nil {
+				return "", fmt.Errorf("error parsing metadata response: %w", err)
+			}
+			if value != nil {
+				nextCursor = *value
+			}
+		default:
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return "", fmt.Errorf("error parsing metadata response: %w", err)
+			}
+		}
+	}
+
+	return nextCursor, nil
+}
+
+// syncMGitMetadata refreshes the metadata of the current repository from a
+// remote: it fetches the MGit objects we lack, then the mappings, and
+// rebuilds the objects and refs the server couldn't send
+func syncMGitMetadata(repo *git.Repository, remoteName string) error {
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		return err
+	}
+
+	token := getTokenForRepo(remoteURL)
+	query := ""
+	if sparseMetadataEnabled() {
+		query = sparseMetadataQuery(repo)
+	}
+	if err := fetchMGitData(remoteName, remoteURL, token, repoRoot(), query); err != nil {
+		return err
+	}
+
+	return reconstructMGitObjects(repoRoot())
+}
+
+// fetchMGitData fetches the MGit objects and mappings of the repository at
+// destination from a remote. A shallow repository, or one with sparse
+// metadata, fetches the mappings first, to know which objects to ask for.
+func fetchMGitData(remoteName, url, token, destination, query string) error {
+	fetchObjects := func() {
+		if err := fetchMGitObjects(remoteName, url, token, destination); err != nil && err != errNoObjectTransfer {
+			fmt.Printf("Warning: Could not fetch MGit objects: %s\n", err)
+		}
+	}
+
+	_, shallow := openShallowRepo(destination)
+	mappingsFirst := shallow || sparseMetadataEnabled()
+	if !mappingsFirst {
+		fetchObjects()
+	}
+	if err := fetchMGitMetadata(remoteName, url, destination, token, query); err != nil {
+		return err
+	}
+	if mappingsFirst {
+		fetchObjects()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NIP-44 version 2 encryption, which NIP-17 direct messages use: an ECDH
+// conversation key, and per message ChaCha20 with an HMAC-SHA256 tag.
+
+// nip44ConversationKey derives the key two parties share: HKDF-extract,
+// salted "nip44-v2", of the x coordinate of our secret times their public
+// key
+func nip44ConversationKey(secret, pubkey []byte) ([]byte, error) {
+	key, err := secpPrivateKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	point, err := schnorr.ParsePubKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	shared := btcec.GenerateSharedSecret(key, point)
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+// nip44MessageKeys expands a conversation key and nonce into the ChaCha20
+// key and nonce and the HMAC key of one message
+func nip44MessageKeys(conversationKey, nonce []byte) (chachaKey, chachaNonce, hmacKey []byte, err error) {
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:32], keys[32:44], keys[44:], nil
+}
+
+// nip44PaddedLen is the length a plaintext is padded to, which hides the
+// exact length of short messages
+func nip44PaddedLen(n int) int {
+	if n <= 32 {
+		return 32
+	}
+	nextPower := 1
+	for nextPower < n {
+		nextPower <<= 1
+	}
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((n-1)/chunk + 1)
+}
+
+// nip44Encrypt encrypts a message with a conversation key, returning the
+// base64 payload
+func nip44Encrypt(conversationKey []byte, plaintext string) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return nip44EncryptWithNonce(conversationKey, nonce, plaintext)
+}
+
+func nip44EncryptWithNonce(conversationKey, nonce []byte, plaintext string) (string, error) {
+	if len(plaintext) < 1 || len(plaintext) > 65535 {
+		return "", errors.New("message must be 1 to 65535 bytes")
+	}
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded := make([]byte, 2+nip44PaddedLen(len(plaintext)))
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.XORKeyStream(ciphertext, padded)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+
+	payload := []byte{2}
+	payload = append(payload, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = mac.Sum(payload)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing"
@@ -16,6 +15,9 @@ type NostrCommitMapping struct {
 	GitHash  string `json:"git_hash"`
 	MGitHash string `json:"mgit_hash"`
 	Pubkey   string `json:"pubkey"`
+	// SupersededBy is the MGit hash of the commit that replaced this one
+	// when its branch was rewritten, e.g. by rebase
+	SupersededBy string `json:"superseded_by,omitempty"`
 }
 
 // GetNostrPubKey gets the user's nostr public key
@@ -35,25 +37,34 @@ func ValidateNostrPubKey(pubkey string) bool {
 	return strings.HasPrefix(pubkey, "npub") && len(pubkey) >= 60
 }
 
-// SignWithNostrKey is a placeholder for future implementation
-// This function could be used later when you want to sign commits with the nostr key
+// SignWithNostrKey signs the SHA-256 of a message with the configured
+// signer, returning the hex signature
 func SignWithNostrKey(message string) (string, error) {
-	pubkey := GetNostrPubKey()
-	if pubkey == "" {
-		return "", fmt.Errorf("no nostr public key configured")
+	signer, err := newSigner()
+	if err != nil {
+		return "", err
 	}
-	
-	// In a real implementation, you'd use the private key to sign the message
-	// For now, we'll just return a placeholder
-	return fmt.Sprintf("nostr-signed:%s:%s", pubkey, message), nil
+	defer signer.Close()
+
+	sig, err := signer.Sign(sha256.Sum256([]byte(message)))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
 }
 
-// VerifyNostrSignature is a placeholder for future implementation
+// VerifyNostrSignature verifies a signature made by SignWithNostrKey
+// against an npub or hex public key
 func VerifyNostrSignature(message, signature, pubkey string) bool {
-	// In a real implementation, you'd verify the signature
-	// For now, we'll just return a placeholder
-	expectedSig := fmt.Sprintf("nostr-signed:%s:%s", pubkey, message)
-	return signature == expectedSig
+	key, err := decodeNostrKey(pubkey, "npub")
+	if err != nil {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return schnorrVerify(key, sha256.Sum256([]byte(message)), sig)
 }
 
 // AddNostrMetadataToCommit is a conceptual example for future implementation
@@ -68,133 +79,31 @@ func AddNostrMetadataToCommit(commit *object.Commit) *object.Commit {
 	return commit
 }
 
-// GetCommitNostrPubkey retrieves the nostr pubkey associated with a commit
+// GetCommitNostrPubkey retrieves the nostr pubkey associated with a commit.
+// It is a compatibility wrapper around the mapping store.
 func GetCommitNostrPubkey(hash plumbing.Hash) string {
-	// Get the mapping file path
-	mappingFile := getNostrMappingFilePath()
-	
-	// Check if the mapping file exists
-	if _, err := os.Stat(mappingFile); os.IsNotExist(err) {
-		return "" // No mapping file exists yet
-	}
-	
-	// Read the mapping file
-	data, err := os.ReadFile(mappingFile)
+	pubkey, err := NewMGitStorage().GetPubkeyForCommit(hash.String())
 	if err != nil {
-		fmt.Printf("Warning: Error reading nostr mapping file: %s\n", err)
-		return ""
-	}
-	
-	// Parse the mappings
-	var mappings []NostrCommitMapping
-	if err := json.Unmarshal(data, &mappings); err != nil {
-		fmt.Printf("Warning: Error parsing nostr mapping file: %s\n", err)
+		// No mapping for this commit
 		return ""
 	}
-	
-	// Look for the commit hash in the mappings
-	hashStr := hash.String()
-	for _, mapping := range mappings {
-		if mapping.GitHash == hashStr || mapping.MGitHash == hashStr {
-			return mapping.Pubkey
-		}
-	}
-	
-	// If we didn't find a mapping, return empty string
-	return ""
+	return pubkey
 }
 
-// StoreCommitNostrMapping stores the mapping between a git commit hash, an mgit hash, and a nostr pubkey
+// StoreCommitNostrMapping stores the mapping between a git commit hash, an
+// mgit hash, and a nostr pubkey. It is a compatibility wrapper around the
+// mapping store.
 func StoreCommitNostrMapping(gitHash, mgitHash plumbing.Hash, pubkey string) error {
-	// Get the mapping file path
-	mappingFile := getNostrMappingFilePath()
-	
-	// Check if the mapping file exists
-	var mappings []NostrCommitMapping
-	if _, err := os.Stat(mappingFile); !os.IsNotExist(err) {
-		// Read existing mappings
-		data, err := os.ReadFile(mappingFile)
-		if err != nil {
-			return fmt.Errorf("error reading nostr mapping file: %s", err)
-		}
-		
-		// Parse existing mappings
-		if err := json.Unmarshal(data, &mappings); err != nil {
-			return fmt.Errorf("error parsing nostr mapping file: %s", err)
-		}
-	}
-	
-	// Add the new mapping
-	newMapping := NostrCommitMapping{
-		GitHash:  gitHash.String(),
-		MGitHash: mgitHash.String(),
-		Pubkey:   pubkey,
-	}
-	
-	// Check for duplicates and update if exists
-	found := false
-	for i, mapping := range mappings {
-		if mapping.GitHash == newMapping.GitHash || mapping.MGitHash == newMapping.MGitHash {
-			mappings[i] = newMapping
-			found = true
-			break
-		}
-	}
-	
-	// If not found, append
-	if !found {
-		mappings = append(mappings, newMapping)
-	}
-	
-	// Marshal to JSON
-	data, err := json.MarshalIndent(mappings, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error encoding mapping data: %s", err)
-	}
-	
-	// Ensure directory exists
-	dir := filepath.Dir(mappingFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("error creating directory for mapping file: %s", err)
-	}
-	
-	// Write to file
-	if err := os.WriteFile(mappingFile, data, 0644); err != nil {
-		return fmt.Errorf("error writing mapping file: %s", err)
-	}
-	
-	return nil
-}
-
-// getNostrMappingFilePath returns the path to the nostr mapping file
-func getNostrMappingFilePath() string {
-	// Store the mapping in the .mgit directory
-	return ".mgit/nostr_mappings.json"
+	return NewMGitStorage().StoreMapping(gitHash.String(), mgitHash.String(), pubkey)
 }
 
 // getAllNostrMappings retrieves all nostr commit mappings
 func getAllNostrMappings() []NostrCommitMapping {
-	// Use the correct path for hash_mappings.json
-	mappingFile := ".mgit/mappings/hash_mappings.json"
-	
-	// Check if the mapping file exists
-	if _, err := os.Stat(mappingFile); os.IsNotExist(err) {
-			return []NostrCommitMapping{} // No mapping file exists
-	}
-	
-	// Read the mapping file
-	data, err := os.ReadFile(mappingFile)
+	mappings, err := NewMGitStorage().GetMappings()
 	if err != nil {
 			fmt.Printf("Warning: Error reading hash mappings file: %s\n", err)
 			return []NostrCommitMapping{}
 	}
 	
-	// Parse the mappings
-	var mappings []NostrCommitMapping
-	if err := json.Unmarshal(data, &mappings); err != nil {
-			fmt.Printf("Warning: Error parsing hash mappings file: %s\n", err)
-			return []NostrCommitMapping{}
-	}
-	
 	return mappings
-}
\ No newline at end of file
+}
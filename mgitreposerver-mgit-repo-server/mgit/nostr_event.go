@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// nostrEvent is a NIP-01 event
+type nostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig,omitempty"`
+}
+
+// nostrJSON encodes a value as nostr expects, without Go's escaping of
+// <, > and &
+func nostrJSON(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b.Bytes(), "\n"), nil
+}
+
+// computeID sets the event's ID, the SHA-256 of its serialized fields
+func (e *nostrEvent) computeID() ([32]byte, error) {
+	if e.Tags == nil {
+		e.Tags = [][]string{}
+	}
+	data, err := nostrJSON([]interface{}{0, e.PubKey, e.CreatedAt, e.Kind, e.Tags, e.Content})
+	if err != nil {
+		return [32]byte{}, err
+	}
+	id := sha256.Sum256(data)
+	e.ID = hex.EncodeToString(id[:])
+	return id, nil
+}
+
+// sign sets the event's pubkey, ID and signature
+func (e *nostrEvent) sign(signer Signer) error {
+	pubkey, err := signer.PublicKey()
+	if err != nil {
+		return err
+	}
+	e.PubKey = hex.EncodeToString(pubkey)
+	id, err := e.computeID()
+	if err != nil {
+		return err
+	}
+	sig, err := signer.Sign(id)
+	if err != nil {
+		return err
+	}
+	e.Sig = hex.EncodeToString(sig)
+	return nil
+}
+
+// relayTimeout bounds connecting to a relay and waiting for its answer
+const relayTimeout = 15 * time.Second
+
+// publishNostrEvent sends an event to a relay and waits for the relay to
+// accept it (NIP-20 "OK")
+func publishNostrEvent(relayURL string, event *nostrEvent) error {
+	span := startSpan("nostr.publish", "relay", relayURL, "kind", event.Kind)
+	err := sendToRelay(relayURL, event)
+	span.End(err)
+	return err
+}
+
+func sendToRelay(relayURL string, event *nostrEvent) error {
+	config, err := websocket.NewConfig(relayURL, "http://localhost/")
+	if err != nil {
+		return err
+	}
+	config.Dialer = &net.Dialer{Timeout: relayTimeout}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %w", relayURL, err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(relayTimeout))
+
+	message, err := nostrJSON([]interface{}{"EVENT", event})
+	if err != nil {
+		return err
+	}
+	if err := websocket.Message.Send(ws, string(message)); err != nil {
+		return err
+	}
+
+	// Skip anything else the relay says, like NOTICEs, until its verdict
+	for {
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			return fmt.Errorf("no answer from %s: %w", relayURL, err)
+		}
+		var fields []interface{}
+		if json.Unmarshal([]byte(reply), &fields) != nil || len(fields) < 3 {
+			continue
+		}
+		if fields[0] != "OK" || fields[1] != event.ID {
+			continue
+		}
+		if accepted, _ := fields[2].(bool); !accepted {
+			reason := ""
+			if len(fields) > 3 {
+				reason, _ = fields[3].(string)
+			}
+			return fmt.Errorf("%s rejected the event: %s", relayURL, reason)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// MGit has no note objects of its own; notes are git's, so `git notes`
+// adds them. They are blobs in the tree of the commit core.notesRef, or
+// refs/notes/commits, points at, each named by the Git hash of the commit
+// it annotates, possibly fanned out into directories as ab/cdef...
+
+// notesRef is the ref notes are read from
+func notesRef() string {
+	return envOr("GIT_NOTES_REF", GetConfigValue("core.notesRef", "refs/notes/commits"))
+}
+
+// commitNotes returns the note on a Git commit, or nil if it has none
+func commitNotes(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	ref, err := repo.Reference(plumbing.ReferenceName(notesRef()), true)
+	if err != nil {
+		return nil, nil
+	}
+	entries, err := treeEntries(repo, ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", notesRef(), err)
+	}
+	for path, entry := range entries {
+		if strings.ReplaceAll(path, "/", "") == hash.String() {
+			return blobContent(repo, entry.Hash)
+		}
+	}
+	return nil, nil
+}
+
+// printCommitNotes prints a commit's note as git show does, after the
+// message
+func printCommitNotes(repo *git.Repository, gitHash string) {
+	if gitHash == "" {
+		return
+	}
+	notes, err := commitNotes(repo, plumbing.NewHash(gitHash))
+	if err != nil {
+		fmt.Printf("Warning: %s\n", err)
+		return
+	}
+	if len(notes) == 0 {
+		return
+	}
+	if ref := notesRef(); ref == "refs/notes/commits" {
+		fmt.Println("Notes:")
+	} else {
+		fmt.Printf("Notes (%s):\n", strings.TrimPrefix(ref, "refs/notes/"))
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(notes), "\n"), "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+	fmt.Println()
+}
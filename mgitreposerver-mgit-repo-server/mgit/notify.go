@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Push notifications are opt-in: after a push, each pubkey in
+// notify.recipients gets a NIP-17 direct message through the relays in
+// notify.relays, saying which branch got how many commits and its MGit
+// head. The messages are sealed with the user's key, so they need the
+// local signer's secret (MGIT_NSEC or signer.keyFile) for the encryption.
+
+// NIP-17 event kinds
+const (
+	kindDirectMessage = 14
+	kindSeal          = 13
+	kindGiftWrap      = 1059
+)
+
+// notifyPush sends the notifications of a push that sent commits, if any
+// are configured. Each recipient needs one relay to take their message.
+func notifyPush(plan *pushPlan, mgitHead string) error {
+	recipients := strings.Fields(GetConfigValue("notify.recipients", ""))
+	if len(recipients) == 0 || len(plan.Commits) == 0 {
+		return nil
+	}
+	relays := strings.Fields(GetConfigValue("notify.relays", ""))
+	if len(relays) == 0 {
+		return fmt.Errorf("notify.recipients is set but notify.relays is not")
+	}
+	sender, err := newLocalSigner()
+	if err != nil {
+		return fmt.Errorf("notifications need the local signer's key: %w", err)
+	}
+	defer sender.Close()
+
+	message := pushNotificationText(plan, mgitHead)
+	failed := []string{}
+	for _, recipient := range recipients {
+		pubkey, err := decodeNostrKey(recipient, "npub")
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", recipient, err))
+			continue
+		}
+		wrap, err := giftWrapMessage(sender, pubkey, message)
+		if err != nil {
+			return err
+		}
+		if err := publishToAnyRelay(relays, wrap); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", shortPubkey(encodeNpub(pubkey)), err))
+			continue
+		}
+		traceEvent("notify.sent", "recipient", encodeNpub(pubkey))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not notify %s", strings.Join(failed, "; "))
+	}
+	fmt.Printf("Sent %d push notifications\n", len(recipients))
+	return nil
+}
+
+// pushNotificationText is the message collaborators get about a push
+func pushNotificationText(plan *pushPlan, mgitHead string) string {
+	commits := fmt.Sprintf("%d commits", len(plan.Commits))
+	if len(plan.Commits) == 1 {
+		commits = "1 commit"
+	}
+	if mgitHead == "" {
+		mgitHead = "(no MGit object)"
+	}
+	return fmt.Sprintf("Pushed %s to %s at %s\nMGit head: %s\nGit head: %s",
+		commits, plan.Branch, plan.RemoteURL, mgitHead, plan.NewHash)
+}
+
+// publishToAnyRelay publishes an event to each relay until one takes it
+func publishToAnyRelay(relays []string, event *nostrEvent) error {
+	errs := []string{}
+	for _, relay := range relays {
+		err := publishNostrEvent(relay, event)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// giftWrapMessage wraps a direct message to a recipient as NIP-17 does: an
+// unsigned kind 14 message, sealed (kind 13) with the sender's key, then
+// wrapped (kind 1059) with a throwaway key, so relays see neither who
+// wrote it nor when
+func giftWrapMessage(sender *localSigner, recipient []byte, text string) (*nostrEvent, error) {
+	senderPub, err := sender.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	recipientHex := hex.EncodeToString(recipient)
+
+	rumor := &nostrEvent{
+		PubKey:    hex.EncodeToString(senderPub),
+		CreatedAt: time.Now().Unix(),
+		Kind:      kindDirectMessage,
+		Tags:      [][]string{{"p", recipientHex}},
+		Content:   text,
+	}
+	if _, err := rumor.computeID(); err != nil {
+		return nil, err
+	}
+	seal, err := encryptedEvent(sender, recipient, kindSeal, nil, rumor)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapKey, err := newEphemeralSigner()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapKey.Close()
+	return encryptedEvent(wrapKey, recipient, kindGiftWrap, [][]string{{"p", recipientHex}}, seal)
+}
+
+// encryptedEvent makes a signed event whose content is another event,
+// NIP-44 encrypted from the signer to the recipient. Its time is up to two
+// days in the past, as NIP-59 asks, so it doesn't date the message.
+func encryptedEvent(signer *localSigner, recipient []byte, kind int, tags [][]string, inner *nostrEvent) (*nostrEvent, error) {
+	key, err := nip44ConversationKey(signer.secret, recipient)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := nostrJSON(inner)
+	if err != nil {
+		return nil, err
+	}
+	content, err := nip44Encrypt(key, string(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	jitter, err := rand.Int(rand.Reader, big.NewInt(2*24*60*60))
+	if err != nil {
+		return nil, err
+	}
+
+	event := &nostrEvent{
+		CreatedAt: time.Now().Unix() - jitter.Int64(),
+		Kind:      kind,
+		Tags:      tags,
+		Content:   content,
+	}
+	if err := event.sign(signer); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// newEphemeralSigner makes a signer with a fresh random key
+func newEphemeralSigner() (*localSigner, error) {
+	for {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if _, err := schnorrPublicKey(secret); err == nil {
+			return &localSigner{secret: secret}, nil
+		}
+	}
+}
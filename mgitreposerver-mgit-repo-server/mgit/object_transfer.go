@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// maxMGitObjectSize bounds the objects read from a pack, so a corrupt or
+// hostile pack can't make us allocate without limit
+const maxMGitObjectSize = 16 << 20
+
+// objectPackHeader starts every object pack. A pack is a sequence of
+// entries, each a header line followed by its data, ending with "end":
+//
+//	<hash> full <n>\n<n bytes: the object>
+//	<hash> delta <base hash> <n>\n<n bytes: delta against the base>
+//
+// A delta's base is an object earlier in the same pack.
+const objectPackHeader = "MGITPACK 1"
+
+// errNoObjectTransfer means the server predates object negotiation, so
+// callers fall back to exchanging the full mapping set
+var errNoObjectTransfer = errors.New("server does not support MGit object transfer")
+
+// objectNegotiationType is the content type of negotiation requests. It is
+// JSON, but not labeled so, because the server streams these bodies to
+// mgit rather than parsing them.
+const objectNegotiationType = "application/x-mgit-negotiation"
+
+// objectNegotiation is the body of negotiation requests and replies. The
+// sender lists the objects it has; the reply lists those the server wants.
+type objectNegotiation struct {
+	Have []string `json:"have,omitempty"`
+	Want []string `json:"want,omitempty"`
+}
+
+// packStats summarizes a pack for progress output
+type packStats struct {
+	Full   int
+	Deltas int
+	Bytes  int
+}
+
+func (s packStats) String() string {
+	return fmt.Sprintf("%d objects (%d full, %d deltas, %d bytes)", s.Full+s.Deltas, s.Full, s.Deltas, s.Bytes)
+}
+
+// isMGitHash reports whether s looks like a full MGit object hash
+func isMGitHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func mgitObjectPath(rootDir, hash string) string {
+	return filepath.Join(rootDir, "objects", hash[:2], hash[2:])
+}
+
+// listMGitObjects returns the hashes of all objects in an MGit directory,
+// loose or packed, sorted
+func listMGitObjects(rootDir string) ([]string, error) {
+	hashes, err := listLooseObjects(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	packed, err := listPackedObjects(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, hash := range hashes {
+		seen[hash] = true
+	}
+	for _, hash := range packed {
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// listLooseObjects returns the hashes of the loose objects in an MGit
+// directory, sorted
+func listLooseObjects(rootDir string) ([]string, error) {
+	objDir := filepath.Join(rootDir, "objects")
+	dirs, err := os.ReadDir(objDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	hashes := []string{}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(objDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if hash := dir.Name() + file.Name(); isMGitHash(hash) {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// errUnverifiableObject marks a received object that can't be checked
+// against this repository, because it lacks the Git commit or an MGit
+// parent the object names
+var errUnverifiableObject = errors.New("is not in this repository")
+
+// receivedObjects checks the objects of a pack against a Git repository
+// as they are stored. The server rejects a pack with any object it can't
+// verify; a client, which may not have fetched every commit the server
+// has objects for, skips those and keeps the rest.
+type receivedObjects struct {
+	repo        *git.Repository
+	rootDir     string
+	skipMissing bool
+	commits     map[string]*MCommitStruct
+}
+
+// newReceivedObjects starts checking the objects received into rootDir
+// against repo
+func newReceivedObjects(repo *git.Repository, rootDir string, skipMissing bool) *receivedObjects {
+	return &receivedObjects{repo: repo, rootDir: rootDir, skipMissing: skipMissing, commits: map[string]*MCommitStruct{}}
+}
+
+// storeMGitObject writes an object received from elsewhere, after checking
+// that it is the object it claims to be. Existing objects are kept. It
+// returns the decoded object, or nil for one skipped as unverifiable.
+func (r *receivedObjects) storeMGitObject(hash string, data []byte) (*MCommitStruct, error) {
+	var commit MCommitStruct
+	if err := json.Unmarshal(data, &commit); err != nil {
+		return nil, fmt.Errorf("object %s is not a valid MGit object: %w", hash, err)
+	}
+	if commit.MGitHash != hash {
+		return nil, fmt.Errorf("object %s claims to be %s", hash, commit.MGitHash)
+	}
+
+	var err error
+	if commit.Type == MGitTagObject {
+		err = r.verifyTag(hash, data)
+	} else {
+		err = r.verifyCommit(&commit)
+	}
+	if errors.Is(err, errUnverifiableObject) && r.skipMissing {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.commits[hash] = &commit
+
+	if hasMGitObject(r.rootDir, hash) {
+		return &commit, nil
+	}
+	path := mgitObjectPath(r.rootDir, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create object directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to write object %s: %w", hash, err)
+	}
+	return &commit, nil
+}
+
+// verifyCommit checks that a received commit hashes, with the pubkey it
+// claims, from the Git commit it names and the MGit objects of that
+// commit's parents, and that its signature verifies if it has one. A
+// parent may be named by its Git hash, as commits are when their parents
+// have no MGit object, or be missing where a shallow repository's history
+// stops.
+func (r *receivedObjects) verifyCommit(commit *MCommitStruct) error {
+	if commit.Type != MGitCommitObject && commit.Type != "" {
+		return fmt.Errorf("object %s has unknown type %q", commit.MGitHash, commit.Type)
+	}
+	gitCommit, err := r.repo.CommitObject(plumbing.NewHash(commit.GitHash))
+	if err != nil {
+		return fmt.Errorf("object %s names Git commit %s, which %w", commit.MGitHash, commit.GitHash, errUnverifiableObject)
+	}
+	if commit.TreeHash != "" && commit.TreeHash != gitCommit.TreeHash.String() {
+		return fmt.Errorf("object %s has tree %s, but Git commit %s has %s",
+			commit.MGitHash, shortHash(commit.TreeHash), shortHash(commit.GitHash), shortHash(gitCommit.TreeHash.String()))
+	}
+	if len(commit.ParentHashes) != len(gitCommit.ParentHashes) {
+		return fmt.Errorf("object %s has %d parents, but Git commit %s has %d",
+			commit.MGitHash, len(commit.ParentHashes), shortHash(commit.GitHash), len(gitCommit.ParentHashes))
+	}
+
+	for i, parent := range commit.ParentHashes {
+		gitParent := gitCommit.ParentHashes[i].String()
+		if parent == gitParent {
+			continue
+		}
+		parentGitHash, known := r.parentGitHash(parent)
+		switch {
+		case known && parentGitHash != gitParent:
+			return fmt.Errorf("object %s names parent %s, which is not Git commit %s",
+				commit.MGitHash, shortHash(parent), shortHash(gitParent))
+		case !known && r.hasGitCommit(gitCommit.ParentHashes[i]):
+			return fmt.Errorf("object %s names parent %s, which %w", commit.MGitHash, shortHash(parent), errUnverifiableObject)
+		}
+	}
+
+	pubkey := ""
+	if commit.Author != nil {
+		pubkey = commit.Author.Pubkey
+	}
+	if computed := computeMGitHash(gitCommit, commit.ParentHashes, pubkey).String(); computed != commit.MGitHash {
+		return fmt.Errorf("object %s hashes to %s from Git commit %s", commit.MGitHash, computed, shortHash(commit.GitHash))
+	}
+	if signed, err := verifyMGitSignature(commit); signed && err != nil {
+		return fmt.Errorf("object %s: %w", commit.MGitHash, err)
+	}
+	return nil
+}
+
+// verifyTag checks a received tag's hash and signature, and that the
+// object it tags is known
+func (r *receivedObjects) verifyTag(hash string, data []byte) error {
+	var tag MTagStruct
+	if err := json.Unmarshal(data, &tag); err != nil {
+		return fmt.Errorf("tag %s is not a valid MGit object: %w", hash, err)
+	}
+	if _, err := verifyMGitTag(&tag); err != nil {
+		return fmt.Errorf("tag %s: %w", hash, err)
+	}
+	if _, known := r.commits[tag.Object]; !known && !hasMGitObject(r.rootDir, tag.Object) {
+		return fmt.Errorf("tag %s tags %s, which %w", hash, shortHash(tag.Object), errUnverifiableObject)
+	}
+	return nil
+}
+
+// parentGitHash returns the Git commit of an MGit object received earlier
+// in the pack or already stored
+func (r *receivedObjects) parentGitHash(hash string) (string, bool) {
+	if commit, ok := r.commits[hash]; ok {
+		return commit.GitHash, true
+	}
+	if !isMGitHash(hash) {
+		return "", false
+	}
+	data, err := readMGitObject(r.rootDir, hash)
+	if err != nil {
+		return "", false
+	}
+	var commit MCommitStruct
+	if err := json.Unmarshal(data, &commit); err != nil {
+		return "", false
+	}
+	return commit.GitHash, true
+}
+
+// hasGitCommit reports whether the repository has a Git commit, which a
+// shallow one lacks past where its history stops
+func (r *receivedObjects) hasGitCommit(hash plumbing.Hash) bool {
+	_, err := r.repo.CommitObject(hash)
+	return err == nil
+}
+
+// writeObjectPack writes a pack of the given objects. Each object whose
+// parent is also in the pack is sent as a delta against it, when that is
+// smaller. Objects the receiver already has are never used as bases: its
+// copy can differ from ours, e.g. when it was reconstructed without the
+// signature ours carries.
+func writeObjectPack(w io.Writer, rootDir string, hashes []string) (packStats, error) {
+	stats := packStats{}
+	type packObject struct {
+		hash   string
+		data   []byte
+		commit MCommitStruct
+	}
+
+	byHash := map[string]*packObject{}
+	for _, hash := range hashes {
+		data, err := readMGitObject(rootDir, hash)
+		if err != nil {
+			return stats, fmt.Errorf("failed to read object %s: %w", hash, err)
+		}
+		object := &packObject{hash: hash, data: data}
+		if err := json.Unmarshal(data, &object.commit); err != nil {
+			return stats, fmt.Errorf("failed to parse object %s: %w", hash, err)
+		}
+		byHash[hash] = object
+	}
+
+	// Parents before their children, so they can serve as delta bases
+	objects := make([]*packObject, 0, len(byHash))
+	visited := map[string]bool{}
+	var visit func(hash string)
+	visit = func(hash string) {
+		object, ok := byHash[hash]
+		if !ok || visited[hash] {
+			return
+		}
+		visited[hash] = true
+		for _, parent := range object.commit.ParentHashes {
+			visit(parent)
+		}
+		objects = append(objects, object)
+	}
+	for _, hash := range hashes {
+		visit(hash)
+	}
+
+	buffered := bufio.NewWriter(w)
+	fmt.Fprintln(buffered, objectPackHeader)
+
+	sent := map[string][]byte{}
+	for _, object := range objects {
+		var best []byte
+		bestBase := ""
+		for _, parent := range object.commit.ParentHashes {
+			base, ok := sent[parent]
+			if !ok {
+				continue
+			}
+			delta := makeDelta(base, object.data)
+			if len(delta) < len(object.data) && (best == nil || len(delta) < len(best)) {
+				best, bestBase = delta, parent
+			}
+		}
+
+		if best != nil {
+			fmt.Fprintf(buffered, "%s delta %s %d\n", object.hash, bestBase, len(best))
+			buffered.Write(best)
+			stats.Deltas++
+			stats.Bytes += len(best)
+		} else {
+			fmt.Fprintf(buffered, "%s full %d\n", object.hash, len(object.data))
+			buffered.Write(object.data)
+			stats.Full++
+			stats.Bytes += len(object.data)
+		}
+		sent[object.hash] = object.data
+	}
+
+	fmt.Fprintln(buffered, "end")
+	return stats, buffered.Flush()
+}
+
+// readObjectPack stores the objects of a pack, resolving deltas against
+// earlier objects in the pack and checking each against the repository.
+// It returns the commits stored.
+func readObjectPack(r io.Reader, objects *receivedObjects) ([]*MCommitStruct, error) {
+	reader := bufio.NewReader(r)
+	header, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(header) != objectPackHeader {
+		return nil, fmt.Errorf("not an MGit object pack")
+	}
+
+	received := map[string][]byte{}
+	commits := []*MCommitStruct{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return commits, fmt.Errorf("truncated object pack")
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 1 && fields[0] == "end" {
+			return commits, nil
+		}
+
+		hash, base := "", ""
+		sizeField := ""
+		switch {
+		case len(fields) == 3 && fields[1] == "full":
+			hash, sizeField = fields[0], fields[2]
+		case len(fields) == 4 && fields[1] == "delta":
+			hash, base, sizeField = fields[0], fields[2], fields[3]
+		default:
+			return commits, fmt.Errorf("invalid object pack entry %q", strings.TrimSpace(line))
+		}
+		if !isMGitHash(hash) {
+			return commits, fmt.Errorf("invalid object hash %q in object pack", hash)
+		}
+		size, err := strconv.Atoi(sizeField)
+		if err != nil || size < 0 || size > maxMGitObjectSize {
+			return commits, fmt.Errorf("invalid size for object %s", hash)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return commits, fmt.Errorf("truncated object pack")
+		}
+
+		if base != "" {
+			baseData, ok := received[base]
+			if !ok {
+				return commits, fmt.Errorf("delta base %s of %s is not in the pack", base, hash)
+			}
+			if data, err = applyDelta(baseData, data); err != nil {
+				return commits, fmt.Errorf("object %s: %w", hash, err)
+			}
+		}
+
+		commit, err := objects.storeMGitObject(hash, data)
+		if err != nil {
+			return commits, err
+		}
+		received[hash] = data
+		if commit != nil {
+			commits = append(commits, commit)
+		}
+	}
+}
+
+// recordObjectMappings adds the hash mappings of received commits that
+// the mapping file doesn't have yet, in a single rewrite of the file
+func recordObjectMappings(rootDir string, commits []*MCommitStruct) error {
+	if len(commits) == 0 {
+		return nil
+	}
+	store := NewMappingStore(rootDir)
+	if err := store.migrate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(store.Path()), 0755); err != nil {
+		return fmt.Errorf("failed to create mapping directory: %w", err)
+	}
+
+	writer, err := newMappingFileWriter(store.Path()+".tmp", false)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort()
+
+	if err := store.ForEach(writer.Add); err != nil {
+		return err
+	}
+	for _, commit := range commits {
+		if commit.Type == MGitTagObject {
+			continue
+		}
+		pubkey := ""
+		if commit.Author != nil {
+			pubkey = commit.Author.Pubkey
+		}
+		if err := writer.Add(NostrCommitMapping{GitHash: commit.GitHash, MGitHash: commit.MGitHash, Pubkey: pubkey}); err != nil {
+			return err
+		}
+	}
+	return writer.Commit(store.Path())
+}
+
+// postObjectRequest sends a gzip-compressed request to one of the object
+// transfer endpoints. A server without them yields errNoObjectTransfer.
+func postObjectRequest(remoteName, url, token, contentType string, payload []byte) (*http.Response, error) {
+	req, err := newGzipRequest("POST", url, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAcceptEncoding(req)
+
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return resp, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		resp.Body.Close()
+		return nil, errNoObjectTransfer
+	}
+
+	defer resp.Body.Close()
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	bodyBytes, _ := io.ReadAll(body)
+	return nil, fmt.Errorf("error response from server: %s", string(bodyBytes))
+}
+
+// pushMGitObjects sends the server the MGit objects it lacks. The server is
+// told which objects we have and answers with the ones it wants; those go
+// in one delta-compressed pack, uploaded in chunks when it is big.
+func pushMGitObjects(repo *git.Repository, remoteName string) error {
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		return err
+	}
+	token := getTokenForRepo(remoteURL)
+	rootDir := mgitCommonDir()
+
+	local, err := listMGitObjects(rootDir)
+	if err != nil {
+		return fmt.Errorf("error listing MGit objects: %w", err)
+	}
+	offer, err := json.Marshal(objectNegotiation{Have: local})
+	if err != nil {
+		return err
+	}
+
+	resp, err := postObjectRequest(remoteName, repoAPIURL(remoteURL, "objects/negotiate"), token, objectNegotiationType, offer)
+	if err != nil {
+		return err
+	}
+	var reply objectNegotiation
+	body, err := decodedBody(resp)
+	if err == nil {
+		err = json.NewDecoder(body).Decode(&reply)
+		body.Close()
+	}
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error parsing negotiation response: %w", err)
+	}
+
+	// Only send what we offered
+	offered := map[string]bool{}
+	for _, hash := range local {
+		offered[hash] = true
+	}
+	want := []string{}
+	for _, hash := range reply.Want {
+		if offered[hash] {
+			want = append(want, hash)
+		}
+	}
+	if len(want) == 0 {
+		fmt.Println("MGit objects up to date on server")
+		return nil
+	}
+
+	var pack bytes.Buffer
+	stats, err := writeObjectPack(&pack, rootDir, want)
+	if err != nil {
+		return err
+	}
+	if err := uploadObjectPack(remoteName, remoteURL, token, pack.Bytes()); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent %s\n", stats)
+	return nil
+}
+
+// fetchMGitObjects downloads the MGit objects the server has and we lack,
+// telling it which ones we have. A shallow repository, or one with sparse
+// metadata, only wants the commits of its mappings. The hash mappings of
+// the received commits are recorded.
+func fetchMGitObjects(remoteName, url, token, destination string) error {
+	rootDir := readCommonDir(filepath.Join(destination, ".mgit"))
+	local, err := listMGitObjects(rootDir)
+	if err != nil {
+		return fmt.Errorf("error listing MGit objects: %w", err)
+	}
+	negotiation := objectNegotiation{Have: local}
+	if _, shallow := openShallowRepo(destination); shallow || sparseMetadataEnabled() {
+		if negotiation.Want, err = mappedObjectWants(rootDir); err != nil {
+			return fmt.Errorf("error reading mappings: %w", err)
+		}
+		if len(negotiation.Want) == 0 {
+			return nil
+		}
+	}
+	request, err := json.Marshal(negotiation)
+	if err != nil {
+		return err
+	}
+
+	resp, err := postObjectRequest(remoteName, repoAPIURL(url, "objects/fetch"), token, objectNegotiationType, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	repo, err := git.PlainOpenWithOptions(destination, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil {
+		return err
+	}
+	commits, err := readObjectPack(body, newReceivedObjects(repo, rootDir, true))
+	if recordErr := recordObjectMappings(rootDir, commits); err == nil {
+		err = recordErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(commits) > 0 {
+		fmt.Printf("Received %d MGit objects\n", len(commits))
+	}
+	return nil
+}
+
+// HandlePackObjects handles the pack-objects command, the server side of
+// object transfer. It reads a negotiation request on stdin. Normally it
+// writes a pack of the objects the requester lacks, or just those it
+// wants if it lists any; with --negotiate it instead answers which of the
+// offered objects this repository wants.
+func HandlePackObjects(args []string) {
+	negotiate := false
+	pubkey := ""
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--negotiate":
+			negotiate = true
+		case arg == "--pubkey" && i+1 < len(args):
+			pubkey = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--pubkey="):
+			pubkey = strings.TrimPrefix(arg, "--pubkey=")
+		default:
+			fmt.Println("Usage: mgit pack-objects [--negotiate] [--pubkey <npub>] < request")
+			os.Exit(1)
+		}
+	}
+
+	guard := startServing(mgitCommonDir(), pubkey)
+	guard.exitOnStop()
+	stdin := guard.Reader(os.Stdin, false)
+
+	var request objectNegotiation
+	if err := json.NewDecoder(stdin).Decode(&request); err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing request: %s\n", err)
+		os.Exit(1)
+	}
+
+	rootDir := mgitCommonDir()
+	local, err := listMGitObjects(rootDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing MGit objects: %s\n", err)
+		os.Exit(1)
+	}
+	have := map[string]bool{}
+	for _, hash := range local {
+		have[hash] = true
+	}
+	theirs := map[string]bool{}
+	for _, hash := range request.Have {
+		if isMGitHash(hash) {
+			theirs[hash] = true
+		}
+	}
+
+	if negotiate {
+		reply := objectNegotiation{Want: []string{}}
+		for hash := range theirs {
+			if !have[hash] {
+				reply.Want = append(reply.Want, hash)
+			}
+		}
+		sort.Strings(reply.Want)
+		json.NewEncoder(guard.Writer(os.Stdout, false)).Encode(reply)
+		return
+	}
+
+	send := []string{}
+	if len(request.Want) > 0 {
+		for _, hash := range request.Want {
+			if have[hash] && !theirs[hash] {
+				send = append(send, hash)
+			}
+		}
+	} else {
+		for _, hash := range local {
+			if !theirs[hash] {
+				send = append(send, hash)
+			}
+		}
+	}
+
+	stats, err := writeObjectPack(guard.Writer(os.Stdout, true), rootDir, send)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing object pack: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Packed %s\n", stats)
+}
+
+// HandleUnpackObjects handles the unpack-objects command, which stores the
+// objects of a pack read from stdin and records their hash mappings
+func HandleUnpackObjects(args []string) {
+	pubkey := ""
+	if len(args) == 2 && args[0] == "--pubkey" {
+		pubkey = args[1]
+	} else if len(args) == 1 && strings.HasPrefix(args[0], "--pubkey=") {
+		pubkey = strings.TrimPrefix(args[0], "--pubkey=")
+	} else if len(args) > 0 {
+		fmt.Println("Usage: mgit unpack-objects [--pubkey <npub>] < pack")
+		os.Exit(1)
+	}
+
+	rootDir := mgitCommonDir()
+	guard := startServing(rootDir, pubkey)
+	guard.exitOnStop()
+	repo := getRepo()
+	commits, err := readObjectPack(guard.Reader(os.Stdin, true), newReceivedObjects(repo, rootDir, false))
+	if recordErr := recordObjectMappings(rootDir, commits); err == nil {
+		err = recordErr
+	}
+	if limitErr := guard.Err(); limitErr != nil {
+		err = limitErr
+	}
+	if err != nil {
+		fmt.Printf("Error unpacking objects: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Unpacked %d objects\n", len(commits))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Packs bigger than push.chunkSize go to the server as a resumable upload
+// instead of in one request, so a dropped connection only costs the chunk
+// in flight:
+//
+//	POST objects/uploads            {"sha256": ..., "length": n} -> {"id", "offset"}
+//	PUT  objects/uploads/<id>       Content-Range: bytes a-b/n   -> {"offset"}
+//	GET  objects/uploads/<id>                                    -> {"offset"}
+//	POST objects/uploads/<id>/complete                           unpacks the pack
+//
+// The uploaded bytes are the gzip-compressed pack, named by their SHA-256.
+// Packing and compressing the same objects gives the same bytes, so a push
+// rerun after a failure finds the server's partial upload and carries on
+// from its offset.
+
+const defaultPackChunkSize = 4 << 20
+
+// errNoChunkedUpload means the server only takes packs in one request
+var errNoChunkedUpload = errors.New("server does not support chunked pack uploads")
+
+// packUpload is the server's view of an upload in progress
+type packUpload struct {
+	ID     string `json:"id,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// uploadObjectPack sends a pack to the server, in chunks when it is bigger
+// than push.chunkSize (0 sends every pack in one request)
+func uploadObjectPack(remoteName, remoteURL, token string, pack []byte) error {
+	chunkSize, err := packChunkSize()
+	if err != nil {
+		return err
+	}
+	if chunkSize > 0 && int64(len(pack)) > chunkSize {
+		err := uploadPackChunks(remoteName, remoteURL, token, pack, chunkSize)
+		if err != errNoChunkedUpload {
+			return err
+		}
+	}
+
+	resp, err := postObjectRequest(remoteName, repoAPIURL(remoteURL, "objects/pack"), token, "application/x-mgit-pack", pack)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func packChunkSize() (int64, error) {
+	value := GetConfigValue("push.chunkSize", "")
+	if value == "" {
+		return defaultPackChunkSize, nil
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("push.chunkSize: %w", err)
+	}
+	return size, nil
+}
+
+// uploadPackChunks sends a pack as a resumable upload. A chunk that fails
+// is retried, up to push.chunkRetries times in a row, from wherever the
+// server says the upload got to.
+func uploadPackChunks(remoteName, remoteURL, token string, pack []byte, chunkSize int64) error {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(pack)
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error compressing object pack: %w", err)
+	}
+	data := compressed.Bytes()
+	sum := sha256.Sum256(data)
+	total := int64(len(data))
+
+	retries, err := strconv.Atoi(GetConfigValue("push.chunkRetries", "3"))
+	if err != nil || retries < 0 {
+		return fmt.Errorf("push.chunkRetries must be a number of retries")
+	}
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return err
+	}
+	uploads := repoAPIURL(remoteURL, "objects/uploads")
+
+	request, _ := json.Marshal(map[string]interface{}{"sha256": hex.EncodeToString(sum[:]), "length": total})
+	var upload packUpload
+	if err := packUploadRequest(client, "POST", uploads, token, "application/json", request, nil, &upload); err != nil {
+		return err
+	}
+	if upload.ID == "" {
+		return fmt.Errorf("server did not name the upload")
+	}
+	if upload.Offset > 0 && upload.Offset < total {
+		fmt.Printf("Resuming upload of MGit objects at %d of %d bytes\n", upload.Offset, total)
+	}
+
+	location := uploads + "/" + upload.ID
+	offset, failures := upload.Offset, 0
+	for offset < total {
+		end := offset + chunkSize
+		if end > total {
+			end = total
+		}
+		header := http.Header{}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, total))
+		var progress packUpload
+		err := packUploadRequest(client, "PUT", location, token, "application/octet-stream", data[offset:end], header, &progress)
+		if err == nil && progress.Offset > offset && progress.Offset <= total {
+			offset, failures = progress.Offset, 0
+			continue
+		}
+
+		failures++
+		if failures > retries {
+			if err == nil {
+				err = fmt.Errorf("the server is at offset %d", progress.Offset)
+			}
+			return fmt.Errorf("upload of MGit objects failed at %d of %d bytes; push again to resume: %w", offset, total, err)
+		}
+		if err != nil {
+			// Whatever the server kept of the failed chunk needn't be sent again
+			fmt.Printf("Upload interrupted (%s), resuming\n", err)
+			if err := packUploadRequest(client, "GET", location, token, "", nil, nil, &progress); err != nil {
+				return err
+			}
+		}
+		if progress.Offset < 0 || progress.Offset > total {
+			return fmt.Errorf("server reported a bad upload offset %d", progress.Offset)
+		}
+		offset = progress.Offset
+	}
+
+	return packUploadRequest(client, "POST", location+"/complete", token, "", nil, nil, nil)
+}
+
+// packUploadRequest makes one request of a chunked upload and decodes the
+// JSON reply into reply, if given. A conflict over a chunk carries the
+// offset the server is at, so it isn't an error. A server without uploads, or that has
+// dropped this one, yields errNoChunkedUpload.
+func packUploadRequest(client *http.Client, method, url, token, contentType string, body []byte, header http.Header, reply *packUpload) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAcceptEncoding(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		return err
+	}
+	defer decoded.Close()
+
+	status := resp.StatusCode
+	switch {
+	case status == http.StatusOK, status == http.StatusCreated, status == http.StatusNoContent,
+		status == http.StatusConflict && reply != nil:
+		if reply == nil {
+			return nil
+		}
+		if err := json.NewDecoder(decoded).Decode(reply); err != nil {
+			return fmt.Errorf("error parsing upload response: %w", err)
+		}
+		return nil
+	case status == http.StatusNotFound, status == http.StatusMethodNotAllowed:
+		return errNoChunkedUpload
+	}
+	bodyBytes, _ := io.ReadAll(decoded)
+	return fmt.Errorf("error response from server: %s", string(bodyBytes))
+}
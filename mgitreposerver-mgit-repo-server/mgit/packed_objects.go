@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MGit objects are stored loose, one JSON file per object under
+// .mgit/objects/<2 chars>/<38 chars>, until mgit gc packs them:
+//
+//	.mgit/objects/pack/pack-<sha1>.pack   the objects, as an object pack
+//	.mgit/objects/pack/pack-<sha1>.idx    "<hash> <offset> <size>" per object
+//
+// A local pack has the layout of the packs objects travel in, with every
+// object in full so it can be read on its own from the offset its index
+// gives. The index is written after the pack, so a pack without one is
+// left over from an interrupted gc and ignored. A loose object is read
+// before a packed one.
+
+// objectPackIndex is where the objects of one local pack are
+type objectPackIndex struct {
+	Path    string // of the .pack
+	Offsets map[string]int64
+	Sizes   map[string]int
+}
+
+// packedObjects caches the pack indexes of each object store, as a
+// command reads many objects. Workers read objects while packs are
+// written, so it is guarded by packedObjectsMu.
+var (
+	packedObjects   = map[string][]*objectPackIndex{}
+	packedObjectsMu sync.Mutex
+)
+
+func mgitPackDir(rootDir string) string {
+	return filepath.Join(rootDir, "objects", "pack")
+}
+
+// loadObjectPacks returns the indexes of the local packs of an object store
+func loadObjectPacks(rootDir string) ([]*objectPackIndex, error) {
+	packedObjectsMu.Lock()
+	defer packedObjectsMu.Unlock()
+	if packs, ok := packedObjects[rootDir]; ok {
+		return packs, nil
+	}
+	indexes, err := filepath.Glob(filepath.Join(mgitPackDir(rootDir), "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(indexes)
+	packs := []*objectPackIndex{}
+	for _, index := range indexes {
+		pack, err := readObjectPackIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	packedObjects[rootDir] = packs
+	return packs, nil
+}
+
+// forgetObjectPacks drops the cached pack indexes of an object store once
+// its packs change
+func forgetObjectPacks(rootDir string) {
+	packedObjectsMu.Lock()
+	defer packedObjectsMu.Unlock()
+	delete(packedObjects, rootDir)
+}
+
+func readObjectPackIndex(path string) (*objectPackIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	pack := &objectPackIndex{
+		Path:    strings.TrimSuffix(path, ".idx") + ".pack",
+		Offsets: map[string]int64{},
+		Sizes:   map[string]int{},
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || !isMGitHash(fields[0]) {
+			return nil, fmt.Errorf("invalid entry %q in pack index %s", scanner.Text(), filepath.Base(path))
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset of %s in pack index %s", fields[0], filepath.Base(path))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size < 0 || size > maxMGitObjectSize {
+			return nil, fmt.Errorf("invalid size of %s in pack index %s", fields[0], filepath.Base(path))
+		}
+		pack.Offsets[fields[0]] = offset
+		pack.Sizes[fields[0]] = size
+	}
+	return pack, scanner.Err()
+}
+
+// readPackedObject reads one object of a local pack
+func (p *objectPackIndex) readPackedObject(hash string) ([]byte, error) {
+	file, err := os.Open(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, p.Sizes[hash])
+	if _, err := file.ReadAt(data, p.Offsets[hash]); err != nil {
+		return nil, fmt.Errorf("failed to read object %s from %s: %w", hash, filepath.Base(p.Path), err)
+	}
+	return data, nil
+}
+
+// readMGitObject reads an object of an object store, loose or packed
+func readMGitObject(rootDir, hash string) ([]byte, error) {
+	data, err := os.ReadFile(mgitObjectPath(rootDir, hash))
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	packs, packErr := loadObjectPacks(rootDir)
+	if packErr != nil {
+		return nil, packErr
+	}
+	for _, pack := range packs {
+		if _, ok := pack.Offsets[hash]; ok {
+			return pack.readPackedObject(hash)
+		}
+	}
+	return nil, err
+}
+
+// hasMGitObject reports whether an object store has an object, loose or
+// packed
+func hasMGitObject(rootDir, hash string) bool {
+	if _, err := os.Stat(mgitObjectPath(rootDir, hash)); err == nil {
+		return true
+	}
+	packs, err := loadObjectPacks(rootDir)
+	if err != nil {
+		return false
+	}
+	for _, pack := range packs {
+		if _, ok := pack.Offsets[hash]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listPackedObjects returns the hashes of the packed objects of an object
+// store
+func listPackedObjects(rootDir string) ([]string, error) {
+	packs, err := loadObjectPacks(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	for _, pack := range packs {
+		for hash := range pack.Offsets {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+// writeLocalObjectPack packs objects into a new local pack, named by the
+// checksum of its content, and returns its path
+func writeLocalObjectPack(rootDir string, objects map[string][]byte) (string, error) {
+	hashes := make([]string, 0, len(objects))
+	for hash := range objects {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	dir := mgitPackDir(rootDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, "tmp-pack-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	checksum := sha1.New()
+	out := io.MultiWriter(file, checksum)
+	index := &strings.Builder{}
+	offset := int64(0)
+	write := func(format string, args ...interface{}) {
+		n, _ := fmt.Fprintf(out, format, args...)
+		offset += int64(n)
+	}
+	write("%s\n", objectPackHeader)
+	for _, hash := range hashes {
+		write("%s full %d\n", hash, len(objects[hash]))
+		fmt.Fprintf(index, "%s %d %d\n", hash, offset, len(objects[hash]))
+		if _, err := out.Write(objects[hash]); err != nil {
+			return "", err
+		}
+		offset += int64(len(objects[hash]))
+	}
+	write("end\n")
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	base := filepath.Join(dir, "pack-"+hex.EncodeToString(checksum.Sum(nil)))
+	if err := os.Rename(file.Name(), base+".pack"); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(base+".idx.tmp", []byte(index.String()), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(base+".idx.tmp", base+".idx"); err != nil {
+		return "", err
+	}
+	forgetObjectPacks(rootDir)
+	return base + ".pack", nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// devNull is the path unified diffs use for a missing side
+const devNull = "/dev/null"
+
+// patchFile is the change to one file in a unified diff. Paths are relative
+// to the top of the repository, "" for the missing side of a creation or
+// deletion.
+type patchFile struct {
+	OldPath  string
+	NewPath  string
+	OldMode  string
+	NewMode  string
+	OldHash  string // abbreviated blob hashes from the "index" line, if any
+	NewHash  string
+	IsNew    bool
+	IsDelete bool
+	IsRename bool
+	IsCopy   bool
+	Binary   bool
+	Hunks    []*patchHunk
+}
+
+// patchHunk is one "@@" section of a file's diff
+type patchHunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []patchLine
+}
+
+// patchLine is a context, removed or added line. Text keeps its "\n"
+// unless the diff marked it "\ No newline at end of file".
+type patchLine struct {
+	Op   diffOp
+	Text string
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parsePatch parses the file diffs in a unified diff, with or without git's
+// extended headers. Text around the diffs, such as a commit message, is
+// skipped. strip removes that many leading components from the paths, like
+// patch -p.
+func parsePatch(text string, strip int) ([]*patchFile, error) {
+	lines := splitLines(text)
+	files := []*patchFile{}
+	var current *patchFile
+	inHeader := false
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			oldPath, newPath := splitGitDiffPaths(strings.TrimPrefix(line, "diff --git "))
+			current = &patchFile{OldPath: stripPath(oldPath, strip), NewPath: stripPath(newPath, strip)}
+			files = append(files, current)
+			inHeader = true
+
+		case inHeader && strings.HasPrefix(line, "new file mode "):
+			current.IsNew = true
+			current.OldPath = ""
+			current.NewMode = strings.TrimPrefix(line, "new file mode ")
+		case inHeader && strings.HasPrefix(line, "deleted file mode "):
+			current.IsDelete = true
+			current.NewPath = ""
+			current.OldMode = strings.TrimPrefix(line, "deleted file mode ")
+		case inHeader && strings.HasPrefix(line, "old mode "):
+			current.OldMode = strings.TrimPrefix(line, "old mode ")
+		case inHeader && strings.HasPrefix(line, "new mode "):
+			current.NewMode = strings.TrimPrefix(line, "new mode ")
+		case inHeader && strings.HasPrefix(line, "index "):
+			fields := strings.Fields(strings.TrimPrefix(line, "index "))
+			if hashes := strings.SplitN(fields[0], "..", 2); len(hashes) == 2 {
+				current.OldHash, current.NewHash = hashes[0], hashes[1]
+			}
+			if len(fields) > 1 && current.OldMode == "" && current.NewMode == "" {
+				current.OldMode, current.NewMode = fields[1], fields[1]
+			}
+		case inHeader && strings.HasPrefix(line, "rename from "):
+			current.IsRename = true
+			current.OldPath = strings.TrimPrefix(line, "rename from ")
+		case inHeader && strings.HasPrefix(line, "rename to "):
+			current.IsRename = true
+			current.NewPath = strings.TrimPrefix(line, "rename to ")
+		case inHeader && strings.HasPrefix(line, "copy from "):
+			current.IsCopy = true
+			current.OldPath = strings.TrimPrefix(line, "copy from ")
+		case inHeader && strings.HasPrefix(line, "copy to "):
+			current.IsCopy = true
+			current.NewPath = strings.TrimPrefix(line, "copy to ")
+		case inHeader && (strings.HasPrefix(line, "Binary files ") || line == "GIT binary patch"):
+			current.Binary = true
+
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldPath := diffHeaderPath(strings.TrimPrefix(line, "--- "))
+			newPath := diffHeaderPath(strings.TrimSuffix(strings.TrimPrefix(lines[i+1], "+++ "), "\n"))
+			i++
+
+			// A plain diff has no "diff --git" line to start the file
+			if current == nil || !inHeader {
+				current = &patchFile{}
+				files = append(files, current)
+			}
+			inHeader = false
+
+			if oldPath == devNull {
+				current.IsNew = true
+				current.OldPath = ""
+			} else if !current.IsRename && !current.IsCopy {
+				current.OldPath = stripPath(oldPath, strip)
+			}
+			if newPath == devNull {
+				current.IsDelete = true
+				current.NewPath = ""
+			} else if !current.IsRename && !current.IsCopy {
+				current.NewPath = stripPath(newPath, strip)
+			}
+
+		case strings.HasPrefix(line, "@@ "):
+			if current == nil {
+				return nil, fmt.Errorf("hunk without a file header at line %d", i+1)
+			}
+			inHeader = false
+			hunk, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			current.Hunks = append(current.Hunks, hunk)
+			i = next - 1
+
+		default:
+			// Anything else ends git's extended header
+			if inHeader && !strings.HasPrefix(line, "similarity index ") && !strings.HasPrefix(line, "dissimilarity index ") {
+				inHeader = false
+			}
+		}
+	}
+
+	for _, file := range files {
+		if file.OldPath == "" && file.NewPath == "" {
+			return nil, fmt.Errorf("patch has a file diff without a path")
+		}
+	}
+	return files, nil
+}
+
+// parseHunk parses the hunk whose header is lines[start], returning it and
+// the index of the first line after it
+func parseHunk(lines []string, start int) (*patchHunk, int, error) {
+	header := strings.TrimSuffix(lines[start], "\n")
+	match := hunkHeader.FindStringSubmatch(header)
+	if match == nil {
+		return nil, 0, fmt.Errorf("malformed hunk header at line %d: %s", start+1, header)
+	}
+
+	hunk := &patchHunk{OldLines: 1, NewLines: 1}
+	hunk.OldStart, _ = strconv.Atoi(match[1])
+	if match[2] != "" {
+		hunk.OldLines, _ = strconv.Atoi(match[2])
+	}
+	hunk.NewStart, _ = strconv.Atoi(match[3])
+	if match[4] != "" {
+		hunk.NewLines, _ = strconv.Atoi(match[4])
+	}
+
+	oldLeft, newLeft := hunk.OldLines, hunk.NewLines
+	i := start + 1
+	for ; i < len(lines) && (oldLeft > 0 || newLeft > 0); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "\\") {
+			markNoNewline(hunk)
+			continue
+		}
+
+		var op diffOp
+		switch {
+		case line == "\n":
+			// Some mailers strip the space off empty context lines
+			op, line = diffEqual, " \n"
+		case line[0] == ' ':
+			op = diffEqual
+		case line[0] == '-':
+			op = diffDelete
+		case line[0] == '+':
+			op = diffInsert
+		default:
+			return nil, 0, fmt.Errorf("corrupt patch at line %d", i+1)
+		}
+
+		switch op {
+		case diffEqual:
+			oldLeft--
+			newLeft--
+		case diffDelete:
+			oldLeft--
+		case diffInsert:
+			newLeft--
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return nil, 0, fmt.Errorf("corrupt patch at line %d: hunk is longer than its header says", i+1)
+		}
+		hunk.Lines = append(hunk.Lines, patchLine{Op: op, Text: line[1:]})
+	}
+
+	if oldLeft > 0 || newLeft > 0 {
+		return nil, 0, fmt.Errorf("corrupt patch: hunk at line %d is truncated", start+1)
+	}
+	if i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+		markNoNewline(hunk)
+		i++
+	}
+	return hunk, i, nil
+}
+
+func markNoNewline(hunk *patchHunk) {
+	if len(hunk.Lines) > 0 {
+		last := &hunk.Lines[len(hunk.Lines)-1]
+		last.Text = strings.TrimSuffix(last.Text, "\n")
+	}
+}
+
+// splitGitDiffPaths splits the "a/x b/y" of a "diff --git" line
+func splitGitDiffPaths(rest string) (string, string) {
+	// With identical names the line splits down the middle, which copes
+	// with spaces in the name
+	if len(rest)%2 == 1 {
+		half := len(rest) / 2
+		oldPath, newPath := rest[:half], rest[half+1:]
+		if strings.HasPrefix(oldPath, "a/") && strings.HasPrefix(newPath, "b/") && oldPath[2:] == newPath[2:] {
+			return oldPath, newPath
+		}
+	}
+	if idx := strings.Index(rest, " b/"); idx >= 0 {
+		return rest[:idx], rest[idx+1:]
+	}
+	if idx := strings.Index(rest, " "); idx >= 0 {
+		return rest[:idx], rest[idx+1:]
+	}
+	return rest, rest
+}
+
+// diffHeaderPath extracts the path from a "---" or "+++" line, dropping the
+// timestamp diff(1) appends after a tab
+func diffHeaderPath(value string) string {
+	if idx := strings.Index(value, "\t"); idx >= 0 {
+		value = value[:idx]
+	}
+	return strings.TrimSpace(value)
+}
+
+// stripPath removes the first n components of a patch path
+func stripPath(path string, n int) string {
+	if path == devNull {
+		return path
+	}
+	for i := 0; i < n; i++ {
+		idx := strings.Index(path, "/")
+		if idx < 0 {
+			break
+		}
+		path = path[idx+1:]
+	}
+	return path
+}
+
+// reverse turns the patch into the one that undoes it
+func (f *patchFile) reverse() {
+	f.OldPath, f.NewPath = f.NewPath, f.OldPath
+	f.OldMode, f.NewMode = f.NewMode, f.OldMode
+	f.OldHash, f.NewHash = f.NewHash, f.OldHash
+	f.IsNew, f.IsDelete = f.IsDelete, f.IsNew
+	for _, hunk := range f.Hunks {
+		hunk.OldStart, hunk.NewStart = hunk.NewStart, hunk.OldStart
+		hunk.OldLines, hunk.NewLines = hunk.NewLines, hunk.OldLines
+		for i := range hunk.Lines {
+			switch hunk.Lines[i].Op {
+			case diffDelete:
+				hunk.Lines[i].Op = diffInsert
+			case diffInsert:
+				hunk.Lines[i].Op = diffDelete
+			}
+		}
+	}
+}
+
+// applyHunks applies hunks to the lines of a file. A hunk whose context
+// doesn't match at the line it names is tried at the nearest offset where it
+// does, as patch(1) does without fuzz.
+func applyHunks(lines []string, hunks []*patchHunk) ([]string, error) {
+	result := []string{}
+	pos := 0
+	offset := 0
+
+	for _, hunk := range hunks {
+		preimage := []string{}
+		postimage := []string{}
+		for _, line := range hunk.Lines {
+			if line.Op != diffInsert {
+				preimage = append(preimage, line.Text)
+			}
+			if line.Op != diffDelete {
+				postimage = append(postimage, line.Text)
+			}
+		}
+
+		// A hunk that only adds lines names the line it goes after
+		expected := hunk.OldStart - 1
+		if hunk.OldLines == 0 {
+			expected = hunk.OldStart
+		}
+		expected += offset
+
+		at := findPreimage(lines, preimage, pos, expected)
+		if at < 0 {
+			return nil, fmt.Errorf("patch failed at line %d", hunk.OldStart)
+		}
+
+		result = append(result, lines[pos:at]...)
+		result = append(result, postimage...)
+		pos = at + len(preimage)
+		offset = at - (expected - offset)
+	}
+
+	return append(result, lines[pos:]...), nil
+}
+
+// findPreimage finds where preimage occurs in lines at or after from,
+// searching outwards from expected. It returns -1 if it doesn't occur.
+func findPreimage(lines, preimage []string, from, expected int) int {
+	matches := func(at int) bool {
+		if at < from || at+len(preimage) > len(lines) {
+			return false
+		}
+		return equalLines(lines[at:at+len(preimage)], preimage)
+	}
+
+	for delta := 0; expected-delta >= from || expected+delta <= len(lines); delta++ {
+		if matches(expected - delta) {
+			return expected - delta
+		}
+		if delta > 0 && matches(expected+delta) {
+			return expected + delta
+		}
+	}
+	return -1
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Once a clone is set up, mgit clone gets it ready the way an organization
+// wants it:
+//
+//  1. the hooks/ of init.templateDir are copied into .mgit/hooks, as git
+//     clone does with its templates
+//  2. with --recurse-config, the config the server recommends for the
+//     repository is applied, e.g. its relays, commit message rules or
+//     signing policy
+//  3. the post-clone hook of .mgit/hooks runs from the top of the new
+//     working tree, with MGIT_CLONE_URL set to the URL cloned from
+//
+// The server is not trusted with the client: it may only recommend the
+// keys in recommendedConfigKeys and commit message rules, and of the
+// security settings in recommendedSecurityConfig only the safe value, so
+// a recommendation can tighten them but never loosen them. Hooks, their
+// path and who gets notified are never taken from it.
+
+// recommendedConfigKeys are the keys a server may recommend any valid
+// value for, besides those of the commitmsg section
+var recommendedConfigKeys = map[string]bool{
+	"notify.relays":    true,
+	"core.abbrev":      true,
+	"mgit.displayHash": true,
+}
+
+// recommendedSecurityConfig are the security settings a server may
+// recommend, with the one value it may recommend for each
+var recommendedSecurityConfig = map[string]bool{
+	"commit.sign":        true,
+	"tag.sign":           true,
+	"pull.verify":        true,
+	"push.requireSigned": true,
+	"core.gitFallback":   false,
+}
+
+// recommendableConfig reports whether a server may recommend value for key
+func recommendableConfig(key, value string) bool {
+	section, name, found := strings.Cut(key, ".")
+	if !found || name == "" || strings.Contains(name, ".") {
+		return false
+	}
+	if safe, ok := recommendedSecurityConfig[key]; ok {
+		enabled, err := parseConfigBool(value)
+		return err == nil && enabled == safe
+	}
+	return recommendedConfigKeys[key] || section == "commitmsg"
+}
+
+// applyCloneTemplateHooks copies the hooks of init.templateDir into a new
+// clone, leaving any already there
+func applyCloneTemplateHooks(destination string) error {
+	templateDir := initTemplateDir("", false)
+	if templateDir == "" {
+		return nil
+	}
+	copied, err := copyTemplatePart(filepath.Join(templateDir, "hooks"), filepath.Join(destination, ".mgit", "hooks"))
+	if err != nil {
+		return err
+	}
+	if copied > 0 {
+		fmt.Printf("Copied %d hooks from template %s\n", copied, templateDir)
+	}
+	return nil
+}
+
+// fetchRecommendedConfig asks the server for the config it recommends for
+// a repository, as dotted keys and values. It returns none if the server
+// has no recommended-config endpoint.
+func fetchRecommendedConfig(url, token string) (map[string]string, error) {
+	req, err := http.NewRequest("GET", repoAPIURL(url, "recommended-config"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAcceptEncoding(req)
+
+	client, err := newHTTPClient("origin")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response from server: %s", string(data))
+	}
+
+	var recommended struct {
+		Config map[string]string `json:"config"`
+	}
+	if err := json.Unmarshal(data, &recommended); err != nil {
+		return nil, fmt.Errorf("error parsing recommended config: %w", err)
+	}
+	return recommended.Config, nil
+}
+
+// applyRecommendedConfig writes the server's recommended config into a new
+// clone's .mgit/config, skipping keys a server can't set and values the
+// schema rejects. Values the clone already has, such as those of clone's
+// own options, are kept.
+func applyRecommendedConfig(destination, url, token string) error {
+	recommended, err := fetchRecommendedConfig(url, token)
+	if err != nil {
+		return err
+	}
+	if len(recommended) == 0 {
+		fmt.Println("The server recommends no config for this repository")
+		return nil
+	}
+
+	configPath := filepath.Join(destination, ".mgit", "config")
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(recommended))
+	for key := range recommended {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	applied := 0
+	for _, key := range keys {
+		value := recommended[key]
+		if !recommendableConfig(key, value) {
+			fmt.Printf("Warning: Skipping recommended %s = %s: not a value the server can set\n", key, value)
+			continue
+		}
+		if err := validateConfigValue(key, value); err != nil {
+			fmt.Printf("Warning: Skipping recommended %s: %s\n", key, err)
+			continue
+		}
+		section, name, err := splitConfigKey(key)
+		if err != nil {
+			return err
+		}
+		if config.Get(section, name) != "" {
+			continue
+		}
+		config.Set(section, name, value)
+		fmt.Printf("  %s = %s\n", key, value)
+		applied++
+	}
+	if applied == 0 {
+		return nil
+	}
+	if err := config.Save(configPath); err != nil {
+		return fmt.Errorf("error saving MGit config: %w", err)
+	}
+	fmt.Printf("Applied %d recommended config values\n", applied)
+	return nil
+}
+
+// postCloneHookPath is where a new clone's post-clone hook is: in its
+// .mgit/hooks, whatever core.hooksPath says, so the hook can only be one
+// the user put there or got from their own init.templateDir
+func postCloneHookPath(destination string) (string, error) {
+	return filepath.Abs(filepath.Join(destination, ".mgit", "hooks", "post-clone"))
+}
+
+// runPostCloneHook runs the post-clone hook at hookPath from the top of a
+// new clone's working tree, where mgit stays for the rest of the command
+func runPostCloneHook(destination, hookPath, url string) error {
+	if err := os.Chdir(destination); err != nil {
+		return err
+	}
+	return runHookAt(hookPath, "post-clone", "", []string{"MGIT_CLONE_URL=" + url})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// serverPushPolicy is the policy document a server advertises for a
+// repository at its policy endpoint. Checking it before uploading fails a
+// push early and says why, rather than leaving it to the server to refuse.
+type serverPushPolicy struct {
+	RequireSigned     bool     `json:"require_signed"`
+	AllowedPubkeys    []string `json:"allowed_pubkeys,omitempty"`
+	ProtectedBranches []string `json:"protected_branches,omitempty"`
+}
+
+// serverPolicyPath is where the last policy fetched from a remote is kept,
+// for pushes made while the server can't be reached
+func serverPolicyPath(remoteName string) string {
+	return filepath.Join(mgitCommonDir(), "cache", "policy", remoteName+".json")
+}
+
+// loadServerPolicy returns a remote's push policy and where it came from:
+// "server", or "cached" when the server can't be asked (offline, or no
+// token). It returns nil when neither has one, e.g. for servers that
+// predate the policy endpoint.
+func loadServerPolicy(remoteName, remoteURL string, offline bool) (*serverPushPolicy, string, error) {
+	if !offline {
+		policy, err := fetchServerPolicy(remoteName, remoteURL)
+		switch {
+		case err == nil && policy == nil:
+			os.Remove(serverPolicyPath(remoteName))
+			return nil, "", nil
+		case err == nil:
+			if err := saveServerPolicy(remoteName, policy); err != nil {
+				fmt.Printf("Warning: could not cache the server's push policy: %s\n", err)
+			}
+			return policy, "server", nil
+		case err != errNoToken:
+			fmt.Printf("Warning: could not fetch the server's push policy, using the cached copy: %s\n", err)
+		}
+	}
+
+	data, err := os.ReadFile(serverPolicyPath(remoteName))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var policy serverPushPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, "", fmt.Errorf("error parsing cached push policy: %w", err)
+	}
+	return &policy, "cached", nil
+}
+
+// errNoToken means there is no token to authenticate a request with
+var errNoToken = fmt.Errorf("no authentication token")
+
+// fetchServerPolicy asks the server for a repository's push policy. It
+// returns nil if the server has no policy endpoint.
+func fetchServerPolicy(remoteName, remoteURL string) (*serverPushPolicy, error) {
+	token, ok := credentialFill(remoteURL)
+	if !ok {
+		token, ok = lookupStoredToken(remoteURL)
+	}
+	if !ok {
+		return nil, errNoToken
+	}
+
+	req, err := http.NewRequest("GET", repoAPIURL(remoteURL, "policy"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAcceptEncoding(req)
+
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response from server: %s", string(data))
+	}
+
+	var policy serverPushPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("error parsing push policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// saveServerPolicy caches a remote's push policy
+func saveServerPolicy(remoteName string, policy *serverPushPolicy) error {
+	target := serverPolicyPath(remoteName)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// protects reports whether the policy protects a branch, returning the
+// matching pattern
+func (p *serverPushPolicy) protects(branch string) (string, bool) {
+	for _, pattern := range p.ProtectedBranches {
+		if matched, err := path.Match(pattern, branch); err == nil && matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// allowsPubkey reports whether the policy lets commits by a pubkey in. An
+// empty list allows everyone; entries may be npubs or hex keys.
+func (p *serverPushPolicy) allowsPubkey(pubkey string) bool {
+	if len(p.AllowedPubkeys) == 0 {
+		return true
+	}
+	key, err := decodeNostrKey(pubkey, "npub")
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.AllowedPubkeys {
+		if allowedKey, err := decodeNostrKey(allowed, "npub"); err == nil && bytes.Equal(key, allowedKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServerPolicy adds the violations of the server's policy to a push
+// plan. Each says what to do about it, since the server would only say no.
+func checkServerPolicy(plan *pushPlan, policy *serverPushPolicy, commits map[string]*MCommitStruct) {
+	if pattern, ok := policy.protects(plan.Branch); ok {
+		plan.Violations = append(plan.Violations,
+			fmt.Sprintf("the server protects %s (%q); push to another branch and ask a maintainer to merge it", plan.Branch, pattern))
+	}
+
+	for _, commit := range plan.Commits {
+		mgitCommit := commits[commit.Hash.String()]
+		if mgitCommit == nil {
+			if policy.RequireSigned || len(policy.AllowedPubkeys) > 0 {
+				plan.Violations = append(plan.Violations,
+					fmt.Sprintf("commit %s has no MGit object, which the server's policy requires; recreate it with `mgit commit`", shortHash(commit.Hash.String())))
+			}
+			continue
+		}
+
+		if policy.RequireSigned {
+			if signed, err := verifyMGitSignature(mgitCommit); !signed || err != nil {
+				plan.Violations = append(plan.Violations,
+					fmt.Sprintf("the server requires signed commits and %s is not validly signed; recreate it with `mgit commit -S`", shortHash(mgitCommit.MGitHash)))
+			}
+		}
+		if mgitCommit.Author != nil && !policy.allowsPubkey(mgitCommit.Author.Pubkey) {
+			plan.Violations = append(plan.Violations,
+				fmt.Sprintf("commit %s is by %s, whose commits the server doesn't accept; ask a maintainer to add the key to allowed_pubkeys",
+					shortHash(mgitCommit.MGitHash), mgitCommit.Author.Pubkey))
+		}
+	}
+}
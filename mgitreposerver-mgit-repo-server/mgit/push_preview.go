@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// pushPlan describes what pushing the current branch would do, worked out
+// from local state alone: the remote-tracking refs stand in for what the
+// server has
+type pushPlan struct {
+	Remote    string
+	RemoteURL string
+	Branch    string
+	OldHash   plumbing.Hash // zero when the branch is new on the remote
+	NewHash   plumbing.Hash
+
+	// Commits the remote doesn't have, children before their parents
+	Commits []*object.Commit
+	// MGit objects of those commits, and the commits that have none
+	MGitObjects []string
+	NoMGit      []plumbing.Hash
+
+	FastForward bool
+	Violations  []string
+
+	// Where the server's policy came from: "server", "cached" or "" for none
+	ServerPolicy string
+
+	// The server's quota, if it has limits, with what the push would add
+	// to it (see checkServerQuota) and what it says about that
+	Quota         *serverQuota
+	UploadSize    int64
+	UploadLFSSize int64
+	Warnings      []string
+}
+
+// planPush works out what `mgit push` would send to a remote and checks it
+// against the push policy:
+//
+//	push.protectedBranches  branches (or globs) that may not be pushed to
+//	push.requireSigned      whether every pushed commit must be signed
+//
+// A push that would be rejected as a non-fast-forward is a violation too,
+// as is breaking the policy the server advertises (see checkServerPolicy),
+// which is fetched unless offline is set. Going over the server's quota
+// is only a warning.
+func planPush(repo *git.Repository, remoteName string, offline bool) (*pushPlan, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("error getting HEAD: %w", err)
+	}
+	if !head.Name().IsBranch() {
+		return nil, fmt.Errorf("cannot push a detached HEAD")
+	}
+	return planBranchPush(repo, remoteName, head.Name().Short(), head.Hash(), offline)
+}
+
+// planBranchPush plans a push of the Git commit newHash to a branch of the
+// remote, as planPush does for HEAD
+func planBranchPush(repo *git.Repository, remoteName, branch string, newHash plumbing.Hash, offline bool) (*pushPlan, error) {
+	plan := &pushPlan{
+		Remote:      remoteName,
+		Branch:      branch,
+		NewHash:     newHash,
+		FastForward: true,
+	}
+	var err error
+	plan.RemoteURL, err = getRemoteURL(repo, remoteName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything reachable from a remote-tracking ref is on the server
+	tracking := []plumbing.Hash{}
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	prefix := "refs/remotes/" + remoteName + "/"
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() != plumbing.HashReference || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		tracking = append(tracking, ref.Hash())
+		if strings.TrimPrefix(name, prefix) == plan.Branch {
+			plan.OldHash = ref.Hash()
+		}
+		return nil
+	})
+	remoteHas, err := gitAncestors(repo, tracking...)
+	if err != nil {
+		return nil, err
+	}
+
+	if plan.OldHash != plumbing.ZeroHash && plan.OldHash != plan.NewHash {
+		ours, err := gitAncestors(repo, plan.NewHash)
+		if err != nil {
+			return nil, err
+		}
+		plan.FastForward = ours[plan.OldHash]
+	}
+
+	storage := NewMGitStorage()
+	requireSigned := GetConfigBool("push.requireSigned", false)
+	mgitCommits := map[string]*MCommitStruct{}
+	err = walkGitCommits(repo, plan.NewHash, remoteHas, func(commit *object.Commit) {
+		plan.Commits = append(plan.Commits, commit)
+
+		mgitHash, err := storage.GetMGitHashFromGit(commit.Hash.String())
+		var mgitCommit *MCommitStruct
+		if err == nil {
+			mgitCommit, err = storage.GetCommit(mgitHash)
+		}
+		if err != nil {
+			plan.NoMGit = append(plan.NoMGit, commit.Hash)
+			if requireSigned {
+				plan.Violations = append(plan.Violations,
+					fmt.Sprintf("commit %s has no MGit object, so it is not signed (push.requireSigned)", shortHash(commit.Hash.String())))
+			}
+			return
+		}
+		plan.MGitObjects = append(plan.MGitObjects, mgitCommit.MGitHash)
+		mgitCommits[commit.Hash.String()] = mgitCommit
+
+		if requireSigned {
+			signed, err := verifyMGitSignature(mgitCommit)
+			switch {
+			case !signed:
+				plan.Violations = append(plan.Violations,
+					fmt.Sprintf("commit %s is not signed (push.requireSigned)", shortHash(mgitCommit.MGitHash)))
+			case err != nil:
+				plan.Violations = append(plan.Violations,
+					fmt.Sprintf("commit %s has an invalid signature: %s", shortHash(mgitCommit.MGitHash), err))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if pattern, ok := protectedBranch(plan.Branch); ok {
+		plan.Violations = append(plan.Violations,
+			fmt.Sprintf("branch %s is protected by %q (push.protectedBranches)", plan.Branch, pattern))
+	}
+	if !plan.FastForward {
+		plan.Violations = append(plan.Violations,
+			fmt.Sprintf("%s on %s has commits HEAD doesn't have; pull first (non-fast-forward)", plan.Branch, remoteName))
+	}
+
+	policy, source, err := loadServerPolicy(remoteName, plan.RemoteURL, offline)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		plan.ServerPolicy = source
+		checkServerPolicy(plan, policy, mgitCommits)
+	}
+	if !offline && len(plan.Commits) > 0 {
+		if err := checkServerQuota(repo, plan); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// runPrePushHook runs the pre-push hook on a planned push, which refuses
+// it by failing
+func runPrePushHook(plan *pushPlan) error {
+	ref := "refs/heads/" + plan.Branch
+	stdin := fmt.Sprintf("%s %s %s %s\n", ref, plan.NewHash, ref, plan.OldHash)
+	return runHook("pre-push", stdin, nil, plan.Remote, plan.RemoteURL)
+}
+
+// protectedBranch reports whether push.protectedBranches covers a branch,
+// returning the matching entry. Entries are separated by commas or spaces
+// and may be globs, e.g. "main release/*".
+func protectedBranch(branch string) (string, bool) {
+	value := GetConfigValue("push.protectedBranches", "")
+	for _, pattern := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if matched, err := path.Match(pattern, branch); err == nil && matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// gitAncestors returns the given Git commits and all their ancestors
+func gitAncestors(repo *git.Repository, starts ...plumbing.Hash) (map[plumbing.Hash]bool, error) {
+	seen := map[plumbing.Hash]bool{}
+	for _, start := range starts {
+		if seen[start] {
+			continue
+		}
+		commit, err := repo.CommitObject(start)
+		if err != nil {
+			return nil, err
+		}
+		iter := object.NewCommitPreorderIter(commit, seen, nil)
+		err = iter.ForEach(func(c *object.Commit) error {
+			seen[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return seen, nil
+}
+
+// walkGitCommits calls fn for the commits reachable from start but not in
+// exclude, children before their parents
+func walkGitCommits(repo *git.Repository, start plumbing.Hash, exclude map[plumbing.Hash]bool, fn func(*object.Commit)) error {
+	if exclude[start] {
+		return nil
+	}
+	commit, err := repo.CommitObject(start)
+	if err != nil {
+		return err
+	}
+	iter := object.NewCommitPreorderIter(commit, exclude, nil)
+	return iter.ForEach(func(c *object.Commit) error {
+		fn(c)
+		return nil
+	})
+}
+
+// printPushPlan reports a push plan like `git push --dry-run` does, with
+// the commits and MGit objects that would be uploaded
+func printPushPlan(plan *pushPlan) {
+	fmt.Printf("To %s\n", plan.RemoteURL)
+	newShort := shortHash(plan.NewHash.String())
+	switch {
+	case plan.OldHash == plumbing.ZeroHash:
+		fmt.Printf(" * [new branch]      %s -> %s\n", plan.Branch, plan.Branch)
+	case plan.OldHash == plan.NewHash:
+		fmt.Printf(" = [up to date]      %s -> %s\n", plan.Branch, plan.Branch)
+	case !plan.FastForward:
+		fmt.Printf(" ! [rejected]        %s -> %s (non-fast-forward)\n", plan.Branch, plan.Branch)
+	default:
+		fmt.Printf("   %s..%s  %s -> %s\n", shortHash(plan.OldHash.String()), newShort, plan.Branch, plan.Branch)
+	}
+
+	if len(plan.Commits) > 0 {
+		fmt.Printf("\nCommits to upload (%d):\n", len(plan.Commits))
+		storage := NewMGitStorage()
+		for _, commit := range plan.Commits {
+			label := shortHash(commit.Hash.String())
+			if mgitHash, err := storage.GetMGitHashFromGit(commit.Hash.String()); err == nil {
+				label = shortHash(mgitHash)
+			}
+			fmt.Printf("  %s %s\n", label, strings.SplitN(commit.Message, "\n", 2)[0])
+		}
+	}
+
+	if len(plan.MGitObjects) > 0 {
+		fmt.Printf("\nMGit objects to upload (%d):\n", len(plan.MGitObjects))
+		for _, hash := range plan.MGitObjects {
+			fmt.Printf("  %s\n", hash)
+		}
+	}
+	if len(plan.NoMGit) > 0 {
+		fmt.Printf("\nCommits without an MGit object (%d):\n", len(plan.NoMGit))
+		for _, hash := range plan.NoMGit {
+			fmt.Printf("  %s\n", hash)
+		}
+	}
+
+	switch plan.ServerPolicy {
+	case "server":
+		fmt.Println("\nChecked against the server's push policy")
+	case "cached":
+		fmt.Println("\nChecked against the server's push policy as last fetched")
+	}
+
+	if plan.Quota != nil {
+		fmt.Printf("\nUpload size: about %s (%s of LFS files); the server has %s\n",
+			formatByteSize(plan.UploadSize), formatByteSize(plan.UploadLFSSize), quotaUsage(plan.Quota.Size, plan.Quota.MaxSize))
+	}
+	if len(plan.Warnings) > 0 {
+		fmt.Printf("\nWarnings (%d):\n", len(plan.Warnings))
+		for _, warning := range plan.Warnings {
+			fmt.Printf("  %s\n", warning)
+		}
+	}
+
+	if len(plan.Violations) > 0 {
+		fmt.Printf("\nPolicy violations (%d):\n", len(plan.Violations))
+		for _, violation := range plan.Violations {
+			fmt.Printf("  %s\n", violation)
+		}
+	}
+}
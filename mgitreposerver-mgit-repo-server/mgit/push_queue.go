@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// QueuedPush is a push recorded while the server was unreachable
+type QueuedPush struct {
+	Remote   string    `json:"remote"`
+	Branch   string    `json:"branch"`
+	GitHash  string    `json:"git_hash"`
+	MGitHash string    `json:"mgit_hash,omitempty"`
+	Pubkey   string    `json:"pubkey,omitempty"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// getPushQueuePath returns the path to the offline push queue
+func getPushQueuePath() string {
+	return filepath.Join(mgitCommonDir(), "push_queue.json")
+}
+
+// loadPushQueue reads the queued pushes in the order they were recorded
+func loadPushQueue() ([]QueuedPush, error) {
+	data, err := os.ReadFile(getPushQueuePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []QueuedPush{}, nil
+		}
+		return nil, fmt.Errorf("failed to read push queue: %w", err)
+	}
+
+	var queue []QueuedPush
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, fmt.Errorf("failed to parse push queue: %w", err)
+	}
+	return queue, nil
+}
+
+// savePushQueue writes the push queue, removing the file once it is empty
+func savePushQueue(queue []QueuedPush) error {
+	queuePath := getPushQueuePath()
+	if len(queue) == 0 {
+		if err := os.Remove(queuePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove push queue: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(queue, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal push queue: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(queuePath), 0755); err != nil {
+		return fmt.Errorf("failed to create push queue directory: %w", err)
+	}
+
+	return os.WriteFile(queuePath, data, 0644)
+}
+
+// queuePush records the current branch tip, together with its MGit metadata,
+// so it can be pushed later with `mgit push --flush`
+func queuePush(repo *git.Repository, remoteName string) (*QueuedPush, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("error getting HEAD: %w", err)
+	}
+	if !head.Name().IsBranch() {
+		return nil, fmt.Errorf("cannot queue a push from a detached HEAD")
+	}
+
+	entry := QueuedPush{
+		Remote:   remoteName,
+		Branch:   head.Name().Short(),
+		GitHash:  head.Hash().String(),
+		QueuedAt: time.Now(),
+	}
+
+	storage := NewMGitStorage()
+	if mgitHash, err := storage.GetMGitHashFromGit(entry.GitHash); err == nil {
+		entry.MGitHash = mgitHash
+		entry.Pubkey, _ = storage.GetPubkeyForCommit(mgitHash)
+	}
+
+	queue, err := loadPushQueue()
+	if err != nil {
+		return nil, err
+	}
+	queue = append(queue, entry)
+
+	if err := savePushQueue(queue); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// flushPushQueue replays queued pushes in order. Each is checked again as
+// a push made now would be, against the server's current policy and
+// quota and, with verify, the pre-push hook; one that no longer passes is
+// dropped from the queue rather than pushed. It stops at the first failed
+// push and keeps that entry and the ones after it for the next flush.
+func flushPushQueue(repo *git.Repository, verify bool) error {
+	queue, err := loadPushQueue()
+	if err != nil {
+		return err
+	}
+
+	if len(queue) == 0 {
+		fmt.Println("Push queue is empty")
+		return nil
+	}
+
+	fmt.Printf("Replaying %d queued push(es)...\n", len(queue))
+	remotes := []string{}
+	pushed := map[string]map[string]string{} // remote, branch: Git hash
+	dropped := 0
+	for len(queue) > 0 {
+		entry := queue[0]
+		refspec := fmt.Sprintf("%s:refs/heads/%s", entry.GitHash, entry.Branch)
+
+		label := entry.GitHash[:7]
+		if entry.MGitHash != "" {
+			label = entry.MGitHash[:7]
+		}
+		fmt.Printf("Pushing %s [%s] to %s (queued %s)\n",
+			entry.Branch, label, entry.Remote, entry.QueuedAt.Format("Mon Jan 2 15:04:05 2006 -0700"))
+
+		plan, err := planBranchPush(repo, entry.Remote, entry.Branch, plumbing.NewHash(entry.GitHash), false)
+		if err != nil {
+			if saveErr := savePushQueue(queue); saveErr != nil {
+				return saveErr
+			}
+			return fmt.Errorf("error planning push of %s, %d push(es) remain queued: %w", entry.Branch, len(queue), err)
+		}
+		refused := plan.Violations
+		if len(refused) == 0 && verify {
+			if err := runPrePushHook(plan); err != nil {
+				refused = []string{err.Error()}
+			}
+		}
+		if len(refused) > 0 {
+			fmt.Printf("Dropping queued push of %s [%s], which is refused now:\n", entry.Branch, label)
+			for _, reason := range refused {
+				fmt.Printf("  %s\n", reason)
+			}
+			queue = queue[1:]
+			if err := savePushQueue(queue); err != nil {
+				return err
+			}
+			dropped++
+			continue
+		}
+		for _, warning := range plan.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+
+		if err := runGitPush(repo, entry.Remote, refspec); err != nil {
+			if saveErr := savePushQueue(queue); saveErr != nil {
+				return saveErr
+			}
+			return fmt.Errorf("push of %s failed, %d push(es) remain queued: %w", entry.Branch, len(queue), err)
+		}
+
+		queue = queue[1:]
+		if err := savePushQueue(queue); err != nil {
+			return err
+		}
+		if !containsString(remotes, entry.Remote) {
+			remotes = append(remotes, entry.Remote)
+			pushed[entry.Remote] = map[string]string{}
+		}
+		pushed[entry.Remote][entry.Branch] = entry.GitHash
+	}
+
+	if dropped > 0 {
+		fmt.Printf("Queued pushes delivered, except %d dropped\n", dropped)
+	} else {
+		fmt.Println("All queued pushes delivered")
+	}
+
+	for _, remote := range remotes {
+		if err := uploadMGitData(repo, remote); err != nil {
+			fmt.Printf("Warning: Failed to upload MGit metadata to %s: %s\n", remote, err)
+		}
+		if err := updateRemoteTrackingRefs(repo, NewMGitStorage(), remote); err != nil {
+			fmt.Printf("Warning: Failed to update MGit remote-tracking branches: %s\n", err)
+		}
+
+		// Only a branch that hasn't moved on since it was queued is
+		// summarized as the server has it
+		branches := []string{}
+		for branch, hash := range pushed[remote] {
+			ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+			if err == nil && ref.Hash().String() == hash {
+				branches = append(branches, branch)
+			}
+		}
+		sort.Strings(branches)
+		if err := pushBranchSummaries(repo, remote, branches); err != nil {
+			fmt.Printf("Warning: Failed to upload branch summaries to %s: %s\n", remote, err)
+		}
+	}
+	return nil
+}
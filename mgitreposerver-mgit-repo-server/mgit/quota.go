@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// A server can hold a repository to a quota, which it reports at its quota
+// endpoint along with how much the repository uses:
+//
+//	mgit quota [<remote>]
+//
+// prints both, and mgit push estimates what a push adds and warns before
+// one that would go over the quota, or past the server's warn_percent of
+// it. The estimate counts the new Git objects uncompressed, the LFS files
+// their pointers name and the MGit objects, so it errs on the high side;
+// the push goes ahead either way, since the server has the last word.
+
+// serverQuota is a repository's disk usage and quota, in bytes. A zero
+// limit is no limit.
+type serverQuota struct {
+	Size        int64   `json:"size"`
+	GitSize     int64   `json:"git_size"`
+	MGitSize    int64   `json:"mgit_size"`
+	LFSSize     int64   `json:"lfs_size"`
+	MaxSize     int64   `json:"max_size"`
+	MaxLFSSize  int64   `json:"max_lfs_size"`
+	WarnPercent float64 `json:"warn_percent"`
+}
+
+// lfsPointerPrefix starts every Git LFS pointer file
+const lfsPointerPrefix = "version https://git-lfs.github.com/spec/v1\n"
+
+// HandleQuota handles the quota command
+func HandleQuota(args []string) {
+	if len(args) > 1 || len(args) == 1 && strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: mgit quota [<remote>]")
+		os.Exit(1)
+	}
+	repo := getRepo()
+	remoteName := defaultRemote(repo)
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	quota, err := fetchServerQuota(remoteName, remoteURL)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if quota == nil {
+		fmt.Printf("%s doesn't report quotas\n", remoteName)
+		return
+	}
+
+	fmt.Printf("Quota of %s (%s):\n", remoteName, remoteURL)
+	fmt.Printf("  total  %s\n", quotaUsage(quota.Size, quota.MaxSize))
+	fmt.Printf("  git    %s\n", formatByteSize(quota.GitSize))
+	fmt.Printf("  mgit   %s\n", formatByteSize(quota.MGitSize))
+	fmt.Printf("  lfs    %s\n", quotaUsage(quota.LFSSize, quota.MaxLFSSize))
+	for _, warning := range quota.warnings(0, 0) {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+}
+
+// quotaUsage is "<used>", or "<used> of <limit> (<n>%)" under a limit
+func quotaUsage(used, limit int64) string {
+	if limit <= 0 {
+		return formatByteSize(used)
+	}
+	return fmt.Sprintf("%s of %s (%d%%)", formatByteSize(used), formatByteSize(limit), used*100/limit)
+}
+
+// formatByteSize formats a byte count in binary units, e.g. "1.5 MiB"
+func formatByteSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		size /= 1024
+		if size < 1024 || unit == "GiB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+	}
+	return ""
+}
+
+// warnings says where the repository would stand against its quota after
+// adding size bytes, of which lfsSize are LFS files: over a limit, or past
+// warn_percent of one
+func (q *serverQuota) warnings(size, lfsSize int64) []string {
+	warnings := []string{}
+	check := func(what string, used, added, limit int64) {
+		if limit <= 0 {
+			return
+		}
+		after := used + added
+		percent := q.WarnPercent
+		if percent <= 0 || percent > 100 {
+			percent = 90
+		}
+		switch {
+		case after > limit && added > 0:
+			warnings = append(warnings, fmt.Sprintf("this push adds about %s, which would take %s to %s, over its quota of %s",
+				formatByteSize(added), what, formatByteSize(after), formatByteSize(limit)))
+		case after > limit:
+			warnings = append(warnings, fmt.Sprintf("%s is over its quota: %s of %s", what, formatByteSize(after), formatByteSize(limit)))
+		case float64(after)*100 > percent*float64(limit) && added > 0:
+			warnings = append(warnings, fmt.Sprintf("this push would take %s to %d%% of its quota (%s of %s)",
+				what, after*100/limit, formatByteSize(after), formatByteSize(limit)))
+		case float64(after)*100 > percent*float64(limit):
+			warnings = append(warnings, fmt.Sprintf("%s is at %d%% of its quota (%s of %s)",
+				what, after*100/limit, formatByteSize(after), formatByteSize(limit)))
+		}
+	}
+	check("the repository", q.Size, size, q.MaxSize)
+	check("its LFS files", q.LFSSize, lfsSize, q.MaxLFSSize)
+	return warnings
+}
+
+// fetchServerQuota asks the server for a repository's disk usage and
+// quota. It returns nil if the server has no quota endpoint.
+func fetchServerQuota(remoteName, remoteURL string) (*serverQuota, error) {
+	token, ok := credentialFill(remoteURL)
+	if !ok {
+		token, ok = lookupStoredToken(remoteURL)
+	}
+	if !ok {
+		return nil, errNoToken
+	}
+
+	req, err := http.NewRequest("GET", repoAPIURL(remoteURL, "quota"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAcceptEncoding(req)
+
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response from server: %s", string(data))
+	}
+
+	var quota serverQuota
+	if err := json.Unmarshal(data, &quota); err != nil {
+		return nil, fmt.Errorf("error parsing quota: %w", err)
+	}
+	return &quota, nil
+}
+
+// checkServerQuota adds to a push plan what the push would upload and the
+// warnings of the server's quota. A server that can't be asked is no
+// reason to hold a push up, so it only warns then.
+func checkServerQuota(repo *git.Repository, plan *pushPlan) error {
+	quota, err := fetchServerQuota(plan.Remote, plan.RemoteURL)
+	switch {
+	case err == errNoToken:
+		return nil
+	case err != nil:
+		fmt.Printf("Warning: could not fetch the server's quota: %s\n", err)
+		return nil
+	case quota == nil || quota.MaxSize <= 0 && quota.MaxLFSSize <= 0:
+		return nil
+	}
+
+	plan.Quota = quota
+	if plan.UploadSize, plan.UploadLFSSize, err = estimatePushSize(repo, plan); err != nil {
+		return fmt.Errorf("error estimating push size: %w", err)
+	}
+	plan.Warnings = append(plan.Warnings, quota.warnings(plan.UploadSize, plan.UploadLFSSize)...)
+	return nil
+}
+
+// estimatePushSize adds up what a push would store on the server: the Git
+// objects of its commits that the commits the remote has don't share,
+// uncompressed, the LFS files their pointers name, and the MGit objects.
+// lfsSize is the part that is LFS files.
+func estimatePushSize(repo *git.Repository, plan *pushPlan) (size, lfsSize int64, err error) {
+	pushed := map[plumbing.Hash]bool{}
+	for _, commit := range plan.Commits {
+		pushed[commit.Hash] = true
+	}
+
+	// Trees and blobs the remote has, from the commits the pushed ones
+	// build on; those missing from a shallow clone are left out
+	seen := map[plumbing.Hash]bool{}
+	for _, commit := range plan.Commits {
+		for _, parent := range commit.ParentHashes {
+			if pushed[parent] {
+				continue
+			}
+			if parentCommit, err := repo.CommitObject(parent); err == nil {
+				if _, _, err := treeSize(repo, parentCommit.TreeHash, seen); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	for _, commit := range plan.Commits {
+		obj, err := repo.Storer.EncodedObject(plumbing.CommitObject, commit.Hash)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += obj.Size()
+		treeBytes, lfsBytes, err := treeSize(repo, commit.TreeHash, seen)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += treeBytes + lfsBytes
+		lfsSize += lfsBytes
+	}
+
+	storage := NewMGitStorage()
+	for _, hash := range plan.MGitObjects {
+		data, err := readMGitObject(storage.RootDir, hash)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += int64(len(data))
+	}
+	return size, lfsSize, nil
+}
+
+// treeSize adds up the objects of a tree not in seen, adding them to it:
+// the trees and blobs in bytes, and apart the LFS files named by pointers
+// among the blobs. Submodules are another repository's and aren't counted.
+func treeSize(repo *git.Repository, hash plumbing.Hash, seen map[plumbing.Hash]bool) (size, lfsSize int64, err error) {
+	if seen[hash] {
+		return 0, 0, nil
+	}
+	seen[hash] = true
+	tree, err := repo.TreeObject(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	obj, err := repo.Storer.EncodedObject(plumbing.TreeObject, hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	size = obj.Size()
+
+	for _, entry := range tree.Entries {
+		switch {
+		case entry.Mode == filemode.Dir:
+			treeBytes, lfsBytes, err := treeSize(repo, entry.Hash, seen)
+			if err != nil {
+				return 0, 0, err
+			}
+			size += treeBytes
+			lfsSize += lfsBytes
+		case entry.Mode == filemode.Submodule || seen[entry.Hash]:
+		default:
+			seen[entry.Hash] = true
+			blob, err := repo.Storer.EncodedObject(plumbing.BlobObject, entry.Hash)
+			if err != nil {
+				return 0, 0, err
+			}
+			size += blob.Size()
+			if lfsBytes, ok := lfsPointerSize(blob); ok {
+				lfsSize += lfsBytes
+			}
+		}
+	}
+	return size, lfsSize, nil
+}
+
+// lfsPointerSize returns the size of the file a blob points to, if the
+// blob is a Git LFS pointer
+func lfsPointerSize(blob plumbing.EncodedObject) (int64, bool) {
+	if blob.Size() > 1024 {
+		return 0, false
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return 0, false
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil || !strings.HasPrefix(string(data), lfsPointerPrefix) {
+		return 0, false
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "size "); ok {
+			size, err := strconv.ParseInt(value, 10, 64)
+			return size, err == nil && size >= 0
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Rebasing rewrites commits, and with them their MGit hashes, which chain
+// through the parents. Plain git leaves the rewritten commits without MGit
+// commits; mgit rebase replays each commit itself, so every new commit gets
+// an MGit hash over its new parents, and marks the mappings of the old ones
+// superseded by the new.
+//
+// A rebase stopped on conflicts is kept in .mgit/rebase-state.json until
+// --continue or --abort.
+
+const rebaseStateFile = "rebase-state.json"
+
+// rebaseState is a rebase in progress
+type rebaseState struct {
+	HeadName  string            `json:"head_name"` // the branch being rebased
+	OrigHead  string            `json:"orig_head"` // its Git commit before the rebase
+	Onto      string            `json:"onto"`
+	Todo      []string          `json:"todo"`    // Git commits still to replay, oldest first
+	Current   string            `json:"current"` // the commit stopped on
+	Conflicts []string          `json:"conflicts,omitempty"`
+	Sign      bool              `json:"sign"`
+	Rewritten map[string]string `json:"rewritten"` // old MGit hash -> new MGit hash
+}
+
+func rebaseStatePath() string {
+	return filepath.Join(mgitDir(), rebaseStateFile)
+}
+
+// loadRebaseState returns the rebase in progress, or nil
+func loadRebaseState() (*rebaseState, error) {
+	data, err := os.ReadFile(rebaseStatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &rebaseState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %w", rebaseStateFile, err)
+	}
+	return state, nil
+}
+
+func (s *rebaseState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rebaseStatePath(), data, 0644)
+}
+
+// HandleRebase handles the rebase command, which replays the commits of
+// the current branch that upstream lacks on top of upstream (or of
+// --onto), regenerating their MGit hashes and mappings
+func HandleRebase(args []string) {
+	onto := ""
+	sign := GetConfigBool("commit.sign", false)
+	revisions := []string{}
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--continue":
+			continueRebase()
+			return
+		case arg == "--abort":
+			if err := abortRebase(); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		case arg == "--onto" && i+1 < len(args):
+			i++
+			onto = args[i]
+		case strings.HasPrefix(arg, "--onto="):
+			onto = strings.TrimPrefix(arg, "--onto=")
+		case arg == "-S" || arg == "--sign":
+			sign = true
+		case arg == "--no-sign":
+			sign = false
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	if len(revisions) != 1 {
+		fmt.Println("Usage: mgit rebase [--onto <newbase>] [-S] <upstream>")
+		fmt.Println("       mgit rebase --continue | --abort")
+		os.Exit(1)
+	}
+
+	if state, err := loadRebaseState(); err != nil || state != nil {
+		fmt.Println("Error: a rebase is in progress; run mgit rebase --continue or --abort")
+		os.Exit(1)
+	}
+	if merge, err := loadPendingMerge(); err != nil || merge != nil {
+		fmt.Println("Error: a merge is in progress; commit the result or run mgit merge --abort")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		fmt.Printf("Error getting HEAD: %s\n", err)
+		os.Exit(1)
+	}
+	if !head.Name().IsBranch() {
+		fmt.Println("Error: cannot rebase a detached HEAD")
+		os.Exit(1)
+	}
+	upstream, err := resolveGitRevision(repo, revisions[0])
+	if err != nil {
+		fmt.Printf("Error: unknown revision %s\n", revisions[0])
+		os.Exit(1)
+	}
+	ontoHash := upstream
+	if onto != "" {
+		if ontoHash, err = resolveGitRevision(repo, onto); err != nil {
+			fmt.Printf("Error: unknown revision %s\n", onto)
+			os.Exit(1)
+		}
+	}
+
+	todo, err := rebaseTodo(repo, head.Hash(), upstream)
+	if err != nil {
+		fmt.Printf("Error reading history: %s\n", err)
+		os.Exit(1)
+	}
+	if len(todo) == 0 || firstParent(repo, todo[0]) == ontoHash {
+		fmt.Printf("Current branch %s is up to date.\n", head.Name().Short())
+		return
+	}
+
+	// The replayed commits are made from the index, so it must be clean
+	if staged, err := hasStagedChanges(repo); err != nil {
+		fmt.Printf("Error getting status: %s\n", err)
+		os.Exit(1)
+	} else if staged {
+		fmt.Println("Error: you have staged changes; commit or unstage them before rebasing")
+		os.Exit(1)
+	}
+
+	// Check the signer up front rather than after rewriting half the branch
+	if sign {
+		signer, err := openCommitSigner(GetConfigValue("user.pubkey", ""))
+		if err != nil {
+			fmt.Printf("Error: cannot sign rebased commits: %s\n", err)
+			os.Exit(1)
+		}
+		signer.Close()
+	}
+
+	if err := switchWorktree(repo, head.Hash(), ontoHash); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if err := setRebaseBranch(repo, head.Name(), ontoHash); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	state := &rebaseState{
+		HeadName:  head.Name().String(),
+		OrigHead:  head.Hash().String(),
+		Onto:      ontoHash.String(),
+		Sign:      sign,
+		Rewritten: map[string]string{},
+	}
+	for _, hash := range todo {
+		state.Todo = append(state.Todo, hash.String())
+	}
+	runRebase(repo, state)
+}
+
+// rebaseTodo lists the commits of head that upstream lacks, oldest first.
+// Like git, it follows first parents and drops merge commits.
+func rebaseTodo(repo *git.Repository, head, upstream plumbing.Hash) ([]plumbing.Hash, error) {
+	excluded, err := gitAncestors(repo, upstream)
+	if err != nil {
+		return nil, err
+	}
+	todo := []plumbing.Hash{}
+	for hash := head; !hash.IsZero() && !excluded[hash]; {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		if commit.NumParents() <= 1 {
+			todo = append([]plumbing.Hash{hash}, todo...)
+		}
+		hash = firstParent(repo, hash)
+	}
+	return todo, nil
+}
+
+// firstParent returns a commit's first parent, or the zero hash
+func firstParent(repo *git.Repository, hash plumbing.Hash) plumbing.Hash {
+	commit, err := repo.CommitObject(hash)
+	if err != nil || commit.NumParents() == 0 {
+		return plumbing.ZeroHash
+	}
+	return commit.ParentHashes[0]
+}
+
+// setRebaseBranch points the branch, and its MGit ref, at a commit
+func setRebaseBranch(repo *git.Repository, branch plumbing.ReferenceName, hash plumbing.Hash) error {
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+		return fmt.Errorf("error updating %s: %w", branch.Short(), err)
+	}
+	storage := NewMGitStorage()
+	if mgitHash, err := storage.GetMGitHashFromGit(hash.String()); err == nil {
+		return storage.UpdateRef(branch.String(), mgitHash)
+	}
+	return nil
+}
+
+// runRebase replays the commits left in state, stopping on conflicts
+func runRebase(repo *git.Repository, state *rebaseState) {
+	for len(state.Todo) > 0 {
+		hash := plumbing.NewHash(state.Todo[0])
+		state.Todo = state.Todo[1:]
+		state.Current = hash.String()
+
+		head, err := repo.Head()
+		if err != nil {
+			stopRebase(state, fmt.Sprintf("Error getting HEAD: %s", err))
+		}
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			stopRebase(state, fmt.Sprintf("Error reading %s: %s", shortHash(hash.String()), err))
+		}
+		subject, _, _ := strings.Cut(commit.Message, "\n")
+		label := fmt.Sprintf("%s (%s)", shortHash(hash.String()), subject)
+
+		result, err := mergeTrees(repo, firstParent(repo, hash), head.Hash(), hash, mergeLabels{Ours: "HEAD", Theirs: label})
+		if err == nil {
+			err = checkMergeWorktree(repo, head.Hash(), result)
+		}
+		if err == nil {
+			err = writeMergeResult(repo, result)
+		}
+		if err != nil {
+			// Nothing of this commit was written, so it can be retried
+			state.Todo = append([]string{hash.String()}, state.Todo...)
+			state.Current = ""
+			stopRebase(state, fmt.Sprintf("Error replaying %s: %s", label, err))
+		}
+
+		if len(result.Conflicts) > 0 {
+			for _, conflict := range result.Conflicts {
+				fmt.Println(conflict.Message)
+				state.Conflicts = append(state.Conflicts, conflict.Path)
+			}
+			stopRebase(state, fmt.Sprintf("Could not apply %s\n"+
+				"Resolve all conflicts, stage them with mgit add, then run mgit rebase --continue.\n"+
+				"To stop and go back to the branch as it was, run mgit rebase --abort.", label))
+		}
+		replayCommit(repo, state, hash)
+	}
+	finishRebase(repo, state)
+}
+
+// replayCommit commits what is staged as the rewrite of a commit, keeping
+// its author and message, or drops it when it changes nothing
+func replayCommit(repo *git.Repository, state *rebaseState, hash plumbing.Hash) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		stopRebase(state, fmt.Sprintf("Error reading %s: %s", shortHash(hash.String()), err))
+	}
+	staged, err := hasStagedChanges(repo)
+	if err != nil {
+		stopRebase(state, fmt.Sprintf("Error getting status: %s", err))
+	}
+	if !staged {
+		fmt.Printf("dropping %s -- patch contents already upstream\n", shortHash(hash.String()))
+		state.Current, state.Conflicts = "", nil
+		return
+	}
+
+	storage := NewMGitStorage()
+	oldMGitHash, _ := storage.GetMGitHashFromGit(hash.String())
+	author := &Signature{Name: commit.Author.Name, Email: commit.Author.Email, When: commit.Author.When}
+	if oldMGitHash != "" {
+		if old, err := storage.GetCommit(oldMGitHash); err == nil && old.Author != nil {
+			author.Pubkey = old.Author.Pubkey
+		}
+	}
+	// Like git, the committer is whoever rebases
+	user, committer, err := commitIdentities(GetConfigValue("user.name", ""), GetConfigValue("user.email", ""), GetConfigValue("user.pubkey", ""), "", "", "")
+	if err != nil {
+		stopRebase(state, fmt.Sprintf("Error: %s", err))
+	}
+	if committer == nil {
+		committer = user
+	}
+
+	// Only the author's own key can sign; others' commits stay unsigned
+	var signer Signer
+	if state.Sign && author.Pubkey != "" {
+		if signer, err = openCommitSigner(author.Pubkey); err != nil {
+			fmt.Printf("Warning: %s is not signed: %s\n", shortHash(hash.String()), err)
+			signer = nil
+		}
+	}
+	newHash, err := MGitCommit(commit.Message, &MCommitOptions{
+		Author:    author,
+		Committer: committer,
+		Signer:    signer,
+	})
+	if signer != nil {
+		signer.Close()
+	}
+	if err != nil {
+		stopRebase(state, fmt.Sprintf("Error committing %s: %s", shortHash(hash.String()), err))
+	}
+	runPostCommitHook(storage, newHash)
+	if oldMGitHash != "" && author.Pubkey != "" {
+		state.Rewritten[oldMGitHash] = newHash.String()
+	}
+	state.Current, state.Conflicts = "", nil
+}
+
+// stopRebase saves the rebase for --continue or --abort and exits
+func stopRebase(state *rebaseState, message string) {
+	if err := state.save(); err != nil {
+		fmt.Printf("Error saving rebase state: %s\n", err)
+	}
+	fmt.Println(message)
+	os.Exit(1)
+}
+
+// finishRebase marks the rewritten commits' mappings superseded and
+// forgets the rebase
+func finishRebase(repo *git.Repository, state *rebaseState) {
+	if err := NewMGitStorage().Mappings().Supersede(state.Rewritten); err != nil {
+		fmt.Printf("Warning: could not mark the old mappings superseded: %s\n", err)
+	}
+	os.Remove(rebaseStatePath())
+	fmt.Printf("Successfully rebased and updated %s (%d MGit commits rewritten).\n", state.HeadName, len(state.Rewritten))
+}
+
+// continueRebase commits the resolution of the commit the rebase stopped
+// on and replays the rest
+func continueRebase() {
+	state, err := loadRebaseState()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if state == nil {
+		fmt.Println("Error: no rebase in progress")
+		os.Exit(1)
+	}
+	repo := getRepo()
+	if state.Current != "" {
+		unresolved, err := (&pendingMerge{Conflicts: state.Conflicts}).Unresolved(repo)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if len(unresolved) > 0 {
+			fmt.Printf("Error: resolve the conflicts in these files and stage them first:\n  %s\n", strings.Join(unresolved, "\n  "))
+			os.Exit(1)
+		}
+		replayCommit(repo, state, plumbing.NewHash(state.Current))
+	}
+	runRebase(repo, state)
+}
+
+// abortRebase puts the branch, worktree and index back as they were
+func abortRebase() error {
+	state, err := loadRebaseState()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no rebase in progress")
+	}
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	origHead := plumbing.NewHash(state.OrigHead)
+
+	// Every path that differs, plus conflicted ones the index doesn't show
+	current, err := treeEntries(repo, head.Hash())
+	if err != nil {
+		return err
+	}
+	orig, err := treeEntries(repo, origHead)
+	if err != nil {
+		return err
+	}
+	paths := map[string]bool{}
+	for path, entry := range current {
+		if !sameEntry(entry, orig[path]) {
+			paths[path] = true
+		}
+	}
+	for path := range orig {
+		if current[path] == nil {
+			paths[path] = true
+		}
+	}
+	for _, path := range state.Conflicts {
+		paths[path] = true
+	}
+	restore := &mergeTreeResult{Gitlinks: map[string]*mergeEntry{}}
+	for path := range paths {
+		if err := restore.take(repo, path, orig[path]); err != nil {
+			return err
+		}
+	}
+	if err := writeMergeResult(repo, restore); err != nil {
+		return err
+	}
+	if err := setRebaseBranch(repo, plumbing.ReferenceName(state.HeadName), origHead); err != nil {
+		return err
+	}
+	os.Remove(rebaseStatePath())
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HandleReceivePack handles the receive-pack command, which the server
+// runs for pushes. It runs git receive-pack on the repository within the
+// serve.* limits, the pushed pack counting toward serve.maxPackSize.
+func HandleReceivePack(args []string) {
+	statelessRPC, advertiseRefs := false, false
+	pubkey := ""
+	for len(args) > 0 {
+		if args[0] == "--stateless-rpc" {
+			statelessRPC = true
+			args = args[1:]
+		} else if args[0] == "--advertise-refs" {
+			advertiseRefs = true
+			args = args[1:]
+		} else if args[0] == "--pubkey" && len(args) > 1 {
+			pubkey = args[1]
+			args = args[2:]
+		} else if strings.HasPrefix(args[0], "--pubkey=") {
+			pubkey = strings.TrimPrefix(args[0], "--pubkey=")
+			args = args[1:]
+		} else {
+			break
+		}
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: mgit receive-pack [--stateless-rpc] [--advertise-refs] [--pubkey <npub>] <repository>")
+		os.Exit(1)
+	}
+	repoPath := args[0]
+	if _, err := servedGitDir(repoPath); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	gitArgs := []string{"receive-pack"}
+	if statelessRPC {
+		gitArgs = append(gitArgs, "--stateless-rpc")
+	}
+	if advertiseRefs {
+		gitArgs = append(gitArgs, "--advertise-refs")
+	}
+	gitArgs = append(gitArgs, repoPath)
+
+	guard := startServing(servedMGitDir(filepath.Clean(repoPath)), pubkey)
+	if err := serveGit(guard, gitArgs, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error executing git receive-pack: %s\n", err)
+		os.Exit(1)
+	}
+}
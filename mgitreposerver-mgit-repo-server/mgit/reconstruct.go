@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// reconstructBatchSize is the number of MGit objects written per pack
+const reconstructBatchSize = 4096
+
+// rebuildMGitCommits builds the MGit commit objects for the mappings in a
+// mapping file, which is streamed rather than loaded, finding the MGit
+// hashes of parents in it by binary search. Commit lookup and object
+// construction run on a pool of workers, each with its own repository
+// handle since go-git storage isn't safe for concurrent use. The objects
+// are written a batch at a time, each batch as one pack.
+func rebuildMGitCommits(repoPath string, storage *MGitStorage, mappings *sortedMappingFile) error {
+	workers := runtime.NumCPU()
+	jobs := make(chan NostrCommitMapping)
+	results := make(chan *MCommitStruct, workers*2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		repo, err := git.PlainOpenWithOptions(repoPath, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+		if err != nil {
+			close(jobs)
+			return fmt.Errorf("error opening Git repository: %w", err)
+		}
+
+		wg.Add(1)
+		go func(repo *git.Repository) {
+			defer wg.Done()
+			for mapping := range jobs {
+				results <- buildMGitCommit(repo, storage, mapping, mappings.MGitHash)
+			}
+		}(repo)
+	}
+
+	var streamErr error
+	go func() {
+		defer close(jobs)
+		streamErr = streamMappingsFile(mappings.file.Name(), func(mapping NostrCommitMapping) error {
+			jobs <- mapping
+			return nil
+		})
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	batch := make([]*MCommitStruct, 0, reconstructBatchSize)
+	written := 0
+	var storeErr error
+	flush := func() {
+		if len(batch) == 0 || storeErr != nil {
+			return
+		}
+		if storeErr = storage.StoreCommits(batch); storeErr == nil {
+			written += len(batch)
+			fmt.Printf("Reconstructed %d MGit commits\n", written)
+		}
+		batch = batch[:0]
+	}
+
+	// Drained to the end even after an error, so the workers finish
+	for commit := range results {
+		if commit != nil {
+			batch = append(batch, commit)
+			if len(batch) == reconstructBatchSize {
+				flush()
+			}
+		}
+	}
+	flush()
+
+	if storeErr != nil {
+		return storeErr
+	}
+	// results is closed only after the producer finished, so streamErr is set
+	if streamErr != nil {
+		return fmt.Errorf("error reading mappings file: %w", streamErr)
+	}
+	return nil
+}
+
+// buildMGitCommit builds the MGit commit object for a mapping, with the
+// MGit hashes of its parents from mgitHash, returning nil if it already
+// exists or the Git commit is missing
+func buildMGitCommit(repo *git.Repository, storage *MGitStorage, mapping NostrCommitMapping, mgitHash func(gitHash string) (string, bool)) *MCommitStruct {
+	// Check if the MGit object already exists
+	if _, err := storage.GetCommit(mapping.MGitHash); err == nil {
+		return nil
+	}
+
+	// Get the Git commit
+	gitCommit, err := repo.CommitObject(plumbing.NewHash(mapping.GitHash))
+	if err != nil {
+		fmt.Printf("Warning: Could not find Git commit %s: %s\n", mapping.GitHash, err)
+		return nil
+	}
+
+	// Find MGit parent hashes
+	parentMGitHashes := []string{}
+	for _, parentGitHash := range gitCommit.ParentHashes {
+		if parentMGitHash, ok := mgitHash(parentGitHash.String()); ok {
+			parentMGitHashes = append(parentMGitHashes, parentMGitHash)
+		}
+	}
+
+	return &MCommitStruct{
+		Type:         MGitCommitObject,
+		MGitHash:     mapping.MGitHash,
+		GitHash:      mapping.GitHash,
+		TreeHash:     gitCommit.TreeHash.String(),
+		ParentHashes: parentMGitHashes,
+		Author: &MGitSignature{
+			Name:   gitCommit.Author.Name,
+			Email:  gitCommit.Author.Email,
+			Pubkey: mapping.Pubkey,
+			When:   gitCommit.Author.When,
+		},
+		Committer: &MGitSignature{
+			Name:   gitCommit.Committer.Name,
+			Email:  gitCommit.Committer.Email,
+			Pubkey: mapping.Pubkey,
+			When:   gitCommit.Committer.When,
+		},
+		Message:  gitCommit.Message,
+		Metadata: map[string]string{"version": "1.0"},
+	}
+}
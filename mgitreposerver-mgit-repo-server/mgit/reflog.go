@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// reflogEntry is one movement of a ref: from Old to New (MGit hashes, all
+// zeros for none), by whom and why
+type reflogEntry struct {
+	Old     string
+	New     string
+	Name    string
+	Email   string
+	Pubkey  string
+	When    time.Time
+	Message string
+}
+
+// zeroMGitHash stands for "no commit" in a reflog entry
+const zeroMGitHash = "0000000000000000000000000000000000000000"
+
+// reflogLine matches a reflog line, which is git's format with the pubkey
+// after the email, as in a sign-off:
+// "<old> <new> Name <email> (npub1...) <unix> <offset>\t<message>"
+var reflogLine = regexp.MustCompile(`^(\S+) (\S+) (.*?) <([^>]*)>(?: \((\S+)\))? (\d+) ([+-]\d{4})(?:\t(.*))?$`)
+
+// reflogPath is where a ref's reflog is kept: .mgit/logs/HEAD or
+// .mgit/logs/refs/heads/<branch>. A linked worktree keeps the log of its
+// own HEAD.
+func reflogPath(storage *MGitStorage, refName string) string {
+	if refName == "HEAD" && storage.HeadDir != "" {
+		return filepath.Join(storage.HeadDir, "logs", "HEAD")
+	}
+	return filepath.Join(storage.RootDir, "logs", filepath.FromSlash(refName))
+}
+
+// reflogAction names the command moving refs, as GIT_REFLOG_ACTION does
+// in git: main sets it to the command, MGIT_REFLOG_ACTION overrides it
+var reflogAction = "mgit"
+
+// reflogDetail, if set, follows the action in the messages of the ref
+// movements a command makes, e.g. "commit: <subject>"
+var reflogDetail string
+
+// setReflogAction sets the action of the command about to run
+func setReflogAction(command string) {
+	reflogAction = command
+	if action := os.Getenv("MGIT_REFLOG_ACTION"); action != "" {
+		reflogAction = action
+	}
+}
+
+// setReflogMessage describes the ref movements that follow
+func setReflogMessage(format string, args ...interface{}) {
+	reflogDetail = fmt.Sprintf(format, args...)
+}
+
+// reflogMessage is the message of a ref movement: the action, and the
+// detail if the command gave one
+func reflogMessage() string {
+	if reflogDetail == "" {
+		return reflogAction
+	}
+	return reflogAction + ": " + reflogDetail
+}
+
+// logRefUpdate records the movement of a ref in its reflog if it is a
+// branch, and in HEAD's if it is the branch checked out. Tags and
+// remote-tracking branches have no reflog.
+func logRefUpdate(storage *MGitStorage, refName, oldHash, newHash string) error {
+	if !strings.HasPrefix(refName, "refs/heads/") {
+		return nil
+	}
+	if err := appendReflog(storage, refName, oldHash, newHash, reflogMessage()); err != nil {
+		return fmt.Errorf("failed to update the reflog of %s: %w", refName, err)
+	}
+	if head, err := storage.GetHead(); err == nil && head == refName {
+		if err := appendReflog(storage, "HEAD", oldHash, newHash, reflogMessage()); err != nil {
+			return fmt.Errorf("failed to update the reflog of HEAD: %w", err)
+		}
+	}
+	return nil
+}
+
+// logHeadSwitch records in HEAD's reflog that HEAD moved from one branch
+// or commit to another, now at newHash. The message says what it moved
+// between unless the command gave another.
+func logHeadSwitch(storage *MGitStorage, oldHead, newHead, newHash string) error {
+	if newHash == "" {
+		return nil // An unborn branch
+	}
+	oldHash := oldHead
+	if strings.HasPrefix(oldHead, "refs/") {
+		oldHash, _ = storage.GetRef(oldHead)
+		oldHash = strings.TrimSpace(oldHash)
+	}
+	message := reflogMessage()
+	if reflogDetail == "" {
+		message = fmt.Sprintf("%s: moving from %s to %s", reflogAction, reflogHeadName(oldHead), reflogHeadName(newHead))
+	}
+	if err := appendReflog(storage, "HEAD", oldHash, newHash, message); err != nil {
+		return fmt.Errorf("failed to update the reflog of HEAD: %w", err)
+	}
+	return nil
+}
+
+// reflogHeadName names what HEAD points at: a branch, or a commit when
+// detached
+func reflogHeadName(head string) string {
+	if strings.HasPrefix(head, "refs/") {
+		return plumbing.ReferenceName(head).Short()
+	}
+	if head == "" {
+		return "nothing"
+	}
+	return shortHash(head)
+}
+
+// String formats the entry as a reflog line
+func (e reflogEntry) String() string {
+	who := fmt.Sprintf("%s <%s>", e.Name, e.Email)
+	if e.Pubkey != "" {
+		who += fmt.Sprintf(" (%s)", e.Pubkey)
+	}
+	return fmt.Sprintf("%s %s %s %d %s\t%s", e.Old, e.New, who, e.When.Unix(), e.When.Format("-0700"),
+		strings.ReplaceAll(e.Message, "\n", " "))
+}
+
+// parseReflogEntry parses a reflog line
+func parseReflogEntry(line string) (reflogEntry, error) {
+	match := reflogLine.FindStringSubmatch(line)
+	if match == nil {
+		return reflogEntry{}, fmt.Errorf("invalid reflog line %q", line)
+	}
+	seconds, err := strconv.ParseInt(match[6], 10, 64)
+	if err != nil {
+		return reflogEntry{}, fmt.Errorf("invalid reflog line %q: %w", line, err)
+	}
+	offset, _ := time.Parse("-0700", match[7])
+	_, zoneOffset := offset.Zone()
+	return reflogEntry{
+		Old:     match[1],
+		New:     match[2],
+		Name:    match[3],
+		Email:   match[4],
+		Pubkey:  match[5],
+		When:    time.Unix(seconds, 0).In(time.FixedZone("", zoneOffset)),
+		Message: match[8],
+	}, nil
+}
+
+// readReflog reads a ref's reflog, oldest entry first. A ref without one
+// has no entries.
+func readReflog(storage *MGitStorage, refName string) ([]reflogEntry, error) {
+	file, err := os.Open(reflogPath(storage, refName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []reflogEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		entry, err := parseReflogEntry(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", refName, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// writeReflog replaces a ref's reflog with the given entries
+func writeReflog(storage *MGitStorage, refName string, entries []reflogEntry) error {
+	target := reflogPath(storage, refName)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		b.WriteString(entry.String())
+		b.WriteString("\n")
+	}
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// appendReflog records a movement of a ref by the configured user. A ref
+// that had no commit moves from zeroMGitHash.
+func appendReflog(storage *MGitStorage, refName, oldHash, newHash, message string) error {
+	if oldHash == "" {
+		oldHash = zeroMGitHash
+	}
+	entry := reflogEntry{
+		Old:     oldHash,
+		New:     newHash,
+		Name:    GetConfigValue("user.name", "mgit User"),
+		Email:   GetConfigValue("user.email", "mgit@example.com"),
+		Pubkey:  GetNostrPubKey(),
+		When:    time.Now(),
+		Message: message,
+	}
+
+	target := reflogPath(storage, refName)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, entry); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// reflogRefs lists the refs that have a reflog
+func reflogRefs(storage *MGitStorage) ([]string, error) {
+	root := filepath.Join(storage.RootDir, "logs")
+	refs := []string{}
+	if storage.HeadDir != "" {
+		if _, err := os.Stat(reflogPath(storage, "HEAD")); err == nil {
+			refs = append(refs, "HEAD")
+		}
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "HEAD" && storage.HeadDir != "" {
+			return nil // The main worktree's
+		}
+		refs = append(refs, filepath.ToSlash(rel))
+		return nil
+	})
+	return refs, err
+}
+
+// reflogExpiry is when reflog entries expire: those older than Reachable,
+// or older than Unreachable if they point at a commit the ref no longer
+// reaches. A zero time expires nothing.
+type reflogExpiry struct {
+	Reachable   time.Time
+	Unreachable time.Time
+}
+
+// configuredReflogExpiry reads gc.reflogExpire (default 90 days) and
+// gc.reflogExpireUnreachable (default 30 days)
+func configuredReflogExpiry(now time.Time) (reflogExpiry, error) {
+	reachable, err := parseExpiry(GetConfigValue("gc.reflogExpire", "90.days.ago"), now)
+	if err != nil {
+		return reflogExpiry{}, fmt.Errorf("gc.reflogExpire: %w", err)
+	}
+	unreachable, err := parseExpiry(GetConfigValue("gc.reflogExpireUnreachable", "30.days.ago"), now)
+	if err != nil {
+		return reflogExpiry{}, fmt.Errorf("gc.reflogExpireUnreachable: %w", err)
+	}
+	return reflogExpiry{Reachable: reachable, Unreachable: unreachable}, nil
+}
+
+// relativeExpiry matches git's approximate dates: "90.days.ago",
+// "2 weeks ago", "90.days"
+var relativeExpiry = regexp.MustCompile(`^(\d+)[. ]+(second|minute|hour|day|week|month|year)s?(?:[. ]+ago)?$`)
+
+// parseExpiry parses an expiry time as git does: "never" (or "false"),
+// "now" (or "all"), a relative time like "90.days.ago", or a date
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "never", "false":
+		return time.Time{}, nil
+	case "now", "all":
+		return now, nil
+	}
+	if match := relativeExpiry.FindStringSubmatch(strings.ToLower(value)); match != nil {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry %q: %w", value, err)
+		}
+		switch match[2] {
+		case "second":
+			return now.Add(-time.Duration(n) * time.Second), nil
+		case "minute":
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		case "hour":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "day":
+			return now.AddDate(0, 0, -n), nil
+		case "week":
+			return now.AddDate(0, 0, -7*n), nil
+		case "month":
+			return now.AddDate(0, -n, 0), nil
+		default:
+			return now.AddDate(-n, 0, 0), nil
+		}
+	}
+	when, err := parseDate(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q", value)
+	}
+	return when, nil
+}
+
+// expireReflog drops a ref's expired entries, returning how many went.
+// With dryRun the reflog is left as it is.
+func expireReflog(storage *MGitStorage, refName string, expiry reflogExpiry, dryRun bool) (int, error) {
+	entries, err := readReflog(storage, refName)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	// What the ref reaches now; the last entry is where it points
+	var reachable map[string]bool
+	if !expiry.Unreachable.IsZero() {
+		reachable = mgitAncestors(storage, entries[len(entries)-1].New)
+	}
+
+	kept := []reflogEntry{}
+	for _, entry := range entries {
+		cutoff := expiry.Reachable
+		if reachable != nil && !reachable[entry.New] && expiry.Unreachable.After(cutoff) {
+			cutoff = expiry.Unreachable
+		}
+		if !cutoff.IsZero() && entry.When.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	removed := len(entries) - len(kept)
+	if removed == 0 || dryRun {
+		return removed, nil
+	}
+	return removed, writeReflog(storage, refName, kept)
+}
+
+// expireAllReflogs expires the entries of every reflog by the configured
+// gc.reflogExpire and gc.reflogExpireUnreachable times
+func expireAllReflogs(storage *MGitStorage, dryRun bool) (int, error) {
+	expiry, err := configuredReflogExpiry(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	refs, err := reflogRefs(storage)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, ref := range refs {
+		removed, err := expireReflog(storage, ref, expiry, dryRun)
+		if err != nil {
+			return total, err
+		}
+		total += removed
+	}
+	return total, nil
+}
+
+// HandleReflog handles the reflog command
+//
+//	reflog [show] [-n <count>] [<ref>]
+//	reflog expire [--expire=<time>] [--expire-unreachable=<time>]
+//	              [--dry-run] [--verbose] (--all | <refs>...)
+func HandleReflog(args []string) {
+	if len(args) > 0 && args[0] == "expire" {
+		reflogExpire(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "show" {
+		args = args[1:]
+	}
+	reflogShow(args)
+}
+
+func printReflogUsage() {
+	fmt.Println("Usage: mgit reflog [show] [-n <count>] [<ref>]")
+	fmt.Println("       mgit reflog expire [--expire=<time>] [--expire-unreachable=<time>] [--dry-run] [--all | <refs>...]")
+}
+
+// reflogShow lists the movements of a ref, HEAD by default, newest first,
+// as <hash> <ref>@{<n>}: <message>
+func reflogShow(args []string) {
+	ref := "HEAD"
+	limit := -1
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var err error
+		switch {
+		case arg == "-n" && i+1 < len(args):
+			i++
+			limit, err = strconv.Atoi(args[i])
+		case strings.HasPrefix(arg, "-n") && len(arg) > 2:
+			limit, err = strconv.Atoi(strings.TrimPrefix(arg, "-n"))
+		case strings.HasPrefix(arg, "--max-count="):
+			limit, err = strconv.Atoi(strings.TrimPrefix(arg, "--max-count="))
+		case strings.HasPrefix(arg, "-"):
+			printReflogUsage()
+			os.Exit(1)
+		default:
+			ref = arg
+		}
+		if err != nil || limit < -1 {
+			fmt.Printf("Error: invalid count '%s'\n", args[i])
+			os.Exit(1)
+		}
+	}
+
+	storage := NewMGitStorage()
+	entries, err := readReflog(storage, expandReflogRef(ref))
+	if err != nil {
+		fmt.Printf("Error reading reflog: %s\n", err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		fmt.Printf("Error: no reflog for %s\n", ref)
+		os.Exit(1)
+	}
+	for n := 0; n < len(entries) && n != limit; n++ {
+		entry := entries[len(entries)-1-n]
+		gitHash, _ := storage.GetGitHashFromMGit(entry.New)
+		fmt.Printf("%s %s@{%d}: %s\n", displayShortHash(entry.New, gitHash), ref, n, entry.Message)
+	}
+}
+
+// reflogRevision matches <ref>@{<n>}, where the ref was n movements ago
+var reflogRevision = regexp.MustCompile(`^(.*)@\{(\d+)\}$`)
+
+// resolveReflogRevision resolves <ref>@{<n>} to the MGit hash the ref's
+// reflog says it was at n movements ago. @{<n>} alone is the branch
+// checked out, or HEAD when detached.
+func resolveReflogRevision(storage *MGitStorage, rev string) (string, bool, error) {
+	match := reflogRevision.FindStringSubmatch(rev)
+	if match == nil {
+		return "", false, nil
+	}
+	ref := match[1]
+	if ref == "" {
+		ref = "HEAD"
+		if head, err := storage.GetHead(); err == nil && strings.HasPrefix(strings.TrimSpace(head), "refs/") {
+			ref = strings.TrimSpace(head)
+		}
+	}
+	n, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", true, fmt.Errorf("invalid reflog entry in %s", rev)
+	}
+	entries, err := readReflog(storage, expandReflogRef(ref))
+	if err != nil {
+		return "", true, err
+	}
+	if n >= len(entries) {
+		return "", true, fmt.Errorf("revision %s: the reflog of %s has only %d entries", rev, ref, len(entries))
+	}
+	hash := entries[len(entries)-1-n].New
+	if hash == zeroMGitHash {
+		return "", true, fmt.Errorf("revision %s: %s had no commit then", rev, ref)
+	}
+	return hash, true, nil
+}
+
+// reflogExpire prunes old entries of reflogs
+func reflogExpire(args []string) {
+	now := time.Now()
+	expiry, err := configuredReflogExpiry(now)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	storage := NewMGitStorage()
+	all := false
+	dryRun := false
+	verbose := false
+	refs := []string{}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--expire="):
+			expiry.Reachable, err = parseExpiry(strings.TrimPrefix(arg, "--expire="), now)
+		case strings.HasPrefix(arg, "--expire-unreachable="):
+			expiry.Unreachable, err = parseExpiry(strings.TrimPrefix(arg, "--expire-unreachable="), now)
+		case arg == "--all":
+			all = true
+		case arg == "-n" || arg == "--dry-run":
+			dryRun = true
+		case arg == "--verbose":
+			verbose = true
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		default:
+			refs = append(refs, expandReflogRef(arg))
+		}
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if all {
+		if refs, err = reflogRefs(storage); err != nil {
+			fmt.Printf("Error listing reflogs: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(refs) == 0 {
+		fmt.Println("Error: no reflog specified; name refs or use --all")
+		os.Exit(1)
+	}
+
+	for _, ref := range refs {
+		removed, err := expireReflog(storage, ref, expiry, dryRun)
+		if err != nil {
+			fmt.Printf("Error expiring reflog of %s: %s\n", ref, err)
+			os.Exit(1)
+		}
+		switch {
+		case dryRun:
+			fmt.Printf("%s: would prune %d entries\n", ref, removed)
+		case verbose:
+			fmt.Printf("%s: pruned %d entries\n", ref, removed)
+		}
+	}
+}
+
+// expandReflogRef turns a branch name into its ref, leaving HEAD and full
+// ref names alone
+func expandReflogRef(name string) string {
+	if name == "HEAD" || strings.HasPrefix(name, "refs/") {
+		return name
+	}
+	return "refs/heads/" + name
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// HandleRemote handles the remote command, which manages the servers the
+// repository pushes to and pulls from:
+//
+//	mgit remote [-v]
+//	mgit remote add [--server-npub <npub>] [--pinned-pubkey <pin>] <name> <url>
+//	mgit remote remove <name>
+//	mgit remote rename <old> <new>
+//	mgit remote set-url <name> <url>
+//	mgit remote show [<name>]
+//
+// A remote lives in the git config, where git and go-git find it, and in
+// [remote "<name>"] of .mgit/config next to its MGit settings, the server
+// identity and certificate pin. Removing or renaming a remote takes those
+// settings, its remote-tracking branches and the branches tracking it
+// along.
+func HandleRemote(args []string) {
+	repo := getRepo()
+	var err error
+	switch {
+	case len(args) == 0:
+		err = listRemotes(repo, false)
+	case args[0] == "-v" || args[0] == "--verbose":
+		err = listRemotes(repo, true)
+	case args[0] == "add":
+		err = addRemote(repo, args[1:])
+	case (args[0] == "remove" || args[0] == "rm") && len(args) == 2:
+		err = removeRemote(repo, args[1])
+	case args[0] == "rename" && len(args) == 3:
+		err = renameRemote(repo, args[1], args[2])
+	case args[0] == "set-url" && len(args) == 3:
+		err = setRemoteURL(repo, args[1], args[2])
+	case args[0] == "show" && len(args) <= 2:
+		if len(args) == 1 {
+			err = listRemotes(repo, false)
+		} else {
+			err = showRemote(repo, args[1])
+		}
+	default:
+		printRemoteUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printRemoteUsage() {
+	fmt.Println("Usage: mgit remote [-v]")
+	fmt.Println("       mgit remote add [--server-npub <npub>] [--pinned-pubkey <pin>] <name> <url>")
+	fmt.Println("       mgit remote remove <name>")
+	fmt.Println("       mgit remote rename <old> <new>")
+	fmt.Println("       mgit remote set-url <name> <url>")
+	fmt.Println("       mgit remote show [<name>]")
+}
+
+// remoteSection is the .mgit/config section of a remote
+func remoteSection(name string) string {
+	return fmt.Sprintf("remote \"%s\"", name)
+}
+
+// defaultRemote is the remote push and pull use when none is named: the
+// one the current branch tracks, or origin
+func defaultRemote(repo *git.Repository) string {
+	if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+		remote := GetConfigValue("branch."+head.Name().Short()+".remote", "")
+		if remote != "" && remote != "." {
+			return remote
+		}
+	}
+	return "origin"
+}
+
+// listRemotes prints the remote names, and with verbose their URLs
+func listRemotes(repo *git.Repository, verbose bool) error {
+	remotes, err := repo.Remotes()
+	if err != nil {
+		return err
+	}
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].Config().Name < remotes[j].Config().Name })
+	for _, remote := range remotes {
+		cfg := remote.Config()
+		if !verbose {
+			fmt.Println(cfg.Name)
+			continue
+		}
+		url := ""
+		if len(cfg.URLs) > 0 {
+			url = cfg.URLs[0]
+		}
+		fmt.Printf("%s\t%s (fetch)\n", cfg.Name, url)
+		fmt.Printf("%s\t%s (push)\n", cfg.Name, url)
+	}
+	return nil
+}
+
+// addRemote adds a remote, with the server identity and pin to check it by
+func addRemote(repo *git.Repository, args []string) error {
+	serverNpub, pinnedPubkey := "", ""
+	names := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--server-npub" && i+1 < len(args):
+			i++
+			serverNpub = args[i]
+		case strings.HasPrefix(arg, "--server-npub="):
+			serverNpub = strings.TrimPrefix(arg, "--server-npub=")
+		case arg == "--pinned-pubkey" && i+1 < len(args):
+			i++
+			pinnedPubkey = args[i]
+		case strings.HasPrefix(arg, "--pinned-pubkey="):
+			pinnedPubkey = strings.TrimPrefix(arg, "--pinned-pubkey=")
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+	if len(names) != 2 {
+		printRemoteUsage()
+		os.Exit(1)
+	}
+	name, url := names[0], names[1]
+	if serverNpub != "" && !ValidateNostrPubKey(serverNpub) {
+		return fmt.Errorf("invalid server npub %q", serverNpub)
+	}
+
+	_, err := repo.CreateRemote(&config.RemoteConfig{Name: name, URLs: []string{url}})
+	if errors.Is(err, git.ErrRemoteExists) {
+		return fmt.Errorf("remote %s already exists", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid remote %s: %w", name, err)
+	}
+
+	settings := map[string]string{"url": url, "serverNpub": serverNpub, "pinnedPubkey": pinnedPubkey}
+	for key, value := range settings {
+		if value == "" {
+			continue
+		}
+		if err := SetConfigValue("remote."+name+"."+key, value, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRemote deletes a remote with its settings and remote-tracking
+// branches; branches that tracked it no longer track anything
+func removeRemote(repo *git.Repository, name string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Remotes[name]; !ok {
+		return fmt.Errorf("no such remote: '%s'", name)
+	}
+	delete(cfg.Remotes, name)
+	for _, branch := range cfg.Branches {
+		if branch.Remote == name {
+			branch.Remote, branch.Merge = "", ""
+		}
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	for _, branch := range branchesTracking(name) {
+		UnsetConfigValue("branch."+branch+".remote", false)
+		UnsetConfigValue("branch."+branch+".merge", false)
+	}
+	if err := RemoveConfigSection(remoteSection(name), false); err != nil {
+		return err
+	}
+	os.Remove(serverPolicyPath(name))
+	return moveRemoteRefs(repo, name, "")
+}
+
+// renameRemote renames a remote, its settings, its remote-tracking
+// branches and its fetch refspecs, and points the branches tracking it at
+// the new name
+func renameRemote(repo *git.Repository, oldName, newName string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := cfg.Remotes[oldName]
+	if !ok {
+		return fmt.Errorf("no such remote: '%s'", oldName)
+	}
+	if _, exists := cfg.Remotes[newName]; exists {
+		return fmt.Errorf("remote %s already exists", newName)
+	}
+	if err := plumbing.NewRemoteHEADReferenceName(newName).Validate(); err != nil {
+		return fmt.Errorf("'%s' is not a valid remote name", newName)
+	}
+
+	// Refspecs fetching into the remote's own tracking refs follow it
+	oldPrefix, newPrefix := "refs/remotes/"+oldName+"/", "refs/remotes/"+newName+"/"
+	for i, refspec := range remote.Fetch {
+		remote.Fetch[i] = config.RefSpec(strings.Replace(refspec.String(), ":"+oldPrefix, ":"+newPrefix, 1))
+	}
+	delete(cfg.Remotes, oldName)
+	remote.Name = newName
+	cfg.Remotes[newName] = remote
+	for _, branch := range cfg.Branches {
+		if branch.Remote == oldName {
+			branch.Remote = newName
+		}
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	for _, branch := range branchesTracking(oldName) {
+		if err := SetConfigValue("branch."+branch+".remote", newName, false); err != nil {
+			return err
+		}
+	}
+	if err := RenameConfigSection(remoteSection(oldName), remoteSection(newName), false); err != nil {
+		return err
+	}
+	os.Rename(serverPolicyPath(oldName), serverPolicyPath(newName))
+	return moveRemoteRefs(repo, oldName, newName)
+}
+
+// setRemoteURL points a remote at a new URL. The server identity and pin
+// stay; update them if the new URL is a different server.
+func setRemoteURL(repo *git.Repository, name, url string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := cfg.Remotes[name]
+	if !ok {
+		return fmt.Errorf("no such remote '%s'", name)
+	}
+	remote.URLs = []string{url}
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+	return SetConfigValue("remote."+name+".url", url, false)
+}
+
+// showRemote prints what is known locally about a remote
+func showRemote(repo *git.Repository, name string) error {
+	remote, err := repo.Remote(name)
+	if err != nil {
+		return fmt.Errorf("no such remote '%s'", name)
+	}
+	cfg := remote.Config()
+
+	fmt.Printf("* remote %s\n", name)
+	for _, url := range cfg.URLs {
+		fmt.Printf("  URL: %s\n", url)
+	}
+	for _, refspec := range cfg.Fetch {
+		fmt.Printf("  Fetch: %s\n", refspec)
+	}
+	if npub := GetConfigValue("remote."+name+".serverNpub", ""); npub != "" {
+		fmt.Printf("  Server npub: %s\n", npub)
+	}
+	if pin := GetConfigValue("remote."+name+".pinnedPubkey", ""); pin != "" {
+		fmt.Printf("  Pinned pubkey: %s\n", pin)
+	}
+
+	branches := []string{}
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	prefix := "refs/remotes/" + name + "/"
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if refName := ref.Name().String(); strings.HasPrefix(refName, prefix) && ref.Type() == plumbing.HashReference {
+			branches = append(branches, strings.TrimPrefix(refName, prefix))
+		}
+		return nil
+	})
+	sort.Strings(branches)
+	if len(branches) > 0 {
+		fmt.Println("  Remote branches:")
+		for _, branch := range branches {
+			fmt.Printf("    %s\n", branch)
+		}
+	}
+
+	tracking := branchesTracking(name)
+	if len(tracking) > 0 {
+		fmt.Println("  Local branches tracking it:")
+		for _, branch := range tracking {
+			merge := strings.TrimPrefix(GetConfigValue("branch."+branch+".merge", ""), "refs/heads/")
+			fmt.Printf("    %s tracks %s\n", branch, merge)
+		}
+	}
+	return nil
+}
+
+// branchesTracking lists the branches whose upstream is on a remote,
+// from .mgit/config
+func branchesTracking(remote string) []string {
+	config, err := LoadConfig(GetConfigFilePath(false))
+	if err != nil {
+		return nil
+	}
+	branches := []string{}
+	for section, values := range config.Sections {
+		if !strings.HasPrefix(section, `branch "`) || values["remote"] != remote {
+			continue
+		}
+		branches = append(branches, strings.TrimSuffix(strings.TrimPrefix(section, `branch "`), `"`))
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// moveRemoteRefs renames a remote's remote-tracking refs, Git and MGit,
+// to another remote, or deletes them when newName is ""
+func moveRemoteRefs(repo *git.Repository, oldName, newName string) error {
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	prefix := "refs/remotes/" + oldName + "/"
+	moved := []*plumbing.Reference{}
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), prefix) {
+			moved = append(moved, ref)
+		}
+		return nil
+	})
+
+	for _, ref := range moved {
+		if newName != "" {
+			name := plumbing.ReferenceName("refs/remotes/" + newName + "/" + strings.TrimPrefix(ref.Name().String(), prefix))
+			var renamed *plumbing.Reference
+			if ref.Type() == plumbing.SymbolicReference {
+				target := strings.Replace(ref.Target().String(), prefix, "refs/remotes/"+newName+"/", 1)
+				renamed = plumbing.NewSymbolicReference(name, plumbing.ReferenceName(target))
+			} else {
+				renamed = plumbing.NewHashReference(name, ref.Hash())
+			}
+			if err := repo.Storer.SetReference(renamed); err != nil {
+				return err
+			}
+		}
+		if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
+			return err
+		}
+	}
+	return moveMGitRemoteRefs(NewMGitStorage(), oldName, newName)
+}
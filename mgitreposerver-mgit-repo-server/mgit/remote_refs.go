@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// The MGit ref store keeps remote-tracking branches next to the local
+// ones, as .mgit/refs/remotes/<remote>/<branch> holding the MGit hash of
+// the Git remote-tracking branch of the same name. They are updated
+// whenever the Git ones move: on clone, pull and push.
+
+// remoteRef is a remote-tracking branch in the MGit ref store
+type remoteRef struct {
+	Name     string // <remote>/<branch>
+	MGitHash string
+}
+
+func mgitRemoteRefsDir(storage *MGitStorage) string {
+	return filepath.Join(storage.RootDir, "refs", "remotes")
+}
+
+// updateRemoteTrackingRefs points the MGit remote-tracking branches of a
+// remote, or of every remote when remote is "", at the MGit commits of
+// the Git ones, and removes those whose Git branch is gone. Branches whose
+// commit has no mapping are left out.
+func updateRemoteTrackingRefs(repo *git.Repository, storage *MGitStorage, remote string) error {
+	prefix := "refs/remotes/"
+	if remote != "" {
+		prefix += remote + "/"
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	wanted := map[string]string{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, prefix) || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		mgitHash, err := storage.GetMGitHashFromGit(ref.Hash().String())
+		if err != nil {
+			// Sparse metadata leaves out other branches on purpose
+			if !sparseMetadataEnabled() {
+				fmt.Printf("Warning: Could not find MGit hash for %s at git hash %s\n", ref.Name().Short(), ref.Hash())
+			}
+			return nil
+		}
+		wanted[name] = mgitHash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	current, err := listRemoteRefs(storage)
+	if err != nil {
+		return err
+	}
+	for _, ref := range current {
+		name := "refs/remotes/" + ref.Name
+		if strings.HasPrefix(name, prefix) && wanted[name] == "" {
+			os.Remove(filepath.Join(storage.RootDir, filepath.FromSlash(name)))
+		}
+	}
+	for name, mgitHash := range wanted {
+		if err := storage.UpdateRef(name, mgitHash); err != nil {
+			return err
+		}
+		traceEvent("refs.update_remote", "ref", name, "mgit_hash", mgitHash)
+	}
+	return nil
+}
+
+// listRemoteRefs lists the remote-tracking branches in the MGit ref
+// store, sorted by name
+func listRemoteRefs(storage *MGitStorage) ([]remoteRef, error) {
+	root := mgitRemoteRefsDir(storage)
+	refs := []remoteRef{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, remoteRef{Name: filepath.ToSlash(name), MGitHash: strings.TrimSpace(string(data))})
+		return nil
+	})
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, err
+}
+
+// moveMGitRemoteRefs renames a remote's MGit remote-tracking branches, or
+// deletes them when newName is ""
+func moveMGitRemoteRefs(storage *MGitStorage, oldName, newName string) error {
+	oldDir := filepath.Join(mgitRemoteRefsDir(storage), oldName)
+	if _, err := os.Stat(oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	if newName == "" {
+		return os.RemoveAll(oldDir)
+	}
+	return os.Rename(oldDir, filepath.Join(mgitRemoteRefsDir(storage), newName))
+}
+
+// listBranchesWithRemotes lists the remote-tracking branches, with the
+// local branches before them when local is set, each with its short MGit
+// hash and subject
+func listBranchesWithRemotes(repo *git.Repository, local bool) error {
+	storage := NewMGitStorage()
+	type branchLine struct {
+		marker, name, hash, subject string
+	}
+	lines := []branchLine{}
+
+	if local {
+		iter, err := repo.Branches()
+		if err != nil {
+			return err
+		}
+		current := getCurrentBranch(repo)
+		iter.ForEach(func(ref *plumbing.Reference) error {
+			line := branchLine{marker: " ", name: ref.Name().Short()}
+			if line.name == current {
+				line.marker = "*"
+			}
+			mgitHash, _ := storage.GetMGitHashFromGit(ref.Hash().String())
+			line.hash = displayShortHash(mgitHash, ref.Hash().String())
+			if commit, err := repo.CommitObject(ref.Hash()); err == nil {
+				line.subject = strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0]
+			}
+			lines = append(lines, line)
+			return nil
+		})
+		sort.Slice(lines, func(i, j int) bool { return lines[i].name < lines[j].name })
+	}
+
+	remotes, err := listRemoteRefs(storage)
+	if err != nil {
+		return err
+	}
+	for _, ref := range remotes {
+		line := branchLine{marker: " ", name: ref.Name, hash: shortHash(ref.MGitHash)}
+		if local {
+			line.name = "remotes/" + ref.Name
+		}
+		if commit, err := storage.GetCommit(ref.MGitHash); err == nil {
+			line.hash = displayShortHash(commit.MGitHash, commit.GitHash)
+			line.subject = strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0]
+		}
+		lines = append(lines, line)
+	}
+
+	width := 0
+	for _, line := range lines {
+		if len(line.name) > width {
+			width = len(line.name)
+		}
+	}
+	for _, line := range lines {
+		fmt.Printf("%s %-*s %s %s\n", line.marker, width, line.name, line.hash, line.subject)
+	}
+	return nil
+}
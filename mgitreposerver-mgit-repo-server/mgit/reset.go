@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// resetMode is how much of the repository reset moves to the commit
+type resetMode int
+
+const (
+	resetSoft  resetMode = iota // the branch only
+	resetMixed                  // the branch and the index
+	resetHard                   // the branch, the index and the worktree
+)
+
+// HandleReset handles the reset command, which points the current branch,
+// or a detached HEAD, and its MGit ref at a commit:
+//
+//	mgit reset [--soft | --mixed | --hard] [<commit>]
+//
+// --mixed, the default, also resets the index and --hard the worktree as
+// well, throwing away local changes to tracked files. The commit, HEAD by
+// default, can be named by MGit hash. The old position is kept in
+// ORIG_HEAD, so `mgit reset ORIG_HEAD` undoes a reset.
+func HandleReset(args []string) {
+	mode := resetMixed
+	revisions := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--soft":
+			mode = resetSoft
+		case arg == "--mixed":
+			mode = resetMixed
+		case arg == "--hard":
+			mode = resetHard
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printResetUsage()
+			os.Exit(1)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	if len(revisions) > 1 {
+		printResetUsage()
+		os.Exit(1)
+	}
+	rev := "HEAD"
+	if len(revisions) == 1 {
+		rev = revisions[0]
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	head, err := repo.Head()
+	if err != nil {
+		fmt.Println("Error: you do not have the initial commit yet")
+		os.Exit(1)
+	}
+	target, err := resolveCommitRevision(repo, storage, rev)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	merge, err := loadPendingMerge()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if merge != nil && mode == resetSoft {
+		fmt.Println("Error: cannot do a soft reset in the middle of a merge")
+		os.Exit(1)
+	}
+
+	if mode != resetSoft {
+		if err := resetIndex(repo, target, mode == resetHard); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	setReflogMessage("moving to %s", rev)
+	if err := setResetHead(repo, storage, head, target); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if merge != nil {
+		clearMergeState()
+	}
+
+	if mode == resetHard {
+		fmt.Printf("HEAD is now at %s\n", commitOneline(repo, target))
+		return
+	}
+	if mode == resetMixed {
+		printUnstagedAfterReset(repo)
+	}
+}
+
+func printResetUsage() {
+	fmt.Println("Usage: mgit reset [--soft | --mixed | --hard] [<commit>]")
+}
+
+// resetIndex makes the index, and with worktree the tracked files, match a
+// commit's tree. Untracked files are left alone, as are submodules.
+func resetIndex(repo *git.Repository, target plumbing.Hash, worktree bool) error {
+	targetSide, err := commitDiffSide(repo, target)
+	if err != nil {
+		return err
+	}
+	index, err := indexDiffSide(repo)
+	if err != nil {
+		return err
+	}
+	paths := changedPaths(index, targetSide, nil)
+	if worktree {
+		current, err := worktreeDiffSide(repo, index)
+		if err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		for _, path := range paths {
+			seen[path] = true
+		}
+		for _, path := range changedPaths(current, targetSide, nil) {
+			if !seen[path] {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	results := []*applyResult{}
+	for _, path := range paths {
+		entry := targetSide.Entries[path]
+		if old := index.Entries[path]; (old != nil && old.Mode == filemode.Submodule) || (entry != nil && entry.Mode == filemode.Submodule) {
+			continue
+		}
+		if entry == nil {
+			results = append(results, &applyResult{Path: path, Deleted: true})
+			continue
+		}
+		content, err := blobContent(repo, entry.Hash)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", path, err)
+		}
+		results = append(results, &applyResult{Path: path, Content: content, Mode: entry.Mode})
+	}
+	if !worktree {
+		return writeApplyResults(repo, results, applyOptions{Cached: true})
+	}
+	if err := writeApplyResults(repo, results, applyOptions{Index: true}); err != nil {
+		return err
+	}
+
+	// Like git, drop directories that deleting files left empty
+	root := repoRoot()
+	for _, result := range results {
+		if !result.Deleted {
+			continue
+		}
+		dir := filepath.Dir(filepath.Join(root, filepath.FromSlash(result.Path)))
+		for dir != root && strings.HasPrefix(dir, root) {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+	return nil
+}
+
+// setResetHead points the branch HEAD is on, or HEAD itself when detached,
+// at the target, in git and in .mgit, and records where it was in
+// ORIG_HEAD
+func setResetHead(repo *git.Repository, storage *MGitStorage, head *plumbing.Reference, target plumbing.Hash) error {
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("ORIG_HEAD", head.Hash())); err != nil {
+		return fmt.Errorf("error writing ORIG_HEAD: %w", err)
+	}
+	name := plumbing.HEAD
+	if head.Name().IsBranch() {
+		name = head.Name()
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(name, target)); err != nil {
+		return fmt.Errorf("error updating %s: %w", name.Short(), err)
+	}
+
+	mgitHash, err := storage.GetMGitHashFromGit(target.String())
+	if err != nil {
+		fmt.Printf("Warning: %s has no MGit commit; the MGit ref was left as it was\n", shortHash(target.String()))
+		return nil
+	}
+	if name == plumbing.HEAD {
+		return storage.DetachHead(mgitHash)
+	}
+	return storage.UpdateRef(name.String(), mgitHash)
+}
+
+// printUnstagedAfterReset lists, as git does, the tracked files that now
+// differ from the index
+func printUnstagedAfterReset(repo *git.Repository) {
+	index, err := indexDiffSide(repo)
+	if err != nil {
+		return
+	}
+	current, err := worktreeDiffSide(repo, index)
+	if err != nil {
+		return
+	}
+	paths := changedPaths(index, current, nil)
+	if len(paths) == 0 {
+		return
+	}
+	fmt.Println("Unstaged changes after reset:")
+	for _, path := range paths {
+		status := "M"
+		if current.Entries[path] == nil {
+			status = "D"
+		}
+		fmt.Printf("%s\t%s\n", status, path)
+	}
+}
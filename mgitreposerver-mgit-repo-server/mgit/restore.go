@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// restoreOptions selects what restore puts back and where
+type restoreOptions struct {
+	Source    string // revision to restore from; the index, or HEAD with Staged, if empty
+	Staged    bool   // restore the index
+	Worktree  bool   // restore the worktree
+	Patch     bool   // pick hunks interactively
+	Pathspecs []string
+}
+
+// HandleRestore handles the restore command, which puts files in the
+// worktree or the index back the way they are in the index or a revision.
+// With -p the hunks to put back are picked one at a time.
+//
+//	-s, --source <rev>  restore from a revision, by MGit or Git hash
+//	-S, --staged        restore the index (from HEAD by default)
+//	-W, --worktree      restore the worktree (the default without --staged)
+//	-p, --patch         pick hunks interactively
+func HandleRestore(args []string) {
+	opts := restoreOptions{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-s" || arg == "--source") && i+1 < len(args):
+			i++
+			opts.Source = args[i]
+		case strings.HasPrefix(arg, "--source="):
+			opts.Source = strings.TrimPrefix(arg, "--source=")
+		case arg == "-S" || arg == "--staged":
+			opts.Staged = true
+		case arg == "-W" || arg == "--worktree":
+			opts.Worktree = true
+		case arg == "-p" || arg == "--patch":
+			opts.Patch = true
+		case arg == "--":
+			opts.Pathspecs = append(opts.Pathspecs, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		default:
+			opts.Pathspecs = append(opts.Pathspecs, arg)
+		}
+	}
+	if len(opts.Pathspecs) == 0 && !opts.Patch {
+		fmt.Println("Usage: mgit restore [-p] [--source <rev>] [--staged] [--worktree] [--] <paths...>")
+		os.Exit(1)
+	}
+	if !opts.Staged {
+		opts.Worktree = true
+	}
+
+	if err := restorePaths(getRepo(), opts); err != nil {
+		fmt.Printf("Error restoring: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// checkoutPatch handles checkout -p [<rev>] [--] [<paths>], which is
+// restore -p, from the index or, given a revision, to both the index and
+// the worktree
+func checkoutPatch(args []string) {
+	opts := restoreOptions{Patch: true, Worktree: true}
+	for i, arg := range args {
+		if arg == "--" {
+			opts.Pathspecs = append(opts.Pathspecs, args[i+1:]...)
+			break
+		}
+		if opts.Source == "" && i == 0 {
+			opts.Source = arg
+			continue
+		}
+		opts.Pathspecs = append(opts.Pathspecs, arg)
+	}
+	// Like git, a lone argument that isn't a revision is a path
+	if opts.Source != "" {
+		if _, err := resolveCommitRevision(getRepo(), NewMGitStorage(), opts.Source); err != nil {
+			opts.Pathspecs = append([]string{opts.Source}, opts.Pathspecs...)
+			opts.Source = ""
+		}
+	}
+	opts.Staged = opts.Source != ""
+
+	if err := restorePaths(getRepo(), opts); err != nil {
+		fmt.Printf("Error checking out: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// restorePaths restores the files matching the pathspecs. Without a
+// revision the selected hunks are shown as the changes they discard;
+// with one, as the changes that bring the file to the revision.
+func restorePaths(repo *git.Repository, opts restoreOptions) error {
+	pathspecs := []string{}
+	for _, spec := range opts.Pathspecs {
+		path, err := repoRelativePath(spec)
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			pathspecs = nil
+			break
+		}
+		pathspecs = append(pathspecs, path)
+	}
+
+	// The source is a commit, or the index when it is nil
+	var source *object.Commit
+	reverse := opts.Source == ""
+	rev := opts.Source
+	if rev == "" && opts.Staged {
+		rev = "HEAD"
+	}
+	if rev != "" {
+		hash, err := resolveCommitRevision(repo, NewMGitStorage(), rev)
+		if err != nil {
+			return err
+		}
+		if source, err = repo.CommitObject(hash); err != nil {
+			return fmt.Errorf("error getting commit: %w", err)
+		}
+	}
+
+	paths, err := restoreCandidates(repo, source, pathspecs)
+	if err != nil {
+		return err
+	}
+
+	verb := "Apply"
+	switch {
+	case reverse && opts.Worktree:
+		verb = "Discard"
+	case reverse:
+		verb = "Unstage"
+	}
+	selector := newHunkSelector(verb)
+	selector.Reverse = reverse
+
+	results := []*applyResult{}
+	for _, path := range paths {
+		var base *applyResult
+		if source != nil {
+			base, err = readRevisionFile(source, path)
+		} else {
+			base, err = readApplyTarget(repo, path, true)
+		}
+		if err != nil {
+			return err
+		}
+
+		// The file being restored: the worktree's copy, or the index's
+		// when only the index is restored
+		target, err := readApplyTarget(repo, path, !opts.Worktree)
+		if err != nil {
+			return err
+		}
+		if opts.Worktree && opts.Staged {
+			staged, err := readApplyTarget(repo, path, true)
+			if err != nil {
+				return err
+			}
+			if !sameApplyContent(staged, target) {
+				fmt.Printf("Skipping %s: it has staged changes; restore the index and the worktree separately\n", path)
+				continue
+			}
+		}
+		if sameApplyContent(base, target) {
+			continue
+		}
+
+		result, err := restoreFile(selector, path, base, target, opts.Patch)
+		if err != nil {
+			return err
+		}
+		if result != nil {
+			results = append(results, result)
+		}
+		if selector.quit {
+			break
+		}
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+	if opts.Staged {
+		if err := writeApplyResults(repo, results, applyOptions{Cached: true}); err != nil {
+			return err
+		}
+	}
+	if opts.Worktree {
+		return writeApplyResults(repo, results, applyOptions{})
+	}
+	return nil
+}
+
+// restoreFile works out a file's restored content: the base version, or
+// with patch, the target with the hunks the user picks brought back to
+// the base. It returns nil if nothing changes.
+func restoreFile(selector *hunkSelector, path string, base, target *applyResult, patch bool) (*applyResult, error) {
+	if !patch {
+		if base == nil {
+			return &applyResult{Path: path, Deleted: true}, nil
+		}
+		return base, nil
+	}
+
+	var baseContent, targetContent []byte
+	if base != nil {
+		baseContent = base.Content
+	}
+	if target != nil {
+		targetContent = target.Content
+	}
+	// The diff goes from the base in reverse mode and to it otherwise
+	from, to := "a/"+path, "b/"+path
+	old, new := targetContent, baseContent
+	if selector.Reverse {
+		old, new = baseContent, targetContent
+		if base == nil {
+			from = "/dev/null"
+		}
+		if target == nil {
+			to = "/dev/null"
+		}
+	} else {
+		if target == nil {
+			from = "/dev/null"
+		}
+		if base == nil {
+			to = "/dev/null"
+		}
+	}
+	header := fmt.Sprintf("diff --git a/%s b/%s\n--- %s\n+++ %s\n", path, path, from, to)
+	if bytes.IndexByte(old, 0) >= 0 || bytes.IndexByte(new, 0) >= 0 {
+		fmt.Printf("%sBinary files differ; restore %s without -p\n", header, path)
+		return nil, nil
+	}
+
+	hunks, err := selector.selectFileHunks(header, splitLines(string(old)), splitLines(string(new)))
+	if err != nil {
+		return nil, err
+	}
+	selected := false
+	for _, hunk := range hunks {
+		selected = selected || hunk.Selected
+	}
+	if !selected {
+		return nil, nil
+	}
+
+	var lines []string
+	if selector.Reverse {
+		lines, err = applySelectedHunks(splitLines(string(targetContent)), reverseHunks(hunks))
+	} else {
+		lines, err = applySelectedHunks(splitLines(string(targetContent)), hunks)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	result := &applyResult{Path: path, Content: []byte(strings.Join(lines, ""))}
+	switch {
+	case target != nil:
+		result.Mode = target.Mode
+	case base != nil:
+		result.Mode = base.Mode
+	}
+	result.Deleted = base == nil && len(lines) == 0
+	return result, nil
+}
+
+// restoreCandidates lists the paths restore looks at: those in the index
+// and, restoring from a commit, those in the commit
+func restoreCandidates(repo *git.Repository, source *object.Commit, pathspecs []string) ([]string, error) {
+	seen := map[string]bool{}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	for _, entry := range idx.Entries {
+		seen[entry.Name] = true
+	}
+	if source != nil {
+		files, err := source.Files()
+		if err != nil {
+			return nil, err
+		}
+		err = files.ForEach(func(file *object.File) error {
+			seen[file.Name] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paths := []string{}
+	for path := range seen {
+		if pathMatches(path, pathspecs, false) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// readRevisionFile reads a file as a commit has it, or returns nil if the
+// commit doesn't have it
+func readRevisionFile(commit *object.Commit, path string) (*applyResult, error) {
+	file, err := commit.File(path)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := readBlob(&file.Blob)
+	if err != nil {
+		return nil, err
+	}
+	return &applyResult{Path: path, Content: content, Mode: file.Mode}, nil
+}
+
+// sameApplyContent reports whether two versions of a file, either of
+// which may be missing, are the same
+func sameApplyContent(a, b *applyResult) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Mode == b.Mode && bytes.Equal(a.Content, b.Content)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A revert stopped on conflicts leaves REVERT_HEAD, naming the commit
+// being reverted, and MERGE_MSG, as git does. The next mgit commit, or
+// mgit revert --continue, finishes it.
+const revertHeadFile = "REVERT_HEAD"
+
+// loadPendingRevert returns the revert in progress, or nil
+func loadPendingRevert() (*pendingMerge, error) {
+	return loadStoppedState(revertHeadFile)
+}
+
+func clearRevertState() {
+	os.Remove(filepath.Join(mgitDir(), revertHeadFile))
+	os.Remove(filepath.Join(mgitDir(), mergeMsgFile))
+}
+
+// HandleRevert handles the revert command, which commits the inverse of a
+// commit on top of HEAD:
+//
+//	mgit revert [-n] [-m <parent>] [-S] [-s] [--no-verify] <commit>
+//	mgit revert --continue | --abort
+//
+// The revert is committed like any other commit, so it gets its own MGit
+// hash, mapping and the reverter's pubkey, and commit hooks and the
+// message lint run on it. Its message names the reverted commit by MGit
+// hash. -n stages the inverse changes without committing them; -m picks
+// the parent a merge commit is reverted to.
+func HandleRevert(args []string) {
+	noCommit, cont, abort := false, false, false
+	mainline := 0
+	commitArgs := []string{}
+	revisions := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--continue":
+			cont = true
+		case arg == "--abort":
+			abort = true
+		case arg == "-n" || arg == "--no-commit":
+			noCommit = true
+		case arg == "-m" || arg == "--mainline":
+			if i+1 >= len(args) {
+				fmt.Printf("Error: %s needs a parent number\n", arg)
+				os.Exit(1)
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				fmt.Printf("Error: invalid parent number %s\n", args[i])
+				os.Exit(1)
+			}
+			mainline = n
+		case arg == "-S" || arg == "--sign" || arg == "-s" || arg == "--signoff" || arg == "--no-verify":
+			commitArgs = append(commitArgs, arg)
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printRevertUsage()
+			os.Exit(1)
+		default:
+			revisions = append(revisions, arg)
+		}
+	}
+	switch {
+	case cont && len(revisions) == 0:
+		continueRevert(commitArgs)
+		return
+	case abort && len(revisions) == 0:
+		if err := abortRevert(getRepo()); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(revisions) != 1 || cont || abort {
+		printRevertUsage()
+		os.Exit(1)
+	}
+
+	if state, err := loadRebaseState(); err != nil || state != nil {
+		fmt.Println("Error: a rebase is in progress; run mgit rebase --continue or --abort")
+		os.Exit(1)
+	}
+	if merge, err := loadPendingMerge(); err != nil || merge != nil {
+		fmt.Println("Error: a merge is in progress; commit the result or run mgit merge --abort")
+		os.Exit(1)
+	}
+	if revert, err := loadPendingRevert(); err != nil || revert != nil {
+		fmt.Println("Error: a revert is in progress; run mgit revert --continue or --abort")
+		os.Exit(1)
+	}
+	if pick, err := loadPendingCherryPick(); err != nil || pick != nil {
+		fmt.Println("Error: a cherry-pick is in progress; run mgit cherry-pick --continue or --abort")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	head, err := repo.Head()
+	if err != nil {
+		fmt.Printf("Error getting HEAD: %s\n", err)
+		os.Exit(1)
+	}
+	target, err := resolveCommitRevision(repo, storage, revisions[0])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	commit, err := repo.CommitObject(target)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	parent := plumbing.ZeroHash
+	switch {
+	case commit.NumParents() > 1 && mainline == 0:
+		fmt.Printf("Error: commit %s is a merge but no -m option was given\n", shortHash(target.String()))
+		os.Exit(1)
+	case mainline > commit.NumParents():
+		fmt.Printf("Error: commit %s does not have parent %d\n", shortHash(target.String()), mainline)
+		os.Exit(1)
+	case mainline > 0:
+		parent = commit.ParentHashes[mainline-1]
+	case commit.NumParents() == 1:
+		parent = commit.ParentHashes[0]
+	}
+
+	// The revert is committed from the index, so it must be clean
+	if !noCommit {
+		if staged, err := hasStagedChanges(repo); err != nil {
+			fmt.Printf("Error getting status: %s\n", err)
+			os.Exit(1)
+		} else if staged {
+			fmt.Println("Error: you have staged changes; commit or unstage them before reverting")
+			os.Exit(1)
+		}
+	}
+
+	message := revertMessage(storage, commit)
+	result, err := mergeTrees(repo, target, head.Hash(), parent, mergeLabels{
+		Ours:   "HEAD",
+		Theirs: "parent of " + commitOneline(repo, target),
+	})
+	if err == nil {
+		err = checkMergeWorktree(repo, head.Hash(), result)
+	}
+	if err == nil {
+		err = writeMergeResult(repo, result)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(result.Conflicts) > 0 {
+		for _, conflict := range result.Conflicts {
+			fmt.Println(conflict.Message)
+		}
+		if !noCommit {
+			if err := saveStoppedState(revertHeadFile, target, message, result.Conflicts); err != nil {
+				fmt.Printf("Error saving revert state: %s\n", err)
+			}
+		}
+		fmt.Printf("Could not revert %s\n", commitOneline(repo, target))
+		fmt.Println("Resolve all conflicts, stage them with mgit add, then run mgit revert --continue.")
+		fmt.Println("To go back to where you were, run mgit revert --abort.")
+		os.Exit(1)
+	}
+	if noCommit {
+		return
+	}
+	if staged, err := hasStagedChanges(repo); err == nil && !staged {
+		fmt.Printf("Error: reverting %s changes nothing\n", commitOneline(repo, target))
+		os.Exit(1)
+	}
+	HandleMGitCommit(append(commitArgs, "-m", message))
+}
+
+func printRevertUsage() {
+	fmt.Println("Usage: mgit revert [-n] [-m <parent>] [-S] [-s] [--no-verify] <commit>")
+	fmt.Println("       mgit revert --continue | --abort")
+}
+
+// revertMessage is git's revert message, naming the commit by MGit hash
+// when it has one
+func revertMessage(storage *MGitStorage, commit *object.Commit) string {
+	subject, _, _ := strings.Cut(commit.Message, "\n")
+	hash := commit.Hash.String()
+	if mgitHash, err := storage.GetMGitHashFromGit(hash); err == nil && mgitHash != "" {
+		hash = mgitHash
+	}
+	return fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.", subject, hash)
+}
+
+// continueRevert commits a stopped revert once its conflicts are resolved
+func continueRevert(commitArgs []string) {
+	revert, err := loadPendingRevert()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if revert == nil {
+		fmt.Println("Error: no revert in progress")
+		os.Exit(1)
+	}
+	// The commit checks the conflicts are resolved and takes the message
+	HandleMGitCommit(commitArgs)
+}
+
+// abortRevert puts back HEAD's version of every path a stopped revert
+// staged or left conflicted
+func abortRevert(repo *git.Repository) error {
+	revert, err := loadPendingRevert()
+	if err != nil {
+		return err
+	}
+	if revert == nil {
+		return fmt.Errorf("no revert in progress")
+	}
+	if err := restoreHead(repo, revert.Conflicts); err != nil {
+		return err
+	}
+	clearRevertState()
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// revisionSuffix matches a trailing ~N, ^N, ~ or ^ on a revision
+var revisionSuffix = regexp.MustCompile(`(~|\^)(\d*)$`)
+
+// resolveMGitRevision resolves a revision to an MGit commit. It accepts
+// HEAD, branch names, tags, remote-tracking and other git refs, MGit hashes
+// and prefixes, Git hashes, and <ref>@{N} from the reflog, optionally
+// followed by ~N and ^N suffixes.
+// Annotated tags resolve to the commit they tag.
+func resolveMGitRevision(repo *git.Repository, storage *MGitStorage, rev string) (*MCommitStruct, error) {
+	if match := revisionSuffix.FindStringSubmatchIndex(rev); match != nil && match[0] > 0 {
+		base, err := resolveMGitRevision(repo, storage, rev[:match[0]])
+		if err != nil {
+			return nil, err
+		}
+
+		op := rev[match[2]:match[3]]
+		n := 1
+		if match[4] != match[5] {
+			n, _ = strconv.Atoi(rev[match[4]:match[5]])
+		}
+
+		if op == "^" {
+			if n == 0 {
+				return base, nil
+			}
+			if n > len(base.ParentHashes) {
+				return nil, fmt.Errorf("revision %s: commit has no parent %d", rev, n)
+			}
+			return storage.GetCommit(base.ParentHashes[n-1])
+		}
+
+		commit := base
+		for i := 0; i < n; i++ {
+			if len(commit.ParentHashes) == 0 {
+				return nil, fmt.Errorf("revision %s: history is shorter than %d commits", rev, n)
+			}
+			if commit, err = storage.GetCommit(commit.ParentHashes[0]); err != nil {
+				return nil, err
+			}
+		}
+		return commit, nil
+	}
+
+	if mgitHash, ok, err := resolveReflogRevision(storage, rev); ok {
+		if err != nil {
+			return nil, err
+		}
+		return peelMGitObject(storage, mgitHash)
+	}
+
+	if rev == "HEAD" || rev == "@" {
+		if commit, err := storage.GetHeadCommit(); err == nil {
+			return commit, nil
+		}
+	}
+
+	// MGit refs first, since they are what MGit commits hang off
+	for _, refName := range []string{rev, "refs/heads/" + rev, "refs/tags/" + rev, "refs/remotes/" + rev} {
+		if !strings.HasPrefix(refName, "refs/") {
+			continue
+		}
+		if mgitHash, err := storage.GetRef(refName); err == nil {
+			return peelMGitObject(storage, strings.TrimSpace(mgitHash))
+		}
+	}
+
+	// Then git refs and hashes, translated through the mappings
+	if gitHash, err := resolveGitRevision(repo, rev); err == nil {
+		mgitHash, err := storage.GetMGitHashFromGit(gitHash.String())
+		if err != nil && materializeSparseCommit(repo, storage, gitHash) {
+			mgitHash, err = storage.GetMGitHashFromGit(gitHash.String())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("revision %s (%s) has no MGit commit", rev, gitHash.String()[:7])
+		}
+		return storage.GetCommit(mgitHash)
+	}
+
+	if len(rev) >= 4 {
+		if commit, err := peelMGitObject(storage, rev); err == nil {
+			return commit, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown revision %s", rev)
+}
+
+// resolveGitRevision resolves HEAD, a ref name, or a full or abbreviated
+// Git or MGit hash
+func resolveGitRevision(repo *git.Repository, rev string) (plumbing.Hash, error) {
+	if rev == "HEAD" || rev == "@" {
+		head, err := repo.Head()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return head.Hash(), nil
+	}
+
+	for _, refName := range []string{rev, "refs/heads/" + rev, "refs/tags/" + rev, "refs/remotes/" + rev} {
+		if ref, err := repo.Reference(plumbing.ReferenceName(refName), true); err == nil {
+			if tag, err := repo.TagObject(ref.Hash()); err == nil {
+				return tag.Target, nil
+			}
+			return ref.Hash(), nil
+		}
+	}
+
+	if len(rev) == 40 && plumbing.IsHash(rev) {
+		hash := plumbing.NewHash(rev)
+		if _, err := repo.CommitObject(hash); err == nil {
+			return hash, nil
+		}
+	}
+
+	// Abbreviated Git hashes, and MGit hashes of commits with a Git side
+	if isHashPrefix(rev) {
+		gitHash, _, err := resolveHashPrefix(repo, NewMGitStorage(), rev)
+		if errors.Is(err, errAmbiguousHash) {
+			return plumbing.ZeroHash, err
+		}
+		if err == nil && gitHash != "" {
+			return plumbing.NewHash(gitHash), nil
+		}
+	}
+
+	return plumbing.ZeroHash, plumbing.ErrReferenceNotFound
+}
+
+// parseRevisionRange splits "a..b" and "a...b" into their ends. A missing
+// end means HEAD. symmetric reports the three-dot form.
+func parseRevisionRange(spec string) (left, right string, symmetric, ok bool) {
+	if idx := strings.Index(spec, "..."); idx >= 0 {
+		left, right, symmetric = spec[:idx], spec[idx+3:], true
+	} else if idx := strings.Index(spec, ".."); idx >= 0 {
+		left, right = spec[:idx], spec[idx+2:]
+	} else {
+		return "", "", false, false
+	}
+
+	if left == "" {
+		left = "HEAD"
+	}
+	if right == "" {
+		right = "HEAD"
+	}
+	return left, right, symmetric, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// secp256k1 comes from btcec, whose arithmetic on secret keys runs in
+// constant time, so signing doesn't leak the key through its timing.
+
+// secpPrivateKey parses a secret key, which must be a number from 1 to
+// the order of the curve
+func secpPrivateKey(secret []byte) (*btcec.PrivateKey, error) {
+	var scalar btcec.ModNScalar
+	if len(secret) > 32 || scalar.SetByteSlice(secret) || scalar.IsZero() {
+		return nil, errors.New("invalid secret key")
+	}
+	return btcec.PrivKeyFromScalar(&scalar), nil
+}
+
+// taggedHash is BIP-340's domain-separated SHA-256
+func taggedHash(tag string, parts ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, part := range parts {
+		h.Write(part)
+	}
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// schnorrPublicKey returns the x-only public key of a secret key
+func schnorrPublicKey(secret []byte) ([]byte, error) {
+	key, err := secpPrivateKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return schnorr.SerializePubKey(key.PubKey()), nil
+}
+
+// schnorrSign makes a BIP-340 signature of a 32-byte message, the scheme
+// nostr uses for events, with fresh auxiliary randomness
+func schnorrSign(secret []byte, msg [32]byte) ([]byte, error) {
+	key, err := secpPrivateKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	var aux [32]byte
+	if _, err := rand.Read(aux[:]); err != nil {
+		return nil, err
+	}
+	sig, err := schnorr.Sign(key, msg[:], schnorr.CustomNonce(aux))
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// schnorrVerify checks a BIP-340 signature against an x-only public key
+func schnorrVerify(pub []byte, msg [32]byte, sig []byte) bool {
+	key, err := schnorr.ParsePubKey(pub)
+	if err != nil {
+		return false
+	}
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return false
+	}
+	return signature.Verify(msg[:], key)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mgit send-patch mails a series of commits as patches, for teams that
+// still review by email, and mgit am applies them on the other side:
+//
+//	mgit send-patch [--to <addr>]... [--cc <addr>]... [--mbox <file>] [--dry-run] (<since> | <a>..<b> | -<n> [<rev>])
+//
+// Each patch is one message in git format-patch's layout, with the commit's
+// MGit hash and author pubkey added as MGit-Hash and MGit-Pubkey trailers,
+// so the reviewer can tell which MGit commit it was and am can keep the
+// author's pubkey. --mbox writes the series to a file (- for stdout)
+// instead of sending it. Mail goes out over SMTP as git send-email
+// configures it: sendemail.smtpServer, sendemail.smtpServerPort,
+// sendemail.smtpEncryption (ssl or tls), sendemail.smtpUser and
+// sendemail.smtpPass. Without a password in the config, MGIT_SMTP_PASS
+// and then the credential helpers are asked for smtp://<user>@<server>.
+
+// mailPatch is one commit of a series, as mailed
+type mailPatch struct {
+	Commit  *MCommitStruct
+	Subject string
+	Body    string
+	Diff    string
+}
+
+// HandleSendPatch handles the send-patch command
+func HandleSendPatch(args []string) {
+	to := splitAddressConfig(GetConfigValue("sendemail.to", ""))
+	cc := splitAddressConfig(GetConfigValue("sendemail.cc", ""))
+	mbox, dryRun, count := "", false, 0
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		hasValue := i+1 < len(args)
+		switch {
+		case arg == "--to" && hasValue:
+			i++
+			to = append(to, args[i])
+		case strings.HasPrefix(arg, "--to="):
+			to = append(to, strings.TrimPrefix(arg, "--to="))
+		case arg == "--cc" && hasValue:
+			i++
+			cc = append(cc, args[i])
+		case strings.HasPrefix(arg, "--cc="):
+			cc = append(cc, strings.TrimPrefix(arg, "--cc="))
+		case arg == "--mbox" && hasValue:
+			i++
+			mbox = args[i]
+		case strings.HasPrefix(arg, "--mbox="):
+			mbox = strings.TrimPrefix(arg, "--mbox=")
+		case arg == "--dry-run":
+			dryRun = true
+		case len(arg) > 1 && arg[0] == '-' && isDigits(arg[1:]):
+			count, _ = strconv.Atoi(arg[1:])
+		case strings.HasPrefix(arg, "-"):
+			printSendPatchUsage()
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) > 1 || (len(positional) == 0 && count == 0) {
+		printSendPatchUsage()
+		os.Exit(1)
+	}
+	if mbox == "" && len(to) == 0 {
+		fmt.Println("Error: no recipients; give --to, set sendemail.to, or use --mbox")
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	commits, err := patchSeries(repo, storage, positional, count)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if len(commits) == 0 {
+		fmt.Println("Error: no commits to send")
+		os.Exit(1)
+	}
+
+	patches := []*mailPatch{}
+	for _, commit := range commits {
+		patch, err := formatMailPatch(repo, commit)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		patches = append(patches, patch)
+	}
+
+	if mbox != "" {
+		if err := writePatchMbox(mbox, patches, to, cc); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := sendPatches(patches, to, cc, dryRun); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printSendPatchUsage() {
+	fmt.Println("Usage: mgit send-patch [--to <addr>]... [--cc <addr>]... [--mbox <file>] [--dry-run] (<since> | <a>..<b> | -<n> [<rev>])")
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// splitAddressConfig splits a comma-separated list of addresses from the
+// config
+func splitAddressConfig(value string) []string {
+	addresses := []string{}
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// patchSeries returns the MGit commits to send, oldest first: those in
+// <a>..<b>, those since <since> up to HEAD, or the last n before <rev>.
+// Merges can't be mailed as patches and are left out.
+func patchSeries(repo *git.Repository, storage *MGitStorage, positional []string, count int) ([]*MCommitStruct, error) {
+	var commits []*MCommitStruct
+	if count > 0 {
+		rev := "HEAD"
+		if len(positional) == 1 {
+			rev = positional[0]
+		}
+		commit, err := resolveMGitRevision(repo, storage, rev)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rev, err)
+		}
+		for commit != nil && len(commits) < count {
+			commits = append(commits, commit)
+			if len(commit.ParentHashes) == 0 {
+				break
+			}
+			if commit, err = storage.GetCommit(commit.ParentHashes[0]); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		left, right, symmetric, ok := parseRevisionRange(positional[0])
+		if symmetric {
+			return nil, fmt.Errorf("a symmetric range can't be sent as a series")
+		}
+		if !ok {
+			left, right = positional[0], "HEAD"
+		}
+		include, err := resolveMGitRevision(repo, storage, right)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", right, err)
+		}
+		exclude, err := resolveMGitRevision(repo, storage, left)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", left, err)
+		}
+		commits = mgitRange(storage, []string{include.MGitHash}, []string{exclude.MGitHash})
+	}
+
+	series := []*MCommitStruct{}
+	for i := len(commits) - 1; i >= 0; i-- {
+		if len(commits[i].ParentHashes) > 1 {
+			fmt.Fprintf(os.Stderr, "Skipping merge %s\n", shortHash(commits[i].MGitHash))
+			continue
+		}
+		series = append(series, commits[i])
+	}
+	return series, nil
+}
+
+// formatMailPatch splits a commit's message into subject and body, adds
+// the MGit trailers and diffs the commit against its Git parent
+func formatMailPatch(repo *git.Repository, commit *MCommitStruct) (*mailPatch, error) {
+	gitCommit, err := repo.CommitObject(plumbing.NewHash(commit.GitHash))
+	if err != nil {
+		return nil, fmt.Errorf("error getting Git commit %s of %s: %w", shortHash(commit.GitHash), shortHash(commit.MGitHash), err)
+	}
+	parent := plumbing.ZeroHash
+	if gitCommit.NumParents() > 0 {
+		parent = gitCommit.ParentHashes[0]
+	}
+	from, err := commitDiffSide(repo, parent)
+	if err != nil {
+		return nil, err
+	}
+	to, err := commitDiffSide(repo, gitCommit.Hash)
+	if err != nil {
+		return nil, err
+	}
+	var diff bytes.Buffer
+	if _, err := writeDiff(&diff, repo, from, to, nil, &diffOptions{Context: hunkContext}); err != nil {
+		return nil, err
+	}
+
+	subject, body, _ := strings.Cut(strings.TrimRight(commit.Message, "\n"), "\n")
+	body = strings.TrimLeft(body, "\n")
+	body = addTrailer(subject+"\n\n"+body, "MGit-Hash", commit.MGitHash)
+	if commit.Author != nil && commit.Author.Pubkey != "" {
+		body = addTrailer(body, "MGit-Pubkey", commit.Author.Pubkey)
+	}
+	_, body, _ = strings.Cut(body, "\n\n")
+
+	return &mailPatch{
+		Commit:  commit,
+		Subject: strings.TrimSpace(subject),
+		Body:    body,
+		Diff:    diff.String(),
+	}, nil
+}
+
+// patchMessage renders a patch as a mail message. sender is who the mail
+// is from; when it isn't the author, the author goes in an in-body From
+// line, which am reads back, as git send-email does.
+func patchMessage(patch *mailPatch, n, total int, sender string, to, cc []string, messageID, threadID string) []byte {
+	author := patchAuthor(patch.Commit)
+	if sender == "" {
+		sender = author
+	}
+	prefix := "[PATCH]"
+	if total > 1 {
+		prefix = fmt.Sprintf("[PATCH %d/%d]", n, total)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\n", encodeAddress(sender))
+	if len(to) > 0 {
+		fmt.Fprintf(&b, "To: %s\n", strings.Join(to, ", "))
+	}
+	if len(cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s\n", strings.Join(cc, ", "))
+	}
+	when := time.Now()
+	if patch.Commit.Author != nil {
+		when = patch.Commit.Author.When
+	}
+	fmt.Fprintf(&b, "Date: %s\n", when.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Subject: %s\n", mime.QEncoding.Encode("utf-8", prefix+" "+patch.Subject))
+	fmt.Fprintf(&b, "Message-Id: %s\n", messageID)
+	if threadID != "" && threadID != messageID {
+		fmt.Fprintf(&b, "In-Reply-To: %s\n", threadID)
+		fmt.Fprintf(&b, "References: %s\n", threadID)
+	}
+	b.WriteString("MIME-Version: 1.0\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+
+	if sender != author {
+		fmt.Fprintf(&b, "From: %s\n\n", author)
+	}
+	b.WriteString(patch.Body)
+	b.WriteString("---\n")
+	b.WriteString(patch.Diff)
+	b.WriteString("-- \nmgit\n")
+	return b.Bytes()
+}
+
+// patchAuthor is a commit's author as "Name <email>"
+func patchAuthor(commit *MCommitStruct) string {
+	if commit.Author == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email)
+}
+
+// encodeAddress encodes the name of an address for a mail header, if it
+// isn't plain ASCII
+func encodeAddress(address string) string {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return address
+	}
+	if parsed.Name == mime.QEncoding.Encode("utf-8", parsed.Name) {
+		return address
+	}
+	return parsed.String()
+}
+
+// patchMessageIDs names the messages of a series; every patch replies to
+// the first, so mail clients thread them
+func patchMessageIDs(patches []*mailPatch) []string {
+	stamp := time.Now().Unix()
+	ids := []string{}
+	for i, patch := range patches {
+		ids = append(ids, fmt.Sprintf("<%d.%d.%s@mgit>", stamp, i+1, shortHash(patch.Commit.MGitHash)))
+	}
+	return ids
+}
+
+// writePatchMbox writes a series as an mbox, "From " lines in bodies
+// escaped the mboxrd way
+func writePatchMbox(output string, patches []*mailPatch, to, cc []string) error {
+	var out io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	ids := patchMessageIDs(patches)
+	for i, patch := range patches {
+		message := patchMessage(patch, i+1, len(patches), "", to, cc, ids[i], ids[0])
+		fmt.Fprintf(out, "From %s Mon Sep 17 00:00:00 2001\n", patch.Commit.MGitHash)
+		headers, body, _ := bytes.Cut(message, []byte("\n\n"))
+		out.Write(headers)
+		out.Write([]byte("\n\n"))
+		for _, line := range strings.SplitAfter(string(body), "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = ">" + line
+			}
+			io.WriteString(out, line)
+		}
+		if _, err := io.WriteString(out, "\n"); err != nil {
+			return err
+		}
+	}
+	if output != "-" {
+		noun := "patches"
+		if len(patches) == 1 {
+			noun = "patch"
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d %s to %s\n", len(patches), noun, output)
+	}
+	return nil
+}
+
+// sendPatches mails a series over SMTP
+func sendPatches(patches []*mailPatch, to, cc []string, dryRun bool) error {
+	sender := GetConfigValue("sendemail.from", "")
+	if sender == "" {
+		name, email := GetConfigValue("user.name", ""), GetConfigValue("user.email", "")
+		if email == "" {
+			return fmt.Errorf("no sender; set sendemail.from or user.email")
+		}
+		sender = fmt.Sprintf("%s <%s>", name, email)
+	}
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return fmt.Errorf("bad sender %q: %w", sender, err)
+	}
+	recipients := []string{}
+	for _, list := range [][]string{to, cc} {
+		for _, address := range list {
+			parsed, err := mail.ParseAddress(address)
+			if err != nil {
+				return fmt.Errorf("bad recipient %q: %w", address, err)
+			}
+			recipients = append(recipients, parsed.Address)
+		}
+	}
+
+	ids := patchMessageIDs(patches)
+	messages := [][]byte{}
+	for i, patch := range patches {
+		// The sender is compared by address, so a differently spelled
+		// name doesn't add an in-body From line
+		messageSender := sender
+		if patch.Commit.Author != nil && strings.EqualFold(patch.Commit.Author.Email, from.Address) {
+			messageSender = ""
+		}
+		messages = append(messages, patchMessage(patch, i+1, len(patches), messageSender, to, cc, ids[i], ids[0]))
+	}
+
+	if dryRun {
+		for i, patch := range patches {
+			fmt.Printf("Dry-Sent [PATCH %d/%d] %s\n", i+1, len(patches), patch.Subject)
+		}
+		fmt.Printf("To: %s\n", strings.Join(recipients, ", "))
+		return nil
+	}
+
+	client, err := dialSMTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	for i, message := range messages {
+		if err := sendMail(client, from.Address, recipients, message); err != nil {
+			return fmt.Errorf("error sending [PATCH %d/%d]: %w", i+1, len(patches), err)
+		}
+		fmt.Printf("Sent [PATCH %d/%d] %s\n", i+1, len(patches), patches[i].Subject)
+	}
+	return client.Quit()
+}
+
+// dialSMTP connects and logs in to the configured SMTP server
+func dialSMTP() (*smtp.Client, error) {
+	host := GetConfigValue("sendemail.smtpServer", "")
+	if host == "" {
+		return nil, fmt.Errorf("sendemail.smtpServer is not set; set it, or use --mbox")
+	}
+	encryption := GetConfigValue("sendemail.smtpEncryption", "")
+	port := GetConfigValue("sendemail.smtpServerPort", "")
+	if port == "" {
+		switch encryption {
+		case "ssl":
+			port = "465"
+		case "tls":
+			port = "587"
+		default:
+			port = "25"
+		}
+	}
+	address := net.JoinHostPort(host, port)
+	config := &tls.Config{ServerName: host}
+
+	var conn net.Conn
+	var err error
+	switch encryption {
+	case "ssl":
+		conn, err = tls.Dial("tcp", address, config)
+	case "tls", "":
+		conn, err = net.DialTimeout("tcp", address, 30*time.Second)
+	default:
+		return nil, fmt.Errorf("sendemail.smtpEncryption must be ssl or tls, not %q", encryption)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", address, err)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error talking to %s: %w", address, err)
+	}
+	if encryption == "tls" {
+		if err := client.StartTLS(config); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("error starting TLS with %s: %w", address, err)
+		}
+	}
+
+	user := GetConfigValue("sendemail.smtpUser", "")
+	if user == "" {
+		return client, nil
+	}
+	pass := GetConfigValue("sendemail.smtpPass", os.Getenv("MGIT_SMTP_PASS"))
+	if pass == "" {
+		filled, ok := credentialFill(fmt.Sprintf("smtp://%s@%s", url.PathEscape(user), address))
+		if !ok {
+			client.Close()
+			return nil, fmt.Errorf("no password for %s; set sendemail.smtpPass or MGIT_SMTP_PASS, or configure a credential helper", user)
+		}
+		pass = filled
+	}
+	if err := client.Auth(smtp.PlainAuth("", user, pass, host)); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error logging in to %s as %s: %w", address, user, err)
+	}
+	return client, nil
+}
+
+func sendMail(client *smtp.Client, from string, recipients []string, message []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The serving commands (upload-pack, receive-pack, pack-objects and
+// unpack-objects) can be limited so a small device isn't worn down by an
+// abusive client. The server's config sets the limits, and the served
+// repository's .mgit/config can only tighten them:
+//
+//	serve.timeout      seconds a connection may last
+//	serve.idleTimeout  seconds a connection may go without moving data
+//	serve.maxPackSize  bytes of pack a connection may send or receive,
+//	                   with an optional k, m or g suffix
+//	serve.rateLimit    connections a client may open, as <n>/<s|m|h>; a
+//	                   token bucket holding n, refilled over the period
+//
+// Clients are told apart by the pubkey the server passes with --pubkey.
+
+// serveLimits are the limits of one connection; zero means no limit
+type serveLimits struct {
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	MaxPackSize int64
+	RateCount   int
+	RatePeriod  time.Duration
+}
+
+var errPackTooLarge = errors.New("pack exceeds serve.maxPackSize")
+
+// loadServeLimits reads the limits for the repository whose .mgit
+// directory is mgitRoot: the server's, or the repository's where they are
+// stricter
+func loadServeLimits(mgitRoot string) (*serveLimits, error) {
+	configPath := filepath.Join(mgitRoot, "config")
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	server, err := parseServeLimits(func(key string) string {
+		return GetGlobalConfigValue("serve."+key, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	repo, err := parseServeLimits(func(key string) string {
+		return config.Get("serve", key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	return server.tighten(repo), nil
+}
+
+// parseServeLimits parses the serve.* limits get returns
+func parseServeLimits(get func(key string) string) (*serveLimits, error) {
+	var err error
+	limits := &serveLimits{}
+	for key, target := range map[string]*time.Duration{"timeout": &limits.Timeout, "idleTimeout": &limits.IdleTimeout} {
+		if value := get(key); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid serve.%s %q: want seconds", key, value)
+			}
+			*target = time.Duration(seconds) * time.Second
+		}
+	}
+	if value := get("maxPackSize"); value != "" {
+		if limits.MaxPackSize, err = parseByteSize(value); err != nil {
+			return nil, fmt.Errorf("invalid serve.maxPackSize: %w", err)
+		}
+	}
+	if value := get("rateLimit"); value != "" {
+		if limits.RateCount, limits.RatePeriod, err = parseRateLimit(value); err != nil {
+			return nil, fmt.Errorf("invalid serve.rateLimit: %w", err)
+		}
+	}
+	return limits, nil
+}
+
+// tighten returns the stricter of each of two sets of limits, no limit
+// being the least strict
+func (l *serveLimits) tighten(other *serveLimits) *serveLimits {
+	stricter := func(a, b int64) int64 {
+		if a == 0 || b != 0 && b < a {
+			return b
+		}
+		return a
+	}
+	limits := &serveLimits{
+		Timeout:     time.Duration(stricter(int64(l.Timeout), int64(other.Timeout))),
+		IdleTimeout: time.Duration(stricter(int64(l.IdleTimeout), int64(other.IdleTimeout))),
+		MaxPackSize: stricter(l.MaxPackSize, other.MaxPackSize),
+		RateCount:   l.RateCount,
+		RatePeriod:  l.RatePeriod,
+	}
+	// The stricter rate is the one allowing fewer connections over time
+	if other.RateCount > 0 && (l.RateCount == 0 ||
+		float64(other.RateCount)/other.RatePeriod.Seconds() < float64(l.RateCount)/l.RatePeriod.Seconds()) {
+		limits.RateCount, limits.RatePeriod = other.RateCount, other.RatePeriod
+	}
+	return limits
+}
+
+// parseByteSize parses a byte count with an optional k, m or g suffix
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", value)
+	}
+	return n * multiplier, nil
+}
+
+// parseRateLimit parses <n>/<period>, the period being s, m or h
+func parseRateLimit(value string) (int, time.Duration, error) {
+	countText, periodText, ok := strings.Cut(value, "/")
+	count, err := strconv.Atoi(countText)
+	if !ok || err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("%q is not <n>/<period>", value)
+	}
+	periods := map[string]time.Duration{
+		"s": time.Second, "sec": time.Second,
+		"m": time.Minute, "min": time.Minute,
+		"h": time.Hour, "hour": time.Hour,
+	}
+	period, ok := periods[periodText]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown period %q, want s, m or h", periodText)
+	}
+	return count, period, nil
+}
+
+// serveRateState is the token bucket of each client, kept in .mgit
+type serveRateState map[string]struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// serveRateLockStale is when a rate lock left by a crashed process is
+// broken
+const serveRateLockStale = 10 * time.Second
+
+// admitConnection takes a token from the client's bucket, failing when the
+// bucket is empty
+func admitConnection(mgitRoot string, limits *serveLimits, client string) error {
+	if limits.RateCount == 0 {
+		return nil
+	}
+	if client == "" {
+		client = "anonymous"
+	}
+
+	if err := os.MkdirAll(mgitRoot, 0755); err != nil {
+		return err
+	}
+	unlock, err := lockServeRate(mgitRoot)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(mgitRoot, "serve-rate.json")
+	state := serveRateState{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &state)
+	}
+
+	now := time.Now()
+	bucket, ok := state[client]
+	if !ok {
+		bucket.Tokens = float64(limits.RateCount)
+	} else {
+		refill := now.Sub(bucket.Updated).Seconds() / limits.RatePeriod.Seconds() * float64(limits.RateCount)
+		bucket.Tokens = math.Min(bucket.Tokens+refill, float64(limits.RateCount))
+	}
+	bucket.Updated = now
+	admitted := bucket.Tokens >= 1
+	if admitted {
+		bucket.Tokens--
+	}
+	state[client] = bucket
+
+	// Forget clients whose buckets are full again
+	for name, b := range state {
+		if now.Sub(b.Updated) > limits.RatePeriod {
+			delete(state, name)
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	if !admitted {
+		return fmt.Errorf("rate limit of %d connections per %s exceeded", limits.RateCount, limits.RatePeriod)
+	}
+	return nil
+}
+
+// lockServeRate serializes updates of the rate state between concurrent
+// connections, returning the function that releases the lock
+func lockServeRate(mgitRoot string) (func(), error) {
+	path := filepath.Join(mgitRoot, "serve-rate.lock")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > serveRateLockStale {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveGuard enforces the timeouts and pack size of a connection. When one
+// is passed, it cancels its context with the reason.
+type serveGuard struct {
+	limits *serveLimits
+	ctx    context.Context
+	cancel context.CancelFunc
+	idle   *time.Timer
+	mu     sync.Mutex
+	reason error
+}
+
+func newServeGuard(limits *serveLimits) *serveGuard {
+	g := &serveGuard{limits: limits}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	if limits.Timeout > 0 {
+		time.AfterFunc(limits.Timeout, func() {
+			g.stop(fmt.Errorf("connection exceeded serve.timeout of %s", limits.Timeout))
+		})
+	}
+	if limits.IdleTimeout > 0 {
+		g.idle = time.AfterFunc(limits.IdleTimeout, func() {
+			g.stop(fmt.Errorf("connection idle for serve.idleTimeout of %s", limits.IdleTimeout))
+		})
+	}
+	return g
+}
+
+// stop ends the connection; the first reason given is kept
+func (g *serveGuard) stop(reason error) {
+	g.mu.Lock()
+	if g.reason == nil {
+		g.reason = reason
+	}
+	g.mu.Unlock()
+	g.cancel()
+}
+
+// Err is why the connection was stopped, or nil
+func (g *serveGuard) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reason
+}
+
+// exitOnStop exits the process with the reason once the connection is
+// stopped, for commands that serve in-process rather than through git
+func (g *serveGuard) exitOnStop() {
+	go func() {
+		<-g.ctx.Done()
+		if err := g.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// activity restarts the idle clock
+func (g *serveGuard) activity() {
+	if g.idle != nil {
+		g.idle.Reset(g.limits.IdleTimeout)
+	}
+}
+
+// Reader watches data read from a client. If pack is set the data counts
+// toward serve.maxPackSize.
+func (g *serveGuard) Reader(r io.Reader, pack bool) io.Reader {
+	return &guardedReader{r: r, guard: g, pack: pack}
+}
+
+// Writer watches data written to a client. If pack is set the data counts
+// toward serve.maxPackSize.
+func (g *serveGuard) Writer(w io.Writer, pack bool) io.Writer {
+	return &guardedWriter{w: w, guard: g, pack: pack}
+}
+
+// count adds n pack bytes, stopping the connection past the limit
+func (g *serveGuard) count(total *int64, n int) error {
+	*total += int64(n)
+	if g.limits.MaxPackSize > 0 && *total > g.limits.MaxPackSize {
+		g.stop(fmt.Errorf("%w (%d bytes)", errPackTooLarge, g.limits.MaxPackSize))
+		return errPackTooLarge
+	}
+	return nil
+}
+
+type guardedReader struct {
+	r     io.Reader
+	guard *serveGuard
+	pack  bool
+	total int64
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.guard.activity()
+	if r.pack && n > 0 {
+		// Data past the limit is dropped rather than passed on with the
+		// error, so buffering readers can't use it anyway
+		if countErr := r.guard.count(&r.total, n); countErr != nil {
+			return 0, countErr
+		}
+	}
+	return n, err
+}
+
+type guardedWriter struct {
+	w     io.Writer
+	guard *serveGuard
+	pack  bool
+	total int64
+}
+
+func (w *guardedWriter) Write(p []byte) (int, error) {
+	if w.pack {
+		if err := w.guard.count(&w.total, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.w.Write(p)
+	w.guard.activity()
+	return n, err
+}
+
+// startServing loads the limits of the repository whose .mgit directory is
+// mgitRoot and admits the client, exiting if it is over its rate
+func startServing(mgitRoot, client string) *serveGuard {
+	limits, err := loadServeLimits(mgitRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if err := admitConnection(mgitRoot, limits, client); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	return newServeGuard(limits)
+}
+
+// serveGit runs a git serving command within a connection's limits, which
+// kill it when passed. The pack goes to the client from upload-pack and
+// comes from it to receive-pack, so packIn says which way to count it.
+// The client's input is copied without being waited for, since a read of
+// our stdin can't be interrupted.
+func serveGit(guard *serveGuard, gitArgs []string, packIn bool) error {
+	cmd := exec.CommandContext(guard.ctx, "git", gitArgs...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, guard.Reader(os.Stdin, packIn))
+		stdin.Close()
+	}()
+	io.Copy(guard.Writer(os.Stdout, !packIn), stdout)
+
+	if err := cmd.Wait(); err != nil {
+		if limitErr := guard.Err(); limitErr != nil {
+			return limitErr
+		}
+		return err
+	}
+	return nil
+}
+
+// servedGitDir checks that repoPath is a Git repository, with a .git
+// directory or bare, and returns its Git directory
+func servedGitDir(repoPath string) (string, error) {
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		return "", fmt.Errorf("repository at %s does not exist", repoPath)
+	}
+	gitDir := filepath.Join(repoPath, ".git")
+	if _, err := os.Stat(gitDir); os.IsNotExist(err) {
+		// A bare repository is its own Git directory
+		if _, err := os.Stat(filepath.Join(repoPath, "objects")); os.IsNotExist(err) {
+			return "", fmt.Errorf("%s is not a valid Git repository", repoPath)
+		}
+		gitDir = repoPath
+	}
+	return gitDir, nil
+}
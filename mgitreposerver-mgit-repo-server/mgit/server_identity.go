@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A remote can be pinned to the nostr identity of its server with
+// remote.<name>.serverNpub. Before talking to the remote, mgit sends the
+// server a random challenge and requires back an event signed by that
+// npub naming the challenge, the host it was asked for and the public key
+// of the TLS certificate it serves, so a hijacked DNS name or a look-alike
+// server without the key is refused, even one that relays the challenge
+// to the real server. Every later connection to the remote in the same
+// run, git's included, must present that same certificate key.
+
+// kindServerIdentity is the kind of the event a server signs to prove its
+// identity, ephemeral like NIP-42's client authentication (22242)
+const kindServerIdentity = 22243
+
+// serverIdentityMaxSkew is how far the proof's time may be from ours
+const serverIdentityMaxSkew = 10 * time.Minute
+
+// verifiedServer is a server proven in this process and the public key
+// pin of the certificate it answered on
+type verifiedServer struct {
+	base string
+	pin  string
+}
+
+// verifiedServers remembers the server proven for each remote
+var verifiedServers = map[string]verifiedServer{}
+
+// identityPin returns the pin of the certificate a remote's server proved
+// its identity on, if it has
+func identityPin(remoteName string) string {
+	return verifiedServers[remoteName].pin
+}
+
+// verifyServerIdentity checks that a remote's server holds the key of
+// remote.<name>.serverNpub. Remotes without one aren't checked.
+func verifyServerIdentity(remoteName, remoteURL string) error {
+	expected := GetConfigValue(fmt.Sprintf("remote.%s.serverNpub", remoteName), "")
+	if expected == "" {
+		return nil
+	}
+	pubkey, err := decodeNostrKey(expected, "npub")
+	if err != nil {
+		return fmt.Errorf("remote.%s.serverNpub: %w", remoteName, err)
+	}
+	base := serverBaseURL(remoteURL)
+	if verified, ok := verifiedServers[remoteName]; ok && verified.base == base {
+		return nil
+	}
+
+	span := startSpan("server.identity", "url", base)
+	pin, err := proveServerIdentity(remoteName, base, pubkey)
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("cannot verify the identity of %s: %w\n"+
+			"If the server's key was legitimately changed, update remote.%s.serverNpub", base, err, remoteName)
+	}
+	verifiedServers[remoteName] = verifiedServer{base: base, pin: pin}
+	// Connections made from here on must present the proven certificate
+	forgetHTTPClient(remoteName)
+	return nil
+}
+
+// proveServerIdentity has the server at base sign a fresh challenge and
+// checks the signature is by pubkey and binds the connection it came on.
+// It returns the pin of the certificate the server presented.
+func proveServerIdentity(remoteName, base string, pubkey []byte) (string, error) {
+	target, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if target.Scheme != "https" {
+		return "", fmt.Errorf("a server's identity can only be verified over https")
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	challenge := hex.EncodeToString(nonce)
+
+	body, err := json.Marshal(map[string]string{"challenge": challenge})
+	if err != nil {
+		return "", err
+	}
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Post(base+"/api/mgit/server/identity", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("the server has no identity endpoint")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return "", fmt.Errorf("the server presented no certificate")
+	}
+	pin := publicKeyPin(resp.TLS.PeerCertificates[0])
+
+	var reply struct {
+		Event nostrEvent `json:"event"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("invalid identity response: %w", err)
+	}
+	return pin, checkServerIdentityEvent(&reply.Event, challenge, target.Host, pin, pubkey)
+}
+
+// checkServerIdentityEvent checks a server's answer to a challenge sent to
+// host over a connection presenting the certificate of pin
+func checkServerIdentityEvent(event *nostrEvent, challenge, host, pin string, pubkey []byte) error {
+	if event.Kind != kindServerIdentity {
+		return fmt.Errorf("identity event has kind %d, not %d", event.Kind, kindServerIdentity)
+	}
+	if event.PubKey != hex.EncodeToString(pubkey) {
+		got, err := hex.DecodeString(event.PubKey)
+		if err != nil || len(got) != 32 {
+			return fmt.Errorf("identity event has an invalid pubkey")
+		}
+		return fmt.Errorf("the server is %s, not %s", encodeNpub(got), encodeNpub(pubkey))
+	}
+	tags := map[string]string{}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 {
+			tags[tag[0]] = tag[1]
+		}
+	}
+	if tags["challenge"] != challenge {
+		return fmt.Errorf("identity event doesn't answer our challenge")
+	}
+	if !strings.EqualFold(tags["host"], host) {
+		return fmt.Errorf("identity event is for host %q, not %q", tags["host"], host)
+	}
+	switch tags["spki"] {
+	case pin:
+	case "":
+		return fmt.Errorf("identity event doesn't name the server's certificate; set MGIT_SERVER_TLS_CERT on the server")
+	default:
+		return fmt.Errorf("identity event is for certificate key %s, but the connection presented %s", tags["spki"], pin)
+	}
+	if skew := time.Since(time.Unix(event.CreatedAt, 0)); skew > serverIdentityMaxSkew || skew < -serverIdentityMaxSkew {
+		return fmt.Errorf("identity event is dated %s", time.Unix(event.CreatedAt, 0).Format(time.RFC3339))
+	}
+
+	claimed := event.ID
+	id, err := event.computeID()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(id[:]) != claimed {
+		return fmt.Errorf("identity event has a wrong id")
+	}
+	sig, err := hex.DecodeString(event.Sig)
+	if err != nil || !schnorrVerify(pubkey, id, sig) {
+		return fmt.Errorf("identity event has a bad signature")
+	}
+	return nil
+}
+
+// serverBaseURL is the server part of a clone URL (http://host/repo) or a
+// remote URL (http://host/api/mgit/repos/repo)
+func serverBaseURL(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	if base, _, ok := strings.Cut(url, "/api/mgit/repos/"); ok {
+		return base
+	}
+	return extractServerBaseURL(url)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// A clone made with --depth has only the newest commits of its branch. Git
+// lists the commits whose parents it didn't fetch in .git/shallow, and
+// .mgit/shallow lists their MGit hashes, so that walks such as verify stop
+// there instead of looking for parents that were never fetched. A shallow
+// repository asks the server only for the mappings and MGit objects of the
+// commits it has: the clone with the metadata endpoint's depth query, later
+// fetches by dropping mappings of commits it lacks.
+
+// mgitShallowPath returns the path of the shallow file in an .mgit directory
+func mgitShallowPath(rootDir string) string {
+	return filepath.Join(rootDir, "shallow")
+}
+
+// gitShallowCommits returns the Git commits whose parents a shallow
+// repository lacks, none if it has its full history
+func gitShallowCommits(repo *git.Repository) []plumbing.Hash {
+	hashes, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil
+	}
+	return hashes
+}
+
+// openShallowRepo opens the repository at path if it is shallow
+func openShallowRepo(path string) (*git.Repository, bool) {
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil || len(gitShallowCommits(repo)) == 0 {
+		return nil, false
+	}
+	return repo, true
+}
+
+// shallowMetadataQuery returns the metadata query of a clone made with
+// --depth, which only has the history of its checked-out branch
+func shallowMetadataQuery(destination string, depth int) string {
+	query := neturl.Values{}
+	query.Set("depth", fmt.Sprint(depth))
+	repo, err := git.PlainOpen(destination)
+	if err == nil {
+		if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+			query.Set("branch", head.Name().Short())
+		}
+	}
+	return query.Encode()
+}
+
+// keepLocalMappings passes on only the mappings of Git commits repo has
+func keepLocalMappings(repo *git.Repository, fn func(NostrCommitMapping) error) func(NostrCommitMapping) error {
+	return func(mapping NostrCommitMapping) error {
+		if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash(mapping.GitHash)); err != nil {
+			return nil
+		}
+		return fn(mapping)
+	}
+}
+
+// mappedObjectWants returns the MGit commits of the mappings in an .mgit
+// directory that it has no object for. A shallow repository, or one with
+// sparse metadata, asks for just these instead of every object the server
+// has.
+func mappedObjectWants(rootDir string) ([]string, error) {
+	local, err := listMGitObjects(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, hash := range local {
+		have[hash] = true
+	}
+	want := []string{}
+	err = NewMappingStore(rootDir).ForEach(func(mapping NostrCommitMapping) error {
+		if !have[mapping.MGitHash] {
+			have[mapping.MGitHash] = true
+			want = append(want, mapping.MGitHash)
+		}
+		return nil
+	})
+	return want, err
+}
+
+// writeMGitShallow records the MGit hashes of a repository's shallow
+// boundary in .mgit/shallow, removing it once the repository has its full
+// history
+func writeMGitShallow(rootDir string, repo *git.Repository, mgitHashOf func(gitHash string) (string, bool)) error {
+	path := mgitShallowPath(rootDir)
+	boundary := gitShallowCommits(repo)
+	if len(boundary) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	hashes := []string{}
+	for _, hash := range boundary {
+		if mgitHash, ok := mgitHashOf(hash.String()); ok {
+			hashes = append(hashes, mgitHash)
+		}
+	}
+	sort.Strings(hashes)
+	return os.WriteFile(path, []byte(strings.Join(hashes, "\n")+"\n"), 0644)
+}
+
+// loadMGitShallow returns the MGit hashes listed in .mgit/shallow
+func loadMGitShallow(rootDir string) map[string]bool {
+	shallow := map[string]bool{}
+	file, err := os.Open(mgitShallowPath(rootDir))
+	if err != nil {
+		return shallow
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+			shallow[hash] = true
+		}
+	}
+	return shallow
+}
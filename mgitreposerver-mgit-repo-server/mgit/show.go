@@ -1,9 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
@@ -22,7 +22,7 @@ func HandleShow(args []string) {
 	repo := getRepo()
 
 	// Try to resolve the reference
-	hash, err := resolveRevision(repo, commitRef)
+	hash, err := resolveGitRevision(repo, commitRef)
 	if err != nil {
 		fmt.Printf("Error resolving reference '%s': %s\n", commitRef, err)
 		os.Exit(1)
@@ -44,29 +44,46 @@ func HandleShow(args []string) {
 
 // HandleMGitShow handles the mgit show command, showing a specific MGit commit
 func HandleMGitShow(args []string) {
+	format, args := formatOption(args)
 	if len(args) < 1 {
-			fmt.Println("Usage: mgit show <hash>")
+			fmt.Println("Usage: mgit show [--format=<template>] <commit>")
 			os.Exit(1)
 	}
 
 	hash := args[0]
 	storage := NewMGitStorage()
 
-	// Get the MGit commit
-	mgitCommit, err := storage.GetCommit(hash)
+	// Get the MGit commit, from a ref or a Git or MGit hash
+	mgitCommit, err := resolveMGitRevision(getRepo(), storage, hash)
 	if err != nil {
 			fmt.Printf("Error: %s\n", err)
 			os.Exit(1)
 	}
 
+	// An annotated tag, named or by MGit hash, is shown before the commit
+	// it tags
+	if format == "" {
+			showTagFor(storage, hash)
+	}
+
 	// Print the MGit commit details
-	printMGitCommit(mgitCommit)
+	if format != "" {
+			formatter, err := newCommitFormatter(storage, format)
+			if err != nil {
+					fmt.Printf("Error: %s\n", err)
+					os.Exit(1)
+			}
+			formatter.Print(mgitCommit)
+	} else {
+			printMGitCommit(mgitCommit, nil)
+			printCommitNotes(getRepo(), mgitCommit.GitHash)
+	}
 
 	// Show parent information
-	if len(mgitCommit.ParentHashes) > 0 {
+	if len(mgitCommit.ParentHashes) > 0 && format == "" {
 			fmt.Println("Parents:")
 			for _, parent := range mgitCommit.ParentHashes {
-					fmt.Printf("  %s\n", parent)
+					fmt.Printf("  %s\n", displayParentHash(storage, parent))
 			}
 			fmt.Println()
 	}
@@ -93,102 +110,6 @@ func HandleMGitShow(args []string) {
 	showCommitDiff(repo, gitCommit)
 }
 
-// resolveRevision resolves a revision (branch, tag, commit hash) to a commit hash
-func resolveRevision(repo *git.Repository, rev string) (plumbing.Hash, error) {
-	// If it's HEAD, resolve it
-	if rev == "HEAD" {
-			ref, err := repo.Head()
-			if err == nil {
-					return ref.Hash(), nil
-			}
-	}
-
-	// Try to resolve as a reference (branch, tag)
-	ref, err := repo.Reference(plumbing.ReferenceName(rev), true)
-	if err == nil {
-			return ref.Hash(), nil
-	}
-
-	// Try with refs/heads/ prefix
-	ref, err = repo.Reference(plumbing.ReferenceName("refs/heads/"+rev), true)
-	if err == nil {
-			return ref.Hash(), nil
-	}
-
-	// Try with refs/tags/ prefix
-	ref, err = repo.Reference(plumbing.ReferenceName("refs/tags/"+rev), true)
-	if err == nil {
-			return ref.Hash(), nil
-	}
-
-	// If it's a full 40-char hash
-	if len(rev) == 40 && plumbing.IsHash(rev) {
-			hash := plumbing.NewHash(rev)
-			_, err := repo.CommitObject(hash)
-			if err == nil {
-					return hash, nil
-			}
-	}
-
-	// If it's a partial hash, try to find a matching commit
-	if len(rev) >= 4 && len(rev) < 40 {
-			// List all commits and find a match
-			iter, err := repo.CommitObjects()
-			if err != nil {
-					return plumbing.ZeroHash, fmt.Errorf("error listing commits: %s", err)
-			}
-			defer iter.Close()
-
-			var matchingHash plumbing.Hash
-			matchCount := 0
-
-			err = iter.ForEach(func(c *object.Commit) error {
-					if strings.HasPrefix(c.Hash.String(), rev) {
-							matchingHash = c.Hash
-							matchCount++
-					}
-					return nil
-			})
-
-			if err != nil {
-					return plumbing.ZeroHash, fmt.Errorf("error searching commits: %s", err)
-			}
-
-			if matchCount == 1 {
-					return matchingHash, nil
-			} else if matchCount > 1 {
-					return plumbing.ZeroHash, fmt.Errorf("ambiguous commit hash prefix: %s", rev)
-			}
-	}
-
-	// Check nostr mappings for MGit hashes
-	if pubkey := GetNostrPubKey(); pubkey != "" {
-			// Read all mappings and search for matches
-			mappings := getAllNostrMappings()
-			if len(mappings) > 0 {
-				// fmt.Printf("Checking %d nostr mappings for hash '%s'\n", len(mappings), rev)
-
-				for _, mapping := range mappings {
-					// fmt.Printf("Comparing with: Git=%s, MGit=%s\n", mapping.GitHash, mapping.MGitHash)
-					
-					// Check for exact MGitHash match
-					if mapping.MGitHash == rev {
-							// fmt.Printf("Found mapping: MGit=%s -> Git=%s\n", rev, mapping.GitHash)
-							return plumbing.NewHash(mapping.GitHash), nil
-					}
-					
-					// Check for prefix match if it's a partial hash
-					if len(rev) >= 4 && len(rev) < 40 && strings.HasPrefix(mapping.MGitHash, rev) {
-							// fmt.Printf("Found mapping for partial hash: MGit=%s -> Git=%s\n", mapping.MGitHash, mapping.GitHash)
-							return plumbing.NewHash(mapping.GitHash), nil
-					}
-				}
-			}
-			fmt.Printf("No matching MGit hash found in mappings\n")
-	} else { fmt.Printf("no nostr pubkey!") }
-	return plumbing.ZeroHash, fmt.Errorf("revision not found")
-}
-
 // displayCommit shows formatted commit information
 func displayCommit(commit *object.Commit) {
 	// Get the MGit hash for this commit
@@ -221,45 +142,30 @@ func displayCommit(commit *object.Commit) {
 	fmt.Println()
 }
 
-// showCommitDiff shows the diff for a commit using git's diff command
+// showCommitDiff shows the diff a commit makes to its first parent
 func showCommitDiff(repo *git.Repository, commit *object.Commit) {
-	// Get the repository path
-	wt, err := repo.Worktree()
+	parent := plumbing.ZeroHash
+	if len(commit.ParentHashes) > 0 {
+			parent = commit.ParentHashes[0]
+	}
+	before, err := commitDiffSide(repo, parent)
 	if err != nil {
-			fmt.Printf("Error getting worktree: %s\n", err)
+			fmt.Printf("Error reading parent tree: %s\n", err)
 			return
 	}
-	repoPath := wt.Filesystem.Root()
-
-	// Prepare git command to show the diff
-	var cmd *exec.Cmd
-	var args []string
-
-	// For commits with a parent, we don't need to handle the parent specially
-	// git show will automatically compare with the parent
-	args = []string{"-C", repoPath, "show", "--no-color", "--patch", commit.Hash.String()}
-	
-	cmd = exec.Command("git", args...)
-	
-	// Run the command and capture output
-	output, err := cmd.Output()
+	after, err := commitDiffSide(repo, commit.Hash)
 	if err != nil {
-			fmt.Printf("Error executing git diff: %s\n", err)
-			if exitErr, ok := err.(*exec.ExitError); ok {
-					fmt.Printf("git diff stderr: %s\n", string(exitErr.Stderr))
-			}
+			fmt.Printf("Error reading commit tree: %s\n", err)
 			return
 	}
-	
-	// Extract just the diff part (after the commit information)
-	diffOutput := string(output)
-	diffStart := strings.Index(diffOutput, "diff --git")
-	if diffStart >= 0 {
-			diffOutput = diffOutput[diffStart:]
+
+	out := bufio.NewWriter(os.Stdout)
+	_, err = writeDiff(out, repo, before, after, nil, &diffOptions{Context: hunkContext})
+	out.Flush()
+	if err != nil {
+			fmt.Printf("Error computing diff: %s\n", err)
 	}
-	
-	// Print the diff
-	fmt.Println(diffOutput)
+	fmt.Println()
 }
 
 // displayFileDiff shows the diff for a single file change
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signer makes nostr (BIP-340 Schnorr) signatures. Backends differ in where
+// the secret key lives: in a file on this machine, or on a device that
+// never hands it out.
+type Signer interface {
+	// PublicKey returns the x-only public key, 32 bytes
+	PublicKey() ([]byte, error)
+	// Sign signs a 32-byte digest, returning a 64-byte signature
+	Sign(digest [32]byte) ([]byte, error)
+	Close() error
+}
+
+// newSigner opens the signer chosen by signer.backend:
+//
+//	local    the secret key from MGIT_NSEC or the file signer.keyFile
+//	device   a signing device on a serial port, signer.device
+//	command  a program speaking the device protocol on stdin and stdout,
+//	         signer.command, e.g. a bridge to an NFC card
+func newSigner() (Signer, error) {
+	backend := GetConfigValue("signer.backend", "local")
+	switch backend {
+	case "local":
+		return newLocalSigner()
+	case "device":
+		device := GetConfigValue("signer.device", "")
+		if device == "" {
+			return nil, fmt.Errorf("signer.device is not set")
+		}
+		return openDeviceSigner(device)
+	case "command":
+		command := GetConfigValue("signer.command", "")
+		if command == "" {
+			return nil, fmt.Errorf("signer.command is not set")
+		}
+		return startCommandSigner(command)
+	}
+	return nil, fmt.Errorf("unknown signer backend %q", backend)
+}
+
+// localSigner holds the secret key in memory
+type localSigner struct {
+	secret []byte
+}
+
+func newLocalSigner() (*localSigner, error) {
+	value := os.Getenv("MGIT_NSEC")
+	if value == "" {
+		keyFile := GetConfigValue("signer.keyFile", "")
+		if keyFile == "" {
+			return nil, fmt.Errorf("no signing key: set MGIT_NSEC or signer.keyFile, or use a device with signer.backend")
+		}
+		data, err := os.ReadFile(expandHomePath(keyFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key: %w", err)
+		}
+		value = string(data)
+	}
+
+	secret, err := decodeNostrKey(value, "nsec")
+	if err != nil {
+		return nil, err
+	}
+	return &localSigner{secret: secret}, nil
+}
+
+func (s *localSigner) PublicKey() ([]byte, error) {
+	return schnorrPublicKey(s.secret)
+}
+
+func (s *localSigner) Sign(digest [32]byte) ([]byte, error) {
+	return schnorrSign(s.secret, digest)
+}
+
+func (s *localSigner) Close() error {
+	for i := range s.secret {
+		s.secret[i] = 0
+	}
+	return nil
+}
+
+// protocolSigner talks to a signing device with a line protocol:
+//
+//	> PUBKEY
+//	< OK <64 hex characters: x-only public key>
+//	> SIGN <64 hex characters: digest>
+//	< OK <128 hex characters: signature>
+//
+// Any request may be answered "ERR <reason>", e.g. when the user declines
+// on the device. Replies are checked before use, so a faulty device can't
+// produce a commit signature that doesn't verify.
+type protocolSigner struct {
+	conn    io.ReadWriteCloser
+	reader  *bufio.Reader
+	timeout time.Duration
+	pubkey  []byte
+	cleanup func() error
+}
+
+func newProtocolSigner(conn io.ReadWriteCloser, cleanup func() error) *protocolSigner {
+	timeout := 60 * time.Second
+	if seconds, err := strconv.Atoi(GetConfigValue("signer.timeout", "")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return &protocolSigner{conn: conn, reader: bufio.NewReader(conn), timeout: timeout, cleanup: cleanup}
+}
+
+// request sends one command and waits for its reply. Devices may wait for
+// a button press, hence the generous timeout.
+func (s *protocolSigner) request(command string) (string, error) {
+	if _, err := io.WriteString(s.conn, command+"\n"); err != nil {
+		return "", fmt.Errorf("error writing to signer: %w", err)
+	}
+
+	type reply struct {
+		line string
+		err  error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		line, err := s.reader.ReadString('\n')
+		replies <- reply{strings.TrimSpace(line), err}
+	}()
+
+	select {
+	case r := <-replies:
+		if r.err != nil && r.line == "" {
+			return "", fmt.Errorf("error reading from signer: %w", r.err)
+		}
+		if strings.HasPrefix(r.line, "ERR") {
+			return "", fmt.Errorf("signer refused: %s", strings.TrimSpace(strings.TrimPrefix(r.line, "ERR")))
+		}
+		if !strings.HasPrefix(r.line, "OK ") {
+			return "", fmt.Errorf("unexpected reply from signer: %q", r.line)
+		}
+		return strings.TrimPrefix(r.line, "OK "), nil
+	case <-time.After(s.timeout):
+		return "", fmt.Errorf("signer did not answer within %s", s.timeout)
+	}
+}
+
+func (s *protocolSigner) PublicKey() ([]byte, error) {
+	if s.pubkey != nil {
+		return s.pubkey, nil
+	}
+	reply, err := s.request("PUBKEY")
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := hex.DecodeString(reply)
+	if err != nil || len(pubkey) != 32 {
+		return nil, fmt.Errorf("signer sent an invalid public key")
+	}
+	s.pubkey = pubkey
+	return pubkey, nil
+}
+
+func (s *protocolSigner) Sign(digest [32]byte) ([]byte, error) {
+	pubkey, err := s.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := s.request("SIGN " + hex.EncodeToString(digest[:]))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hex.DecodeString(reply)
+	if err != nil || len(sig) != 64 {
+		return nil, fmt.Errorf("signer sent an invalid signature")
+	}
+	if !schnorrVerify(pubkey, digest, sig) {
+		return nil, fmt.Errorf("signer sent a signature that does not verify")
+	}
+	return sig, nil
+}
+
+func (s *protocolSigner) Close() error {
+	err := s.conn.Close()
+	if s.cleanup != nil {
+		if cleanupErr := s.cleanup(); err == nil {
+			err = cleanupErr
+		}
+	}
+	return err
+}
+
+// openDeviceSigner opens a serial signing device, setting its speed from
+// signer.baud
+func openDeviceSigner(device string) (*protocolSigner, error) {
+	file, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening signing device: %w", err)
+	}
+	baud, err := strconv.Atoi(GetConfigValue("signer.baud", "115200"))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid signer.baud: %w", err)
+	}
+	if err := configureSerial(file, baud); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error configuring signing device: %w", err)
+	}
+	return newProtocolSigner(file, nil), nil
+}
+
+// commandConn joins a child process's stdout and stdin into one connection
+type commandConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// startCommandSigner runs a signer program in the shell
+func startCommandSigner(command string) (*protocolSigner, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting signer command: %w", err)
+	}
+	return newProtocolSigner(commandConn{stdout, stdin}, cmd.Wait), nil
+}
+
+// mgitSignatureDigest is what a commit signature signs: the MGit hash,
+// domain-separated so the signature can't be replayed as a nostr event
+func mgitSignatureDigest(mgitHash string) [32]byte {
+	return taggedHash("mgit/commit", []byte(mgitHash))
+}
+
+// signMGitCommit signs a commit's MGit hash, recording the signature in
+// its metadata. The signer's key must be the author's pubkey.
+func signMGitCommit(signer Signer, commit *MCommitStruct) error {
+	if commit.Author == nil || commit.Author.Pubkey == "" {
+		return fmt.Errorf("commit has no author pubkey to sign with")
+	}
+	authorKey, err := decodeNostrKey(commit.Author.Pubkey, "npub")
+	if err != nil {
+		return fmt.Errorf("author pubkey: %w", err)
+	}
+	signerKey, err := signer.PublicKey()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(signerKey, authorKey) {
+		return fmt.Errorf("signing key %s is not the author pubkey %s", encodeNpub(signerKey), commit.Author.Pubkey)
+	}
+
+	sig, err := signer.Sign(mgitSignatureDigest(commit.MGitHash))
+	if err != nil {
+		return err
+	}
+	if commit.Metadata == nil {
+		commit.Metadata = map[string]string{}
+	}
+	commit.Metadata["signature"] = hex.EncodeToString(sig)
+	return nil
+}
+
+// verifyMGitSignature checks the signature recorded on a commit, if any.
+// signed reports whether there was one.
+func verifyMGitSignature(commit *MCommitStruct) (signed bool, err error) {
+	sigHex := commit.Metadata["signature"]
+	if sigHex == "" {
+		return false, nil
+	}
+	if commit.Author == nil || commit.Author.Pubkey == "" {
+		return true, fmt.Errorf("signed commit has no author pubkey")
+	}
+	pubkey, err := decodeNostrKey(commit.Author.Pubkey, "npub")
+	if err != nil {
+		return true, err
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return true, fmt.Errorf("malformed signature")
+	}
+	if !schnorrVerify(pubkey, mgitSignatureDigest(commit.MGitHash), sig) {
+		return true, fmt.Errorf("bad signature")
+	}
+	return true, nil
+}
+
+// HandleSigner handles the signer command, which shows the configured
+// signer and its public key, asking the device for it if need be
+func HandleSigner(args []string) {
+	if len(args) > 0 && args[0] != "status" {
+		fmt.Println("Usage: mgit signer [status]")
+		os.Exit(1)
+	}
+
+	signer, err := newSigner()
+	if err != nil {
+		fmt.Printf("Error opening signer: %s\n", err)
+		os.Exit(1)
+	}
+	defer signer.Close()
+
+	pubkey, err := signer.PublicKey()
+	if err != nil {
+		fmt.Printf("Error reading public key from signer: %s\n", err)
+		os.Exit(1)
+	}
+	npub := encodeNpub(pubkey)
+	fmt.Printf("Backend: %s\n", GetConfigValue("signer.backend", "local"))
+	fmt.Printf("Public key: %s\n", npub)
+	if configured := GetNostrPubKey(); configured != "" && configured != npub {
+		fmt.Printf("Warning: user.pubkey is %s, so commits can't be signed with this key\n", configured)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Sensitive paths can be reserved to a group of pubkeys. A commit changing
+// a path that matches a signpath pattern must be signed (-S) by a member
+// of the pattern's group:
+//
+//	[signgroup "clinicians"]
+//		members = npub1... npub1...
+//	[signpath "records/**"]
+//		group = clinicians
+//
+// or mgit config signpath.records/**.group clinicians. Patterns are
+// wildmatch globs, where ** crosses directories. The rules are checked by
+// mgit commit, before anything is written, and by mgit verify for the
+// whole history; a merge is held to them only for the paths it changes
+// from every parent, i.e. its conflict resolutions.
+
+// signingRule reserves the paths matching a pattern to a group
+type signingRule struct {
+	Pattern string
+	Group   string
+	Members map[string]bool // hex pubkeys
+	match   *regexp.Regexp
+}
+
+// signingRules are the rules of a repository
+type signingRules []signingRule
+
+// loadSigningRules reads the rules from the global config and the config
+// of an MGit store, whose sections override the global ones
+func loadSigningRules(storage *MGitStorage) (signingRules, error) {
+	local := filepath.Join(storage.RootDir, "config")
+	if storage.RootDir == mgitCommonDir() {
+		local = GetConfigFilePath(false)
+	}
+	sections := map[string]map[string]string{}
+	for _, path := range []string{GetConfigFilePath(true), local} {
+		if path == "" {
+			continue
+		}
+		config, err := LoadConfigWithIncludes(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range config.Sections {
+			sections[name] = values
+		}
+	}
+
+	rules := signingRules{}
+	for name, values := range sections {
+		pattern, ok := configSubsection(name, "signpath")
+		if !ok {
+			continue
+		}
+		group := values["group"]
+		if group == "" {
+			return nil, fmt.Errorf("signpath.%s.group is not set", pattern)
+		}
+		members, ok := sections[`signgroup "`+group+`"`]
+		if !ok || strings.TrimSpace(members["members"]) == "" {
+			return nil, fmt.Errorf("signpath.%s names group %s, which has no signgroup.%s.members", pattern, group, group)
+		}
+		rule := signingRule{Pattern: pattern, Group: group, Members: map[string]bool{}, match: globToRegexp(pattern)}
+		for _, member := range strings.Fields(members["members"]) {
+			pubkey, err := decodeNostrKey(member, "npub")
+			if err != nil {
+				return nil, fmt.Errorf("signgroup.%s.members: %s: %w", group, member, err)
+			}
+			rule.Members[hex.EncodeToString(pubkey)] = true
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pattern < rules[j].Pattern })
+	return rules, nil
+}
+
+// configSubsection returns the subsection of a section header like
+// `signpath "records/**"` when its section is the given one
+func configSubsection(header, section string) (string, bool) {
+	prefix := section + ` "`
+	if !strings.HasPrefix(header, prefix) || !strings.HasSuffix(header, `"`) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(header, prefix), `"`), true
+}
+
+// Digest identifies the rules, for the verification cache
+func (rules signingRules) Digest() string {
+	if len(rules) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, rule := range rules {
+		members := []string{}
+		for member := range rule.Members {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		fmt.Fprintf(h, "%s\n%s\n", rule.Pattern, strings.Join(members, " "))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Violations returns how a change to paths by pubkey, signed or not,
+// breaks the rules, one line per rule broken
+func (rules signingRules) Violations(paths []string, pubkey string, signed bool) []string {
+	signer := ""
+	if key, err := decodeNostrKey(pubkey, "npub"); err == nil {
+		signer = hex.EncodeToString(key)
+	}
+	problems := []string{}
+	for _, rule := range rules {
+		matched := []string{}
+		for _, path := range paths {
+			if rule.match.MatchString(path) {
+				matched = append(matched, path)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		reason := ""
+		switch {
+		case !signed:
+			reason = "the commit is not signed"
+		case !rule.Members[signer]:
+			reason = fmt.Sprintf("%s is not in the group", shortPubkey(pubkey))
+		default:
+			continue
+		}
+		if len(matched) > 3 {
+			matched = append(matched[:3], fmt.Sprintf("and %d more", len(matched)-3))
+		}
+		problems = append(problems, fmt.Sprintf("%s needs a signature from a member of %s, but %s (%s)",
+			rule.Pattern, rule.Group, reason, strings.Join(matched, ", ")))
+	}
+	return problems
+}
+
+// pathsChangedFrom lists the paths of tree under pathspecs that differ
+// from the first parent and, for a merge, from every other parent too.
+// Without parents every path counts as changed.
+func pathsChangedFrom(tree *diffSide, parents []*diffSide, pathspecs []string) []string {
+	if len(parents) == 0 {
+		parents = []*diffSide{{Entries: map[string]*mergeEntry{}}}
+	}
+	paths := changedPaths(parents[0], tree, pathspecs)
+	for _, parent := range parents[1:] {
+		kept := []string{}
+		for _, path := range paths {
+			if !sameEntry(parent.Entries[path], tree.Entries[path]) {
+				kept = append(kept, path)
+			}
+		}
+		paths = kept
+	}
+	return paths
+}
+
+// commitChangedPaths lists the paths a Git commit changes, as the signing
+// rules see them
+func commitChangedPaths(repo *git.Repository, hash plumbing.Hash) ([]string, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commitDiffSide(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	parents := []*diffSide{}
+	for _, parent := range commit.ParentHashes {
+		side, err := commitDiffSide(repo, parent)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, side)
+	}
+	return pathsChangedFrom(tree, parents, nil), nil
+}
+
+// checkCommitSigning checks what is staged for a commit against the
+// signing rules, before it is made. parents are the commit's parents
+// beyond HEAD, for a merge.
+func checkCommitSigning(repo *git.Repository, pathspecs []string, parents []plumbing.Hash, pubkey string, signed bool) error {
+	rules, err := loadSigningRules(NewMGitStorage())
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	index, err := indexDiffSide(repo)
+	if err != nil {
+		return err
+	}
+	if len(parents) == 0 {
+		if head, err := repo.Head(); err == nil {
+			parents = []plumbing.Hash{head.Hash()}
+		}
+	}
+	sides := []*diffSide{}
+	for _, parent := range parents {
+		side, err := commitDiffSide(repo, parent)
+		if err != nil {
+			return err
+		}
+		sides = append(sides, side)
+	}
+
+	problems := rules.Violations(pathsChangedFrom(index, sides, pathspecs), pubkey, signed)
+	if len(problems) > 0 {
+		return fmt.Errorf("commit refused by the signing rules:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
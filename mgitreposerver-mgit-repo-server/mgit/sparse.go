@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// With mgit.sparseMetadata, a repository keeps the mappings and MGit
+// objects of the checked-out branch's history only, for devices where
+// .mgit should stay small. Fetches and clones ask the server's metadata
+// endpoint for just that history:
+//
+//	GET /api/mgit/repos/<repo>/metadata?branch=<branch>
+//	GET /api/mgit/repos/<repo>/metadata?commit=<git hash>
+//
+// and request only the objects of the mappings they get. The rest is
+// fetched on demand: when another branch is checked out, or a revision
+// turns out to have no MGit commit locally.
+
+// sparseMetadataEnabled reports whether mgit.sparseMetadata is on
+func sparseMetadataEnabled() bool {
+	return GetConfigBool("mgit.sparseMetadata", false)
+}
+
+// sparseMetadataQuery returns the metadata query for the history of the
+// repository's HEAD: its branch, or its commit when detached
+func sparseMetadataQuery(repo *git.Repository) string {
+	head, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+	query := neturl.Values{}
+	if head.Name().IsBranch() {
+		query.Set("branch", head.Name().Short())
+	} else {
+		query.Set("commit", head.Hash().String())
+	}
+	return query.Encode()
+}
+
+// materializeSparseMetadata fetches the mappings and MGit objects of the
+// history a metadata query names, such as a branch just checked out, into
+// a repository with sparse metadata
+func materializeSparseMetadata(repo *git.Repository, query string) error {
+	remoteName := defaultRemote(repo)
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		return err
+	}
+	token, ok := credentialFill(remoteURL)
+	if !ok {
+		token, ok = lookupStoredToken(remoteURL)
+	}
+	if !ok {
+		return errNoToken
+	}
+	if err := verifyServerIdentity(remoteName, remoteURL); err != nil {
+		return err
+	}
+
+	fmt.Printf("Fetching MGit metadata from %s (mgit.sparseMetadata)...\n", remoteName)
+	if err := fetchMGitData(remoteName, remoteURL, token, repoRoot(), query); err != nil {
+		return err
+	}
+	return reconstructMGitObjects(repoRoot())
+}
+
+// materializeSparseCommit fetches the history of a Git commit that has no
+// MGit commit locally, in a repository with sparse metadata. It reports
+// whether it fetched anything.
+func materializeSparseCommit(repo *git.Repository, storage *MGitStorage, hash plumbing.Hash) bool {
+	if !sparseMetadataEnabled() {
+		return false
+	}
+	if _, err := storage.GetMGitHashFromGit(hash.String()); err == nil {
+		return false
+	}
+	query := neturl.Values{}
+	query.Set("commit", hash.String())
+	if err := materializeSparseMetadata(repo, query.Encode()); err != nil {
+		fmt.Printf("Warning: Could not fetch MGit metadata of %s: %s\n", shortHash(hash.String()), err)
+		return false
+	}
+	return true
+}
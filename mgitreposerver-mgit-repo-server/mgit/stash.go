@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// A stash entry is a JSON file in .mgit/stash holding the commit it was
+// made on and, for every path with local changes, its staged and working
+// tree versions, with their contents. Unlike git's stash commits the
+// entries don't depend on Git objects nothing references, so they outlive
+// branch switches and git gc alike. stash@{0} is the newest.
+
+const stashDir = "stash"
+
+// stashEntry is one stash
+type stashEntry struct {
+	ID      string            `json:"-"`
+	Message string            `json:"message"` // "WIP on <branch>: ..." or "On <branch>: <message>"
+	Branch  string            `json:"branch"`
+	Head    string            `json:"head"` // the Git commit the changes were made on
+	Created time.Time         `json:"created"`
+	Files   []stashFile       `json:"files"`
+	Blobs   map[string][]byte `json:"blobs"` // contents by Git blob hash
+}
+
+// stashFile is a path's staged and working tree versions; a nil version
+// is a file missing from the index or the working tree
+type stashFile struct {
+	Path      string        `json:"path"`
+	Index     *stashVersion `json:"index,omitempty"`
+	Worktree  *stashVersion `json:"worktree,omitempty"`
+	Untracked bool          `json:"untracked,omitempty"`
+}
+
+type stashVersion struct {
+	Hash string            `json:"hash"`
+	Mode filemode.FileMode `json:"mode"`
+}
+
+func (v *stashVersion) entry() *mergeEntry {
+	return &mergeEntry{Hash: plumbing.NewHash(v.Hash), Mode: v.Mode}
+}
+
+func stashPath() string {
+	return filepath.Join(mgitCommonDir(), stashDir)
+}
+
+// loadStash lists the stash entries, newest first
+func loadStash() ([]*stashEntry, error) {
+	files, err := os.ReadDir(stashPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*stashEntry{}
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || id == file.Name() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(stashPath(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entry := &stashEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("stash entry %s is corrupt: %w", id, err)
+		}
+		entry.ID = id
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created.After(entries[j].Created) })
+	return entries, nil
+}
+
+// save writes the entry under the hash of its content
+func (e *stashEntry) save() error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	e.ID = stashID(data)
+	return writeStashFile(e.ID, data)
+}
+
+// stashID is the name of an entry, the hash of its JSON
+func stashID(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeStashFile(id string, data []byte) error {
+	if err := os.MkdirAll(stashPath(), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(stashPath(), id+".json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(stashPath(), id+".json"))
+}
+
+func (e *stashEntry) drop() error {
+	return os.Remove(filepath.Join(stashPath(), e.ID+".json"))
+}
+
+// keep records a version of a path, its content stored once however many
+// versions share it
+func (e *stashEntry) keep(entry *mergeEntry, content []byte) *stashVersion {
+	if entry == nil {
+		return nil
+	}
+	hash := entry.Hash.String()
+	e.Blobs[hash] = content
+	return &stashVersion{Hash: hash, Mode: entry.Mode}
+}
+
+// HandleStash handles the stash command
+//
+//	push [-m <message>] [-u] [--remote[=<remote>]] [-- <paths>...]
+//	                                           save local changes and revert them (the default),
+//	                                           with --remote also to the server
+//	fetch [<remote>]                           move the entries on the server into the stash
+//	list                                       list the entries, newest first
+//	show [-p] [<stash>]                        the changes an entry holds
+//	apply [--index] [<stash>]                  reapply an entry's changes
+//	pop [--index] [<stash>]                    apply an entry and drop it
+//	drop [<stash>]                             delete an entry
+//	clear                                      delete every entry
+//
+// An entry is named stash@{<n>} or just <n>, and defaults to stash@{0}.
+func HandleStash(args []string) {
+	sub := "push"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+
+	var err error
+	switch sub {
+	case "push", "save":
+		err = stashPush(args)
+	case "fetch":
+		err = stashFetch(args)
+	case "list":
+		err = stashList()
+	case "show":
+		err = stashShow(args)
+	case "apply":
+		err = stashApply(args, false)
+	case "pop":
+		err = stashApply(args, true)
+	case "drop":
+		err = stashDrop(args)
+	case "clear":
+		err = os.RemoveAll(stashPath())
+	default:
+		printStashUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printStashUsage() {
+	fmt.Println("Usage: mgit stash [push [-m <message>] [-u] [--remote[=<remote>]] [-- <paths>...] | fetch [<remote>] | list | show [-p] [<stash>] | apply [--index] [<stash>] | pop [--index] [<stash>] | drop [<stash>] | clear]")
+}
+
+// findStash picks the entry an argument names
+func findStash(args []string) (*stashEntry, int, error) {
+	if len(args) > 1 {
+		printStashUsage()
+		os.Exit(1)
+	}
+	entries, err := loadStash()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, 0, fmt.Errorf("no stash entries found")
+	}
+	if len(args) == 0 {
+		return entries[0], 0, nil
+	}
+	name := args[0]
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "stash@{"), "}"))
+	if err != nil || n < 0 {
+		return nil, 0, fmt.Errorf("%s is not a stash reference", name)
+	}
+	if n >= len(entries) {
+		return nil, 0, fmt.Errorf("stash@{%d} does not exist, there are only %d entries", n, len(entries))
+	}
+	return entries[n], n, nil
+}
+
+// stashPush saves the staged and unstaged changes, and with -u the
+// untracked files, then reverts them to HEAD
+func stashPush(args []string) error {
+	message := ""
+	untracked := false
+	upload, remoteName := false, ""
+	pathArgs := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			pathArgs = append(pathArgs, args[i+1:]...)
+			i = len(args)
+		case arg == "-m" || arg == "--message":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s needs a message", arg)
+			}
+			i++
+			message = args[i]
+		case strings.HasPrefix(arg, "--message="):
+			message = strings.TrimPrefix(arg, "--message=")
+		case arg == "-u" || arg == "--include-untracked":
+			untracked = true
+		case arg == "--remote":
+			upload = true
+		case strings.HasPrefix(arg, "--remote="):
+			upload, remoteName = true, strings.TrimPrefix(arg, "--remote=")
+		case strings.HasPrefix(arg, "-"):
+			printStashUsage()
+			os.Exit(1)
+		default:
+			pathArgs = append(pathArgs, arg)
+		}
+	}
+	pathspecs := []string{}
+	for _, arg := range pathArgs {
+		path, err := repoRelativePath(arg)
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			pathspecs = nil
+			break
+		}
+		pathspecs = append(pathspecs, path)
+	}
+
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("you do not have the initial commit yet")
+	}
+	headSide, err := commitDiffSide(repo, head.Hash())
+	if err != nil {
+		return err
+	}
+	index, err := indexDiffSide(repo)
+	if err != nil {
+		return err
+	}
+	worktree, err := worktreeDiffSide(repo, index)
+	if err != nil {
+		return err
+	}
+
+	paths := map[string]bool{}
+	for _, path := range changedPaths(headSide, index, pathspecs) {
+		paths[path] = true
+	}
+	for _, path := range changedPaths(index, worktree, pathspecs) {
+		paths[path] = true
+	}
+	untrackedPaths := map[string]bool{}
+	if untracked {
+		w, err := repo.Worktree()
+		if err != nil {
+			return fmt.Errorf("error getting worktree: %w", err)
+		}
+		status, err := scanStatus(repo, w)
+		if err != nil {
+			return fmt.Errorf("error getting status: %w", err)
+		}
+		for path, fileStatus := range status {
+			if fileStatus.Worktree == git.Untracked && pathMatches(path, pathspecs, false) {
+				paths[path] = true
+				untrackedPaths[path] = true
+			}
+		}
+	}
+
+	entry := &stashEntry{Head: head.Hash().String(), Created: time.Now(), Blobs: map[string][]byte{}}
+	sorted := []string{}
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		file := stashFile{Path: path, Untracked: untrackedPaths[path]}
+		if file.Untracked {
+			current, err := readApplyTarget(repo, path, false)
+			if err != nil {
+				return err
+			}
+			if current == nil {
+				continue
+			}
+			hash := plumbing.ComputeHash(plumbing.BlobObject, current.Content)
+			file.Worktree = entry.keep(&mergeEntry{Hash: hash, Mode: current.Mode}, current.Content)
+			entry.Files = append(entry.Files, file)
+			continue
+		}
+
+		// Submodules keep their own changes
+		if e := index.Entries[path]; e != nil && e.Mode == filemode.Submodule {
+			continue
+		}
+		if e := headSide.Entries[path]; e != nil && e.Mode == filemode.Submodule {
+			continue
+		}
+		if e := index.Entries[path]; e != nil {
+			content, err := index.read(repo, path)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", path, err)
+			}
+			file.Index = entry.keep(e, content)
+		}
+		if e := worktree.Entries[path]; e != nil {
+			content, err := worktree.read(repo, path)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", path, err)
+			}
+			file.Worktree = entry.keep(e, content)
+		}
+		entry.Files = append(entry.Files, file)
+	}
+	if len(entry.Files) == 0 {
+		fmt.Println("No local changes to save")
+		return nil
+	}
+
+	entry.Branch = "(no branch)"
+	if head.Name().IsBranch() {
+		entry.Branch = head.Name().Short()
+	}
+	if message != "" {
+		entry.Message = fmt.Sprintf("On %s: %s", entry.Branch, message)
+	} else {
+		entry.Message = fmt.Sprintf("WIP on %s: %s", entry.Branch, commitOneline(repo, head.Hash()))
+	}
+	if err := entry.save(); err != nil {
+		return fmt.Errorf("error saving stash: %w", err)
+	}
+
+	// Put every saved path back as HEAD has it
+	results := []*applyResult{}
+	for _, file := range entry.Files {
+		if e := headSide.Entries[file.Path]; e != nil {
+			content, err := blobContent(repo, e.Hash)
+			if err != nil {
+				return err
+			}
+			results = append(results, &applyResult{Path: file.Path, Content: content, Mode: e.Mode})
+		} else {
+			results = append(results, &applyResult{Path: file.Path, Deleted: true})
+		}
+	}
+	if err := writeApplyResults(repo, results, applyOptions{Index: true}); err != nil {
+		return fmt.Errorf("error reverting local changes: %w", err)
+	}
+	fmt.Printf("Saved working directory and index state %s\n", entry.Message)
+
+	if upload {
+		if remoteName == "" {
+			remoteName = defaultRemote(repo)
+		}
+		if err := uploadStash(repo, remoteName, entry); err != nil {
+			return fmt.Errorf("the stash is saved locally, but could not be sent to %s: %w", remoteName, err)
+		}
+	}
+	return nil
+}
+
+// commitOneline is the short MGit hash, or Git hash if it has none, and
+// subject of a commit
+func commitOneline(repo *git.Repository, hash plumbing.Hash) string {
+	name := hash.String()
+	if mgitHash, err := NewMGitStorage().GetMGitHashFromGit(name); err == nil && mgitHash != "" {
+		name = mgitHash
+	}
+	subject := ""
+	if commit, err := repo.CommitObject(hash); err == nil {
+		subject = strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0]
+	}
+	return strings.TrimSpace(shortHash(name) + " " + subject)
+}
+
+func stashList() error {
+	entries, err := loadStash()
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		fmt.Printf("stash@{%d}: %s\n", i, entry.Message)
+	}
+	return nil
+}
+
+// stashSides are the commit an entry was made on and its working tree
+// version of the files
+func stashSides(repo *git.Repository, entry *stashEntry) (*diffSide, *diffSide, error) {
+	base, err := commitDiffSide(repo, plumbing.NewHash(entry.Head))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading the stash's base commit %s: %w", shortHash(entry.Head), err)
+	}
+	stashed := &diffSide{Entries: map[string]*mergeEntry{}, Content: map[string][]byte{}}
+	for path, e := range base.Entries {
+		stashed.Entries[path] = e
+	}
+	for _, file := range entry.Files {
+		if file.Worktree == nil {
+			delete(stashed.Entries, file.Path)
+			continue
+		}
+		stashed.Entries[file.Path] = file.Worktree.entry()
+		stashed.Content[file.Path] = entry.Blobs[file.Worktree.Hash]
+	}
+	return base, stashed, nil
+}
+
+func stashShow(args []string) error {
+	opts := &diffOptions{Context: hunkContext, NameStatus: true}
+	names := []string{}
+	for _, arg := range args {
+		if arg == "-p" || arg == "--patch" {
+			opts.NameStatus = false
+		} else {
+			names = append(names, arg)
+		}
+	}
+	entry, _, err := findStash(names)
+	if err != nil {
+		return err
+	}
+	repo := getRepo()
+	base, stashed, err := stashSides(repo, entry)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	_, err = writeDiff(out, repo, base, stashed, nil, opts)
+	return err
+}
+
+// stashApply merges an entry's changes into the working tree. Files staged
+// when it was made are only staged again with restoreIndex, which needs
+// HEAD where it was, except that new files are always added. An entry
+// that applies with conflicts is kept even by pop.
+func stashApply(args []string, pop bool) error {
+	restoreIndex := false
+	names := []string{}
+	for _, arg := range args {
+		if arg == "--index" {
+			restoreIndex = true
+		} else {
+			names = append(names, arg)
+		}
+	}
+	entry, n, err := findStash(names)
+	if err != nil {
+		return err
+	}
+
+	repo := getRepo()
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("you do not have the initial commit yet")
+	}
+	if restoreIndex && head.Hash().String() != entry.Head {
+		return fmt.Errorf("cannot restore the index: stash@{%d} was made on %s, not HEAD; apply it without --index", n, shortHash(entry.Head))
+	}
+
+	base, stashed, err := stashSides(repo, entry)
+	if err != nil {
+		return err
+	}
+	// The merge reads the stashed contents from the object store
+	for _, file := range entry.Files {
+		for _, version := range []*stashVersion{file.Index, file.Worktree} {
+			if version == nil {
+				continue
+			}
+			if _, err := storeBlob(repo, entry.Blobs[version.Hash]); err != nil {
+				return err
+			}
+		}
+	}
+	ours, err := treeEntries(repo, head.Hash())
+	if err != nil {
+		return err
+	}
+	result, err := mergeTreeEntries(repo, base.Entries, ours, stashed.Entries, mergeLabels{Ours: "Updated upstream", Theirs: "Stashed changes"})
+	if err != nil {
+		return err
+	}
+	if err := checkMergeWorktree(repo, head.Hash(), result); err != nil {
+		return err
+	}
+	if err := writeApplyResults(repo, result.Results, applyOptions{}); err != nil {
+		return err
+	}
+
+	conflicted := map[string]bool{}
+	for _, conflict := range result.Conflicts {
+		conflicted[conflict.Path] = true
+	}
+	staged := []*applyResult{}
+	for _, file := range entry.Files {
+		if file.Untracked || conflicted[file.Path] {
+			continue
+		}
+		switch {
+		case restoreIndex && file.Index == nil:
+			staged = append(staged, &applyResult{Path: file.Path, Deleted: true})
+		case file.Index != nil && (restoreIndex || base.Entries[file.Path] == nil):
+			staged = append(staged, &applyResult{Path: file.Path, Content: entry.Blobs[file.Index.Hash], Mode: file.Index.Mode})
+		}
+	}
+	if err := writeApplyResults(repo, staged, applyOptions{Cached: true}); err != nil {
+		return err
+	}
+
+	if len(result.Conflicts) > 0 {
+		for _, conflict := range result.Conflicts {
+			fmt.Println(conflict.Message)
+		}
+		if pop {
+			fmt.Println("The stash entry is kept in case you need it again.")
+		}
+		return fmt.Errorf("stash@{%d} applied with conflicts", n)
+	}
+	fmt.Printf("Applied stash@{%d}: %s\n", n, entry.Message)
+	if pop {
+		if err := entry.drop(); err != nil {
+			return err
+		}
+		fmt.Printf("Dropped stash@{%d} (%s)\n", n, shortHash(entry.ID))
+	}
+	return nil
+}
+
+func stashDrop(args []string) error {
+	entry, n, err := findStash(args)
+	if err != nil {
+		return err
+	}
+	if err := entry.drop(); err != nil {
+		return err
+	}
+	fmt.Printf("Dropped stash@{%d} (%s)\n", n, shortHash(entry.ID))
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Stash entries can move between machines through the server. mgit stash
+// push --remote sends the new entry, and mgit stash fetch on another clone
+// moves every entry the server holds into its stash, deleting them there:
+//
+//	PUT    /api/mgit/repos/<repo>/stashes/<id>
+//	GET    /api/mgit/repos/<repo>/stashes
+//	GET    /api/mgit/repos/<repo>/stashes/<id>
+//	DELETE /api/mgit/repos/<repo>/stashes/<id>
+//
+// The server keeps them apart per pubkey, and only ever sees them
+// encrypted: XChaCha20-Poly1305, with a key derived from the signing key's
+// NIP-44 conversation key with itself. Only the holder of the signing key
+// can read them, so both machines need the same key.
+
+// stashKeyInfo separates the stash key from other uses of the
+// conversation key
+const stashKeyInfo = "mgit stash v1"
+
+// stashKey derives the key stash entries are encrypted with
+func stashKey() ([]byte, error) {
+	signer, err := newLocalSigner()
+	if err != nil {
+		return nil, fmt.Errorf("sending stashes needs the local signer's key: %w", err)
+	}
+	defer signer.Close()
+	pubkey, err := signer.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	conversationKey, err := nip44ConversationKey(signer.secret, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, []byte(stashKeyInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sealStash encrypts an entry's JSON, bound to its ID, as nonce and
+// ciphertext
+func sealStash(key []byte, id string, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(id)), nil
+}
+
+// openStash decrypts what sealStash made, checking it is the entry id
+func openStash(key []byte, id string, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("stash %s is truncated", shortHash(id))
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt stash %s; was it sent with another key?", shortHash(id))
+	}
+	if stashID(data) != id {
+		return nil, fmt.Errorf("stash %s does not match its name", shortHash(id))
+	}
+	return data, nil
+}
+
+// stashServer talks to the stash endpoints of a remote's server
+type stashServer struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newStashServer(repo *git.Repository, remoteName string) (*stashServer, error) {
+	url, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyServerIdentity(remoteName, url); err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	return &stashServer{url: url, token: getTokenForRepo(url), client: client}, nil
+}
+
+// do makes a request to a stash endpoint, returning the response body
+func (s *stashServer) do(method, endpoint string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, repoAPIURL(s.url, endpoint), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.token))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	setAcceptEncoding(req)
+
+	span := startSpan("stash.remote", "method", method, "endpoint", endpoint)
+	resp, err := s.client.Do(req)
+	span.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	reader, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return data, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("the server does not keep stashes, or has no such stash")
+	}
+	return nil, fmt.Errorf("error response from server: %s", string(data))
+}
+
+// uploadStash sends an entry to a remote's server
+func uploadStash(repo *git.Repository, remoteName string, entry *stashEntry) error {
+	data, err := os.ReadFile(filepath.Join(stashPath(), entry.ID+".json"))
+	if err != nil {
+		return err
+	}
+	key, err := stashKey()
+	if err != nil {
+		return err
+	}
+	sealed, err := sealStash(key, entry.ID, data)
+	if err != nil {
+		return err
+	}
+	server, err := newStashServer(repo, remoteName)
+	if err != nil {
+		return err
+	}
+	if _, err := server.do("PUT", "stashes/"+entry.ID, sealed); err != nil {
+		return err
+	}
+	fmt.Printf("Sent stash %s to %s\n", shortHash(entry.ID), remoteName)
+	return nil
+}
+
+// stashFetch moves the entries on a remote's server into the stash
+func stashFetch(args []string) error {
+	if len(args) > 1 {
+		printStashUsage()
+		os.Exit(1)
+	}
+	repo := getRepo()
+	remoteName := defaultRemote(repo)
+	if len(args) > 0 {
+		remoteName = args[0]
+	}
+
+	key, err := stashKey()
+	if err != nil {
+		return err
+	}
+	server, err := newStashServer(repo, remoteName)
+	if err != nil {
+		return err
+	}
+	listing, err := server.do("GET", "stashes", nil)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	if err := json.Unmarshal(listing, &ids); err != nil {
+		return fmt.Errorf("error parsing stash list: %w", err)
+	}
+	if len(ids) == 0 {
+		fmt.Printf("No stashes on %s\n", remoteName)
+		return nil
+	}
+
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(stashPath(), id+".json")); err != nil {
+			sealed, err := server.do("GET", "stashes/"+id, nil)
+			if err != nil {
+				return err
+			}
+			data, err := openStash(key, id, sealed)
+			if err != nil {
+				return err
+			}
+			entry := &stashEntry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				return fmt.Errorf("stash %s is corrupt: %w", shortHash(id), err)
+			}
+			if err := writeStashFile(id, data); err != nil {
+				return err
+			}
+			fmt.Printf("Fetched stash %s: %s\n", shortHash(id), entry.Message)
+		}
+		// Fetching moves an entry, so it can't come back once dropped
+		if _, err := server.do("DELETE", "stashes/"+id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// repoStatus returns the status of the worktree. While the fsmonitor daemon
+// is running only the paths it saw change are examined; otherwise the whole
+// worktree is scanned, with the status cache unless it is turned off.
+func repoStatus(repo *git.Repository, w *git.Worktree) (git.Status, error) {
+	if _, running := fsmonitorPid(); running {
+		status, err := fsmonitorStatus(repo, w)
+		if err == nil {
+			return status, nil
+		}
+		fmt.Printf("Warning: fsmonitor cache unusable, scanning worktree: %s\n", err)
+	}
+	return scanStatus(repo, w)
+}
+
+// stagedStatus compares the index with the HEAD tree without touching the
+// worktree, returning the staging code of every path that differs
+func stagedStatus(repo *git.Repository, idx *index.Index) (map[string]git.StatusCode, error) {
+	// Files and submodule gitlinks; tree.Files() would leave out the latter
+	headFiles := map[string]object.TreeEntry{}
+	if head, err := repo.Head(); err == nil {
+		commit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			return nil, err
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+		walker := object.NewTreeWalker(tree, true, nil)
+		defer walker.Close()
+		for {
+			name, entry, err := walker.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if entry.Mode != filemode.Dir {
+				headFiles[name] = entry
+			}
+		}
+	}
+
+	staged := map[string]git.StatusCode{}
+	for _, entry := range idx.Entries {
+		file, ok := headFiles[entry.Name]
+		if !ok {
+			staged[entry.Name] = git.Added
+		} else if file.Hash != entry.Hash || file.Mode != entry.Mode {
+			staged[entry.Name] = git.Modified
+		}
+		delete(headFiles, entry.Name)
+	}
+	for name := range headFiles {
+		staged[name] = git.Deleted
+	}
+	return staged, nil
+}
+
+// worktreePathStatus compares one worktree path with its index entry, which
+// is nil for paths that aren't tracked
+func worktreePathStatus(root, path string, entry *index.Entry, ignores *ignoreMatcher) (git.StatusCode, error) {
+	fullPath := filepath.Join(root, filepath.FromSlash(path))
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return git.Unmodified, err
+		}
+		if entry != nil {
+			return git.Deleted, nil
+		}
+		return git.Unmodified, nil
+	}
+	if info.IsDir() {
+		if entry != nil {
+			return git.Deleted, nil
+		}
+		return git.Unmodified, nil
+	}
+
+	if entry == nil {
+		if ignores.Ignored(path) {
+			return git.Unmodified, nil
+		}
+		return git.Untracked, nil
+	}
+
+	mode, err := filemode.NewFromOSFileMode(info.Mode())
+	if err != nil {
+		return git.Unmodified, err
+	}
+	if mode != entry.Mode {
+		return git.Modified, nil
+	}
+	if mode.IsRegular() && uint32(info.Size()) != entry.Size {
+		return git.Modified, nil
+	}
+
+	hash, err := hashWorktreeFile(fullPath, info)
+	if err != nil {
+		return git.Unmodified, err
+	}
+	if hash != entry.Hash {
+		return git.Modified, nil
+	}
+	return git.Unmodified, nil
+}
+
+// hashWorktreeFile computes the blob hash of a file or symlink
+func hashWorktreeFile(fullPath string, info os.FileInfo) (plumbing.Hash, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return plumbing.ComputeHash(plumbing.BlobObject, []byte(filepath.ToSlash(target))), nil
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer file.Close()
+
+	hasher := plumbing.NewHasher(plumbing.BlobObject, info.Size())
+	if _, err := io.Copy(hasher, file); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return hasher.Sum(), nil
+}
+
+// stagePaths updates the index entries of the given worktree paths,
+// removing the ones that no longer exist. Unlike go-git's Add it doesn't
+// compute the status of the whole worktree first.
+func stagePaths(repo *git.Repository, root string, paths []string) error {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+
+	for _, path := range paths {
+		fullPath := filepath.Join(root, filepath.FromSlash(path))
+		info, err := os.Lstat(fullPath)
+		if os.IsNotExist(err) {
+			idx.Remove(path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Only a checked-out submodule is staged as a directory, by
+			// the commit it has checked out
+			head, err := submoduleHead(fullPath)
+			if err != nil {
+				return err
+			}
+			if head.IsZero() {
+				return fmt.Errorf("error adding %s: not a submodule", path)
+			}
+			entry, err := idx.Entry(path)
+			if err != nil {
+				entry = idx.Add(path)
+			}
+			entry.Hash = head
+			entry.Mode = filemode.Submodule
+			entry.ModifiedAt = info.ModTime()
+			entry.Size = 0
+			continue
+		}
+
+		hash, err := storeWorktreeBlob(repo, fullPath, info)
+		if err != nil {
+			return fmt.Errorf("error adding %s: %w", path, err)
+		}
+
+		entry, err := idx.Entry(path)
+		if err != nil {
+			entry = idx.Add(path)
+		}
+		entry.Hash = hash
+		entry.ModifiedAt = info.ModTime()
+		entry.Mode, err = filemode.NewFromOSFileMode(info.Mode())
+		if err != nil {
+			return err
+		}
+		if entry.Mode.IsRegular() {
+			entry.Size = uint32(info.Size())
+		}
+	}
+
+	return repo.Storer.SetIndex(idx)
+}
+
+// storeWorktreeBlob writes a worktree file to the object store as a blob
+func storeWorktreeBlob(repo *git.Repository, fullPath string, info os.FileInfo) (plumbing.Hash, error) {
+	var data []byte
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		data = []byte(filepath.ToSlash(target))
+	} else {
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		data = content
+	}
+	return storeBlob(repo, data)
+}
+
+// storeBlob writes data to the object store as a blob
+func storeBlob(repo *git.Repository, data []byte) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(data)))
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := writer.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// ignoreMatcher answers gitignore queries for individual paths, reading
+// only the .gitignore files on the way to each path
+type ignoreMatcher struct {
+	root     string
+	patterns map[string][]gitignore.Pattern // by directory, "" for the root
+}
+
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	m := &ignoreMatcher{root: root, patterns: map[string][]gitignore.Pattern{}}
+
+	// info/exclude applies like a top-level .gitignore
+	m.patterns[""] = append(
+		readIgnoreFile(filepath.Join(repoCommonGitDir(), "info", "exclude"), nil),
+		readIgnoreFile(filepath.Join(root, ".gitignore"), nil)...)
+	return m
+}
+
+// Ignored reports whether a path, or one of the directories above it, is
+// ignored
+func (m *ignoreMatcher) Ignored(path string) bool {
+	return m.ignored(path, false)
+}
+
+// IgnoredDir is Ignored for a directory, so patterns like "build/" match
+func (m *ignoreMatcher) IgnoredDir(path string) bool {
+	return m.ignored(path, true)
+}
+
+func (m *ignoreMatcher) ignored(path string, dir bool) bool {
+	parts := strings.Split(path, "/")
+	patterns := append([]gitignore.Pattern{}, m.patterns[""]...)
+
+	for i := 1; i <= len(parts); i++ {
+		isDir := i < len(parts) || dir
+		if gitignore.NewMatcher(patterns).Match(parts[:i], isDir) {
+			return true
+		}
+		if isDir {
+			patterns = append(patterns, m.dirPatterns(parts[:i])...)
+		}
+	}
+	return false
+}
+
+func (m *ignoreMatcher) dirPatterns(dirParts []string) []gitignore.Pattern {
+	dir := strings.Join(dirParts, "/")
+	if patterns, ok := m.patterns[dir]; ok {
+		return patterns
+	}
+	patterns := readIgnoreFile(filepath.Join(m.root, filepath.FromSlash(dir), ".gitignore"), dirParts)
+	m.patterns[dir] = patterns
+	return patterns
+}
+
+// readIgnoreFile parses a gitignore file whose patterns apply below domain
+func readIgnoreFile(path string, domain []string) []gitignore.Pattern {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	patterns := []gitignore.Pattern{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, domain))
+	}
+	return patterns
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+)
+
+// statusCacheVersion is bumped whenever the cache layout changes
+const statusCacheVersion = 1
+
+// statusCacheRacyWindow is how recent a change can be and still be cached.
+// Anything modified this close to the scan might change again within the
+// filesystem's timestamp granularity without its mtime moving.
+const statusCacheRacyWindow = 2 * time.Second
+
+// statusCache is what status remembers between runs, like git's untracked
+// cache: the listing of every directory by its mtime, so unchanged
+// directories aren't read again, and the hashes of files that differ from
+// the index, so they aren't hashed again while they stay untouched
+type statusCache struct {
+	Version int
+	Dirs    map[string]cachedDir
+	Hashes  map[string]cachedHash
+
+	// The index-versus-HEAD comparison, valid for this index and HEAD tree
+	StagedIndex string
+	StagedTree  string
+	Staged      map[string]git.StatusCode
+}
+
+type cachedDir struct {
+	ModTime int64
+	Names   []string
+	IsDir   []bool
+}
+
+type cachedHash struct {
+	ModTime int64
+	Size    int64
+	Hash    plumbing.Hash
+}
+
+// statusCachePath returns the file the status cache is kept in
+func statusCachePath() string {
+	return filepath.Join(mgitDir(), "cache", "untracked")
+}
+
+func loadStatusCache() *statusCache {
+	cache := &statusCache{}
+	if file, err := os.Open(statusCachePath()); err == nil {
+		err = gob.NewDecoder(file).Decode(cache)
+		file.Close()
+		if err != nil {
+			cache = &statusCache{}
+		}
+	}
+	if cache.Version != statusCacheVersion || cache.Dirs == nil || cache.Hashes == nil {
+		cache = &statusCache{Version: statusCacheVersion, Dirs: map[string]cachedDir{}, Hashes: map[string]cachedHash{}}
+	}
+	return cache
+}
+
+// save writes the cache atomically, so a concurrent status never reads a
+// half-written one
+func (c *statusCache) save() error {
+	path := statusCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "untracked-*")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(c); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// statusCacheEnabled reports whether status uses the cache; like git's
+// core.untrackedCache, but on by default
+func statusCacheEnabled() bool {
+	return GetConfigBool("core.untrackedCache", true)
+}
+
+// scanStatus computes the status of the whole worktree, with the status
+// cache unless core.untrackedCache is false
+func scanStatus(repo *git.Repository, w *git.Worktree) (git.Status, error) {
+	if !statusCacheEnabled() {
+		return w.Status()
+	}
+	return cachedStatus(repo, w)
+}
+
+// cachedStatus computes the worktree status with the help of the status
+// cache. Tracked files are checked by stat against the index and hashed
+// only when their stat data differs; directories whose mtime hasn't changed
+// are listed from the cache instead of being read.
+func cachedStatus(repo *git.Repository, w *git.Worktree) (git.Status, error) {
+	root := w.Filesystem.Root()
+	scanStart := time.Now()
+	racyBefore := scanStart.Add(-statusCacheRacyWindow).UnixNano()
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	cache := loadStatusCache()
+	fresh := &statusCache{Version: statusCacheVersion, Dirs: map[string]cachedDir{}, Hashes: map[string]cachedHash{}}
+
+	// Stat data of files written after the index could be stale
+	indexTime := int64(0)
+	if info, err := os.Stat(filepath.Join(repoGitDir(), "index")); err == nil {
+		indexTime = info.ModTime().UnixNano()
+	}
+
+	entries := map[string]*index.Entry{}
+	for _, entry := range idx.Entries {
+		entries[entry.Name] = entry
+	}
+
+	worktree := map[string]git.StatusCode{}
+	for _, entry := range idx.Entries {
+		code, err := cachedEntryStatus(root, entry, indexTime, racyBefore, cache, fresh)
+		if err != nil {
+			return nil, err
+		}
+		if code != git.Unmodified {
+			worktree[entry.Name] = code
+		}
+	}
+
+	ignores := newIgnoreMatcher(root)
+	if err := scanUntracked(root, "", entries, ignores, racyBefore, cache, fresh, worktree); err != nil {
+		return nil, err
+	}
+
+	staged, err := cachedStagedStatus(repo, idx, cache, fresh)
+	if err != nil {
+		return nil, err
+	}
+
+	status := git.Status{}
+	for path, code := range staged {
+		status[path] = &git.FileStatus{Staging: code, Worktree: git.Unmodified}
+	}
+	for path, code := range worktree {
+		fileStatus, ok := status[path]
+		if !ok {
+			fileStatus = &git.FileStatus{Staging: git.Unmodified}
+			status[path] = fileStatus
+		}
+		fileStatus.Worktree = code
+		if code == git.Untracked {
+			fileStatus.Staging = git.Untracked
+		}
+	}
+
+	// The cache only speeds things up, so failing to save it isn't an error
+	fresh.save()
+	return status, nil
+}
+
+// cachedEntryStatus compares a tracked file with its index entry, hashing
+// it only if its stat data doesn't match and no cached hash does either
+func cachedEntryStatus(root string, entry *index.Entry, indexTime, racyBefore int64, cache, fresh *statusCache) (git.StatusCode, error) {
+	if entry.Mode == filemode.Submodule {
+		// A submodule that isn't checked out is left alone, like git does
+		head, err := submoduleHead(filepath.Join(root, filepath.FromSlash(entry.Name)))
+		if err != nil || head.IsZero() || head == entry.Hash {
+			return git.Unmodified, err
+		}
+		return git.Modified, nil
+	}
+
+	fullPath := filepath.Join(root, filepath.FromSlash(entry.Name))
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return git.Deleted, nil
+	}
+	if err != nil {
+		return git.Unmodified, err
+	}
+	if info.IsDir() {
+		return git.Deleted, nil
+	}
+
+	mode, err := filemode.NewFromOSFileMode(info.Mode())
+	if err != nil {
+		return git.Unmodified, err
+	}
+	if mode != entry.Mode {
+		return git.Modified, nil
+	}
+	if mode.IsRegular() && uint32(info.Size()) != entry.Size {
+		return git.Modified, nil
+	}
+
+	modTime := info.ModTime().UnixNano()
+	if modTime == entry.ModifiedAt.UnixNano() && modTime < indexTime {
+		return git.Unmodified, nil
+	}
+
+	hash := plumbing.ZeroHash
+	if cached, ok := cache.Hashes[entry.Name]; ok && cached.ModTime == modTime && cached.Size == info.Size() {
+		hash = cached.Hash
+	} else if hash, err = hashWorktreeFile(fullPath, info); err != nil {
+		return git.Unmodified, err
+	}
+	if modTime < racyBefore {
+		fresh.Hashes[entry.Name] = cachedHash{ModTime: modTime, Size: info.Size(), Hash: hash}
+	}
+
+	if hash != entry.Hash {
+		return git.Modified, nil
+	}
+	return git.Unmodified, nil
+}
+
+// scanUntracked finds the untracked files below dir, listing directories
+// from the cache when their mtime shows they haven't changed
+func scanUntracked(root, dir string, entries map[string]*index.Entry, ignores *ignoreMatcher, racyBefore int64, cache, fresh *statusCache, worktree map[string]git.StatusCode) error {
+	fullDir := filepath.Join(root, filepath.FromSlash(dir))
+	info, err := os.Stat(fullDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	modTime := info.ModTime().UnixNano()
+
+	listing, ok := cache.Dirs[dir]
+	if !ok || listing.ModTime != modTime {
+		dirEntries, err := os.ReadDir(fullDir)
+		if err != nil {
+			return err
+		}
+		listing = cachedDir{ModTime: modTime}
+		for _, dirEntry := range dirEntries {
+			listing.Names = append(listing.Names, dirEntry.Name())
+			listing.IsDir = append(listing.IsDir, dirEntry.IsDir())
+		}
+	}
+	if modTime < racyBefore {
+		fresh.Dirs[dir] = listing
+	}
+
+	for i, name := range listing.Names {
+		path := name
+		if dir != "" {
+			path = dir + "/" + name
+		}
+		if isMetadataPath(path) {
+			continue
+		}
+
+		if listing.IsDir[i] {
+			// A tracked directory is a submodule, which has its own status
+			if _, tracked := entries[path]; tracked || ignores.IgnoredDir(path) {
+				continue
+			}
+			if err := scanUntracked(root, path, entries, ignores, racyBefore, cache, fresh, worktree); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, tracked := entries[path]; tracked || ignores.Ignored(path) {
+			continue
+		}
+		worktree[path] = git.Untracked
+	}
+	return nil
+}
+
+// cachedStagedStatus compares the index with HEAD, reusing the last result
+// while neither has changed
+func cachedStagedStatus(repo *git.Repository, idx *index.Index, cache, fresh *statusCache) (map[string]git.StatusCode, error) {
+	checksum, err := indexChecksum()
+	if err != nil {
+		return nil, err
+	}
+	tree := ""
+	if head, err := repo.Head(); err == nil {
+		if commit, err := repo.CommitObject(head.Hash()); err == nil {
+			tree = commit.TreeHash.String()
+		}
+	}
+
+	if checksum != "" && cache.Staged != nil && cache.StagedIndex == checksum && cache.StagedTree == tree {
+		fresh.StagedIndex, fresh.StagedTree, fresh.Staged = checksum, tree, cache.Staged
+		return cache.Staged, nil
+	}
+
+	staged, err := stagedStatus(repo, idx)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		fresh.StagedIndex, fresh.StagedTree, fresh.Staged = checksum, tree, staged
+	}
+	return staged, nil
+}
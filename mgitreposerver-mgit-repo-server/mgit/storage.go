@@ -43,13 +43,18 @@ type MGitSignature struct {
 // MGitStorage handles the storage and retrieval of MGit objects
 type MGitStorage struct {
 	RootDir string // Usually ".mgit"
+	HeadDir string // Where HEAD is kept when not in RootDir, as in a linked worktree
 }
 
-// NewMGitStorage creates a new storage instance
+// NewMGitStorage creates a new storage instance for the current repository
 func NewMGitStorage() *MGitStorage {
-	return &MGitStorage{
-		RootDir: ".mgit",
+	storage := &MGitStorage{
+		RootDir: mgitCommonDir(),
 	}
+	if storage.RootDir != mgitDir() {
+		storage.HeadDir = mgitDir()
+	}
+	return storage
 }
 
 // Initialize creates the necessary directory structure for MGit
@@ -75,7 +80,7 @@ func (s *MGitStorage) Initialize() error {
 	}
 
 	// Create an initial HEAD file if it doesn't exist
-	headPath := filepath.Join(s.RootDir, "HEAD")
+	headPath := s.HeadPath()
 	if _, err := os.Stat(headPath); os.IsNotExist(err) {
 		// Default to "ref: refs/heads/master"
 		if err := ioutil.WriteFile(headPath, []byte("ref: refs/heads/master"), 0644); err != nil {
@@ -88,6 +93,13 @@ func (s *MGitStorage) Initialize() error {
 
 // StoreCommit stores an MGit commit object
 func (s *MGitStorage) StoreCommit(commit *MCommitStruct) error {
+	span := startSpan("storage.store_commit", "hash", commit.MGitHash)
+	err := s.storeCommit(commit)
+	span.End(err)
+	return err
+}
+
+func (s *MGitStorage) storeCommit(commit *MCommitStruct) error {
 	// Ensure the hash is set
 	if commit.MGitHash == "" {
 		return fmt.Errorf("MGit hash cannot be empty")
@@ -121,8 +133,41 @@ func (s *MGitStorage) StoreCommit(commit *MCommitStruct) error {
 	return nil
 }
 
+// StoreCommits stores many commits at once, as a single pack
+func (s *MGitStorage) StoreCommits(commits []*MCommitStruct) error {
+	span := startSpan("storage.store_commits", "commits", len(commits))
+	objects := make(map[string][]byte, len(commits))
+	for _, commit := range commits {
+		if commit.MGitHash == "" {
+			span.End(fmt.Errorf("MGit hash cannot be empty"))
+			return fmt.Errorf("MGit hash cannot be empty")
+		}
+		commit.Type = MGitCommitObject
+		data, err := json.MarshalIndent(commit, "", "  ")
+		if err != nil {
+			span.End(err)
+			return fmt.Errorf("failed to marshal commit: %w", err)
+		}
+		objects[commit.MGitHash] = data
+	}
+	
+	_, err := writeLocalObjectPack(s.RootDir, objects)
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("failed to write commit objects: %w", err)
+	}
+	return nil
+}
+
 // GetCommit retrieves an MGit commit by hash
 func (s *MGitStorage) GetCommit(mgitHash string) (*MCommitStruct, error) {
+	span := startSpan("storage.get_commit", "hash", mgitHash)
+	commit, err := s.getCommit(mgitHash)
+	span.End(err)
+	return commit, err
+}
+
+func (s *MGitStorage) getCommit(mgitHash string) (*MCommitStruct, error) {
 	if len(mgitHash) < 4 {
 		return nil, fmt.Errorf("MGit hash too short, need at least 4 characters")
 	}
@@ -145,18 +190,11 @@ func (s *MGitStorage) GetCommit(mgitHash string) (*MCommitStruct, error) {
 		mgitHash = matches[0]
 	}
 	
-	// Get the object path
-	prefix := mgitHash[:2]
-	suffix := mgitHash[2:]
-	objPath := filepath.Join(s.RootDir, "objects", prefix, suffix)
-	
-	// Check if the file exists
-	if _, err := os.Stat(objPath); os.IsNotExist(err) {
+	// Read the object, loose or packed
+	data, err := readMGitObject(s.RootDir, mgitHash)
+	if os.IsNotExist(err) {
 		return nil, fmt.Errorf("commit object not found: %s", mgitHash)
 	}
-	
-	// Read the file
-	data, err := ioutil.ReadFile(objPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read commit object: %w", err)
 	}
@@ -167,11 +205,34 @@ func (s *MGitStorage) GetCommit(mgitHash string) (*MCommitStruct, error) {
 		return nil, fmt.Errorf("failed to unmarshal commit: %w", err)
 	}
 	
+	// Tag objects share the object store
+	if commit.Type != "" && commit.Type != MGitCommitObject {
+		return nil, fmt.Errorf("object %s is a %s, not a commit", mgitHash, commit.Type)
+	}
+	
 	return &commit, nil
 }
 
-// findObjectByPrefix finds objects that start with the given prefix
+// findObjectByPrefix finds objects that start with the given prefix,
+// loose or packed
 func (s *MGitStorage) findObjectByPrefix(prefix string) ([]string, error) {
+	matches, err := s.findLooseObjectByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	packed, err := listPackedObjects(s.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range packed {
+		if strings.HasPrefix(hash, prefix) && !containsString(matches, hash) {
+			matches = append(matches, hash)
+		}
+	}
+	return matches, nil
+}
+
+func (s *MGitStorage) findLooseObjectByPrefix(prefix string) ([]string, error) {
 	matches := []string{}
 	
 	// For very short prefixes (1-2 chars), search directory names
@@ -215,7 +276,8 @@ func (s *MGitStorage) findObjectByPrefix(prefix string) ([]string, error) {
 	return matches, nil
 }
 
-// UpdateRef updates an MGit reference (branch or tag)
+// UpdateRef updates an MGit reference (branch or tag), recording a branch's
+// movement in its reflog and HEAD's
 func (s *MGitStorage) UpdateRef(refName string, mgitHash string) error {
 	// Ensure refName is formatted correctly
 	if !strings.HasPrefix(refName, "refs/") {
@@ -223,6 +285,7 @@ func (s *MGitStorage) UpdateRef(refName string, mgitHash string) error {
 	}
 	
 	refPath := filepath.Join(s.RootDir, refName)
+	oldHash, _ := s.GetRef(refName)
 	
 	// Create directory if it doesn't exist
 	refDir := filepath.Dir(refPath)
@@ -235,6 +298,9 @@ func (s *MGitStorage) UpdateRef(refName string, mgitHash string) error {
 		return fmt.Errorf("failed to write ref: %w", err)
 	}
 	
+	if strings.TrimSpace(oldHash) != mgitHash {
+		return logRefUpdate(s, refName, strings.TrimSpace(oldHash), mgitHash)
+	}
 	return nil
 }
 
@@ -261,9 +327,18 @@ func (s *MGitStorage) GetRef(refName string) (string, error) {
 	return string(data), nil
 }
 
-// UpdateHead updates the HEAD reference
+// HeadPath returns the path of the HEAD file
+func (s *MGitStorage) HeadPath() string {
+	if s.HeadDir != "" {
+		return filepath.Join(s.HeadDir, "HEAD")
+	}
+	return filepath.Join(s.RootDir, "HEAD")
+}
+
+// UpdateHead updates the HEAD reference, recording a switch of branch in
+// HEAD's reflog
 func (s *MGitStorage) UpdateHead(refName string) error {
-	headPath := filepath.Join(s.RootDir, "HEAD")
+	headPath := s.HeadPath()
 	
 	// Format the content as "ref: refs/heads/branch-name"
 	// Ensure refName is formatted correctly
@@ -272,18 +347,37 @@ func (s *MGitStorage) UpdateHead(refName string) error {
 	}
 	
 	content := fmt.Sprintf("ref: %s", refName)
+	oldHead, _ := s.GetHead()
+	oldHead = strings.TrimSpace(oldHead)
 	
 	// Write the HEAD file
 	if err := ioutil.WriteFile(headPath, []byte(content), 0644); err != nil {
 		return fmt.Errorf("failed to update HEAD: %w", err)
 	}
 	
+	if oldHead != refName {
+		newHash, _ := s.GetRef(refName)
+		return logHeadSwitch(s, oldHead, refName, strings.TrimSpace(newHash))
+	}
+	return nil
+}
+
+// DetachHead points HEAD straight at an MGit commit
+func (s *MGitStorage) DetachHead(mgitHash string) error {
+	oldHead, _ := s.GetHead()
+	oldHead = strings.TrimSpace(oldHead)
+	if err := ioutil.WriteFile(s.HeadPath(), []byte(mgitHash), 0644); err != nil {
+		return fmt.Errorf("failed to update HEAD: %w", err)
+	}
+	if oldHead != mgitHash {
+		return logHeadSwitch(s, oldHead, mgitHash, mgitHash)
+	}
 	return nil
 }
 
 // GetHead gets the current HEAD reference
 func (s *MGitStorage) GetHead() (string, error) {
-	headPath := filepath.Join(s.RootDir, "HEAD")
+	headPath := s.HeadPath()
 	
 	// Check if the file exists
 	if _, err := os.Stat(headPath); os.IsNotExist(err) {
@@ -329,150 +423,95 @@ func (s *MGitStorage) GetHeadCommit() (*MCommitStruct, error) {
 	}
 }
 
+// Mappings returns the mapping store of this MGit directory
+func (s *MGitStorage) Mappings() *MappingStore {
+	return NewMappingStore(s.RootDir)
+}
+
 // StoreMapping stores a mapping between Git and MGit hashes
 func (s *MGitStorage) StoreMapping(gitHash string, mgitHash string, pubkey string) error {
-	mappingPath := filepath.Join(s.RootDir, "mappings", "hash_mappings.json")
-	
-	// Create directory if it doesn't exist
-	mappingDir := filepath.Dir(mappingPath)
-	if err := os.MkdirAll(mappingDir, 0755); err != nil {
-		return fmt.Errorf("failed to create mapping directory: %w", err)
-	}
-	
-	// Read existing mappings if they exist
-	var mappings []struct {
-		GitHash  string `json:"git_hash"`
-		MGitHash string `json:"mgit_hash"`
-		Pubkey   string `json:"pubkey"`
-	}
-	
-	if _, err := os.Stat(mappingPath); !os.IsNotExist(err) {
-		data, err := ioutil.ReadFile(mappingPath)
-		if err != nil {
-			return fmt.Errorf("failed to read hash mappings: %w", err)
-		}
-		
-		if err := json.Unmarshal(data, &mappings); err != nil {
-			return fmt.Errorf("failed to unmarshal hash mappings: %w", err)
-		}
-	}
-	
-	// Add or update the mapping
-	newMapping := struct {
-		GitHash  string `json:"git_hash"`
-		MGitHash string `json:"mgit_hash"`
-		Pubkey   string `json:"pubkey"`
-	}{
+	// Add or update the mapping, appending it to the file
+	err := s.Mappings().Upsert(NostrCommitMapping{
 		GitHash:  gitHash,
 		MGitHash: mgitHash,
 		Pubkey:   pubkey,
-	}
-	
-	// Check for existing mapping
-	found := false
-	for i, mapping := range mappings {
-		if mapping.GitHash == gitHash || mapping.MGitHash == mgitHash {
-			mappings[i] = newMapping
-			found = true
-			break
-		}
-	}
-	
-	// Add if not found
-	if !found {
-		mappings = append(mappings, newMapping)
-	}
-	
-	// Marshal to JSON
-	data, err := json.MarshalIndent(mappings, "", "  ")
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal hash mappings: %w", err)
-	}
-	
-	// Write to file
-	if err := ioutil.WriteFile(mappingPath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write hash mappings: %w", err)
 	}
 	
 	return nil
 }
 
-// GetMappings gets all hash mappings
-func (s *MGitStorage) GetMappings() ([]struct {
-	GitHash  string `json:"git_hash"`
-	MGitHash string `json:"mgit_hash"`
-	Pubkey   string `json:"pubkey"`
-}, error) {
-	mappingPath := filepath.Join(s.RootDir, "mappings", "hash_mappings.json")
-	
-	var mappings []struct {
-		GitHash  string `json:"git_hash"`
-		MGitHash string `json:"mgit_hash"`
-		Pubkey   string `json:"pubkey"`
+// ForEachMapping calls fn for each hash mapping without loading the whole
+// mapping file into memory. fn can return errStopMappings to stop early.
+func (s *MGitStorage) ForEachMapping(fn func(NostrCommitMapping) error) error {
+	if err := s.Mappings().ForEach(fn); err != nil {
+		return fmt.Errorf("failed to read hash mappings: %w", err)
 	}
-	
-	// Check if the file exists
-	if _, err := os.Stat(mappingPath); os.IsNotExist(err) {
-		return mappings, nil // Return empty mappings
+	return nil
+}
+
+// GetMappings gets all hash mappings
+func (s *MGitStorage) GetMappings() ([]NostrCommitMapping, error) {
+	mappings := []NostrCommitMapping{}
+	err := s.ForEachMapping(func(mapping NostrCommitMapping) error {
+		mappings = append(mappings, mapping)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	
-	// Read the mappings
-	data, err := ioutil.ReadFile(mappingPath)
+	return mappings, nil
+}
+
+// findMapping returns the first mapping satisfying match
+func (s *MGitStorage) findMapping(match func(NostrCommitMapping) bool) (*NostrCommitMapping, error) {
+	mapping, err := s.Mappings().Find(match)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read hash mappings: %w", err)
 	}
-	
-	if err := json.Unmarshal(data, &mappings); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal hash mappings: %w", err)
-	}
-	
-	return mappings, nil
+	return mapping, nil
 }
 
 // GetMGitHashFromGit gets the MGit hash for a Git hash
 func (s *MGitStorage) GetMGitHashFromGit(gitHash string) (string, error) {
-	mappings, err := s.GetMappings()
+	mapping, err := s.findMapping(func(m NostrCommitMapping) bool {
+		return m.GitHash == gitHash
+	})
 	if err != nil {
 		return "", err
 	}
-	
-	for _, mapping := range mappings {
-		if mapping.GitHash == gitHash {
-			return mapping.MGitHash, nil
-		}
+	if mapping == nil {
+		return "", fmt.Errorf("no MGit hash found for Git hash %s", gitHash)
 	}
-	
-	return "", fmt.Errorf("no MGit hash found for Git hash %s", gitHash)
+	return mapping.MGitHash, nil
 }
 
 // GetGitHashFromMGit gets the Git hash for an MGit hash
 func (s *MGitStorage) GetGitHashFromMGit(mgitHash string) (string, error) {
-	mappings, err := s.GetMappings()
+	mapping, err := s.findMapping(func(m NostrCommitMapping) bool {
+		return m.MGitHash == mgitHash
+	})
 	if err != nil {
 		return "", err
 	}
-	
-	for _, mapping := range mappings {
-		if mapping.MGitHash == mgitHash {
-			return mapping.GitHash, nil
-		}
+	if mapping == nil {
+		return "", fmt.Errorf("no Git hash found for MGit hash %s", mgitHash)
 	}
-	
-	return "", fmt.Errorf("no Git hash found for MGit hash %s", mgitHash)
+	return mapping.GitHash, nil
 }
 
 // GetPubkeyForCommit gets the nostr pubkey for a commit (Git or MGit hash)
 func (s *MGitStorage) GetPubkeyForCommit(hash string) (string, error) {
-	mappings, err := s.GetMappings()
+	mapping, err := s.findMapping(func(m NostrCommitMapping) bool {
+		return m.GitHash == hash || m.MGitHash == hash
+	})
 	if err != nil {
 		return "", err
 	}
-	
-	for _, mapping := range mappings {
-		if mapping.GitHash == hash || mapping.MGitHash == hash {
-			return mapping.Pubkey, nil
-		}
+	if mapping == nil {
+		return "", fmt.Errorf("no pubkey found for hash %s", hash)
 	}
-	
-	return "", fmt.Errorf("no pubkey found for hash %s", hash)
+	return mapping.Pubkey, nil
 }
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// mgit submodule manages submodules the way git submodule does, with the
+// same .gitmodules and .git/config entries, so either tool can be used:
+//
+//	mgit submodule add [-b <branch>] [--name <name>] <url> [<path>]
+//	mgit submodule init [<path>...]
+//	mgit submodule update [--init] [--recursive] [<path>...]
+//	mgit submodule [status] [<path>...]
+//
+// A submodule on an MGit server is cloned and fetched the way mgit clone
+// does it, with the token and MGit metadata, so verify --recurse-submodules
+// can check it. One in a local directory that has a .mgit store gets that
+// store's objects and mappings. Any other URL is a plain Git submodule.
+
+// HandleSubmodule handles the submodule command
+func HandleSubmodule(args []string) {
+	sub := "status"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+
+	var err error
+	switch sub {
+	case "add":
+		err = submoduleAdd(args)
+	case "init":
+		err = submoduleInit(getRepo(), args)
+	case "update":
+		err = submoduleUpdate(args)
+	case "status":
+		err = submoduleStatus(args)
+	default:
+		printSubmoduleUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printSubmoduleUsage() {
+	fmt.Println("Usage: mgit submodule add [-b <branch>] [--name <name>] <url> [<path>]")
+	fmt.Println("       mgit submodule init [<path>...]")
+	fmt.Println("       mgit submodule update [--init] [--recursive] [<path>...]")
+	fmt.Println("       mgit submodule [status] [<path>...]")
+}
+
+// readGitmodules reads the .gitmodules of the worktree, empty if there is
+// none
+func readGitmodules(root string) (*config.Modules, error) {
+	modules := config.NewModules()
+	data, err := os.ReadFile(filepath.Join(root, ".gitmodules"))
+	if os.IsNotExist(err) {
+		return modules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := modules.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf(".gitmodules: %w", err)
+	}
+	return modules, nil
+}
+
+// selectSubmodules returns the submodules under the given paths, all of
+// them by default, sorted by path
+func selectSubmodules(modules *config.Modules, args []string) ([]*config.Submodule, error) {
+	paths := []string{}
+	for _, arg := range args {
+		p, err := repoRelativePath(arg)
+		if err != nil {
+			return nil, err
+		}
+		if p == "." {
+			paths = nil
+			break
+		}
+		paths = append(paths, p)
+	}
+
+	selected := []*config.Submodule{}
+	matched := map[string]bool{}
+	for _, sm := range modules.Submodules {
+		for _, p := range paths {
+			if pathMatches(sm.Path, []string{p}, false) {
+				matched[p] = true
+			}
+		}
+		if pathMatches(sm.Path, paths, false) {
+			selected = append(selected, sm)
+		}
+	}
+	for _, p := range paths {
+		if !matched[p] {
+			return nil, fmt.Errorf("pathspec '%s' did not match any submodule", p)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Path < selected[j].Path })
+	return selected, nil
+}
+
+// submoduleHead returns the commit checked out in a submodule, or the zero
+// hash when it isn't checked out
+func submoduleHead(dir string) (plumbing.Hash, error) {
+	repo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, nil
+	}
+	return head.Hash(), nil
+}
+
+// isSubmodulePath reports whether a worktree path is a checked-out
+// submodule rather than a directory of the repository
+func isSubmodulePath(root, p string) bool {
+	if p == "." {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(root, filepath.FromSlash(p), ".git"))
+	return err == nil
+}
+
+// gitlinks returns the submodule commits recorded in the index, by path
+func gitlinks(repo *git.Repository) (map[string]plumbing.Hash, error) {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	links := map[string]plumbing.Hash{}
+	for _, entry := range idx.Entries {
+		if entry.Mode == filemode.Submodule {
+			links[entry.Name] = entry.Hash
+		}
+	}
+	return links, nil
+}
+
+// resolveSubmoduleURL resolves a ./ or ../ URL the way git does: against
+// the superproject's remote URL, or its directory when it has no remote
+func resolveSubmoduleURL(repo *git.Repository, rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, "./") && !strings.HasPrefix(rawURL, "../") {
+		return rawURL, nil
+	}
+	base, err := getRemoteURL(repo, defaultRemote(repo))
+	if err != nil {
+		if base, err = filepath.Abs(repoRoot()); err != nil {
+			return "", err
+		}
+		return filepath.Join(base, filepath.FromSlash(rawURL)), nil
+	}
+	parsed, err := url.Parse(base)
+	if err != nil || parsed.Scheme == "" {
+		return filepath.Join(base, filepath.FromSlash(rawURL)), nil
+	}
+	parsed.Path = path.Join(parsed.Path, rawURL)
+	return parsed.String(), nil
+}
+
+// submoduleToken returns the token for a submodule on an MGit server, or
+// false when the URL isn't one mgit has a token for
+func submoduleToken(rawURL string) (string, bool) {
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		return "", false
+	}
+	if token, ok := credentialFill(rawURL); ok {
+		return token, true
+	}
+	return lookupStoredToken(rawURL)
+}
+
+// submoduleAdd clones a repository into the worktree and records it as a
+// submodule
+func submoduleAdd(args []string) error {
+	branch, name := "", ""
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-b" || arg == "--branch") && i+1 < len(args):
+			i++
+			branch = args[i]
+		case arg == "--name" && i+1 < len(args):
+			i++
+			name = args[i]
+		case strings.HasPrefix(arg, "-"):
+			printSubmoduleUsage()
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		printSubmoduleUsage()
+		os.Exit(1)
+	}
+	rawURL := positional[0]
+	target := strings.TrimSuffix(path.Base(strings.TrimSuffix(filepath.ToSlash(rawURL), "/")), ".git")
+	if len(positional) == 2 {
+		target = positional[1]
+	}
+	subPath, err := repoRelativePath(target)
+	if err != nil {
+		return err
+	}
+	if subPath == "." || !validPatchPath(subPath) {
+		return fmt.Errorf("invalid submodule path '%s'", target)
+	}
+	if name == "" {
+		name = subPath
+	}
+
+	repo := getRepo()
+	root := repoRoot()
+	modules, err := readGitmodules(root)
+	if err != nil {
+		return err
+	}
+	for _, sm := range modules.Submodules {
+		if sm.Path == subPath || sm.Name == name {
+			return fmt.Errorf("'%s' already exists in .gitmodules", subPath)
+		}
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	for _, entry := range idx.Entries {
+		if entry.Name == subPath || strings.HasPrefix(entry.Name, subPath+"/") {
+			return fmt.Errorf("'%s' already exists in the index", subPath)
+		}
+	}
+
+	resolved, err := resolveSubmoduleURL(repo, rawURL)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(root, filepath.FromSlash(subPath))
+	if head, err := submoduleHead(dir); err != nil {
+		return err
+	} else if !head.IsZero() {
+		fmt.Printf("Adding existing repo at '%s' to the index\n", subPath)
+	} else {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+			return fmt.Errorf("'%s' already exists and is not a valid git repo", subPath)
+		}
+		if err := cloneSubmodule(resolved, dir); err != nil {
+			return err
+		}
+	}
+	if branch != "" {
+		if err := checkoutSubmodule(dir, branch); err != nil {
+			return err
+		}
+	}
+	head, err := submoduleHead(dir)
+	if err != nil {
+		return err
+	}
+	if head.IsZero() {
+		return fmt.Errorf("'%s' has no commits to record", subPath)
+	}
+
+	modules.Submodules[name] = &config.Submodule{Name: name, Path: subPath, URL: rawURL, Branch: branch}
+	data, err := modules.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(root, ".gitmodules"), data, 0644); err != nil {
+		return err
+	}
+	if err := stagePaths(repo, root, []string{".gitmodules", subPath}); err != nil {
+		return err
+	}
+	if err := registerSubmodule(repo, name, resolved); err != nil {
+		return err
+	}
+	fmt.Printf("Added submodule '%s' at %s\n", subPath, submoduleCommitName(dir, head))
+	return nil
+}
+
+// registerSubmodule records a submodule's URL in .git/config, which is
+// what marks it initialized for update
+func registerSubmodule(repo *git.Repository, name, resolvedURL string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Submodules[name] = &config.Submodule{Name: name, URL: resolvedURL}
+	return repo.SetConfig(cfg)
+}
+
+// submoduleInit registers the selected submodules in .git/config
+func submoduleInit(repo *git.Repository, args []string) error {
+	modules, err := readGitmodules(repoRoot())
+	if err != nil {
+		return err
+	}
+	selected, err := selectSubmodules(modules, args)
+	if err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	for _, sm := range selected {
+		if registered := cfg.Submodules[sm.Name]; registered != nil && registered.URL != "" {
+			continue
+		}
+		resolved, err := resolveSubmoduleURL(repo, sm.URL)
+		if err != nil {
+			return err
+		}
+		cfg.Submodules[sm.Name] = &config.Submodule{Name: sm.Name, URL: resolved}
+		fmt.Printf("Submodule '%s' (%s) registered for path '%s'\n", sm.Name, resolved, sm.Path)
+	}
+	return repo.SetConfig(cfg)
+}
+
+// submoduleUpdate clones the initialized submodules that are missing and
+// checks out the commit the index records in each
+func submoduleUpdate(args []string) error {
+	initFirst, recursive := false, false
+	paths := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--init":
+			initFirst = true
+		case arg == "--recursive":
+			recursive = true
+		case strings.HasPrefix(arg, "-"):
+			printSubmoduleUsage()
+			os.Exit(1)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+
+	repo := getRepo()
+	if initFirst {
+		if err := submoduleInit(repo, paths); err != nil {
+			return err
+		}
+	}
+	root := repoRoot()
+	modules, err := readGitmodules(root)
+	if err != nil {
+		return err
+	}
+	selected, err := selectSubmodules(modules, paths)
+	if err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	links, err := gitlinks(repo)
+	if err != nil {
+		return err
+	}
+
+	// Like git, one submodule failing doesn't stop the others
+	failed := 0
+	for _, sm := range selected {
+		registered := cfg.Submodules[sm.Name]
+		if registered == nil || registered.URL == "" {
+			continue
+		}
+		commit, ok := links[sm.Path]
+		if !ok {
+			fmt.Printf("Warning: submodule '%s' is not in the index\n", sm.Path)
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(sm.Path))
+		if err := updateSubmodule(dir, registered.URL, commit); err != nil {
+			fmt.Printf("Error: submodule '%s': %s\n", sm.Path, err)
+			failed++
+			continue
+		}
+		if recursive {
+			if _, err := os.Stat(filepath.Join(dir, ".gitmodules")); err == nil {
+				if err := runInSubmodule(dir, "submodule", "update", "--init", "--recursive"); err != nil {
+					fmt.Printf("Error: submodule '%s': %s\n", sm.Path, err)
+					failed++
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d submodules could not be updated", failed)
+	}
+	return nil
+}
+
+// updateSubmodule checks out a commit in a submodule, cloning or fetching
+// it first if need be
+func updateSubmodule(dir, rawURL string, commit plumbing.Hash) error {
+	head, err := submoduleHead(dir)
+	if err != nil {
+		return err
+	}
+	if head.IsZero() {
+		if err := cloneSubmodule(rawURL, dir); err != nil {
+			return err
+		}
+	} else if head == commit {
+		return nil
+	}
+
+	subRepo, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := subRepo.CommitObject(commit); err != nil || missingMGitMapping(dir, commit) {
+		// git pull fetches submodules on its own, without the MGit
+		// metadata, so an MGit submodule is fetched for that too
+		if err := fetchSubmodule(rawURL, dir); err != nil {
+			return err
+		}
+		if subRepo, err = git.PlainOpen(dir); err != nil {
+			return err
+		}
+		if _, err := subRepo.CommitObject(commit); err != nil {
+			return fmt.Errorf("fetched from %s, but commit %s is not there", rawURL, shortHash(commit.String()))
+		}
+	}
+	if err := checkoutSubmodule(dir, commit.String()); err != nil {
+		return err
+	}
+	rel, _ := filepath.Rel(repoRoot(), dir)
+	fmt.Printf("Submodule path '%s': checked out %s\n", filepath.ToSlash(rel), submoduleCommitName(dir, commit))
+	return nil
+}
+
+// missingMGitMapping reports whether a submodule with an MGit store has no
+// MGit hash for a commit
+func missingMGitMapping(dir string, commit plumbing.Hash) bool {
+	storage := &MGitStorage{RootDir: filepath.Join(dir, ".mgit")}
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		return false
+	}
+	mgitHash, err := storage.GetMGitHashFromGit(commit.String())
+	return err != nil || mgitHash == ""
+}
+
+// submoduleCommitName names a submodule commit by MGit hash when the
+// submodule has one for it
+func submoduleCommitName(dir string, commit plumbing.Hash) string {
+	storage := &MGitStorage{RootDir: filepath.Join(dir, ".mgit")}
+	if mgitHash, err := storage.GetMGitHashFromGit(commit.String()); err == nil && mgitHash != "" {
+		return fmt.Sprintf("'%s' (git %s)", mgitHash, shortHash(commit.String()))
+	}
+	return fmt.Sprintf("'%s'", commit)
+}
+
+// checkoutSubmodule checks out a branch or commit in a submodule and
+// brings its .mgit HEAD along
+func checkoutSubmodule(dir, rev string) error {
+	args := []string{"-C", dir, "checkout", "-q", rev}
+	if plumbing.IsHash(rev) {
+		args = []string{"-C", dir, "checkout", "-q", "--detach", rev}
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error checking out %s: %w", rev, err)
+	}
+	subRepo, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	storage := &MGitStorage{RootDir: filepath.Join(dir, ".mgit")}
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		return nil
+	}
+	return followGitHead(subRepo, storage)
+}
+
+// cloneSubmodule clones a submodule: from an MGit server with its MGit
+// metadata, or with git, picking up the .mgit store of a local repository
+func cloneSubmodule(rawURL, dir string) error {
+	if token, ok := submoduleToken(rawURL); ok {
+		if err := verifyServerIdentity("origin", rawURL); err != nil {
+			return err
+		}
+		if err := cloneRepository(strings.TrimSuffix(rawURL, "/"), dir, token, &CloneOptions{}); err != nil {
+			return err
+		}
+		return excludeMGitStore(dir)
+	}
+
+	cmd := exec.Command("git", "clone", "-q", rawURL, dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error cloning %s: %w", rawURL, err)
+	}
+	if err := importLocalMGit(rawURL, dir); err != nil {
+		return err
+	}
+	return excludeMGitStore(dir)
+}
+
+// excludeMGitStore keeps a submodule's .mgit out of its git status, which
+// would otherwise show the submodule as dirty in the superproject
+func excludeMGitStore(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".mgit")); err != nil {
+		return nil
+	}
+	return addInfoExclude(filepath.Join(dir, ".git"), "/.mgit/")
+}
+
+// addInfoExclude adds a pattern to the info/exclude of a git directory,
+// unless it is there already
+func addInfoExclude(gitDir, pattern string) error {
+	exclude := filepath.Join(gitDir, "info", "exclude")
+	data, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
+		}
+	}
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(exclude, append(data, pattern+"\n"...), 0644)
+}
+
+// fetchSubmodule fetches a submodule's origin, and its MGit metadata
+func fetchSubmodule(rawURL, dir string) error {
+	token, isMGit := submoduleToken(rawURL)
+	args := []string{"-C", dir}
+	if isMGit {
+		args = append(args, gitTLSArgs("origin")...)
+		args = append(args, "-c", fmt.Sprintf("http.extraHeader=Authorization: Bearer %s", token))
+	}
+	cmd := exec.Command("git", append(args, "fetch", "-q", "origin")...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error fetching %s: %w", rawURL, err)
+	}
+	if !isMGit {
+		return importLocalMGit(rawURL, dir)
+	}
+
+	if err := fetchMGitData("origin", rawURL, token, dir, ""); err != nil {
+		return err
+	}
+	return reconstructMGitObjects(dir)
+}
+
+// importLocalMGit copies the MGit objects and mappings of a local
+// repository into a clone of it. Anything that isn't a local directory
+// with a .mgit store is left a plain Git clone.
+func importLocalMGit(source, dir string) error {
+	source = strings.TrimPrefix(source, "file://")
+	sourceStore := filepath.Join(source, ".mgit")
+	if info, err := os.Stat(sourceStore); err != nil || !info.IsDir() {
+		return nil
+	}
+	store := filepath.Join(dir, ".mgit")
+
+	objects := filepath.Join(sourceStore, "objects")
+	err := filepath.WalkDir(objects, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(objects, p)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(store, "objects", rel)
+		if _, err := os.Stat(to); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		return copyFile(p, to)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error copying MGit objects: %w", err)
+	}
+
+	// The source's mappings, then any the clone has of its own
+	mappings := NewMappingStore(store)
+	if err := os.MkdirAll(filepath.Dir(mappings.Path()), 0755); err != nil {
+		return err
+	}
+	writer, err := newMappingFileWriter(mappings.Path()+".tmp", false)
+	if err != nil {
+		return err
+	}
+	defer writer.Abort()
+	if err := NewMappingStore(sourceStore).ForEach(writer.Add); err != nil {
+		return fmt.Errorf("error reading mappings of %s: %w", source, err)
+	}
+	if err := mappings.ForEach(writer.Add); err != nil {
+		return fmt.Errorf("error reading local mappings: %w", err)
+	}
+	if err := writer.Commit(mappings.Path()); err != nil {
+		return err
+	}
+	return reconstructMGitObjects(dir)
+}
+
+// runInSubmodule runs mgit in a submodule, as mgit -C <dir> would
+func runInSubmodule(dir string, args ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// submoduleStatus lists the submodules with the commit the index records:
+// "-" before it when the submodule isn't checked out, "+" when another
+// commit is
+func submoduleStatus(args []string) error {
+	repo := getRepo()
+	root := repoRoot()
+	modules, err := readGitmodules(root)
+	if err != nil {
+		return err
+	}
+	selected, err := selectSubmodules(modules, args)
+	if err != nil {
+		return err
+	}
+	links, err := gitlinks(repo)
+	if err != nil {
+		return err
+	}
+	for _, sm := range selected {
+		commit, ok := links[sm.Path]
+		if !ok {
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(sm.Path))
+		head, err := submoduleHead(dir)
+		if err != nil {
+			return err
+		}
+		prefix, shown := " ", commit
+		switch {
+		case head.IsZero():
+			prefix = "-"
+		case head != commit:
+			prefix, shown = "+", head
+		}
+		line := fmt.Sprintf("%s%s %s", prefix, shown, sm.Path)
+		storage := &MGitStorage{RootDir: filepath.Join(dir, ".mgit")}
+		if mgitHash, err := storage.GetMGitHashFromGit(shown.String()); err == nil && mgitHash != "" {
+			line += fmt.Sprintf(" (mgit %s)", shortHash(mgitHash))
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
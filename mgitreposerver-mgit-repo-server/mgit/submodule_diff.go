@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// A submodule is a gitlink, a mode 160000 entry naming a commit of another
+// repository, which diff shows as a "Subproject commit" line and status
+// only as modified. mgit diff --submodule=log and mgit status say instead
+// what changed: the MGit hashes the submodule moved between, the commits
+// it gained or lost, and whether its checkout has changes of its own.
+//
+// diff.submodule sets the format diff uses when --submodule isn't given:
+// short, the "Subproject commit" lines, or log.
+
+// submoduleDirt is what a checked-out submodule has changed besides the
+// commit it is on
+type submoduleDirt struct {
+	Modified  bool // tracked files changed
+	Untracked bool // files git doesn't track
+}
+
+func (d submoduleDirt) clean() bool {
+	return !d.Modified && !d.Untracked
+}
+
+// notes names the changes, as git status does
+func (d submoduleDirt) notes() []string {
+	notes := []string{}
+	if d.Modified {
+		notes = append(notes, "modified content")
+	}
+	if d.Untracked {
+		notes = append(notes, "untracked content")
+	}
+	return notes
+}
+
+// submoduleDirtState returns the changes in a submodule's checkout, none
+// when it isn't checked out. The submodule's own .mgit doesn't count.
+func submoduleDirtState(dir string) (submoduleDirt, error) {
+	dirt := submoduleDirt{}
+	if head, err := submoduleHead(dir); err != nil || head.IsZero() {
+		return dirt, err
+	}
+	out, err := exec.Command("git", "-C", dir, "status", "--porcelain", "--ignore-submodules=dirty").Output()
+	if err != nil {
+		return dirt, fmt.Errorf("error getting status of submodule %s: %w", dir, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) < 4 || isMetadataPath(strings.TrimSuffix(line[3:], "/")) {
+			continue
+		}
+		if strings.HasPrefix(line, "??") {
+			dirt.Untracked = true
+		} else {
+			dirt.Modified = true
+		}
+	}
+	return dirt, nil
+}
+
+// submoduleCommitLabel names a submodule commit in one-line output, by the
+// MGit hash the submodule has for it when it has one
+func submoduleCommitLabel(dir string, commit plumbing.Hash) string {
+	if commit.IsZero() {
+		return shortHash(commit.String())
+	}
+	storage := &MGitStorage{RootDir: filepath.Join(dir, ".mgit")}
+	mgitHash, _ := storage.GetMGitHashFromGit(commit.String())
+	return displayShortHash(mgitHash, commit.String())
+}
+
+// submoduleRange is "<from>..<to>" for a submodule that moved forward, or
+// "<from>...<to>" when it was added, removed or rewound
+func submoduleRange(dir string, from, to plumbing.Hash, fastForward bool) string {
+	separator := "..."
+	if fastForward {
+		separator = ".."
+	}
+	return submoduleCommitLabel(dir, from) + separator + submoduleCommitLabel(dir, to)
+}
+
+// submoduleMoves returns the commits a submodule gained moving from one
+// commit to another, and those it lost when it was rewound, newest first.
+// It fails when the submodule doesn't have both commits.
+func submoduleMoves(dir string, from, to plumbing.Hash) (gained, lost []*object.Commit, err error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	fromAncestors, err := gitAncestors(repo, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	toAncestors, err := gitAncestors(repo, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = walkGitCommits(repo, to, fromAncestors, func(commit *object.Commit) {
+		gained = append(gained, commit)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = walkGitCommits(repo, from, toAncestors, func(commit *object.Commit) {
+		lost = append(lost, commit)
+	})
+	return gained, lost, err
+}
+
+// writeSubmoduleLog writes a submodule's change the way git diff
+// --submodule=log does: its dirt, then the commits it moved between and
+// the subject of each commit gained (>) or lost (<)
+func writeSubmoduleLog(w io.Writer, path string, from, to *mergeEntry, dirt submoduleDirt) {
+	dir := filepath.Join(repoRoot(), filepath.FromSlash(path))
+	if dirt.Untracked {
+		fmt.Fprintf(w, "Submodule %s contains untracked content\n", path)
+	}
+	if dirt.Modified {
+		fmt.Fprintf(w, "Submodule %s contains modified content\n", path)
+	}
+
+	switch {
+	case from != nil && to != nil && from.Hash == to.Hash:
+		return
+	case from == nil:
+		fmt.Fprintf(w, "Submodule %s %s (new submodule)\n", path, submoduleRange(dir, plumbing.ZeroHash, to.Hash, false))
+		return
+	case to == nil:
+		fmt.Fprintf(w, "Submodule %s %s (submodule deleted)\n", path, submoduleRange(dir, from.Hash, plumbing.ZeroHash, false))
+		return
+	}
+
+	gained, lost, err := submoduleMoves(dir, from.Hash, to.Hash)
+	if err != nil {
+		fmt.Fprintf(w, "Submodule %s %s (commits not present)\n", path, submoduleRange(dir, from.Hash, to.Hash, true))
+		return
+	}
+	if len(lost) > 0 {
+		fmt.Fprintf(w, "Submodule %s %s (rewind):\n", path, submoduleRange(dir, from.Hash, to.Hash, false))
+	} else {
+		fmt.Fprintf(w, "Submodule %s %s:\n", path, submoduleRange(dir, from.Hash, to.Hash, true))
+	}
+	for _, commit := range gained {
+		fmt.Fprintf(w, "  > %s\n", strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0])
+	}
+	for _, commit := range lost {
+		fmt.Fprintf(w, "  < %s\n", strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0])
+	}
+}
+
+// submoduleStatusNote describes a submodule for mgit status: the commits
+// it moved between, then its dirt, e.g. "(new commits 1a2b3c4..5d6e7f8,
+// modified content)"
+func submoduleStatusNote(path string, from, to plumbing.Hash, dirt submoduleDirt) string {
+	dir := filepath.Join(repoRoot(), filepath.FromSlash(path))
+	notes := []string{}
+	if from != to && !from.IsZero() && !to.IsZero() {
+		gained, lost, err := submoduleMoves(dir, from, to)
+		switch {
+		case err != nil:
+			notes = append(notes, "commits not present "+submoduleRange(dir, from, to, true))
+		case len(lost) > 0:
+			notes = append(notes, "rewound "+submoduleRange(dir, from, to, false))
+		default:
+			notes = append(notes, fmt.Sprintf("%d new commits %s", len(gained), submoduleRange(dir, from, to, true)))
+		}
+	}
+	notes = append(notes, dirt.notes()...)
+	if len(notes) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(notes, ", ") + ")"
+}
+
+// submoduleStatusNotes returns the notes mgit status adds after the
+// submodules it lists, by path: for changes to be committed, the commits
+// between HEAD's gitlink and the index's, and for changes not staged,
+// those between the index's and the checkout, with its dirt. A submodule
+// whose only changes are its own is added to status as modified, as git
+// status lists it.
+func submoduleStatusNotes(repo *git.Repository, status git.Status) (staged, unstaged map[string]string, err error) {
+	staged, unstaged = map[string]string{}, map[string]string{}
+	links, err := gitlinks(repo)
+	if err != nil || len(links) == 0 {
+		return staged, unstaged, err
+	}
+	var headEntries map[string]*mergeEntry
+	if head, err := repo.Head(); err == nil {
+		if headEntries, err = treeEntries(repo, head.Hash()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	root := repoRoot()
+	for path, commit := range links {
+		fileStatus, listed := status[path]
+		if listed && fileStatus.Staging == git.Modified {
+			if from := headEntries[path]; from != nil && from.Mode == filemode.Submodule {
+				staged[path] = submoduleStatusNote(path, from.Hash, commit, submoduleDirt{})
+			}
+		}
+
+		dir := filepath.Join(root, filepath.FromSlash(path))
+		head, err := submoduleHead(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if head.IsZero() {
+			continue
+		}
+		dirt, err := submoduleDirtState(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if head == commit && dirt.clean() {
+			continue
+		}
+		if !listed {
+			fileStatus = &git.FileStatus{Staging: git.Unmodified}
+			status[path] = fileStatus
+		}
+		fileStatus.Worktree = git.Modified
+		unstaged[path] = submoduleStatusNote(path, commit, head, dirt)
+	}
+	return staged, unstaged, nil
+}
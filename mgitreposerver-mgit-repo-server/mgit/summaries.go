@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// A branch summary is a small snapshot of a branch's history: its head,
+// how many commits it has, who wrote them and when it last changed. They
+// are kept in .mgit/summaries, one file per branch, and sent to the server
+// after each push so repository listings can show them without walking the
+// history:
+//
+//	PUT /api/mgit/repos/<repo>/summaries/<branch>
+//	GET /api/mgit/repos/<repo>/summaries
+//
+// A summary is brought up to date by walking only the commits added since
+// it was made, unless the branch was rewritten.
+
+// branchSummary is the summary of one branch
+type branchSummary struct {
+	Branch       string               `json:"branch"`
+	Head         string               `json:"head"` // MGit hash
+	GitHead      string               `json:"git_head"`
+	Commits      int                  `json:"commits"`
+	Contributors []summaryContributor `json:"contributors"`
+	LastActivity time.Time            `json:"last_activity"`
+}
+
+// summaryContributor is an author of commits on a branch, told apart by
+// pubkey, or by email for commits without one
+type summaryContributor struct {
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Pubkey       string    `json:"pubkey,omitempty"`
+	Commits      int       `json:"commits"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// summaryPath returns the file a branch's summary is kept in. The name is
+// escaped so branches like feature/x stay one file.
+func summaryPath(branch string) string {
+	return filepath.Join(mgitCommonDir(), "summaries", url.PathEscape(branch)+".json")
+}
+
+// loadBranchSummary reads a branch's summary, nil if it has none
+func loadBranchSummary(branch string) (*branchSummary, error) {
+	data, err := os.ReadFile(summaryPath(branch))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	summary := &branchSummary{}
+	if err := json.Unmarshal(data, summary); err != nil {
+		return nil, fmt.Errorf("error reading summary of %s: %w", branch, err)
+	}
+	return summary, nil
+}
+
+func (s *branchSummary) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := summaryPath(s.Branch)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// add counts commits into the summary
+func (s *branchSummary) add(commits []*MCommitStruct) {
+	index := map[string]int{}
+	for i, c := range s.Contributors {
+		index[contributorKey(c.Pubkey, c.Email)] = i
+	}
+	for _, commit := range commits {
+		s.Commits++
+		if commit.Committer != nil && commit.Committer.When.After(s.LastActivity) {
+			s.LastActivity = commit.Committer.When
+		}
+		author := commit.Author
+		if author == nil {
+			continue
+		}
+		key := contributorKey(author.Pubkey, author.Email)
+		i, ok := index[key]
+		if !ok {
+			i = len(s.Contributors)
+			index[key] = i
+			s.Contributors = append(s.Contributors, summaryContributor{Name: author.Name, Email: author.Email, Pubkey: author.Pubkey})
+		}
+		c := &s.Contributors[i]
+		c.Commits++
+		if author.When.After(c.LastActivity) {
+			// The name and email of an author's latest commit win
+			c.LastActivity = author.When
+			c.Name, c.Email = author.Name, author.Email
+		}
+	}
+	sort.SliceStable(s.Contributors, func(i, j int) bool {
+		if s.Contributors[i].Commits != s.Contributors[j].Commits {
+			return s.Contributors[i].Commits > s.Contributors[j].Commits
+		}
+		return s.Contributors[i].LastActivity.After(s.Contributors[j].LastActivity)
+	})
+}
+
+func contributorKey(pubkey, email string) string {
+	if pubkey != "" {
+		return "pubkey:" + pubkey
+	}
+	return "email:" + strings.ToLower(email)
+}
+
+// updateBranchSummary brings a branch's summary up to date with its Git
+// tip and saves it
+func updateBranchSummary(repo *git.Repository, storage *MGitStorage, branch string) (*branchSummary, error) {
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return nil, fmt.Errorf("no such branch '%s'", branch)
+	}
+	gitHead := ref.Hash().String()
+	head, err := storage.GetMGitHashFromGit(gitHead)
+	if err != nil || head == "" {
+		return nil, fmt.Errorf("branch %s has no MGit commit for %s; run 'mgit checkout --reconcile %s'", branch, shortHash(gitHead), branch)
+	}
+
+	summary, err := loadBranchSummary(branch)
+	if err != nil {
+		return nil, err
+	}
+	if summary != nil && summary.Head == head {
+		return summary, nil
+	}
+	if summary == nil || !isMGitAncestor(storage, summary.Head, head) {
+		// New, or rewritten since: count everything again
+		summary = &branchSummary{Branch: branch, Contributors: []summaryContributor{}}
+		summary.add(mgitRange(storage, []string{head}, nil))
+	} else {
+		summary.add(mgitRange(storage, []string{head}, []string{summary.Head}))
+	}
+	summary.Head, summary.GitHead = head, gitHead
+	if err := summary.save(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// HandleSummary handles the summary command
+func HandleSummary(args []string) {
+	upload, asJSON := false, false
+	remoteName := ""
+	branches := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "--upload":
+			upload = true
+		case strings.HasPrefix(arg, "--upload="):
+			upload = true
+			remoteName = strings.TrimPrefix(arg, "--upload=")
+		case arg == "--json":
+			asJSON = true
+		case strings.HasPrefix(arg, "-"):
+			fmt.Println("Usage: mgit summary [--json] [--upload[=<remote>]] [<branch>...]")
+			os.Exit(1)
+		default:
+			branches = append(branches, arg)
+		}
+	}
+
+	repo := getRepo()
+	if len(branches) == 0 {
+		iter, err := repo.Branches()
+		if err != nil {
+			fmt.Printf("Error listing branches: %s\n", err)
+			os.Exit(1)
+		}
+		iter.ForEach(func(ref *plumbing.Reference) error {
+			branches = append(branches, ref.Name().Short())
+			return nil
+		})
+		sort.Strings(branches)
+	}
+
+	storage := NewMGitStorage()
+	summaries := []*branchSummary{}
+	failed := false
+	for _, branch := range branches {
+		summary, err := updateBranchSummary(repo, storage, branch)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			failed = true
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(summaries, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, s := range summaries {
+			fmt.Printf("%s  %s  %d commits  %d contributors  last activity %s\n",
+				s.Branch, shortHash(s.Head), s.Commits, len(s.Contributors),
+				s.LastActivity.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		}
+	}
+
+	if upload {
+		if remoteName == "" {
+			remoteName = defaultRemote(repo)
+		}
+		if err := uploadBranchSummaries(repo, remoteName, summaries); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// pushBranchSummaries updates the summaries of pushed branches and sends
+// them to the remote's server, unless push.summaries is off
+func pushBranchSummaries(repo *git.Repository, remoteName string, branches []string) error {
+	if !GetConfigBool("push.summaries", true) {
+		return nil
+	}
+	storage := NewMGitStorage()
+	summaries := []*branchSummary{}
+	for _, branch := range branches {
+		summary, err := updateBranchSummary(repo, storage, branch)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, summary)
+	}
+	return uploadBranchSummaries(repo, remoteName, summaries)
+}
+
+// uploadBranchSummaries sends summaries to a remote's server
+func uploadBranchSummaries(repo *git.Repository, remoteName string, summaries []*branchSummary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+	remoteURL, err := getRemoteURL(repo, remoteName)
+	if err != nil {
+		return err
+	}
+	if err := verifyServerIdentity(remoteName, remoteURL); err != nil {
+		return err
+	}
+	client, err := newHTTPClient(remoteName)
+	if err != nil {
+		return err
+	}
+	token := getTokenForRepo(remoteURL)
+
+	for _, summary := range summaries {
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		endpoint := "summaries/" + url.PathEscape(summary.Branch)
+		req, err := http.NewRequest("PUT", repoAPIURL(remoteURL, endpoint), bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		setAcceptEncoding(req)
+
+		span := startSpan("summary.upload", "branch", summary.Branch)
+		resp, err := client.Do(req)
+		span.End(err)
+		if err != nil {
+			return fmt.Errorf("error making request: %w", err)
+		}
+		body, err := decodedBody(resp)
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		message, _ := io.ReadAll(body)
+		body.Close()
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+			fmt.Printf("Uploaded summary of %s to %s\n", summary.Branch, remoteName)
+		case http.StatusNotFound, http.StatusMethodNotAllowed:
+			fmt.Println("Server does not accept branch summaries, skipping")
+			return nil
+		case http.StatusConflict:
+			return fmt.Errorf("%s on %s is not at %s; push the branch first", summary.Branch, remoteName, shortHash(summary.Head))
+		default:
+			return fmt.Errorf("error response from server: %s", string(message))
+		}
+	}
+	return nil
+}
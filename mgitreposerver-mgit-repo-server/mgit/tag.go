@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// MGit tags live under .mgit/refs/tags, next to a Git tag of the same name.
+// A lightweight tag's ref holds the MGit hash of a commit; an annotated
+// tag's holds the hash of an MGit tag object, which is stored with the
+// commits in .mgit/objects and names the commit by its MGit hash, with the
+// tagger's nostr pubkey and, if signed, their Schnorr signature.
+//
+//	tag.sign  sign annotated tags without -s
+
+// MGitTagObject is the type of annotated tag objects
+const MGitTagObject MGitObjectType = "tag"
+
+// tagEditHelp follows the message in the file tag -a opens
+const tagEditHelp = `
+#
+# Write a message for tag:
+#   %s
+# Lines starting with '#' will be ignored.
+`
+
+// MTagStruct is an MGit tag object
+type MTagStruct struct {
+	Type       MGitObjectType    `json:"type"`
+	MGitHash   string            `json:"mgit_hash"`
+	Object     string            `json:"object"` // MGit hash of the tagged commit
+	ObjectType MGitObjectType    `json:"object_type"`
+	GitHash    string            `json:"git_hash,omitempty"` // the Git tag object
+	Name       string            `json:"tag"`
+	Tagger     *MGitSignature    `json:"tagger"`
+	Message    string            `json:"message"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// computeMGitTagHash hashes a tag object the way git hashes its tags,
+// with the tagger's pubkey. The Git tag's hash is left out, so the MGit
+// hash depends only on what the tag says.
+func computeMGitTagHash(tag *MTagStruct) string {
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "object %s\ntype %s\ntag %s\n", tag.Object, tag.ObjectType, tag.Name)
+	if tag.Tagger != nil {
+		fmt.Fprintf(hasher, "tagger %s <%s> %d %s\n", tag.Tagger.Name, tag.Tagger.Email, tag.Tagger.When.Unix(), tag.Tagger.Pubkey)
+	}
+	fmt.Fprintf(hasher, "\n%s", tag.Message)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// mgitTagSignatureDigest is what a tag signature signs, domain-separated
+// from commit signatures
+func mgitTagSignatureDigest(mgitHash string) [32]byte {
+	return taggedHash("mgit/tag", []byte(mgitHash))
+}
+
+// signMGitTag signs a tag's MGit hash, recording the signature in its
+// metadata. The signer's key must be the tagger's pubkey.
+func signMGitTag(signer Signer, tag *MTagStruct) error {
+	if tag.Tagger == nil || tag.Tagger.Pubkey == "" {
+		return fmt.Errorf("tag has no tagger pubkey to sign with")
+	}
+	taggerKey, err := decodeNostrKey(tag.Tagger.Pubkey, "npub")
+	if err != nil {
+		return fmt.Errorf("tagger pubkey: %w", err)
+	}
+	signerKey, err := signer.PublicKey()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(signerKey, taggerKey) {
+		return fmt.Errorf("signing key %s is not the tagger pubkey %s", encodeNpub(signerKey), tag.Tagger.Pubkey)
+	}
+
+	sig, err := signer.Sign(mgitTagSignatureDigest(tag.MGitHash))
+	if err != nil {
+		return err
+	}
+	if tag.Metadata == nil {
+		tag.Metadata = map[string]string{}
+	}
+	tag.Metadata["signature"] = hex.EncodeToString(sig)
+	return nil
+}
+
+// verifyMGitTag checks a tag object's hash and the signature recorded on
+// it, if any. signed reports whether there was one.
+func verifyMGitTag(tag *MTagStruct) (signed bool, err error) {
+	sigHex := tag.Metadata["signature"]
+	if computed := computeMGitTagHash(tag); computed != tag.MGitHash {
+		return sigHex != "", fmt.Errorf("tag object hashes to %s, not %s", shortHash(computed), shortHash(tag.MGitHash))
+	}
+	if sigHex == "" {
+		return false, nil
+	}
+	if tag.Tagger == nil || tag.Tagger.Pubkey == "" {
+		return true, fmt.Errorf("signed tag has no tagger pubkey")
+	}
+	pubkey, err := decodeNostrKey(tag.Tagger.Pubkey, "npub")
+	if err != nil {
+		return true, err
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return true, fmt.Errorf("malformed signature")
+	}
+	if !schnorrVerify(pubkey, mgitTagSignatureDigest(tag.MGitHash), sig) {
+		return true, fmt.Errorf("bad signature")
+	}
+	return true, nil
+}
+
+// StoreTag stores an MGit tag object
+func (s *MGitStorage) StoreTag(tag *MTagStruct) error {
+	if !isMGitHash(tag.MGitHash) {
+		return fmt.Errorf("invalid MGit tag hash %q", tag.MGitHash)
+	}
+	tag.Type = MGitTagObject
+	data, err := json.MarshalIndent(tag, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal tag: %w", err)
+	}
+	path := mgitObjectPath(s.RootDir, tag.MGitHash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write tag object: %w", err)
+	}
+	return nil
+}
+
+// GetTag reads an MGit tag object by its full hash or a prefix
+func (s *MGitStorage) GetTag(mgitHash string) (*MTagStruct, error) {
+	if len(mgitHash) < 40 {
+		matches, err := s.findObjectByPrefix(mgitHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) != 1 {
+			return nil, fmt.Errorf("no single object with hash prefix %s", mgitHash)
+		}
+		mgitHash = matches[0]
+	}
+	if !isMGitHash(mgitHash) {
+		return nil, fmt.Errorf("invalid MGit hash %q", mgitHash)
+	}
+	data, err := readMGitObject(s.RootDir, mgitHash)
+	if err != nil {
+		return nil, fmt.Errorf("tag object not found: %s", mgitHash)
+	}
+	var tag MTagStruct
+	if err := json.Unmarshal(data, &tag); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tag: %w", err)
+	}
+	if tag.Type != MGitTagObject {
+		return nil, fmt.Errorf("object %s is not a tag", shortHash(mgitHash))
+	}
+	return &tag, nil
+}
+
+// peelMGitObject returns the commit an MGit hash names, following tag
+// objects to the commit they tag
+func peelMGitObject(storage *MGitStorage, hash string) (*MCommitStruct, error) {
+	for depth := 0; depth < 10; depth++ {
+		tag, err := storage.GetTag(hash)
+		if err != nil {
+			return storage.GetCommit(hash)
+		}
+		hash = tag.Object
+	}
+	return nil, fmt.Errorf("tag %s nests too deep", shortHash(hash))
+}
+
+// mgitTagRef returns the MGit hash refs/tags/<name> holds
+func mgitTagRef(storage *MGitStorage, name string) (string, error) {
+	hash, err := storage.GetRef("refs/tags/" + name)
+	if err != nil {
+		return "", fmt.Errorf("tag '%s' not found", name)
+	}
+	return strings.TrimSpace(hash), nil
+}
+
+// listMGitTags returns the names of the tags under .mgit/refs/tags, sorted
+func listMGitTags(storage *MGitStorage) []string {
+	names := []string{}
+	root := filepath.Join(storage.RootDir, "refs", "tags")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name, _ := filepath.Rel(root, path)
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+// HandleTag handles the tag command:
+//
+//	mgit tag [-l] [<pattern>...]                       list tags
+//	mgit tag [-a | -s] [-f] [-m <msg>] <name> [<rev>]  create a tag
+//	mgit tag -d <name>...                              delete tags
+//	mgit tag -v <name>...                              verify annotated tags
+func HandleTag(args []string) {
+	mode := ""
+	annotate := false
+	sign := GetConfigBool("tag.sign", false)
+	force := false
+	message := ""
+	hasMessage := false
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-l" || arg == "--list":
+			mode = "list"
+		case arg == "-d" || arg == "--delete":
+			mode = "delete"
+		case arg == "-v" || arg == "--verify":
+			mode = "verify"
+		case arg == "-a" || arg == "--annotate":
+			annotate = true
+		case arg == "-s" || arg == "--sign":
+			annotate, sign = true, true
+		case arg == "--no-sign":
+			sign = false
+		case arg == "-f" || arg == "--force":
+			force = true
+		case arg == "-m" || arg == "--message":
+			if i+1 >= len(args) {
+				fmt.Println("Error: -m needs a message")
+				os.Exit(1)
+			}
+			i++
+			message, hasMessage, annotate = args[i], true, true
+		case strings.HasPrefix(arg, "--message="):
+			message, hasMessage, annotate = strings.TrimPrefix(arg, "--message="), true, true
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			fmt.Printf("Error: unknown option %s\n", arg)
+			printTagUsage()
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	storage := NewMGitStorage()
+	if mode == "" && len(positional) == 0 {
+		mode = "list"
+	}
+	switch mode {
+	case "list":
+		for _, name := range listMGitTags(storage) {
+			if matchesAnyPattern(name, positional) {
+				fmt.Println(name)
+			}
+		}
+		return
+	case "delete":
+		if len(positional) == 0 {
+			printTagUsage()
+			os.Exit(1)
+		}
+		failed := false
+		for _, name := range positional {
+			if err := deleteMGitTag(getRepo(), storage, name); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	case "verify":
+		if len(positional) == 0 {
+			printTagUsage()
+			os.Exit(1)
+		}
+		valid := true
+		for _, name := range positional {
+			valid = verifyTagByName(storage, name) && valid
+		}
+		if !valid {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(positional) > 2 {
+		printTagUsage()
+		os.Exit(1)
+	}
+	name := positional[0]
+	rev := "HEAD"
+	if len(positional) == 2 {
+		rev = positional[1]
+	}
+	if err := plumbing.ReferenceName("refs/tags/" + name).Validate(); err != nil {
+		fmt.Printf("Error: '%s' is not a valid tag name\n", name)
+		os.Exit(1)
+	}
+	if _, err := mgitTagRef(storage, name); err == nil && !force {
+		fmt.Printf("Error: tag '%s' already exists\n", name)
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	commit, err := resolveMGitRevision(repo, storage, rev)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if !annotate {
+		if err := createGitTag(repo, name, commit, nil, force); err != nil {
+			fmt.Printf("Warning: no Git tag was made: %s\n", err)
+		}
+		if err := storage.UpdateRef("refs/tags/"+name, commit.MGitHash); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !hasMessage {
+		if message, err = editTagMessage(name); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+
+	userName := GetConfigValue("user.name", "")
+	userEmail := GetConfigValue("user.email", "")
+	tagger := &MGitSignature{
+		Name:   envOr("GIT_COMMITTER_NAME", userName),
+		Email:  envOr("GIT_COMMITTER_EMAIL", userEmail),
+		Pubkey: GetNostrPubKey(),
+		When:   time.Now().Truncate(time.Second),
+	}
+	if tagger.Name == "" || tagger.Email == "" {
+		fmt.Println("Please set your user name and email first:")
+		fmt.Println("  mgit config --global user.name \"Your Name\"")
+		fmt.Println("  mgit config --global user.email \"your.email@example.com\"")
+		os.Exit(1)
+	}
+
+	// Open the signer first, so a missing device or wrong key stops the
+	// tag before anything is written
+	var signer Signer
+	if sign {
+		if signer, err = openCommitSigner(tagger.Pubkey); err != nil {
+			fmt.Printf("Error: cannot sign tag: %s\n", err)
+			os.Exit(1)
+		}
+		defer signer.Close()
+	}
+
+	tag := &MTagStruct{
+		Type:       MGitTagObject,
+		Object:     commit.MGitHash,
+		ObjectType: MGitCommitObject,
+		Name:       name,
+		Tagger:     tagger,
+		Message:    message,
+	}
+	tag.MGitHash = computeMGitTagHash(tag)
+	if signer != nil {
+		if err := signMGitTag(signer, tag); err != nil {
+			fmt.Printf("Error: cannot sign tag: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := createGitTag(repo, name, commit, tag, force); err != nil {
+		fmt.Printf("Warning: no Git tag was made: %s\n", err)
+	}
+	if err := storage.StoreTag(tag); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if err := storage.UpdateRef("refs/tags/"+name, tag.MGitHash); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	recordHashIndex(storage, "-", tag.MGitHash)
+}
+
+func printTagUsage() {
+	fmt.Println("Usage: mgit tag [-l] [<pattern>...]")
+	fmt.Println("       mgit tag [-a | -s] [-f] [-m <msg>] <name> [<commit>]")
+	fmt.Println("       mgit tag -d <name>...")
+	fmt.Println("       mgit tag -v <name>...")
+}
+
+// matchesAnyPattern reports whether name matches one of the glob patterns,
+// or there are none
+func matchesAnyPattern(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// createGitTag makes the Git tag beside an MGit tag, annotated when tag is
+// set, so Git tools and remotes see it too
+func createGitTag(repo *git.Repository, name string, commit *MCommitStruct, tag *MTagStruct, force bool) error {
+	if commit.GitHash == "" {
+		return fmt.Errorf("commit %s has no Git commit", shortHash(commit.MGitHash))
+	}
+	target := plumbing.NewHash(commit.GitHash)
+	if _, err := repo.CommitObject(target); err != nil {
+		return fmt.Errorf("Git commit %s is missing", shortHash(commit.GitHash))
+	}
+	if force {
+		if err := repo.DeleteTag(name); err != nil && err != git.ErrTagNotFound {
+			return err
+		}
+	}
+
+	var opts *git.CreateTagOptions
+	if tag != nil {
+		opts = &git.CreateTagOptions{
+			Tagger:  &object.Signature{Name: tag.Tagger.Name, Email: tag.Tagger.Email, When: tag.Tagger.When},
+			Message: tag.Message,
+		}
+	}
+	ref, err := repo.CreateTag(name, target, opts)
+	if err != nil {
+		return err
+	}
+	if tag != nil {
+		tag.GitHash = ref.Hash().String()
+	}
+	return nil
+}
+
+// deleteMGitTag removes a tag's MGit ref and its Git tag. The tag object,
+// if any, stays, as in git.
+func deleteMGitTag(repo *git.Repository, storage *MGitStorage, name string) error {
+	hash, err := mgitTagRef(storage, name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(storage.RootDir, "refs", "tags", filepath.FromSlash(name))); err != nil {
+		return fmt.Errorf("failed to delete tag '%s': %w", name, err)
+	}
+	if err := repo.DeleteTag(name); err != nil && err != git.ErrTagNotFound {
+		fmt.Printf("Warning: Git tag '%s' was not deleted: %s\n", name, err)
+	}
+	fmt.Printf("Deleted tag '%s' (was %s)\n", name, shortHash(hash))
+	return nil
+}
+
+// verifyTagByName checks a tag's object and signature, printing the result
+func verifyTagByName(storage *MGitStorage, name string) bool {
+	hash, err := mgitTagRef(storage, name)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return false
+	}
+	tag, err := storage.GetTag(hash)
+	if err != nil {
+		fmt.Printf("Error: %s is a lightweight tag, with nothing to verify\n", name)
+		return false
+	}
+	signed, err := verifyMGitTag(tag)
+	switch {
+	case err != nil:
+		fmt.Printf("Tag %s: %s\n", name, err)
+		return false
+	case !signed:
+		fmt.Printf("Tag %s is not signed\n", name)
+		return false
+	}
+	fmt.Printf("Tag %s: good signature from %s\n", name, tag.Tagger.Pubkey)
+	return true
+}
+
+// editTagMessage has the user write a tag message in their editor
+func editTagMessage(name string) (string, error) {
+	path := filepath.Join(mgitDir(), "TAG_EDITMSG")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(tagEditHelp, name)), 0644); err != nil {
+		return "", err
+	}
+	if err := runEditor(path); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	message := stripCommentLines(string(data))
+	if message == "" {
+		return "", fmt.Errorf("no tag message")
+	}
+	return message, nil
+}
+
+// printMGitTag prints an annotated tag the way show does before the
+// commit it tags
+func printMGitTag(tag *MTagStruct) {
+	fmt.Printf("tag %s\n", tag.Name)
+	fmt.Printf("mgit-tag %s\n", tag.MGitHash)
+	if tag.Tagger != nil {
+		pubkeyInfo := ""
+		if tag.Tagger.Pubkey != "" {
+			pubkeyInfo = fmt.Sprintf(" <%s>", tag.Tagger.Pubkey)
+		}
+		fmt.Printf("Tagger: %s <%s>%s\n", tag.Tagger.Name, tag.Tagger.Email, pubkeyInfo)
+		fmt.Printf("Date:   %s\n", tag.Tagger.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+	}
+	switch signed, err := verifyMGitTag(tag); {
+	case err != nil:
+		fmt.Printf("Signature: bad (%s)\n", err)
+	case signed:
+		fmt.Println("Signature: good")
+	default:
+		fmt.Println("Signature: none")
+	}
+	fmt.Printf("Target: %s %s\n", tag.ObjectType, tag.Object)
+	fmt.Println()
+	for _, line := range strings.Split(strings.TrimRight(tag.Message, "\n"), "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+	fmt.Println()
+}
+
+// showTagFor prints the annotated tag rev names, by name or MGit hash, if
+// it names one, followed by any tags that tag tags in turn
+func showTagFor(storage *MGitStorage, rev string) {
+	name := strings.TrimPrefix(rev, "refs/tags/")
+	if name == rev {
+		// A branch of the same name wins, as in resolveMGitRevision
+		if _, err := storage.GetRef("refs/heads/" + rev); err == nil {
+			return
+		}
+	}
+	hash, err := mgitTagRef(storage, name)
+	if err != nil {
+		if !isHashPrefix(rev) {
+			return
+		}
+		hash = rev
+	}
+	for depth := 0; depth < 10; depth++ {
+		tag, err := storage.GetTag(hash)
+		if err != nil {
+			return
+		}
+		printMGitTag(tag)
+		hash = tag.Object
+	}
+}
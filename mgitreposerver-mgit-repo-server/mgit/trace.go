@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing is switched on with MGIT_TRACE: "1" or "true" writes to stderr,
+// an absolute path appends to that file. Each event is one JSON object per
+// line, so traces can be filtered with jq and compared between runs:
+//
+//	{"time":"...","span":"storage.get_commit","ms":0.21,"hash":"4f9c..."}
+//
+// Spans are timed operations; events without "ms" are points in time.
+var (
+	traceOnce   sync.Once
+	traceMu     sync.Mutex
+	traceWriter io.Writer
+)
+
+// tracer returns where trace events go, or nil when tracing is off
+func tracer() io.Writer {
+	traceOnce.Do(func() {
+		value := os.Getenv("MGIT_TRACE")
+		switch strings.ToLower(value) {
+		case "", "0", "false", "no", "off":
+			return
+		case "1", "2", "true", "yes", "on":
+			traceWriter = os.Stderr
+			return
+		}
+		if !filepath.IsAbs(value) {
+			fmt.Fprintf(os.Stderr, "Warning: MGIT_TRACE must be 1 or an absolute path, tracing to stderr\n")
+			traceWriter = os.Stderr
+			return
+		}
+		file, err := os.OpenFile(value, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot open trace file %s: %s\n", value, err)
+			return
+		}
+		traceWriter = file
+	})
+	return traceWriter
+}
+
+// traceSpan is a timed operation being traced. A nil span, which
+// startSpan returns when tracing is off, ignores everything.
+type traceSpan struct {
+	name  string
+	start time.Time
+	attrs map[string]interface{}
+}
+
+// startSpan starts timing an operation. attrs are key, value pairs.
+func startSpan(name string, attrs ...interface{}) *traceSpan {
+	if tracer() == nil {
+		return nil
+	}
+	span := &traceSpan{name: name, start: time.Now(), attrs: map[string]interface{}{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		span.attrs[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+	return span
+}
+
+// Set records an attribute of the span
+func (s *traceSpan) Set(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// End writes the span with its duration. An error is recorded with it.
+func (s *traceSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.attrs["error"] = err.Error()
+	}
+	elapsed := time.Since(s.start)
+	writeTraceEvent("span", s.name, float64(elapsed.Microseconds())/1000, s.attrs)
+}
+
+// traceEvent writes a point-in-time event
+func traceEvent(name string, attrs ...interface{}) {
+	if tracer() == nil {
+		return
+	}
+	fields := map[string]interface{}{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		fields[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+	writeTraceEvent("event", name, -1, fields)
+}
+
+// writeTraceEvent writes one trace line. The fixed fields are written
+// first so the lines line up when read by eye.
+func writeTraceEvent(kind, name string, ms float64, attrs map[string]interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"time":%q,%q:%q`, time.Now().Format(time.RFC3339Nano), kind, name)
+	if ms >= 0 {
+		fmt.Fprintf(&b, `,"ms":%.3f`, ms)
+	}
+	if len(attrs) > 0 {
+		data, err := json.Marshal(attrs)
+		if err == nil && len(data) > 2 {
+			b.WriteString(",")
+			b.Write(data[1 : len(data)-1])
+		}
+	}
+	b.WriteString("}\n")
+
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	io.WriteString(tracer(), b.String())
+}
+
+// tracingTransport traces each HTTP request made through it
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip times a request up to the response headers; bodies are
+// streamed afterwards and their reading is traced by the caller's span
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := *req.URL
+	url.RawQuery = ""
+	span := startSpan("http", "method", req.Method, "url", url.String())
+	if req.ContentLength > 0 {
+		span.Set("request_bytes", req.ContentLength)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { span.Set("reused", info.Reused) },
+	}))
+	resp, err := t.next.RoundTrip(req)
+	if resp != nil {
+		span.Set("status", resp.StatusCode)
+		span.Set("proto", resp.Proto)
+		if resp.ContentLength >= 0 {
+			span.Set("response_bytes", resp.ContentLength)
+		}
+	}
+	span.End(err)
+	return resp, err
+}
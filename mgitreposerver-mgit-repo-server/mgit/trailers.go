@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// trailer is one "Key: value" line of a commit message's trailer block
+type trailer struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// signoffKey is the trailer --signoff adds
+const signoffKey = "Signed-off-by"
+
+// trailerLine matches the first line of a trailer. Keys are letters, digits
+// and dashes, as in git.
+var trailerLine = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)\s*:\s?(.*)$`)
+
+// signoffValue matches "Name <email>" with an optional "(npub1...)"
+var signoffValue = regexp.MustCompile(`^(.*?)\s*<([^>]*)>\s*(?:\((npub1[0-9a-z]+)\))?\s*$`)
+
+// parseTrailers returns the trailers of a commit message: the lines of its
+// last paragraph, if that paragraph consists of trailers only. Lines that
+// start with whitespace continue the previous trailer's value.
+func parseTrailers(message string) []trailer {
+	block, _ := trailerBlock(message)
+	return block
+}
+
+// trailerBlock splits off the trailer block of a message, returning the
+// trailers and the message without them
+func trailerBlock(message string) ([]trailer, string) {
+	body := strings.TrimRight(message, "\n")
+	start := strings.LastIndex(body, "\n\n")
+	if start < 0 {
+		// A message that is all trailers has no subject to hang them on
+		return nil, message
+	}
+
+	trailers := []trailer{}
+	for _, line := range strings.Split(body[start+2:], "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(trailers) > 0 {
+			last := &trailers[len(trailers)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		match := trailerLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, message
+		}
+		trailers = append(trailers, trailer{Key: match[1], Value: strings.TrimSpace(match[2])})
+	}
+	return trailers, body[:start]
+}
+
+// addTrailer appends a trailer to a message, starting a trailer block if
+// there is none. Like git, it doesn't add a trailer identical to the last
+// one, so signing off twice leaves one sign-off.
+func addTrailer(message, key, value string) string {
+	trailers, rest := trailerBlock(message)
+	if n := len(trailers); n > 0 && strings.EqualFold(trailers[n-1].Key, key) && trailers[n-1].Value == value {
+		return message
+	}
+	trailers = append(trailers, trailer{Key: key, Value: value})
+
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(rest, "\n"))
+	b.WriteString("\n\n")
+	for _, t := range trailers {
+		fmt.Fprintf(&b, "%s: %s\n", t.Key, t.Value)
+	}
+	return b.String()
+}
+
+// signoffTrailer formats a sign-off: "Name <email> (npub1...)", without the
+// pubkey when there is none
+func signoffTrailer(sig *Signature) string {
+	value := fmt.Sprintf("%s <%s>", sig.Name, sig.Email)
+	if sig.Pubkey != "" {
+		value += fmt.Sprintf(" (%s)", sig.Pubkey)
+	}
+	return value
+}
+
+// parseSignoff splits a sign-off value into the identity and pubkey it
+// names. The pubkey is empty for plain git sign-offs.
+func parseSignoff(value string) (name, email, pubkey string, ok bool) {
+	match := signoffValue.FindStringSubmatch(value)
+	if match == nil {
+		return "", "", "", false
+	}
+	return match[1], match[2], match[3], true
+}
+
+// trailerValues returns the values of the trailers with a key, compared
+// case-insensitively as git does
+func trailerValues(trailers []trailer, key string) []string {
+	values := []string{}
+	for _, t := range trailers {
+		if strings.EqualFold(t.Key, key) {
+			values = append(values, t.Value)
+		}
+	}
+	return values
+}
+
+// HandleInterpretTrailers handles the interpret-trailers command, which
+// adds trailers to a message or, for tools, extracts them. The message is
+// read from a file or stdin.
+//
+//	--trailer <key>=<value>  add a trailer (also <key>:<value>)
+//	--parse                  print only the trailers, one per line
+//	--json                   print the trailers as JSON, with sign-offs
+//	                         split into name, email and pubkey
+func HandleInterpretTrailers(args []string) {
+	parse := false
+	asJSON := false
+	added := []trailer{}
+	files := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--parse":
+			parse = true
+		case arg == "--json":
+			asJSON = true
+		case arg == "--trailer" && i+1 < len(args):
+			i++
+			sep := strings.IndexAny(args[i], "=:")
+			if sep <= 0 {
+				fmt.Printf("Error: invalid trailer %q, expected <key>=<value>\n", args[i])
+				os.Exit(1)
+			}
+			added = append(added, trailer{Key: strings.TrimSpace(args[i][:sep]), Value: strings.TrimSpace(args[i][sep+1:])})
+		case strings.HasPrefix(arg, "-"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		default:
+			files = append(files, arg)
+		}
+	}
+
+	var data []byte
+	var err error
+	switch len(files) {
+	case 0:
+		data, err = io.ReadAll(os.Stdin)
+	case 1:
+		data, err = os.ReadFile(files[0])
+	default:
+		fmt.Println("Usage: mgit interpret-trailers [--parse | --json] [--trailer <key>=<value>]... [<file>]")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error reading message: %s\n", err)
+		os.Exit(1)
+	}
+
+	message := string(data)
+	for _, t := range added {
+		message = addTrailer(message, t.Key, t.Value)
+	}
+
+	switch {
+	case asJSON:
+		type signoff struct {
+			Name   string `json:"name"`
+			Email  string `json:"email"`
+			Pubkey string `json:"pubkey,omitempty"`
+		}
+		out := struct {
+			Trailers []trailer `json:"trailers"`
+			Signoffs []signoff `json:"signoffs"`
+		}{Trailers: parseTrailers(message), Signoffs: []signoff{}}
+		if out.Trailers == nil {
+			out.Trailers = []trailer{}
+		}
+		for _, value := range trailerValues(out.Trailers, signoffKey) {
+			if name, email, pubkey, ok := parseSignoff(value); ok {
+				out.Signoffs = append(out.Signoffs, signoff{Name: name, Email: email, Pubkey: pubkey})
+			}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(out)
+	case parse:
+		for _, t := range parseTrailers(message) {
+			fmt.Printf("%s: %s\n", t.Key, t.Value)
+		}
+	default:
+		fmt.Print(message)
+	}
+}
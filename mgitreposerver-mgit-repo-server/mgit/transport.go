@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// pinPrefix is the prefix used for public key pins, matching the format of
+// curl's --pinnedpubkey and git's http.pinnedPubkey
+const pinPrefix = "sha256//"
+
+// acceptEncoding lists the content encodings mgit can decode
+const acceptEncoding = "gzip, deflate"
+
+// PinMismatchError is returned when a server presents a certificate whose
+// public key does not match any of the pins configured for the remote
+type PinMismatchError struct {
+	Host     string
+	Remote   string
+	Actual   string
+	Expected []string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("certificate pinning failed for %s (remote %q): server presented %s, expected %s. "+
+		"If the server certificate was legitimately replaced, update remote.%s.pinnedPubkey",
+		e.Host, e.Remote, e.Actual, strings.Join(e.Expected, " or "), e.Remote)
+}
+
+// httpClients holds one client per remote, so the metadata and pack
+// transports share its pooled connections instead of paying for a TCP and
+// TLS handshake on every request
+var (
+	httpClientsMu sync.Mutex
+	httpClients   = map[string]*http.Client{}
+)
+
+// newHTTPClient returns the HTTP client for talking to the mgit server
+// behind the given remote, honoring http.sslCAInfo, http.sslVerify and
+// remote.<name>.pinnedPubkey. It is built once per remote and shared.
+func newHTTPClient(remoteName string) (*http.Client, error) {
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+	if client, ok := httpClients[remoteName]; ok {
+		return client, nil
+	}
+
+	tlsConfig, err := tlsConfigForRemote(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := pooledTransport(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: transport}
+	if tracer() != nil {
+		client.Transport = &tracingTransport{next: transport}
+	}
+	httpClients[remoteName] = client
+	return client, nil
+}
+
+// forgetHTTPClient drops the shared client of a remote, so the next one is
+// built with its current TLS settings
+func forgetHTTPClient(remoteName string) {
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+	if client, ok := httpClients[remoteName]; ok {
+		client.CloseIdleConnections()
+		delete(httpClients, remoteName)
+	}
+}
+
+// pooledTransport builds a keep-alive transport that negotiates HTTP/2
+// when the server offers it. Its limits come from the config:
+//
+//	http.version          HTTP/2 (the default) or HTTP/1.1
+//	http.maxConnsPerHost  connections per server, 0 for no limit (default)
+//	http.maxIdleConns     idle connections kept per server (default 4)
+//	http.idleTimeout      seconds an idle connection is kept (default 90)
+func pooledTransport(tlsConfig *tls.Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	switch version := GetConfigValue("http.version", "HTTP/2"); version {
+	case "HTTP/2":
+		// A custom TLS config turns HTTP/2 off unless it is asked for
+		transport.ForceAttemptHTTP2 = true
+	case "HTTP/1.1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	default:
+		return nil, fmt.Errorf("http.version must be HTTP/2 or HTTP/1.1, not %q", version)
+	}
+
+	transport.MaxIdleConnsPerHost = 4
+	for _, limit := range []struct {
+		key   string
+		value *int
+	}{
+		{"http.maxConnsPerHost", &transport.MaxConnsPerHost},
+		{"http.maxIdleConns", &transport.MaxIdleConnsPerHost},
+	} {
+		n, err := strconv.Atoi(GetConfigValue(limit.key, strconv.Itoa(*limit.value)))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a number of connections", limit.key)
+		}
+		*limit.value = n
+	}
+
+	seconds, err := strconv.Atoi(GetConfigValue("http.idleTimeout", strconv.Itoa(int(transport.IdleConnTimeout/time.Second))))
+	if err != nil || seconds < 0 {
+		return nil, fmt.Errorf("http.idleTimeout must be a number of seconds")
+	}
+	transport.IdleConnTimeout = time.Duration(seconds) * time.Second
+	return transport, nil
+}
+
+// tlsConfigForRemote builds the TLS configuration for a remote
+func tlsConfigForRemote(remoteName string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	// Trust an additional CA bundle, typically the self-signed cert of an Umbrel
+	if caFile := GetConfigValue("http.sslCAInfo", ""); caFile != "" {
+		caFile = expandHomePath(caFile)
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading http.sslCAInfo file %s: %w", caFile, err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no PEM certificates found in http.sslCAInfo file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if !GetConfigBool("http.sslVerify", true) {
+		fmt.Println("Warning: TLS certificate verification is disabled (http.sslVerify=false)")
+		config.InsecureSkipVerify = true
+	}
+
+	pins := getRemotePins(remoteName)
+	proven := identityPin(remoteName)
+	if len(pins) == 0 && proven == "" {
+		return config, nil
+	}
+
+	// A matching pin is a stronger guarantee than the CA chain, so a pinned
+	// self-signed certificate is accepted without a CA. The key a server
+	// proved its identity on is checked on top of the chain, not instead.
+	if len(pins) > 0 {
+		config.InsecureSkipVerify = true
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("certificate pinning failed for %s: server presented no certificate", state.ServerName)
+		}
+
+		actual := publicKeyPin(state.PeerCertificates[0])
+		if proven != "" && actual != proven {
+			return fmt.Errorf("certificate pinning failed for %s (remote %q): server presented %s, not %s, on which it proved its identity",
+				state.ServerName, remoteName, actual, proven)
+		}
+		if len(pins) == 0 {
+			return nil
+		}
+		for _, pin := range pins {
+			if pin == actual {
+				return nil
+			}
+		}
+
+		return &PinMismatchError{
+			Host:     state.ServerName,
+			Remote:   remoteName,
+			Actual:   actual,
+			Expected: pins,
+		}
+	}
+
+	return config, nil
+}
+
+// getRemotePins returns the public key pins configured for a remote.
+// Multiple pins can be separated by ';' to allow for key rotation.
+func getRemotePins(remoteName string) []string {
+	if remoteName == "" {
+		return nil
+	}
+
+	value := GetConfigValue(fmt.Sprintf("remote.%s.pinnedPubkey", remoteName), "")
+	pins := []string{}
+	for _, pin := range strings.Split(value, ";") {
+		pin = strings.TrimSpace(pin)
+		if pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// publicKeyPin computes the sha256// pin of a certificate's public key
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validatePin checks that a pin is in the sha256//<base64> format
+func validatePin(pin string) error {
+	if !strings.HasPrefix(pin, pinPrefix) {
+		return fmt.Errorf("invalid pin %q: must start with %s", pin, pinPrefix)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+	if err != nil || len(raw) != sha256.Size {
+		return fmt.Errorf("invalid pin %q: expected a base64 encoded SHA-256 digest", pin)
+	}
+	return nil
+}
+
+// gitTLSArgs returns the -c options that apply the same TLS settings to
+// the git subprocesses used for clone and push
+func gitTLSArgs(remoteName string) []string {
+	args := []string{}
+
+	if caFile := GetConfigValue("http.sslCAInfo", ""); caFile != "" {
+		args = append(args, "-c", "http.sslCAInfo="+expandHomePath(caFile))
+	}
+
+	pins := getRemotePins(remoteName)
+	proven := identityPin(remoteName)
+	switch {
+	case len(pins) > 0:
+		// git checks the pin independently of chain verification. A proven
+		// key passed one of the pins, so these cover it.
+		args = append(args, "-c", "http.sslVerify=false", "-c", "http.pinnedPubkey="+strings.Join(pins, ";"))
+	case proven != "":
+		args = append(args, "-c", "http.pinnedPubkey="+proven)
+		if !GetConfigBool("http.sslVerify", true) {
+			args = append(args, "-c", "http.sslVerify=false")
+		}
+	case !GetConfigBool("http.sslVerify", true):
+		args = append(args, "-c", "http.sslVerify=false")
+	}
+
+	// The pack transport speaks the same protocol version as the metadata one
+	if version := GetConfigValue("http.version", ""); version != "" {
+		args = append(args, "-c", "http.version="+version)
+	}
+
+	return args
+}
+
+// installHTTPTransport makes go-git use the TLS settings of the given remote
+// for http and https operations such as pull
+func installHTTPTransport(remoteName string) error {
+	httpClient, err := newHTTPClient(remoteName)
+	if err != nil {
+		return err
+	}
+
+	transport := githttp.NewClient(httpClient)
+	client.InstallProtocol("https", transport)
+	client.InstallProtocol("http", transport)
+	return nil
+}
+
+// setAcceptEncoding advertises compressed responses. Setting the header
+// explicitly turns off Go's transparent gzip handling, so responses must be
+// read through decodedBody.
+func setAcceptEncoding(req *http.Request) {
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+}
+
+// decodedBody returns the response body decompressed according to its
+// Content-Encoding
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding gzip response: %w", err)
+		}
+		return reader, nil
+	case "deflate":
+		// RFC 9110 deflate is zlib-wrapped, but some servers send raw deflate
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading deflate response: %w", err)
+		}
+		if reader, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			return reader, nil
+		}
+		return flate.NewReader(bytes.NewReader(data)), nil
+	default:
+		return nil, fmt.Errorf("unsupported response encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// newGzipRequest creates a request whose body is gzip-compressed
+func newGzipRequest(method, url string, payload []byte) (*http.Request, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, fmt.Errorf("error compressing request body: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing request body: %w", err)
+	}
+
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	return req, nil
+}
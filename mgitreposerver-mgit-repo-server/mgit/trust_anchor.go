@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A repository's trust can be rooted in a single npub: the maintainer signs
+// a NIP-34 repository announcement naming the other maintainers, and verify
+// then requires every branch head to be covered by a commit signed by one
+// of them, i.e. to be that commit or one of its ancestors. With the MGit
+// hash chain verified below those commits, trust runs from the npub to
+// every commit on every branch.
+//
+//	verify.trustAnchor  the announcement event, a JSON file (relative to
+//	                    the top of the working tree)
+//	verify.trustRoot    the npub that must have signed it
+
+// kindRepoAnnouncement is NIP-34's repository announcement
+const kindRepoAnnouncement = 30617
+
+// trustAnchor is what a checked announcement delegates trust to
+type trustAnchor struct {
+	Root        string          // npub that signed the announcement
+	RepoID      string          // the announcement's "d" tag
+	Maintainers map[string]bool // hex pubkeys: the root and its maintainers
+}
+
+// loadTrustAnchor reads and checks an announcement event. root, if set, is
+// the npub that must have signed it.
+func loadTrustAnchor(path, root string) (*trustAnchor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var event nostrEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("%s is not a nostr event: %w", path, err)
+	}
+	if event.Kind != kindRepoAnnouncement {
+		return nil, fmt.Errorf("%s has kind %d, not a repository announcement (%d)", path, event.Kind, kindRepoAnnouncement)
+	}
+
+	pubkey, err := hex.DecodeString(event.PubKey)
+	if err != nil || len(pubkey) != 32 {
+		return nil, fmt.Errorf("announcement has an invalid pubkey")
+	}
+	claimed := event.ID
+	id, err := event.computeID()
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(id[:]) != claimed {
+		return nil, fmt.Errorf("announcement has a wrong id")
+	}
+	sig, err := hex.DecodeString(event.Sig)
+	if err != nil || !schnorrVerify(pubkey, id, sig) {
+		return nil, fmt.Errorf("announcement has a bad signature")
+	}
+	if root != "" {
+		rootKey, err := decodeNostrKey(root, "npub")
+		if err != nil {
+			return nil, fmt.Errorf("verify.trustRoot: %w", err)
+		}
+		if hex.EncodeToString(rootKey) != event.PubKey {
+			return nil, fmt.Errorf("announcement is signed by %s, not the trust root %s", encodeNpub(pubkey), encodeNpub(rootKey))
+		}
+	}
+
+	anchor := &trustAnchor{
+		Root:        encodeNpub(pubkey),
+		Maintainers: map[string]bool{event.PubKey: true},
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "d":
+			anchor.RepoID = tag[1]
+		case "maintainers":
+			for _, maintainer := range tag[1:] {
+				key, err := decodeNostrKey(maintainer, "npub")
+				if err != nil {
+					return nil, fmt.Errorf("announcement maintainer %q: %w", maintainer, err)
+				}
+				anchor.Maintainers[hex.EncodeToString(key)] = true
+			}
+		}
+	}
+	return anchor, nil
+}
+
+// delegates reports whether a commit's signature is by a maintainer
+func (a *trustAnchor) delegates(commit *MCommitStruct) bool {
+	if signed, err := verifyMGitSignature(commit); !signed || err != nil {
+		return false
+	}
+	key, err := decodeNostrKey(commit.Author.Pubkey, "npub")
+	return err == nil && a.Maintainers[hex.EncodeToString(key)]
+}
+
+// trustAnchorPath is the configured announcement file, or "" without one
+func trustAnchorPath(flag string) string {
+	path := flag
+	if path == "" {
+		path = GetConfigValue("verify.trustAnchor", "")
+	}
+	if path == "" {
+		return ""
+	}
+	path = expandHomePath(path)
+	if !filepath.IsAbs(path) && flag == "" {
+		path = filepath.Join(repoRoot(), path)
+	}
+	return path
+}
+
+// verifyTrustAnchor checks every MGit branch head against the trust anchor
+// at path, printing those not covered by a maintainer's signed commit
+func verifyTrustAnchor(storage *MGitStorage, path string) bool {
+	anchor, err := loadTrustAnchor(path, GetConfigValue("verify.trustRoot", ""))
+	if err != nil {
+		fmt.Printf("Trust anchor verification failed: %s\n", err)
+		return false
+	}
+	if GetConfigValue("verify.trustRoot", "") == "" {
+		fmt.Printf("Warning: verify.trustRoot is not set, so any announcement is accepted; this one is signed by %s\n", anchor.Root)
+	}
+
+	// Every ancestor of a maintainer's signed commit is covered
+	hashes, err := listMGitObjects(storage.RootDir)
+	if err != nil {
+		fmt.Printf("Error listing MGit objects: %s\n", err)
+		return false
+	}
+	covered := map[string]bool{}
+	queue := []string{}
+	for _, hash := range hashes {
+		commit, err := storage.GetCommit(hash)
+		if err == nil && anchor.delegates(commit) {
+			queue = append(queue, hash)
+		}
+	}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if covered[hash] {
+			continue
+		}
+		covered[hash] = true
+		if commit, err := storage.GetCommit(hash); err == nil {
+			queue = append(queue, commit.ParentHashes...)
+		}
+	}
+
+	heads := mgitBranchesByHash(storage)
+	names := []string{}
+	byName := map[string]string{}
+	for hash, branches := range heads {
+		for _, branch := range branches {
+			names = append(names, branch)
+			byName[branch] = hash
+		}
+	}
+	sort.Strings(names)
+
+	valid := true
+	for _, branch := range names {
+		if !covered[byName[branch]] {
+			fmt.Printf("Branch %s (%s) is not covered by a commit signed by a maintainer of %s\n",
+				branch, shortHash(byName[branch]), anchorName(anchor))
+			valid = false
+		}
+	}
+	if valid {
+		fmt.Printf("All %d branches are covered by commits signed by the %d maintainers of %s, rooted in %s\n",
+			len(names), len(anchor.Maintainers), anchorName(anchor), shortPubkey(anchor.Root))
+	}
+	return valid
+}
+
+// anchorName names the announced repository
+func anchorName(anchor *trustAnchor) string {
+	if strings.TrimSpace(anchor.RepoID) == "" {
+		return "the announced repository"
+	}
+	return anchor.RepoID
+}
@@ -3,66 +3,94 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 // HandleUploadPack handles the upload-pack command
 // This is used by the server to serve Git repositories over HTTP
+// Without a repository argument it serves the current repository
 func HandleUploadPack(args []string) {
-	if len(args) < 1 {
-		fmt.Println("Usage: mgit upload-pack [--stateless-rpc] <repository>")
-		os.Exit(1)
+	// Check for --stateless-rpc, --advertise-refs and the requester's --pubkey
+	statelessRPC, advertiseRefs := false, false
+	pubkey := ""
+	for len(args) > 0 {
+		if args[0] == "--stateless-rpc" {
+			statelessRPC = true
+			args = args[1:]
+		} else if args[0] == "--advertise-refs" {
+			advertiseRefs = true
+			args = args[1:]
+		} else if args[0] == "--pubkey" && len(args) > 1 {
+			pubkey = args[1]
+			args = args[2:]
+		} else if strings.HasPrefix(args[0], "--pubkey=") {
+			pubkey = strings.TrimPrefix(args[0], "--pubkey=")
+			args = args[1:]
+		} else {
+			break
+		}
 	}
 
-	// Check for --stateless-rpc flag
-	statelessRPC := false
-	repoPath := args[0]
+	if len(args) > 1 {
+		fmt.Println("Usage: mgit upload-pack [--stateless-rpc] [--advertise-refs] [--pubkey <npub>] [<repository>]")
+		os.Exit(1)
+	}
 
-	if args[0] == "--stateless-rpc" {
-		statelessRPC = true
-		if len(args) < 2 {
-			fmt.Println("Usage: mgit upload-pack [--stateless-rpc] <repository>")
-			os.Exit(1)
-		}
-		repoPath = args[1]
+	repoPath := repoRoot()
+	if len(args) == 1 {
+		repoPath = args[0]
 	}
 
-	// Verify the repository exists
-	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-		fmt.Printf("Error: repository at %s does not exist\n", repoPath)
+	if _, err := servedGitDir(repoPath); err != nil {
+		fmt.Printf("Error: %s\n", err)
 		os.Exit(1)
 	}
 
-	// Check if it has a .git directory (it's a proper Git repository)
-	gitDir := filepath.Join(repoPath, ".git")
-	if _, err := os.Stat(gitDir); os.IsNotExist(err) {
-		// If no .git directory, it might be a bare repository (the repo itself is the .git dir)
-		if _, err := os.Stat(filepath.Join(repoPath, "objects")); os.IsNotExist(err) {
-			fmt.Printf("Error: %s is not a valid Git repository\n", repoPath)
-			os.Exit(1)
-		}
-		gitDir = repoPath
+	// Nothing is sent before the request is allowed; the reason goes to
+	// stderr, since stdout is the client's protocol stream
+	if err := authorizeUploadPack(repoPath, pubkey); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
 	}
 
-	// Prepare Git upload-pack arguments
-	gitArgs := []string{"upload-pack"}
+	// Prepare Git upload-pack arguments, passing on the hidden refs
+	gitArgs := []string{}
+	for _, pattern := range uploadPackHiddenRefs(repoPath) {
+		gitArgs = append(gitArgs, "-c", "uploadpack.hideRefs="+pattern)
+	}
+	gitArgs = append(gitArgs, "upload-pack")
 	if statelessRPC {
 		gitArgs = append(gitArgs, "--stateless-rpc")
 	}
+	if advertiseRefs {
+		gitArgs = append(gitArgs, "--advertise-refs")
+	}
 	gitArgs = append(gitArgs, repoPath)
 
-	// Execute git-upload-pack
-	cmd := exec.Command("git", gitArgs...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error executing git upload-pack: %s\n", err)
+	// Execute git-upload-pack within the connection limits
+	guard := startServing(servedMGitDir(filepath.Clean(repoPath)), pubkey)
+	if err := serveGit(guard, gitArgs, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error executing git upload-pack: %s\n", err)
 		os.Exit(1)
 	}
 
 	// After the standard Git upload-pack, we could add custom MGit functionality
 	// But for now, we're just forwarding to the standard Git command for compatibility
-}
\ No newline at end of file
+}
+
+// uploadPackHiddenRefs lists the uploadpack.hideRefs patterns for a
+// repository: the server's, from its environment and global config, then
+// the repository's own in .mgit/config, each a space-separated list. git
+// applies them as it does its own uploadpack.hideRefs: a pattern hides the
+// refs it prefixes, "!" exempts refs from an earlier pattern and "^"
+// matches the full ref name before namespaces. Hidden refs are neither
+// advertised nor fetchable, over HTTP too, where the server runs
+// upload-pack through mgit for both.
+func uploadPackHiddenRefs(repoPath string) []string {
+	patterns := strings.Fields(GetGlobalConfigValue("uploadpack.hideRefs", ""))
+	if config, err := LoadConfig(filepath.Join(servedMGitDir(filepath.Clean(repoPath)), "config")); err == nil {
+		patterns = append(patterns, strings.Fields(config.Get("uploadpack", "hideRefs"))...)
+	}
+	return patterns
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Before upload-pack serves a repository it checks, in order:
+//
+//	uploadpack.root        the repository must be inside this directory
+//	uploadpack.accessHook  a command that allows the request by exiting 0
+//	access.read            in the served repository's .mgit/config, the
+//	                       npubs that may read it ("*" for anyone); those in
+//	                       access.write may read too
+//
+// The root and the hook come from the server's environment and global
+// config only, never a local .mgit/config, so a served repository can't
+// move the root or run a command of its choosing. The ACL belongs to the
+// repository. Without a hook or an ACL a repository inside the root is
+// served to anyone, as before.
+
+// authorizeUploadPack decides whether pubkey, empty for an anonymous
+// request, may fetch the repository at repoPath
+func authorizeUploadPack(repoPath, pubkey string) error {
+	abs, err := filepath.Abs(repoPath)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+
+	if root := GetGlobalConfigValue("uploadpack.root", ""); root != "" {
+		if !insideDir(abs, expandHomePath(root)) {
+			return fmt.Errorf("%s is outside uploadpack.root", repoPath)
+		}
+	}
+
+	if hook := GetGlobalConfigValue("uploadpack.accessHook", ""); hook != "" {
+		return runUploadPackAccessHook(hook, abs, pubkey)
+	}
+
+	config, err := LoadConfig(filepath.Join(servedMGitDir(abs), "config"))
+	if err != nil {
+		return fmt.Errorf("cannot read the access list of %s: %w", repoPath, err)
+	}
+	readers := strings.Fields(config.Get("access", "read") + " " + config.Get("access", "write"))
+	if len(readers) == 0 {
+		return nil
+	}
+	if pubkeyListed(readers, pubkey) {
+		return nil
+	}
+	if pubkey == "" {
+		return fmt.Errorf("%s requires an authenticated pubkey", repoPath)
+	}
+	return fmt.Errorf("%s may not read %s", pubkey, repoPath)
+}
+
+// runUploadPackAccessHook runs uploadpack.accessHook in the shell with the
+// request in MGIT_UPLOADPACK_REPO and MGIT_UPLOADPACK_PUBKEY. Its output
+// goes to stderr, as stdout carries the pack protocol.
+func runUploadPackAccessHook(hook, repoPath, pubkey string) error {
+	span := startSpan("hook", "name", "uploadpack.accessHook")
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Env = append(os.Environ(), "MGIT_UPLOADPACK_REPO="+repoPath, "MGIT_UPLOADPACK_PUBKEY="+pubkey)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	span.End(err)
+	if err != nil {
+		reason := strings.TrimSpace(output.String())
+		if reason == "" {
+			reason = err.Error()
+		}
+		return fmt.Errorf("access denied by uploadpack.accessHook: %s", reason)
+	}
+	return nil
+}
+
+// pubkeyListed reports whether pubkey is in a list of npubs or hex keys, or
+// the list has "*"
+func pubkeyListed(list []string, pubkey string) bool {
+	want, err := decodeNostrKey(pubkey, "npub")
+	for _, entry := range list {
+		if entry == "*" {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+		if key, keyErr := decodeNostrKey(entry, "npub"); keyErr == nil && bytes.Equal(key, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// insideDir reports whether path is dir or below it, following symlinks
+// in dir
+func insideDir(path, dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// servedMGitDir is the .mgit directory of a repository upload-pack is asked
+// for, which git may name by its working tree, its .git directory or, when
+// bare, itself
+func servedMGitDir(repoPath string) string {
+	if filepath.Base(repoPath) == ".git" {
+		return filepath.Join(filepath.Dir(repoPath), ".mgit")
+	}
+	return filepath.Join(repoPath, ".mgit")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// verifyAlgoVersion names the verification rules in cache keys. Bump it
+// when verification changes so cached results from the old rules are
+// ignored.
+const verifyAlgoVersion = "1"
+
+// verifyCacheHeader starts the cache file; a file with another header is
+// from an incompatible version and is discarded
+const verifyCacheHeader = "# mgit verify cache v1"
+
+// verifyCache remembers which commits verified, keyed by everything their
+// verification depends on, so verify only redoes the work for commits that
+// are new or whose objects changed
+type verifyCache struct {
+	path    string
+	entries map[string]bool
+	added   []string
+
+	// rules is the digest of the signing rules commits are checked
+	// against, if there are any
+	rules string
+}
+
+// verifyCacheDir returns the directory of an MGit store's verification
+// cache
+func verifyCacheDir(storage *MGitStorage) string {
+	return filepath.Join(storage.RootDir, "cache", "verify")
+}
+
+// loadVerifyCache reads the verification cache. A missing or unreadable
+// cache is empty.
+func loadVerifyCache(storage *MGitStorage) *verifyCache {
+	cache := &verifyCache{
+		path:    filepath.Join(verifyCacheDir(storage), "verified"),
+		entries: map[string]bool{},
+	}
+
+	file, err := os.Open(cache.path)
+	if err != nil {
+		return cache
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != verifyCacheHeader {
+		return cache
+	}
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			cache.entries[key] = true
+		}
+	}
+	return cache
+}
+
+// key hashes the object hash, the algorithm version, the signature and
+// the rest of what verification reads from the commit, plus the signing
+// rules, so any change to them misses the cache
+func (c *verifyCache) key(commit *MCommitStruct) string {
+	pubkey := ""
+	if commit.Author != nil {
+		pubkey = commit.Author.Pubkey
+	}
+
+	h := sha256.New()
+	for _, field := range []string{
+		commit.MGitHash,
+		verifyAlgoVersion,
+		commit.Metadata["signature"],
+		commit.GitHash,
+		strings.Join(commit.ParentHashes, ","),
+		pubkey,
+	} {
+		fmt.Fprintf(h, "%s\n", field)
+	}
+	// Without rules the key is what it was before there were any
+	if c.rules != "" {
+		fmt.Fprintf(h, "signing rules %s\n", c.rules)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Has reports whether the commit verified before with the same inputs
+func (c *verifyCache) Has(commit *MCommitStruct) bool {
+	return c.entries[c.key(commit)]
+}
+
+// Add records that the commit verified
+func (c *verifyCache) Add(commit *MCommitStruct) {
+	key := c.key(commit)
+	if !c.entries[key] {
+		c.entries[key] = true
+		c.added = append(c.added, key)
+	}
+}
+
+// Save appends the commits verified since loading to the cache file
+func (c *verifyCache) Save() error {
+	if len(c.added) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	// Start a new file when there is none or it has the wrong header
+	fresh := true
+	if existing, err := os.Open(c.path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		fresh = !scanner.Scan() || scanner.Text() != verifyCacheHeader
+		existing.Close()
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if fresh {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(c.path, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	if fresh {
+		fmt.Fprintln(writer, verifyCacheHeader)
+	}
+	for _, key := range c.added {
+		fmt.Fprintln(writer, key)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	c.added = nil
+	return file.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// submoduleTrust is how far a submodule's history could be verified
+type submoduleTrust int
+
+const (
+	submoduleVerified   submoduleTrust = iota // its MGit chain verified
+	submoduleUnverified                       // there was nothing to verify
+	submoduleFailed                           // its MGit chain failed to verify
+)
+
+func (t submoduleTrust) String() string {
+	switch t {
+	case submoduleVerified:
+		return "verified"
+	case submoduleFailed:
+		return "failed"
+	default:
+		return "unverified"
+	}
+}
+
+// submoduleVerification is the outcome of verifying one submodule
+type submoduleVerification struct {
+	Path   string // relative to the top superproject
+	Commit string // the Git commit the superproject records
+	Trust  submoduleTrust
+	Reason string // why it is unverified or failed
+}
+
+// verifySubmodules verifies the MGit chain of each submodule recorded in
+// a superproject commit, from the commit the superproject pins, and then
+// of their own submodules. Submodules that aren't checked out or have no
+// .mgit store are reported as unverified.
+func verifySubmodules(repo *git.Repository, root, gitHash, prefix string, useCache bool) ([]submoduleVerification, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(gitHash))
+	if err != nil {
+		return nil, fmt.Errorf("cannot find Git commit %s: %w", gitHash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []submoduleVerification{}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Submodule {
+			continue
+		}
+
+		result := submoduleVerification{Path: path.Join(prefix, name), Commit: entry.Hash.String()}
+		dir := filepath.Join(root, filepath.FromSlash(name))
+		fmt.Printf("\nSubmodule %s (%s):\n", result.Path, shortHash(result.Commit))
+		nested, err := verifySubmodule(dir, &result, useCache)
+		if err != nil {
+			return nil, err
+		}
+		if result.Trust != submoduleVerified {
+			fmt.Printf("  %s: %s\n", result.Trust, result.Reason)
+		}
+		results = append(results, result)
+		results = append(results, nested...)
+	}
+	return results, nil
+}
+
+// verifySubmodule verifies one checked out submodule, recording the
+// outcome in result, and returns the outcomes of its own submodules
+func verifySubmodule(dir string, result *submoduleVerification, useCache bool) ([]submoduleVerification, error) {
+	subRepo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		result.Trust, result.Reason = submoduleUnverified, "not checked out"
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening submodule %s: %w", result.Path, err)
+	}
+
+	storage := &MGitStorage{RootDir: filepath.Join(dir, ".mgit")}
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		result.Trust, result.Reason = submoduleUnverified, "no .mgit store; a plain Git submodule"
+		return nil, nil
+	}
+	mgitHash, err := storage.GetMGitHashFromGit(result.Commit)
+	if err != nil {
+		result.Trust = submoduleUnverified
+		result.Reason = fmt.Sprintf("commit %s has no MGit object; fetch or checkout the submodule", shortHash(result.Commit))
+		return nil, nil
+	}
+
+	if verifyMGitHistory(subRepo, storage, mgitHash, useCache, nil) {
+		result.Trust = submoduleVerified
+	} else {
+		result.Trust, result.Reason = submoduleFailed, "MGit commit chain verification failed"
+	}
+	return verifySubmodules(subRepo, dir, result.Commit, result.Path, useCache)
+}
+
+// submoduleTrustStatus combines the outcomes of the submodules: failed if
+// any failed, unverified if any couldn't be verified, verified otherwise
+func submoduleTrustStatus(results []submoduleVerification) submoduleTrust {
+	status := submoduleVerified
+	for _, result := range results {
+		if result.Trust > status {
+			status = result.Trust
+		}
+	}
+	return status
+}
+
+// printSubmoduleSummary lists each submodule's outcome
+func printSubmoduleSummary(results []submoduleVerification) {
+	fmt.Println("\nSubmodules:")
+	for _, result := range results {
+		fmt.Printf("  %-10s  %s (%s)\n", result.Trust, result.Path, shortHash(result.Commit))
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// webDefaultPort is the port mgit web listens on unless told otherwise,
+// the same default as git instaweb
+const webDefaultPort = "1234"
+
+// webMaxFileSize is the largest file the browser shows inline
+const webMaxFileSize = 1 << 20
+
+// webServer serves a read-only view of one repository
+type webServer struct {
+	mu      sync.Mutex // go-git's object cache isn't safe for concurrent use
+	repo    *git.Repository
+	storage *MGitStorage
+	name    string
+}
+
+// webCommit is an MGit commit as the templates show it
+type webCommit struct {
+	MGitHash  string
+	GitHash   string
+	Parents   []string
+	Author    string
+	Email     string
+	Pubkey    string
+	When      time.Time
+	Committer string
+	Subject   string
+	Message   string
+	Badge     string // verified, mismatch, unsigned or missing
+}
+
+// webDiffLine is one line of a rendered diff
+type webDiffLine struct {
+	Class string
+	Text  string
+}
+
+// webTreeEntry is one entry of a directory listing
+type webTreeEntry struct {
+	Name string
+	Path string
+	Dir  bool
+	Size int64
+}
+
+// webLinks builds the URLs the pages link to. The server links to its own
+// paths; a site written by export-site links to its .html files relative
+// to the page, Root leading back up to the top of the site. A site only
+// has file pages for the commits in Trees, and no raw files.
+type webLinks struct {
+	Static bool
+	Root   string
+	Head   string
+	Trees  map[string]bool
+}
+
+// Log links to the history of a revision; a site has one for HEAD and
+// each branch
+func (l webLinks) Log(rev string) string {
+	if l.Static {
+		return l.site(siteLogPage(rev))
+	}
+	if rev == "" || rev == "HEAD" {
+		return "/"
+	}
+	return "/?rev=" + url.QueryEscape(rev)
+}
+
+// More links to a longer history; a site's histories are never cut short
+func (l webLinks) More(rev string, n int) string {
+	return "/?rev=" + url.QueryEscape(rev) + "&n=" + strconv.Itoa(n)
+}
+
+func (l webLinks) Commit(hash string) string {
+	if l.Static {
+		return l.site(siteCommitPage(hash))
+	}
+	return "/commit/" + hash
+}
+
+// Tree links to a directory or file in a commit, or is "" when a site
+// doesn't have it
+func (l webLinks) Tree(hash, filePath string, dir bool) string {
+	if !l.Static {
+		return "/tree/" + hash + "/" + filePath
+	}
+	if !l.Trees[hash] {
+		return ""
+	}
+	return l.site(siteTreePage(hash, filePath, dir))
+}
+
+func (l webLinks) Raw(hash, filePath string) string {
+	if l.Static {
+		return ""
+	}
+	return "/raw/" + hash + "/" + filePath
+}
+
+// Files links to the files of HEAD
+func (l webLinks) Files() string {
+	if !l.Static {
+		return "/tree/HEAD/"
+	}
+	return l.Tree(l.Head, "", true)
+}
+
+// site links to a page of an exported site
+func (l webLinks) site(page string) string {
+	parts := strings.Split(page, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return l.Root + strings.Join(parts, "/")
+}
+
+// HandleWeb handles the web command, which serves a small read-only web UI
+// for the repository on localhost, like git instaweb: the MGit log with
+// pubkeys and verification badges, commit diffs and a file browser.
+func HandleWeb(args []string) {
+	port := GetConfigValue("web.port", webDefaultPort)
+	bind := GetConfigValue("web.bind", "127.0.0.1")
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "--port" || arg == "-p") && i+1 < len(args):
+			i++
+			port = args[i]
+		case strings.HasPrefix(arg, "--port="):
+			port = strings.TrimPrefix(arg, "--port=")
+		case arg == "--bind" && i+1 < len(args):
+			i++
+			bind = args[i]
+		case strings.HasPrefix(arg, "--bind="):
+			bind = strings.TrimPrefix(arg, "--bind=")
+		default:
+			fmt.Println("Usage: mgit web [--port <port>] [--bind <address>]")
+			os.Exit(1)
+		}
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		fmt.Printf("Error: invalid port %s\n", port)
+		os.Exit(1)
+	}
+
+	server := &webServer{
+		repo:    getRepo(),
+		storage: NewMGitStorage(),
+		name:    repoDisplayName(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleLog)
+	mux.HandleFunc("/commit/", server.handleCommit)
+	mux.HandleFunc("/tree/", server.handleTree)
+	mux.HandleFunc("/raw/", server.handleRaw)
+
+	addr := net.JoinHostPort(bind, port)
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	fmt.Printf("Serving %s at http://%s/ (press Ctrl-C to stop)\n", server.name, addr)
+	if err := httpServer.ListenAndServe(); err != nil {
+		fmt.Printf("Error serving web UI: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// repoDisplayName names the repository after its directory
+func repoDisplayName() string {
+	root := repoRoot()
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return strings.TrimSuffix(filepath.Base(root), ".git")
+}
+
+// handleLog shows the MGit history from a revision, HEAD by default
+func (s *webServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		rev = "HEAD"
+	}
+	limit := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n > 0 {
+		limit = n
+	}
+
+	start, err := resolveMGitRevision(s.repo, s.storage, rev)
+	if err != nil {
+		s.render(w, http.StatusNotFound, "error", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	commits := s.logCommits(start, limit)
+	s.render(w, http.StatusOK, "log", map[string]interface{}{
+		"Rev":      rev,
+		"Branches": s.branches(),
+		"Commits":  commits,
+		"More":     len(commits) == limit,
+		"Next":     limit * 2,
+	})
+}
+
+// handleCommit shows one commit and its diff against its first parent
+func (s *webServer) handleCommit(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	commit, err := resolveMGitRevision(s.repo, s.storage, strings.TrimPrefix(r.URL.Path, "/commit/"))
+	if err != nil {
+		s.render(w, http.StatusNotFound, "error", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	data, err := s.commitPage(commit)
+	if err != nil {
+		s.render(w, http.StatusInternalServerError, "error", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	s.render(w, http.StatusOK, "commit", data)
+}
+
+// handleTree browses the files of a commit: /tree/<rev>/<path>
+func (s *webServer) handleTree(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	commit, tree, filePath, err := s.resolvePath(strings.TrimPrefix(r.URL.Path, "/tree/"))
+	if err != nil {
+		s.render(w, http.StatusNotFound, "error", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	name, data, err := s.treePage(commit, tree, filePath)
+	if err != nil {
+		s.render(w, http.StatusNotFound, "error", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	s.render(w, http.StatusOK, name, data)
+}
+
+// handleRaw serves a file's contents as plain bytes: /raw/<rev>/<path>
+func (s *webServer) handleRaw(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, tree, filePath, err := s.resolvePath(strings.TrimPrefix(r.URL.Path, "/raw/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := tree.File(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Never let the browser render repository content as HTML
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(contents))
+}
+
+// resolvePath splits "<rev>/<path>" and resolves the revision's tree
+func (s *webServer) resolvePath(spec string) (*MCommitStruct, *object.Tree, string, error) {
+	rev, filePath := spec, ""
+	if idx := strings.Index(spec, "/"); idx >= 0 {
+		rev, filePath = spec[:idx], strings.Trim(spec[idx+1:], "/")
+	}
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	commit, err := resolveMGitRevision(s.repo, s.storage, rev)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	gitCommit, err := s.repo.CommitObject(plumbing.NewHash(commit.GitHash))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	tree, err := gitCommit.Tree()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return commit, tree, filePath, nil
+}
+
+// logCommits prepares the MGit history from a commit, at most limit
+// commits of it, or all of it when limit is 0
+func (s *webServer) logCommits(start *MCommitStruct, limit int) []webCommit {
+	commits := []webCommit{}
+	for _, commit := range mgitRange(s.storage, []string{start.MGitHash}, nil) {
+		if limit > 0 && len(commits) == limit {
+			break
+		}
+		commits = append(commits, s.webCommit(commit))
+	}
+	return commits
+}
+
+// commitPage prepares a commit and its diff against its first parent
+func (s *webServer) commitPage(commit *MCommitStruct) (map[string]interface{}, error) {
+	lines, err := s.commitDiff(commit)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"Commit": s.webCommit(commit),
+		"Diff":   lines,
+	}, nil
+}
+
+// treePage prepares the listing of a directory, or the contents of a file,
+// in a commit's tree, and returns the template that shows it
+func (s *webServer) treePage(commit *MCommitStruct, tree *object.Tree, filePath string) (string, map[string]interface{}, error) {
+	data := map[string]interface{}{
+		"Commit": s.webCommit(commit),
+		"Path":   filePath,
+		"Crumbs": breadcrumbs(filePath),
+	}
+
+	dir := tree
+	if filePath != "" {
+		var err error
+		if dir, err = tree.Tree(filePath); err != nil {
+			file, err := tree.File(filePath)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s not found in %s", filePath, shortHash(commit.MGitHash))
+			}
+			data["Size"] = file.Size
+			if binary, _ := file.IsBinary(); binary {
+				data["Binary"] = true
+			} else if file.Size > webMaxFileSize {
+				data["TooLarge"] = true
+			} else if contents, err := file.Contents(); err == nil {
+				data["Lines"] = strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+			}
+			return "file", data, nil
+		}
+	}
+
+	entries := []webTreeEntry{}
+	for _, entry := range dir.Entries {
+		entryPath := path.Join(filePath, entry.Name)
+		item := webTreeEntry{Name: entry.Name, Path: entryPath, Dir: !entry.Mode.IsFile()}
+		if !item.Dir {
+			if size, err := dir.Size(entry.Name); err == nil {
+				item.Size = size
+			}
+		}
+		entries = append(entries, item)
+	}
+	// Directories first, like most file browsers
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Dir && !entries[j].Dir
+	})
+	data["Entries"] = entries
+	return "tree", data, nil
+}
+
+// commitDiff renders the changes a commit makes to its first parent
+func (s *webServer) commitDiff(commit *MCommitStruct) ([]webDiffLine, error) {
+	gitCommit, err := s.repo.CommitObject(plumbing.NewHash(commit.GitHash))
+	if err != nil {
+		return nil, err
+	}
+	tree, err := gitCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var parentTree *object.Tree
+	if gitCommit.NumParents() > 0 {
+		parent, err := gitCommit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := changes.Patch()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []webDiffLine{}
+	for _, line := range strings.Split(strings.TrimSuffix(patch.String(), "\n"), "\n") {
+		class := "ctx"
+		switch {
+		case strings.HasPrefix(line, "diff --git"):
+			class = "file"
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"), strings.HasPrefix(line, "index "),
+			strings.HasPrefix(line, "new file"), strings.HasPrefix(line, "deleted file"):
+			class = "meta"
+		case strings.HasPrefix(line, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(line, "+"):
+			class = "add"
+		case strings.HasPrefix(line, "-"):
+			class = "del"
+		}
+		lines = append(lines, webDiffLine{Class: class, Text: line})
+	}
+	return lines, nil
+}
+
+// webCommit prepares a commit for the templates, verifying its MGit hash
+func (s *webServer) webCommit(commit *MCommitStruct) webCommit {
+	view := webCommit{
+		MGitHash: commit.MGitHash,
+		GitHash:  commit.GitHash,
+		Parents:  commit.ParentHashes,
+		Message:  commit.Message,
+		Subject:  strings.SplitN(commit.Message, "\n", 2)[0],
+	}
+	if commit.Author != nil {
+		view.Author = commit.Author.Name
+		view.Email = commit.Author.Email
+		view.Pubkey = commit.Author.Pubkey
+		view.When = commit.Author.When
+	}
+	if commit.Committer != nil && commit.Committer.Name != view.Author {
+		view.Committer = commit.Committer.Name
+	}
+
+	expected, err := expectedMGitHash(s.repo, commit)
+	switch {
+	case err != nil:
+		view.Badge = "missing"
+	case expected.String() != commit.MGitHash:
+		view.Badge = "mismatch"
+	case view.Pubkey == "":
+		view.Badge = "unsigned"
+	default:
+		view.Badge = "verified"
+	}
+	return view
+}
+
+// branches lists the MGit branches, falling back to git's
+func (s *webServer) branches() []string {
+	names := []string{}
+	entries, err := os.ReadDir(filepath.Join(s.storage.RootDir, "refs", "heads"))
+	if err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	if len(names) == 0 {
+		if refs, err := s.repo.Branches(); err == nil {
+			refs.ForEach(func(ref *plumbing.Reference) error {
+				names = append(names, ref.Name().Short())
+				return nil
+			})
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// breadcrumbs splits a path into links to each of its directories
+func breadcrumbs(filePath string) []webTreeEntry {
+	crumbs := []webTreeEntry{}
+	if filePath == "" {
+		return crumbs
+	}
+	parts := strings.Split(filePath, "/")
+	for i, part := range parts {
+		crumbs = append(crumbs, webTreeEntry{Name: part, Path: strings.Join(parts[:i+1], "/"), Dir: i < len(parts)-1})
+	}
+	return crumbs
+}
+
+func (s *webServer) render(w http.ResponseWriter, status int, name string, data map[string]interface{}) {
+	data["Repo"] = s.name
+	data["Links"] = webLinks{}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := webTemplates.ExecuteTemplate(w, name, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error rendering %s: %s\n", name, err)
+	}
+}
+
+// shortHash abbreviates a hash to core.abbrev characters
+func shortHash(hash string) string {
+	if n := abbrevLength(); len(hash) > n {
+		return hash[:n]
+	}
+	return hash
+}
+
+// shortPubkey abbreviates an npub to its start and end
+func shortPubkey(pubkey string) string {
+	if len(pubkey) <= 20 {
+		return pubkey
+	}
+	return pubkey[:12] + "…" + pubkey[len(pubkey)-6:]
+}
+
+var webTemplates = template.Must(template.New("web").Funcs(template.FuncMap{
+	"short":  shortHash,
+	"npub":   shortPubkey,
+	"date":   func(t time.Time) string { return t.Format("2006-01-02 15:04:05 -0700") },
+	"isZero": func(t time.Time) bool { return t.IsZero() },
+	"inc":    func(i int) int { return i + 1 },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Repo}} - mgit</title>
+<style>
+body{font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;margin:0;color:#222}
+header{background:#1f2937;color:#fff;padding:.6em 1em}
+header a{color:#fff;text-decoration:none;margin-right:1em}
+main{padding:1em}
+table{border-collapse:collapse;width:100%}
+td,th{padding:.3em .6em;border-bottom:1px solid #eee;text-align:left;vertical-align:top}
+code,pre,.hash{font-family:ui-monospace,Menlo,Consolas,monospace;font-size:.9em}
+pre{margin:0}
+.badge{border-radius:3px;padding:0 .4em;font-size:.8em;color:#fff}
+.verified{background:#16a34a}.unsigned{background:#6b7280}.mismatch,.missing{background:#dc2626}
+.diff .file{background:#e5e7eb;font-weight:bold}.diff .meta{color:#6b7280}.diff .hunk{color:#7c3aed}
+.diff .add{background:#dcfce7}.diff .del{background:#fee2e2}
+.lines td.n{color:#9ca3af;text-align:right;user-select:none;width:1%}
+.lines td{border:0;padding:0 .6em}
+.muted{color:#6b7280}
+</style></head><body>
+<header><a href="{{.Links.Log ""}}"><b>{{.Repo}}</b></a><a href="{{.Links.Log ""}}">log</a>{{with .Links.Files}}<a href="{{.}}">files</a>{{end}}</header><main>
+{{end}}
+
+{{define "footer"}}</main></body></html>{{end}}
+
+{{define "badge"}}<span class="badge {{.}}" title="MGit hash {{.}}">{{.}}</span>{{end}}
+
+{{define "error"}}{{template "header" .}}<p>{{.Error}}</p>{{template "footer" .}}{{end}}
+
+{{define "log"}}{{template "header" .}}
+{{if .Branches}}<p>Branches: {{range .Branches}}<a href="{{$.Links.Log .}}">{{.}}</a> {{end}}</p>{{end}}
+<h3>History of {{.Rev}}</h3>
+<table>
+<tr><th>MGit hash</th><th>Subject</th><th>Author</th><th>Pubkey</th><th>Date</th><th></th></tr>
+{{range .Commits}}<tr>
+<td class="hash"><a href="{{$.Links.Commit .MGitHash}}">{{short .MGitHash}}</a></td>
+<td>{{.Subject}}</td>
+<td>{{.Author}}</td>
+<td class="hash" title="{{.Pubkey}}">{{npub .Pubkey}}</td>
+<td class="muted">{{date .When}}</td>
+<td>{{template "badge" .Badge}}</td>
+</tr>{{end}}
+</table>
+{{if .More}}<p><a href="{{.Links.More .Rev .Next}}">More</a></p>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "commit"}}{{template "header" .}}
+{{with .Commit}}
+<h3>{{.Subject}} {{template "badge" .Badge}}</h3>
+<table>
+<tr><th>MGit hash</th><td class="hash">{{.MGitHash}}</td></tr>
+<tr><th>Git hash</th><td class="hash">{{.GitHash}}</td></tr>
+<tr><th>Author</th><td>{{.Author}} &lt;{{.Email}}&gt;</td></tr>
+{{if .Committer}}<tr><th>Committer</th><td>{{.Committer}}</td></tr>{{end}}
+<tr><th>Pubkey</th><td class="hash">{{if .Pubkey}}{{.Pubkey}}{{else}}<span class="muted">none</span>{{end}}</td></tr>
+{{if not (isZero .When)}}<tr><th>Date</th><td>{{date .When}}</td></tr>{{end}}
+<tr><th>Parents</th><td class="hash">{{range .Parents}}<a href="{{$.Links.Commit .}}">{{short .}}</a> {{end}}</td></tr>
+{{with $.Links.Tree .MGitHash "" true}}<tr><th>Files</th><td><a href="{{.}}">browse</a></td></tr>{{end}}
+</table>
+<pre>{{.Message}}</pre>
+{{end}}
+<pre class="diff">{{range .Diff}}<div class="{{.Class}}">{{.Text}}</div>{{end}}</pre>
+{{template "footer" .}}{{end}}
+
+{{define "crumbs"}}<p class="hash"><a href="{{.Links.Tree .Commit.MGitHash "" true}}">{{short .Commit.MGitHash}}</a> / {{range .Crumbs}}{{if .Dir}}<a href="{{$.Links.Tree $.Commit.MGitHash .Path true}}">{{.Name}}</a> / {{else}}{{.Name}}{{end}}{{end}}</p>{{end}}
+
+{{define "tree"}}{{template "header" .}}
+{{template "crumbs" .}}
+<table>
+{{range .Entries}}<tr>
+<td>{{if .Dir}}📁{{else}}📄{{end}} <a href="{{$.Links.Tree $.Commit.MGitHash .Path .Dir}}">{{.Name}}</a></td>
+<td class="muted">{{if not .Dir}}{{.Size}} bytes{{end}}</td>
+</tr>{{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "file"}}{{template "header" .}}
+{{template "crumbs" .}}
+<p class="muted">{{.Size}} bytes{{with .Links.Raw .Commit.MGitHash .Path}} · <a href="{{.}}">raw</a>{{end}}</p>
+{{if .Binary}}<p>Binary file not shown.</p>
+{{else if .TooLarge}}<p>File too large to show.</p>
+{{else}}<table class="lines">{{range $i, $line := .Lines}}<tr><td class="n">{{inc $i}}</td><td><pre>{{$line}}</pre></td></tr>{{end}}</table>{{end}}
+{{template "footer" .}}{{end}}
+`))
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// workspaceRepos lists the repositories of the workspace
+const workspaceRepos = "workspace-repos"
+
+// HandleWorkspace handles the workspace command, which runs commands
+// across a set of registered repositories
+//
+//	add [<path>...]      register repositories, the current one by default
+//	remove [<path>...]   unregister repositories
+//	list                 list the registered repositories
+//	exec [--jobs=<n>] [--quiet] -- <command> [<args>...]
+func HandleWorkspace(args []string) {
+	if len(args) == 0 {
+		printWorkspaceUsage()
+	}
+	switch args[0] {
+	case "add":
+		workspaceAdd(args[1:])
+	case "remove", "rm":
+		workspaceRemove(args[1:])
+	case "list":
+		workspaceList()
+	case "exec":
+		workspaceExec(args[1:])
+	default:
+		printWorkspaceUsage()
+	}
+}
+
+func printWorkspaceUsage() {
+	fmt.Println("Usage: mgit workspace add [<path>...]")
+	fmt.Println("       mgit workspace remove [<path>...]")
+	fmt.Println("       mgit workspace list")
+	fmt.Println("       mgit workspace exec [--jobs=<n>] [--quiet] -- <command> [<args>...]")
+	os.Exit(1)
+}
+
+// workspacePaths turns command line paths into absolute repository paths,
+// the current repository when none are given
+func workspacePaths(args []string) []string {
+	if len(args) == 0 {
+		args = []string{repoRoot()}
+	}
+	paths := []string{}
+	for _, arg := range args {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// workspaceAdd registers repositories with the workspace
+func workspaceAdd(args []string) {
+	repos, err := readRepoList(workspaceRepos)
+	if err != nil {
+		fmt.Printf("Error reading workspace: %s\n", err)
+		os.Exit(1)
+	}
+	registered := map[string]bool{}
+	for _, repo := range repos {
+		registered[repo] = true
+	}
+
+	failed := false
+	for _, path := range workspacePaths(args) {
+		if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+			fmt.Printf("Error: %s is not a repository\n", path)
+			failed = true
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(path, ".mgit")); err != nil {
+			fmt.Printf("Warning: %s has no .mgit directory\n", path)
+		}
+		if registered[path] {
+			fmt.Printf("%s is already in the workspace\n", path)
+			continue
+		}
+		registered[path] = true
+		repos = append(repos, path)
+		fmt.Printf("Added %s\n", path)
+	}
+
+	if err := saveRepoList(workspaceRepos, repos); err != nil {
+		fmt.Printf("Error saving workspace: %s\n", err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// workspaceRemove unregisters repositories from the workspace
+func workspaceRemove(args []string) {
+	repos, err := readRepoList(workspaceRepos)
+	if err != nil {
+		fmt.Printf("Error reading workspace: %s\n", err)
+		os.Exit(1)
+	}
+	removed := map[string]bool{}
+	for _, path := range workspacePaths(args) {
+		removed[path] = true
+	}
+
+	kept := []string{}
+	for _, repo := range repos {
+		if removed[repo] {
+			fmt.Printf("Removed %s\n", repo)
+			delete(removed, repo)
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	for path := range removed {
+		fmt.Printf("Warning: %s is not in the workspace\n", path)
+	}
+
+	if err := saveRepoList(workspaceRepos, kept); err != nil {
+		fmt.Printf("Error saving workspace: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// workspaceList prints the registered repositories, marking those that
+// are gone
+func workspaceList() {
+	repos, err := readRepoList(workspaceRepos)
+	if err != nil {
+		fmt.Printf("Error reading workspace: %s\n", err)
+		os.Exit(1)
+	}
+	for _, repo := range repos {
+		if _, err := os.Stat(repo); err != nil {
+			fmt.Printf("%s (missing)\n", repo)
+			continue
+		}
+		fmt.Println(repo)
+	}
+}
+
+// workspaceResult is the outcome of running a command in one repository
+type workspaceResult struct {
+	Repo   string
+	Output []byte
+	Err    error
+	done   chan struct{}
+}
+
+// workspaceExec runs an mgit command in every registered repository. Each
+// runs in its own process, up to --jobs at a time; the outputs are printed
+// in registration order, followed by a one-line summary per repository.
+func workspaceExec(args []string) {
+	jobs := 1
+	quiet := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		switch {
+		case strings.HasPrefix(arg, "--jobs="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--jobs="))
+			if err != nil || n < 1 {
+				fmt.Printf("Error: invalid job count %q\n", strings.TrimPrefix(arg, "--jobs="))
+				os.Exit(1)
+			}
+			jobs = n
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		default:
+			fmt.Printf("Unknown option: %s\n", arg)
+			os.Exit(1)
+		}
+	}
+	if len(args) == 0 {
+		printWorkspaceUsage()
+	}
+
+	repos, err := readRepoList(workspaceRepos)
+	if err != nil {
+		fmt.Printf("Error reading workspace: %s\n", err)
+		os.Exit(1)
+	}
+	if len(repos) == 0 {
+		fmt.Println("No repositories in the workspace; add them with 'mgit workspace add'")
+		os.Exit(1)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	results := make([]*workspaceResult, len(repos))
+	slots := make(chan struct{}, jobs)
+	for i, repo := range repos {
+		result := &workspaceResult{Repo: repo, done: make(chan struct{})}
+		results[i] = result
+		go func() {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			defer close(result.done)
+			cmd := exec.Command(self, append([]string{"-C", result.Repo}, args...)...)
+			result.Output, result.Err = cmd.CombinedOutput()
+		}()
+	}
+
+	failed := 0
+	for _, result := range results {
+		<-result.done
+		if result.Err != nil {
+			failed++
+		}
+		if !quiet {
+			fmt.Printf("== %s\n", result.Repo)
+			os.Stdout.Write(result.Output)
+			fmt.Println()
+		}
+	}
+
+	width := 0
+	for _, repo := range repos {
+		if len(repo) > width {
+			width = len(repo)
+		}
+	}
+	fmt.Println("Summary:")
+	for _, result := range results {
+		state := "ok"
+		if result.Err != nil {
+			state = "failed"
+		}
+		fmt.Printf("  %-6s  %-*s  %s\n", state, width, result.Repo, summarizeWorkspaceOutput(args[0], result))
+	}
+	fmt.Printf("%d repositories, %d failed\n", len(results), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// summarizeWorkspaceOutput sums up what a command printed in one line:
+// the counts of changes for status, the last line otherwise, which is
+// where commands like pull and verify report their outcome
+func summarizeWorkspaceOutput(command string, result *workspaceResult) string {
+	output := strings.TrimSpace(string(result.Output))
+	if command == "status" && result.Err == nil {
+		return summarizeStatus(output)
+	}
+	if output == "" {
+		if result.Err != nil {
+			return result.Err.Error()
+		}
+		return ""
+	}
+	lines := strings.Split(output, "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// summarizeStatus counts the entries of each section of status output
+func summarizeStatus(output string) string {
+	counts := map[string]int{}
+	section := ""
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case line == "Changes to be committed:":
+			section = "staged"
+		case line == "Changes not staged for commit:":
+			section = "unstaged"
+		case line == "Untracked files:":
+			section = "untracked"
+		case strings.HasPrefix(line, "  ") && section != "":
+			counts[section]++
+		}
+	}
+
+	parts := []string{}
+	for _, section := range []string{"staged", "unstaged", "untracked"} {
+		if counts[section] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[section], section))
+		}
+	}
+	if len(parts) == 0 {
+		return "clean"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// mgit worktree checks out more branches of a repository side by side, on
+// top of git's linked worktrees. A linked worktree gets a .mgit of its own
+// for its HEAD and the state of commands in progress (merge, rebase, am,
+// bisect), with a commondir file naming the main .mgit, where the objects,
+// refs, mappings and config all worktrees share are kept:
+//
+//	main/.mgit/objects, refs, mappings, config, ...
+//	main/.mgit/HEAD
+//	labs/.mgit/commondir   -> main/.mgit
+//	labs/.mgit/HEAD
+//
+// As in git, a branch can only be checked out in one worktree at a time.
+
+// worktreeInfo is a worktree as git worktree list describes it
+type worktreeInfo struct {
+	Path     string
+	Head     plumbing.Hash
+	Branch   string // empty when detached
+	Bare     bool
+	Locked   bool
+	Prunable bool
+}
+
+// HandleWorktree handles the worktree command
+func HandleWorktree(args []string) {
+	if len(args) == 0 {
+		printWorktreeUsage()
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "add":
+		err = worktreeAdd(args[1:])
+	case "list":
+		err = worktreeList(args[1:])
+	case "remove", "prune", "lock", "unlock", "move", "repair":
+		// Nothing of these is MGit's: a worktree's .mgit lives inside it
+		cmd := newGitCommand(append([]string{"worktree"}, args...)...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if cmd.Run() != nil {
+			os.Exit(1)
+		}
+	default:
+		printWorktreeUsage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printWorktreeUsage() {
+	fmt.Println("Usage: mgit worktree add [-b <new-branch>] [--detach] <path> [<commit-ish>]")
+	fmt.Println("       mgit worktree list")
+	fmt.Println("       mgit worktree remove [--force] <worktree>")
+	fmt.Println("       mgit worktree prune | lock | unlock | move | repair ...")
+}
+
+// worktreeAdd creates a linked worktree with git and gives it its .mgit
+func worktreeAdd(args []string) error {
+	gitArgs := []string{"worktree", "add"}
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-b" || arg == "-B") && i+1 < len(args):
+			gitArgs = append(gitArgs, arg, args[i+1])
+			i++
+		case arg == "--detach" || arg == "-f" || arg == "--force" || arg == "--lock" || arg == "-q" || arg == "--quiet":
+			gitArgs = append(gitArgs, arg)
+		case strings.HasPrefix(arg, "-"):
+			printWorktreeUsage()
+			os.Exit(1)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		printWorktreeUsage()
+		os.Exit(1)
+	}
+
+	repo := getRepo()
+	storage := NewMGitStorage()
+	if _, err := os.Stat(storage.RootDir); err != nil {
+		return fmt.Errorf("not an MGit repository: %s is missing", storage.RootDir)
+	}
+	common, err := filepath.Abs(storage.RootDir)
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(positional[0])
+	if err != nil {
+		return err
+	}
+	gitArgs = append(gitArgs, path)
+
+	// A commit can be named by its MGit hash, which git doesn't know
+	if len(positional) == 2 {
+		rev := positional[1]
+		if _, err := repo.Reference(plumbing.NewBranchReferenceName(rev), true); err != nil {
+			commit, err := resolveMGitRevision(repo, storage, rev)
+			if err != nil {
+				return err
+			}
+			rev = commit.GitHash
+		}
+		gitArgs = append(gitArgs, rev)
+	}
+
+	cmd := newGitCommand(gitArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git worktree add failed")
+	}
+
+	own := filepath.Join(path, ".mgit")
+	if err := os.MkdirAll(own, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(own, "commondir"), []byte(common+"\n"), 0644); err != nil {
+		return err
+	}
+	// The worktree's checkout may lack the .gitignore naming .mgit
+	if err := addInfoExclude(repoCommonGitDir(), "/.mgit/"); err != nil {
+		return err
+	}
+
+	linked, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil {
+		return err
+	}
+	linkedStorage := &MGitStorage{RootDir: common, HeadDir: own}
+	head, err := linked.Head()
+	if err != nil {
+		return err
+	}
+	mgitHash, err := linkedStorage.GetMGitHashFromGit(head.Hash().String())
+	if err != nil {
+		fmt.Printf("Warning: %s has no MGit commit; run 'mgit checkout --reconcile' in the worktree\n", shortHash(head.Hash().String()))
+		if head.Name().IsBranch() {
+			return linkedStorage.UpdateHead(head.Name().String())
+		}
+		return nil
+	}
+	if head.Name().IsBranch() {
+		// A branch made with -b has no MGit ref yet
+		if _, err := linkedStorage.GetRef(head.Name().String()); err != nil {
+			if err := linkedStorage.UpdateRef(head.Name().String(), mgitHash); err != nil {
+				return err
+			}
+		}
+	}
+	if err := followGitHead(linked, linkedStorage); err != nil {
+		return err
+	}
+	fmt.Printf("MGit HEAD is now at %s\n", shortHash(mgitHash))
+	return nil
+}
+
+// worktreeList lists the worktrees of the repository with their commits,
+// by MGit hash where there is one
+func worktreeList(args []string) error {
+	if len(args) > 0 {
+		printWorktreeUsage()
+		os.Exit(1)
+	}
+	worktrees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+	storage := NewMGitStorage()
+
+	width := 0
+	for _, wt := range worktrees {
+		if len(wt.Path) > width {
+			width = len(wt.Path)
+		}
+	}
+	for _, wt := range worktrees {
+		line := fmt.Sprintf("%-*s  ", width, wt.Path)
+		switch {
+		case wt.Bare:
+			line += "(bare)"
+		default:
+			mgitHash, _ := storage.GetMGitHashFromGit(wt.Head.String())
+			line += displayShortHash(mgitHash, wt.Head.String())
+			if wt.Branch != "" {
+				line += " [" + wt.Branch + "]"
+			} else {
+				line += " (detached HEAD)"
+			}
+		}
+		if wt.Locked {
+			line += " locked"
+		}
+		if wt.Prunable {
+			line += " prunable"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// listWorktrees returns the worktrees of the current repository, the main
+// one first
+func listWorktrees() ([]worktreeInfo, error) {
+	out, err := newGitCommand("worktree", "list", "--porcelain").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing worktrees: %w", err)
+	}
+	worktrees := []worktreeInfo{}
+	var current *worktreeInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "worktree":
+			worktrees = append(worktrees, worktreeInfo{Path: value})
+			current = &worktrees[len(worktrees)-1]
+		case "HEAD":
+			if current != nil {
+				current.Head = plumbing.NewHash(value)
+			}
+		case "branch":
+			if current != nil {
+				current.Branch = plumbing.ReferenceName(value).Short()
+			}
+		case "bare":
+			if current != nil {
+				current.Bare = true
+			}
+		case "locked":
+			if current != nil {
+				current.Locked = true
+			}
+		case "prunable":
+			if current != nil {
+				current.Prunable = true
+			}
+		}
+	}
+	return worktrees, nil
+}
+
+// branchCheckedOutElsewhere returns the other worktree a branch is checked
+// out in, if any
+func branchCheckedOutElsewhere(branch string) string {
+	// Without linked worktrees there is nowhere else
+	if _, err := os.Stat(filepath.Join(repoCommonGitDir(), "worktrees")); err != nil {
+		return ""
+	}
+	worktrees, err := listWorktrees()
+	if err != nil || len(worktrees) < 2 {
+		return ""
+	}
+	here, err := filepath.Abs(repoRoot())
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(here); err == nil {
+		here = resolved
+	}
+	for _, wt := range worktrees {
+		path := wt.Path
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		if wt.Branch == branch && path != here {
+			return wt.Path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// switchWorktree moves the worktree and index from one commit's tree to
+// another's, touching only the paths that differ between the two. Unlike
+// go-git's Reset, it leaves untracked files (and .mgit) alone, and it
+// writes nothing if a path it would change has local modifications.
+func switchWorktree(repo *git.Repository, from, to plumbing.Hash) error {
+	fromTree, err := commitTree(repo, from)
+	if err != nil {
+		return err
+	}
+	toTree, err := commitTree(repo, to)
+	if err != nil {
+		return err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return fmt.Errorf("error comparing trees: %w", err)
+	}
+
+	root := repoRoot()
+	results := []*applyResult{}
+	dirty := []string{}
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		if change.From.TreeEntry.Mode == filemode.Submodule || change.To.TreeEntry.Mode == filemode.Submodule {
+			continue
+		}
+
+		// The worktree must hold the old version, or already the new one
+		current, err := worktreeBlobHash(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		if current != change.From.TreeEntry.Hash && current != change.To.TreeEntry.Hash {
+			dirty = append(dirty, name)
+			continue
+		}
+
+		if change.To.Name == "" {
+			results = append(results, &applyResult{Path: name, Deleted: true})
+			continue
+		}
+		blob, err := repo.BlobObject(change.To.TreeEntry.Hash)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", name, err)
+		}
+		content, err := readBlob(blob)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", name, err)
+		}
+		results = append(results, &applyResult{Path: name, Content: content, Mode: change.To.TreeEntry.Mode})
+	}
+
+	if len(dirty) > 0 {
+		sort.Strings(dirty)
+		return fmt.Errorf("your local changes to these files would be overwritten:\n  %s\nCommit or stash them first",
+			strings.Join(dirty, "\n  "))
+	}
+
+	if err := writeApplyResults(repo, results, applyOptions{Index: true}); err != nil {
+		return err
+	}
+
+	// Like git, drop directories that deleting files left empty
+	for _, result := range results {
+		if !result.Deleted {
+			continue
+		}
+		dir := filepath.Dir(filepath.Join(root, filepath.FromSlash(result.Path)))
+		for dir != root && strings.HasPrefix(dir, root) {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+	return nil
+}
+
+// commitTree returns the tree of a commit, or nil for the zero hash (an
+// unborn branch)
+func commitTree(repo *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	if hash.IsZero() {
+		return nil, nil
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// worktreeBlobHash returns the blob hash of a worktree file, or the zero
+// hash if there is none
+func worktreeBlobHash(fullPath string) (plumbing.Hash, error) {
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if info.IsDir() {
+		return plumbing.ZeroHash, fmt.Errorf("%s is a directory", fullPath)
+	}
+	return hashWorktreeFile(fullPath, info)
+}
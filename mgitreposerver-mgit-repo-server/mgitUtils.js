@@ -67,12 +67,33 @@ function getRepoDescription(repoPath) {
   return 'No description available';
 }
 
+/**
+ * Gets the summary mgit uploaded for a branch after its last push
+ * @param {string} repoPath - Path to the repository
+ * @param {string} branch - Branch name
+ * @returns {Object|null} - The summary, or null if there is none
+ */
+function getBranchSummary(repoPath, branch) {
+  const summaryPath = path.join(repoPath, '.mgit', 'summaries', encodeURIComponent(branch) + '.json');
+  try {
+    return JSON.parse(fs.readFileSync(summaryPath, 'utf8'));
+  } catch (err) {
+    return null;
+  }
+}
+
 /**
  * Gets the date of the last commit
  * @param {string} repoPath - Path to the repository
  * @returns {string} - ISO formatted date string
  */
 function getLastCommitDate(repoPath) {
+  // The default branch's summary saves walking the log
+  const summary = getBranchSummary(repoPath, getDefaultBranch(repoPath));
+  if (summary && summary.last_activity) {
+    return new Date(summary.last_activity).toISOString();
+  }
+
   try {
     // Use mgit log to get last commit date
     const output = execSync('mgit log -1 --format=%cd', { cwd: repoPath, encoding: 'utf8' });
@@ -412,6 +433,7 @@ function getNostrPubkey(repoPath, gitHash) {
 module.exports = {
   getDefaultBranch,
   getBranches,
+  getBranchSummary,
   getRepoDescription,
   getLastCommitDate,
   getRepoCreationDate,
@@ -14,7 +14,7 @@ const { bech32 } = require('bech32');
 const USERS_PATH = process.env.USERS_PATH || path.join(__dirname, '..', 'users');
 
 // nostr
-const { verifyEvent, validateEvent, getEventHash } = require('nostr-tools');
+const { verifyEvent, validateEvent, getEventHash, finalizeEvent, getPublicKey, nip19 } = require('nostr-tools');
 
 // Import security configuration
 const configureSecurity = require('./security');
@@ -31,6 +31,46 @@ const security = configureSecurity(app);
 // JWT secret key for authentication tokens
 const JWT_SECRET = process.env.JWT_SECRET || crypto.randomBytes(32).toString('hex');
 
+// The server's own nostr key, hex or nsec. Clients that pin this server with
+// remote.<name>.serverNpub ask it to sign a challenge before trusting it.
+function loadServerSecretKey() {
+  const value = process.env.MGIT_SERVER_NSEC;
+  if (!value) return null;
+  if (value.startsWith('nsec1')) {
+    return nip19.decode(value).data;
+  }
+  if (!/^[0-9a-f]{64}$/i.test(value)) {
+    throw new Error('MGIT_SERVER_NSEC must be an nsec or 64 hex characters');
+  }
+  return Uint8Array.from(Buffer.from(value, 'hex'));
+}
+const SERVER_SECRET_KEY = loadServerSecretKey();
+
+// Kind of the event proving the server's identity
+const KIND_SERVER_IDENTITY = 22243;
+
+// sha256// pin of a certificate's public key, as curl and mgit write them
+function certificatePin(der) {
+  const spki = new crypto.X509Certificate(der).publicKey.export({ type: 'spki', format: 'der' });
+  return 'sha256//' + crypto.createHash('sha256').update(spki).digest('base64');
+}
+
+// The pin of the certificate clients see, when a proxy terminates TLS in
+// front of this server: MGIT_SERVER_TLS_CERT names its PEM file
+const PROXY_CERTIFICATE_PIN = process.env.MGIT_SERVER_TLS_CERT
+  ? certificatePin(fs.readFileSync(process.env.MGIT_SERVER_TLS_CERT))
+  : null;
+
+// The pin of the certificate a request came in on: our own when we serve
+// TLS ourselves, the proxy's otherwise
+function servedCertificatePin(req) {
+  const own = typeof req.socket.getCertificate === 'function' && req.socket.getCertificate();
+  if (own && own.raw) {
+    return certificatePin(own.raw);
+  }
+  return PROXY_CERTIFICATE_PIN;
+}
+
 // Token expiration time in seconds (2 hrs)
 const TOKEN_EXPIRATION = 120 * 60;
 
@@ -411,6 +451,41 @@ function bech32ToHex(bech32Str) {
   return Buffer.from(bytes).toString('hex');
 }
 
+// Server identity: sign the client's challenge with the server's key, along
+// with the host it was asked for and the certificate key it was asked
+// over, so the answer can't be relayed through another server
+app.post('/api/mgit/server/identity', (req, res) => {
+  if (!SERVER_SECRET_KEY) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'This server has no nostr identity'
+    });
+  }
+
+  const { challenge } = req.body;
+  if (typeof challenge !== 'string' || !/^[0-9a-f]{64}$/.test(challenge)) {
+    return res.status(400).json({
+      status: 'error',
+      reason: 'Challenge must be 64 hex characters'
+    });
+  }
+
+  const tags = [['challenge', challenge], ['host', req.headers.host || '']];
+  const pin = servedCertificatePin(req);
+  if (pin) {
+    tags.push(['spki', pin]);
+  }
+
+  const event = finalizeEvent({
+    kind: KIND_SERVER_IDENTITY,
+    created_at: Math.floor(Date.now() / 1000),
+    tags,
+    content: ''
+  }, SERVER_SECRET_KEY);
+
+  res.json({ event });
+});
+
 // 1. Repository-specific challenge generation
 app.post('/api/mgit/auth/challenge', (req, res) => {
   const { repoId } = req.body;
@@ -577,6 +652,151 @@ app.get('/api/mgit/repos/:repoId/info', validateMGitToken, (req, res) => {
   });
 });
 
+// Push policy for a repository, which clients check before uploading:
+// { require_signed, allowed_pubkeys, protected_branches }, from the
+// repository's "policy" entry in repo-config.json
+app.get('/api/mgit/repos/:repoId/policy', validateMGitToken, (req, res) => {
+  const { repoId } = req.params;
+  const policy = (repoConfigurations[repoId] && repoConfigurations[repoId].policy) || {};
+
+  res.json({
+    require_signed: policy.require_signed === true,
+    allowed_pubkeys: Array.isArray(policy.allowed_pubkeys) ? policy.allowed_pubkeys : [],
+    protected_branches: Array.isArray(policy.protected_branches) ? policy.protected_branches : []
+  });
+});
+
+// Config a repository recommends to its clones, which `mgit clone
+// --recurse-config` applies: { config: { "<section>.<key>": "<value>" } },
+// from the repository's "recommended_config" entry in repo-config.json
+app.get('/api/mgit/repos/:repoId/recommended-config', validateMGitToken, (req, res) => {
+  const { repoId } = req.params;
+  const recommended = (repoConfigurations[repoId] && repoConfigurations[repoId].recommended_config) || {};
+
+  const config = {};
+  for (const [key, value] of Object.entries(recommended)) {
+    if (value !== null && typeof value !== 'object') {
+      config[key] = String(value);
+    }
+  }
+  res.json({ config });
+});
+
+// Bytes used under a path, not following symlinks, walked asynchronously
+// so a big repository doesn't hold up other requests
+async function diskUsage(target) {
+  let stat;
+  try {
+    stat = await fs.promises.lstat(target);
+  } catch (err) {
+    return 0;
+  }
+  if (!stat.isDirectory()) {
+    return stat.size;
+  }
+  const entries = await fs.promises.readdir(target);
+  const sizes = await Promise.all(entries.map(entry => diskUsage(path.join(target, entry))));
+  return sizes.reduce((total, size) => total + size, 0);
+}
+
+// How long a repository's measured disk usage is served before it is
+// measured again
+const REPO_USAGE_TTL = 60 * 1000;
+
+// The last disk usage measured of each repository, by path:
+// { usage, measuredAt, refreshing }
+const repoUsageCache = new Map();
+
+// Disk usage of a repository, with LFS objects (.git/lfs) apart from the
+// rest of .git
+async function measureRepoUsage(repoPath) {
+  const [size, gitSize, mgitSize, lfsSize] = await Promise.all([
+    diskUsage(repoPath),
+    diskUsage(path.join(repoPath, '.git')),
+    diskUsage(path.join(repoPath, '.mgit')),
+    diskUsage(path.join(repoPath, '.git', 'lfs'))
+  ]);
+  return { size, git_size: gitSize - lfsSize, mgit_size: mgitSize, lfs_size: lfsSize };
+}
+
+// The cached disk usage of a repository. Once it is older than
+// REPO_USAGE_TTL it is measured again in the background, while the old
+// figure is served; only the first request for a repository waits for it.
+function repoUsage(repoPath) {
+  let entry = repoUsageCache.get(repoPath);
+  if (!entry) {
+    entry = { usage: null, measuredAt: 0, refreshing: null };
+    repoUsageCache.set(repoPath, entry);
+  }
+  if (!entry.refreshing && Date.now() - entry.measuredAt > REPO_USAGE_TTL) {
+    entry.refreshing = measureRepoUsage(repoPath)
+      .then((usage) => {
+        entry.usage = usage;
+        entry.measuredAt = Date.now();
+        return usage;
+      })
+      .finally(() => {
+        entry.refreshing = null;
+      });
+    if (entry.usage) {
+      entry.refreshing.catch((err) => {
+        console.error(`Error measuring repository ${repoPath}: ${err.message}`);
+      });
+    }
+  }
+  return entry.usage ? Promise.resolve(entry.usage) : entry.refreshing;
+}
+
+// Has a repository's disk usage measured again at the next request, as a
+// push changed it
+function staleRepoUsage(repoPath) {
+  const entry = repoUsageCache.get(repoPath);
+  if (entry) {
+    entry.measuredAt = 0;
+  }
+}
+
+// A limit from the quota entry of repo-config.json, in bytes, or null
+function quotaLimit(value) {
+  return Number.isSafeInteger(value) && value > 0 ? value : null;
+}
+
+// Disk usage of a repository and the quota it is held to, which `mgit
+// quota` reports and `mgit push` checks before uploading: sizes in bytes,
+// with LFS objects (.git/lfs) counted apart from the rest of .git, and the
+// limits from the repository's "quota" entry in repo-config.json
+// ({ max_size, max_lfs_size, warn_percent }), null when unlimited. The
+// sizes come from repoUsage, so they can be up to REPO_USAGE_TTL old.
+app.get('/api/mgit/repos/:repoId/quota', validateMGitToken, async (req, res) => {
+  const { repoId } = req.params;
+  const repoPath = path.join(REPOS_PATH, repoId);
+  if (!fs.existsSync(repoPath)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+  }
+  const quota = (repoConfigurations[repoId] && repoConfigurations[repoId].quota) || {};
+
+  try {
+    const usage = await repoUsage(repoPath);
+    const warnPercent = quota.warn_percent;
+    res.json({
+      ...usage,
+      max_size: quotaLimit(quota.max_size),
+      max_lfs_size: quotaLimit(quota.max_lfs_size),
+      warn_percent: Number.isFinite(warnPercent) && warnPercent > 0 && warnPercent <= 100 ? warnPercent : 90
+    });
+  } catch (err) {
+    console.error(`Error measuring repository ${repoId}: ${err.message}`);
+    res.status(500).json({
+      status: 'error',
+      reason: 'Failed to measure repository',
+      details: err.message
+    });
+  }
+});
+
 // app.get('/api/mgit/repos/:repoId/git-upload-pack', validateMGitToken, (req, res) => {
 //   const { repoId } = req.params;
 //   const { pubkey, access } = req.user;
@@ -726,98 +946,117 @@ app.get('/api/mgit/repos/:repoId/info/refs', validateMGitToken, (req, res) => {
     }
   }
   
-  // Set appropriate headers
-  res.setHeader('Content-Type', `application/x-${service}-advertisement`);
-  res.setHeader('Cache-Control', 'no-cache');
-  
-  // Get repository path
-  const repoPath = path.join(REPOS_PATH, repoId);
-  
-  // Format the packet properly
+  // Format the packet properly, followed by a flush packet (0000)
   const serviceHeader = `# service=${service}\n`;
   const length = (serviceHeader.length + 4).toString(16).padStart(4, '0');
+  const preamble = length + serviceHeader + '0000';
   
-  // Write the packet
-  res.write(length + serviceHeader);
-  // Write the flush packet (0000)
-  res.write('0000');
-  
-  // Extract the command name from the service
-  const gitCommand = service.replace('git-', ''); // 'upload-pack' or 'receive-pack'
-  
-  // Log what we're doing
+  // mgit checks the access list and hides refs before advertising any
+  const command = service.replace('git-', ''); // 'upload-pack' or 'receive-pack'
   console.log(`Advertising refs for ${repoId} using ${service}`);
-  
-  // Run git command to advertise refs
+  runGitService(req, res, command, ['--advertise-refs'],
+    `application/x-${service}-advertisement`, preamble);
+});
+
+/*
+  Runs mgit upload-pack or receive-pack for a Git protocol request. mgit
+  applies the server's serve.* limits to both, and the repository's access
+  list and hidden refs to upload-pack. The response starts with the first
+  output, so a request mgit refuses gets an error status instead.
+*/
+function runGitService(req, res, service, extraArgs, contentType, preamble = '') {
+  const { repoId } = req.params;
+  const repoPath = path.join(REPOS_PATH, repoId);
+
+  if (!fs.existsSync(repoPath)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+  }
+
+  const mgitPath = `${process.env.MGITPATH}/mgit` || '../mgit/mgit';
   const { spawn } = require('child_process');
-  const process = spawn('git', [gitCommand, '--stateless-rpc', '--advertise-refs', repoPath]);
-  
-  // Pipe stdout to response
-  process.stdout.pipe(res);
-  
-  // Log any errors
-  process.stderr.on('data', (data) => {
-    console.error(`git ${gitCommand} stderr: ${data}`);
+  const zlib = require('zlib');
+  const args = [service, '--stateless-rpc', ...extraArgs];
+  if (req.user && req.user.pubkey) {
+    args.push('--pubkey', req.user.pubkey);
+  }
+  args.push(repoPath);
+  const child = spawn(mgitPath, args, { cwd: repoPath });
+
+  console.log(`mgit ${service} for ${repoId}`);
+
+  let input = req;
+  if ((req.headers['content-encoding'] || '').toLowerCase() === 'gzip') {
+    input = req.pipe(zlib.createGunzip());
+  }
+  input.on('error', (err) => {
+    console.error(`mgit ${service} request error: ${err.message}`);
+    child.kill();
   });
-  
-  process.on('error', (err) => {
-    console.error(`Error spawning git process: ${err}`);
+  // mgit may refuse the request without reading it
+  child.stdin.on('error', () => {});
+  input.pipe(child.stdin);
+
+  let stderr = '';
+  child.stderr.on('data', (data) => {
+    stderr += data.toString();
+    console.error(`mgit ${service} stderr: ${data.toString()}`);
+  });
+
+  child.stdout.once('data', (chunk) => {
+    res.setHeader('Content-Type', contentType);
+    res.setHeader('Cache-Control', 'no-cache');
+    res.write(preamble);
+    res.write(chunk);
+    child.stdout.pipe(res);
+  });
+
+  child.on('error', (err) => {
+    console.error(`mgit ${service} process error: ${err.message}`);
     if (!res.headersSent) {
       res.status(500).json({
         status: 'error',
-        reason: 'Error advertising refs',
+        reason: `Failed to execute mgit ${service}`,
         details: err.message
       });
     }
   });
-});
+
+  child.on('close', (code) => {
+    console.log(`mgit ${service} for ${repoId} exited with code ${code}`);
+    if (service === 'receive-pack') {
+      staleRepoUsage(repoPath);
+    }
+    if (res.headersSent) {
+      return;
+    }
+    if (code === 0) {
+      res.setHeader('Content-Type', contentType);
+      return res.end(preamble);
+    }
+    let status = 500;
+    if (/rate limit/.test(stderr)) {
+      status = 429;
+    } else if (/may not read|requires an authenticated pubkey|access denied|outside uploadpack.root/.test(stderr)) {
+      status = 403;
+    }
+    res.status(status).json({
+      status: 'error',
+      reason: stderr.trim().replace(/^Error: /, '') || `mgit ${service} failed`
+    });
+  });
+}
 
 // Git protocol endpoint for git-upload-pack (needed for clone)
 // data transfer phase
 app.post('/api/mgit/repos/:repoId/git-upload-pack', validateMGitToken, (req, res) => {
-  const { repoId } = req.params;
-  
-  // Get repository path
-  const repoPath = path.join(REPOS_PATH, repoId);
-  
-  // Set content type for git response
-  res.setHeader('Content-Type', 'application/x-git-upload-pack-result');
-  
-  // Spawn git upload-pack process
-  const { spawn } = require('child_process');
-  const process = spawn('git', ['upload-pack', '--stateless-rpc', repoPath]);
-  
-  // Add better logging
-  console.log(`POST git-upload-pack for ${repoId}`);
-  
-  // Pipe the request body to git's stdin
-  req.pipe(process.stdin);
-  
-  // Pipe git's stdout to the response
-  process.stdout.pipe(res);
-  
-  // Log stderr
-  process.stderr.on('data', (data) => {
-    console.error(`git-upload-pack stderr: ${data.toString()}`);
-  });
-  
-  // Handle errors
-  process.on('error', (err) => {
-    console.error(`git-upload-pack process error: ${err.message}`);
-    if (!res.headersSent) {
-      res.status(500).send('Git error');
-    }
-  });
-  
-  // Handle process exit
-  process.on('exit', (code) => {
-    console.log(`git-upload-pack process exited with code ${code}`);
-  });
+  runGitService(req, res, 'upload-pack', [], 'application/x-git-upload-pack-result');
 });
 
 // Git protocol endpoint for git-receive-pack (needed for push)
 app.post('/api/mgit/repos/:repoId/git-receive-pack', validateMGitToken, (req, res) => {
-  const { repoId } = req.params;
   const { access } = req.user;
   
   // Check write permissions
@@ -827,70 +1066,65 @@ app.post('/api/mgit/repos/:repoId/git-receive-pack', validateMGitToken, (req, re
       reason: 'Insufficient permissions to push to repository' 
     });
   }
-  
-  // Get repository path
-  const repoPath = path.join(REPOS_PATH, repoId);
-  
-  // Check if the repository exists
-  if (!fs.existsSync(repoPath)) {
-    return res.status(404).json({ 
-      status: 'error', 
-      reason: 'Repository not found' 
+
+  runGitService(req, res, 'receive-pack', [], 'application/x-git-receive-pack-result');
+});
+
+/*
+ * Passes each mapping of a mapping file to fn as the file is read, cutting
+ * the JSON array into its objects so the file is never held whole.
+ */
+function streamMappings(file, fn) {
+  return new Promise((resolve, reject) => {
+    const input = fs.createReadStream(file, { encoding: 'utf8' });
+    let depth = 0;
+    let inString = false;
+    let escaped = false;
+    let partial = '';
+    input.on('data', (chunk) => {
+      let start = depth > 0 ? 0 : -1;
+      try {
+        for (let i = 0; i < chunk.length; i++) {
+          const c = chunk[i];
+          if (inString) {
+            if (escaped) {
+              escaped = false;
+            } else if (c === '\\') {
+              escaped = true;
+            } else if (c === '"') {
+              inString = false;
+            }
+          } else if (c === '"') {
+            inString = true;
+          } else if (c === '{') {
+            if (depth++ === 0) {
+              start = i;
+            }
+          } else if (c === '}' && --depth === 0) {
+            fn(JSON.parse(partial + chunk.slice(start, i + 1)));
+            partial = '';
+          }
+        }
+      } catch (err) {
+        input.destroy();
+        return reject(err);
+      }
+      if (depth > 0) {
+        partial += chunk.slice(start);
+      }
     });
-  }
-  
-  // Set content type for git response
-  res.setHeader('Content-Type', 'application/x-git-receive-pack-result');
-  
-  // Spawn git receive-pack process
-  const { spawn } = require('child_process');
-  const process = spawn('git', ['receive-pack', '--stateless-rpc', repoPath]);
-  
-  // Add better logging
-  console.log(`POST git-receive-pack for ${repoId}`);
-  
-  // Pipe the request body to git's stdin
-  req.pipe(process.stdin);
-  
-  // Pipe git's stdout to the response
-  process.stdout.pipe(res);
-  
-  // Log stderr
-  process.stderr.on('data', (data) => {
-    console.error(`git-receive-pack stderr: ${data.toString()}`);
-  });
-  
-  // Handle errors
-  process.on('error', (err) => {
-    console.error(`git-receive-pack process error: ${err.message}`);
-    if (!res.headersSent) {
-      res.status(500).json({
-        status: 'error',
-        reason: 'Git error',
-        details: err.message
-      });
-    }
-  });
-  
-  // Handle process exit
-  process.on('exit', (code) => {
-    console.log(`git-receive-pack process exited with code ${code}`);
-    
-    // If we wanted to extend this to handle MGit metadata, we would do it here
-    // after the git process completes successfully
-    if (code === 0) {
-      console.log(`Successfully processed push for repository ${repoId}`);
-      
-      // In the future, you might want to add code here to:
-      // 1. Extract commit info from the pushed data
-      // 2. Update nostr_mappings.json
-      // 3. Perform any other MGit-specific operations
-    }
+    input.on('end', () => {
+      if (depth > 0 || inString) {
+        return reject(new Error('unexpected end of the mappings file'));
+      }
+      resolve();
+    });
+    input.on('error', reject);
   });
-});
+}
 
 // Endpoint to get MGit-specific metadata (e.g., nostr mappings)
-app.get('/api/mgit/repos/:repoId/metadata', validateMGitToken, (req, res) => {
+app.get('/api/mgit/repos/:repoId/metadata', validateMGitToken, async (req, res) => {
   const { repoId } = req.params;
   const { access } = req.user;
   
@@ -947,16 +1181,62 @@ app.get('/api/mgit/repos/:repoId/metadata', validateMGitToken, (req, res) => {
     console.log(`Created empty mappings file at ${mappingsPath}`);
   }
   
+  // A shallow clone (mgit clone --depth) or a repository with sparse
+  // metadata asks only for the mappings of the history it has:
+  // ?branch=<name> or ?commit=<git hash> (every branch without either),
+  // and ?depth=<n>
+  let shallow = null;
+  const { depth, branch, commit } = req.query;
+  if (depth !== undefined || branch !== undefined || commit !== undefined) {
+    const limit = depth === undefined ? Infinity : Number(depth);
+    if (depth !== undefined && (!Number.isInteger(limit) || limit < 1)) {
+      return res.status(400).json({
+        status: 'error',
+        reason: 'depth must be a positive integer'
+      });
+    }
+    if (commit !== undefined && !/^[0-9a-f]{40}$/.test(commit)) {
+      return res.status(400).json({
+        status: 'error',
+        reason: 'commit must be a full Git hash'
+      });
+    }
+    const tip = commit || (branch !== undefined ? `refs/heads/${branch}` : null);
+    try {
+      shallow = shallowHistory(repoPath, limit, tip);
+    } catch (err) {
+      return res.status(404).json({
+        status: 'error',
+        reason: `Unknown branch or commit ${commit || branch}`
+      });
+    }
+  }
+
   // Read the mappings file
   try {
-    const mappingsData = fs.readFileSync(mappingsPath, 'utf8');
-    
-    // Set content type and send the mappings data
-    res.setHeader('Content-Type', 'application/json');
-    res.send(mappingsData);
+    if (shallow) {
+      // Only the mappings of the history asked for are kept, the last one
+      // of a Git hash winning as in mgit's mapping store
+      const wanted = new Map();
+      await streamMappings(mappingsPath, (mapping) => {
+        if (shallow.has(mapping.git_hash)) {
+          wanted.set(mapping.git_hash, mapping);
+        }
+      });
+      res.setHeader('Content-Type', 'application/json');
+      res.send(JSON.stringify([...wanted.values()]));
+    } else {
+      res.setHeader('Content-Type', 'application/json');
+      await new Promise((resolve, reject) => {
+        fs.createReadStream(mappingsPath).on('error', reject).on('end', resolve).pipe(res);
+      });
+    }
     console.log(`Successfully served mappings from ${mappingsPath}`);
   } catch (err) {
     console.error(`Error reading nostr mappings: ${err.message}`);
+    if (res.headersSent) {
+      return res.end();
+    }
     res.status(500).json({ 
       status: 'error', 
       reason: 'Failed to read MGit metadata',
@@ -965,6 +1245,573 @@ app.get('/api/mgit/repos/:repoId/metadata', validateMGitToken, (req, res) => {
   }
 });
 
+/*
+ * Returns the Git hashes of the commits at most depth commits deep from a
+ * tip, or from every branch, as git clone --depth fetches them. depth may
+ * be Infinity. Throws if the tip doesn't exist.
+ */
+function shallowHistory(repoPath, depth, tip) {
+  const { execFileSync } = require('child_process');
+  const tips = tip ? [tip] : ['--branches'];
+  const output = execFileSync('git', ['rev-list', '--parents', ...tips],
+    { cwd: repoPath, encoding: 'utf8', maxBuffer: 256 * 1024 * 1024 });
+
+  const parents = new Map();
+  for (const line of output.split('\n')) {
+    const [commit, ...rest] = line.split(' ');
+    if (commit) parents.set(commit, rest);
+  }
+  const tipHashes = execFileSync('git', ['rev-parse', ...tips],
+    { cwd: repoPath, encoding: 'utf8' }).split('\n').filter(Boolean);
+
+  // Walk breadth first, so a commit gets the shortest depth it has
+  const seen = new Set(tipHashes);
+  let level = tipHashes;
+  for (let i = 1; i < depth && level.length > 0; i++) {
+    const next = [];
+    for (const commit of level) {
+      for (const parent of parents.get(commit) || []) {
+        if (!seen.has(parent)) {
+          seen.add(parent);
+          next.push(parent);
+        }
+      }
+    }
+    level = next;
+  }
+  return seen;
+}
+
+/*
+ * Looks up the mapping of a single Git commit, for clients whose local
+ * metadata is missing it (mgit verify --lookup-mappings). 404 means the
+ * server doesn't know the commit either.
+ */
+app.get('/api/mgit/repos/:repoId/mappings/:gitHash', validateMGitToken, (req, res) => {
+  const { repoId, gitHash } = req.params;
+  const { access } = req.user;
+
+  if (access !== 'admin' && access !== 'read-write' && access !== 'read-only') {
+    return res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to access repository'
+    });
+  }
+
+  if (!/^[0-9a-f]{40}$/.test(gitHash)) {
+    return res.status(400).json({
+      status: 'error',
+      reason: 'Invalid Git hash'
+    });
+  }
+
+  const repoPath = path.join(REPOS_PATH, repoId);
+  if (!fs.existsSync(repoPath)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+  }
+
+  const mappingsPath = [
+    path.join(repoPath, '.mgit', 'mappings', 'hash_mappings.json'),
+    path.join(repoPath, '.mgit', 'nostr_mappings.json')
+  ].find(p => fs.existsSync(p));
+
+  try {
+    const mappings = mappingsPath ? JSON.parse(fs.readFileSync(mappingsPath, 'utf8')) : [];
+    // Prefer the current mapping over ones superseded by a rewrite, and a
+    // mapping appended later over an earlier one
+    const matches = mappings.filter(m => m.git_hash === gitHash).reverse();
+    const mapping = matches.find(m => !m.superseded_by) || matches[0];
+    if (!mapping) {
+      return res.status(404).json({
+        status: 'error',
+        reason: 'No mapping for commit'
+      });
+    }
+    res.json(mapping);
+  } catch (err) {
+    console.error(`Error reading mappings: ${err.message}`);
+    res.status(500).json({
+      status: 'error',
+      reason: 'Failed to read MGit metadata',
+      details: err.message
+    });
+  }
+});
+
+/*
+ * Stashes sent with mgit stash push --remote, kept per pubkey until mgit
+ * stash fetch moves them to another clone. They are encrypted by the
+ * client, so the server only stores opaque bytes.
+ */
+const stashIdPattern = /^[0-9a-f]{40}$/;
+
+function stashDir(req) {
+  return path.join(REPOS_PATH, req.params.repoId, '.mgit', 'stashes', req.user.pubkey);
+}
+
+function checkStashRequest(req, res, write) {
+  const { access } = req.user;
+  const allowed = write ? ['admin', 'read-write'] : ['admin', 'read-write', 'read-only'];
+  if (!allowed.includes(access)) {
+    res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to access repository'
+    });
+    return false;
+  }
+  if (!fs.existsSync(path.join(REPOS_PATH, req.params.repoId))) {
+    res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+    return false;
+  }
+  if (req.params.stashId !== undefined && !stashIdPattern.test(req.params.stashId)) {
+    res.status(400).json({
+      status: 'error',
+      reason: 'Invalid stash id'
+    });
+    return false;
+  }
+  return true;
+}
+
+app.get('/api/mgit/repos/:repoId/stashes', validateMGitToken, (req, res) => {
+  if (!checkStashRequest(req, res, false)) return;
+  const dir = stashDir(req);
+  const ids = fs.existsSync(dir) ? fs.readdirSync(dir).filter(name => stashIdPattern.test(name)) : [];
+  res.json(ids);
+});
+
+app.put('/api/mgit/repos/:repoId/stashes/:stashId', validateMGitToken,
+  express.raw({ type: 'application/octet-stream', limit: '100mb' }), (req, res) => {
+  if (!checkStashRequest(req, res, true)) return;
+  try {
+    const dir = stashDir(req);
+    fs.mkdirSync(dir, { recursive: true });
+    fs.writeFileSync(path.join(dir, req.params.stashId), req.body);
+    res.status(201).json({ status: 'OK' });
+  } catch (err) {
+    console.error(`Error storing stash: ${err.message}`);
+    res.status(500).json({
+      status: 'error',
+      reason: 'Failed to store stash',
+      details: err.message
+    });
+  }
+});
+
+app.get('/api/mgit/repos/:repoId/stashes/:stashId', validateMGitToken, (req, res) => {
+  if (!checkStashRequest(req, res, false)) return;
+  const file = path.join(stashDir(req), req.params.stashId);
+  if (!fs.existsSync(file)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Stash not found'
+    });
+  }
+  res.setHeader('Content-Type', 'application/octet-stream');
+  res.send(fs.readFileSync(file));
+});
+
+app.delete('/api/mgit/repos/:repoId/stashes/:stashId', validateMGitToken, (req, res) => {
+  if (!checkStashRequest(req, res, true)) return;
+  const file = path.join(stashDir(req), req.params.stashId);
+  if (fs.existsSync(file)) {
+    fs.unlinkSync(file);
+  }
+  res.status(204).end();
+});
+
+/*
+ * Branch summaries sent by mgit after a push: the branch's head, commit
+ * count, contributors and last activity, so repository listings needn't
+ * walk the history. One file per branch in .mgit/summaries. A summary is
+ * only taken if its Git head is where the branch is on the server.
+ */
+const summaryHashPattern = /^[0-9a-f]{40}$/;
+
+function summaryPath(repoPath, branch) {
+  return path.join(repoPath, '.mgit', 'summaries', encodeURIComponent(branch) + '.json');
+}
+
+function readSummaries(repoPath) {
+  const dir = path.join(repoPath, '.mgit', 'summaries');
+  if (!fs.existsSync(dir)) return [];
+  return fs.readdirSync(dir)
+    .filter(name => name.endsWith('.json'))
+    .map(name => {
+      try {
+        return JSON.parse(fs.readFileSync(path.join(dir, name), 'utf8'));
+      } catch (err) {
+        console.error(`Skipping unreadable summary ${name}: ${err.message}`);
+        return null;
+      }
+    })
+    .filter(summary => summary !== null);
+}
+
+function checkSummaryRequest(req, res, write) {
+  const { access } = req.user;
+  const allowed = write ? ['admin', 'read-write'] : ['admin', 'read-write', 'read-only'];
+  if (!allowed.includes(access)) {
+    res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to access repository'
+    });
+    return false;
+  }
+  if (!fs.existsSync(path.join(REPOS_PATH, req.params.repoId))) {
+    res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+    return false;
+  }
+  return true;
+}
+
+app.get('/api/mgit/repos/:repoId/summaries', validateMGitToken, (req, res) => {
+  if (!checkSummaryRequest(req, res, false)) return;
+  res.json(readSummaries(path.join(REPOS_PATH, req.params.repoId)));
+});
+
+app.put('/api/mgit/repos/:repoId/summaries/:branch', validateMGitToken, (req, res) => {
+  if (!checkSummaryRequest(req, res, true)) return;
+  const { branch } = req.params;
+  const summary = req.body || {};
+  if (summary.branch !== branch || !summaryHashPattern.test(summary.head) ||
+      !summaryHashPattern.test(summary.git_head) || !Number.isInteger(summary.commits) ||
+      !Array.isArray(summary.contributors)) {
+    return res.status(400).json({
+      status: 'error',
+      reason: 'Invalid branch summary'
+    });
+  }
+
+  const repoPath = path.join(REPOS_PATH, req.params.repoId);
+  const { execFileSync } = require('child_process');
+  let tip = '';
+  try {
+    tip = execFileSync('git', ['rev-parse', '--verify', '--quiet', `refs/heads/${branch}`],
+      { cwd: repoPath, encoding: 'utf8' }).trim();
+  } catch (err) {
+    // No such branch
+  }
+  if (tip !== summary.git_head) {
+    return res.status(409).json({
+      status: 'error',
+      reason: `Branch ${branch} is not at ${summary.git_head}`
+    });
+  }
+
+  try {
+    const file = summaryPath(repoPath, branch);
+    fs.mkdirSync(path.dirname(file), { recursive: true });
+    fs.writeFileSync(file, JSON.stringify(summary, null, 2));
+    res.status(201).json({ status: 'OK' });
+  } catch (err) {
+    console.error(`Error storing branch summary: ${err.message}`);
+    res.status(500).json({
+      status: 'error',
+      reason: 'Failed to store branch summary',
+      details: err.message
+    });
+  }
+});
+
+/*
+ * MGit object transfer: clients offer the hashes of the MGit objects they
+ * have and only the missing objects move, as delta-compressed packs. The
+ * work is done by mgit pack-objects and unpack-objects in the repository.
+ * Request bodies are piped to mgit as they arrive (gunzipped if needed), so
+ * they use their own content types rather than going through express.json.
+ * A finished chunked upload is piped from its file instead.
+ */
+function runMGitObjectCommand(req, res, args, contentType, input = null, onSuccess = null) {
+  const { repoId } = req.params;
+  const repoPath = path.join(REPOS_PATH, repoId);
+
+  if (!fs.existsSync(repoPath)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+  }
+
+  const mgitPath = `${process.env.MGITPATH}/mgit` || '../mgit/mgit';
+  const { spawn } = require('child_process');
+  const zlib = require('zlib');
+  // The requester's pubkey lets mgit apply its per-client serve.* limits
+  if (req.user && req.user.pubkey) {
+    args = [...args, '--pubkey', req.user.pubkey];
+  }
+  const child = spawn(mgitPath, args, { cwd: repoPath });
+
+  console.log(`POST mgit ${args.join(' ')} for ${repoId}`);
+
+  if (!input) {
+    input = req;
+    if ((req.headers['content-encoding'] || '').toLowerCase() === 'gzip') {
+      input = req.pipe(zlib.createGunzip());
+    }
+  }
+  input.on('error', (err) => {
+    console.error(`mgit ${args[0]} request error: ${err.message}`);
+    child.kill();
+  });
+  input.pipe(child.stdin);
+
+  // Buffer the output so a failure can still be reported with a status
+  const chunks = [];
+  child.stdout.on('data', (chunk) => chunks.push(chunk));
+  child.stderr.on('data', (data) => {
+    console.error(`mgit ${args[0]} stderr: ${data.toString()}`);
+  });
+
+  child.on('error', (err) => {
+    console.error(`mgit ${args[0]} process error: ${err.message}`);
+    if (!res.headersSent) {
+      res.status(500).json({
+        status: 'error',
+        reason: `Failed to execute mgit ${args[0]}`,
+        details: err.message
+      });
+    }
+  });
+
+  child.on('close', (code) => {
+    if (res.headersSent) {
+      return;
+    }
+    const output = Buffer.concat(chunks);
+    if (code !== 0) {
+      return res.status(500).json({
+        status: 'error',
+        reason: `mgit ${args[0]} failed`,
+        details: output.toString()
+      });
+    }
+    if (onSuccess) {
+      onSuccess();
+    }
+    res.setHeader('Content-Type', contentType);
+    res.send(output);
+  });
+}
+
+// Tells a pushing client which of the objects it has the server wants
+app.post('/api/mgit/repos/:repoId/objects/negotiate', validateMGitToken, (req, res) => {
+  const { access } = req.user;
+
+  if (access !== 'admin' && access !== 'read-write') {
+    return res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to push to repository'
+    });
+  }
+
+  runMGitObjectCommand(req, res, ['pack-objects', '--negotiate'], 'application/json');
+});
+
+// Receives a pack of the objects the server wanted
+app.post('/api/mgit/repos/:repoId/objects/pack', validateMGitToken, (req, res) => {
+  const { access } = req.user;
+
+  if (access !== 'admin' && access !== 'read-write') {
+    return res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to push to repository'
+    });
+  }
+
+  runMGitObjectCommand(req, res, ['unpack-objects'], 'text/plain');
+});
+
+/*
+ * Resumable pack uploads, for packs too big to risk in one request. The
+ * client names an upload by the SHA-256 of the gzipped pack and sends it in
+ * Content-Range chunks; a rerun of the same push finds the partial upload
+ * and carries on from its offset. Uploads are kept per pubkey under
+ * .mgit/uploads until completed.
+ */
+const uploadIdPattern = /^[0-9a-f]{64}$/;
+
+function uploadPath(req, uploadId) {
+  return path.join(REPOS_PATH, req.params.repoId, '.mgit', 'uploads', req.user.pubkey, uploadId);
+}
+
+// Checks push access and the upload id, and returns the upload's file
+function checkUploadRequest(req, res, uploadId) {
+  const { access } = req.user;
+  if (access !== 'admin' && access !== 'read-write') {
+    res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to push to repository'
+    });
+    return null;
+  }
+  if (!fs.existsSync(path.join(REPOS_PATH, req.params.repoId))) {
+    res.status(404).json({
+      status: 'error',
+      reason: 'Repository not found'
+    });
+    return null;
+  }
+  if (!uploadIdPattern.test(uploadId || '')) {
+    res.status(400).json({
+      status: 'error',
+      reason: 'Invalid upload id'
+    });
+    return null;
+  }
+  return uploadPath(req, uploadId);
+}
+
+// The length an upload was started with is kept next to it
+function uploadOffset(file) {
+  return fs.existsSync(file) ? fs.statSync(file).size : 0;
+}
+
+function uploadLength(file) {
+  return parseInt(fs.readFileSync(`${file}.length`, 'utf8'), 10);
+}
+
+// Starts an upload, or reports how far an earlier one with the same id got
+app.post('/api/mgit/repos/:repoId/objects/uploads', validateMGitToken, (req, res) => {
+  const { sha256, length } = req.body || {};
+  const file = checkUploadRequest(req, res, sha256);
+  if (!file) return;
+  if (!Number.isSafeInteger(length) || length <= 0) {
+    return res.status(400).json({
+      status: 'error',
+      reason: 'Invalid upload length'
+    });
+  }
+
+  try {
+    if (fs.existsSync(`${file}.length`) && uploadLength(file) === length) {
+      return res.json({ id: sha256, offset: uploadOffset(file) });
+    }
+    fs.mkdirSync(path.dirname(file), { recursive: true });
+    fs.writeFileSync(file, '');
+    fs.writeFileSync(`${file}.length`, String(length));
+    res.status(201).json({ id: sha256, offset: 0 });
+  } catch (err) {
+    console.error(`Error starting upload: ${err.message}`);
+    res.status(500).json({
+      status: 'error',
+      reason: 'Failed to start upload',
+      details: err.message
+    });
+  }
+});
+
+app.get('/api/mgit/repos/:repoId/objects/uploads/:uploadId', validateMGitToken, (req, res) => {
+  const file = checkUploadRequest(req, res, req.params.uploadId);
+  if (!file) return;
+  if (!fs.existsSync(`${file}.length`)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Upload not found'
+    });
+  }
+  res.json({ offset: uploadOffset(file) });
+});
+
+// Appends a chunk. A chunk that doesn't start where the upload is gets a
+// 409 with the upload's offset, so the client can carry on from there.
+app.put('/api/mgit/repos/:repoId/objects/uploads/:uploadId', validateMGitToken,
+  express.raw({ type: 'application/octet-stream', limit: '64mb' }), (req, res) => {
+  const file = checkUploadRequest(req, res, req.params.uploadId);
+  if (!file) return;
+  if (!fs.existsSync(`${file}.length`)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Upload not found'
+    });
+  }
+
+  const range = /^bytes (\d+)-(\d+)\/(\d+)$/.exec(req.headers['content-range'] || '');
+  const length = uploadLength(file);
+  if (!range || Number(range[3]) !== length || Number(range[2]) - Number(range[1]) + 1 !== req.body.length ||
+      Number(range[2]) >= length) {
+    return res.status(400).json({
+      status: 'error',
+      reason: 'Invalid Content-Range'
+    });
+  }
+
+  const offset = uploadOffset(file);
+  if (Number(range[1]) !== offset) {
+    return res.status(409).json({ offset });
+  }
+  try {
+    fs.appendFileSync(file, req.body);
+    res.json({ offset: offset + req.body.length });
+  } catch (err) {
+    console.error(`Error storing upload chunk: ${err.message}`);
+    res.status(500).json({
+      status: 'error',
+      reason: 'Failed to store upload chunk',
+      details: err.message
+    });
+  }
+});
+
+// Checks a finished upload against its id and unpacks it
+app.post('/api/mgit/repos/:repoId/objects/uploads/:uploadId/complete', validateMGitToken, (req, res) => {
+  const file = checkUploadRequest(req, res, req.params.uploadId);
+  if (!file) return;
+  if (!fs.existsSync(`${file}.length`)) {
+    return res.status(404).json({
+      status: 'error',
+      reason: 'Upload not found'
+    });
+  }
+  if (uploadOffset(file) !== uploadLength(file)) {
+    return res.status(409).json({
+      status: 'error',
+      reason: 'Upload is incomplete',
+      offset: uploadOffset(file)
+    });
+  }
+
+  const removeUpload = () => {
+    fs.rmSync(file, { force: true });
+    fs.rmSync(`${file}.length`, { force: true });
+  };
+  const digest = crypto.createHash('sha256').update(fs.readFileSync(file)).digest('hex');
+  if (digest !== req.params.uploadId) {
+    removeUpload();
+    return res.status(422).json({
+      status: 'error',
+      reason: 'Upload does not match its SHA-256; push again'
+    });
+  }
+
+  const zlib = require('zlib');
+  const input = fs.createReadStream(file).pipe(zlib.createGunzip());
+  runMGitObjectCommand(req, res, ['unpack-objects'], 'text/plain', input, removeUpload);
+});
+
+// Sends a fetching client a pack of the objects it doesn't have
+app.post('/api/mgit/repos/:repoId/objects/fetch', validateMGitToken, (req, res) => {
+  const { access } = req.user;
+
+  if (access !== 'admin' && access !== 'read-write' && access !== 'read-only') {
+    return res.status(403).json({
+      status: 'error',
+      reason: 'Insufficient permissions to access repository'
+    });
+  }
+
+  runMGitObjectCommand(req, res, ['pack-objects'], 'application/x-mgit-pack');
+});
+
 // helper fns moved to mgitUtils
 
 // Express static file serving for the React frontend ONLY
@@ -987,4 +1834,7 @@ app.listen(PORT, async () => {
   await ensureUsersDirectory();
   console.log(`Server running on port ${PORT}`);
   console.log(`Access the application at http://localhost:${PORT}`);
+  if (SERVER_SECRET_KEY) {
+    console.log(`Server identity: ${nip19.npubEncode(getPublicKey(SERVER_SECRET_KEY))}`);
+  }
 });
\ No newline at end of file